@@ -0,0 +1,743 @@
+package caddyrl
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func init() {
+	caddy.RegisterModule(adminAPI{})
+}
+
+// adminAPI is a module that provides the /rate_limit/ endpoints
+// for the Caddy admin API. This allows for inspecting and
+// modifying rate limit state at runtime without reloading
+// the config.
+type adminAPI struct{}
+
+// CaddyModule returns the Caddy module information.
+func (adminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.rate_limit",
+		New: func() caddy.Module { return new(adminAPI) },
+	}
+}
+
+// Routes returns the routes for the /rate_limit/ endpoints.
+func (adminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: adminZonesPrefix,
+			Handler: caddy.AdminHandlerFunc(handleZones),
+		},
+		{
+			Pattern: adminClampPath,
+			Handler: caddy.AdminHandlerFunc(handleClampAll),
+		},
+		{
+			Pattern: adminEventsPath,
+			Handler: caddy.AdminHandlerFunc(handleEventStream),
+		},
+		{
+			Pattern: adminDashboardPath,
+			Handler: caddy.AdminHandlerFunc(handleDashboard),
+		},
+		{
+			Pattern: adminClusterPath,
+			Handler: caddy.AdminHandlerFunc(handleCluster),
+		},
+		{
+			Pattern: adminDebugVarsPath,
+			Handler: caddy.AdminHandlerFunc(handleDebugVars),
+		},
+	}
+}
+
+// handleZones dispatches requests for a single zone. The path
+// is of the form /rate_limit/zones/{zone}[/...], where each
+// segment is path-escaped so that zone names and keys may
+// contain slashes.
+func handleZones(w http.ResponseWriter, r *http.Request) error {
+	segments, err := adminPathSegments(r, adminZonesPrefix)
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        err,
+		}
+	}
+	if len(segments) == 0 || segments[0] == "" {
+		if r.Method == http.MethodGet {
+			return handleZoneList(w, r)
+		}
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("zone name is required"),
+		}
+	}
+
+	zoneName := segments[0]
+	rlm, ok := zoneLimiters(zoneName)
+	if !ok {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("unknown zone: %s", zoneName),
+		}
+	}
+
+	switch {
+	case len(segments) == 1:
+		return handleZone(w, r, rlm, zoneName)
+	case len(segments) == 2 && segments[1] == "keys":
+		return handleKeys(w, r, rlm, zoneName)
+	case len(segments) == 3 && segments[1] == "keys" && segments[2] != "":
+		return handleKey(w, r, rlm, zoneName, segments[2])
+	case len(segments) == 4 && segments[1] == "keys" && segments[2] != "" && segments[3] == "refund":
+		return handleRefund(w, r, rlm, segments[2])
+	case len(segments) == 4 && segments[1] == "keys" && segments[2] != "" && segments[3] == "allow":
+		return handleAllow(w, r, rlm, segments[2])
+	case len(segments) == 4 && segments[1] == "keys" && segments[2] != "" && segments[3] == "usage":
+		return handleUsage(w, r, rlm, segments[2])
+	case len(segments) == 2 && segments[1] == "check":
+		return handleCheck(w, r, rlm)
+	case len(segments) == 2 && segments[1] == "bans":
+		return handleBans(w, r, rlm, zoneName)
+	case len(segments) == 3 && segments[1] == "bans" && segments[2] != "":
+		return handleBan(w, r, rlm, zoneName, segments[2])
+	case len(segments) == 2 && segments[1] == "suggestion":
+		return handleSuggestion(w, r, rlm, zoneName)
+	case len(segments) == 2 && segments[1] == "clamp":
+		return handleClamp(w, r, map[string]*rateLimitersMap{zoneName: rlm})
+	}
+
+	return caddy.APIError{
+		HTTPStatus: http.StatusNotFound,
+		Err:        fmt.Errorf("resource not found: %s", r.URL.Path),
+	}
+}
+
+// handleZone handles requests for a whole zone.
+//
+// Deleting a zone forgets the state of all of its keys on this
+// instance; like resetting a single key, it does not clear counts
+// that peers have written to storage.
+//
+// Patching a zone changes its limits until the next config reload,
+// which restores the configured values.
+func handleZone(w http.ResponseWriter, r *http.Request, rlm *rateLimitersMap, zoneName string) error {
+	switch r.Method {
+	case http.MethodGet:
+		return writeAdminJSON(w, newZoneStatus(zoneName, rlm))
+
+	case http.MethodDelete:
+		rlm.reset()
+		w.WriteHeader(http.StatusOK)
+		return nil
+
+	case http.MethodPatch:
+		var patch zoneLimitsPatch
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("decoding request body: %v", err),
+			}
+		}
+
+		oldMaxEvents, oldWindow := rlm.limits()
+		maxEvents, window := oldMaxEvents, oldWindow
+		if patch.MaxEvents != nil {
+			maxEvents = *patch.MaxEvents
+		}
+		if patch.Window != nil {
+			window = time.Duration(*patch.Window)
+		}
+		if window <= 0 {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("window must be greater than zero"),
+			}
+		}
+		if maxEvents < 0 {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("max_events must be at least zero"),
+			}
+		}
+
+		rlm.updateAll(maxEvents, window)
+		updateConfigMetric(zoneName, oldMaxEvents, oldWindow, maxEvents, window)
+
+		return writeAdminJSON(w, newZoneStatus(zoneName, rlm))
+
+	default:
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+}
+
+// handleKeys handles requests for the keys of a zone: it lists them
+// (see handleKeyPages), or resets all keys that start with the prefix
+// given in the query string, e.g. the addresses of a subnet or the keys
+// of a customer, at once. Like deleting a single key, resetting only
+// changes this instance's state.
+func handleKeys(w http.ResponseWriter, r *http.Request, rlm *rateLimitersMap, zoneName string) error {
+	switch r.Method {
+	case http.MethodGet:
+		return handleKeyPages(w, r, rlm)
+
+	case http.MethodDelete:
+		prefix, err := adminKeyPrefix(r)
+		if err != nil {
+			return err
+		}
+		var reset int
+		for _, key := range rlm.keysWithPrefix(prefix) {
+			if rlm.delete(key) {
+				reset++
+			}
+		}
+		return writeAdminJSON(w, prefixResult{Zone: zoneName, Prefix: prefix, Keys: reset})
+
+	default:
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+}
+
+// adminKeyPrefix returns the prefix query parameter of a request for
+// many keys at once, which must not be empty so that a request without
+// it doesn't act on every key.
+func adminKeyPrefix(r *http.Request) (string, error) {
+	prefix := r.URL.Query().Get("prefix")
+	if prefix == "" {
+		return "", caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("prefix query parameter is required"),
+		}
+	}
+	return prefix, nil
+}
+
+// handleKey handles requests for a single key in a zone.
+//
+// Deleting a key only resets this instance's state for it. With
+// distributed rate limiting, counts that peers have already written
+// to storage still apply, so the client may remain limited until
+// those events fall out of the window.
+func handleKey(w http.ResponseWriter, r *http.Request, rlm *rateLimitersMap, zoneName, key string) error {
+	switch r.Method {
+	case http.MethodDelete:
+		// forget the key's state so the client can make requests again
+		if !rlm.delete(key) {
+			return caddy.APIError{
+				HTTPStatus: http.StatusNotFound,
+				Err:        fmt.Errorf("unknown key in zone %s: %s", zoneName, key),
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+		return nil
+
+	default:
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+}
+
+// handleRefund credits events back to a key, e.g. because an operation
+// that was charged for was rolled back. Only this instance's state is
+// changed.
+func handleRefund(w http.ResponseWriter, r *http.Request, rlm *rateLimitersMap, key string) error {
+	if r.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	var req refundRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("decoding request body: %v", err),
+		}
+	}
+	if req.Events < 1 {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("events must be at least 1"),
+		}
+	}
+
+	refunded, err := rlm.refund(key, req.Events)
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        err,
+		}
+	}
+	_, remaining, _ := rlm.peek(key)
+	return writeAdminJSON(w, refundResult{Key: key, Refunded: refunded, Remaining: remaining})
+}
+
+// handleAllow decides whether the cost given in the body, 1 by default,
+// of events of a key are allowed, and counts them if so, like the Go
+// API's RateLimiterProvider.Allow, so that services outside of Caddy can
+// share the zone's quota. Only this instance's state is considered.
+func handleAllow(w http.ResponseWriter, r *http.Request, rlm *rateLimitersMap, key string) error {
+	if r.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	req := allowRequest{Cost: 1}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("decoding request body: %v", err),
+		}
+	}
+
+	d, err := rlm.allow(key, req.Cost)
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        err,
+		}
+	}
+	return writeAdminJSON(w, allowResult{
+		Key:        key,
+		Allowed:    d.Allowed,
+		Limit:      d.Limit,
+		Window:     d.Window.String(),
+		Remaining:  d.Remaining,
+		RetryAfter: d.RetryAfter.Seconds(),
+	})
+}
+
+// handleUsage reports how much of its limit a key is using in the
+// current window and, if the zone keeps a usage history, how many of
+// its events were allowed and declined in recent windows, newest first.
+// Only this instance's state is considered.
+func handleUsage(w http.ResponseWriter, r *http.Request, rlm *rateLimitersMap, key string) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	allowed, remaining, wait := rlm.peek(key)
+	maxEvents, window := rlm.limits()
+
+	return writeAdminJSON(w, usageResult{
+		Key:    key,
+		Limit:  maxEvents,
+		Window: window.String(),
+		Current: currentUsage{
+			Events:     max(maxEvents-remaining, 0),
+			Remaining:  remaining,
+			Allowed:    allowed,
+			RetryAfter: wait.Seconds(),
+		},
+		Periods: rlm.usageOf(key),
+	})
+}
+
+// handleCheck reports whether a request for the key given in the
+// query string would currently be allowed, without consuming an
+// event. Only this instance's state is considered.
+func handleCheck(w http.ResponseWriter, r *http.Request, rlm *rateLimitersMap) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	query := r.URL.Query()
+	if !query.Has("key") {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("key query parameter is required"),
+		}
+	}
+
+	key := query.Get("key")
+	allowed, remaining, wait := rlm.peek(key)
+	maxEvents, _ := rlm.limits()
+
+	return writeAdminJSON(w, checkResult{
+		Key:        key,
+		Allowed:    allowed,
+		Limit:      maxEvents,
+		Remaining:  remaining,
+		RetryAfter: wait.Seconds(),
+	})
+}
+
+// handleBans lists the keys and prefixes that are currently banned in a
+// zone, or those that start with the prefix given in the query string.
+// With a prefix, it also bans the prefix, i.e. all keys of the zone that
+// start with it, or lifts the bans of those keys and prefixes.
+func handleBans(w http.ResponseWriter, r *http.Request, rlm *rateLimitersMap, zoneName string) error {
+	switch r.Method {
+	case http.MethodGet:
+		prefix := r.URL.Query().Get("prefix")
+		results := []banStatus{}
+		for key, until := range rlm.activeBans() {
+			if strings.HasPrefix(key, prefix) {
+				results = append(results, newBanStatus(key, until))
+			}
+		}
+		for banned, until := range rlm.activePrefixBans() {
+			if strings.HasPrefix(banned, prefix) {
+				results = append(results, banStatus{Key: banned, Prefix: true, Expires: until})
+			}
+		}
+		slices.SortFunc(results, func(a, b banStatus) int { return strings.Compare(a.Key, b.Key) })
+		return writeAdminJSON(w, results)
+
+	case http.MethodPut:
+		prefix, err := adminKeyPrefix(r)
+		if err != nil {
+			return err
+		}
+		var req banRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("decoding request body: %v", err),
+			}
+		}
+		if req.TTL <= 0 {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("ttl must be greater than zero"),
+			}
+		}
+
+		// the prefix bans keys that the zone hasn't seen yet; the
+		// keys that it has state for are also banned one by one, so
+		// that their bans emit events
+		until := now().Add(time.Duration(req.TTL))
+		rlm.banPrefix(prefix, until)
+		results := []banStatus{{Key: prefix, Prefix: true, Expires: until}}
+		for _, key := range rlm.keysWithPrefix(prefix) {
+			rlm.ban(key, until)
+			rlm.emitEvent(eventBan, map[string]any{
+				"zone":    zoneName,
+				"key":     key,
+				"expires": until,
+			})
+			results = append(results, newBanStatus(key, until))
+		}
+		return writeAdminJSON(w, results)
+
+	case http.MethodDelete:
+		prefix, err := adminKeyPrefix(r)
+		if err != nil {
+			return err
+		}
+		var lifted int
+		for key := range rlm.activeBans() {
+			if !strings.HasPrefix(key, prefix) || !rlm.unban(key) {
+				continue
+			}
+			rlm.emitEvent(eventUnban, map[string]any{
+				"zone": zoneName,
+				"key":  key,
+			})
+			lifted++
+		}
+		return writeAdminJSON(w, prefixResult{
+			Zone:     zoneName,
+			Prefix:   prefix,
+			Keys:     lifted,
+			Prefixes: rlm.unbanPrefixes(prefix),
+		})
+
+	default:
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+}
+
+// handleBan places a key into, or removes it from, a zone's penalty
+// box. Bans are local to this instance and do not survive restarts.
+func handleBan(w http.ResponseWriter, r *http.Request, rlm *rateLimitersMap, zoneName, key string) error {
+	switch r.Method {
+	case http.MethodPut:
+		var req banRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("decoding request body: %v", err),
+			}
+		}
+		if req.TTL <= 0 {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("ttl must be greater than zero"),
+			}
+		}
+
+		until := now().Add(time.Duration(req.TTL))
+		rlm.ban(key, until)
+		rlm.emitEvent(eventBan, map[string]any{
+			"zone":    zoneName,
+			"key":     key,
+			"expires": until,
+		})
+		return writeAdminJSON(w, newBanStatus(key, until))
+
+	case http.MethodDelete:
+		if !rlm.unban(key) {
+			return caddy.APIError{
+				HTTPStatus: http.StatusNotFound,
+				Err:        fmt.Errorf("key is not banned in zone %s: %s", zoneName, key),
+			}
+		}
+		rlm.emitEvent(eventUnban, map[string]any{
+			"zone": zoneName,
+			"key":  key,
+		})
+		w.WriteHeader(http.StatusOK)
+		return nil
+
+	default:
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+}
+
+// checkResult is the response of a non-consuming check.
+type checkResult struct {
+	Key       string `json:"key"`
+	Allowed   bool   `json:"allowed"`
+	Limit     int    `json:"limit"`
+	Remaining int    `json:"remaining"`
+
+	// Seconds until the next event would be allowed; zero if
+	// an event would be allowed now.
+	RetryAfter float64 `json:"retry_after"`
+}
+
+// usageResult is the response of a usage report.
+type usageResult struct {
+	Key     string       `json:"key"`
+	Limit   int          `json:"limit"`
+	Window  string       `json:"window"`
+	Current currentUsage `json:"current"`
+
+	// The key's usage in the current and past windows, newest first,
+	// if the zone keeps a usage history.
+	Periods []usageStatus `json:"periods,omitempty"`
+}
+
+// currentUsage is a key's usage of its limit in the current window.
+type currentUsage struct {
+	Events    int  `json:"events"`
+	Remaining int  `json:"remaining"`
+	Allowed   bool `json:"allowed"`
+
+	// Seconds until the next event would be allowed; zero if
+	// an event would be allowed now.
+	RetryAfter float64 `json:"retry_after"`
+}
+
+// allowRequest is the request body for counting events of a key.
+type allowRequest struct {
+	// The number of events. Default: 1
+	Cost int `json:"cost"`
+}
+
+// allowResult is the response of counting events of a key.
+type allowResult struct {
+	Key       string `json:"key"`
+	Allowed   bool   `json:"allowed"`
+	Limit     int    `json:"limit"`
+	Window    string `json:"window"`
+	Remaining int    `json:"remaining"`
+
+	// Seconds until the events would be allowed; zero if they were.
+	RetryAfter float64 `json:"retry_after"`
+}
+
+// refundRequest is the request body for refunding events to a key.
+type refundRequest struct {
+	// The number of events to refund. Required.
+	Events int `json:"events"`
+}
+
+// refundResult is the response of a refund.
+type refundResult struct {
+	Key       string `json:"key"`
+	Refunded  int    `json:"refunded"`
+	Remaining int    `json:"remaining"`
+}
+
+// banRequest is the request body for banning a key.
+type banRequest struct {
+	// How long the key stays in the penalty box. Required.
+	TTL caddy.Duration `json:"ttl"`
+}
+
+// prefixResult is the response of a request for all keys of a zone
+// that start with a prefix: the number of keys that were reset or
+// whose bans were lifted, and of banned prefixes whose bans were lifted.
+type prefixResult struct {
+	Zone     string `json:"zone"`
+	Prefix   string `json:"prefix"`
+	Keys     int    `json:"keys"`
+	Prefixes int    `json:"prefixes,omitempty"`
+}
+
+// banStatus describes a banned key in admin API responses.
+type banStatus struct {
+	Key     string    `json:"key"`
+	Prefix  bool      `json:"prefix,omitempty"` // Key is a banned prefix
+	Expires time.Time `json:"expires"`
+}
+
+func newBanStatus(key string, until time.Time) banStatus {
+	return banStatus{Key: key, Expires: until}
+}
+
+// zoneLimitsPatch is the request body for changing a zone's
+// limits. Fields that are omitted keep their current value.
+type zoneLimitsPatch struct {
+	MaxEvents *int            `json:"max_events,omitempty"`
+	Window    *caddy.Duration `json:"window,omitempty"`
+}
+
+// zoneStatus describes a zone in admin API responses.
+type zoneStatus struct {
+	Zone      string       `json:"zone"`
+	MaxEvents int          `json:"max_events"`
+	Window    string       `json:"window"`
+	Clamp     *clampStatus `json:"clamp,omitempty"`
+}
+
+func newZoneStatus(zoneName string, rlm *rateLimitersMap) zoneStatus {
+	maxEvents, window := rlm.limits()
+	return zoneStatus{
+		Zone:      zoneName,
+		MaxEvents: maxEvents,
+		Window:    window.String(),
+		Clamp:     rlm.clampStatus(),
+	}
+}
+
+// zoneSummary describes a zone and its busiest keys in the zone list.
+type zoneSummary struct {
+	zoneStatus
+	Keys    int          `json:"keys"`
+	TopKeys []keySummary `json:"top_keys"`
+}
+
+type keySummary struct {
+	Key       string `json:"key"`
+	Events    int    `json:"events"`
+	Remaining int    `json:"remaining"`
+}
+
+// handleZoneList lists all zones with their busiest keys, i.e. those
+// with the most events in the current window. The `top` query parameter
+// sets the number of keys per zone (default 10), and the `tenant` query
+// parameter restricts the list to the zones of a tenant.
+func handleZoneList(w http.ResponseWriter, r *http.Request) error {
+	top := 10
+	if value := r.URL.Query().Get("top"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("invalid top '%s'", value),
+			}
+		}
+		top = n
+	}
+
+	// tenants only see their own zones; see Handler.Tenant
+	tenant := r.URL.Query().Get("tenant")
+
+	summaries := []zoneSummary{}
+	for _, zone := range dashboardZones(top) {
+		if tenant != "" && !strings.HasPrefix(zone.Name, tenant+"/") {
+			continue
+		}
+		summary := zoneSummary{
+			zoneStatus: zoneStatus{
+				Zone:      zone.Name,
+				MaxEvents: zone.MaxEvents,
+				Window:    zone.Window.String(),
+				Clamp:     zone.Clamp,
+			},
+			Keys:    zone.Keys,
+			TopKeys: []keySummary{},
+		}
+		for _, key := range zone.TopKeys {
+			summary.TopKeys = append(summary.TopKeys, keySummary{Key: key.Key, Events: key.Events, Remaining: key.Remaining})
+		}
+		summaries = append(summaries, summary)
+	}
+	return writeAdminJSON(w, summaries)
+}
+
+// writeAdminJSON writes v to w as a JSON response.
+func writeAdminJSON(w http.ResponseWriter, v any) error {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        err,
+		}
+	}
+	return nil
+}
+
+// adminPathSegments returns the unescaped path segments of r
+// that follow prefix.
+func adminPathSegments(r *http.Request, prefix string) ([]string, error) {
+	rest := strings.TrimPrefix(r.URL.EscapedPath(), prefix)
+	if rest == "" {
+		return nil, nil
+	}
+	segments := strings.Split(rest, "/")
+	for i, seg := range segments {
+		unescaped, err := url.PathUnescape(seg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path segment '%s': %v", seg, err)
+		}
+		segments[i] = unescaped
+	}
+	return segments, nil
+}
+
+const (
+	adminZonesPrefix = "/rate_limit/zones/"
+	adminClampPath   = "/rate_limit/clamp"
+)
+
+// Interface guards
+var (
+	_ caddy.AdminRouter = (*adminAPI)(nil)
+)
@@ -0,0 +1,575 @@
+package caddyrl
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/samrg472/caddy-ratelimit/client"
+)
+
+// newTestZone registers a zone with the given name in the global
+// pool for the duration of the test.
+func newTestZone(t *testing.T, zoneName string, maxEvents int, window time.Duration) *rateLimitersMap {
+	t.Helper()
+	rlm := newRateLimiterMap()
+	rlm.updateAll(maxEvents, window)
+	rateLimits.LoadOrStore(zoneName, rlm)
+	t.Cleanup(func() { _, _ = rateLimits.Delete(zoneName) })
+	return rlm
+}
+
+// serveAdmin sends a request to the zones endpoint and returns the
+// recorded response along with the HTTP status of the returned API
+// error, if any.
+func serveAdmin(t *testing.T, method, target string) (*httptest.ResponseRecorder, int) {
+	t.Helper()
+	req := httptest.NewRequest(method, target, nil)
+	rec := httptest.NewRecorder()
+	err := handleZones(rec, req)
+	if err == nil {
+		return rec, 0
+	}
+	var apiErr caddy.APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("handler returned non-API error: %v", err)
+	}
+	return rec, apiErr.HTTPStatus
+}
+
+func TestAdminDeleteKey(t *testing.T) {
+	initTime()
+
+	rlm := newTestZone(t, "admin_zone", 1, time.Minute)
+	limiter := rlm.getOrInsert("10.0.0.1/32")
+	if limiter.When() != 0 {
+		t.Fatal("first event should be allowed")
+	}
+	if limiter.When() == 0 {
+		t.Fatal("second event should be declined")
+	}
+
+	rec, errStatus := serveAdmin(t, http.MethodDelete, "/rate_limit/zones/admin_zone/keys/10.0.0.1%2F32")
+	if errStatus != 0 {
+		t.Fatalf("unexpected error status %d", errStatus)
+	}
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", rec.Code, rec.Body)
+	}
+
+	if when := rlm.getOrInsert("10.0.0.1/32").When(); when != 0 {
+		t.Fatalf("event should be allowed after reset, but must wait %s", when)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		method string
+		target string
+		status int
+	}{
+		{"unknown-key", http.MethodDelete, "/rate_limit/zones/admin_zone/keys/unknown", http.StatusNotFound},
+		{"unknown-zone", http.MethodDelete, "/rate_limit/zones/no_such_zone/keys/foo", http.StatusNotFound},
+		{"empty-zone", http.MethodDelete, "/rate_limit/zones//keys/foo", http.StatusNotFound},
+		{"empty-key", http.MethodDelete, "/rate_limit/zones/admin_zone/keys/", http.StatusNotFound},
+		{"wrong-method", http.MethodGet, "/rate_limit/zones/admin_zone/keys/10.0.0.1%2F32", http.StatusMethodNotAllowed},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, errStatus := serveAdmin(t, tc.method, tc.target)
+			if errStatus != tc.status {
+				t.Fatalf("expected error status %d, got %d", tc.status, errStatus)
+			}
+		})
+	}
+}
+
+func TestAdminDeleteZone(t *testing.T) {
+	initTime()
+
+	rlm := newTestZone(t, "admin_zone_reset", 1, time.Minute)
+	for _, key := range []string{"a", "b", "c"} {
+		rlm.getOrInsert(key).When()
+	}
+
+	rec, errStatus := serveAdmin(t, http.MethodDelete, "/rate_limit/zones/admin_zone_reset")
+	if errStatus != 0 {
+		t.Fatalf("unexpected error status %d", errStatus)
+	}
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", rec.Code, rec.Body)
+	}
+
+	if remaining := rlm.len(); remaining != 0 {
+		t.Fatalf("expected zone to be empty after reset, but it has %d keys", remaining)
+	}
+
+	if _, errStatus := serveAdmin(t, http.MethodPost, "/rate_limit/zones/admin_zone_reset"); errStatus != http.StatusMethodNotAllowed {
+		t.Fatalf("expected error status %d, got %d", http.StatusMethodNotAllowed, errStatus)
+	}
+}
+
+func TestAdminPatchZone(t *testing.T) {
+	initTime()
+
+	rlm := newTestZone(t, "admin_zone_patch", 1, time.Minute)
+	limiter := rlm.getOrInsert("key")
+	limiter.When()
+
+	req := httptest.NewRequest(http.MethodPatch, "/rate_limit/zones/admin_zone_patch", strings.NewReader(`{"max_events": 5, "window": "10s"}`))
+	rec := httptest.NewRecorder()
+	if err := handleZones(rec, req); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var status zoneStatus
+	if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	if status.MaxEvents != 5 || status.Window != "10s" {
+		t.Fatalf("unexpected zone status: %+v", status)
+	}
+
+	// existing and new rate limiters should both pick up the new limits
+	if limiter.MaxEvents() != 5 || limiter.Window() != 10*time.Second {
+		t.Fatalf("existing limiter was not updated: %d events per %s", limiter.MaxEvents(), limiter.Window())
+	}
+	if newLimiter := rlm.getOrInsert("other"); newLimiter.MaxEvents() != 5 {
+		t.Fatalf("new limiter has wrong max events: %d", newLimiter.MaxEvents())
+	}
+
+	for _, body := range []string{`{"window": "0s"}`, `{"max_events": -1}`, `not json`} {
+		req := httptest.NewRequest(http.MethodPatch, "/rate_limit/zones/admin_zone_patch", strings.NewReader(body))
+		var apiErr caddy.APIError
+		if err := handleZones(httptest.NewRecorder(), req); !errors.As(err, &apiErr) || apiErr.HTTPStatus != http.StatusBadRequest {
+			t.Fatalf("expected bad request for body %s, got %v", body, err)
+		}
+	}
+}
+
+func TestAdminBans(t *testing.T) {
+	initTime()
+
+	rlm := newTestZone(t, "admin_zone_bans", 10, time.Minute)
+
+	var emitted []string
+	rlm.setEventEmitter(func(name string, data map[string]any) {
+		emitted = append(emitted, name+":"+data["key"].(string))
+	})
+
+	req := httptest.NewRequest(http.MethodPut, "/rate_limit/zones/admin_zone_bans/bans/abuser", strings.NewReader(`{"ttl": "30s"}`))
+	if err := handleZones(httptest.NewRecorder(), req); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(emitted) != 1 || emitted[0] != eventBan+":abuser" {
+		t.Fatalf("unexpected events: %v", emitted)
+	}
+	if dur := rlm.banned("abuser"); dur != 30*time.Second {
+		t.Fatalf("expected key to be banned for 30s, got %s", dur)
+	}
+	if dur := rlm.banned("innocent"); dur != 0 {
+		t.Fatalf("unexpected ban for other key: %s", dur)
+	}
+
+	rec, errStatus := serveAdmin(t, http.MethodGet, "/rate_limit/zones/admin_zone_bans/bans")
+	if errStatus != 0 {
+		t.Fatalf("unexpected error status %d", errStatus)
+	}
+	var bans []banStatus
+	if err := json.NewDecoder(rec.Body).Decode(&bans); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	if len(bans) != 1 || bans[0].Key != "abuser" {
+		t.Fatalf("unexpected ban list: %+v", bans)
+	}
+
+	// bans expire on their own
+	advanceTime(31)
+	if dur := rlm.banned("abuser"); dur != 0 {
+		t.Fatalf("ban should have expired, but %s remain", dur)
+	}
+	if _, errStatus := serveAdmin(t, http.MethodDelete, "/rate_limit/zones/admin_zone_bans/bans/abuser"); errStatus != http.StatusNotFound {
+		t.Fatalf("expected error status %d for expired ban, got %d", http.StatusNotFound, errStatus)
+	}
+
+	// or can be lifted manually
+	rlm.ban("abuser", now().Add(time.Hour))
+	if _, errStatus := serveAdmin(t, http.MethodDelete, "/rate_limit/zones/admin_zone_bans/bans/abuser"); errStatus != 0 {
+		t.Fatalf("unexpected error status %d", errStatus)
+	}
+	if dur := rlm.banned("abuser"); dur != 0 {
+		t.Fatalf("ban should have been lifted, but %s remain", dur)
+	}
+
+	req = httptest.NewRequest(http.MethodPut, "/rate_limit/zones/admin_zone_bans/bans/abuser", strings.NewReader(`{}`))
+	var apiErr caddy.APIError
+	if err := handleZones(httptest.NewRecorder(), req); !errors.As(err, &apiErr) || apiErr.HTTPStatus != http.StatusBadRequest {
+		t.Fatalf("expected bad request for missing ttl, got %v", err)
+	}
+}
+
+func TestAdminKeyPrefix(t *testing.T) {
+	initTime()
+
+	rlm := newTestZone(t, "admin_zone_prefix", 1, time.Minute)
+	for _, key := range []string{"10.42.0.1", "10.42.0.2", "10.4.2.1"} {
+		rlm.getOrInsert(key).When()
+	}
+
+	var emitted []string
+	rlm.setEventEmitter(func(name string, data map[string]any) {
+		emitted = append(emitted, name+":"+data["key"].(string))
+	})
+
+	req := httptest.NewRequest(http.MethodPut, "/rate_limit/zones/admin_zone_prefix/bans?prefix=10.42.", strings.NewReader(`{"ttl": "1h"}`))
+	rec := httptest.NewRecorder()
+	if err := handleZones(rec, req); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var bans []banStatus
+	if err := json.NewDecoder(rec.Body).Decode(&bans); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	if len(bans) != 3 || !bans[0].Prefix || bans[0].Key != "10.42." || bans[1].Key != "10.42.0.1" || bans[2].Key != "10.42.0.2" {
+		t.Fatalf("expected the prefix and its keys to be banned, got %+v", bans)
+	}
+	if len(emitted) != 2 || rlm.banned("10.4.2.1") != 0 {
+		t.Fatalf("expected only the keys with the prefix to be banned, got events %v", emitted)
+	}
+	if rlm.banned("10.42.9.9") == 0 {
+		t.Fatal("expected a key with the prefix that made no requests yet to be banned")
+	}
+	rlm.ban("10.4.2.1", now().Add(time.Hour))
+
+	rec, errStatus := serveAdmin(t, http.MethodGet, "/rate_limit/zones/admin_zone_prefix/bans?prefix=10.4")
+	if errStatus != 0 {
+		t.Fatalf("unexpected error status %d", errStatus)
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&bans); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	if len(bans) != 4 {
+		t.Fatalf("expected the prefix to match all bans, got %+v", bans)
+	}
+
+	rec, errStatus = serveAdmin(t, http.MethodDelete, "/rate_limit/zones/admin_zone_prefix/bans?prefix=10.42.")
+	if errStatus != 0 {
+		t.Fatalf("unexpected error status %d", errStatus)
+	}
+	var result prefixResult
+	if err := json.NewDecoder(rec.Body).Decode(&result); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	if result.Keys != 2 || result.Prefixes != 1 || rlm.banned("10.42.0.1") != 0 || rlm.banned("10.42.9.9") != 0 || rlm.banned("10.4.2.1") == 0 {
+		t.Fatalf("expected the bans of the prefix and its keys to be lifted, got %+v", result)
+	}
+
+	rec, errStatus = serveAdmin(t, http.MethodDelete, "/rate_limit/zones/admin_zone_prefix/keys?prefix=10.42.")
+	if errStatus != 0 {
+		t.Fatalf("unexpected error status %d", errStatus)
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&result); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	if result.Keys != 2 || rlm.len() != 1 {
+		t.Fatalf("expected the keys with the prefix to be reset, got %+v with %d keys left", result, rlm.len())
+	}
+	if allowed, _, _ := rlm.peek("10.42.0.1"); !allowed {
+		t.Fatal("expected a reset key to be allowed again")
+	}
+
+	for _, method := range []string{http.MethodPut, http.MethodDelete} {
+		if _, errStatus := serveAdmin(t, method, "/rate_limit/zones/admin_zone_prefix/bans"); errStatus != http.StatusBadRequest {
+			t.Errorf("%s: expected bad request without a prefix, got %d", method, errStatus)
+		}
+	}
+	if _, errStatus := serveAdmin(t, http.MethodDelete, "/rate_limit/zones/admin_zone_prefix/keys?prefix="); errStatus != http.StatusBadRequest {
+		t.Errorf("expected bad request for an empty prefix, got %d", errStatus)
+	}
+}
+
+func TestAdminClient(t *testing.T) {
+	initTime()
+	newTestZone(t, "admin_zone_client", 3, time.Minute)
+
+	// serve the zones like Caddy's admin API, which describes errors
+	// in a JSON object
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := handleZones(w, r); err != nil {
+			var apiErr caddy.APIError
+			if !errors.As(err, &apiErr) {
+				t.Errorf("handler returned non-API error: %v", err)
+				return
+			}
+			w.WriteHeader(apiErr.HTTPStatus)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": apiErr.Err.Error()})
+		}
+	}))
+	defer server.Close()
+	c := client.New(server.URL + "/")
+	ctx := context.Background()
+
+	d, err := c.Allow(ctx, "admin_zone_client", "tenant/1", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !d.Allowed || d.Remaining != 1 || d.Limit != 3 || d.Window != time.Minute {
+		t.Errorf("unexpected decision: %+v", d)
+	}
+	if d, err := c.Allow(ctx, "admin_zone_client", "tenant/1", 2); err != nil || d.Allowed || d.RetryAfter != time.Minute {
+		t.Errorf("expected the events beyond the limit to be declined for a minute, got %+v, %v", d, err)
+	}
+	if d, err := c.Check(ctx, "admin_zone_client", "tenant/1"); err != nil || !d.Allowed || d.Remaining != 1 {
+		t.Errorf("expected the key's last event to be allowed, got %+v, %v", d, err)
+	}
+	if d, err := c.Check(ctx, "admin_zone_client", "tenant/2"); err != nil || d.Remaining != 3 {
+		t.Errorf("expected other keys not to be counted, got %+v, %v", d, err)
+	}
+
+	var clientErr *client.Error
+	if _, err := c.Allow(ctx, "admin_zone_client", "tenant/1", 0); !errors.As(err, &clientErr) || clientErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected bad request for a cost of 0, got %v", err)
+	}
+	if _, err := c.Check(ctx, "missing", "tenant/1"); !errors.As(err, &clientErr) || clientErr.StatusCode != http.StatusNotFound || !strings.Contains(clientErr.Message, "unknown zone") {
+		t.Errorf("expected not found for an unknown zone, got %v", err)
+	}
+	if _, errStatus := serveAdmin(t, http.MethodGet, "/rate_limit/zones/admin_zone_client/keys/tenant/allow"); errStatus != http.StatusMethodNotAllowed {
+		t.Errorf("expected error status %d, got %d", http.StatusMethodNotAllowed, errStatus)
+	}
+}
+
+func TestAdminRefund(t *testing.T) {
+	initTime()
+
+	rlm := newTestZone(t, "admin_zone_refund", 3, time.Minute)
+	limiter := rlm.getOrInsert("tenant")
+	for range 3 {
+		limiter.When()
+	}
+
+	refund := func(body string) (refundResult, error) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/rate_limit/zones/admin_zone_refund/keys/tenant/refund", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		if err := handleZones(rec, req); err != nil {
+			return refundResult{}, err
+		}
+		var result refundResult
+		if err := json.NewDecoder(rec.Body).Decode(&result); err != nil {
+			t.Fatalf("decoding response: %v", err)
+		}
+		return result, nil
+	}
+
+	result, err := refund(`{"events": 2}`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Refunded != 2 || result.Remaining != 2 {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	if result, _ := refund(`{"events": 5}`); result.Refunded != 1 || result.Remaining != 3 {
+		t.Fatalf("expected refund to be bounded by the events in the window: %+v", result)
+	}
+
+	var apiErr caddy.APIError
+	if _, err := refund(`{}`); !errors.As(err, &apiErr) || apiErr.HTTPStatus != http.StatusBadRequest {
+		t.Fatalf("expected bad request for missing events, got %v", err)
+	}
+	if _, errStatus := serveAdmin(t, http.MethodGet, "/rate_limit/zones/admin_zone_refund/keys/tenant/refund"); errStatus != http.StatusMethodNotAllowed {
+		t.Fatalf("expected error status %d, got %d", http.StatusMethodNotAllowed, errStatus)
+	}
+}
+
+func TestAdminCheck(t *testing.T) {
+	initTime()
+
+	rlm := newTestZone(t, "admin_zone_check", 2, time.Minute)
+
+	check := func(key string) checkResult {
+		t.Helper()
+		rec, errStatus := serveAdmin(t, http.MethodGet, "/rate_limit/zones/admin_zone_check/check?key="+key)
+		if errStatus != 0 {
+			t.Fatalf("unexpected error status %d", errStatus)
+		}
+		var result checkResult
+		if err := json.NewDecoder(rec.Body).Decode(&result); err != nil {
+			t.Fatalf("decoding response: %v", err)
+		}
+		return result
+	}
+
+	if result := check("fresh"); !result.Allowed || result.Remaining != 2 || result.Limit != 2 {
+		t.Fatalf("unexpected result for unknown key: %+v", result)
+	}
+	if _, ok := rlm.get("fresh"); ok {
+		t.Fatal("checking a key should not allocate a rate limiter")
+	}
+
+	limiter := rlm.getOrInsert("busy")
+	limiter.When()
+	if result := check("busy"); !result.Allowed || result.Remaining != 1 {
+		t.Fatalf("unexpected result after one event: %+v", result)
+	}
+	if result := check("busy"); result.Remaining != 1 {
+		t.Fatalf("checking should not consume events: %+v", result)
+	}
+
+	advanceTime(15)
+	limiter.When()
+	if result := check("busy"); result.Allowed || result.Remaining != 0 || result.RetryAfter != 45 {
+		t.Fatalf("unexpected result for exhausted key: %+v", result)
+	}
+
+	if _, errStatus := serveAdmin(t, http.MethodGet, "/rate_limit/zones/admin_zone_check/check"); errStatus != http.StatusBadRequest {
+		t.Fatalf("expected error status %d without key, got %d", http.StatusBadRequest, errStatus)
+	}
+}
+
+func TestAdminUsage(t *testing.T) {
+	initTime() // 40s into a minute
+
+	rlm := newTestZone(t, "admin_zone_usage", 3, time.Minute)
+	rlm.setUsageHistory(2, time.Minute)
+	limiter := rlm.getOrInsert("tenant")
+	limiter.When()
+	rlm.recordUsage("tenant", 1, 0)
+
+	advanceTime(30)
+	limiter.When()
+	rlm.recordUsage("tenant", 1, 0)
+	rlm.recordUsage("tenant", 0, 1)
+
+	usage := func(zone string) usageResult {
+		t.Helper()
+		rec, errStatus := serveAdmin(t, http.MethodGet, "/rate_limit/zones/"+zone+"/keys/tenant/usage")
+		if errStatus != 0 {
+			t.Fatalf("unexpected error status %d", errStatus)
+		}
+		var result usageResult
+		if err := json.NewDecoder(rec.Body).Decode(&result); err != nil {
+			t.Fatalf("decoding response: %v", err)
+		}
+		return result
+	}
+
+	result := usage("admin_zone_usage")
+	if result.Limit != 3 || result.Current.Events != 2 || result.Current.Remaining != 1 || !result.Current.Allowed {
+		t.Fatalf("unexpected current usage: %+v", result)
+	}
+	if len(result.Periods) != 3 {
+		t.Fatalf("expected the current and 2 past windows, got %+v", result.Periods)
+	}
+	if p := result.Periods[0]; p.Allowed != 1 || p.Declined != 1 || !p.Start.Equal(time.Unix(referenceTime+20, 0)) || !p.End.Equal(time.Unix(referenceTime+80, 0)) {
+		t.Errorf("unexpected current window: %+v", p)
+	}
+	if p := result.Periods[1]; p.Allowed != 1 || p.Declined != 0 || !p.Start.Equal(time.Unix(referenceTime-40, 0)) {
+		t.Errorf("unexpected previous window: %+v", p)
+	}
+	if p := result.Periods[2]; p.Allowed != 0 || p.Declined != 0 {
+		t.Errorf("expected no events in the oldest window: %+v", p)
+	}
+
+	// keys are forgotten once their events are older than the history
+	advanceTime(200)
+	rlm.sweepUsage()
+	if n := len(rlm.usage); n != 0 {
+		t.Errorf("expected the key's usage to be swept, got %d keys", n)
+	}
+
+	newTestZone(t, "admin_zone_no_usage", 3, time.Minute)
+	if result := usage("admin_zone_no_usage"); result.Periods != nil || result.Current.Remaining != 3 {
+		t.Errorf("expected no periods without usage_history: %+v", result)
+	}
+	if _, errStatus := serveAdmin(t, http.MethodDelete, "/rate_limit/zones/admin_zone_usage/keys/tenant/usage"); errStatus != http.StatusMethodNotAllowed {
+		t.Fatalf("expected error status %d, got %d", http.StatusMethodNotAllowed, errStatus)
+	}
+}
+
+func TestAdminZoneListTenant(t *testing.T) {
+	initTime()
+
+	newTestZone(t, "acme/admin_zone_tenant", 5, time.Minute)
+	newTestZone(t, "globex/admin_zone_tenant", 5, time.Minute)
+
+	rec, errStatus := serveAdmin(t, http.MethodGet, "/rate_limit/zones/?tenant=acme")
+	if errStatus != 0 {
+		t.Fatalf("unexpected error status %d", errStatus)
+	}
+	var zones []zoneSummary
+	if err := json.NewDecoder(rec.Body).Decode(&zones); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	if len(zones) != 1 || zones[0].Zone != "acme/admin_zone_tenant" {
+		t.Errorf("expected only the tenant's zone, got %+v", zones)
+	}
+}
+
+func TestAdminClamp(t *testing.T) {
+	initTime()
+
+	rlm := newTestZone(t, "admin_zone_clamp", 10, time.Minute)
+	rlm.setTotal(100)
+
+	req := httptest.NewRequest(http.MethodPut, "/rate_limit/zones/admin_zone_clamp/clamp", strings.NewReader(`{"factor": 0.2, "ttl": "50ms"}`))
+	rec := httptest.NewRecorder()
+	if err := handleZones(rec, req); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if maxEvents, _ := rlm.limits(); maxEvents != 2 {
+		t.Fatalf("expected clamped max events 2, got %d", maxEvents)
+	}
+	if total := rlm.total.Load().MaxEvents(); total != 20 {
+		t.Fatalf("expected clamped total 20, got %d", total)
+	}
+	if rlm.clampStatus() == nil {
+		t.Fatal("expected the zone's status to report the clamp")
+	}
+
+	// limits changed while clamped are clamped, too
+	rlm.updateAll(20, time.Minute)
+	if maxEvents, _ := rlm.limits(); maxEvents != 4 {
+		t.Fatalf("expected clamped max events 4, got %d", maxEvents)
+	}
+
+	// the configured limits are restored after the TTL
+	deadline := time.Now().Add(5 * time.Second)
+	for rlm.clampStatus() != nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if maxEvents, _ := rlm.limits(); maxEvents != 20 {
+		t.Fatalf("expected max events 20 after the clamp expired, got %d", maxEvents)
+	}
+
+	// freezing declines all requests until lifted
+	req = httptest.NewRequest(http.MethodPut, "/rate_limit/clamp", strings.NewReader(`{"freeze": true, "ttl": "1h"}`))
+	if err := handleClampAll(httptest.NewRecorder(), req); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if wait := rlm.when(rlm.getOrInsert("a")); wait == 0 {
+		t.Fatal("expected requests of a frozen zone to be declined")
+	}
+	req = httptest.NewRequest(http.MethodDelete, "/rate_limit/clamp", nil)
+	if err := handleClampAll(httptest.NewRecorder(), req); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if wait := rlm.when(rlm.getOrInsert("a")); wait != 0 {
+		t.Fatalf("expected requests to be allowed after lifting the clamp, but must wait %s", wait)
+	}
+	if _, errStatus := serveAdmin(t, http.MethodDelete, "/rate_limit/zones/admin_zone_clamp/clamp"); errStatus != http.StatusNotFound {
+		t.Fatalf("expected status %d without a clamp, got %d", http.StatusNotFound, errStatus)
+	}
+
+	for _, body := range []string{`{"ttl": "1m"}`, `{"factor": 2, "ttl": "1m"}`, `{"factor": 0.5}`, `{"freeze": true, "factor": 0.5, "ttl": "1m"}`} {
+		req := httptest.NewRequest(http.MethodPut, "/rate_limit/zones/admin_zone_clamp/clamp", strings.NewReader(body))
+		err := handleZones(httptest.NewRecorder(), req)
+		var apiErr caddy.APIError
+		if !errors.As(err, &apiErr) || apiErr.HTTPStatus != http.StatusBadRequest {
+			t.Errorf("body %s: expected bad request, got %v", body, err)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package caddyrl
+
+import (
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func init() {
+	caddy.RegisterModule(SlidingWindow{})
+}
+
+// Algorithm decides whether the events of a zone's keys are allowed.
+// Modules in the `rate_limit.algorithms` namespace implement it, so that
+// other algorithms can be compiled in with xcaddy and selected per zone
+// with the zone's `algorithm`, by module name.
+type Algorithm interface {
+	// NewLimiter returns the limiter of a new key, which allows
+	// maxEvents events per window.
+	NewLimiter(maxEvents int, window time.Duration) Limiter
+}
+
+// Limiter limits the events of one key of a zone. Its methods may be
+// called concurrently. The time is passed in rather than read from the
+// clock, so that limiters can be tested deterministically.
+type Limiter interface {
+	// Allow returns 0 if n events at ref are allowed, in which case
+	// they are counted, or how long to wait before they would be.
+	Allow(ref time.Time, n int) time.Duration
+
+	// Remaining returns the number of events that would be allowed
+	// at ref.
+	Remaining(ref time.Time) int
+
+	// SetLimits changes the limits, e.g. when the config is reloaded
+	// or the zone is clamped.
+	SetLimits(maxEvents int, window time.Duration)
+
+	// Idle returns true if the limiter's state no longer affects its
+	// decisions at ref, so that it can be forgotten.
+	Idle(ref time.Time) bool
+}
+
+// SlidingWindow is the default algorithm: it allows max_events events
+// in any window of the zone's duration, remembering the time of each
+// event. Zones that use it support all features, such as distributed
+// rate limiting and total limits, and their keys can be inspected
+// through the admin API.
+type SlidingWindow struct{}
+
+// CaddyModule returns the Caddy module information.
+func (SlidingWindow) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "rate_limit.algorithms.sliding_window",
+		New: func() caddy.Module { return new(SlidingWindow) },
+	}
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler. Syntax:
+//
+//	algorithm sliding_window
+func (SlidingWindow) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume algorithm name
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+// NewLimiter implements Algorithm. Zones that use the sliding window
+// keep their limiters themselves, so it is only used by others, e.g. to
+// compare algorithms.
+func (SlidingWindow) NewLimiter(maxEvents int, window time.Duration) Limiter {
+	return &slidingWindowLimiter{ring: newRingBufferRateLimiter(maxEvents, window)}
+}
+
+type slidingWindowLimiter struct {
+	ring *ringBufferRateLimiter
+}
+
+func (l *slidingWindowLimiter) Allow(ref time.Time, n int) time.Duration {
+	l.ring.mu.Lock()
+	defer l.ring.mu.Unlock()
+	if wait := l.ring.waitNUnsynced(ref, n); wait > 0 {
+		return wait
+	}
+	for range n {
+		l.ring.reserveAt(ref)
+	}
+	return 0
+}
+
+func (l *slidingWindowLimiter) Remaining(ref time.Time) int {
+	count, _ := l.ring.Count(ref)
+	return max(l.ring.MaxEvents()-count, 0)
+}
+
+func (l *slidingWindowLimiter) SetLimits(maxEvents int, window time.Duration) {
+	l.ring.SetMaxEvents(maxEvents)
+	l.ring.SetWindow(window)
+}
+
+func (l *slidingWindowLimiter) Idle(ref time.Time) bool {
+	return l.ring.expired(ref)
+}
+
+// sharedAlgorithm is implemented by algorithms that keep the state of
+// all of a zone's keys together, such as the count-min sketch, rather
+// than in a Limiter per key.
+type sharedAlgorithm interface {
+	// newShared returns the state of a new zone.
+	newShared() sharedLimiters
+}
+
+// sharedLimiters is the state of all keys of a zone that uses a
+// sharedAlgorithm. Keys can't be deleted, swept or counted.
+type sharedLimiters interface {
+	// limiter returns the limiter of key with the given limits.
+	limiter(key string, maxEvents int, window time.Duration) Limiter
+	// get returns the limiter of key with the current limits.
+	get(key string) Limiter
+	setLimits(maxEvents int, window time.Duration)
+	reset()
+}
+
+// algorithmLimiters are the limiters of the keys of a zone that uses an
+// algorithm module.
+type algorithmLimiters struct {
+	algorithm Algorithm
+	config    string // of the algorithm, to tell whether it changed
+
+	// the state of all keys, if the algorithm is a sharedAlgorithm;
+	// limiters is not used then
+	shared sharedLimiters
+
+	mu       sync.Mutex
+	limiters map[string]Limiter
+}
+
+// setAlgorithm makes the zone use algorithm, whose JSON config is
+// config, unless it already does, in which case the state of its keys
+// is kept; a nil algorithm means the sliding window.
+func (rlm *rateLimitersMap) setAlgorithm(algorithm Algorithm, config string) {
+	rlm.limitersMu.Lock()
+	defer rlm.limitersMu.Unlock()
+	if current := rlm.algorithm.Load(); current != nil && current.config == config {
+		return
+	}
+	if algorithm == nil {
+		rlm.algorithm.Store(nil)
+		return
+	}
+	al := &algorithmLimiters{
+		algorithm: algorithm,
+		config:    config,
+		limiters:  make(map[string]Limiter),
+	}
+	if shared, ok := algorithm.(sharedAlgorithm); ok {
+		al.shared = shared.newShared()
+		al.shared.setLimits(rlm.limits())
+	}
+	rlm.algorithm.Store(al)
+}
+
+// limiter returns the limiter of key, creating it with the zone's
+// current limits if it doesn't exist.
+func (al *algorithmLimiters) limiter(key string, maxEvents int, window time.Duration) Limiter {
+	if al.shared != nil {
+		return al.shared.limiter(key, maxEvents, window)
+	}
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	limiter, ok := al.limiters[key]
+	if !ok {
+		limiter = al.algorithm.NewLimiter(maxEvents, window)
+		al.limiters[key] = limiter
+	}
+	return limiter
+}
+
+// get returns the limiter of key, if it exists.
+func (al *algorithmLimiters) get(key string) (Limiter, bool) {
+	if al.shared != nil {
+		return al.shared.get(key), true
+	}
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	limiter, ok := al.limiters[key]
+	return limiter, ok
+}
+
+// delete forgets the limiter of key. It returns true if there was one.
+func (al *algorithmLimiters) delete(key string) bool {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	_, ok := al.limiters[key]
+	delete(al.limiters, key)
+	return ok
+}
+
+// setLimits changes the limits of all limiters.
+func (al *algorithmLimiters) setLimits(maxEvents int, window time.Duration) {
+	if al.shared != nil {
+		al.shared.setLimits(maxEvents, window)
+		return
+	}
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	for _, limiter := range al.limiters {
+		limiter.SetLimits(maxEvents, window)
+	}
+}
+
+// sweep forgets idle limiters and returns how many it forgot.
+func (al *algorithmLimiters) sweep(ref time.Time) int {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	var idle int
+	for key, limiter := range al.limiters {
+		if limiter.Idle(ref) {
+			delete(al.limiters, key)
+			idle++
+		}
+	}
+	return idle
+}
+
+// forEach calls fn with every key and its limiter. fn must not call
+// other methods of al.
+func (al *algorithmLimiters) forEach(fn func(key string, limiter Limiter)) {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	for key, limiter := range al.limiters {
+		fn(key, limiter)
+	}
+}
+
+func (al *algorithmLimiters) len() int {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	return len(al.limiters)
+}
+
+func (al *algorithmLimiters) reset() {
+	if al.shared != nil {
+		al.shared.reset()
+		return
+	}
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	clear(al.limiters)
+}
+
+// Interface guards
+var (
+	_ Algorithm             = (*SlidingWindow)(nil)
+	_ caddyfile.Unmarshaler = (*SlidingWindow)(nil)
+)
@@ -0,0 +1,283 @@
+package caddyrl
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func init() {
+	caddy.RegisterModule(fixedWindow{})
+}
+
+// fixedWindow is an algorithm module as a third party would write it:
+// it allows max events in each window that starts at a multiple of the
+// window's duration.
+type fixedWindow struct{}
+
+func (fixedWindow) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "rate_limit.algorithms.test_fixed_window",
+		New: func() caddy.Module { return new(fixedWindow) },
+	}
+}
+
+func (*fixedWindow) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume algorithm name
+	return nil
+}
+
+func (fixedWindow) NewLimiter(maxEvents int, window time.Duration) Limiter {
+	return &fixedWindowLimiter{maxEvents: maxEvents, window: window}
+}
+
+type fixedWindowLimiter struct {
+	mu        sync.Mutex
+	maxEvents int
+	window    time.Duration
+	start     time.Time
+	count     int
+}
+
+func (l *fixedWindowLimiter) Allow(ref time.Time, n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if end := l.start.Add(l.window); !ref.Before(end) {
+		l.start, l.count = ref.Truncate(l.window), 0
+	}
+	if l.count+n > l.maxEvents {
+		return l.start.Add(l.window).Sub(ref)
+	}
+	l.count += n
+	return 0
+}
+
+func (l *fixedWindowLimiter) Remaining(ref time.Time) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !ref.Before(l.start.Add(l.window)) {
+		return l.maxEvents
+	}
+	return max(l.maxEvents-l.count, 0)
+}
+
+func (l *fixedWindowLimiter) SetLimits(maxEvents int, window time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.maxEvents, l.window = maxEvents, window
+}
+
+func (l *fixedWindowLimiter) Idle(ref time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return !ref.Before(l.start.Add(l.window))
+}
+
+func TestAlgorithmModule(t *testing.T) {
+	initTime()
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: t.Context()})
+	defer cancel()
+
+	zone := &RateLimit{
+		ZoneName:     "fixed_zone",
+		MaxEvents:    3,
+		Window:       caddy.Duration(time.Minute),
+		AlgorithmRaw: json.RawMessage(`{"name": "test_fixed_window"}`),
+	}
+	if err := zone.provision(ctx, zone.ZoneName); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _, _ = rateLimits.Delete(zone.ZoneName) })
+	if _, ok := zone.algorithm.(*fixedWindow); !ok {
+		t.Fatalf("expected the fixed window algorithm, got %T", zone.algorithm)
+	}
+	if len(zone.AlgorithmRaw) == 0 {
+		t.Error("expected the algorithm's config to be kept")
+	}
+	rlm := zone.limitersMap
+
+	// the window started at 999960s, so it ends in 20s
+	for i := range 3 {
+		if wait := rlm.whenKey("client"); wait != 0 {
+			t.Fatalf("event %d: expected to be allowed, got wait %v", i, wait)
+		}
+	}
+	if wait := rlm.whenKey("client"); wait != 20*time.Second {
+		t.Errorf("expected to wait until the window ends, got %v", wait)
+	}
+	if _, remaining, _ := rlm.peek("client"); remaining != 0 {
+		t.Errorf("expected no remaining events, got %d", remaining)
+	}
+	if n := rlm.len(); n != 1 {
+		t.Errorf("expected 1 key, got %d", n)
+	}
+
+	// clamps and reloads change the limits of existing keys
+	rlm.setClamp(2, time.Hour)
+	if wait := rlm.whenKey("client"); wait != 0 {
+		t.Errorf("expected a clamp to raise the limit, got wait %v", wait)
+	}
+	rlm.liftClamp(nil)
+
+	d, err := new(RateLimitApp).Allow(context.Background(), "fixed_zone", "other", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !d.Allowed || d.Remaining != 1 {
+		t.Errorf("unexpected decision: %+v", d)
+	}
+
+	// keys are forgotten once their window is over
+	advanceTime(20)
+	if _, expired := rlm.sweep(); expired != 2 || rlm.len() != 0 {
+		t.Errorf("expected 2 idle keys to be swept, got %d with %d left", expired, rlm.len())
+	}
+
+	// reprovisioning with the same algorithm keeps the state of keys
+	if wait := rlm.whenKey("client"); wait != 0 {
+		t.Fatalf("expected to be allowed in the next window, got wait %v", wait)
+	}
+	again := &RateLimit{
+		ZoneName:     "fixed_zone",
+		MaxEvents:    3,
+		Window:       caddy.Duration(time.Minute),
+		AlgorithmRaw: json.RawMessage(`{"name": "test_fixed_window"}`),
+	}
+	if err := again.provision(ctx, again.ZoneName); err != nil {
+		t.Fatal(err)
+	}
+	if n := rlm.len(); n != 1 {
+		t.Errorf("expected the key to be kept across reloads, got %d keys", n)
+	}
+	if !rlm.delete("client") || rlm.len() != 0 {
+		t.Error("expected the key to be deleted")
+	}
+}
+
+func TestAlgorithmProvisionErrors(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: t.Context()})
+	defer cancel()
+
+	for _, zone := range []*RateLimit{
+		{TotalMaxEvents: 10},
+		{MaxKeys: 10},
+	} {
+		zone.ZoneName = "invalid_algorithm_zone"
+		zone.MaxEvents = 3
+		zone.Window = caddy.Duration(time.Minute)
+		zone.AlgorithmRaw = json.RawMessage(`{"name": "test_fixed_window"}`)
+		if err := zone.provision(ctx, zone.ZoneName); err == nil {
+			t.Errorf("expected an error for zone %+v", zone)
+		}
+	}
+
+	// the sliding window supports everything, since it is built in
+	zone := &RateLimit{
+		ZoneName:       "sliding_zone",
+		MaxEvents:      3,
+		TotalMaxEvents: 10,
+		Window:         caddy.Duration(time.Minute),
+		AlgorithmRaw:   json.RawMessage(`{"name": "sliding_window"}`),
+	}
+	if err := zone.provision(ctx, zone.ZoneName); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _, _ = rateLimits.Delete(zone.ZoneName) })
+	if zone.algorithm != nil || zone.limitersMap.algorithm.Load() != nil {
+		t.Error("expected the sliding window to use the built-in limiters")
+	}
+}
+
+func TestSlidingWindowLimiter(t *testing.T) {
+	ref := time.Unix(referenceTime, 0)
+	limiter := SlidingWindow{}.NewLimiter(2, time.Minute)
+
+	if wait := limiter.Allow(ref, 2); wait != 0 {
+		t.Fatalf("expected 2 events to be allowed, got wait %v", wait)
+	}
+	if wait := limiter.Allow(ref.Add(10*time.Second), 1); wait != 50*time.Second {
+		t.Errorf("expected to wait 50s, got %v", wait)
+	}
+	if remaining := limiter.Remaining(ref.Add(time.Minute + time.Second)); remaining != 2 {
+		t.Errorf("expected 2 remaining events, got %d", remaining)
+	}
+	if limiter.Idle(ref.Add(time.Second)) || !limiter.Idle(ref.Add(2*time.Minute)) {
+		t.Error("expected the limiter to be idle only once its events left the window")
+	}
+	limiter.SetLimits(3, time.Minute)
+	if wait := limiter.Allow(ref.Add(10*time.Second), 1); wait != 0 {
+		t.Errorf("expected a raised limit to allow another event, got wait %v", wait)
+	}
+}
+
+func TestCaddyfileAlgorithm(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`
+	rate_limit {
+		zone fixed {
+			key    static
+			window 1m
+			events 5
+			algorithm test_fixed_window
+		}
+		zone sliding {
+			key    static
+			window 1m
+			events 5
+			algorithm sliding_window
+		}
+	}`)
+
+	var h Handler
+	if err := h.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshaling Caddyfile: %v", err)
+	}
+	for i, expected := range []string{"test_fixed_window", "sliding_window"} {
+		var algorithm struct {
+			Name string `json:"name"`
+		}
+		if err := json.Unmarshal(h.RateLimits[i].AlgorithmRaw, &algorithm); err != nil {
+			t.Fatal(err)
+		}
+		if algorithm.Name != expected {
+			t.Errorf("zone %d: expected algorithm %s, got %s", i, expected, algorithm.Name)
+		}
+	}
+
+	for _, input := range []string{
+		`rate_limit {
+			zone bogus {
+				key static
+				window 1m
+				events 5
+				algorithm bogus
+			}
+		}`,
+		`rate_limit {
+			zone twice {
+				key static
+				window 1m
+				events 5
+				algorithm sliding_window
+				algorithm sliding_window
+			}
+		}`,
+		`rate_limit {
+			zone args {
+				key static
+				window 1m
+				events 5
+				algorithm sliding_window extra
+			}
+		}`,
+	} {
+		var h Handler
+		if err := h.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err == nil {
+			t.Errorf("expected error for input: %s", input)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package caddyrl
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+)
+
+// AnomalyDetection learns how many requests the keys of a zone usually
+// make per interval, and flags or bans keys that make sharply more,
+// whether or not they exceed the zone's limit. The learned baseline is
+// kept in storage, so that it survives restarts and is shared by the
+// instances that share storage.
+type AnomalyDetection struct {
+	// What happens to anomalous keys: `flag` emits a
+	// `rate_limit.anomaly` event and logs them; `ban` also bans them in
+	// the zone for ban_duration. Default: flag
+	Action string `json:"action,omitempty"`
+
+	// How long keys are banned with the ban action. Default: 10m
+	BanDuration caddy.Duration `json:"ban_duration,omitempty"`
+
+	// The interval over which the requests of keys are counted and
+	// compared to the baseline. Default: 1m
+	Interval caddy.Duration `json:"interval,omitempty"`
+
+	// The number of standard deviations above the baseline's mean at
+	// which the count of a key is anomalous. Default: 4
+	Threshold float64 `json:"threshold,omitempty"`
+
+	// The number of requests per interval below which keys are never
+	// anomalous, which keeps quiet zones from flagging small bursts.
+	// Default: 10
+	MinEvents int `json:"min_events,omitempty"`
+
+	// How long the baseline is learned before keys are flagged.
+	// Default: 1h
+	LearningPeriod caddy.Duration `json:"learning_period,omitempty"`
+
+	zone    *RateLimit
+	storage certmagic.Storage
+	logger  *zap.Logger
+
+	mu     sync.Mutex
+	counts map[string]int
+	model  anomalyModel
+}
+
+// Actions for anomalous keys.
+const (
+	anomalyFlag = "flag"
+	anomalyBan  = "ban"
+)
+
+// anomalySmoothing is the weight of each interval in the baseline, which
+// thereby mostly reflects the last few dozen intervals.
+const anomalySmoothing = 0.05
+
+// anomalyModel is the learned baseline of a zone: moving averages of
+// the per-key counts of requests per interval and of their squares.
+type anomalyModel struct {
+	Mean       float64   `json:"mean"`
+	MeanSquare float64   `json:"mean_square"`
+	Intervals  int       `json:"intervals"`
+	Since      time.Time `json:"since"`
+}
+
+// stddev returns the standard deviation of the per-key counts.
+func (m anomalyModel) stddev() float64 {
+	return math.Sqrt(max(m.MeanSquare-m.Mean*m.Mean, 0))
+}
+
+// anomalyStoragePrefix is where baselines are kept in storage.
+const anomalyStoragePrefix = "rate_limit/anomaly"
+
+// provision sets up the detection for zone, whose baseline is kept in
+// storage.
+func (ad *AnomalyDetection) provision(ctx context.Context, zone *RateLimit, storage certmagic.Storage, logger *zap.Logger) error {
+	if zone.dynamic != nil {
+		return fmt.Errorf("zones with placeholders in their names are not supported")
+	}
+	switch ad.Action {
+	case "":
+		ad.Action = anomalyFlag
+	case anomalyFlag, anomalyBan:
+	default:
+		return fmt.Errorf("unknown action '%s'", ad.Action)
+	}
+	if ad.BanDuration == 0 {
+		ad.BanDuration = caddy.Duration(10 * time.Minute)
+	}
+	if ad.Interval == 0 {
+		ad.Interval = caddy.Duration(time.Minute)
+	}
+	if ad.Threshold == 0 {
+		ad.Threshold = 4
+	}
+	if ad.MinEvents == 0 {
+		ad.MinEvents = 10
+	}
+	if ad.LearningPeriod == 0 {
+		ad.LearningPeriod = caddy.Duration(time.Hour)
+	}
+	if ad.BanDuration < 0 || ad.Interval < 0 || ad.Threshold < 0 || ad.MinEvents < 0 || ad.LearningPeriod < 0 {
+		return fmt.Errorf("ban_duration, interval, threshold, min_events and learning_period must be greater than zero")
+	}
+	ad.zone = zone
+	ad.storage = storage
+	ad.logger = logger.With(zap.String("zone", zone.ZoneName))
+	ad.counts = make(map[string]int)
+	ad.model = anomalyModel{Since: now()}
+
+	encoded, err := storage.Load(ctx, ad.storageKey())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("loading baseline: %v", err)
+	}
+	if err := json.Unmarshal(encoded, &ad.model); err != nil {
+		// start over rather than refuse the config
+		ad.logger.Warn("discarding invalid anomaly baseline", zap.Error(err))
+		ad.model = anomalyModel{Since: now()}
+	}
+	return nil
+}
+
+func (ad *AnomalyDetection) storageKey() string {
+	return path.Join(anomalyStoragePrefix, ad.zone.ZoneName+".json")
+}
+
+// observe counts a request of key.
+func (ad *AnomalyDetection) observe(key string) {
+	ad.mu.Lock()
+	ad.counts[key]++
+	ad.mu.Unlock()
+}
+
+// run evaluates the counts of every interval until ctx is canceled.
+func (ad *AnomalyDetection) run(ctx context.Context, emit func(name string, data map[string]any)) {
+	labelTask(ctx, "anomaly_detection")
+	ticker := time.NewTicker(time.Duration(ad.Interval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, anomaly := range ad.evaluate(now()) {
+				ad.act(anomaly, emit)
+			}
+			ad.save(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// keyAnomaly is a key that made anomalously many requests in an interval.
+type keyAnomaly struct {
+	key    string
+	count  int
+	mean   float64
+	stddev float64
+}
+
+// evaluate compares the counts of the interval that ends at ref to the
+// baseline, returning the anomalous keys once the baseline is learned,
+// and learns from the other keys.
+func (ad *AnomalyDetection) evaluate(ref time.Time) []keyAnomaly {
+	ad.mu.Lock()
+	defer ad.mu.Unlock()
+	counts := ad.counts
+	ad.counts = make(map[string]int, len(counts))
+	if len(counts) == 0 {
+		return nil
+	}
+
+	model := ad.model
+	learned := model.Intervals > 0 && ref.Sub(model.Since) >= time.Duration(ad.LearningPeriod)
+	limit := model.Mean + ad.Threshold*model.stddev()
+
+	var anomalies []keyAnomaly
+	var sum, sumSquares float64
+	var n int
+	for key, count := range counts {
+		if learned && count >= ad.MinEvents && float64(count) > limit {
+			anomalies = append(anomalies, keyAnomaly{key: key, count: count, mean: model.Mean, stddev: model.stddev()})
+			continue // anomalies don't shift the baseline
+		}
+		sum += float64(count)
+		sumSquares += float64(count) * float64(count)
+		n++
+	}
+	if n > 0 {
+		mean, meanSquare := sum/float64(n), sumSquares/float64(n)
+		if model.Intervals == 0 {
+			ad.model.Mean, ad.model.MeanSquare = mean, meanSquare
+		} else {
+			ad.model.Mean += anomalySmoothing * (mean - model.Mean)
+			ad.model.MeanSquare += anomalySmoothing * (meanSquare - model.MeanSquare)
+		}
+		ad.model.Intervals++
+	}
+
+	sort.Slice(anomalies, func(i, j int) bool { return anomalies[i].count > anomalies[j].count })
+	return anomalies
+}
+
+// act flags, and if so configured bans, an anomalous key.
+func (ad *AnomalyDetection) act(anomaly keyAnomaly, emit func(name string, data map[string]any)) {
+	ad.logger.Warn("anomalous request rate",
+		zap.String("key", anomaly.key),
+		zap.Int("count", anomaly.count),
+		zap.Float64("baseline_mean", anomaly.mean),
+		zap.Float64("baseline_stddev", anomaly.stddev),
+		zap.String("action", ad.Action),
+	)
+	emit(eventAnomaly, map[string]any{
+		"zone":     ad.zone.ZoneName,
+		"key":      anomaly.key,
+		"count":    anomaly.count,
+		"interval": time.Duration(ad.Interval),
+		"mean":     anomaly.mean,
+		"stddev":   anomaly.stddev,
+	})
+	if ad.Action != anomalyBan {
+		return
+	}
+	until := now().Add(time.Duration(ad.BanDuration))
+	ad.zone.limitersMap.ban(anomaly.key, until)
+	ad.zone.Log.banned(ad.zone.ZoneName, anomaly.key, until, "anomaly")
+	emit(eventBan, map[string]any{
+		"zone":    ad.zone.ZoneName,
+		"key":     anomaly.key,
+		"expires": until,
+	})
+}
+
+// save writes the baseline to storage.
+func (ad *AnomalyDetection) save(ctx context.Context) {
+	ad.mu.Lock()
+	encoded, err := json.Marshal(ad.model)
+	ad.mu.Unlock()
+	if err == nil {
+		err = ad.storage.Store(ctx, ad.storageKey(), encoded)
+	}
+	if err != nil && ctx.Err() == nil {
+		ad.logger.Error("storing anomaly baseline", zap.Error(err))
+	}
+}
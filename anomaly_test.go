@@ -0,0 +1,79 @@
+package caddyrl
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+)
+
+func TestAnomalyDetection(t *testing.T) {
+	initTime()
+
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	zone := &RateLimit{ZoneName: "anomaly_zone", MaxEvents: 1000, Window: caddy.Duration(time.Minute)}
+	zone.provisionState(zone.ZoneName)
+	defer rateLimits.Delete(zone.ZoneName)
+
+	ad := &AnomalyDetection{Action: anomalyBan, LearningPeriod: caddy.Duration(10 * time.Minute)}
+	if err := ad.provision(t.Context(), zone, storage, zap.NewNop()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var emitted []string
+	emit := func(name string, data map[string]any) {
+		emitted = append(emitted, fmt.Sprintf("%s:%v", name, data["key"]))
+	}
+
+	// 9 minutes of keys making 5 to 7 requests a minute
+	interval := func(minute int, extra map[string]int) []keyAnomaly {
+		for i := range 20 {
+			for range 5 + i%3 {
+				ad.observe(fmt.Sprintf("client%d", i))
+			}
+		}
+		for key, n := range extra {
+			for range n {
+				ad.observe(key)
+			}
+		}
+		advanceTime(60 * minute)
+		return ad.evaluate(now())
+	}
+	for minute := 1; minute < 10; minute++ {
+		// while learning, even heavy keys aren't flagged
+		if anomalies := interval(minute, map[string]int{"early": 100}); len(anomalies) > 0 {
+			t.Fatalf("minute %d: expected no anomalies while learning, got %v", minute, anomalies)
+		}
+	}
+
+	anomalies := interval(11, map[string]int{"scraper": 200, "busy": 9})
+	if len(anomalies) != 1 || anomalies[0].key != "scraper" || anomalies[0].count != 200 {
+		t.Fatalf("expected only the scraper to be anomalous, got %+v", anomalies)
+	}
+	ad.act(anomalies[0], emit)
+	if zone.limitersMap.banned("scraper") == 0 {
+		t.Error("expected the scraper to be banned")
+	}
+	if len(emitted) != 2 || emitted[0] != eventAnomaly+":scraper" || emitted[1] != eventBan+":scraper" {
+		t.Errorf("unexpected events %v", emitted)
+	}
+
+	// the baseline is restored from storage
+	ad.save(t.Context())
+	restored := new(AnomalyDetection)
+	if err := restored.provision(t.Context(), zone, storage, zap.NewNop()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, want := restored.model, ad.model; got.Mean != want.Mean || got.MeanSquare != want.MeanSquare ||
+		got.Intervals != want.Intervals || !got.Since.Equal(want.Since) {
+		t.Errorf("expected baseline %+v to be restored, got %+v", ad.model, restored.model)
+	}
+
+	if err := (&AnomalyDetection{Action: "block"}).provision(t.Context(), zone, storage, zap.NewNop()); err == nil {
+		t.Error("expected an error for an unknown action")
+	}
+}
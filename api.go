@@ -0,0 +1,104 @@
+package caddyrl
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// RateLimiterProvider lets other Caddy modules, such as authentication
+// providers or custom handlers, limit events in the zones of rate_limit
+// handlers, sharing their quotas. The rate_limit app implements it:
+//
+//	app, err := ctx.App("rate_limit")
+//	if err != nil {
+//		return err
+//	}
+//	limiter := app.(caddyrl.RateLimiterProvider)
+//
+// and then, e.g. for each failed login:
+//
+//	decision, err := limiter.Allow(r.Context(), "login", username, 1)
+type RateLimiterProvider interface {
+	// Allow reports whether cost events of key are allowed in the zone
+	// with the given name right now, and if so, counts them. Zones whose
+	// names have placeholders are named after their values. It returns
+	// an error if the zone doesn't exist or cost is less than 1. Costs
+	// greater than the zone's (possibly clamped) limit are never allowed.
+	Allow(ctx context.Context, zone, key string, cost int) (Decision, error)
+}
+
+// Decision is the outcome of RateLimiterProvider.Allow.
+type Decision struct {
+	// Whether the events are allowed.
+	Allowed bool
+
+	// The number of events of the key that remain in the window after
+	// this decision.
+	Remaining int
+
+	// How long to wait before the events would be allowed, if they
+	// aren't.
+	RetryAfter time.Duration
+
+	// How long until the oldest of the key's events leaves the window,
+	// or zero if the key has none, or the zone's algorithm doesn't
+	// tell.
+	Reset time.Duration
+
+	// The zone's current limit of events per key, and its window.
+	Limit  int
+	Window time.Duration
+}
+
+// Allow implements RateLimiterProvider. Zones are limited locally; with
+// distributed rate limiting, the events of other instances are not
+// taken into account.
+func (*RateLimitApp) Allow(_ context.Context, zone, key string, cost int) (Decision, error) {
+	rlm, ok := zoneLimiters(zone)
+	if !ok {
+		return Decision{}, fmt.Errorf("unknown zone %s", zone)
+	}
+	return rlm.allow(key, cost)
+}
+
+// allow counts cost events of key if they are allowed.
+func (rlm *rateLimitersMap) allow(key string, cost int) (Decision, error) {
+	maxEvents, window := rlm.limits()
+	d := Decision{Limit: maxEvents, Window: window}
+	if cost < 1 {
+		return Decision{}, fmt.Errorf("cost must be at least 1")
+	}
+
+	if wait := max(rlm.banned(key), rlm.backedOff(key)); wait > 0 {
+		d.RetryAfter = wait
+		return d, nil
+	}
+	if rlm.observation.Load().observe(key, window) {
+		d.Allowed, d.Remaining = true, maxEvents
+		return d, nil
+	}
+
+	if al := rlm.algorithm.Load(); al != nil {
+		limiter := al.limiter(key, maxEvents, window)
+		ref := now()
+		d.RetryAfter = limiter.Allow(ref, cost)
+		d.Allowed = d.RetryAfter == 0
+		d.Remaining = limiter.Remaining(ref)
+		return d, nil
+	}
+
+	limiter := rlm.getOrInsert(key)
+	d.RetryAfter = rlm.whenN(limiter, cost)
+	d.Allowed = d.RetryAfter == 0
+	ref := now()
+	count, oldest := limiter.Count(ref)
+	if count > 0 {
+		d.Reset = oldest.Add(window).Sub(ref)
+	}
+	d.Remaining = max(limiter.MaxEvents()-count, 0)
+	return d, nil
+}
+
+// Interface guards
+var _ RateLimiterProvider = (*RateLimitApp)(nil)
@@ -0,0 +1,56 @@
+package caddyrl
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestAllow(t *testing.T) {
+	initTime()
+
+	rlm := newTestZone(t, "api_zone", 5, time.Minute)
+	app := new(RateLimitApp)
+	allow := func(key string, cost int) Decision {
+		t.Helper()
+		d, err := app.Allow(context.Background(), "api_zone", key, cost)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return d
+	}
+
+	if d := allow("client", 2); !d.Allowed || d.Remaining != 3 || d.Limit != 5 || d.Window != time.Minute {
+		t.Errorf("unexpected decision: %+v", d)
+	}
+	advanceTime(10)
+	if d := allow("client", 3); !d.Allowed || d.Remaining != 0 {
+		t.Errorf("unexpected decision for the remaining events: %+v", d)
+	}
+
+	// 3 more events are allowed once the 2 events at 0s and the first
+	// of the events at 10s have left the window
+	advanceTime(20)
+	if d := allow("client", 3); d.Allowed || d.Remaining != 0 || d.RetryAfter != 50*time.Second {
+		t.Errorf("unexpected decision for exceeding the limit: %+v", d)
+	}
+	advanceTime(75)
+	if d := allow("client", 2); !d.Allowed || d.Remaining != 3 {
+		t.Errorf("unexpected decision after events left the window: %+v", d)
+	}
+
+	if d := allow("other", 6); d.Allowed || d.RetryAfter != time.Minute {
+		t.Errorf("expected a cost above the limit to be declined, got %+v", d)
+	}
+	rlm.ban("banned", now().Add(time.Hour))
+	if d := allow("banned", 1); d.Allowed || d.RetryAfter != time.Hour {
+		t.Errorf("expected a banned key to be declined, got %+v", d)
+	}
+
+	if _, err := app.Allow(context.Background(), "api_zone", "client", 0); err == nil {
+		t.Error("expected an error for a cost of 0")
+	}
+	if _, err := app.Allow(context.Background(), "missing", "client", 1); err == nil {
+		t.Error("expected an error for an unknown zone")
+	}
+}
@@ -1,42 +1,349 @@
 package caddyrl
 
-import "github.com/caddyserver/caddy/v2"
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+)
 
 const moduleName = "rate_limit"
 
 func init() {
-	caddy.RegisterModule(RateLimitApp{})
+	caddy.RegisterModule(new(RateLimitApp))
 }
 
 type RateLimitApp struct {
 	Metrics MetricsConfig `json:"metrics"`
+
+	// Maximum number of bytes that the state of all zones may use
+	// together. When it is exceeded, the least recently used keys of
+	// every zone are evicted in proportion to the zone's memory usage,
+	// which resets their quotas. It is enforced every 10 seconds and
+	// is approximate. Default: 0 (no limit)
+	MaxMemory int64 `json:"max_memory,omitempty"`
+
+	// Tightens the limits of all zones while the process's CPU usage,
+	// memory or goroutine count crosses a threshold, to protect the
+	// instance from overload.
+	LoadShedding *LoadShedding `json:"load_shedding,omitempty"`
+
+	// Named rate limit policies, which zones can be based on by setting
+	// their `policy`. A policy has the same fields as a zone, except for
+	// `zone_name` and `policy`.
+	Policies map[string]*RateLimit `json:"policies,omitempty"`
+
+	// A zone that every request passing through a rate_limit handler is
+	// limited in, after the zones of the handler, regardless of how they
+	// are tuned; e.g. a total request budget that protects the whole
+	// instance from overload. A request is counted once, even if it passes
+	// through several handlers. It has the same fields as a zone, except
+	// for `policy`; `zone_name` defaults to "global".
+	Global *RateLimit `json:"global,omitempty"`
+
+	// Settings that all handlers and zones inherit unless they set
+	// their own.
+	Defaults HandlerDefaults `json:"defaults"`
+
+	// Storage backend through which handlers sync distributed rate
+	// limit state, unless they configure their own. If not set, the
+	// global storage configuration is used.
+	StorageRaw json.RawMessage `json:"storage,omitempty" caddy:"namespace=caddy.storage inline_key=module"`
+
+	// A path under which handlers keep their state in storage, unless
+	// they set their own; see the handler's `storage_namespace`.
+	StorageNamespace string `json:"storage_namespace,omitempty"`
+
+	// TLS of connections to remote backends that carry quota state.
+	BackendTLS *BackendTLS `json:"backend_tls,omitempty"`
+
+	// Pools of connections to remote backends that carry quota state.
+	BackendPool *BackendPool `json:"backend_pool,omitempty"`
+
+	storage      certmagic.Storage
+	zones        map[string]*RateLimit
+	renamed      map[string]string // old zone names to new ones
+	zonesMu      sync.Mutex
+	logger       *zap.Logger
+	stopBudget   context.CancelFunc
+	stopShedding context.CancelFunc
+	metricsQueue *metricsQueue
+}
+
+// HandlerDefaults are settings that rate_limit handlers and their zones
+// inherit unless they set their own, to avoid repeating them and letting
+// them drift apart across many sites.
+type HandlerDefaults struct {
+	// Settings of every zone, written like a policy. A zone's own policy
+	// takes precedence over them.
+	Zone *RateLimit `json:"zone,omitempty"`
+
+	// Default jitter of handlers.
+	Jitter float64 `json:"jitter,omitempty"`
+
+	// If true, handlers log the key of declined requests.
+	LogKey bool `json:"log_key,omitempty"`
+
+	// Default sweep interval of handlers.
+	SweepInterval caddy.Duration `json:"sweep_interval,omitempty"`
 }
 
 type MetricsConfig struct {
 	IncludeKey bool `json:"include_key,omitempty"`
+
+	// Maximum number of distinct key label values per zone when
+	// include_key is enabled. Further keys are reported under the
+	// `__other__` label, so that many distinct keys (e.g. from a botnet)
+	// cannot blow up the metrics system's memory. Default: 0 (no limit)
+	MaxKeysPerZone int `json:"max_keys_per_zone,omitempty"`
+
+	// If true, per-key metrics are labeled with a short, stable hash of
+	// the key instead of the key itself, so that keys containing personal
+	// data (emails, tokens, IP addresses...) are not exported.
+	HashKeys bool `json:"hash_keys,omitempty"`
+
+	// A placeholder whose value is the `tenant` label of the
+	// requests_total and declined_requests_total metrics, e.g.
+	// `{http.request.header.X-Customer-ID}`, so that per-customer
+	// dashboards and alerts don't need per-key metrics. Handlers with a
+	// tenant label these metrics with their tenant instead, and the
+	// keys_total gauge of their zones too. Every value is a series of
+	// its own, so use placeholders with few values.
+	Tenant string `json:"tenant,omitempty"`
+
+	// Upper bounds, in seconds, of the buckets of the process_time_seconds
+	// histogram. They must be strictly increasing. Because metrics are
+	// registered once per process, changes take effect after a restart.
+	// Default: .001, .005, .01, .025, .05, .1, .25, .5, 1
+	ProcessTimeBuckets []float64 `json:"process_time_buckets,omitempty"`
+
+	// Sends the same measurements to a StatsD or DogStatsD agent,
+	// whether or not Caddy's Prometheus metrics are enabled.
+	StatsD *StatsDExporter `json:"statsd,omitempty"`
+
+	// Pushes the same metrics to an OpenTelemetry collector over OTLP,
+	// whether or not Caddy's Prometheus metrics are enabled.
+	OTLP *OTLPExporter `json:"otlp,omitempty"`
+
+	// If greater than zero, per-request measurements are queued in a
+	// buffer of this size and recorded by a background worker, so that
+	// requests don't wait for label lookups and observations. If the
+	// buffer is full, measurements are recorded while serving the
+	// request. Default: 0 (record while serving requests)
+	AsyncBuffer int `json:"async_buffer,omitempty"`
 }
 
-func (RateLimitApp) CaddyModule() caddy.ModuleInfo {
+func (*RateLimitApp) CaddyModule() caddy.ModuleInfo {
 	return caddy.ModuleInfo{
 		ID:  moduleName,
 		New: func() caddy.Module { return new(RateLimitApp) },
 	}
 }
 
-func (s RateLimitApp) Provision(_ caddy.Context) error {
+func (s *RateLimitApp) Provision(ctx caddy.Context) error {
+	s.logger = ctx.Logger()
+	if s.MaxMemory < 0 {
+		return fmt.Errorf("max_memory must be at least zero")
+	}
+	if s.LoadShedding != nil {
+		if err := s.LoadShedding.provision(s.logger); err != nil {
+			return fmt.Errorf("setting up load shedding: %v", err)
+		}
+	}
+	if s.Defaults.Zone != nil && s.Defaults.Zone.Policy != "" {
+		return fmt.Errorf("zone defaults cannot be based on a policy")
+	}
+	for name, policy := range s.Policies {
+		if policy == nil {
+			return fmt.Errorf("policy %s is empty", name)
+		}
+		if policy.Policy != "" {
+			return fmt.Errorf("policy %s: policies cannot be based on other policies", name)
+		}
+	}
+	if len(s.StorageRaw) > 0 {
+		val, err := ctx.LoadModule(s, "StorageRaw")
+		if err != nil {
+			return fmt.Errorf("loading storage module: %v", err)
+		}
+		stor, err := val.(caddy.StorageConverter).CertMagicStorage()
+		if err != nil {
+			return fmt.Errorf("creating storage value: %v", err)
+		}
+		s.storage = stor
+	}
+	if err := validateStorageNamespace(s.StorageNamespace); err != nil {
+		return err
+	}
+	if s.BackendTLS != nil {
+		// fail on unreadable files when the config is loaded, rather
+		// than when ownership is set up
+		if _, err := s.BackendTLS.config(); err != nil {
+			return fmt.Errorf("setting up backend TLS: %v", err)
+		}
+	}
+	if s.BackendPool != nil {
+		if err := s.BackendPool.provision(); err != nil {
+			return fmt.Errorf("setting up backend pool: %v", err)
+		}
+	}
+	if s.Metrics.MaxKeysPerZone < 0 {
+		return fmt.Errorf("max_keys_per_zone must be at least zero")
+	}
+	if s.Metrics.AsyncBuffer < 0 {
+		return fmt.Errorf("async_buffer must be at least zero")
+	}
+	if s.Metrics.AsyncBuffer > 0 {
+		s.metricsQueue = newMetricsQueue(s.Metrics.AsyncBuffer)
+	}
+	for i, bound := range s.Metrics.ProcessTimeBuckets {
+		if i > 0 && bound <= s.Metrics.ProcessTimeBuckets[i-1] {
+			return fmt.Errorf("process_time_buckets must be strictly increasing")
+		}
+	}
+	if s.Metrics.StatsD != nil {
+		if err := s.Metrics.StatsD.provision(); err != nil {
+			return fmt.Errorf("setting up statsd exporter: %v", err)
+		}
+	}
+	if s.Metrics.OTLP != nil {
+		if err := s.Metrics.OTLP.provision(ctx.GetMetricsRegistry()); err != nil {
+			return fmt.Errorf("setting up otlp exporter: %v", err)
+		}
+	}
+	if s.Global != nil {
+		if err := s.provisionGlobal(ctx); err != nil {
+			return fmt.Errorf("setting up global zone: %v", err)
+		}
+	}
+	return nil
+}
+
+// provisionGlobal sets up the global zone.
+func (s *RateLimitApp) provisionGlobal(ctx caddy.Context) error {
+	if s.Global.ZoneName == "" {
+		s.Global.ZoneName = "global"
+	}
+	if s.Global.Policy != "" {
+		return fmt.Errorf("the global zone cannot be based on a policy")
+	}
+	if !newKeyTemplate(s.Global.ZoneName).static {
+		return fmt.Errorf("the global zone's name cannot have placeholders")
+	}
+	if err := s.Global.applyPreset(); err != nil {
+		return err
+	}
+	if _, err := unknownPlaceholders(s.Global.Key); err != nil {
+		return fmt.Errorf("invalid key '%s': %v", s.Global.Key, err)
+	}
+	if err := s.registerZone(s.Global); err != nil {
+		return err
+	}
+	return s.Global.provision(ctx, s.Global.ZoneName)
+}
+
+// registerZone records a zone defined by a handler. Handlers share the
+// state of zones with the same name, which is only sensible if they
+// define the zone the same way, so differing definitions are an error.
+func (s *RateLimitApp) registerZone(rl *RateLimit) error {
+	s.zonesMu.Lock()
+	defer s.zonesMu.Unlock()
+
+	// a zone that was renamed takes over the old name's state, which
+	// can't be shared with a zone that still has that name
+	if newName, ok := s.renamed[rl.ZoneName]; ok && newName != rl.ZoneName {
+		return fmt.Errorf("zone %s was renamed to %s, so it can't be defined anymore", rl.ZoneName, newName)
+	}
+	for _, oldName := range rl.RenamedFrom {
+		if _, ok := s.zones[oldName]; ok {
+			return fmt.Errorf("zone %s was renamed to %s, so it can't be defined anymore", oldName, rl.ZoneName)
+		}
+		if newName, ok := s.renamed[oldName]; ok && newName != rl.ZoneName {
+			return fmt.Errorf("zone %s is renamed to both %s and %s", oldName, newName, rl.ZoneName)
+		}
+		if s.renamed == nil {
+			s.renamed = make(map[string]string)
+		}
+		s.renamed[oldName] = rl.ZoneName
+	}
+
+	other, ok := s.zones[rl.ZoneName]
+	if !ok {
+		if s.zones == nil {
+			s.zones = make(map[string]*RateLimit)
+		}
+		s.zones[rl.ZoneName] = rl
+		return nil
+	}
+	if string(other.AlgorithmRaw) != string(rl.AlgorithmRaw) {
+		return fmt.Errorf("zone %s is defined more than once with different algorithms; use distinct zone names", rl.ZoneName)
+	}
+	if other.Key != rl.Key || other.MaxEvents != rl.MaxEvents || other.Window != rl.Window {
+		return fmt.Errorf("zone %s is defined more than once with different settings (key '%s', %d events per %s vs. key '%s', %d events per %s); use distinct zone names",
+			rl.ZoneName, other.Key, other.MaxEvents, time.Duration(other.Window), rl.Key, rl.MaxEvents, time.Duration(rl.Window))
+	}
 	return nil
 }
 
-func (RateLimitApp) Start() error {
+func (s *RateLimitApp) Start() error {
+	if s.MaxMemory > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		s.stopBudget = cancel
+		go enforceMemoryBudget(ctx, s.MaxMemory, s.logger)
+	}
+	if s.LoadShedding != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		s.stopShedding = cancel
+		go s.LoadShedding.run(ctx)
+	}
+	if s.metricsQueue != nil {
+		s.metricsQueue.start()
+	}
+	if s.Metrics.OTLP != nil {
+		return s.Metrics.OTLP.start(context.Background())
+	}
 	return nil
 }
 
-func (RateLimitApp) Stop() error {
+func (s *RateLimitApp) Stop() error {
+	if s.stopBudget != nil {
+		s.stopBudget()
+	}
+	if s.stopShedding != nil {
+		s.stopShedding()
+	}
+	if s.metricsQueue != nil {
+		s.metricsQueue.stop()
+	}
+	if s.Metrics.OTLP != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := s.Metrics.OTLP.stop(ctx); err != nil {
+			return err
+		}
+	}
+	if s.Metrics.StatsD != nil {
+		return s.Metrics.StatsD.close()
+	}
+	return nil
+}
+
+// Cleanup cleans up the app.
+func (s *RateLimitApp) Cleanup() error {
+	if s.Global != nil && s.Global.limitersMap != nil {
+		rateLimits.Delete(s.Global.ZoneName)
+	}
 	return nil
 }
 
 var (
-	_ caddy.App         = (*RateLimitApp)(nil)
-	_ caddy.Module      = (*RateLimitApp)(nil)
-	_ caddy.Provisioner = (*RateLimitApp)(nil)
+	_ caddy.App          = (*RateLimitApp)(nil)
+	_ caddy.Module       = (*RateLimitApp)(nil)
+	_ caddy.Provisioner  = (*RateLimitApp)(nil)
+	_ caddy.CleanerUpper = (*RateLimitApp)(nil)
 )
@@ -0,0 +1,77 @@
+package caddyrl
+
+import (
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestRegisterZone(t *testing.T) {
+	app := new(RateLimitApp)
+	zone := func(maxEvents int) *RateLimit {
+		return &RateLimit{ZoneName: "shared", Key: "static", Window: caddy.Duration(time.Minute), MaxEvents: maxEvents}
+	}
+
+	if err := app.registerZone(zone(10)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := app.registerZone(zone(10)); err != nil {
+		t.Fatalf("handlers should be able to share a zone defined the same way: %v", err)
+	}
+	if err := app.registerZone(zone(20)); err == nil {
+		t.Fatal("expected error for zone defined with different limits")
+	}
+}
+
+func TestRegisterRenamedZone(t *testing.T) {
+	zone := func(name string, renamedFrom ...string) *RateLimit {
+		return &RateLimit{ZoneName: name, RenamedFrom: renamedFrom, Key: "static", Window: caddy.Duration(time.Minute), MaxEvents: 10}
+	}
+
+	app := new(RateLimitApp)
+	if err := app.registerZone(zone("new", "old")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := app.registerZone(zone("new", "old")); err != nil {
+		t.Fatalf("handlers should be able to share a renamed zone: %v", err)
+	}
+	if err := app.registerZone(zone("old")); err == nil {
+		t.Error("expected an error for a zone with the old name")
+	}
+	if err := app.registerZone(zone("other", "old")); err == nil {
+		t.Error("expected an error for renaming a zone twice")
+	}
+
+	app = new(RateLimitApp)
+	if err := app.registerZone(zone("old")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := app.registerZone(zone("new", "old")); err == nil {
+		t.Error("expected an error for renaming a zone that is still defined")
+	}
+}
+
+func TestGlobalZone(t *testing.T) {
+	app := &RateLimitApp{Global: &RateLimit{Key: "static", Window: caddy.Duration(time.Second), MaxEvents: 2}}
+	if err := app.provisionGlobal(caddy.Context{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	t.Cleanup(func() { app.Cleanup() })
+	if app.Global.ZoneName != "global" {
+		t.Fatalf("expected default zone name, got %q", app.Global.ZoneName)
+	}
+	if _, ok := zoneLimiters("global"); !ok {
+		t.Fatal("expected the global zone to be registered")
+	}
+
+	for _, global := range []*RateLimit{
+		{ZoneName: "global_{http.request.host}", Window: caddy.Duration(time.Second), MaxEvents: 2},
+		{Policy: "per_ip"},
+	} {
+		app := &RateLimitApp{Global: global}
+		if err := app.provisionGlobal(caddy.Context{}); err == nil {
+			t.Errorf("expected error for global zone %+v", global)
+		}
+	}
+}
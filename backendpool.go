@@ -0,0 +1,136 @@
+package caddyrl
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// BackendPool tunes the pools of connections to remote backends that
+// carry quota state, i.e. the other instances that key ownership
+// forwards events to. Go's defaults keep only two idle connections per
+// backend, so under load most events would open a new connection.
+// Limits are per backend. Connections over HTTP/2 carry many events at
+// once, so these settings mostly matter for HTTP/1.1.
+type BackendPool struct {
+	// The most connections to a backend, including those in use; events
+	// beyond it wait for a connection. Default: 0 (no limit)
+	MaxConns int `json:"max_conns,omitempty"`
+
+	// The most idle connections that are kept open to a backend for
+	// later events. Default: 64
+	MaxIdleConns int `json:"max_idle_conns,omitempty"`
+
+	// The number of connections that are opened to each backend ahead
+	// of events, whenever the owners of keys are updated from storage,
+	// so that bursts don't wait on connecting. Default: 0
+	MinIdleConns int `json:"min_idle_conns,omitempty"`
+
+	// How long an idle connection is kept open. Default: 90s
+	IdleTimeout caddy.Duration `json:"idle_timeout,omitempty"`
+
+	// How long a connection is used before it is replaced, e.g. so that
+	// connections are spread again over backends behind a load balancer
+	// or pick up DNS changes. Default: 0 (forever)
+	MaxLifetime caddy.Duration `json:"max_lifetime,omitempty"`
+
+	// How long connecting to a backend may take, including the TLS
+	// handshake. Default: 0 (only limited by the timeout of the call)
+	DialTimeout caddy.Duration `json:"dial_timeout,omitempty"`
+}
+
+func (bp *BackendPool) provision() error {
+	if bp.MaxConns < 0 || bp.MaxIdleConns < 0 || bp.MinIdleConns < 0 {
+		return fmt.Errorf("connection counts must be at least zero")
+	}
+	if bp.IdleTimeout < 0 || bp.MaxLifetime < 0 || bp.DialTimeout < 0 {
+		return fmt.Errorf("durations must be at least zero")
+	}
+	if bp.MaxIdleConns == 0 {
+		bp.MaxIdleConns = 64
+	}
+	if bp.MaxConns > 0 {
+		bp.MaxIdleConns = min(bp.MaxIdleConns, bp.MaxConns)
+	}
+	if bp.IdleTimeout == 0 {
+		bp.IdleTimeout = caddy.Duration(90 * time.Second)
+	}
+	return nil
+}
+
+// client returns an HTTP client whose calls time out after timeout,
+// with connections pooled as configured and secured by tlsConfig, if
+// not nil.
+func (bp *BackendPool) client(timeout time.Duration, tlsConfig *tls.Config) *http.Client {
+	pt := &pooledTransport{pool: bp, tlsConfig: tlsConfig, timeout: timeout}
+	return &http.Client{Timeout: timeout, Transport: pt}
+}
+
+// pooledTransport pools connections to backends, and replaces all of
+// them every MaxLifetime by starting over with a new pool.
+type pooledTransport struct {
+	pool      *BackendPool
+	tlsConfig *tls.Config
+	timeout   time.Duration // of calls, after which old pools are idle
+
+	mu      sync.Mutex
+	current *http.Transport
+	expires time.Time
+}
+
+func (pt *pooledTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return pt.transport().RoundTrip(req)
+}
+
+// transport returns the current pool, replacing it if it is too old.
+func (pt *pooledTransport) transport() *http.Transport {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	if pt.current != nil && (pt.pool.MaxLifetime == 0 || now().Before(pt.expires)) {
+		return pt.current
+	}
+	if old := pt.current; old != nil {
+		// connections still in use are closed once their calls ended
+		old.CloseIdleConnections()
+		time.AfterFunc(pt.timeout, old.CloseIdleConnections)
+	}
+	dialer := &net.Dialer{Timeout: time.Duration(pt.pool.DialTimeout), KeepAlive: 30 * time.Second}
+	pt.current = &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         dialer.DialContext,
+		TLSClientConfig:     pt.tlsConfig,
+		TLSHandshakeTimeout: time.Duration(pt.pool.DialTimeout),
+		ForceAttemptHTTP2:   true,
+		MaxConnsPerHost:     pt.pool.MaxConns,
+		MaxIdleConnsPerHost: pt.pool.MaxIdleConns,
+		IdleConnTimeout:     time.Duration(pt.pool.IdleTimeout),
+	}
+	pt.expires = now().Add(time.Duration(pt.pool.MaxLifetime))
+	return pt.current
+}
+
+// warm opens MinIdleConns connections to each of the backends at urls,
+// if they aren't open already, with as many concurrent HEAD requests.
+func (bp *BackendPool) warm(ctx context.Context, client *http.Client, urls []string) {
+	var wg sync.WaitGroup
+	for _, u := range urls {
+		for range bp.MinIdleConns {
+			wg.Go(func() {
+				req, err := http.NewRequestWithContext(ctx, http.MethodHead, u, nil)
+				if err != nil {
+					return
+				}
+				if resp, err := client.Do(req); err == nil {
+					resp.Body.Close()
+				}
+			})
+		}
+	}
+	wg.Wait()
+}
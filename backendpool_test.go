@@ -0,0 +1,110 @@
+package caddyrl
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+)
+
+func TestBackendPool(t *testing.T) {
+	initTime()
+
+	var conns atomic.Int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	bp := &BackendPool{MaxConns: 8, MaxIdleConns: 100, MinIdleConns: 3, MaxLifetime: caddy.Duration(time.Minute)}
+	if err := bp.provision(); err != nil {
+		t.Fatal(err)
+	}
+	if bp.MaxIdleConns != 8 || bp.IdleTimeout != caddy.Duration(90*time.Second) {
+		t.Errorf("unexpected defaults: %+v", bp)
+	}
+	client := bp.client(time.Second, nil)
+
+	// warming opens the minimum of idle connections, which later
+	// events use
+	bp.warm(context.Background(), client, []string{srv.URL})
+	if n := conns.Load(); n != 3 {
+		t.Fatalf("expected 3 connections to be opened ahead of events, got %d", n)
+	}
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if n := conns.Load(); n != 3 {
+		t.Errorf("expected the event to use an open connection, got %d connections", n)
+	}
+
+	// connections are replaced after their lifetime
+	pt := client.Transport.(*pooledTransport)
+	first := pt.transport()
+	advanceTime(30)
+	if pt.transport() != first {
+		t.Error("expected the pool to be kept within its lifetime")
+	}
+	advanceTime(61)
+	if pt.transport() == first {
+		t.Error("expected the pool to be replaced after its lifetime")
+	}
+
+	if err := (&BackendPool{MinIdleConns: -1}).provision(); err == nil {
+		t.Error("expected an error for a negative count")
+	}
+}
+
+func TestCaddyfileBackendPool(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`
+	rate_limit {
+		backend_pool {
+			max_conns      256
+			max_idle_conns 128
+			min_idle_conns 8
+			idle_timeout   1m
+			max_lifetime   10m
+			dial_timeout   200ms
+		}
+	}`)
+
+	parsed, err := parseGlobalRateLimitMetrics(d, nil)
+	if err != nil {
+		t.Fatalf("unmarshaling Caddyfile: %v", err)
+	}
+	var app RateLimitApp
+	if err := json.Unmarshal(parsed.(httpcaddyfile.App).Value, &app); err != nil {
+		t.Fatal(err)
+	}
+	bp := app.BackendPool
+	if bp == nil || bp.MaxConns != 256 || bp.MaxIdleConns != 128 || bp.MinIdleConns != 8 ||
+		bp.IdleTimeout != caddy.Duration(time.Minute) || bp.MaxLifetime != caddy.Duration(10*time.Minute) ||
+		bp.DialTimeout != caddy.Duration(200*time.Millisecond) {
+		t.Errorf("unexpected backend pool: %+v", bp)
+	}
+
+	if _, err := parseGlobalRateLimitMetrics(caddyfile.NewTestDispenser(`rate_limit {
+		backend_pool {
+			max_conns lots
+		}
+	}`), nil); err == nil {
+		t.Error("expected an error for an invalid count")
+	}
+}
@@ -0,0 +1,80 @@
+package caddyrl
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"os"
+)
+
+// BackendTLS secures the connections to remote backends that carry
+// quota state, i.e. the other instances that key ownership forwards
+// events to, so that the state doesn't cross the network in cleartext.
+// Storage modules are configured with their own TLS settings.
+type BackendTLS struct {
+	// PEM files of the CA certificates that backends' certificates must
+	// be issued by, which pins them instead of the system's roots.
+	CAFiles []string `json:"ca_files,omitempty"`
+
+	// PEM files of the client certificate and its key that are
+	// presented to backends which require mutual TLS.
+	ClientCertFile string `json:"client_cert_file,omitempty"`
+	ClientKeyFile  string `json:"client_key_file,omitempty"`
+
+	// The name that backends' certificates are verified against, if it
+	// differs from the host of their URL, e.g. when instances advertise
+	// IP addresses.
+	ServerName string `json:"server_name,omitempty"`
+
+	// If true, backends must be reached over HTTPS; URLs with other
+	// schemes are refused.
+	Require bool `json:"require,omitempty"`
+}
+
+// config returns the TLS configuration of connections to backends.
+func (bt *BackendTLS) config() (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: bt.ServerName,
+	}
+	if len(bt.CAFiles) > 0 {
+		cfg.RootCAs = x509.NewCertPool()
+		for _, file := range bt.CAFiles {
+			pem, err := os.ReadFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("reading CA file: %v", err)
+			}
+			if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates in CA file %s", file)
+			}
+		}
+	}
+	if (bt.ClientCertFile == "") != (bt.ClientKeyFile == "") {
+		return nil, fmt.Errorf("client_cert_file and client_key_file must be set together")
+	}
+	if bt.ClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(bt.ClientCertFile, bt.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// allows returns an error if rawURL may not be reached, because TLS is
+// required and it isn't an HTTPS URL.
+func (bt *BackendTLS) allows(rawURL string) error {
+	if bt == nil || !bt.Require {
+		return nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "https" {
+		return fmt.Errorf("backend TLS is required, but %s isn't an https URL", rawURL)
+	}
+	return nil
+}
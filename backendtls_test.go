@@ -0,0 +1,104 @@
+package caddyrl
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+)
+
+func TestBackendTLS(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer srv.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(caFile, caPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// only backends with certificates of the pinned CA are trusted
+	get := func(bt *BackendTLS) error {
+		tlsConfig, err := bt.config()
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+		resp, err := client.Get(srv.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	if err := get(&BackendTLS{CAFiles: []string{caFile}, ServerName: "example.com"}); err != nil {
+		t.Errorf("expected the pinned CA to be trusted, got %v", err)
+	}
+	if err := get(&BackendTLS{}); err == nil {
+		t.Error("expected the test server's certificate not to be trusted without the pinned CA")
+	}
+
+	for _, bt := range []*BackendTLS{
+		{CAFiles: []string{filepath.Join(t.TempDir(), "missing.pem")}},
+		{CAFiles: []string{os.DevNull}},
+		{ClientCertFile: caFile},
+	} {
+		if _, err := bt.config(); err == nil {
+			t.Errorf("expected an error for %+v", bt)
+		}
+	}
+
+	// required TLS refuses cleartext URLs
+	required := &BackendTLS{Require: true}
+	if err := required.allows("http://10.0.0.5:8080/decide"); err == nil {
+		t.Error("expected an http URL to be refused")
+	}
+	if err := required.allows("https://10.0.0.5:8443/decide"); err != nil {
+		t.Errorf("expected an https URL to be allowed, got %v", err)
+	}
+	if err := (*BackendTLS)(nil).allows("http://10.0.0.5:8080"); err != nil {
+		t.Errorf("expected any URL to be allowed without backend TLS, got %v", err)
+	}
+	if err := (&KeyOwnership{Advertise: "http://10.0.0.5:8080", Secret: "s"}).provision("self", required, nil, nil); err == nil {
+		t.Error("expected a cleartext advertise URL to be refused")
+	}
+}
+
+func TestCaddyfileBackendTLS(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`
+	rate_limit {
+		backend_tls {
+			ca          /etc/caddy/ca1.pem /etc/caddy/ca2.pem
+			client_cert /etc/caddy/instance.pem /etc/caddy/instance-key.pem
+			server_name rate-limit.internal
+			require
+		}
+	}`)
+
+	parsed, err := parseGlobalRateLimitMetrics(d, nil)
+	if err != nil {
+		t.Fatalf("unmarshaling Caddyfile: %v", err)
+	}
+	var app RateLimitApp
+	if err := json.Unmarshal(parsed.(httpcaddyfile.App).Value, &app); err != nil {
+		t.Fatal(err)
+	}
+	bt := app.BackendTLS
+	if bt == nil || len(bt.CAFiles) != 2 || bt.ClientCertFile != "/etc/caddy/instance.pem" ||
+		bt.ClientKeyFile != "/etc/caddy/instance-key.pem" || bt.ServerName != "rate-limit.internal" || !bt.Require {
+		t.Errorf("unexpected backend TLS: %+v", bt)
+	}
+
+	if _, err := parseGlobalRateLimitMetrics(caddyfile.NewTestDispenser(`rate_limit {
+		backend_tls {
+			client_cert /etc/caddy/instance.pem
+		}
+	}`), nil); err == nil {
+		t.Error("expected an error for a client certificate without a key")
+	}
+}
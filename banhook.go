@@ -0,0 +1,162 @@
+package caddyrl
+
+import (
+	"context"
+	"fmt"
+	"hash/maphash"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// BanExecHook runs commands when a key is banned or its ban ends, so
+// that bans can be pushed to firewalls (nftables, cloud WAFs...) too.
+//
+// Commands are run directly, not through a shell. In each argument,
+// `{zone}` and `{key}` are replaced with the zone name and the key.
+// The command's environment also contains RATE_LIMIT_EVENT,
+// RATE_LIMIT_ZONE and RATE_LIMIT_KEY, plus RATE_LIMIT_EXPIRES (RFC 3339)
+// when a ban begins. Since keys are derived from requests, avoid passing
+// them to a shell unquoted; keys that start with "-", which commands
+// would take for options, are never substituted for `{key}`.
+//
+// Commands run in the background, a few at a time, and the events of
+// each key run in the order they happened, so that a ban's command
+// finishes before the command of its end starts. If commands fall
+// behind, new events are dropped rather than starting more processes.
+type BanExecHook struct {
+	// The command and its arguments to run when a ban begins.
+	OnBan []string `json:"on_ban,omitempty"`
+
+	// The command and its arguments to run when a ban ends.
+	OnUnban []string `json:"on_unban,omitempty"`
+
+	// Maximum time a command may run before it is killed. Default: 30s
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	ctx    context.Context
+	queues []chan banHookEvent
+	seed   maphash.Seed
+	logger *zap.Logger
+}
+
+// banHookWorkers is the number of commands of a hook that run at once,
+// and banHookQueue the number of events that each of them queues.
+const (
+	banHookWorkers = 4
+	banHookQueue   = 64
+)
+
+// banHookEvent is an event whose command is waiting to run.
+type banHookEvent struct {
+	command []string
+	name    string
+	data    map[string]any
+}
+
+func (bh *BanExecHook) provision(ctx caddy.Context, logger *zap.Logger) error {
+	if len(bh.OnBan) == 0 && len(bh.OnUnban) == 0 {
+		return fmt.Errorf("at least one of on_ban or on_unban is required")
+	}
+	if bh.Timeout < 0 {
+		return fmt.Errorf("timeout must be at least zero")
+	}
+	if bh.Timeout == 0 {
+		bh.Timeout = caddy.Duration(30 * time.Second)
+	}
+	bh.ctx = ctx
+	bh.logger = logger
+
+	// the events of a key always go to the same worker, which runs
+	// them in order
+	bh.seed = maphash.MakeSeed()
+	bh.queues = make([]chan banHookEvent, banHookWorkers)
+	for i := range bh.queues {
+		bh.queues[i] = make(chan banHookEvent, banHookQueue)
+		go bh.work(bh.queues[i])
+	}
+	return nil
+}
+
+// observe queues the configured command to run in the background if
+// the event is the beginning or end of a ban. It never blocks.
+func (bh *BanExecHook) observe(name string, data map[string]any) {
+	var command []string
+	switch name {
+	case eventBan:
+		command = bh.OnBan
+	case eventUnban:
+		command = bh.OnUnban
+	}
+	if len(command) == 0 {
+		return
+	}
+
+	zone, _ := data["zone"].(string)
+	key, _ := data["key"].(string)
+	queue := bh.queues[maphash.String(bh.seed, zone+"\x00"+key)%uint64(len(bh.queues))]
+	select {
+	case queue <- banHookEvent{command: command, name: name, data: data}:
+	default:
+		bh.logger.Warn("ban hook queue is full; dropping event",
+			zap.String("event", name),
+			zap.String("zone", zone),
+			zap.String("key", key))
+	}
+}
+
+// work runs the commands of queued events, one at a time, until the
+// hook's context is done.
+func (bh *BanExecHook) work(queue <-chan banHookEvent) {
+	for {
+		select {
+		case ev := <-queue:
+			if err := bh.run(ev.command, ev.name, ev.data); err != nil {
+				bh.logger.Error("running ban hook",
+					zap.String("event", ev.name),
+					zap.Strings("command", ev.command),
+					zap.Error(err))
+			}
+		case <-bh.ctx.Done():
+			return
+		}
+	}
+}
+
+// run runs command for the given event and waits for it to finish.
+func (bh *BanExecHook) run(command []string, name string, data map[string]any) error {
+	zone, _ := data["zone"].(string)
+	key, _ := data["key"].(string)
+
+	repl := strings.NewReplacer("{zone}", zone, "{key}", key)
+	args := make([]string, len(command))
+	for i, arg := range command {
+		if strings.HasPrefix(key, "-") && strings.Contains(arg, "{key}") {
+			return fmt.Errorf("key %q would be taken for an option", key)
+		}
+		args[i] = repl.Replace(arg)
+	}
+
+	ctx, cancel := context.WithTimeout(bh.ctx, time.Duration(bh.Timeout))
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Env = append(os.Environ(),
+		"RATE_LIMIT_EVENT="+name,
+		"RATE_LIMIT_ZONE="+zone,
+		"RATE_LIMIT_KEY="+key,
+	)
+	if expires, ok := data["expires"].(time.Time); ok {
+		cmd.Env = append(cmd.Env, "RATE_LIMIT_EXPIRES="+expires.Format(time.RFC3339))
+	}
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, output)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package caddyrl
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func TestBanExecHook(t *testing.T) {
+	initTime()
+
+	out := filepath.Join(t.TempDir(), "out")
+	bh := &BanExecHook{
+		OnBan:   []string{"sh", "-c", `printf '%s %s %s %s' "$1" "$RATE_LIMIT_EVENT" "$RATE_LIMIT_ZONE" "$RATE_LIMIT_KEY" > "$2"`, "sh", "{zone}/{key}", out},
+		Timeout: caddy.Duration(5 * time.Second),
+		ctx:     context.Background(),
+	}
+
+	err := bh.run(bh.OnBan, eventBan, map[string]any{
+		"zone":    "zone1",
+		"key":     "10.0.0.1",
+		"expires": now().Add(time.Minute),
+	})
+	if err != nil {
+		t.Fatalf("running hook: %v", err)
+	}
+
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("reading hook output: %v", err)
+	}
+	if want := "zone1/10.0.0.1 rate_limit.ban zone1 10.0.0.1"; string(got) != want {
+		t.Fatalf("unexpected hook output %q (wanted %q)", got, want)
+	}
+
+	if err := bh.run([]string{"false"}, eventBan, nil); err == nil {
+		t.Fatal("expected error from failing command")
+	}
+	if err := bh.run(bh.OnBan, eventBan, map[string]any{"zone": "zone1", "key": "-rf"}); err == nil {
+		t.Fatal("expected a key that looks like an option to be refused")
+	}
+}
+
+func TestBanExecHookOrder(t *testing.T) {
+	initTime()
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: t.Context()})
+	defer cancel()
+
+	// the ban's command is slower than that of its end, which must
+	// still run after it
+	out := filepath.Join(t.TempDir(), "out")
+	bh := &BanExecHook{
+		OnBan:   []string{"sh", "-c", `sleep 0.2; echo ban >> "$1"`, "sh", out},
+		OnUnban: []string{"sh", "-c", `echo unban >> "$1"`, "sh", out},
+	}
+	if err := bh.provision(ctx, zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+	data := map[string]any{"zone": "zone1", "key": "10.0.0.1"}
+	bh.observe(eventBan, data)
+	bh.observe(eventUnban, data)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got, _ := os.ReadFile(out)
+		if lines := strings.Fields(string(got)); len(lines) == 2 {
+			if lines[0] != "ban" || lines[1] != "unban" {
+				t.Fatalf("expected the ban's command before its end's, got %q", lines)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected both commands to run, got %q", got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,252 @@
+package caddyrl
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+)
+
+// BanPersistence keeps the bans of the handler's zones in storage, so
+// that they survive restarts and are shared by the instances that use
+// the same storage, whether or not they limit rates together with
+// distributed rate limiting. Bans and lifted bans are stored as they
+// happen, and bans of other instances are picked up every sync_interval.
+// Bans picked up from storage don't emit events on this instance.
+type BanPersistence struct {
+	// How often to pick up the bans of other instances from storage.
+	// Default: 10s
+	SyncInterval caddy.Duration `json:"sync_interval,omitempty"`
+
+	storage certmagic.Storage
+	logger  *zap.Logger
+	changes chan banChange
+
+	// bans as this instance knows them to be in storage
+	mu    sync.Mutex
+	known map[bannedKey]knownBan
+}
+
+type bannedKey struct {
+	zone, key string
+}
+
+type knownBan struct {
+	until time.Time
+
+	// whether the ban was stored, rather than waiting to be
+	stored bool
+}
+
+// storedBan is a ban as it is kept in storage.
+type storedBan struct {
+	Zone    string    `json:"zone"`
+	Key     string    `json:"key"`
+	Expires time.Time `json:"expires"`
+}
+
+// banChange is a ban to store, or one to delete if unban is true.
+type banChange struct {
+	ban   storedBan
+	unban bool
+}
+
+// banStoragePrefix is where bans are kept in storage.
+const banStoragePrefix = "rate_limit/bans"
+
+// maxPendingBanChanges is how many bans may wait to be stored; beyond
+// it, bans are only kept in memory.
+const maxPendingBanChanges = 1024
+
+func (bp *BanPersistence) provision(storage certmagic.Storage, logger *zap.Logger) error {
+	if bp.SyncInterval < 0 {
+		return fmt.Errorf("sync_interval must be at least zero")
+	}
+	if bp.SyncInterval == 0 {
+		bp.SyncInterval = caddy.Duration(10 * time.Second)
+	}
+	bp.storage = storage
+	bp.logger = logger
+	bp.changes = make(chan banChange, maxPendingBanChanges)
+	bp.known = make(map[bannedKey]knownBan)
+	return nil
+}
+
+// banStorageKey returns where the ban of key in zone is kept. Zone
+// names and keys may have any characters, so they are hashed.
+func banStorageKey(zone, key string) string {
+	sum := sha256.Sum256([]byte(zone + "\x00" + key))
+	return path.Join(banStoragePrefix, hex.EncodeToString(sum[:])+".json")
+}
+
+// observe queues bans and lifted bans to be stored.
+func (bp *BanPersistence) observe(name string, data map[string]any) {
+	zone, _ := data["zone"].(string)
+	key, _ := data["key"].(string)
+	bk := bannedKey{zone, key}
+
+	var change banChange
+	switch name {
+	case eventBan:
+		until, _ := data["expires"].(time.Time)
+		bp.mu.Lock()
+		bp.known[bk] = knownBan{until: until}
+		bp.mu.Unlock()
+		change = banChange{ban: storedBan{Zone: zone, Key: key, Expires: until}}
+
+	case eventUnban:
+		// bans that expired are deleted by sync; deleting them here
+		// could delete a later ban of another instance
+		bp.mu.Lock()
+		known, ok := bp.known[bk]
+		delete(bp.known, bk)
+		bp.mu.Unlock()
+		if !ok || !known.until.After(now()) {
+			return
+		}
+		change = banChange{ban: storedBan{Zone: zone, Key: key}, unban: true}
+
+	default:
+		return
+	}
+
+	select {
+	case bp.changes <- change:
+	default:
+		bp.logger.Warn("too many bans waiting to be stored; keeping ban in memory only",
+			zap.String("zone", zone),
+			zap.String("key", key))
+	}
+}
+
+// run picks up the bans in storage, then stores changes of bans in the
+// order they happened and syncs bans from storage every sync interval,
+// until ctx is done.
+func (bp *BanPersistence) run(ctx context.Context) {
+	labelTask(ctx, "ban_sync")
+	if err := bp.sync(ctx); err != nil && ctx.Err() == nil {
+		bp.logger.Error("syncing bans from storage", zap.Error(err))
+	}
+	ticker := time.NewTicker(time.Duration(bp.SyncInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case change := <-bp.changes:
+			if err := bp.store(ctx, change); err != nil && ctx.Err() == nil {
+				bp.logger.Error("storing ban",
+					zap.String("zone", change.ban.Zone),
+					zap.String("key", change.ban.Key),
+					zap.Bool("unban", change.unban),
+					zap.Error(err))
+			}
+
+		case <-ticker.C:
+			if err := bp.sync(ctx); err != nil && ctx.Err() == nil {
+				bp.logger.Error("syncing bans from storage", zap.Error(err))
+			}
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// store applies change to storage.
+func (bp *BanPersistence) store(ctx context.Context, change banChange) error {
+	storageKey := banStorageKey(change.ban.Zone, change.ban.Key)
+	if change.unban {
+		if err := bp.storage.Delete(ctx, storageKey); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	encoded, err := json.Marshal(change.ban)
+	if err != nil {
+		return err
+	}
+	if err := bp.storage.Store(ctx, storageKey, encoded); err != nil {
+		return err
+	}
+	bk := bannedKey{change.ban.Zone, change.ban.Key}
+	bp.mu.Lock()
+	if known, ok := bp.known[bk]; ok && known.until.Equal(change.ban.Expires) {
+		bp.known[bk] = knownBan{until: known.until, stored: true}
+	}
+	bp.mu.Unlock()
+	return nil
+}
+
+// sync bans the keys whose bans are in storage, in the zones that exist
+// on this instance, and lifts the bans that other instances lifted.
+// Expired bans are deleted from storage.
+func (bp *BanPersistence) sync(ctx context.Context) error {
+	storageKeys, err := bp.storage.List(ctx, banStoragePrefix, false)
+	if errors.Is(err, fs.ErrNotExist) {
+		storageKeys, err = nil, nil
+	}
+	if err != nil {
+		return fmt.Errorf("listing bans: %v", err)
+	}
+
+	stored := make(map[bannedKey]time.Time, len(storageKeys))
+	for _, storageKey := range storageKeys {
+		encoded, err := bp.storage.Load(ctx, storageKey)
+		if errors.Is(err, fs.ErrNotExist) {
+			// lifted or expired meanwhile
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("loading ban %s: %v", storageKey, err)
+		}
+		var ban storedBan
+		if err := json.Unmarshal(encoded, &ban); err != nil {
+			bp.logger.Warn("skipping invalid ban in storage",
+				zap.String("storage_key", storageKey),
+				zap.Error(err))
+			continue
+		}
+		if !ban.Expires.After(now()) {
+			if err := bp.storage.Delete(ctx, storageKey); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				bp.logger.Warn("deleting expired ban", zap.String("storage_key", storageKey), zap.Error(err))
+			}
+			continue
+		}
+		stored[bannedKey{ban.Zone, ban.Key}] = ban.Expires
+	}
+
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	for bk, until := range stored {
+		if known, ok := bp.known[bk]; ok && !known.stored && known.until.After(until) {
+			// a later ban of this instance waits to be stored
+			continue
+		}
+		bp.known[bk] = knownBan{until: until, stored: true}
+		if rlm, ok := zoneLimiters(bk.zone); ok && rlm.banned(bk.key) < until.Sub(now()) {
+			rlm.ban(bk.key, until)
+		}
+	}
+	for bk, known := range bp.known {
+		if _, ok := stored[bk]; ok || !known.stored {
+			continue
+		}
+		// another instance lifted the ban, or it expired
+		delete(bp.known, bk)
+		if rlm, ok := zoneLimiters(bk.zone); ok && known.until.After(now()) {
+			rlm.unban(bk.key)
+		}
+	}
+	return nil
+}
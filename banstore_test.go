@@ -0,0 +1,67 @@
+package caddyrl
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+)
+
+func TestBanPersistence(t *testing.T) {
+	initTime()
+	ctx := context.Background()
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+
+	// two instances that share storage
+	first, second := new(BanPersistence), new(BanPersistence)
+	for _, bp := range []*BanPersistence{first, second} {
+		if err := bp.provision(storage, zap.NewNop()); err != nil {
+			t.Fatalf("provisioning: %v", err)
+		}
+	}
+	rlm := newTestZone(t, "banstore", 1, time.Minute)
+
+	until := now().Add(time.Hour)
+	rlm.ban("10.0.0.1", until)
+	first.observe(eventBan, map[string]any{"zone": "banstore", "key": "10.0.0.1", "expires": until})
+	if err := first.store(ctx, <-first.changes); err != nil {
+		t.Fatalf("storing ban: %v", err)
+	}
+
+	// a restart loses the ban in memory, but it is picked up from storage
+	rlm.unban("10.0.0.1")
+	if err := second.sync(ctx); err != nil {
+		t.Fatalf("syncing bans: %v", err)
+	}
+	if got := rlm.banned("10.0.0.1"); got != time.Hour {
+		t.Fatalf("expected ban of 1h to be picked up, got %v", got)
+	}
+
+	// lifting the ban on one instance lifts it on the others
+	first.observe(eventUnban, map[string]any{"zone": "banstore", "key": "10.0.0.1"})
+	if err := first.store(ctx, <-first.changes); err != nil {
+		t.Fatalf("deleting ban: %v", err)
+	}
+	if err := second.sync(ctx); err != nil {
+		t.Fatalf("syncing bans: %v", err)
+	}
+	if got := rlm.banned("10.0.0.1"); got != 0 {
+		t.Fatalf("expected ban to be lifted, got %v", got)
+	}
+
+	// expired bans are deleted from storage
+	rlm.ban("10.0.0.2", now().Add(time.Minute))
+	first.observe(eventBan, map[string]any{"zone": "banstore", "key": "10.0.0.2", "expires": now().Add(time.Minute)})
+	if err := first.store(ctx, <-first.changes); err != nil {
+		t.Fatalf("storing ban: %v", err)
+	}
+	advanceTime(120)
+	if err := second.sync(ctx); err != nil {
+		t.Fatalf("syncing bans: %v", err)
+	}
+	if storage.Exists(ctx, banStorageKey("banstore", "10.0.0.2")) {
+		t.Fatal("expected expired ban to be deleted from storage")
+	}
+}
@@ -0,0 +1,195 @@
+package caddyrl
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// BruteForceProtection turns a zone into login protection: instead of
+// every request, the zone counts the failed authentication responses of
+// each username and client IP, and once they reach the zone's max_events
+// within its window, locks the pair out. Every lockout in a row lasts
+// twice as long as the one before, and a successful response clears the
+// pair's failures and lockouts.
+//
+// Unless set, the zone's key is the username and the client IP, its
+// max_events is 5, and its window 15m. Lockouts are bans, so they emit
+// ban events, show up in the admin API and can be lifted there.
+type BruteForceProtection struct {
+	// The username of login attempts, usually a placeholder such as
+	// `{http.request.header.X-Username}` or `{http.auth.user.id}`. It is
+	// combined with the client IP into the zone's key, unless the zone
+	// has a key. Default: none (only the client IP)
+	Username string `json:"username,omitempty"`
+
+	// The response statuses that count as failed attempts.
+	// Default: [401, 403]
+	FailureStatuses []int `json:"failure_statuses,omitempty"`
+
+	// How long the first lockout lasts. Default: 1m
+	Lockout caddy.Duration `json:"lockout,omitempty"`
+
+	// The longest lockout. Default: 1h
+	MaxLockout caddy.Duration `json:"max_lockout,omitempty"`
+}
+
+// lockoutStreak is a run of lockouts of a key.
+type lockoutStreak struct {
+	lockouts int
+
+	// when the streak is forgotten if there is no other lockout
+	expires time.Time
+}
+
+// preset fills in the settings of zone that brute force protection
+// has defaults for.
+func (bf *BruteForceProtection) preset(zone *RateLimit) {
+	if zone.Key == "" {
+		zone.Key = "{http.vars.client_ip}"
+		if bf.Username != "" {
+			zone.Key = bf.Username + "/" + zone.Key
+		}
+	}
+	if zone.MaxEvents == 0 {
+		zone.MaxEvents = 5
+	}
+	if zone.Window == 0 {
+		zone.Window = caddy.Duration(15 * time.Minute)
+	}
+}
+
+// provision sets the defaults and validates the protection.
+func (bf *BruteForceProtection) provision() error {
+	if len(bf.FailureStatuses) == 0 {
+		bf.FailureStatuses = []int{http.StatusUnauthorized, http.StatusForbidden}
+	}
+	if bf.Lockout == 0 {
+		bf.Lockout = caddy.Duration(time.Minute)
+	}
+	if bf.MaxLockout == 0 {
+		bf.MaxLockout = caddy.Duration(time.Hour)
+	}
+	if bf.Lockout < 0 || bf.MaxLockout < bf.Lockout {
+		return fmt.Errorf("lockout must be greater than zero, and max_lockout at least lockout")
+	}
+	for _, status := range bf.FailureStatuses {
+		if status < 100 || status > 599 {
+			return fmt.Errorf("invalid failure status %d", status)
+		}
+	}
+	return nil
+}
+
+// responded counts the response to an attempt of key in zone: failures
+// are counted, and lock the key out once there are too many; successes
+// clear the key's state.
+func (bf *BruteForceProtection) responded(zone *RateLimit, key string, status int) {
+	rlm := zone.limitersMap
+	switch {
+	case slices.Contains(bf.FailureStatuses, status):
+		// the failure that fills the window locks the key out, as
+		// does every further one while the window is full
+		limiter := rlm.getOrInsert(key)
+		if rlm.when(limiter) == 0 {
+			if count, _ := limiter.Count(now()); count < limiter.MaxEvents() {
+				return
+			}
+		}
+		until := now().Add(rlm.lockOut(key, time.Duration(bf.Lockout), time.Duration(bf.MaxLockout)))
+		rlm.ban(key, until)
+		zone.Log.banned(zone.ZoneName, key, until, "brute_force")
+		rlm.emitEvent(eventBan, map[string]any{
+			"zone":    zone.ZoneName,
+			"key":     key,
+			"expires": until,
+		})
+
+	case status >= 200 && status < 300:
+		rlm.delete(key)
+		rlm.limitersMu.Lock()
+		delete(rlm.lockouts, key)
+		rlm.limitersMu.Unlock()
+	}
+}
+
+// lockOut starts another lockout of key and returns how long it lasts:
+// lockout at first, and twice as long as the one before for every
+// lockout in a row, up to maxLockout.
+func (rlm *rateLimitersMap) lockOut(key string, lockout, maxLockout time.Duration) time.Duration {
+	ref := now()
+	rlm.limitersMu.Lock()
+	defer rlm.limitersMu.Unlock()
+
+	streak, ok := rlm.lockouts[key]
+	if !ok || !streak.expires.After(ref) {
+		streak = lockoutStreak{}
+	}
+	for range streak.lockouts {
+		if lockout >= maxLockout {
+			break
+		}
+		lockout *= 2
+	}
+	lockout = min(lockout, maxLockout)
+	streak.lockouts++
+	// a streak lasts until the window after the lockout would have
+	// forgotten its failures
+	streak.expires = ref.Add(lockout + time.Duration(rlm.window.Load()))
+	rlm.lockouts[key] = streak
+	return lockout
+}
+
+// wrapBruteForce returns w wrapped so that the responses of later
+// handlers are counted against the keys of zones with brute force
+// protection.
+func wrapBruteForce(w http.ResponseWriter, keys []limitedKey) http.ResponseWriter {
+	return &bruteForceWriter{
+		ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w},
+		keys:                  keys,
+	}
+}
+
+// bruteForceWriter counts the responses of later handlers; see
+// BruteForceProtection.
+type bruteForceWriter struct {
+	*caddyhttp.ResponseWriterWrapper
+	keys        []limitedKey
+	wroteHeader bool
+}
+
+func (w *bruteForceWriter) WriteHeader(status int) {
+	// informational responses are followed by the final one
+	if !w.wroteHeader && status >= 200 {
+		w.wroteHeader = true
+		for _, lk := range w.keys {
+			lk.zone.BruteForce.responded(lk.zone, lk.key, status)
+		}
+	}
+	w.ResponseWriterWrapper.WriteHeader(status)
+}
+
+func (w *bruteForceWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriterWrapper.Write(p)
+}
+
+func (w *bruteForceWriter) ReadFrom(r io.Reader) (int64, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriterWrapper.ReadFrom(r)
+}
+
+// Interface guards
+var (
+	_ http.ResponseWriter = (*bruteForceWriter)(nil)
+	_ io.ReaderFrom       = (*bruteForceWriter)(nil)
+)
@@ -0,0 +1,81 @@
+package caddyrl
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestBruteForce(t *testing.T) {
+	initTime()
+
+	rl := &RateLimit{
+		ZoneName:   "brute_force_zone",
+		MaxEvents:  3,
+		BruteForce: &BruteForceProtection{Username: "{http.request.header.X-Username}"},
+	}
+	h := newTestHandler(t, rl)
+	if rl.Key != "{http.request.header.X-Username}/{http.vars.client_ip}" || rl.Window != caddy.Duration(15*time.Minute) {
+		t.Fatalf("unexpected preset of key %q and window %s", rl.Key, time.Duration(rl.Window))
+	}
+
+	attempt := func(status int) bool {
+		t.Helper()
+		req := newTestRequest("POST", "/login", map[string]string{
+			"http.request.header.X-Username": "alice",
+			"http.vars.client_ip":            "192.0.2.1",
+		})
+		next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) error {
+			w.WriteHeader(status)
+			return nil
+		})
+		err := h.ServeHTTP(httptest.NewRecorder(), req, next)
+		if err != nil && !isDeclined(err) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return err == nil
+	}
+	const key = "alice/192.0.2.1"
+
+	// requests aren't counted, failures are, and the one that fills the
+	// window locks the pair out
+	for range 5 {
+		attempt(http.StatusOK)
+	}
+	for i := range 3 {
+		if !attempt(http.StatusUnauthorized) {
+			t.Fatalf("attempt %d should be allowed", i)
+		}
+	}
+	if dur := rl.limitersMap.banned(key); dur != time.Minute {
+		t.Fatalf("expected a lockout of 1m, got %s", dur)
+	}
+	if attempt(http.StatusUnauthorized) {
+		t.Fatal("expected attempt during lockout to be declined")
+	}
+
+	// every further lockout in a row lasts twice as long
+	advanceTime(61)
+	attempt(http.StatusForbidden)
+	if dur := rl.limitersMap.banned(key); dur != 2*time.Minute {
+		t.Fatalf("expected a lockout of 2m, got %s", dur)
+	}
+
+	// a success clears the pair's failures and lockouts
+	advanceTime(61 + 121)
+	attempt(http.StatusOK)
+	for range 2 {
+		attempt(http.StatusUnauthorized)
+	}
+	if dur := rl.limitersMap.banned(key); dur != 0 {
+		t.Fatalf("expected no lockout after a success, got %s", dur)
+	}
+	attempt(http.StatusUnauthorized)
+	if dur := rl.limitersMap.banned(key); dur != time.Minute {
+		t.Fatalf("expected the lockouts to start over at 1m, got %s", dur)
+	}
+}
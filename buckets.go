@@ -0,0 +1,454 @@
+package caddyrl
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"path"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(Buckets{})
+}
+
+// Buckets counts the events of each key in buckets of a fixed duration,
+// such as an hour, rather than remembering the time of every event, for
+// quotas with windows of weeks or months. A key takes memory for the
+// buckets it has events in, at most one more than fit in the window,
+// however many events the window allows. Events count towards the limit
+// until their bucket has left the window, so for up to a bucket longer
+// than with the sliding window.
+//
+// With persist_interval, the buckets of the zone's keys are kept in
+// storage, so that quotas survive restarts. They are written as a
+// journal of changes that is compacted from time to time, so that a
+// crash while writing can't lose the state of the whole zone.
+type Buckets struct {
+	// How long each bucket is. Default: 1h, or a tenth of the window
+	// if that is shorter
+	Bucket caddy.Duration `json:"bucket,omitempty"`
+
+	// How often to write the buckets of the zone's keys to storage,
+	// from which they are read when the zone starts without state,
+	// e.g. after a restart. Default: 0 (not stored)
+	PersistInterval caddy.Duration `json:"persist_interval,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (Buckets) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "rate_limit.algorithms.buckets",
+		New: func() caddy.Module { return new(Buckets) },
+	}
+}
+
+// Provision validates the algorithm's config.
+func (b *Buckets) Provision(caddy.Context) error {
+	if b.Bucket < 0 || b.PersistInterval < 0 {
+		return fmt.Errorf("bucket and persist_interval must be at least zero")
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler. Syntax:
+//
+//	algorithm buckets [<bucket>] {
+//	    persist_interval <interval>
+//	}
+func (b *Buckets) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume algorithm name
+	if d.NextArg() {
+		bucket, err := caddy.ParseDuration(d.Val())
+		if err != nil {
+			return d.Errf("invalid bucket '%s': %v", d.Val(), err)
+		}
+		b.Bucket = caddy.Duration(bucket)
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "persist_interval":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			interval, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid persist_interval '%s': %v", d.Val(), err)
+			}
+			b.PersistInterval = caddy.Duration(interval)
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		default:
+			return d.Errf("unrecognized buckets option '%s'", d.Val())
+		}
+	}
+	return nil
+}
+
+// NewLimiter implements Algorithm.
+func (b Buckets) NewLimiter(maxEvents int, window time.Duration) Limiter {
+	return &bucketsLimiter{bucket: time.Duration(b.Bucket), maxEvents: maxEvents, window: window}
+}
+
+// bucketsLimiter limits one key with the Buckets algorithm.
+type bucketsLimiter struct {
+	bucket time.Duration // as configured, 0 for the default
+
+	mu        sync.Mutex
+	maxEvents int
+	window    time.Duration
+
+	// the buckets with events, oldest first
+	counts []bucketCount
+}
+
+// bucketCount is the number of events of a key in one bucket.
+type bucketCount struct {
+	N     int64 `json:"n"` // of the bucket since the epoch, in bucket durations
+	Count int   `json:"count"`
+}
+
+// bucketsState is the state of a bucketsLimiter as it is kept in
+// storage; the buckets are discarded if their duration changed.
+type bucketsState struct {
+	Bucket time.Duration `json:"bucket"`
+	Counts []bucketCount `json:"counts"`
+}
+
+// durationUnsynced returns how long the limiter's buckets are.
+func (l *bucketsLimiter) durationUnsynced() time.Duration {
+	if l.bucket > 0 {
+		return l.bucket
+	}
+	return max(min(time.Hour, l.window/10), 1)
+}
+
+// endUnsynced returns when the bucket numbered n leaves the window, in
+// nanoseconds since the epoch.
+func (l *bucketsLimiter) endUnsynced(n int64) int64 {
+	return (n+1)*int64(l.durationUnsynced()) + int64(l.window)
+}
+
+// countUnsynced forgets the buckets that have left the window at ref,
+// and returns the number of events in the others.
+func (l *bucketsLimiter) countUnsynced(ref int64) int {
+	expired := 0
+	for expired < len(l.counts) && l.endUnsynced(l.counts[expired].N) <= ref {
+		expired++
+	}
+	l.counts = l.counts[expired:]
+	var count int
+	for _, c := range l.counts {
+		count += c.Count
+	}
+	return count
+}
+
+func (l *bucketsLimiter) Allow(ref time.Time, n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if n > l.maxEvents {
+		return max(l.window, 1)
+	}
+
+	ns := unixNano(ref)
+	count := l.countUnsynced(ns)
+	if excess := count + n - l.maxEvents; excess > 0 {
+		// wait until the oldest buckets with enough events between
+		// them have left the window
+		for _, c := range l.counts {
+			if excess -= c.Count; excess <= 0 {
+				return time.Duration(l.endUnsynced(c.N) - ns)
+			}
+		}
+		return max(l.window, 1)
+	}
+
+	current := ns / int64(l.durationUnsynced())
+	if last := len(l.counts) - 1; last >= 0 && l.counts[last].N == current {
+		l.counts[last].Count += n
+	} else {
+		l.counts = append(l.counts, bucketCount{N: current, Count: n})
+	}
+	return 0
+}
+
+func (l *bucketsLimiter) Remaining(ref time.Time) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return max(l.maxEvents-l.countUnsynced(unixNano(ref)), 0)
+}
+
+func (l *bucketsLimiter) SetLimits(maxEvents int, window time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	before := l.durationUnsynced()
+	l.maxEvents, l.window = maxEvents, window
+	if l.durationUnsynced() != before {
+		// the events were counted in buckets of another duration
+		l.counts = nil
+	}
+}
+
+func (l *bucketsLimiter) Idle(ref time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.countUnsynced(unixNano(ref)) == 0
+}
+
+// state returns the limiter's state to be stored.
+func (l *bucketsLimiter) state() bucketsState {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return bucketsState{Bucket: l.durationUnsynced(), Counts: append([]bucketCount(nil), l.counts...)}
+}
+
+// restore sets the limiter's state to one that was stored, unless its
+// buckets are of another duration.
+func (l *bucketsLimiter) restore(state bucketsState) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if state.Bucket == l.durationUnsynced() {
+		l.counts = state.Counts
+	}
+}
+
+// bucketsStoragePrefix is where the buckets of zones are kept in
+// storage.
+const bucketsStoragePrefix = "rate_limit/buckets"
+
+// persistBuckets reads the buckets of zone, which uses the Buckets
+// algorithm, from storage if the zone has no state yet, and then writes
+// them to storage every persist interval, and once more when ctx is
+// done, e.g. before a restart.
+func (h *Handler) persistBuckets(ctx context.Context, zone *RateLimit, interval time.Duration) {
+	labelTask(ctx, "buckets_persistence")
+	logger := h.logger.With(zap.String("zone", zone.ZoneName))
+	al := zone.limitersMap.algorithm.Load()
+	if al == nil {
+		return
+	}
+	journal := newBucketsJournal(h.storage, zone.ZoneName, logger)
+
+	if al.len() == 0 {
+		states, err := journal.load(ctx)
+		// a renamed zone reads the buckets of its old names until it
+		// has stored its own
+		for _, oldName := range zone.RenamedFrom {
+			if len(states) > 0 || err != nil {
+				break
+			}
+			states, err = newBucketsJournal(h.storage, oldName, logger).load(ctx)
+		}
+		if err != nil && ctx.Err() == nil {
+			logger.Error("loading buckets", zap.Error(err))
+		}
+		maxEvents, window := zone.limitersMap.limits()
+		for key, state := range states {
+			if limiter, ok := al.limiter(key, maxEvents, window).(*bucketsLimiter); ok {
+				limiter.restore(state)
+			}
+		}
+	}
+
+	save := func(ctx context.Context, compact bool) {
+		states := make(map[string]bucketsState)
+		al.forEach(func(key string, limiter Limiter) {
+			if limiter, ok := limiter.(*bucketsLimiter); ok {
+				if state := limiter.state(); len(state.Counts) > 0 {
+					states[key] = state
+				}
+			}
+		})
+		if err := journal.write(ctx, states, compact); err != nil {
+			logger.Error("storing buckets", zap.Error(err))
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			save(ctx, false)
+		case <-ctx.Done():
+			// the context's storage operations would fail now
+			saveCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			save(saveCtx, true)
+			cancel()
+			return
+		}
+	}
+}
+
+// bucketsCompactEvery is how many journal entries are written before
+// they are compacted into a snapshot.
+const bucketsCompactEvery = 10
+
+// bucketsJournal keeps the buckets of a zone's keys in storage as a
+// snapshot of all keys and a journal of entries with the keys that
+// changed since, so that most writes only add a small entry instead of
+// rewriting the state of the whole zone, and a crash in the middle of a
+// write loses at most that write's changes. Every bucketsCompactEvery
+// entries, and when Caddy stops, the entries are compacted into a new
+// snapshot.
+//
+// The events in a bucket only ever increase, so the snapshot and the
+// entries are merged by the highest count of each bucket, regardless of
+// their order; entries that outlive the snapshot they were compacted
+// into, e.g. after a crash during compaction, thus don't undo later
+// events, although events that were refunded or reset since count
+// again.
+type bucketsJournal struct {
+	storage       certmagic.Storage
+	snapshotKey   string
+	entriesPrefix string
+	logger        *zap.Logger
+
+	// the states as of the last write, and the number of entries
+	// since the last snapshot
+	written map[string]bucketsState
+	entries int
+}
+
+// newBucketsJournal returns the journal of the zone with the given name.
+func newBucketsJournal(storage certmagic.Storage, zoneName string, logger *zap.Logger) *bucketsJournal {
+	return &bucketsJournal{
+		storage:       storage,
+		snapshotKey:   path.Join(bucketsStoragePrefix, zoneName+".json"),
+		entriesPrefix: path.Join(bucketsStoragePrefix, zoneName+".journal"),
+		logger:        logger,
+	}
+}
+
+// load returns the states merged from the snapshot and the entries.
+// Corrupted values are skipped rather than failing the whole load.
+func (j *bucketsJournal) load(ctx context.Context) (map[string]bucketsState, error) {
+	states := make(map[string]bucketsState)
+	if err := j.loadValue(ctx, j.snapshotKey, states); err != nil {
+		return nil, err
+	}
+	keys, err := j.storage.List(ctx, j.entriesPrefix, false)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return states, err
+	}
+	// entry keys sort by when they were written, so a later entry
+	// decides the duration of a key's buckets
+	slices.Sort(keys)
+	for _, key := range keys {
+		if err := j.loadValue(ctx, key, states); err != nil {
+			return states, err
+		}
+		j.entries++
+	}
+	j.written = maps.Clone(states)
+	return states, nil
+}
+
+// loadValue merges the states stored at key into states.
+func (j *bucketsJournal) loadValue(ctx context.Context, key string, states map[string]bucketsState) error {
+	encoded, err := j.storage.Load(ctx, key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var stored map[string]bucketsState
+	if err := json.Unmarshal(encoded, &stored); err != nil {
+		j.logger.Warn("discarding invalid buckets", zap.String("storage_key", key), zap.Error(err))
+		return nil
+	}
+	for key, state := range stored {
+		states[key] = mergeBucketsStates(states[key], state)
+	}
+	return nil
+}
+
+// write appends an entry with the states that changed since the last
+// write, or writes a snapshot of all states if compact is true or enough
+// entries have been written, after which the entries are deleted.
+func (j *bucketsJournal) write(ctx context.Context, states map[string]bucketsState, compact bool) error {
+	if compact || j.entries >= bucketsCompactEvery {
+		encoded, err := json.Marshal(states)
+		if err != nil {
+			return err
+		}
+		if err := j.storage.Store(ctx, j.snapshotKey, encoded); err != nil {
+			return err
+		}
+		j.written, j.entries = states, 0
+		// the entries are in the snapshot now; should deleting them
+		// fail, merging them again on load does no harm
+		keys, err := j.storage.List(ctx, j.entriesPrefix, false)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		for _, key := range keys {
+			if err := j.storage.Delete(ctx, key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		}
+		return nil
+	}
+
+	changed := make(map[string]bucketsState)
+	for key, state := range states {
+		if written, ok := j.written[key]; !ok || written.Bucket != state.Bucket || !slices.Equal(written.Counts, state.Counts) {
+			changed[key] = state
+		}
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+	encoded, err := json.Marshal(changed)
+	if err != nil {
+		return err
+	}
+	// zero-padded, so that entries sort by when they were written
+	entryKey := path.Join(j.entriesPrefix, fmt.Sprintf("%020d-%04d.json", unixNano(now()), j.entries))
+	if err := j.storage.Store(ctx, entryKey, encoded); err != nil {
+		return err
+	}
+	j.written, j.entries = states, j.entries+1
+	return nil
+}
+
+// mergeBucketsStates returns the states of the same key merged by the
+// highest count of each bucket; if their buckets are of different
+// durations, later, which was written after earlier, replaces it.
+func mergeBucketsStates(earlier, later bucketsState) bucketsState {
+	if earlier.Bucket != later.Bucket {
+		return later
+	}
+	counts := make(map[int64]int, len(earlier.Counts)+len(later.Counts))
+	for _, c := range slices.Concat(earlier.Counts, later.Counts) {
+		counts[c.N] = max(counts[c.N], c.Count)
+	}
+	merged := bucketsState{Bucket: later.Bucket, Counts: make([]bucketCount, 0, len(counts))}
+	for _, n := range slices.Sorted(maps.Keys(counts)) {
+		merged.Counts = append(merged.Counts, bucketCount{N: n, Count: counts[n]})
+	}
+	return merged
+}
+
+// Interface guards
+var (
+	_ Algorithm             = (*Buckets)(nil)
+	_ caddy.Provisioner     = (*Buckets)(nil)
+	_ caddyfile.Unmarshaler = (*Buckets)(nil)
+)
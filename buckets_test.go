@@ -0,0 +1,227 @@
+package caddyrl
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+)
+
+func TestBucketsLimiter(t *testing.T) {
+	ref := time.Unix(referenceTime, 0) // 2800s into an hourly bucket
+
+	limiter := Buckets{Bucket: caddy.Duration(time.Hour)}.NewLimiter(3, 24*time.Hour)
+	if wait := limiter.Allow(ref, 2); wait != 0 {
+		t.Fatalf("expected 2 events to be allowed, got wait %v", wait)
+	}
+	if wait := limiter.Allow(ref.Add(2*time.Hour), 1); wait != 0 {
+		t.Fatalf("expected a third event to be allowed, got wait %v", wait)
+	}
+	if remaining := limiter.Remaining(ref.Add(2 * time.Hour)); remaining != 0 {
+		t.Errorf("expected no remaining events, got %d", remaining)
+	}
+
+	// the first bucket counts until a window after it ended
+	expires := ref.Add(800*time.Second + 24*time.Hour)
+	if wait := limiter.Allow(ref.Add(2*time.Hour), 1); wait != expires.Sub(ref.Add(2*time.Hour)) {
+		t.Errorf("expected to wait until the first bucket leaves the window, got %v", wait)
+	}
+	if wait := limiter.Allow(ref, 4); wait != 24*time.Hour {
+		t.Errorf("expected more events than allowed at all to wait a window, got %v", wait)
+	}
+	if wait := limiter.Allow(expires, 2); wait != 0 {
+		t.Errorf("expected events to be allowed once the first bucket left, got wait %v", wait)
+	}
+	if n := len(limiter.(*bucketsLimiter).counts); n != 2 {
+		t.Errorf("expected 2 buckets to be kept, got %d", n)
+	}
+	if !limiter.Idle(expires.Add(25 * time.Hour)) {
+		t.Error("expected the limiter to be idle once all buckets left the window")
+	}
+
+	// a 30-day window of hourly buckets holds many events in few buckets
+	limiter = Buckets{}.NewLimiter(1_000_000, 30*24*time.Hour)
+	for i := range 1000 {
+		if wait := limiter.Allow(ref.Add(time.Duration(i)*time.Minute), 100); wait != 0 {
+			t.Fatalf("expected events to be allowed, got wait %v", wait)
+		}
+	}
+	if n := len(limiter.(*bucketsLimiter).counts); n > 18 {
+		t.Errorf("expected at most 18 hourly buckets, got %d", n)
+	}
+	if remaining := limiter.Remaining(ref.Add(1000 * time.Minute)); remaining != 900_000 {
+		t.Errorf("expected 900000 remaining events, got %d", remaining)
+	}
+}
+
+func TestBucketsPersistence(t *testing.T) {
+	initTime()
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: t.Context()})
+	defer cancel()
+
+	zone := &RateLimit{
+		ZoneName:     "buckets_zone",
+		MaxEvents:    2,
+		Window:       caddy.Duration(7 * 24 * time.Hour),
+		AlgorithmRaw: json.RawMessage(`{"name": "buckets", "persist_interval": "1m"}`),
+	}
+	if err := zone.provision(ctx, zone.ZoneName); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _, _ = rateLimits.Delete(zone.ZoneName) })
+	rlm := zone.limitersMap
+
+	for range 2 {
+		if wait := rlm.whenKey("customer"); wait != 0 {
+			t.Fatalf("expected to be allowed, got wait %v", wait)
+		}
+	}
+
+	// the buckets are stored when the handler stops, and restored when
+	// the zone starts over without state
+	h := &Handler{logger: zap.NewNop(), storage: &certmagic.FileStorage{Path: t.TempDir()}}
+	stopped, stop := context.WithCancel(t.Context())
+	stop()
+	h.persistBuckets(stopped, zone, time.Minute)
+	rlm.reset()
+	if wait := rlm.whenKey("customer"); wait != 0 {
+		t.Fatalf("expected a reset to forget the buckets, got wait %v", wait)
+	}
+	rlm.reset()
+	h.persistBuckets(stopped, zone, time.Minute)
+	if wait := rlm.whenKey("customer"); wait == 0 {
+		t.Error("expected the buckets to be restored from storage")
+	}
+}
+
+func TestCaddyfileBuckets(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`
+	rate_limit {
+		zone monthly {
+			key    {http.request.header.X-Api-Key}
+			window 720h
+			events 100000
+			algorithm buckets 1h {
+				persist_interval 5m
+			}
+		}
+	}`)
+
+	var h Handler
+	if err := h.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshaling Caddyfile: %v", err)
+	}
+	var config struct {
+		Name            string         `json:"name"`
+		Bucket          caddy.Duration `json:"bucket"`
+		PersistInterval caddy.Duration `json:"persist_interval"`
+	}
+	if err := json.Unmarshal(h.RateLimits[0].AlgorithmRaw, &config); err != nil {
+		t.Fatal(err)
+	}
+	if config.Name != "buckets" || config.Bucket != caddy.Duration(time.Hour) || config.PersistInterval != caddy.Duration(5*time.Minute) {
+		t.Errorf("unexpected algorithm config: %+v", config)
+	}
+
+	for _, input := range []string{
+		`rate_limit {
+			zone z {
+				key static
+				window 720h
+				events 5
+				algorithm buckets hourly
+			}
+		}`,
+		`rate_limit {
+			zone z {
+				key static
+				window 720h
+				events 5
+				algorithm buckets {
+					persist 5m
+				}
+			}
+		}`,
+	} {
+		var h Handler
+		if err := h.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err == nil {
+			t.Errorf("expected error for input: %s", input)
+		}
+	}
+}
+
+func TestBucketsJournal(t *testing.T) {
+	initTime()
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	newJournal := func() *bucketsJournal {
+		return newBucketsJournal(storage, "z", zap.NewNop())
+	}
+	ctx := context.Background()
+	j := newJournal()
+
+	states := map[string]bucketsState{
+		"a": {Bucket: time.Hour, Counts: []bucketCount{{N: 1, Count: 2}}},
+		"b": {Bucket: time.Hour, Counts: []bucketCount{{N: 1, Count: 1}}},
+	}
+	if err := j.write(ctx, states, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// only changed keys are appended to the journal
+	advanceTime(60)
+	states = maps.Clone(states)
+	states["a"] = bucketsState{Bucket: time.Hour, Counts: []bucketCount{{N: 1, Count: 2}, {N: 2, Count: 3}}}
+	if err := j.write(ctx, states, false); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := storage.List(ctx, j.entriesPrefix, false)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("expected one entry, got %v (%v)", entries, err)
+	}
+	entry, err := storage.Load(ctx, entries[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var changed map[string]bucketsState
+	if err := json.Unmarshal(entry, &changed); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := changed["b"]; ok || len(changed) != 1 {
+		t.Errorf("expected only the changed key in the entry, got %+v", changed)
+	}
+
+	// a write cut short by a crash only loses its own changes
+	if err := storage.Store(ctx, j.entriesPrefix+"/99999999999999999999-0000.json", []byte(`{"b": {"bucket`)); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := newJournal().load(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(loaded["a"].Counts, states["a"].Counts) || !slices.Equal(loaded["b"].Counts, states["b"].Counts) {
+		t.Errorf("expected the snapshot and entries to be merged, got %+v", loaded)
+	}
+
+	// compaction replaces the entries with a snapshot
+	if err := j.write(ctx, states, true); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := storage.List(ctx, j.entriesPrefix, false); len(entries) != 0 {
+		t.Errorf("expected compaction to delete the entries, got %v", entries)
+	}
+
+	merged := mergeBucketsStates(
+		bucketsState{Bucket: time.Hour, Counts: []bucketCount{{N: 1, Count: 5}, {N: 2, Count: 1}}},
+		bucketsState{Bucket: time.Hour, Counts: []bucketCount{{N: 2, Count: 3}, {N: 3, Count: 1}}},
+	)
+	if expected := []bucketCount{{N: 1, Count: 5}, {N: 2, Count: 3}, {N: 3, Count: 1}}; !slices.Equal(merged.Counts, expected) {
+		t.Errorf("expected the highest count of each bucket %v, got %v", expected, merged.Counts)
+	}
+}
@@ -15,13 +15,16 @@
 package caddyrl
 
 import (
+	"encoding/json"
 	"strconv"
+	"strings"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/dustin/go-humanize"
 )
 
 func init() {
@@ -38,226 +41,2253 @@ func parseGlobalRateLimitMetrics(d *caddyfile.Dispenser, _ any) (any, error) {
 
 	for nesting := d.Nesting(); d.NextBlock(nesting); {
 		switch d.Val() {
+		case "max_memory":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			maxMemory, err := humanize.ParseBytes(d.Val())
+			if err != nil {
+				return nil, d.Errf("invalid max memory size '%s': %v", d.Val(), err)
+			}
+			app.MaxMemory = int64(maxMemory)
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+
+		case "load_shedding":
+			if app.LoadShedding != nil {
+				return nil, d.Err("load shedding already specified")
+			}
+			app.LoadShedding = new(LoadShedding)
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				option := d.Val()
+				if !d.NextArg() {
+					return nil, d.ArgErr()
+				}
+				switch option {
+				case "cpu":
+					maxCPU, err := strconv.ParseFloat(d.Val(), 64)
+					if err != nil {
+						return nil, d.Errf("invalid cpu fraction '%s': %v", d.Val(), err)
+					}
+					app.LoadShedding.MaxCPU = maxCPU
+				case "memory":
+					maxMemory, err := humanize.ParseBytes(d.Val())
+					if err != nil {
+						return nil, d.Errf("invalid memory size '%s': %v", d.Val(), err)
+					}
+					app.LoadShedding.MaxMemory = int64(maxMemory)
+				case "goroutines":
+					maxGoroutines, err := strconv.Atoi(d.Val())
+					if err != nil {
+						return nil, d.Errf("invalid goroutines integer '%s': %v", d.Val(), err)
+					}
+					app.LoadShedding.MaxGoroutines = maxGoroutines
+				case "factor":
+					factor, err := strconv.ParseFloat(d.Val(), 64)
+					if err != nil {
+						return nil, d.Errf("invalid factor '%s': %v", d.Val(), err)
+					}
+					app.LoadShedding.Factor = factor
+				case "interval":
+					interval, err := caddy.ParseDuration(d.Val())
+					if err != nil {
+						return nil, d.Errf("invalid interval '%s': %v", d.Val(), err)
+					}
+					app.LoadShedding.Interval = caddy.Duration(interval)
+				default:
+					return nil, d.Errf("unknown load shedding option '%s'", option)
+				}
+				if d.NextArg() {
+					return nil, d.ArgErr()
+				}
+			}
+
+		case "storage":
+			storageRaw, err := parseStorage(d)
+			if err != nil {
+				return nil, err
+			}
+			app.StorageRaw = storageRaw
+
+		case "storage_namespace":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			app.StorageNamespace = d.Val()
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+
+		case "backend_pool":
+			if app.BackendPool != nil {
+				return nil, d.Err("backend pool already specified")
+			}
+			app.BackendPool = new(BackendPool)
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				option := d.Val()
+				if !d.NextArg() {
+					return nil, d.ArgErr()
+				}
+				switch option {
+				case "max_conns", "max_idle_conns", "min_idle_conns":
+					count, err := strconv.Atoi(d.Val())
+					if err != nil {
+						return nil, d.Errf("invalid %s '%s': %v", option, d.Val(), err)
+					}
+					switch option {
+					case "max_conns":
+						app.BackendPool.MaxConns = count
+					case "max_idle_conns":
+						app.BackendPool.MaxIdleConns = count
+					case "min_idle_conns":
+						app.BackendPool.MinIdleConns = count
+					}
+				case "idle_timeout", "max_lifetime", "dial_timeout":
+					dur, err := caddy.ParseDuration(d.Val())
+					if err != nil {
+						return nil, d.Errf("invalid %s '%s': %v", option, d.Val(), err)
+					}
+					switch option {
+					case "idle_timeout":
+						app.BackendPool.IdleTimeout = caddy.Duration(dur)
+					case "max_lifetime":
+						app.BackendPool.MaxLifetime = caddy.Duration(dur)
+					case "dial_timeout":
+						app.BackendPool.DialTimeout = caddy.Duration(dur)
+					}
+				default:
+					return nil, d.Errf("unknown backend pool option '%s'", option)
+				}
+				if d.NextArg() {
+					return nil, d.ArgErr()
+				}
+			}
+
+		case "backend_tls":
+			if app.BackendTLS != nil {
+				return nil, d.Err("backend TLS already specified")
+			}
+			app.BackendTLS = new(BackendTLS)
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				switch d.Val() {
+				case "ca":
+					app.BackendTLS.CAFiles = append(app.BackendTLS.CAFiles, d.RemainingArgs()...)
+					if len(app.BackendTLS.CAFiles) == 0 {
+						return nil, d.ArgErr()
+					}
+					continue
+				case "client_cert":
+					if !d.NextArg() {
+						return nil, d.ArgErr()
+					}
+					app.BackendTLS.ClientCertFile = d.Val()
+					if !d.NextArg() {
+						return nil, d.ArgErr()
+					}
+					app.BackendTLS.ClientKeyFile = d.Val()
+				case "server_name":
+					if !d.NextArg() {
+						return nil, d.ArgErr()
+					}
+					app.BackendTLS.ServerName = d.Val()
+				case "require":
+					app.BackendTLS.Require = true
+				default:
+					return nil, d.Errf("unknown backend TLS option '%s'", d.Val())
+				}
+				if d.NextArg() {
+					return nil, d.ArgErr()
+				}
+			}
+
+		case "defaults":
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				switch d.Val() {
+				case "zone":
+					app.Defaults.Zone = new(RateLimit)
+					if err := parseZone(d, app.Defaults.Zone); err != nil {
+						return nil, err
+					}
+					if app.Defaults.Zone.Policy != "" {
+						return nil, d.Err("zone defaults cannot be based on a policy")
+					}
+				case "jitter":
+					if !d.NextArg() {
+						return nil, d.ArgErr()
+					}
+					jitter, err := strconv.ParseFloat(d.Val(), 64)
+					if err != nil {
+						return nil, d.Errf("invalid jitter percentage '%s': %v", d.Val(), err)
+					}
+					app.Defaults.Jitter = jitter
+				case "log_key":
+					app.Defaults.LogKey = true
+				case "sweep_interval":
+					if !d.NextArg() {
+						return nil, d.ArgErr()
+					}
+					interval, err := caddy.ParseDuration(d.Val())
+					if err != nil {
+						return nil, d.Errf("invalid sweep interval '%s': %v", d.Val(), err)
+					}
+					app.Defaults.SweepInterval = caddy.Duration(interval)
+				default:
+					return nil, d.Errf("unknown defaults option '%s'", d.Val())
+				}
+			}
+
+		case "policy":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			name := d.Val()
+			if _, ok := app.Policies[name]; ok {
+				return nil, d.Errf("policy %s already defined", name)
+			}
+			policy := new(RateLimit)
+			if err := parseZone(d, policy); err != nil {
+				return nil, err
+			}
+			if policy.Policy != "" {
+				return nil, d.Err("policies cannot be based on other policies")
+			}
+			if app.Policies == nil {
+				app.Policies = make(map[string]*RateLimit)
+			}
+			app.Policies[name] = policy
+
+		case "global":
+			if app.Global != nil {
+				return nil, d.Err("global zone already defined")
+			}
+			app.Global = new(RateLimit)
+			if d.NextArg() {
+				app.Global.ZoneName = d.Val()
+			}
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			if err := parseZone(d, app.Global); err != nil {
+				return nil, err
+			}
+			if app.Global.Policy != "" {
+				return nil, d.Err("the global zone cannot be based on a policy")
+			}
+			if app.Global.Preset == "" && (app.Global.Window == 0 || app.Global.MaxEvents == 0) {
+				return nil, d.Err("global zone must have a window and events, or a preset")
+			}
+
 		case "metrics":
 			for nesting := d.Nesting(); d.NextBlock(nesting); {
 				switch d.Val() {
 				case "include_key":
 					app.Metrics.IncludeKey = true
+				case "hash_keys":
+					app.Metrics.HashKeys = true
+				case "tenant":
+					if !d.NextArg() {
+						return nil, d.ArgErr()
+					}
+					app.Metrics.Tenant = d.Val()
+				case "max_keys_per_zone":
+					if !d.NextArg() {
+						return nil, d.ArgErr()
+					}
+					maxKeys, err := strconv.Atoi(d.Val())
+					if err != nil {
+						return nil, d.Errf("invalid max keys per zone integer '%s': %v", d.Val(), err)
+					}
+					app.Metrics.MaxKeysPerZone = maxKeys
+
+				case "async_buffer":
+					if !d.NextArg() {
+						return nil, d.ArgErr()
+					}
+					size, err := strconv.Atoi(d.Val())
+					if err != nil {
+						return nil, d.Errf("invalid async buffer size '%s': %v", d.Val(), err)
+					}
+					app.Metrics.AsyncBuffer = size
+
+				case "process_time_buckets":
+					args := d.RemainingArgs()
+					if len(args) == 0 {
+						return nil, d.ArgErr()
+					}
+					for _, arg := range args {
+						bound, err := strconv.ParseFloat(arg, 64)
+						if err != nil {
+							return nil, d.Errf("invalid bucket bound '%s': %v", arg, err)
+						}
+						app.Metrics.ProcessTimeBuckets = append(app.Metrics.ProcessTimeBuckets, bound)
+					}
+				case "statsd":
+					if !d.NextArg() {
+						return nil, d.ArgErr()
+					}
+					app.Metrics.StatsD = &StatsDExporter{Address: d.Val()}
+					if d.NextArg() {
+						return nil, d.ArgErr()
+					}
+					for nesting := d.Nesting(); d.NextBlock(nesting); {
+						switch d.Val() {
+						case "prefix":
+							if !d.NextArg() {
+								return nil, d.ArgErr()
+							}
+							app.Metrics.StatsD.Prefix = d.Val()
+						case "dogstatsd":
+							app.Metrics.StatsD.DogStatsD = true
+						default:
+							return nil, d.Errf("unknown statsd option '%s'", d.Val())
+						}
+					}
+				case "otlp":
+					app.Metrics.OTLP = new(OTLPExporter)
+					if d.NextArg() {
+						app.Metrics.OTLP.Endpoint = d.Val()
+					}
+					if d.NextArg() {
+						return nil, d.ArgErr()
+					}
+					for nesting := d.Nesting(); d.NextBlock(nesting); {
+						switch d.Val() {
+						case "protocol":
+							if !d.NextArg() {
+								return nil, d.ArgErr()
+							}
+							app.Metrics.OTLP.Protocol = d.Val()
+						case "insecure":
+							app.Metrics.OTLP.Insecure = true
+						case "interval":
+							if !d.NextArg() {
+								return nil, d.ArgErr()
+							}
+							interval, err := caddy.ParseDuration(d.Val())
+							if err != nil {
+								return nil, d.Errf("invalid otlp interval '%s': %v", d.Val(), err)
+							}
+							app.Metrics.OTLP.Interval = caddy.Duration(interval)
+						default:
+							return nil, d.Errf("unknown otlp option '%s'", d.Val())
+						}
+					}
 				default:
 					return nil, d.Errf("unknown option '%s'", d.Val())
 				}
-			}
-		default:
-			return nil, d.Errf("unrecognized subdirective '%s'", d.Val())
-		}
-	}
+			}
+		default:
+			return nil, d.Errf("unrecognized subdirective '%s'", d.Val())
+		}
+	}
+
+	return httpcaddyfile.App{
+		Name:  "rate_limit",
+		Value: caddyconfig.JSON(app, nil),
+	}, nil
+}
+
+// parseZone parses the block of a zone or policy into zone.
+func parseZone(d *caddyfile.Dispenser, zone *RateLimit) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "policy":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if zone.Policy != "" {
+				return d.Errf("zone policy already specified: %s", zone.Policy)
+			}
+			zone.Policy = d.Val()
+
+		case "renamed_from":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			zone.RenamedFrom = append(zone.RenamedFrom, d.Val())
+			zone.RenamedFrom = append(zone.RenamedFrom, d.RemainingArgs()...)
+
+		case "preset":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if zone.Preset != "" {
+				return d.Errf("zone preset already specified: %s", zone.Preset)
+			}
+			zone.Preset = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+
+		case "key":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if zone.Key != "" {
+				return d.Errf("zone key already specified: %s", zone.Key)
+			}
+			zone.Key = d.Val()
+
+		case "window":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if zone.Window != 0 {
+				return d.Errf("zone window already specified: %v", zone.Window)
+			}
+			window, err := caddy.ParseDuration(expandEnv(d.Val()))
+			if err != nil {
+				return d.Errf("invalid window duration '%s': %v", d.Val(), err)
+			}
+			zone.Window = caddy.Duration(window)
+
+		case "algorithm":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if zone.AlgorithmRaw != nil {
+				return d.Errf("zone algorithm already specified")
+			}
+			name := d.Val()
+			unm, err := caddyfile.UnmarshalModule(d, "rate_limit.algorithms."+name)
+			if err != nil {
+				return err
+			}
+			zone.AlgorithmRaw = caddyconfig.JSONModuleObject(unm, "name", name, nil)
+
+		case "events":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if zone.MaxEvents != 0 {
+				return d.Errf("zone max events already specified: %v", zone.MaxEvents)
+			}
+			maxEvents, err := strconv.Atoi(expandEnv(d.Val()))
+			if err != nil {
+				return d.Errf("invalid max events integer '%s': %v", d.Val(), err)
+			}
+			zone.MaxEvents = maxEvents
+
+		case "total_events":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if zone.TotalMaxEvents != 0 {
+				return d.Errf("zone total events already specified: %v", zone.TotalMaxEvents)
+			}
+			totalMaxEvents, err := strconv.Atoi(expandEnv(d.Val()))
+			if err != nil {
+				return d.Errf("invalid total events integer '%s': %v", d.Val(), err)
+			}
+			zone.TotalMaxEvents = totalMaxEvents
+
+		case "method_cost":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			method := strings.ToUpper(d.Val())
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			cost, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid method cost integer '%s': %v", d.Val(), err)
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			if zone.MethodCosts == nil {
+				zone.MethodCosts = make(map[string]int)
+			}
+			zone.MethodCosts[method] = cost
+
+		case "method_events":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			method := strings.ToUpper(d.Val())
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			maxEvents, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid method events integer '%s': %v", d.Val(), err)
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			if zone.MethodEvents == nil {
+				zone.MethodEvents = make(map[string]int)
+			}
+			zone.MethodEvents[method] = maxEvents
+
+		case "path_cost":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			pattern := d.Val()
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			cost, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid path cost integer '%s': %v", d.Val(), err)
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			zone.PathCosts = append(zone.PathCosts, PathCost{Path: pattern, Cost: cost})
+
+		case "cost_header":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			zone.CostHeader = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+
+		case "refund_header":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			zone.RefundHeader = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+
+		case "response_bytes":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if zone.MaxResponseBytes != 0 {
+				return d.Errf("zone response bytes already specified: %v", zone.MaxResponseBytes)
+			}
+			maxBytes, err := humanize.ParseBytes(expandEnv(d.Val()))
+			if err != nil {
+				return d.Errf("invalid response bytes size '%s': %v", d.Val(), err)
+			}
+			zone.MaxResponseBytes = int64(maxBytes)
+
+		case "request_bytes":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if zone.MaxRequestBytes != 0 {
+				return d.Errf("zone request bytes already specified: %v", zone.MaxRequestBytes)
+			}
+			maxBytes, err := humanize.ParseBytes(expandEnv(d.Val()))
+			if err != nil {
+				return d.Errf("invalid request bytes size '%s': %v", d.Val(), err)
+			}
+			zone.MaxRequestBytes = int64(maxBytes)
+
+		case "overload_status":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if zone.OverloadStatus != 0 {
+				return d.Errf("zone overload status already specified: %d", zone.OverloadStatus)
+			}
+			status, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid overload status code '%s': %v", d.Val(), err)
+			}
+			zone.OverloadStatus = status
+
+		case "cooldown":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if zone.Cooldown != 0 {
+				return d.Errf("zone cooldown already specified: %v", zone.Cooldown)
+			}
+			cooldown, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid cooldown '%s': %v", d.Val(), err)
+			}
+			zone.Cooldown = caddy.Duration(cooldown)
+
+		case "consistency":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if zone.Consistency != "" {
+				return d.Errf("zone consistency already specified: %s", zone.Consistency)
+			}
+			if err := validConsistency(d.Val()); err != nil {
+				return d.Err(err.Error())
+			}
+			zone.Consistency = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+
+		case "store_failure":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if err := validStoreFailure(d.Val()); err != nil {
+				return d.Err(err.Error())
+			}
+			zone.StoreFailure = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+
+		case "near_limit":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if zone.NearLimit != 0 {
+				return d.Errf("zone near limit already specified: %v", zone.NearLimit)
+			}
+			nearLimit, err := strconv.ParseFloat(d.Val(), 64)
+			if err != nil {
+				return d.Errf("invalid near limit '%s': %v", d.Val(), err)
+			}
+			zone.NearLimit = nearLimit
+
+		case "pressure_header":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			zone.PressureHeader = d.Val()
+			if d.NextArg() {
+				threshold, err := strconv.ParseFloat(d.Val(), 64)
+				if err != nil {
+					return d.Errf("invalid pressure threshold '%s': %v", d.Val(), err)
+				}
+				zone.PressureThreshold = threshold
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+
+		case "schedule":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			schedule := &LimitSchedule{Name: d.Val()}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				switch d.Val() {
+				case "days":
+					schedule.Days = d.RemainingArgs()
+					if len(schedule.Days) == 0 {
+						return d.ArgErr()
+					}
+				case "from":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					schedule.From = d.Val()
+				case "to":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					schedule.To = d.Val()
+				case "events":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					maxEvents, err := strconv.Atoi(expandEnv(d.Val()))
+					if err != nil {
+						return d.Errf("invalid max events integer '%s': %v", d.Val(), err)
+					}
+					schedule.MaxEvents = maxEvents
+				default:
+					return d.Errf("unrecognized schedule option '%s'", d.Val())
+				}
+			}
+			zone.Schedules = append(zone.Schedules, schedule)
+
+		case "circuit_breaker":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			zone.CircuitBreaker = new(CircuitBreaker)
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				switch d.Val() {
+				case "upstreams":
+					zone.CircuitBreaker.Upstreams = append(zone.CircuitBreaker.Upstreams, d.RemainingArgs()...)
+					if len(zone.CircuitBreaker.Upstreams) == 0 {
+						return d.ArgErr()
+					}
+				case "factor":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					factor, err := strconv.ParseFloat(d.Val(), 64)
+					if err != nil {
+						return d.Errf("invalid circuit breaker factor '%s': %v", d.Val(), err)
+					}
+					zone.CircuitBreaker.Factor = factor
+				case "slow_start":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					slowStart, err := caddy.ParseDuration(d.Val())
+					if err != nil {
+						return d.Errf("invalid slow start duration '%s': %v", d.Val(), err)
+					}
+					zone.CircuitBreaker.SlowStart = caddy.Duration(slowStart)
+				default:
+					return d.Errf("unrecognized circuit breaker option '%s'", d.Val())
+				}
+			}
+
+		case "anomaly":
+			zone.Anomaly = new(AnomalyDetection)
+			if d.NextArg() {
+				zone.Anomaly.Action = d.Val()
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				option := d.Val()
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				switch option {
+				case "interval", "learning_period", "ban_duration":
+					dur, err := caddy.ParseDuration(d.Val())
+					if err != nil {
+						return d.Errf("invalid anomaly %s '%s': %v", option, d.Val(), err)
+					}
+					switch option {
+					case "interval":
+						zone.Anomaly.Interval = caddy.Duration(dur)
+					case "learning_period":
+						zone.Anomaly.LearningPeriod = caddy.Duration(dur)
+					case "ban_duration":
+						zone.Anomaly.BanDuration = caddy.Duration(dur)
+					}
+				case "threshold":
+					threshold, err := strconv.ParseFloat(d.Val(), 64)
+					if err != nil {
+						return d.Errf("invalid anomaly threshold '%s': %v", d.Val(), err)
+					}
+					zone.Anomaly.Threshold = threshold
+				case "min_events":
+					minEvents, err := strconv.Atoi(d.Val())
+					if err != nil {
+						return d.Errf("invalid anomaly min_events '%s': %v", d.Val(), err)
+					}
+					zone.Anomaly.MinEvents = minEvents
+				default:
+					return d.Errf("unrecognized anomaly option '%s'", option)
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			}
+
+		case "brute_force":
+			zone.BruteForce = new(BruteForceProtection)
+			if d.NextArg() {
+				zone.BruteForce.Username = d.Val()
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				option := d.Val()
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				switch option {
+				case "lockout", "max_lockout":
+					dur, err := caddy.ParseDuration(d.Val())
+					if err != nil {
+						return d.Errf("invalid brute force %s '%s': %v", option, d.Val(), err)
+					}
+					if option == "lockout" {
+						zone.BruteForce.Lockout = caddy.Duration(dur)
+					} else {
+						zone.BruteForce.MaxLockout = caddy.Duration(dur)
+					}
+					if d.NextArg() {
+						return d.ArgErr()
+					}
+				case "failure_status":
+					for {
+						status, err := strconv.Atoi(d.Val())
+						if err != nil {
+							return d.Errf("invalid brute force failure status '%s': %v", d.Val(), err)
+						}
+						zone.BruteForce.FailureStatuses = append(zone.BruteForce.FailureStatuses, status)
+						if !d.NextArg() {
+							break
+						}
+					}
+				default:
+					return d.Errf("unrecognized brute force option '%s'", option)
+				}
+			}
+
+		case "warm_up":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid warm-up duration '%s': %v", d.Val(), err)
+			}
+			zone.WarmUp = &WarmUp{Duration: caddy.Duration(dur)}
+			if d.NextArg() {
+				factor, err := strconv.ParseFloat(d.Val(), 64)
+				if err != nil {
+					return d.Errf("invalid warm-up factor '%s': %v", d.Val(), err)
+				}
+				zone.WarmUp.Factor = factor
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+
+		case "greylist":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			maxEvents, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid greylist max events '%s': %v", d.Val(), err)
+			}
+			zone.Greylist = &Greylist{MaxEvents: maxEvents}
+			if d.NextArg() {
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid greylist duration '%s': %v", d.Val(), err)
+				}
+				zone.Greylist.Duration = caddy.Duration(dur)
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+
+		case "key_slow_start":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid key_slow_start duration '%s': %v", d.Val(), err)
+			}
+			zone.KeySlowStart = &KeySlowStart{Duration: caddy.Duration(dur)}
+			if d.NextArg() {
+				factor, err := strconv.ParseFloat(d.Val(), 64)
+				if err != nil {
+					return d.Errf("invalid key_slow_start factor '%s': %v", d.Val(), err)
+				}
+				zone.KeySlowStart.Factor = factor
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+
+		case "new_keys":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			maxKeys, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid new_keys max keys '%s': %v", d.Val(), err)
+			}
+			zone.NewKeys = &NewKeyLimit{MaxKeys: maxKeys}
+			if d.NextArg() {
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid new_keys interval '%s': %v", d.Val(), err)
+				}
+				zone.NewKeys.Interval = caddy.Duration(dur)
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+
+		case "retry_storm":
+			zone.RetryStorm = new(RetryStormDetection)
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				option := d.Val()
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				switch option {
+				case "interval", "ban_duration":
+					dur, err := caddy.ParseDuration(d.Val())
+					if err != nil {
+						return d.Errf("invalid retry storm %s '%s': %v", option, d.Val(), err)
+					}
+					if option == "interval" {
+						zone.RetryStorm.Interval = caddy.Duration(dur)
+					} else {
+						zone.RetryStorm.BanDuration = caddy.Duration(dur)
+					}
+				case "threshold":
+					threshold, err := strconv.Atoi(d.Val())
+					if err != nil {
+						return d.Errf("invalid retry storm threshold '%s': %v", d.Val(), err)
+					}
+					zone.RetryStorm.Threshold = threshold
+				default:
+					return d.Errf("unrecognized retry storm option '%s'", option)
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			}
+
+		case "distinct":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			zone.Distinct = &DistinctLimit{Value: d.Val()}
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			maxValues, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid distinct max values '%s': %v", d.Val(), err)
+			}
+			zone.Distinct.MaxValues = maxValues
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+
+		case "waf_score":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			zone.WAFScore = &WAFScore{Score: d.Val()}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				option := d.Val()
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				switch option {
+				case "threshold", "weight":
+					value, err := strconv.ParseFloat(d.Val(), 64)
+					if err != nil {
+						return d.Errf("invalid waf score %s '%s': %v", option, d.Val(), err)
+					}
+					if option == "threshold" {
+						zone.WAFScore.Threshold = value
+					} else {
+						zone.WAFScore.Weight = value
+					}
+				case "max_factor":
+					maxFactor, err := strconv.Atoi(d.Val())
+					if err != nil {
+						return d.Errf("invalid waf score max_factor '%s': %v", d.Val(), err)
+					}
+					zone.WAFScore.MaxFactor = maxFactor
+				default:
+					return d.Errf("unrecognized waf score option '%s'", option)
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			}
+
+		case "timezone":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			zone.Timezone = d.Val()
+
+		case "suggest":
+			zone.Suggest = new(LimitSuggestion)
+			if d.NextArg() {
+				period, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid suggestion period '%s': %v", d.Val(), err)
+				}
+				zone.Suggest.Period = caddy.Duration(period)
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				option := d.Val()
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				value, err := strconv.ParseFloat(d.Val(), 64)
+				if err != nil {
+					return d.Errf("invalid suggestion %s '%s': %v", option, d.Val(), err)
+				}
+				switch option {
+				case "percentile":
+					zone.Suggest.Percentile = value
+				case "headroom":
+					zone.Suggest.Headroom = value
+				default:
+					return d.Errf("unrecognized suggestion option '%s'", option)
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			}
+
+		case "decline_log":
+			zone.DeclineLog = new(DeclineLog)
+			if d.NextArg() {
+				sampleRate, err := strconv.ParseFloat(d.Val(), 64)
+				if err != nil {
+					return d.Errf("invalid decline log sample rate '%s': %v", d.Val(), err)
+				}
+				zone.DeclineLog.SampleRate = sampleRate
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+
+		case "log":
+			zone.Log = new(ZoneLog)
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				option := d.Val()
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				switch option {
+				case "name":
+					zone.Log.Name = d.Val()
+				case "level":
+					zone.Log.Level = d.Val()
+				default:
+					return d.Errf("unrecognized log option '%s'", option)
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			}
+
+		case "deny_list", "exempt_list":
+			directive := d.Val()
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			list := &KeyList{Source: d.Val()}
+			if d.NextArg() {
+				interval, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid %s refresh interval '%s': %v", directive, d.Val(), err)
+				}
+				list.RefreshInterval = caddy.Duration(interval)
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			if directive == "deny_list" {
+				zone.DenyList = list
+			} else {
+				zone.ExemptList = list
+			}
+
+		case "sweep_interval":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if zone.SweepInterval != 0 {
+				return d.Errf("zone sweep interval already specified: %v", zone.SweepInterval)
+			}
+			interval, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid sweep interval '%s': %v", d.Val(), err)
+			}
+			zone.SweepInterval = caddy.Duration(interval)
+
+		case "idempotency_window":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if zone.IdempotencyWindow != 0 {
+				return d.Errf("zone idempotency window already specified: %v", zone.IdempotencyWindow)
+			}
+			window, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid idempotency window '%s': %v", d.Val(), err)
+			}
+			zone.IdempotencyWindow = caddy.Duration(window)
+
+		case "count_once_per":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			zone.CountOncePer = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+
+		case "idle_ttl":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if zone.IdleTTL != 0 {
+				return d.Errf("zone idle TTL already specified: %v", zone.IdleTTL)
+			}
+			ttl, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid idle TTL '%s': %v", d.Val(), err)
+			}
+			zone.IdleTTL = caddy.Duration(ttl)
+
+		case "metrics_include_key":
+			includeKey := true
+			if d.NextArg() {
+				var err error
+				includeKey, err = strconv.ParseBool(d.Val())
+				if err != nil {
+					return d.Errf("invalid metrics include key boolean '%s': %v", d.Val(), err)
+				}
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			zone.MetricsIncludeKey = &includeKey
+
+		case "max_keys":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if zone.MaxKeys != 0 {
+				return d.Errf("zone max keys already specified: %v", zone.MaxKeys)
+			}
+			maxKeys, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid max keys integer '%s': %v", d.Val(), err)
+			}
+			zone.MaxKeys = maxKeys
+
+		case "max_zones":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if zone.MaxZones != 0 {
+				return d.Errf("zone max zones already specified: %v", zone.MaxZones)
+			}
+			maxZones, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid max zones integer '%s': %v", d.Val(), err)
+			}
+			zone.MaxZones = maxZones
+
+		case "first_seen_filter":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if zone.FirstSeenFilter != 0 {
+				return d.Errf("zone first-seen filter already specified: %v", zone.FirstSeenFilter)
+			}
+			capacity, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid first-seen filter capacity '%s': %v", d.Val(), err)
+			}
+			zone.FirstSeenFilter = capacity
+
+		case "usage_history":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if zone.UsageHistory != 0 {
+				return d.Errf("zone usage history already specified: %v", zone.UsageHistory)
+			}
+			windows, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid usage history '%s': %v", d.Val(), err)
+			}
+			zone.UsageHistory = windows
+
+		case "log_evictions":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			zone.LogEvictions = true
+
+		case "isolate_by_host":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			zone.IsolateByHost = true
+
+		case "count_repeats":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			zone.CountRepeats = true
+
+		case "coalesce":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			zone.Coalesce = true
+
+		case "tier_by":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			zone.TierBy = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+
+		case "tier":
+			args := d.RemainingArgs()
+			if len(args) < 2 || len(args) > 3 {
+				return d.ArgErr()
+			}
+			tier := &ZoneTier{Name: args[0]}
+			if args[1] == "unlimited" {
+				if len(args) == 3 {
+					return d.ArgErr()
+				}
+				tier.Unlimited = true
+			} else {
+				maxEvents, err := strconv.Atoi(args[1])
+				if err != nil {
+					return d.Errf("invalid tier events integer '%s': %v", args[1], err)
+				}
+				tier.MaxEvents = maxEvents
+				if len(args) == 3 {
+					tier.Key = args[2]
+				}
+			}
+			zone.Tiers = append(zone.Tiers, tier)
+
+		case "authenticated":
+			args := d.RemainingArgs()
+			if len(args) < 1 || len(args) > 2 {
+				return d.ArgErr()
+			}
+			maxEvents, err := strconv.Atoi(args[0])
+			if err != nil {
+				return d.Errf("invalid authenticated events integer '%s': %v", args[0], err)
+			}
+			zone.Authenticated = &AuthenticatedLimit{MaxEvents: maxEvents}
+			if len(args) == 2 {
+				zone.Authenticated.User = args[1]
+			}
+
+		case "match":
+			matcherSet, err := caddyhttp.ParseCaddyfileNestedMatcherSet(d)
+			if err != nil {
+				return d.Errf("failed to parse match: %w", err)
+			}
+
+			zone.MatcherSetsRaw = append(zone.MatcherSetsRaw, matcherSet)
+
+		default:
+			return d.Errf("unrecognized subdirective '%s'", d.Val())
+		}
+	}
+	return nil
+}
+
+// parseDiscovery parses the block of ownership's `discovery`.
+func parseDiscovery(d *caddyfile.Dispenser) (*PeerDiscovery, error) {
+	pd := new(PeerDiscovery)
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	var port string
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		if !d.NextArg() {
+			return nil, d.ArgErr()
+		}
+		switch option {
+		case "srv":
+			pd.SRV = d.Val()
+		case "kubernetes":
+			pd.Kubernetes = &KubernetesEndpoints{Service: d.Val()}
+			if d.NextArg() {
+				pd.Kubernetes.Namespace = d.Val()
+			}
+		case "port":
+			port = d.Val()
+		case "scheme":
+			pd.Scheme = d.Val()
+		case "interval":
+			interval, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return nil, d.Errf("invalid discovery interval '%s': %v", d.Val(), err)
+			}
+			pd.Interval = caddy.Duration(interval)
+		default:
+			return nil, d.Errf("unrecognized discovery option '%s'", option)
+		}
+		if d.NextArg() {
+			return nil, d.ArgErr()
+		}
+	}
+	if port != "" {
+		if pd.Kubernetes == nil {
+			return nil, d.Err("port requires kubernetes discovery")
+		}
+		pd.Kubernetes.Port = port
+	}
+	return pd, nil
+}
+
+// parseStorage parses a storage module, as in `storage <module...>`.
+func parseStorage(d *caddyfile.Dispenser) (json.RawMessage, error) {
+	if !d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	modID := "caddy.storage." + d.Val()
+	unm, err := caddyfile.UnmarshalModule(d, modID)
+	if err != nil {
+		return nil, err
+	}
+	storage, ok := unm.(caddy.StorageConverter)
+	if !ok {
+		return nil, d.Errf("module %s is not a caddy.StorageConverter", modID)
+	}
+	return caddyconfig.JSONModuleObject(storage, "module", storage.(caddy.Module).CaddyModule().ID.Name(), nil), nil
+}
+
+// parseHandlerDirectives unmarshals tokens from h into a new Middleware.
+func parseHandlerDirectives(helper httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	var h Handler
+	err := h.UnmarshalCaddyfile(helper.Dispenser)
+	return h, err
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler. Syntax:
+//
+//	rate_limit {
+//	    zone <name> {
+//	        policy <name>
+//	        renamed_from <name...>
+//	        max_zones <count>
+//	        preset api|login|crawl|download
+//	        key    <string>
+//	        window <duration>
+//	        events <max_events>
+//	        algorithm <name> [<options...>]
+//	        total_events <total_max_events>
+//	        overload_status <code>
+//	        cooldown <duration>
+//	        consistency strict|eventual|local
+//	        store_failure open|closed
+//	        method_cost <method> <cost>
+//	        method_events <method> <max_events>
+//	        path_cost <pattern> <cost>
+//	        cost_header <name>
+//	        refund_header <name>
+//	        idempotency_window <duration>
+//	        count_once_per connection|<placeholder>
+//	        response_bytes <size>
+//	        request_bytes <size>
+//	        schedule <name> {
+//	            days <day...>
+//	            from <time>
+//	            to   <time>
+//	            events <max_events>
+//	        }
+//	        timezone <name>
+//	        circuit_breaker {
+//	            upstreams <addresses...>
+//	            factor <fraction>
+//	            slow_start <duration>
+//	        }
+//	        anomaly [flag|ban] {
+//	            interval        <duration>
+//	            threshold       <stddevs>
+//	            min_events      <count>
+//	            learning_period <duration>
+//	            ban_duration    <duration>
+//	        }
+//	        brute_force [<username>] {
+//	            failure_status <codes...>
+//	            lockout        <duration>
+//	            max_lockout    <duration>
+//	        }
+//	        warm_up <duration> [<factor>]
+//	        greylist <max_events> [<duration>]
+//	        key_slow_start <duration> [<factor>]
+//	        new_keys <max_keys> [<interval>]
+//	        retry_storm {
+//	            interval     <duration>
+//	            threshold    <requests>
+//	            ban_duration <duration>
+//	        }
+//	        distinct <placeholder> <max_values>
+//	        waf_score <placeholder> {
+//	            threshold  <score>
+//	            weight     <factor>
+//	            max_factor <factor>
+//	        }
+//	        suggest [<period>] {
+//	            percentile <percent>
+//	            headroom   <factor>
+//	        }
+//	        near_limit <fraction>
+//	        pressure_header <name> [<threshold>]
+//	        decline_log [<sample_rate>]
+//	        log {
+//	            name  <name>
+//	            level debug|info|warn|error
+//	        }
+//	        deny_list   <file|url> [<refresh_interval>]
+//	        exempt_list <file|url> [<refresh_interval>]
+//	        metrics_include_key [true|false]
+//	        sweep_interval <duration>
+//	        idle_ttl <duration>
+//	        max_keys <count>
+//	        first_seen_filter <capacity>
+//	        usage_history <windows>
+//	        log_evictions
+//	        isolate_by_host
+//	        count_repeats
+//	        coalesce
+//	        tier_by <placeholder>
+//	        tier <name> <events>|unlimited [<key>]
+//	        authenticated <events> [<user>]
+//	        match {
+//	        	<matchers>
+//	        }
+//	    }
+//	    distributed {
+//	        read_interval  <duration>
+//	        write_interval <duration>
+//	        jitter    <percent>
+//	        compression none|gzip
+//	        purge_age <duration>
+//	        instance_id <id>
+//	        aggregation instances|leader
+//	        drain_reserve <percent>
+//	        max_clock_skew   <duration>
+//	        clock_correction none|storage
+//	        observe
+//	        timeout   <duration>
+//	        breaker {
+//	            failures       <count>
+//	            probe_interval <duration>
+//	        }
+//	        ownership <advertise_url> {
+//	            secret  <secret>
+//	            path    <path>
+//	            timeout <duration>
+//	            discovery {
+//	                srv        <name>
+//	                kubernetes <service> [<namespace>]
+//	                port       <name>
+//	                scheme     http|https
+//	                interval   <duration>
+//	            }
+//	        }
+//	    }
+//	    webhook <url> {
+//	        decline_threshold <count>
+//	        flush_interval    <duration>
+//	        max_batch_size    <count>
+//	        max_attempts      <count>
+//	    }
+//	    ban_hook {
+//	        on_ban   <command> [<args...>]
+//	        on_unban <command> [<args...>]
+//	        timeout  <duration>
+//	    }
+//	    ban_persistence {
+//	        sync_interval <duration>
+//	    }
+//	    websocket <name> [throttle] {
+//	        <zone options...>
+//	    }
+//	    user_agent_classes {
+//	        class <name> <patterns...>
+//	        disable_builtin
+//	    }
+//	    signing {
+//	        key      <id> <secret> [<tier>]
+//	        header   <name>
+//	        max_skew <duration>
+//	    }
+//	    challenge <provider> {
+//	        site_key      <key>
+//	        secret        <secret>
+//	        difficulty    <bits>
+//	        cookie_secret <secret>
+//	        ttl           <duration>
+//	        path          <path>
+//	        exempt
+//	    }
+//	    upstream_retry_after {
+//	        record
+//	        max_duration <duration>
+//	    }
+//	    usage_export [<period>] {
+//	        zones <names...>
+//	        file  <path> [json|csv]
+//	        url   <url>
+//	        storage
+//	    }
+//	    fail2ban <path>
+//	    max_concurrent_per_connection <count>
+//	    exempt_defaults
+//	    disable_cache_headers
+//	    retry_after_format seconds|http_date
+//	    tenant <placeholder>
+//	    log_key
+//	    storage <module...>
+//	    storage_namespace <path>
+//	    jitter  <percent>
+//	    sweep_interval <duration>
+//	}
+func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			if err := h.unmarshalOption(d); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// unmarshalOption unmarshals the handler option at the dispenser's
+// current token; see UnmarshalCaddyfile.
+func (h *Handler) unmarshalOption(d *caddyfile.Dispenser) error {
+	switch d.Val() {
+	case "zone":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		zoneName := d.Val()
+
+		var zone RateLimit
+		if err := parseZone(d, &zone); err != nil {
+			return err
+		}
+		if zone.Policy == "" && zone.Preset == "" && zone.BruteForce == nil && (zone.Window == 0 || !zone.limitsAnything()) {
+			return d.Err("a rate limit zone requires both a window and maximum events, bytes or distinct values, a policy, a preset, or brute_force")
+		}
+
+		zone.ZoneName = zoneName
+		h.RateLimits = append(h.RateLimits, &zone)
+
+	case "distributed":
+		h.Distributed = new(DistributedRateLimiting)
+
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			switch d.Val() {
+			case "read_interval":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				if h.Distributed.ReadInterval != 0 {
+					return d.Errf("read interval already specified: %v", h.Distributed.ReadInterval)
+				}
+				interval, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid read interval '%s': %v", d.Val(), err)
+				}
+				h.Distributed.ReadInterval = caddy.Duration(interval)
+
+			case "write_interval":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				if h.Distributed.WriteInterval != 0 {
+					return d.Errf("write interval already specified: %v", h.Distributed.WriteInterval)
+				}
+				interval, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid write interval '%s': %v", d.Val(), err)
+				}
+				h.Distributed.WriteInterval = caddy.Duration(interval)
+
+			case "jitter":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				jitter, err := strconv.ParseFloat(d.Val(), 64)
+				if err != nil {
+					return d.Errf("invalid sync jitter percentage '%s': %v", d.Val(), err)
+				}
+				h.Distributed.Jitter = jitter
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "drain_reserve":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				reserve, err := strconv.ParseFloat(d.Val(), 64)
+				if err != nil {
+					return d.Errf("invalid drain reserve percentage '%s': %v", d.Val(), err)
+				}
+				h.Distributed.DrainReserve = reserve
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "observe":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				h.Distributed.Observe = true
+
+			case "compression":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				h.Distributed.Compression = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "purge_age":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				if h.Distributed.PurgeAge != 0 {
+					return d.Errf("purge age already specified: %v", h.Distributed.PurgeAge)
+				}
+				age, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid purge age '%s': %v", d.Val(), err)
+				}
+				h.Distributed.PurgeAge = caddy.Duration(age)
+
+			case "aggregation":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				h.Distributed.Aggregation = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "max_clock_skew":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				skew, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid max clock skew '%s': %v", d.Val(), err)
+				}
+				h.Distributed.MaxClockSkew = caddy.Duration(skew)
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "clock_correction":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				h.Distributed.ClockCorrection = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "instance_id":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				h.Distributed.InstanceID = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "timeout":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				timeout, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid storage timeout '%s': %v", d.Val(), err)
+				}
+				h.Distributed.Timeout = caddy.Duration(timeout)
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "breaker":
+				if h.Distributed.Breaker != nil {
+					return d.Err("breaker already specified")
+				}
+				sb := new(StoreBreaker)
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					switch d.Val() {
+					case "failures":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						failures, err := strconv.Atoi(d.Val())
+						if err != nil {
+							return d.Errf("invalid breaker failures '%s': %v", d.Val(), err)
+						}
+						sb.Failures = failures
+					case "probe_interval":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						interval, err := caddy.ParseDuration(d.Val())
+						if err != nil {
+							return d.Errf("invalid breaker probe interval '%s': %v", d.Val(), err)
+						}
+						sb.ProbeInterval = caddy.Duration(interval)
+					default:
+						return d.Errf("unrecognized breaker option '%s'", d.Val())
+					}
+					if d.NextArg() {
+						return d.ArgErr()
+					}
+				}
+				h.Distributed.Breaker = sb
+
+			case "ownership":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				if h.Distributed.Ownership != nil {
+					return d.Err("ownership already specified")
+				}
+				ko := &KeyOwnership{Advertise: d.Val()}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					switch d.Val() {
+					case "secret":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						ko.Secret = d.Val()
+					case "path":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						ko.Path = d.Val()
+					case "timeout":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						timeout, err := caddy.ParseDuration(d.Val())
+						if err != nil {
+							return d.Errf("invalid ownership timeout '%s': %v", d.Val(), err)
+						}
+						ko.Timeout = caddy.Duration(timeout)
+					case "discovery":
+						if ko.Discovery != nil {
+							return d.Err("discovery already specified")
+						}
+						pd, err := parseDiscovery(d)
+						if err != nil {
+							return err
+						}
+						ko.Discovery = pd
+					default:
+						return d.Errf("unrecognized ownership option '%s'", d.Val())
+					}
+					if d.NextArg() {
+						return d.ArgErr()
+					}
+				}
+				h.Distributed.Ownership = ko
+
+			default:
+				return d.Errf("unrecognized subdirective '%s'", d.Val())
+			}
+		}
+
+	case "webhook":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		h.Webhook = &WebhookNotifier{URL: d.Val()}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			switch d.Val() {
+			case "decline_threshold", "max_batch_size", "max_attempts":
+				opt := d.Val()
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				val, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid %s integer '%s': %v", opt, d.Val(), err)
+				}
+				switch opt {
+				case "decline_threshold":
+					h.Webhook.DeclineThreshold = val
+				case "max_batch_size":
+					h.Webhook.MaxBatchSize = val
+				case "max_attempts":
+					h.Webhook.MaxAttempts = val
+				}
+
+			case "flush_interval":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				interval, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid flush interval '%s': %v", d.Val(), err)
+				}
+				h.Webhook.FlushInterval = caddy.Duration(interval)
+
+			default:
+				return d.Errf("unrecognized subdirective '%s'", d.Val())
+			}
+		}
+
+	case "ban_hook":
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		h.BanHook = new(BanExecHook)
+
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			switch d.Val() {
+			case "on_ban":
+				h.BanHook.OnBan = d.RemainingArgs()
+				if len(h.BanHook.OnBan) == 0 {
+					return d.ArgErr()
+				}
+
+			case "on_unban":
+				h.BanHook.OnUnban = d.RemainingArgs()
+				if len(h.BanHook.OnUnban) == 0 {
+					return d.ArgErr()
+				}
+
+			case "timeout":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				timeout, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid timeout '%s': %v", d.Val(), err)
+				}
+				h.BanHook.Timeout = caddy.Duration(timeout)
+
+			default:
+				return d.Errf("unrecognized subdirective '%s'", d.Val())
+			}
+		}
+
+	case "usage_export":
+		h.UsageExport = new(UsageExport)
+		if d.NextArg() {
+			period, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid period '%s': %v", d.Val(), err)
+			}
+			h.UsageExport.Period = caddy.Duration(period)
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			switch d.Val() {
+			case "zones":
+				h.UsageExport.Zones = d.RemainingArgs()
+				if len(h.UsageExport.Zones) == 0 {
+					return d.ArgErr()
+				}
+
+			case "file":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				h.UsageExport.File = d.Val()
+				if d.NextArg() {
+					h.UsageExport.Format = d.Val()
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "url":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				h.UsageExport.URL = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
 
-	return httpcaddyfile.App{
-		Name:  "rate_limit",
-		Value: caddyconfig.JSON(app, nil),
-	}, nil
-}
+			case "storage":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				h.UsageExport.Storage = true
 
-// parseHandlerDirectives unmarshals tokens from h into a new Middleware.
-func parseHandlerDirectives(helper httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
-	var h Handler
-	err := h.UnmarshalCaddyfile(helper.Dispenser)
-	return h, err
-}
+			default:
+				return d.Errf("unrecognized subdirective '%s'", d.Val())
+			}
+		}
 
-// UnmarshalCaddyfile implements caddyfile.Unmarshaler. Syntax:
-//
-//	rate_limit {
-//	    zone <name> {
-//	        key    <string>
-//	        window <duration>
-//	        events <max_events>
-//	        match {
-//	        	<matchers>
-//	        }
-//	    }
-//	    distributed {
-//	        read_interval  <duration>
-//	        write_interval <duration>
-//	        purge_age <duration>
-//	    }
-//	    log_key
-//	    storage <module...>
-//	    jitter  <percent>
-//	    sweep_interval <duration>
-//	}
-func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
-	for d.Next() {
+	case "ban_persistence":
 		if d.NextArg() {
 			return d.ArgErr()
 		}
+		h.BanPersistence = new(BanPersistence)
 
 		for nesting := d.Nesting(); d.NextBlock(nesting); {
 			switch d.Val() {
-			case "zone":
+			case "sync_interval":
 				if !d.NextArg() {
 					return d.ArgErr()
 				}
-				zoneName := d.Val()
-
-				var zone RateLimit
-				for nesting := d.Nesting(); d.NextBlock(nesting); {
-					switch d.Val() {
-					case "key":
-						if !d.NextArg() {
-							return d.ArgErr()
-						}
-						if zone.Key != "" {
-							return d.Errf("zone key already specified: %s", zone.Key)
-						}
-						zone.Key = d.Val()
-
-					case "window":
-						if !d.NextArg() {
-							return d.ArgErr()
-						}
-						if zone.Window != 0 {
-							return d.Errf("zone window already specified: %v", zone.Window)
-						}
-						window, err := caddy.ParseDuration(d.Val())
-						if err != nil {
-							return d.Errf("invalid window duration '%s': %v", d.Val(), err)
-						}
-						zone.Window = caddy.Duration(window)
+				interval, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid sync_interval '%s': %v", d.Val(), err)
+				}
+				h.BanPersistence.SyncInterval = caddy.Duration(interval)
 
-					case "events":
-						if !d.NextArg() {
-							return d.ArgErr()
-						}
-						if zone.MaxEvents != 0 {
-							return d.Errf("zone max events already specified: %v", zone.MaxEvents)
-						}
-						maxEvents, err := strconv.Atoi(d.Val())
-						if err != nil {
-							return d.Errf("invalid max events integer '%s': %v", d.Val(), err)
-						}
-						zone.MaxEvents = maxEvents
+			default:
+				return d.Errf("unrecognized subdirective '%s'", d.Val())
+			}
+		}
 
-					case "match":
-						matcherSet, err := caddyhttp.ParseCaddyfileNestedMatcherSet(d)
-						if err != nil {
-							return d.Errf("failed to parse match: %w", err)
-						}
+	case "websocket":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		if h.WebSocket != nil {
+			return d.Err("websocket limit already specified")
+		}
+		h.WebSocket = &WebSocketLimit{Zone: &RateLimit{ZoneName: d.Val()}}
+		if d.NextArg() {
+			if d.Val() != "throttle" {
+				return d.Errf("unrecognized websocket option '%s'", d.Val())
+			}
+			h.WebSocket.Throttle = true
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		if err := parseZone(d, h.WebSocket.Zone); err != nil {
+			return err
+		}
+		if zone := h.WebSocket.Zone; zone.Policy == "" && (zone.Window == 0 || zone.MaxEvents == 0) {
+			return d.Err("a websocket limit requires both a window and maximum events, or a policy")
+		}
 
-						zone.MatcherSetsRaw = append(zone.MatcherSetsRaw, matcherSet)
+	case "user_agent_classes":
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		if h.UserAgentClasses == nil {
+			h.UserAgentClasses = new(UserAgentClassifier)
+		}
 
-					default:
-						return d.Errf("unrecognized subdirective '%s'", d.Val())
-					}
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			switch d.Val() {
+			case "class":
+				if !d.NextArg() {
+					return d.ArgErr()
 				}
-				if zone.Window == 0 || zone.MaxEvents == 0 {
-					return d.Err("a rate limit zone requires both a window and maximum events")
+				rule := &UserAgentRule{Class: d.Val(), Patterns: d.RemainingArgs()}
+				if len(rule.Patterns) == 0 {
+					return d.ArgErr()
 				}
+				h.UserAgentClasses.Rules = append(h.UserAgentClasses.Rules, rule)
 
-				zone.ZoneName = zoneName
-				h.RateLimits = append(h.RateLimits, &zone)
-
-			case "distributed":
-				h.Distributed = new(DistributedRateLimiting)
-
-				for nesting := d.Nesting(); d.NextBlock(nesting); {
-					switch d.Val() {
-					case "read_interval":
-						if !d.NextArg() {
-							return d.ArgErr()
-						}
-						if h.Distributed.ReadInterval != 0 {
-							return d.Errf("read interval already specified: %v", h.Distributed.ReadInterval)
-						}
-						interval, err := caddy.ParseDuration(d.Val())
-						if err != nil {
-							return d.Errf("invalid read interval '%s': %v", d.Val(), err)
-						}
-						h.Distributed.ReadInterval = caddy.Duration(interval)
+			case "disable_builtin":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				h.UserAgentClasses.DisableBuiltin = true
 
-					case "write_interval":
-						if !d.NextArg() {
-							return d.ArgErr()
-						}
-						if h.Distributed.WriteInterval != 0 {
-							return d.Errf("write interval already specified: %v", h.Distributed.WriteInterval)
-						}
-						interval, err := caddy.ParseDuration(d.Val())
-						if err != nil {
-							return d.Errf("invalid write interval '%s': %v", d.Val(), err)
-						}
-						h.Distributed.WriteInterval = caddy.Duration(interval)
+			default:
+				return d.Errf("unrecognized subdirective '%s'", d.Val())
+			}
+		}
 
-					case "purge_age":
-						if !d.NextArg() {
-							return d.ArgErr()
-						}
-						if h.Distributed.PurgeAge != 0 {
-							return d.Errf("purge age already specified: %v", h.Distributed.PurgeAge)
-						}
-						age, err := caddy.ParseDuration(d.Val())
-						if err != nil {
-							return d.Errf("invalid purge age '%s': %v", d.Val(), err)
-						}
-						h.Distributed.PurgeAge = caddy.Duration(age)
+	case "signing":
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		if h.Signing == nil {
+			h.Signing = new(RequestSigning)
+		}
 
-					default:
-						return d.Errf("unrecognized subdirective '%s'", d.Val())
-					}
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			switch d.Val() {
+			case "key":
+				args := d.RemainingArgs()
+				if len(args) < 2 || len(args) > 3 {
+					return d.ArgErr()
 				}
+				key := &SigningKey{ID: args[0], Secret: args[1]}
+				if len(args) == 3 {
+					key.Tier = args[2]
+				}
+				h.Signing.Keys = append(h.Signing.Keys, key)
 
-			case "log_key":
+			case "header":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				h.Signing.Header = d.Val()
 				if d.NextArg() {
 					return d.ArgErr()
 				}
-				h.LogKey = true
 
-			case "storage":
+			case "max_skew":
 				if !d.NextArg() {
 					return d.ArgErr()
 				}
-				modID := "caddy.storage." + d.Val()
-				unm, err := caddyfile.UnmarshalModule(d, modID)
+				dur, err := caddy.ParseDuration(d.Val())
 				if err != nil {
-					return err
+					return d.Errf("invalid max_skew duration '%s': %v", d.Val(), err)
 				}
-				storage, ok := unm.(caddy.StorageConverter)
-				if !ok {
-					return d.Errf("module %s is not a caddy.StorageConverter", modID)
+				h.Signing.MaxSkew = caddy.Duration(dur)
+				if d.NextArg() {
+					return d.ArgErr()
 				}
-				h.StorageRaw = caddyconfig.JSONModuleObject(storage, "module", storage.(caddy.Module).CaddyModule().ID.Name(), nil)
 
-			case "jitter":
+			default:
+				return d.Errf("unrecognized subdirective '%s'", d.Val())
+			}
+		}
+
+	case "challenge":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		h.Challenge = &Challenge{Provider: d.Val()}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			option := d.Val()
+			switch option {
+			case "site_key", "secret", "cookie_secret", "path":
 				if !d.NextArg() {
 					return d.ArgErr()
 				}
-				if h.Jitter != 0 {
-					return d.Errf("jitter already specified: %v", h.Jitter)
+				switch option {
+				case "site_key":
+					h.Challenge.SiteKey = d.Val()
+				case "secret":
+					h.Challenge.Secret = d.Val()
+				case "cookie_secret":
+					h.Challenge.CookieSecret = d.Val()
+				case "path":
+					h.Challenge.Path = d.Val()
 				}
-				jitter, err := strconv.ParseFloat(d.Val(), 64)
-				if err != nil {
-					return d.Errf("invalid jitter percentage '%s': %v", d.Val(), err)
+				if d.NextArg() {
+					return d.ArgErr()
 				}
-				h.Jitter = jitter
 
-			case "sweep_interval":
+			case "difficulty":
 				if !d.NextArg() {
 					return d.ArgErr()
 				}
-				if h.SweepInterval != 0 {
-					return d.Errf("sweep interval already specified: %v", h.SweepInterval)
+				difficulty, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid difficulty '%s': %v", d.Val(), err)
 				}
-				interval, err := caddy.ParseDuration(d.Val())
+				h.Challenge.Difficulty = difficulty
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "ttl":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				ttl, err := caddy.ParseDuration(d.Val())
 				if err != nil {
-					return d.Errf("invalid sweep interval '%s': %v", d.Val(), err)
+					return d.Errf("invalid ttl '%s': %v", d.Val(), err)
+				}
+				h.Challenge.TTL = caddy.Duration(ttl)
+
+			case "exempt":
+				if d.NextArg() {
+					return d.ArgErr()
 				}
-				h.SweepInterval = caddy.Duration(interval)
+				h.Challenge.Exempt = true
 
 			default:
 				return d.Errf("unrecognized subdirective '%s'", d.Val())
 			}
 		}
-	}
 
+	case "upstream_retry_after":
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		if h.UpstreamRetryAfter != nil {
+			return d.Err("upstream retry-after already specified")
+		}
+		h.UpstreamRetryAfter = new(UpstreamRetryAfter)
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			switch d.Val() {
+			case "record":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				h.UpstreamRetryAfter.Record = true
+			case "max_duration":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				maxDuration, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid max duration '%s': %v", d.Val(), err)
+				}
+				h.UpstreamRetryAfter.MaxDuration = caddy.Duration(maxDuration)
+			default:
+				return d.Errf("unrecognized upstream retry-after option '%s'", d.Val())
+			}
+		}
+
+	case "fail2ban":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		h.Fail2Ban = &Fail2BanLog{Path: d.Val()}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+
+	case "max_concurrent_per_connection":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		maxConcurrent, err := strconv.Atoi(d.Val())
+		if err != nil {
+			return d.Errf("invalid max concurrent requests per connection '%s': %v", d.Val(), err)
+		}
+		h.MaxConcurrentPerConnection = maxConcurrent
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+
+	case "exempt_defaults":
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		h.ExemptDefaults = true
+
+	case "disable_cache_headers":
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		h.DisableCacheHeaders = true
+
+	case "retry_after_format":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		switch d.Val() {
+		case retryAfterSeconds, retryAfterHTTPDate:
+			h.RetryAfterFormat = d.Val()
+		default:
+			return d.Errf("unknown retry_after_format '%s'", d.Val())
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+
+	case "tenant":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		if h.Tenant != "" {
+			return d.Errf("tenant already specified: %s", h.Tenant)
+		}
+		h.Tenant = d.Val()
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+
+	case "log_key":
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		h.LogKey = true
+
+	case "storage":
+		storageRaw, err := parseStorage(d)
+		if err != nil {
+			return err
+		}
+		h.StorageRaw = storageRaw
+
+	case "storage_namespace":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		h.StorageNamespace = d.Val()
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+
+	case "jitter":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		if h.Jitter != 0 {
+			return d.Errf("jitter already specified: %v", h.Jitter)
+		}
+		jitter, err := strconv.ParseFloat(d.Val(), 64)
+		if err != nil {
+			return d.Errf("invalid jitter percentage '%s': %v", d.Val(), err)
+		}
+		h.Jitter = jitter
+
+	case "sweep_interval":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		if h.SweepInterval != 0 {
+			return d.Errf("sweep interval already specified: %v", h.SweepInterval)
+		}
+		interval, err := caddy.ParseDuration(d.Val())
+		if err != nil {
+			return d.Errf("invalid sweep interval '%s': %v", d.Val(), err)
+		}
+		h.SweepInterval = caddy.Duration(interval)
+
+	default:
+		return d.Errf("unrecognized subdirective '%s'", d.Val())
+	}
 	return nil
 }
+
+// Interface guards
+var (
+	_ caddyfile.Unmarshaler = (*Handler)(nil)
+)
@@ -18,7 +18,10 @@ import (
 	"bytes"
 	"fmt"
 	"testing"
+	"time"
 
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddytest"
 )
 
@@ -73,3 +76,73 @@ func TestCaddyfileRateLimits(t *testing.T) {
 
 	tester.AssertGetResponse("http://localhost:8080", 200, "")
 }
+
+func TestUnmarshalCaddyfile(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`
+	rate_limit {
+		zone login {
+			match {
+				method POST
+				path /login
+			}
+			key    {http.request.remote.host}
+			window 1m
+			events 5
+		}
+		zone api {
+			key    static
+			window 10s
+			events 100
+		}
+		jitter 0.2
+		tenant {http.request.header.X-Tenant-ID}
+	}`)
+
+	var h Handler
+	if err := h.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshaling Caddyfile: %v", err)
+	}
+	if len(h.RateLimits) != 2 {
+		t.Fatalf("expected 2 zones, got %d", len(h.RateLimits))
+	}
+	login := h.RateLimits[0]
+	if login.ZoneName != "login" || login.Key != "{http.request.remote.host}" ||
+		login.Window != caddy.Duration(time.Minute) || login.MaxEvents != 5 {
+		t.Fatalf("unexpected zone: %+v", login)
+	}
+	if len(login.MatcherSetsRaw) != 1 || len(login.MatcherSetsRaw[0]) != 2 {
+		t.Fatalf("expected one matcher set with two matchers, got %v", login.MatcherSetsRaw)
+	}
+	if h.RateLimits[1].ZoneName != "api" || h.Jitter != 0.2 {
+		t.Fatalf("unexpected config: %+v, jitter %v", h.RateLimits[1], h.Jitter)
+	}
+	if h.Tenant != "{http.request.header.X-Tenant-ID}" {
+		t.Fatalf("unexpected tenant: %s", h.Tenant)
+	}
+
+	for _, input := range []string{
+		`rate_limit {
+			zone incomplete {
+				key static
+				window 1m
+			}
+		}`,
+		`rate_limit {
+			zone bad_window {
+				window forever
+				events 5
+			}
+		}`,
+		`rate_limit {
+			bogus
+		}`,
+		`rate_limit {
+			tenant {http.request.host} {http.request.header.X-Tenant-ID}
+		}`,
+	} {
+		var h Handler
+		if err := h.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err == nil {
+			t.Errorf("expected error for input: %s", input)
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package caddyrl
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// Challenge responds to declined browser requests with a challenge page
+// instead of an error. Clients that pass the challenge get a signed
+// cookie (a pass), which sets the `{http.rate_limit.challenge_passed}`
+// placeholder to `true` on their requests until it expires, so that
+// zones can give them higher limits, or which exempts them from the
+// handler's zones altogether. Clients that are declined while they hold
+// a pass get the usual error.
+//
+// Only GET and HEAD requests that accept HTML are challenged; other
+// requests, e.g. of APIs, are declined as usual.
+type Challenge struct {
+	// The CAPTCHA service that verifies clients: `turnstile` (Cloudflare
+	// Turnstile) or `hcaptcha`; or `proof_of_work`, a hash puzzle that
+	// the page solves with JavaScript, without any third party.
+	Provider string `json:"provider"`
+
+	// The site key and secret of the CAPTCHA service. Placeholders such
+	// as `{env.TURNSTILE_SECRET}` are replaced when the config is loaded.
+	// Not used by proof_of_work.
+	SiteKey string `json:"site_key,omitempty"`
+	Secret  string `json:"secret,omitempty"`
+
+	// The number of leading zero bits that the hash of a proof-of-work
+	// solution must have. Each bit doubles the work of clients, which
+	// is about a second at 20 on a typical device. Default: 20
+	Difficulty int `json:"difficulty,omitempty"`
+
+	// The key with which passes are signed. Placeholders are replaced
+	// when the config is loaded. Instances that serve the same clients
+	// need the same key to honor each other's passes. Default: a random
+	// key, which changes when the process restarts
+	CookieSecret string `json:"cookie_secret,omitempty"`
+
+	// How long a pass is valid. Default: 1h
+	TTL caddy.Duration `json:"ttl,omitempty"`
+
+	// The path to which the challenge page submits its solution.
+	// Default: /.well-known/rate-limit-challenge
+	Path string `json:"path,omitempty"`
+
+	// If true, requests of clients with a pass are not limited by the
+	// handler's zones, except for the app's global zone.
+	Exempt bool `json:"exempt,omitempty"`
+
+	cookieKey []byte
+	verifyURL string
+	client    *http.Client
+	logger    *zap.Logger
+}
+
+// challengeProviders are the widgets and verification endpoints of the
+// supported CAPTCHA services.
+var challengeProviders = map[string]struct {
+	script, widgetClass, formField, verifyURL string
+}{
+	"turnstile": {
+		script:      "https://challenges.cloudflare.com/turnstile/v0/api.js",
+		widgetClass: "cf-turnstile",
+		formField:   "cf-turnstile-response",
+		verifyURL:   "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+	},
+	"hcaptcha": {
+		script:      "https://js.hcaptcha.com/1/api.js",
+		widgetClass: "h-captcha",
+		formField:   "h-captcha-response",
+		verifyURL:   "https://api.hcaptcha.com/siteverify",
+	},
+}
+
+// challengePassCookie is the name of the cookie that holds a pass.
+const challengePassCookie = "caddy_rate_limit_pass"
+
+var (
+	// key that signs passes if no cookie secret is configured; it is
+	// kept across config reloads, so passes outlive them
+	defaultChallengeKey     []byte
+	defaultChallengeKeyOnce sync.Once
+)
+
+func (c *Challenge) provision(logger *zap.Logger) error {
+	repl := caddy.NewReplacer()
+	if c.Provider == challengeProofOfWork {
+		if c.Difficulty == 0 {
+			c.Difficulty = 20
+		}
+		if c.Difficulty < 1 || c.Difficulty > 32 {
+			return fmt.Errorf("difficulty must be between 1 and 32")
+		}
+	} else {
+		provider, ok := challengeProviders[c.Provider]
+		if !ok {
+			return fmt.Errorf("unknown provider '%s'", c.Provider)
+		}
+		c.SiteKey = repl.ReplaceKnown(c.SiteKey, "")
+		c.Secret = repl.ReplaceKnown(c.Secret, "")
+		if c.SiteKey == "" || c.Secret == "" {
+			return fmt.Errorf("site_key and secret are required")
+		}
+		if c.verifyURL == "" {
+			c.verifyURL = provider.verifyURL
+		}
+	}
+	if cookieSecret := repl.ReplaceKnown(c.CookieSecret, ""); cookieSecret != "" {
+		c.cookieKey = []byte(cookieSecret)
+	} else {
+		defaultChallengeKeyOnce.Do(func() {
+			defaultChallengeKey = make([]byte, 32)
+			_, _ = rand.Read(defaultChallengeKey)
+		})
+		c.cookieKey = defaultChallengeKey
+	}
+	if c.TTL == 0 {
+		c.TTL = caddy.Duration(time.Hour)
+	}
+	if c.TTL < 0 {
+		return fmt.Errorf("ttl must be greater than zero")
+	}
+	if c.Path == "" {
+		c.Path = "/.well-known/rate-limit-challenge"
+	}
+	if !strings.HasPrefix(c.Path, "/") {
+		return fmt.Errorf("path must start with '/'")
+	}
+	c.client = &http.Client{Timeout: 10 * time.Second}
+	c.logger = logger
+	return nil
+}
+
+// challengeable returns true if r may be answered with a challenge page.
+func (c *Challenge) challengeable(r *http.Request) bool {
+	return (r.Method == http.MethodGet || r.Method == http.MethodHead) &&
+		strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// passed returns true if r carries a valid pass for its client.
+func (c *Challenge) passed(r *http.Request) bool {
+	cookie, err := r.Cookie(challengePassCookie)
+	if err != nil {
+		return false
+	}
+	expires, signature, ok := strings.Cut(cookie.Value, ".")
+	if !ok {
+		return false
+	}
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || now().Unix() >= unix {
+		return false
+	}
+	want, err := base64.RawURLEncoding.DecodeString(signature)
+	return err == nil && hmac.Equal(want, c.sign("pass", expires, remoteIPOf(r)))
+}
+
+// sign returns the signature of the given parts, e.g. of a pass that
+// expires at some Unix time for the client at some IP address. Passes
+// and puzzles are bound to the client's IP address, so that a solved
+// challenge can't be shared by many clients.
+func (c *Challenge) sign(parts ...string) []byte {
+	mac := hmac.New(sha256.New, c.cookieKey)
+	mac.Write([]byte(strings.Join(parts, "|")))
+	return mac.Sum(nil)
+}
+
+// setPass sets the cookie of a pass for the client of r.
+func (c *Challenge) setPass(w http.ResponseWriter, r *http.Request) {
+	expires := now().Add(time.Duration(c.TTL))
+	unix := strconv.FormatInt(expires.Unix(), 10)
+	http.SetCookie(w, &http.Cookie{
+		Name:     challengePassCookie,
+		Value:    unix + "." + base64.RawURLEncoding.EncodeToString(c.sign("pass", unix, remoteIPOf(r))),
+		Path:     "/",
+		Expires:  expires,
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// challengeDeclined is the error of declined requests that are to be
+// answered with a challenge page.
+type challengeDeclined struct{}
+
+func (challengeDeclined) Error() string { return "request declined: challenge required" }
+
+// challengePage is the page that challenges declined clients.
+var challengePage = template.Must(template.New("challenge").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Just a moment</title>
+<script src="{{.Script}}" async defer></script>
+</head>
+<body>
+<h1>Just a moment</h1>
+<p>You have sent a lot of requests. Please confirm that you are human to continue.</p>
+<form method="POST" action="{{.Path}}">
+<input type="hidden" name="redirect" value="{{.Redirect}}">
+<div class="{{.WidgetClass}}" data-sitekey="{{.SiteKey}}"></div>
+<button type="submit">Continue</button>
+</form>
+</body>
+</html>
+`))
+
+// writePage writes the challenge page for the declined request r.
+func (c *Challenge) writePage(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusTooManyRequests)
+	if r.Method == http.MethodHead {
+		return nil
+	}
+	if c.Provider == challengeProofOfWork {
+		return proofOfWorkPage.Execute(w, map[string]any{
+			"Puzzle":     c.puzzle(r),
+			"Difficulty": c.Difficulty,
+			"Path":       c.Path,
+			"Redirect":   r.URL.RequestURI(),
+		})
+	}
+	provider := challengeProviders[c.Provider]
+	return challengePage.Execute(w, map[string]string{
+		"Script":      provider.script,
+		"WidgetClass": provider.widgetClass,
+		"SiteKey":     c.SiteKey,
+		"Path":        c.Path,
+		"Redirect":    r.URL.RequestURI(),
+	})
+}
+
+// serveVerify verifies the solution that the challenge page submitted,
+// and if it is valid, gives the client a pass and redirects it back to
+// the page it was declined on.
+func (c *Challenge) serveVerify(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return nil
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 64<<10)
+	if err := r.ParseForm(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return nil
+	}
+
+	var ok bool
+	var err error
+	if c.Provider == challengeProofOfWork {
+		ok = c.verifyWork(r, r.PostForm.Get("puzzle"), r.PostForm.Get("nonce"))
+	} else {
+		ok, err = c.verify(r, r.PostForm.Get(challengeProviders[c.Provider].formField))
+	}
+	if err != nil {
+		c.logger.Error("verifying challenge", zap.String("provider", c.Provider), zap.Error(err))
+		w.WriteHeader(http.StatusBadGateway)
+		return nil
+	}
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+		return nil
+	}
+	c.setPass(w, r)
+
+	// only redirect within the site
+	redirect := r.PostForm.Get("redirect")
+	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") || strings.HasPrefix(redirect, "/\\") {
+		redirect = "/"
+	}
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+	return nil
+}
+
+// verify asks the CAPTCHA service whether response, the token of the
+// widget, is a solved challenge.
+func (c *Challenge) verify(r *http.Request, response string) (bool, error) {
+	if response == "" {
+		return false, nil
+	}
+	form := url.Values{
+		"secret":   {c.Secret},
+		"response": {response},
+		"remoteip": {remoteIPOf(r)},
+	}
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, c.verifyURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var result struct {
+		Success bool `json:"success"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return false, fmt.Errorf("decoding response: %v", err)
+	}
+	return result.Success, nil
+}
@@ -0,0 +1,117 @@
+package caddyrl
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestChallenge(t *testing.T) {
+	initTime()
+
+	verifier := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.PostFormValue("secret") != "secret" {
+			t.Errorf("unexpected secret %q", r.PostFormValue("secret"))
+		}
+		if r.PostFormValue("response") == "solved" {
+			w.Write([]byte(`{"success": true}`))
+		} else {
+			w.Write([]byte(`{"success": false}`))
+		}
+	}))
+	defer verifier.Close()
+
+	c := &Challenge{Provider: "turnstile", SiteKey: "site", Secret: "secret", verifyURL: verifier.URL}
+	if err := c.provision(zap.NewNop()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// browsers navigating to pages are challenged
+	r := httptest.NewRequest(http.MethodGet, "/page?q=1", nil)
+	r.Header.Set("Accept", "text/html,application/xhtml+xml")
+	if !c.challengeable(r) {
+		t.Error("expected a page request to be challengeable")
+	}
+	api := httptest.NewRequest(http.MethodPost, "/api", nil)
+	api.Header.Set("Accept", "application/json")
+	if c.challengeable(api) {
+		t.Error("expected an API request not to be challengeable")
+	}
+
+	w := httptest.NewRecorder()
+	if err := c.writePage(w, r); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected status 429, got %d", w.Code)
+	}
+	for _, want := range []string{`class="cf-turnstile" data-sitekey="site"`, `action="/.well-known/rate-limit-challenge"`, `value="/page?q=1"`} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("expected challenge page to contain %s, got:\n%s", want, w.Body.String())
+		}
+	}
+
+	submit := func(response, redirect string) *httptest.ResponseRecorder {
+		form := url.Values{"cf-turnstile-response": {response}, "redirect": {redirect}}
+		r := httptest.NewRequest(http.MethodPost, c.Path, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		if err := c.serveVerify(w, r); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return w
+	}
+
+	if w := submit("wrong", "/page"); w.Code != http.StatusForbidden || len(w.Result().Cookies()) != 0 {
+		t.Errorf("expected a failed challenge to be forbidden without a pass, got %d", w.Code)
+	}
+	if w := submit("solved", "//evil.example"); w.Header().Get("Location") != "/" {
+		t.Errorf("expected redirects off the site to be ignored, got %s", w.Header().Get("Location"))
+	}
+	w = submit("solved", "/page?q=1")
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/page?q=1" {
+		t.Errorf("expected a redirect back to the page, got %d to %s", w.Code, w.Header().Get("Location"))
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != challengePassCookie {
+		t.Fatalf("expected a pass, got %v", cookies)
+	}
+
+	r.AddCookie(cookies[0])
+	if !c.passed(r) {
+		t.Error("expected the pass to be valid")
+	}
+
+	// passes are bound to the client's IP address
+	other := httptest.NewRequest(http.MethodGet, "/page", nil)
+	other.RemoteAddr = "192.0.2.2:1234"
+	other.AddCookie(cookies[0])
+	if c.passed(other) {
+		t.Error("expected the pass to be invalid for another client")
+	}
+
+	forged := httptest.NewRequest(http.MethodGet, "/page", nil)
+	forged.AddCookie(&http.Cookie{Name: challengePassCookie, Value: "99999999999.AAAA"})
+	if c.passed(forged) {
+		t.Error("expected a forged pass to be invalid")
+	}
+
+	advanceTime(3600)
+	if c.passed(r) {
+		t.Error("expected the pass to expire")
+	}
+
+	for _, c := range []*Challenge{
+		{Provider: "recaptcha", SiteKey: "site", Secret: "secret"},
+		{Provider: "hcaptcha", SiteKey: "site"},
+		{Provider: "hcaptcha", SiteKey: "site", Secret: "secret", Path: "challenge"},
+	} {
+		if err := c.provision(zap.NewNop()); err == nil {
+			t.Errorf("expected an error for challenge %+v", c)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package caddyrl
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
+	"go.uber.org/zap"
+)
+
+// CircuitBreaker couples a zone's limits to the health of reverse_proxy
+// upstreams: while an upstream is unhealthy, the zone's event limits are
+// reduced (or zeroed), and once all upstreams are healthy again, they
+// ramp back up gradually, so that a recovering backend isn't flooded
+// right away. Health is learned from the `healthy` and `unhealthy`
+// events of reverse_proxy's active health checks.
+type CircuitBreaker struct {
+	// The upstreams whose health the zone follows, as the addresses in
+	// the events of health checks, e.g. `10.0.0.1:8080`. Default: all
+	Upstreams []string `json:"upstreams,omitempty"`
+
+	// Factor by which the zone's event limits are multiplied while an
+	// upstream is unhealthy, between 0 and 1. Default: 0 (decline all)
+	Factor float64 `json:"factor,omitempty"`
+
+	// Duration over which the limits ramp back up from the factor to
+	// their full value once all upstreams are healthy again.
+	// Default: 0 (restore them right away)
+	SlowStart caddy.Duration `json:"slow_start,omitempty"`
+
+	zone   *RateLimit
+	ctx    context.Context
+	logger *zap.Logger
+
+	mu        sync.Mutex
+	unhealthy map[string]struct{}
+	ramps     int // incremented to stop the running ramp
+}
+
+// provision sets up the breaker of zone, which follows the health
+// events of events.
+func (cb *CircuitBreaker) provision(ctx caddy.Context, events *caddyevents.App, zone *RateLimit, logger *zap.Logger) error {
+	if cb.Factor < 0 || cb.Factor > 1 {
+		return fmt.Errorf("factor must be between 0 and 1")
+	}
+	if cb.SlowStart < 0 {
+		return fmt.Errorf("slow_start must be at least zero")
+	}
+	cb.zone = zone
+	cb.ctx = ctx
+	cb.logger = logger
+	cb.unhealthy = make(map[string]struct{})
+
+	handler := eventHandlerFunc(cb.handleHealthEvent)
+	if err := events.On("healthy", handler); err != nil {
+		return err
+	}
+	return events.On("unhealthy", handler)
+}
+
+// eventHandlerFunc is a function that handles events of the events app.
+type eventHandlerFunc func(ctx context.Context, e caddy.Event) error
+
+func (f eventHandlerFunc) Handle(ctx context.Context, e caddy.Event) error { return f(ctx, e) }
+
+// handleHealthEvent opens the breaker when the first followed upstream
+// becomes unhealthy, and closes it when the last one becomes healthy.
+func (cb *CircuitBreaker) handleHealthEvent(_ context.Context, e caddy.Event) error {
+	host, _ := e.Data["host"].(string)
+	if len(cb.Upstreams) > 0 && !slices.Contains(cb.Upstreams, host) {
+		return nil
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	wasOpen := len(cb.unhealthy) > 0
+	if e.Name() == "unhealthy" {
+		cb.unhealthy[host] = struct{}{}
+	} else {
+		delete(cb.unhealthy, host)
+	}
+
+	switch open := len(cb.unhealthy) > 0; {
+	case open && !wasOpen:
+		cb.logger.Warn("upstream is unhealthy; reducing rate limit",
+			zap.String("zone", cb.zone.ZoneName),
+			zap.String("upstream", host),
+			zap.Float64("factor", cb.Factor),
+		)
+		cb.ramps++
+		cb.setFactor(cb.Factor, true)
+
+	case !open && wasOpen:
+		cb.logger.Info("upstreams are healthy again; restoring rate limit",
+			zap.String("zone", cb.zone.ZoneName),
+			zap.Duration("slow_start", time.Duration(cb.SlowStart)),
+		)
+		cb.ramps++
+		if cb.SlowStart > 0 {
+			go cb.rampUp(cb.ramps)
+		} else {
+			cb.setFactor(0, false)
+		}
+	}
+	return nil
+}
+
+// breakerRampSteps is the number of steps in which limits ramp up.
+const breakerRampSteps = 20
+
+// rampUp raises the zone's limits from the factor to their full value
+// over the slow start, unless another ramp starts or the breaker opens
+// again.
+func (cb *CircuitBreaker) rampUp(ramp int) {
+	labelTask(cb.ctx, "circuit_breaker")
+	ticker := time.NewTicker(time.Duration(cb.SlowStart) / breakerRampSteps)
+	defer ticker.Stop()
+
+	for step := 1; step <= breakerRampSteps; step++ {
+		select {
+		case <-ticker.C:
+		case <-cb.ctx.Done():
+			return
+		}
+		cb.mu.Lock()
+		if cb.ramps != ramp {
+			cb.mu.Unlock()
+			return
+		}
+		if step == breakerRampSteps {
+			cb.setFactor(0, false)
+		} else {
+			cb.setFactor(cb.Factor+(1-cb.Factor)*float64(step)/breakerRampSteps, true)
+		}
+		cb.mu.Unlock()
+	}
+}
+
+// setFactor scales the event limits of the zone (or each zone it has
+// resolved to) by factor if active, and otherwise restores them.
+func (cb *CircuitBreaker) setFactor(factor float64, active bool) {
+	cb.zone.forEachZone(func(zone *RateLimit) {
+		zone.limitersMap.setBreakerFactor(factor, active)
+	})
+}
+
+// setBreakerFactor sets the factor by which a circuit breaker scales the
+// zone's event limits, if active.
+func (rlm *rateLimitersMap) setBreakerFactor(factor float64, active bool) {
+	rlm.limitersMu.Lock()
+	rlm.breakerFactor, rlm.breakerActive = factor, active
+	maxEvents, window := rlm.configuredLimits()
+	rlm.limitersMu.Unlock()
+
+	rlm.updateAll(maxEvents, window)
+}
@@ -0,0 +1,71 @@
+package caddyrl
+
+import (
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: t.Context()})
+	defer cancel()
+
+	zone := &RateLimit{ZoneName: "breaker_zone", limitersMap: newRateLimiterMap()}
+	zone.limitersMap.updateAll(100, time.Minute)
+	cb := &CircuitBreaker{
+		Upstreams: []string{"10.0.0.1:80", "10.0.0.2:80"},
+		Factor:    0.1,
+		SlowStart: caddy.Duration(time.Second),
+		zone:      zone,
+		ctx:       ctx,
+		logger:    zap.NewNop(),
+		unhealthy: make(map[string]struct{}),
+	}
+
+	emit := func(name, host string) {
+		t.Helper()
+		e, err := caddy.NewEvent(ctx, name, map[string]any{"host": host})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cb.handleHealthEvent(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	maxEvents := func() int {
+		maxEvents, _ := zone.limitersMap.limits()
+		return maxEvents
+	}
+
+	// upstreams that the zone doesn't follow are ignored
+	emit("unhealthy", "10.0.0.3:80")
+	if n := maxEvents(); n != 100 {
+		t.Fatalf("expected max events 100, got %d", n)
+	}
+
+	emit("unhealthy", "10.0.0.1:80")
+	emit("unhealthy", "10.0.0.2:80")
+	if n := maxEvents(); n != 10 {
+		t.Fatalf("expected max events 10 while upstreams are unhealthy, got %d", n)
+	}
+	emit("healthy", "10.0.0.1:80")
+	if n := maxEvents(); n != 10 {
+		t.Fatalf("expected max events 10 while an upstream is unhealthy, got %d", n)
+	}
+
+	// once all upstreams are healthy, the limit ramps up over the slow start
+	emit("healthy", "10.0.0.2:80")
+	time.Sleep(150 * time.Millisecond)
+	if n := maxEvents(); n <= 10 || n >= 100 {
+		t.Fatalf("expected max events to be ramping up, got %d", n)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for maxEvents() != 100 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := maxEvents(); n != 100 {
+		t.Fatalf("expected max events 100 after the slow start, got %d", n)
+	}
+}
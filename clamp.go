@@ -0,0 +1,187 @@
+package caddyrl
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// zoneClamp scales the event limits of a zone until it expires, e.g. to
+// shed load during an incident.
+type zoneClamp struct {
+	factor float64
+	until  time.Time
+	timer  *time.Timer
+}
+
+// clamped returns the limit n scaled by the zone's clamp, load shedding
+// and circuit breaker, if any. A factor greater than zero leaves at least one
+// event, so that only a factor of zero freezes the zone.
+// rlm.limitersMu must be held.
+func (rlm *rateLimitersMap) clamped(n int) int {
+	factor := 1.0
+	if rlm.clamp != nil {
+		factor = rlm.clamp.factor
+	}
+	if rlm.shedFactor > 0 {
+		factor *= rlm.shedFactor
+	}
+	if rlm.breakerActive {
+		factor *= rlm.breakerFactor
+	}
+	if rlm.warmUp != nil {
+		factor *= rlm.warmUp.factor
+	}
+	if factor == 1 || n == 0 {
+		return n
+	}
+	if factor == 0 {
+		return 0
+	}
+	return max(int(float64(n)*factor), 1)
+}
+
+// setClamp scales the zone's event limits, including its total, by
+// factor until ttl has passed, replacing any previous clamp. A factor of
+// zero declines all requests.
+func (rlm *rateLimitersMap) setClamp(factor float64, ttl time.Duration) {
+	rlm.limitersMu.Lock()
+	if rlm.clamp != nil {
+		rlm.clamp.timer.Stop()
+	}
+	clamp := &zoneClamp{factor: factor, until: now().Add(ttl)}
+	clamp.timer = time.AfterFunc(ttl, func() { rlm.liftClamp(clamp) })
+	rlm.clamp = clamp
+	maxEvents, window := rlm.configuredLimits()
+	rlm.limitersMu.Unlock()
+
+	rlm.updateAll(maxEvents, window)
+}
+
+// liftClamp restores the zone's configured limits if clamp is still the
+// zone's clamp, or if clamp is nil, whichever clamp the zone has. It
+// returns false if there was nothing to lift.
+func (rlm *rateLimitersMap) liftClamp(clamp *zoneClamp) bool {
+	rlm.limitersMu.Lock()
+	if rlm.clamp == nil || clamp != nil && rlm.clamp != clamp {
+		rlm.limitersMu.Unlock()
+		return false
+	}
+	rlm.clamp.timer.Stop()
+	rlm.clamp = nil
+	maxEvents, window := rlm.configuredLimits()
+	rlm.limitersMu.Unlock()
+
+	rlm.updateAll(maxEvents, window)
+	return true
+}
+
+// clampStatus returns the status of the zone's clamp, or nil if it
+// has none.
+func (rlm *rateLimitersMap) clampStatus() *clampStatus {
+	rlm.limitersMu.Lock()
+	defer rlm.limitersMu.Unlock()
+	if rlm.clamp == nil {
+		return nil
+	}
+	return &clampStatus{
+		Factor:  rlm.clamp.factor,
+		Expires: rlm.clamp.until,
+	}
+}
+
+// handleClamp clamps or unclamps the given zones; see clampRequest.
+// Clamps are local to this instance; they outlast config reloads, but
+// not their TTL.
+func handleClamp(w http.ResponseWriter, r *http.Request, zones map[string]*rateLimitersMap) error {
+	switch r.Method {
+	case http.MethodPut:
+		var req clampRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("decoding request body: %v", err),
+			}
+		}
+		if req.Freeze {
+			if req.Factor != nil && *req.Factor != 0 {
+				return caddy.APIError{
+					HTTPStatus: http.StatusBadRequest,
+					Err:        fmt.Errorf("a frozen zone cannot have a factor"),
+				}
+			}
+			req.Factor = new(float64)
+		}
+		if req.Factor == nil || *req.Factor < 0 || *req.Factor > 1 {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("factor between 0 and 1, or freeze, is required"),
+			}
+		}
+		if req.TTL <= 0 {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("ttl must be greater than zero"),
+			}
+		}
+
+		results := make(map[string]*clampStatus, len(zones))
+		for zoneName, rlm := range zones {
+			rlm.setClamp(*req.Factor, time.Duration(req.TTL))
+			results[zoneName] = rlm.clampStatus()
+		}
+		return writeAdminJSON(w, results)
+
+	case http.MethodDelete:
+		var lifted bool
+		for _, rlm := range zones {
+			lifted = rlm.liftClamp(nil) || lifted
+		}
+		if !lifted {
+			return caddy.APIError{
+				HTTPStatus: http.StatusNotFound,
+				Err:        fmt.Errorf("not clamped"),
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+		return nil
+
+	default:
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+}
+
+// handleClampAll clamps or unclamps all zones.
+func handleClampAll(w http.ResponseWriter, r *http.Request) error {
+	zones := make(map[string]*rateLimitersMap)
+	rateLimits.Range(func(key, value any) bool {
+		zones[key.(string)] = value.(*rateLimitersMap)
+		return true
+	})
+	return handleClamp(w, r, zones)
+}
+
+// clampRequest is the request body for clamping zones.
+type clampRequest struct {
+	// Factor by which the zones' event limits are multiplied, between
+	// 0 and 1, e.g. 0.2 to allow a fifth of the usual events.
+	Factor *float64 `json:"factor,omitempty"`
+
+	// If true, all requests of the zones are declined, like a factor of 0.
+	Freeze bool `json:"freeze,omitempty"`
+
+	// How long until the zones' limits revert. Required.
+	TTL caddy.Duration `json:"ttl"`
+}
+
+// clampStatus describes a zone's clamp in admin API responses.
+type clampStatus struct {
+	Factor  float64   `json:"factor"`
+	Expires time.Time `json:"expires"`
+}
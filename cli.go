@@ -0,0 +1,206 @@
+package caddyrl
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "rate-limit",
+		Short: "Inspects and simulates rate limits",
+		Long: `
+Commands for rate limits. The inspect command requires that the admin API
+of the running instance is enabled and accessible; simulate, replay and
+dashboards run offline.
+`,
+		CobraFunc: func(cmd *cobra.Command) {
+			inspect := &cobra.Command{
+				Use:   "inspect [--zone <name>] [--top <n>] [--config <path> [--adapter <name>]] [--address <interface>]",
+				Short: "Prints zones, their busiest keys and remaining budgets",
+				Long: `
+Prints a table of the rate limit zones of the running instance, with their
+limits, number of keys, and the keys that made the most events in the
+current window along with the events that remain for them.
+
+The address of the admin API can be customized using the --address flag, or
+from the given --config, if not the default.
+`,
+				Example: "caddy rate-limit inspect --zone login --top 20",
+				RunE:    caddycmd.WrapCommandFuncForCobra(cmdInspect),
+			}
+			inspect.Flags().StringP("config", "c", "", "Configuration file to use to parse the admin address, if --address is not used")
+			inspect.Flags().StringP("adapter", "a", "", "Name of config adapter to apply (when --config is used)")
+			inspect.Flags().StringP("address", "", "", "The address to use to reach the admin API endpoint, if not the default")
+			inspect.Flags().StringP("zone", "z", "", "Only print this zone")
+			inspect.Flags().IntP("top", "t", 10, "Number of keys to print per zone")
+			cmd.AddCommand(inspect)
+
+			simulate := &cobra.Command{
+				Use:   "simulate [--config <path> [--adapter <name>] --zone <name>] [--max-events <n>] [--window <duration>] (--replay <file> | --rate <n> [--keys <n>] [--duration <duration>])",
+				Short: "Reports how many requests a zone would decline",
+				Long: `
+Replays a pattern of requests against the limits of a zone, offline, and
+reports how many of them would have been declined, to validate limits
+before deploying them.
+
+The zone's limits are taken from the zone of the given --config, and/or
+from --max-events, --window and --total-max-events, which take precedence.
+
+The requests are either replayed from a file (- for stdin) with --replay,
+or synthetic with --rate: each of --keys keys makes --rate requests per
+second, evenly spaced, for --duration. Replayed files have one request per
+line: a Caddy JSON access log entry, whose key is the field given by
+--key-field, or a timestamp (RFC 3339 or Unix seconds) and a key separated
+by whitespace.
+`,
+				Example: "caddy rate-limit simulate --config Caddyfile --zone login --replay access.log",
+				RunE:    caddycmd.WrapCommandFuncForCobra(cmdSimulate),
+			}
+			simulate.Flags().StringP("config", "c", "", "Configuration file with the zone")
+			simulate.Flags().StringP("adapter", "a", "", "Name of config adapter to apply (when --config is used)")
+			simulate.Flags().StringP("zone", "z", "", "Name of the zone in the config")
+			simulate.Flags().Int("max-events", 0, "Number of events allowed per key within the window")
+			simulate.Flags().String("window", "", "Duration of the sliding window")
+			simulate.Flags().Int("total-max-events", 0, "Number of events allowed of all keys together within the window")
+			simulate.Flags().StringP("replay", "r", "", "File of requests to replay, or - for stdin")
+			simulate.Flags().String("key-field", "request.client_ip", "Field of JSON log entries that is the key")
+			simulate.Flags().Float64("rate", 0, "Requests per second of each key of a synthetic pattern")
+			simulate.Flags().Int("keys", 1, "Number of keys of a synthetic pattern")
+			simulate.Flags().String("duration", "1h", "Duration of a synthetic pattern")
+			simulate.Flags().IntP("top", "t", 10, "Number of declined keys to print")
+			cmd.AddCommand(simulate)
+
+			replay := &cobra.Command{
+				Use:   "replay --config <path> [--adapter <name>] --log <file> [--zone <name>] [--top <n>] [--percentile <p>] [--headroom <factor>]",
+				Short: "Replays access logs through the zones of a config",
+				Long: `
+Replays a Caddy JSON access log (- for stdin) through all rate limit zones
+of the given --config, offline, and reports for each zone how many of its
+requests would have been declined, the keys that would have been declined
+the most, and a max_events suggested by the events that keys made per
+window, to validate limits before anything goes live.
+
+Requests are rebuilt from the access log entries, so that the zones'
+matchers and keys apply to them like they would to live requests. Each
+zone is replayed on its own, with its max_events, window and
+total_max_events.
+`,
+				Example: "caddy rate-limit replay --config zone.json --log access.log",
+				RunE:    caddycmd.WrapCommandFuncForCobra(cmdReplay),
+			}
+			replay.Flags().StringP("config", "c", "", "Configuration file with the zones")
+			replay.Flags().StringP("adapter", "a", "", "Name of config adapter to apply")
+			replay.Flags().StringP("log", "l", "", "Access log to replay, or - for stdin")
+			replay.Flags().StringP("zone", "z", "", "Only replay this zone")
+			replay.Flags().IntP("top", "t", 10, "Number of declined keys to print per zone")
+			replay.Flags().Float64("percentile", 99, "Percentile of events per window that suggestions are based on")
+			replay.Flags().Float64("headroom", 1.5, "Factor by which suggestions exceed the percentile")
+			cmd.AddCommand(replay)
+
+			dashboards := &cobra.Command{
+				Use:   "dashboards --config <path> [--adapter <name>] [--output <dir>] [--decline-ratio <ratio>]",
+				Short: "Generates a Grafana dashboard and Prometheus alerts for the zones of a config",
+				Long: `
+Generates a Grafana dashboard and Prometheus alerting rules for the rate
+limit zones of the given --config, so that observability follows the
+config. They are written to rate-limit-dashboard.json and
+rate-limit-alerts.yml in the --output directory.
+
+The dashboard has a row per zone, titled with its limits, with its
+requests and declines, decline ratio, keys and utilization of limits; its
+Prometheus data source is chosen when it is imported. Each zone alerts
+when it declines more than --decline-ratio of its requests for 10
+minutes, and zones with max_keys alert when they keep evicting keys.
+`,
+				Example: "caddy rate-limit dashboards --config Caddyfile --output observability",
+				RunE:    caddycmd.WrapCommandFuncForCobra(cmdDashboards),
+			}
+			dashboards.Flags().StringP("config", "c", "", "Configuration file with the zones")
+			dashboards.Flags().StringP("adapter", "a", "", "Name of config adapter to apply")
+			dashboards.Flags().StringP("output", "o", ".", "Directory to write the dashboard and the rules to")
+			dashboards.Flags().Float64("decline-ratio", 0.05, "Ratio of declined requests that zones alert at")
+			cmd.AddCommand(dashboards)
+		},
+	})
+}
+
+func cmdInspect(fl caddycmd.Flags) (int, error) {
+	addressFlag := fl.String("address")
+	configFlag := fl.String("config")
+	configAdapterFlag := fl.String("adapter")
+	zoneFlag := fl.String("zone")
+	topFlag := fl.Int("top")
+
+	adminAddr, err := caddycmd.DetermineAdminAPIAddress(addressFlag, nil, configFlag, configAdapterFlag)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("couldn't determine admin API address: %v", err)
+	}
+
+	resp, err := caddycmd.AdminAPIRequest(adminAddr, http.MethodGet, adminZonesPrefix+"?top="+strconv.Itoa(topFlag), nil, nil)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer resp.Body.Close()
+
+	var zones []zoneSummary
+	if err := json.NewDecoder(resp.Body).Decode(&zones); err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("decoding response: %v", err)
+	}
+	if zoneFlag != "" {
+		var found []zoneSummary
+		for _, zone := range zones {
+			if zone.Zone == zoneFlag {
+				found = append(found, zone)
+			}
+		}
+		if len(found) == 0 {
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("zone %s not found", zoneFlag)
+		}
+		zones = found
+	}
+
+	if err := writeInspectTable(os.Stdout, zones); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	return caddy.ExitCodeSuccess, nil
+}
+
+// writeInspectTable prints zones and their busiest keys as tables.
+func writeInspectTable(w io.Writer, zones []zoneSummary) error {
+	if len(zones) == 0 {
+		_, err := fmt.Fprintln(w, "No zones")
+		return err
+	}
+	for i, zone := range zones {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		limit := fmt.Sprintf("%d per %s", zone.MaxEvents, zone.Window)
+		if zone.Clamp != nil {
+			limit += fmt.Sprintf(", clamped ×%g until %s", zone.Clamp.Factor, zone.Clamp.Expires.Local().Format("15:04:05"))
+		}
+		fmt.Fprintf(w, "%s: %s, %d keys\n", zone.Zone, limit, zone.Keys)
+		if len(zone.TopKeys) == 0 {
+			continue
+		}
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "  KEY\tEVENTS\tREMAINING")
+		for _, key := range zone.TopKeys {
+			fmt.Fprintf(tw, "  %s\t%d\t%d\n", key.Key, key.Events, key.Remaining)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
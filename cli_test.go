@@ -0,0 +1,60 @@
+package caddyrl
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInspect(t *testing.T) {
+	initTime()
+
+	rlm := newTestZone(t, "inspect_zone", 5, time.Minute)
+	for key, events := range map[string]int{"busy": 4, "quiet": 1, "idle": 0} {
+		limiter := rlm.getOrInsert(key)
+		for range events {
+			rlm.when(limiter)
+		}
+	}
+
+	rec, errStatus := serveAdmin(t, http.MethodGet, "/rate_limit/zones/?top=1")
+	if errStatus != 0 {
+		t.Fatalf("unexpected error status %d", errStatus)
+	}
+	var zones []zoneSummary
+	if err := json.NewDecoder(rec.Body).Decode(&zones); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	var zone *zoneSummary
+	for i := range zones {
+		if zones[i].Zone == "inspect_zone" {
+			zone = &zones[i]
+		}
+	}
+	if zone == nil {
+		t.Fatalf("expected the zone to be listed, got %+v", zones)
+	}
+	if zone.MaxEvents != 5 || zone.Window != "1m0s" || zone.Keys != 3 {
+		t.Errorf("unexpected zone summary: %+v", zone)
+	}
+	if len(zone.TopKeys) != 1 || zone.TopKeys[0] != (keySummary{Key: "busy", Events: 4, Remaining: 1}) {
+		t.Errorf("expected only the busiest key, got %+v", zone.TopKeys)
+	}
+
+	if _, errStatus := serveAdmin(t, http.MethodGet, "/rate_limit/zones/?top=x"); errStatus != http.StatusBadRequest {
+		t.Errorf("expected error status %d for invalid top, got %d", http.StatusBadRequest, errStatus)
+	}
+
+	var out strings.Builder
+	if err := writeInspectTable(&out, []zoneSummary{*zone}); err != nil {
+		t.Fatal(err)
+	}
+	want := "inspect_zone: 5 per 1m0s, 3 keys\n" +
+		"  KEY   EVENTS  REMAINING\n" +
+		"  busy  4       1\n"
+	if out.String() != want {
+		t.Errorf("unexpected table:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
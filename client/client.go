@@ -0,0 +1,193 @@
+// Package client asks a Caddy instance with the rate_limit module for
+// rate limit decisions through its admin API, so that Go services
+// outside of Caddy can share the quotas of its zones without
+// implementing the protocol. It has no dependencies beyond the standard
+// library.
+//
+//	c := client.New("http://localhost:2019")
+//	d, err := c.Allow(ctx, "login", username, 1)
+//	if err != nil {
+//		return err
+//	}
+//	if !d.Allowed {
+//		// retry after d.RetryAfter
+//	}
+//
+// Decisions are made by the instance that is asked, with its own state
+// only, even with distributed rate limiting.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Client makes requests to the admin API of a Caddy instance.
+type Client struct {
+	// The address of the admin API, e.g. http://localhost:2019.
+	BaseURL string
+
+	// The client that requests are made with, e.g. one that dials the
+	// admin API's Unix socket. Default: http.DefaultClient
+	HTTPClient *http.Client
+
+	// The Origin header of requests, if the admin API enforces origins.
+	Origin string
+}
+
+// New returns a client of the admin API at baseURL.
+func New(baseURL string) *Client {
+	return &Client{BaseURL: strings.TrimSuffix(baseURL, "/")}
+}
+
+// Decision is the outcome of a check or of counting events.
+type Decision struct {
+	// Whether the events are, or would be, allowed.
+	Allowed bool
+
+	// The number of events of the key that remain in the window.
+	Remaining int
+
+	// How long to wait before the events would be allowed, if they
+	// aren't.
+	RetryAfter time.Duration
+
+	// The zone's current limit of events per key, and its window; the
+	// window is zero for checks.
+	Limit  int
+	Window time.Duration
+}
+
+// Error is an error response of the admin API, e.g. for an unknown
+// zone.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("rate limit admin API: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// Allow reports whether cost events of key are allowed in the zone right
+// now, and if so, counts them, sharing the zone's quota with the
+// requests that Caddy limits. Costs greater than the zone's limit are
+// never allowed.
+func (c *Client) Allow(ctx context.Context, zone, key string, cost int) (Decision, error) {
+	body, err := json.Marshal(map[string]int{"cost": cost})
+	if err != nil {
+		return Decision{}, err
+	}
+	var result struct {
+		Allowed    bool    `json:"allowed"`
+		Limit      int     `json:"limit"`
+		Window     string  `json:"window"`
+		Remaining  int     `json:"remaining"`
+		RetryAfter float64 `json:"retry_after"`
+	}
+	if err := c.do(ctx, http.MethodPost, zonePath(zone, "keys", key, "allow"), body, &result); err != nil {
+		return Decision{}, err
+	}
+	window, err := time.ParseDuration(result.Window)
+	if err != nil {
+		return Decision{}, fmt.Errorf("decoding window: %v", err)
+	}
+	return Decision{
+		Allowed:    result.Allowed,
+		Remaining:  result.Remaining,
+		RetryAfter: seconds(result.RetryAfter),
+		Limit:      result.Limit,
+		Window:     window,
+	}, nil
+}
+
+// Check reports whether an event of key would be allowed in the zone
+// right now, without counting it.
+func (c *Client) Check(ctx context.Context, zone, key string) (Decision, error) {
+	var result struct {
+		Allowed    bool    `json:"allowed"`
+		Limit      int     `json:"limit"`
+		Remaining  int     `json:"remaining"`
+		RetryAfter float64 `json:"retry_after"`
+	}
+	target := zonePath(zone, "check") + "?" + url.Values{"key": {key}}.Encode()
+	if err := c.do(ctx, http.MethodGet, target, nil, &result); err != nil {
+		return Decision{}, err
+	}
+	return Decision{
+		Allowed:    result.Allowed,
+		Remaining:  result.Remaining,
+		RetryAfter: seconds(result.RetryAfter),
+		Limit:      result.Limit,
+	}, nil
+}
+
+// do makes a request to the admin API and decodes its JSON response into
+// result.
+func (c *Client) do(ctx context.Context, method, target string, body []byte, result any) error {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+target, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Origin != "" {
+		req.Header.Set("Origin", c.Origin)
+	}
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		// Caddy's admin API describes errors in a JSON object
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		if json.Unmarshal(respBody, &apiErr) != nil || apiErr.Error == "" {
+			apiErr.Error = strings.TrimSpace(string(respBody))
+		}
+		return &Error{StatusCode: resp.StatusCode, Message: apiErr.Error}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("decoding response: %v", err)
+	}
+	return nil
+}
+
+// zonePath returns the path of the zone's admin endpoint with the given
+// segments, each escaped, since zone names and keys may contain slashes.
+func zonePath(zone string, segments ...string) string {
+	var sb strings.Builder
+	sb.WriteString("/rate_limit/zones/")
+	sb.WriteString(url.PathEscape(zone))
+	for _, segment := range segments {
+		sb.WriteByte('/')
+		sb.WriteString(url.PathEscape(segment))
+	}
+	return sb.String()
+}
+
+// seconds returns a duration of the given number of seconds.
+func seconds(s float64) time.Duration {
+	return time.Duration(math.Round(s * float64(time.Second)))
+}
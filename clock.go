@@ -0,0 +1,32 @@
+package caddyrl
+
+import "time"
+
+// now returns the current time. All state that depends on the time,
+// such as windows, bans, clamps, schedules and quotas, reads it from
+// now rather than from time.Now, so that tests can substitute a clock
+// that only moves when they advance it (see useTestClock). Durations
+// that are only measured, such as processing times, use time.Now.
+var now = time.Now
+
+// clockBase is the time the process started, with its monotonic clock
+// reading; see unixNano.
+var clockBase = time.Now()
+
+// unixNano returns t in nanoseconds since the Unix epoch, as limiters
+// store the times of events. Times read from time.Now are measured on
+// the monotonic clock from clockBase, so that steps of the wall clock,
+// e.g. by NTP, don't shift events in or out of their windows, which
+// would be noticeable with windows of a fraction of a second; other
+// times, such as those of a test clock, fall back to their wall clock.
+func unixNano(t time.Time) int64 {
+	return clockBase.UnixNano() + int64(t.Sub(clockBase))
+}
+
+// fromUnixNano returns the time of ns nanoseconds since the Unix epoch,
+// as returned by unixNano, with a monotonic clock reading, so that
+// durations between it and times read from time.Now are measured on the
+// monotonic clock too.
+func fromUnixNano(ns int64) time.Time {
+	return clockBase.Add(time.Duration(ns - clockBase.UnixNano()))
+}
@@ -0,0 +1,87 @@
+package caddyrl
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// testClock is a clock that only moves when a test sets or advances it.
+type testClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+// useTestClock makes now read from a new test clock, set to start, until
+// the test ends. Unlike initTime and advanceTime, it is safe to advance
+// while handlers read the time concurrently.
+func useTestClock(t testing.TB, start time.Time) *testClock {
+	t.Helper()
+	c := &testClock{t: start}
+	previous := now
+	now = c.now
+	t.Cleanup(func() { now = previous })
+	return c
+}
+
+func (c *testClock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+// set moves the clock to at.
+func (c *testClock) set(at time.Time) {
+	c.mu.Lock()
+	c.t = at
+	c.mu.Unlock()
+}
+
+// advance moves the clock forward by d.
+func (c *testClock) advance(d time.Duration) {
+	c.mu.Lock()
+	c.t = c.t.Add(d)
+	c.mu.Unlock()
+}
+
+func TestTestClock(t *testing.T) {
+	start := time.Unix(referenceTime, 0)
+	clock := useTestClock(t, start)
+	if !now().Equal(start) {
+		t.Fatalf("expected %v, got %v", start, now())
+	}
+	clock.advance(1500 * time.Millisecond)
+	if want := start.Add(1500 * time.Millisecond); !now().Equal(want) {
+		t.Fatalf("expected %v after advancing, got %v", want, now())
+	}
+	clock.set(start)
+	if !now().Equal(start) {
+		t.Fatalf("expected %v after setting, got %v", start, now())
+	}
+}
+
+func TestUnixNano(t *testing.T) {
+	// times of the test clock have no monotonic reading, so they are
+	// their wall clock time
+	start := time.Unix(referenceTime, 250)
+	if ns := unixNano(start); ns != start.UnixNano() {
+		t.Errorf("expected %d, got %d", start.UnixNano(), ns)
+	}
+	if back := fromUnixNano(unixNano(start)); !back.Equal(start) || back.Sub(start) != 0 {
+		t.Errorf("expected %v, got %v", start, back)
+	}
+
+	// times of the real clock are measured on the monotonic clock, and
+	// come back with a monotonic reading
+	ref := time.Now()
+	later := ref.Add(100 * time.Millisecond)
+	if d := unixNano(later) - unixNano(ref); d != int64(100*time.Millisecond) {
+		t.Errorf("expected 100ms between the times, got %v", time.Duration(d))
+	}
+	if d := fromUnixNano(unixNano(later)).Sub(ref); d != 100*time.Millisecond {
+		t.Errorf("expected 100ms between the times, got %v", d)
+	}
+	if back := fromUnixNano(unixNano(ref)); back.String() == back.Round(0).String() {
+		t.Errorf("expected a monotonic clock reading, got %v", back)
+	}
+}
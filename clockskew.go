@@ -0,0 +1,140 @@
+package caddyrl
+
+import (
+	"context"
+	"path"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+)
+
+// Ways in which the clocks of other instances are corrected; see
+// DistributedRateLimiting.ClockCorrection
+const (
+	clockCorrectionNone    = "none"
+	clockCorrectionStorage = "storage"
+)
+
+// storageClockOffset estimates how far the clock of the instance that
+// wrote a value is ahead of storage's, from the timestamp of the value
+// and when storage modified it. Values are modified a little after their
+// timestamp, so every estimate is low by about the latency of a write;
+// since all instances' estimates are low alike, that cancels out when
+// they are compared. It returns false if storage doesn't record when
+// values are modified.
+func storageClockOffset(timestamp, modified time.Time) (time.Duration, bool) {
+	if modified.IsZero() || timestamp.IsZero() {
+		return 0, false
+	}
+	return timestamp.Sub(modified), true
+}
+
+// storageModified returns when storage last modified the value at key,
+// or the zero time if it doesn't know.
+func storageModified(ctx context.Context, storage certmagic.Storage, key string) time.Time {
+	info, err := storage.Stat(ctx, key)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.Modified
+}
+
+// measureClock estimates how far this instance's clock is ahead of
+// storage's from the state that it just wrote at the given time.
+func (d *DistributedRateLimiting) measureClock(ctx context.Context, storage certmagic.Storage, timestamp time.Time) {
+	key := path.Join(storagePrefix, d.instanceID+".rlstate")
+	if offset, ok := storageClockOffset(timestamp, storageModified(ctx, storage, key)); ok {
+		d.clockOffset.Store(&offset)
+	}
+}
+
+// modifiedBeforeLoad returns when storage last modified the value at
+// key, to be passed to clockDelta once the value is loaded, or the zero
+// time if clocks aren't corrected.
+func (d *DistributedRateLimiting) modifiedBeforeLoad(ctx context.Context, storage certmagic.Storage, key string) time.Time {
+	if d.ClockCorrection != clockCorrectionStorage {
+		return time.Time{}
+	}
+	return storageModified(ctx, storage, key)
+}
+
+// clockDelta returns what to add to the timestamps of the value at key,
+// which were recorded at timestamp by another instance's clock, to
+// correct them to this instance's clock, or 0 if clocks aren't
+// corrected or are apart by no more than max_clock_skew. The value must
+// have been loaded after storage last modified it at before (see
+// modifiedBeforeLoad); if it was modified again since, the loaded value
+// may be the older one, whose timestamp would be compared with when the
+// newer one was modified, so its clock isn't corrected.
+func (d *DistributedRateLimiting) clockDelta(ctx context.Context, storage certmagic.Storage, key string, timestamp, before time.Time) time.Duration {
+	if d.ClockCorrection != clockCorrectionStorage {
+		return 0
+	}
+	modified := storageModified(ctx, storage, key)
+	if !modified.Equal(before) {
+		return 0
+	}
+	offset, ok := storageClockOffset(timestamp, modified)
+	if !ok {
+		return 0
+	}
+	var ownOffset time.Duration
+	if own := d.clockOffset.Load(); own != nil {
+		ownOffset = *own
+	}
+	delta := ownOffset - offset
+	if delta.Abs() <= time.Duration(d.MaxClockSkew) {
+		return 0
+	}
+	return delta
+}
+
+// correctClock corrects the timestamps of state, which was read from
+// key after storage last modified it at before, to this instance's
+// clock, and limits how far ahead of it they are to max_clock_skew.
+func (h Handler) correctClock(ctx context.Context, key string, before time.Time, state *rlState) {
+	if delta := h.Distributed.clockDelta(ctx, h.storage, key, state.Timestamp, before); delta != 0 {
+		h.logger.Debug("correcting clock skew of instance",
+			zap.String("instance_id", state.InstanceID),
+			zap.Duration("skew", -delta))
+		shiftState(state, delta)
+	}
+	h.Distributed.clampState(state, now())
+}
+
+// shiftState adds delta to the timestamps of state.
+func shiftState(state *rlState, delta time.Duration) {
+	if delta == 0 {
+		return
+	}
+	state.Timestamp = state.Timestamp.Add(delta)
+	for _, zone := range state.Zones {
+		for key, value := range zone {
+			if !value.OldestEvent.IsZero() {
+				value.OldestEvent = value.OldestEvent.Add(delta)
+				zone[key] = value
+			}
+		}
+	}
+}
+
+// clampState limits the timestamps of state to max_clock_skew after
+// ref, if it is set.
+func (d *DistributedRateLimiting) clampState(state *rlState, ref time.Time) {
+	if d.MaxClockSkew <= 0 {
+		return
+	}
+	limit := ref.Add(time.Duration(d.MaxClockSkew))
+	if state.Timestamp.After(limit) {
+		state.Timestamp = limit
+	}
+	for _, zone := range state.Zones {
+		for key, value := range zone {
+			if value.OldestEvent.After(limit) {
+				value.OldestEvent = limit
+				zone[key] = value
+			}
+		}
+	}
+}
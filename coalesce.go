@@ -0,0 +1,191 @@
+package caddyrl
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// maxCoalescedBytes is the most of a response body that is kept for
+// the requests that coalesce onto it; requests that would need more of
+// it are declined after all.
+const maxCoalescedBytes = 1 << 20
+
+// coalescer tracks the GET requests in flight that zones with
+// RateLimit.Coalesce allowed, so that requests for the same key and
+// URL that the zones decline get a copy of their response instead.
+type coalescer struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+func newCoalescer() *coalescer {
+	return &coalescer{flights: make(map[string]*flight)}
+}
+
+// flight is a request in flight and, once done is closed, its response.
+type flight struct {
+	keys []string
+	done chan struct{}
+
+	status    int
+	header    http.Header
+	body      bytes.Buffer
+	truncated bool
+
+	// whether the next handlers served the request without an error,
+	// and whether the response is complete, so that it can be replayed
+	served, complete bool
+}
+
+// flightKey returns the key of the flight of requests of key in the
+// zone with the same host, URI and content encodings as r. Responses
+// may be compressed differently for different Accept-Encoding headers,
+// so those aren't coalesced.
+func flightKey(zoneName, key string, r *http.Request) string {
+	return zoneName + "\x00" + key + "\x00" + r.Host + r.URL.RequestURI() + "\x00" + r.Header.Get("Accept-Encoding")
+}
+
+// coalescible returns the key of the flight that r may coalesce onto if
+// rl declines it at its limit, or an empty string if it may not.
+// Requests with credentials neither lead nor follow flights, since
+// their responses are likely specific to the client.
+func coalescible(rl *RateLimit, key string, r *http.Request) string {
+	if !rl.Coalesce || r.Method != http.MethodGet {
+		return ""
+	}
+	if r.Header.Get("Authorization") != "" || r.Header.Get("Cookie") != "" {
+		return ""
+	}
+	return flightKey(rl.ZoneName, key, r)
+}
+
+// privateResponse returns true if the Cache-Control header of a
+// response forbids sharing it with other clients.
+func privateResponse(header http.Header) bool {
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, _, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if strings.EqualFold(name, "private") || strings.EqualFold(name, "no-store") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// lead starts a flight under each of keys that has none yet, and
+// returns it, or nil if each key has a flight already.
+func (c *coalescer) lead(keys []string) *flight {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f := &flight{done: make(chan struct{})}
+	for _, key := range keys {
+		if _, ok := c.flights[key]; !ok {
+			c.flights[key] = f
+			f.keys = append(f.keys, key)
+		}
+	}
+	if len(f.keys) == 0 {
+		return nil
+	}
+	return f
+}
+
+// land ends f and wakes the requests that coalesced onto it.
+func (c *coalescer) land(f *flight) {
+	f.complete = f.served && f.status != 0 && !f.truncated && !privateResponse(f.header)
+	c.mu.Lock()
+	for _, key := range f.keys {
+		if c.flights[key] == f {
+			delete(c.flights, key)
+		}
+	}
+	c.mu.Unlock()
+	close(f.done)
+}
+
+// follow waits for the flight under key, if there is one, and writes
+// a copy of its response to w. It returns false if there is no such
+// flight, r is canceled first, or the response can't be replayed, in
+// which case r stays declined.
+func (c *coalescer) follow(w http.ResponseWriter, r *http.Request, key string) bool {
+	c.mu.Lock()
+	f := c.flights[key]
+	c.mu.Unlock()
+	return f != nil && f.replay(w, r)
+}
+
+// replay waits for f to land and writes a copy of its response to w,
+// if it can be replayed and r isn't canceled first.
+func (f *flight) replay(w http.ResponseWriter, r *http.Request) bool {
+	select {
+	case <-f.done:
+	case <-r.Context().Done():
+		return false
+	}
+	if !f.complete {
+		return false
+	}
+
+	// the headers of the decline are replaced by the response's
+	header := w.Header()
+	header.Del("Retry-After")
+	header.Del("Cache-Control")
+	for name, values := range f.header {
+		// cookies are the leading request's own
+		if name == "Set-Cookie" {
+			continue
+		}
+		header[name] = append([]string(nil), values...)
+	}
+	w.WriteHeader(f.status)
+	_, _ = w.Write(f.body.Bytes())
+	return true
+}
+
+// flightWriter records the response to the leading request of a flight
+// while writing it.
+type flightWriter struct {
+	*caddyhttp.ResponseWriterWrapper
+	f *flight
+}
+
+func (w *flightWriter) WriteHeader(status int) {
+	// informational responses are followed by the final one
+	if w.f.status == 0 && status >= 200 {
+		w.f.status = status
+		w.f.header = w.Header().Clone()
+	}
+	w.ResponseWriterWrapper.WriteHeader(status)
+}
+
+func (w *flightWriter) Write(p []byte) (int, error) {
+	if w.f.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.f.truncated {
+		if w.f.body.Len()+len(p) > maxCoalescedBytes {
+			w.f.truncated = true
+			w.f.body = bytes.Buffer{}
+		} else {
+			w.f.body.Write(p)
+		}
+	}
+	return w.ResponseWriterWrapper.Write(p)
+}
+
+func (w *flightWriter) ReadFrom(r io.Reader) (int64, error) {
+	// copy through Write, which records the body
+	return io.Copy(struct{ io.Writer }{w}, r)
+}
+
+// Interface guards
+var (
+	_ http.ResponseWriter = (*flightWriter)(nil)
+	_ io.ReaderFrom       = (*flightWriter)(nil)
+)
@@ -0,0 +1,160 @@
+package caddyrl
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestCoalesce(t *testing.T) {
+	initTime()
+
+	rl := &RateLimit{
+		ZoneName:  "coalesce_zone",
+		Key:       "static",
+		Window:    caddy.Duration(time.Minute),
+		MaxEvents: 1,
+		Coalesce:  true,
+	}
+	h := newTestHandler(t, rl)
+	h.coalescer = newCoalescer()
+	release := make(chan struct{})
+	upstreamRequests := 0
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) error {
+		upstreamRequests++
+		<-release
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Set-Cookie", "session=leader")
+		_, _ = w.Write([]byte("hot"))
+		return nil
+	})
+	serve := func(target string) (*httptest.ResponseRecorder, error) {
+		req := newTestRequest(http.MethodGet, target, nil)
+		rec := httptest.NewRecorder()
+		return rec, h.ServeHTTP(rec, req, next)
+	}
+
+	type result struct {
+		rec *httptest.ResponseRecorder
+		err error
+	}
+	leader := make(chan result)
+	go func() {
+		rec, err := serve("/hot")
+		leader <- result{rec, err}
+	}()
+	for {
+		h.coalescer.mu.Lock()
+		started := len(h.coalescer.flights) > 0
+		h.coalescer.mu.Unlock()
+		if started {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// requests for other URLs have no flight to coalesce onto
+	if _, err := serve("/cold"); !isDeclined(err) {
+		t.Fatalf("expected a request for another URL to be declined, got %v", err)
+	}
+
+	follower := make(chan result)
+	go func() {
+		rec, err := serve("/hot")
+		follower <- result{rec, err}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	for _, res := range []result{<-leader, <-follower} {
+		if res.err != nil {
+			t.Fatalf("expected the response of the leading request, got %v", res.err)
+		}
+		if body := res.rec.Body.String(); body != "hot" || res.rec.Header().Get("Content-Type") != "text/plain" {
+			t.Errorf("unexpected response: %q %v", body, res.rec.Header())
+		}
+	}
+	if upstreamRequests != 1 {
+		t.Errorf("expected a single upstream request, got %d", upstreamRequests)
+	}
+
+	// once the flight has landed, requests are declined again
+	if _, err := serve("/hot"); !isDeclined(err) {
+		t.Fatalf("expected a request after the flight to be declined, got %v", err)
+	}
+}
+
+func TestCoalescerFollow(t *testing.T) {
+	c := newCoalescer()
+	respond := func(f *flight, body []byte) {
+		w := &flightWriter{
+			ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: httptest.NewRecorder()},
+			f:                     f,
+		}
+		w.Header().Set("Set-Cookie", "session=leader")
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write(body)
+		f.served = true
+		c.land(f)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	f := c.lead([]string{"a", "b"})
+	if f == nil || c.lead([]string{"a"}) != nil {
+		t.Fatal("expected a single flight per key")
+	}
+	respond(f, []byte("missing"))
+	if c.follow(httptest.NewRecorder(), req, "b") {
+		t.Fatal("expected no flight after landing")
+	}
+
+	// the response replaces the decline, without the leader's cookies
+	rec := httptest.NewRecorder()
+	rec.Header().Set("Retry-After", "60")
+	if !f.replay(rec, req) {
+		t.Fatal("expected the response to be replayed")
+	}
+	if rec.Code != http.StatusNotFound || rec.Body.String() != "missing" || rec.Header().Get("Set-Cookie") != "" || rec.Header().Get("Retry-After") != "" {
+		t.Errorf("unexpected response: %d %q %v", rec.Code, rec.Body.String(), rec.Header())
+	}
+
+	// responses that are too large, or whose handlers failed, aren't
+	f = c.lead([]string{"a"})
+	respond(f, make([]byte, maxCoalescedBytes+1))
+	if f.replay(httptest.NewRecorder(), req) {
+		t.Error("expected a truncated response not to be replayed")
+	}
+	f = c.lead([]string{"a"})
+	c.land(f)
+	if f.replay(httptest.NewRecorder(), req) {
+		t.Error("expected a failed response not to be replayed")
+	}
+
+	// nor are responses that are private to the client
+	for _, cacheControl := range []string{"private", "max-age=60, no-store", `Private="Set-Cookie"`} {
+		f = c.lead([]string{"a"})
+		f.header = http.Header{"Cache-Control": {cacheControl}}
+		f.status, f.served = http.StatusOK, true
+		c.land(f)
+		if f.replay(httptest.NewRecorder(), req) {
+			t.Errorf("expected a response with Cache-Control %s not to be replayed", cacheControl)
+		}
+	}
+
+	// requests with credentials don't coalesce
+	rl := &RateLimit{ZoneName: "coalesce_credentials", Coalesce: true}
+	if coalescible(rl, "a", req) == "" {
+		t.Fatal("expected a request without credentials to coalesce")
+	}
+	for _, header := range []string{"Authorization", "Cookie"} {
+		withCredentials := httptest.NewRequest(http.MethodGet, "/", nil)
+		withCredentials.Header.Set(header, "secret")
+		if coalescible(rl, "a", withCredentials) != "" {
+			t.Errorf("expected a request with header %s not to coalesce", header)
+		}
+	}
+}
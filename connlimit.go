@@ -0,0 +1,58 @@
+package caddyrl
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// connectionRequests counts the requests in progress per client
+// connection, identified by the client's address and port.
+type connectionRequests struct {
+	mu         sync.Mutex
+	inProgress map[string]int
+}
+
+func newConnectionRequests() *connectionRequests {
+	return &connectionRequests{inProgress: make(map[string]int)}
+}
+
+// start counts a request of conn as in progress, unless conn already
+// has max requests in progress, in which case it returns false.
+func (cr *connectionRequests) start(conn string, max int) bool {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if cr.inProgress[conn] >= max {
+		return false
+	}
+	cr.inProgress[conn]++
+	return true
+}
+
+// done counts a request of conn as no longer in progress.
+func (cr *connectionRequests) done(conn string) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if cr.inProgress[conn] <= 1 {
+		delete(cr.inProgress, conn)
+		return
+	}
+	cr.inProgress[conn]--
+}
+
+// tooManyConcurrent declines r because its connection has too many
+// requests in progress.
+func (h Handler) tooManyConcurrent(w http.ResponseWriter, r *http.Request) error {
+	h.logger.Info("too many concurrent requests on connection",
+		zap.String("remote_ip", remoteIPOf(r)),
+		zap.String("proto", r.Proto),
+		zap.Int("max_concurrent_per_connection", h.MaxConcurrentPerConnection),
+	)
+	if isGRPC(r) {
+		setGRPCExhausted(w.Header(), 0)
+		return grpcDeclined{}
+	}
+	return caddyhttp.Error(http.StatusTooManyRequests, nil)
+}
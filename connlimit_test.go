@@ -0,0 +1,30 @@
+package caddyrl
+
+import "testing"
+
+func TestConnectionRequests(t *testing.T) {
+	cr := newConnectionRequests()
+
+	if !cr.start("10.0.0.1:1234", 2) || !cr.start("10.0.0.1:1234", 2) {
+		t.Fatal("requests within the limit should start")
+	}
+	if cr.start("10.0.0.1:1234", 2) {
+		t.Fatal("request beyond the limit should not start")
+	}
+	if !cr.start("10.0.0.1:5678", 2) {
+		t.Fatal("other connections of the same client have their own limit")
+	}
+
+	cr.done("10.0.0.1:1234")
+	if !cr.start("10.0.0.1:1234", 2) {
+		t.Fatal("request should start once another one is done")
+	}
+
+	for range 3 {
+		cr.done("10.0.0.1:1234")
+	}
+	cr.done("10.0.0.1:5678")
+	if len(cr.inProgress) != 0 {
+		t.Fatalf("expected no connections to be tracked, got %v", cr.inProgress)
+	}
+}
@@ -0,0 +1,122 @@
+package caddyrl
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Consistency levels of a zone's decisions under distributed rate
+// limiting; see RateLimit.Consistency.
+const (
+	// decisions read other instances' states from storage first, and
+	// allowed events are stored before the request continues
+	consistencyStrict = "strict"
+
+	// decisions use the last known states of other instances, which are
+	// synced in the background
+	consistencyEventual = "eventual"
+
+	// decisions only count the events of this instance, whose state is
+	// still stored for other instances' decisions
+	consistencyLocal = "local"
+)
+
+func validConsistency(consistency string) error {
+	switch consistency {
+	case "", consistencyStrict, consistencyEventual, consistencyLocal:
+		return nil
+	}
+	return fmt.Errorf("unknown consistency '%s'; must be strict, eventual or local", consistency)
+}
+
+// What a zone decides while distributed state can't be synced with
+// storage; see RateLimit.StoreFailure.
+const (
+	// decisions use the last known states of other instances
+	storeFailureOpen = "open"
+
+	// requests are declined
+	storeFailureClosed = "closed"
+)
+
+func validStoreFailure(storeFailure string) error {
+	switch storeFailure {
+	case "", storeFailureOpen, storeFailureClosed:
+		return nil
+	}
+	return fmt.Errorf("unknown store_failure '%s'; must be open or closed", storeFailure)
+}
+
+// storeSync coalesces the syncs of concurrent strict decisions, so that
+// storage is read or written once for all of them rather than once for
+// each. A decision waits for a sync that starts after it asked for one,
+// so that the sync reflects everything before the decision.
+type storeSync struct {
+	mu      sync.Mutex
+	pending *storeFlight // the next sync, which callers can still join
+
+	running sync.Mutex // held while a sync runs
+}
+
+type storeFlight struct {
+	done chan struct{}
+	err  error
+}
+
+// do runs sync, or joins a sync that hasn't started yet, and returns
+// its error. The sync isn't cancelled with ctx, since other requests may
+// wait for it; only waiting stops when ctx is done.
+func (s *storeSync) do(ctx context.Context, sync func(context.Context) error) error {
+	s.mu.Lock()
+	flight := s.pending
+	if flight == nil {
+		flight = &storeFlight{done: make(chan struct{})}
+		s.pending = flight
+		go s.run(context.WithoutCancel(ctx), flight, sync)
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-flight.done:
+		return flight.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *storeSync) run(ctx context.Context, flight *storeFlight, sync func(context.Context) error) {
+	s.running.Lock()
+	defer s.running.Unlock()
+
+	// callers from now on need a later sync
+	s.mu.Lock()
+	s.pending = nil
+	s.mu.Unlock()
+
+	flight.err = sync(ctx)
+	close(flight.done)
+}
+
+// strictSync runs one of the handler's syncs for a strict decision and
+// records it like the background syncs, including in failed. If it
+// fails, the decision is degraded.
+func (h Handler) strictSync(ctx context.Context, operation string, s *storeSync, sync func(context.Context) error, failed *atomic.Bool) {
+	// the sync has the same timeout, but storage may not heed it
+	ctx, cancel := h.Distributed.withTimeout(ctx)
+	defer cancel()
+
+	start := time.Now()
+	err := s.do(ctx, sync)
+	h.metrics.recordSync(operation, time.Since(start), err)
+	failed.Store(err != nil)
+	if err != nil {
+		h.logger.Warn("syncing distributed state for strict decision",
+			zap.String("operation", operation),
+			zap.Error(err))
+	}
+}
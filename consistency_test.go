@@ -0,0 +1,220 @@
+package caddyrl
+
+import (
+	"context"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/certmagic"
+)
+
+func TestStoreSync(t *testing.T) {
+	var s storeSync
+	var syncs atomic.Int32
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+	slowSync := func(context.Context) error {
+		syncs.Add(1)
+		started <- struct{}{}
+		<-release
+		return nil
+	}
+
+	// a sync is running, so the callers that arrive meanwhile need
+	// another one, which they share
+	go func() { _ = s.do(context.Background(), slowSync) }()
+	<-started
+	var wg sync.WaitGroup
+	var arrived atomic.Int32
+	for range 10 {
+		wg.Go(func() {
+			arrived.Add(1)
+			if err := s.do(context.Background(), slowSync); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+	for arrived.Load() < 10 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if n := syncs.Load(); n != 2 {
+		t.Errorf("expected the waiting callers to share one sync, got %d syncs", n)
+	}
+
+	// waiting stops with the caller's context
+	block := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.do(ctx, func(context.Context) error { <-block; return nil }); err != context.Canceled {
+		t.Errorf("expected the wait to be cancelled, got %v", err)
+	}
+	close(block)
+}
+
+func TestConsistency(t *testing.T) {
+	initTime()
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+
+	// another instance of the cluster used up the key's events
+	peer := rlState{
+		Timestamp: now(),
+		Zones:     make(map[string]map[string]rlStateValue),
+	}
+	for _, zone := range []string{"strict_zone", "eventual_zone", "local_zone"} {
+		peer.Zones[zone] = map[string]rlStateValue{"static": {Count: 2, OldestEvent: now()}}
+	}
+	if err := writeRateLimitState(context.Background(), peer, "peer", storage, compressionNone); err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(consistency string) error {
+		rl := &RateLimit{
+			ZoneName:    consistency + "_zone",
+			Key:         "static",
+			Window:      caddy.Duration(time.Minute),
+			MaxEvents:   2,
+			Consistency: consistency,
+		}
+		h := newTestHandler(t, rl)
+		h.Distributed = &DistributedRateLimiting{instanceID: "self"}
+		h.storage = storage
+		_, err := h.limitRequest(httptest.NewRecorder(), newTestRequest("GET", "/", nil))
+		return err
+	}
+
+	// only strict decisions read the peer's state before deciding
+	if err := serve(consistencyStrict); !isDeclined(err) {
+		t.Errorf("expected the strict zone to see the peer's events, got %v", err)
+	}
+	if err := serve(consistencyEventual); err != nil {
+		t.Errorf("expected the eventual zone not to have read the peer's state yet, got %v", err)
+	}
+	if err := serve(consistencyLocal); err != nil {
+		t.Errorf("expected the local zone to ignore the peer, got %v", err)
+	}
+
+	// allowed strict events are stored before the request continues
+	if err := writeRateLimitState(context.Background(), rlState{Timestamp: now()}, "peer", storage, compressionNone); err != nil {
+		t.Fatal(err)
+	}
+	if err := serve(consistencyStrict); err != nil {
+		t.Fatalf("expected the strict zone to allow the event, got %v", err)
+	}
+	encoded, err := storage.Load(context.Background(), storagePrefix+"/self.rlstate")
+	if err != nil {
+		t.Fatalf("expected the instance's state to be stored, got %v", err)
+	}
+	state, err := decodeRateLimitState(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value := state.Zones["strict_zone"]["static"]; value.Count != 1 {
+		t.Errorf("expected the allowed event to be stored, got %+v", value)
+	}
+}
+
+func TestStoreFailure(t *testing.T) {
+	initTime()
+	storage := &failingStorage{Storage: &certmagic.FileStorage{Path: t.TempDir()}, failList: true}
+
+	serve := func(consistency, storeFailure string, storeFailing bool) error {
+		rl := &RateLimit{
+			ZoneName:     consistency + "_" + storeFailure + "_zone",
+			Key:          "static",
+			Window:       caddy.Duration(time.Minute),
+			MaxEvents:    2,
+			Consistency:  consistency,
+			StoreFailure: storeFailure,
+		}
+		h := newTestHandler(t, rl)
+		h.Distributed = &DistributedRateLimiting{instanceID: "self"}
+		h.storage = storage
+		h.Distributed.readFailed.Store(storeFailing)
+		_, err := h.limitRequest(httptest.NewRecorder(), newTestRequest("GET", "/", nil))
+		return err
+	}
+
+	// a strict decision whose read fails is degraded
+	if err := serve(consistencyStrict, storeFailureOpen, false); err != nil {
+		t.Errorf("expected the fail-open zone to allow the event, got %v", err)
+	}
+	if err := serve(consistencyStrict, storeFailureClosed, false); !isDeclined(err) {
+		t.Errorf("expected the fail-closed zone to decline the event, got %v", err)
+	}
+
+	// eventual decisions are degraded while background syncs fail
+	if err := serve(consistencyEventual, storeFailureClosed, false); err != nil {
+		t.Errorf("expected the event to be allowed while syncs succeed, got %v", err)
+	}
+	if err := serve(consistencyEventual, storeFailureClosed, true); !isDeclined(err) {
+		t.Errorf("expected the fail-closed zone to decline the event while syncs fail, got %v", err)
+	}
+	if err := serve(consistencyLocal, storeFailureClosed, true); err != nil {
+		t.Errorf("expected the local zone not to depend on storage, got %v", err)
+	}
+}
+
+func TestCaddyfileConsistency(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`
+	rate_limit {
+		zone api {
+			key         static
+			window      1m
+			events      5
+			consistency strict
+			store_failure closed
+		}
+	}`)
+
+	var h Handler
+	if err := h.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshaling Caddyfile: %v", err)
+	}
+	if h.RateLimits[0].Consistency != consistencyStrict {
+		t.Errorf("expected strict consistency, got %q", h.RateLimits[0].Consistency)
+	}
+	if h.RateLimits[0].StoreFailure != storeFailureClosed {
+		t.Errorf("expected the zone to fail closed, got %q", h.RateLimits[0].StoreFailure)
+	}
+
+	for _, input := range []string{
+		`rate_limit {
+			zone api {
+				key static
+				window 1m
+				events 5
+				consistency sometimes
+			}
+		}`,
+		`rate_limit {
+			zone api {
+				key static
+				window 1m
+				events 5
+				consistency local
+				consistency strict
+			}
+		}`,
+		`rate_limit {
+			zone api {
+				key static
+				window 1m
+				events 5
+				store_failure maybe
+			}
+		}`,
+	} {
+		var h Handler
+		if err := h.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err == nil {
+			t.Errorf("expected error for input: %s", input)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package caddyrl
+
+import (
+	"html/template"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(DashboardHandler{})
+	httpcaddyfile.RegisterHandlerDirective("rate_limit_dashboard", parseDashboardDirective)
+	httpcaddyfile.RegisterDirectiveOrder("rate_limit_dashboard", "before", "respond")
+}
+
+// DashboardHandler serves an HTML page with the state of all zones:
+// their limits, busiest keys and recent declines. It shows keys and
+// client IPs, so it should only be reachable by operators, e.g. behind
+// `basic_auth` or a `remote_ip` matcher. The same page is served by the
+// admin API at /rate_limit/dashboard.
+type DashboardHandler struct{}
+
+// CaddyModule returns the Caddy module information.
+func (DashboardHandler) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.rate_limit_dashboard",
+		New: func() caddy.Module { return new(DashboardHandler) },
+	}
+}
+
+func (DashboardHandler) ServeHTTP(w http.ResponseWriter, r *http.Request, _ caddyhttp.Handler) error {
+	return writeDashboard(w, r)
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler. Syntax:
+//
+//	rate_limit_dashboard
+func (*DashboardHandler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume directive name
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+func parseDashboardDirective(helper httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	var h DashboardHandler
+	err := h.UnmarshalCaddyfile(helper.Dispenser)
+	return h, err
+}
+
+// adminDashboardPath is the admin endpoint that serves the dashboard.
+const adminDashboardPath = "/rate_limit/dashboard"
+
+// handleDashboard serves the dashboard over the admin API.
+func handleDashboard(w http.ResponseWriter, r *http.Request) error {
+	return writeDashboard(w, r)
+}
+
+// dashboardTopKeys is the number of keys per zone that the dashboard
+// shows, busiest first.
+const dashboardTopKeys = 5
+
+// recentDeclinesSize is the number of recent declines that the
+// dashboard shows.
+const recentDeclinesSize = 50
+
+// declineHistory keeps the most recent declines of all handlers.
+type declineHistory struct {
+	mu       sync.Mutex
+	declines []dashboardDecline // ring buffer
+	next     int
+}
+
+// recentDeclines are the most recent declines of all handlers.
+var recentDeclines = &declineHistory{declines: make([]dashboardDecline, 0, recentDeclinesSize)}
+
+// add records the decline of a `rate_limit.deny` event.
+func (dh *declineHistory) add(data map[string]any) {
+	d := dashboardDecline{Time: now()}
+	d.Zone, _ = data["zone"].(string)
+	d.Key, _ = data["key"].(string)
+	d.RemoteIP, _ = data["remote_ip"].(string)
+	d.Wait, _ = data["wait"].(time.Duration)
+
+	dh.mu.Lock()
+	defer dh.mu.Unlock()
+	if len(dh.declines) < cap(dh.declines) {
+		dh.declines = append(dh.declines, d)
+	} else {
+		dh.declines[dh.next] = d
+	}
+	dh.next = (dh.next + 1) % cap(dh.declines)
+}
+
+// list returns the recorded declines, most recent first.
+func (dh *declineHistory) list() []dashboardDecline {
+	dh.mu.Lock()
+	defer dh.mu.Unlock()
+	list := make([]dashboardDecline, 0, len(dh.declines))
+	for i := 1; i <= len(dh.declines); i++ {
+		list = append(list, dh.declines[(dh.next-i+len(dh.declines))%len(dh.declines)])
+	}
+	return list
+}
+
+type dashboardDecline struct {
+	Time     time.Time
+	Zone     string
+	Key      string
+	RemoteIP string
+	Wait     time.Duration
+}
+
+type dashboardZone struct {
+	Name      string
+	MaxEvents int
+	Window    time.Duration
+	Keys      int
+	Clamp     *clampStatus
+	TopKeys   []dashboardKey
+}
+
+type dashboardKey struct {
+	Key         string
+	Events      int
+	Remaining   int
+	Utilization int // percent of max events
+}
+
+// dashboardZones returns the state of all zones, sorted by name, with
+// up to topKeys of their busiest keys.
+func dashboardZones(topKeys int) []dashboardZone {
+	ref := now()
+	var zones []dashboardZone
+	rateLimits.Range(func(name, value any) bool {
+		rlm := value.(*rateLimitersMap)
+		maxEvents, window := rlm.limits()
+		zone := dashboardZone{
+			Name:      name.(string),
+			MaxEvents: maxEvents,
+			Window:    window,
+			Keys:      rlm.len(),
+			Clamp:     rlm.clampStatus(),
+		}
+		rlm.forEach(func(key string, limiter *ringBufferRateLimiter) {
+			count, _ := limiter.Count(ref)
+			if count == 0 {
+				return
+			}
+			k := dashboardKey{Key: key, Events: count, Remaining: max(maxEvents-count, 0)}
+			if maxEvents > 0 {
+				k.Utilization = count * 100 / maxEvents
+			}
+			zone.TopKeys = append(zone.TopKeys, k)
+		})
+		sort.Slice(zone.TopKeys, func(i, j int) bool { return zone.TopKeys[i].Events > zone.TopKeys[j].Events })
+		if len(zone.TopKeys) > topKeys {
+			zone.TopKeys = zone.TopKeys[:topKeys]
+		}
+		zones = append(zones, zone)
+		return true
+	})
+	sort.Slice(zones, func(i, j int) bool { return zones[i].Name < zones[j].Name })
+	return zones
+}
+
+// writeDashboard writes the dashboard page.
+func writeDashboard(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Method == http.MethodHead {
+		return nil
+	}
+	return dashboardPage.Execute(w, map[string]any{
+		"Time":     now(),
+		"Zones":    dashboardZones(dashboardTopKeys),
+		"Declines": recentDeclines.list(),
+	})
+}
+
+var dashboardPage = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="10">
+<title>Rate limits</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left; vertical-align: top; }
+meter { width: 6em; }
+</style>
+</head>
+<body>
+<h1>Rate limits</h1>
+<p>As of {{.Time.Format "2006-01-02 15:04:05 MST"}}; refreshes every 10 seconds.</p>
+<h2>Zones</h2>
+<table>
+<tr><th>Zone</th><th>Limit</th><th>Keys</th><th>Busiest keys</th></tr>
+{{range .Zones}}
+<tr>
+<td>{{.Name}}</td>
+<td>{{.MaxEvents}} per {{.Window}}{{with .Clamp}}<br>clamped &times;{{.Factor}} until {{.Expires.Format "15:04:05"}}{{end}}</td>
+<td>{{.Keys}}</td>
+<td>{{range .TopKeys}}<meter min="0" max="100" value="{{.Utilization}}"></meter> {{.Utilization}}% {{.Key}} ({{.Events}})<br>{{else}}&ndash;{{end}}</td>
+</tr>
+{{else}}
+<tr><td colspan="4">No zones</td></tr>
+{{end}}
+</table>
+<h2>Recent declines</h2>
+<table>
+<tr><th>Time</th><th>Zone</th><th>Key</th><th>Remote IP</th><th>Wait</th></tr>
+{{range .Declines}}
+<tr><td>{{.Time.Format "15:04:05"}}</td><td>{{.Zone}}</td><td>{{.Key}}</td><td>{{.RemoteIP}}</td><td>{{.Wait}}</td></tr>
+{{else}}
+<tr><td colspan="5">No declines</td></tr>
+{{end}}
+</table>
+</body>
+</html>
+`))
+
+// Interface guards
+var (
+	_ caddyhttp.MiddlewareHandler = (*DashboardHandler)(nil)
+	_ caddyfile.Unmarshaler       = (*DashboardHandler)(nil)
+)
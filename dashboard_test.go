@@ -0,0 +1,60 @@
+package caddyrl
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDashboard(t *testing.T) {
+	initTime()
+
+	rlm := newTestZone(t, "dashboard_zone", 10, time.Minute)
+	for i := 1; i <= 7; i++ {
+		limiter := rlm.getOrInsert(fmt.Sprintf("client%d", i))
+		for range i {
+			rlm.when(limiter)
+		}
+	}
+
+	history := &declineHistory{declines: make([]dashboardDecline, 0, 3)}
+	for i := range 5 {
+		history.add(map[string]any{"zone": "dashboard_zone", "key": fmt.Sprintf("abuser%d", i), "wait": time.Second})
+	}
+	declines := history.list()
+	if len(declines) != 3 || declines[0].Key != "abuser4" || declines[2].Key != "abuser2" {
+		t.Errorf("expected the 3 most recent declines, most recent first, got %+v", declines)
+	}
+
+	var zone *dashboardZone
+	zones := dashboardZones(dashboardTopKeys)
+	for i := range zones {
+		if zones[i].Name == "dashboard_zone" {
+			zone = &zones[i]
+		}
+	}
+	if zone == nil {
+		t.Fatalf("expected the zone to be listed, got %+v", zones)
+	}
+	if zone.Keys != 7 || len(zone.TopKeys) != dashboardTopKeys {
+		t.Fatalf("unexpected zone %+v", zone)
+	}
+	if top := zone.TopKeys[0]; top.Key != "client7" || top.Events != 7 || top.Remaining != 3 || top.Utilization != 70 {
+		t.Errorf("unexpected busiest key %+v", top)
+	}
+
+	recentDeclines.add(map[string]any{"zone": "dashboard_zone", "key": "<script>", "remote_ip": "192.0.2.1"})
+	w := httptest.NewRecorder()
+	if err := handleDashboard(w, httptest.NewRequest(http.MethodGet, adminDashboardPath, nil)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	body := w.Body.String()
+	for _, want := range []string{"dashboard_zone", "10 per 1m0s", "70% client7 (7)", "&lt;script&gt;", "192.0.2.1"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected the dashboard to contain %q", want)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package caddyrl
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// adminDebugVarsPath is the admin endpoint that reports internal
+// counters of the module, in the manner of expvar, for debugging its
+// performance in more detail than its metrics do.
+const adminDebugVarsPath = "/rate_limit/debug/vars"
+
+// countedPool is a sync.Pool that counts how often values are taken
+// from it, and how often it had none to reuse.
+type countedPool struct {
+	pool sync.Pool
+
+	// makes a value if the pool has none; if nil, Get returns nil
+	new func() any
+
+	gets, misses atomic.Int64
+}
+
+func (p *countedPool) Get() any {
+	p.gets.Add(1)
+	v := p.pool.Get()
+	if v == nil {
+		p.misses.Add(1)
+		if p.new != nil {
+			v = p.new()
+		}
+	}
+	return v
+}
+
+func (p *countedPool) Put(v any) {
+	p.pool.Put(v)
+}
+
+// debugPool describes a pool in debug vars.
+type debugPool struct {
+	Gets    int64   `json:"gets"`
+	Misses  int64   `json:"misses"`
+	HitRate float64 `json:"hit_rate"`
+}
+
+func (p *countedPool) debugVars() debugPool {
+	gets, misses := p.gets.Load(), p.misses.Load()
+	vars := debugPool{Gets: gets, Misses: misses}
+	if gets > 0 {
+		vars.HitRate = float64(gets-misses) / float64(gets)
+	}
+	return vars
+}
+
+// debugZone describes the state of a zone in debug vars.
+type debugZone struct {
+	// Number of rate limiters, in all shards and in the largest one.
+	Keys         int `json:"keys"`
+	Shards       int `json:"shards"`
+	LargestShard int `json:"largest_shard"`
+
+	// Number of times that a shard's lock had to be waited for.
+	ContendedLocks int64 `json:"contended_locks"`
+
+	// Sizes of the zone's other state.
+	Bans         int `json:"bans"`
+	Backoffs     int `json:"backoffs"`
+	Idempotent   int `json:"idempotent"`
+	Sessions     int `json:"sessions"`
+	RetryStreaks int `json:"retry_streaks"`
+	Lockouts     int `json:"lockouts"`
+	Retired      int `json:"retired"`
+
+	// Number of sweeps, and how long the last one took.
+	Sweeps        int64   `json:"sweeps"`
+	LastSweepSecs float64 `json:"last_sweep_seconds"`
+}
+
+func (rlm *rateLimitersMap) debugVars() debugZone {
+	vars := debugZone{
+		Shards:        len(rlm.shards),
+		Sweeps:        rlm.sweeps.Load(),
+		LastSweepSecs: time.Duration(rlm.sweepDuration.Load()).Seconds(),
+	}
+	for i := range rlm.shards {
+		shard := &rlm.shards[i]
+		shard.lock()
+		n := len(shard.limiters)
+		vars.Bans += len(shard.bans)
+		vars.Backoffs += len(shard.backoffs)
+		shard.mu.Unlock()
+		vars.Keys += n
+		vars.LargestShard = max(vars.LargestShard, n)
+		vars.ContendedLocks += shard.contended.Load()
+	}
+	rlm.limitersMu.Lock()
+	vars.Idempotent = len(rlm.idempotent)
+	vars.Sessions = len(rlm.sessions)
+	vars.RetryStreaks = len(rlm.retryStreaks)
+	vars.Lockouts = len(rlm.lockouts)
+	rlm.limitersMu.Unlock()
+	rlm.retiredMu.Lock()
+	vars.Retired = len(rlm.retiring) + len(rlm.retired)
+	rlm.retiredMu.Unlock()
+	return vars
+}
+
+// debugVars are the internal counters of the module.
+type debugVars struct {
+	Zones map[string]debugZone `json:"zones"`
+	Pools map[string]debugPool `json:"pools"`
+}
+
+// handleDebugVars reports the internal counters of the module: the
+// sizes of each zone's state, how often the locks of its shards were
+// contended and how often it was swept, and how often pools had values
+// to reuse. Counters are totals since Caddy started.
+func handleDebugVars(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	vars := debugVars{
+		Zones: make(map[string]debugZone),
+		Pools: map[string]debugPool{
+			"limiters":     limiterPool.debugVars(),
+			"gob_buffers":  gobBufPool.debugVars(),
+			"gzip_writers": gzipWriterPool.debugVars(),
+		},
+	}
+	rateLimits.Range(func(name, value any) bool {
+		vars.Zones[name.(string)] = value.(*rateLimitersMap).debugVars()
+		return true
+	})
+	return writeAdminJSON(w, vars)
+}
@@ -0,0 +1,80 @@
+package caddyrl
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestCountedPool(t *testing.T) {
+	p := &countedPool{new: func() any { return new(int) }}
+	v := p.Get()
+	if v == nil {
+		t.Fatal("expected the pool to make a value")
+	}
+	p.Put(v)
+	p.Get()
+
+	vars := p.debugVars()
+	if vars.Gets != 2 || vars.Misses < 1 || vars.HitRate > 0.5 {
+		t.Errorf("unexpected pool vars: %+v", vars)
+	}
+
+	var empty countedPool
+	if v := empty.Get(); v != nil {
+		t.Errorf("expected a pool without new to return nil, got %v", v)
+	}
+	if vars := empty.debugVars(); vars.Gets != 1 || vars.Misses != 1 || vars.HitRate != 0 {
+		t.Errorf("unexpected pool vars: %+v", vars)
+	}
+}
+
+func TestDebugVars(t *testing.T) {
+	initTime()
+
+	rl := &RateLimit{
+		ZoneName:  "debug_zone",
+		Key:       "static",
+		Window:    caddy.Duration(time.Minute),
+		MaxEvents: 10,
+	}
+	if err := rl.provision(caddy.Context{}, rl.ZoneName); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _, _ = rateLimits.Delete(rl.ZoneName) })
+	rlm, _ := zoneLimiters(rl.ZoneName)
+	rlm.sweep()
+	for _, key := range []string{"a", "b", "c"} {
+		rlm.getOrInsert(key)
+	}
+
+	w := httptest.NewRecorder()
+	if err := handleDebugVars(w, httptest.NewRequest(http.MethodGet, adminDebugVarsPath, nil)); err != nil {
+		t.Fatal(err)
+	}
+	var vars debugVars
+	if err := json.NewDecoder(w.Body).Decode(&vars); err != nil {
+		t.Fatal(err)
+	}
+	zone, ok := vars.Zones[rl.ZoneName]
+	if !ok {
+		t.Fatalf("expected the zone in debug vars, got %+v", vars.Zones)
+	}
+	if zone.Keys != 3 || zone.Shards != len(rlm.shards) || zone.LargestShard < 1 || zone.Sweeps != 1 {
+		t.Errorf("unexpected zone vars: %+v", zone)
+	}
+	for _, pool := range []string{"limiters", "gob_buffers", "gzip_writers"} {
+		if _, ok := vars.Pools[pool]; !ok {
+			t.Errorf("expected pool %s in debug vars", pool)
+		}
+	}
+
+	err := handleDebugVars(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, adminDebugVarsPath, nil))
+	if apiErr, ok := err.(caddy.APIError); !ok || apiErr.HTTPStatus != http.StatusMethodNotAllowed {
+		t.Errorf("expected method not allowed, got %v", err)
+	}
+}
@@ -0,0 +1,255 @@
+package caddyrl
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(DecisionHandler{})
+	httpcaddyfile.RegisterHandlerDirective("rate_limit_decisions", parseDecisionDirective)
+	httpcaddyfile.RegisterDirectiveOrder("rate_limit_decisions", "before", "respond")
+}
+
+// DecisionHandler serves a JSON API for rate limit decisions, so that
+// services in any language, and edge functions, can limit events in
+// the zones of rate_limit handlers and share their quotas, like other
+// Caddy modules do with RateLimiterProvider. POST requests to a path
+// that ends in /check decide on the events in their body and count them
+// if they are allowed; GET requests to a path that ends in /openapi.json
+// are served the API's OpenAPI description. Anyone who reaches the
+// handler can use up the quotas of keys, so it should only be reachable
+// by trusted services, e.g. behind `basic_auth` or a `remote_ip`
+// matcher.
+type DecisionHandler struct{}
+
+// CaddyModule returns the Caddy module information.
+func (DecisionHandler) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.rate_limit_decisions",
+		New: func() caddy.Module { return new(DecisionHandler) },
+	}
+}
+
+func (DecisionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request, _ caddyhttp.Handler) error {
+	switch {
+	case strings.HasSuffix(r.URL.Path, decisionCheckPath) && r.Method == http.MethodPost:
+		serveDecision(w, r)
+	case strings.HasSuffix(r.URL.Path, decisionSpecPath) && (r.Method == http.MethodGet || r.Method == http.MethodHead):
+		serveDecisionSpec(w, strings.TrimSuffix(r.URL.Path, decisionSpecPath))
+	case strings.HasSuffix(r.URL.Path, decisionCheckPath), strings.HasSuffix(r.URL.Path, decisionSpecPath):
+		writeDecisionError(w, http.StatusMethodNotAllowed, "method not allowed")
+	default:
+		writeDecisionError(w, http.StatusNotFound, "not found")
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler. Syntax:
+//
+//	rate_limit_decisions
+func (*DecisionHandler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume directive name
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+func parseDecisionDirective(helper httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	var h DecisionHandler
+	err := h.UnmarshalCaddyfile(helper.Dispenser)
+	return h, err
+}
+
+// the endings of the paths that the decision API serves
+const (
+	decisionCheckPath = "/check"
+	decisionSpecPath  = "/openapi.json"
+)
+
+// decisionRequest is the body of a request for a decision.
+type decisionRequest struct {
+	Zone string `json:"zone" doc:"The name of the zone; zones whose names have placeholders are named after their values."`
+	Key  string `json:"key" doc:"The key whose events are limited."`
+	Cost int    `json:"cost,omitempty" doc:"The number of events, at least 1. Default: 1"`
+}
+
+// decisionResponse is the body of a decision.
+type decisionResponse struct {
+	Allowed    bool    `json:"allowed" doc:"Whether the events are allowed, in which case they were counted."`
+	Remaining  int     `json:"remaining" doc:"The number of events of the key that remain in the window."`
+	Reset      float64 `json:"reset" doc:"Seconds until the oldest of the key's events leaves the window; 0 if the key has none."`
+	RetryAfter float64 `json:"retry_after" doc:"Seconds to wait before the events would be allowed, if they aren't."`
+	Limit      int     `json:"limit" doc:"The zone's current limit of events per key."`
+	Window     float64 `json:"window" doc:"The zone's window in seconds."`
+}
+
+// decisionError is the body of an error response of the decision API.
+type decisionError struct {
+	Error string `json:"error" doc:"What is wrong with the request."`
+}
+
+// serveDecision decides on the events of the request's body.
+func serveDecision(w http.ResponseWriter, r *http.Request) {
+	req := decisionRequest{Cost: 1}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&req); err != nil {
+		writeDecisionError(w, http.StatusBadRequest, fmt.Sprintf("decoding request body: %v", err))
+		return
+	}
+	if req.Zone == "" {
+		writeDecisionError(w, http.StatusBadRequest, "zone is required")
+		return
+	}
+	rlm, ok := zoneLimiters(req.Zone)
+	if !ok {
+		writeDecisionError(w, http.StatusNotFound, fmt.Sprintf("unknown zone: %s", req.Zone))
+		return
+	}
+	d, err := rlm.allow(req.Key, req.Cost)
+	if err != nil {
+		writeDecisionError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(decisionResponse{
+		Allowed:    d.Allowed,
+		Remaining:  d.Remaining,
+		Reset:      d.Reset.Seconds(),
+		RetryAfter: d.RetryAfter.Seconds(),
+		Limit:      d.Limit,
+		Window:     d.Window.Seconds(),
+	})
+}
+
+func writeDecisionError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(decisionError{Error: message})
+}
+
+// serveDecisionSpec serves the OpenAPI description of the decision API
+// that is served under base.
+func serveDecisionSpec(w http.ResponseWriter, base string) {
+	spec := decisionSpec()
+	if base != "" {
+		spec["servers"] = []any{map[string]any{"url": base}}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(spec)
+}
+
+// decisionSpec returns the OpenAPI description of the decision API,
+// generated from the types of its requests and responses, so that it
+// can't drift from them.
+func decisionSpec() map[string]any {
+	schemas := decisionSchemas()
+	ref := func(name string) map[string]any {
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	}
+	errorResponse := func(description string) map[string]any {
+		return map[string]any{
+			"description": description,
+			"content":     map[string]any{"application/json": map[string]any{"schema": ref("Error")}},
+		}
+	}
+	return map[string]any{
+		"openapi": "3.1.0",
+		"info": map[string]any{
+			"title":       "Caddy rate limit decisions",
+			"description": "Limits events in the zones of Caddy's rate_limit handlers, sharing their quotas.",
+			"version":     "1",
+		},
+		"paths": map[string]any{
+			decisionCheckPath: map[string]any{
+				"post": map[string]any{
+					"operationId": "check",
+					"summary":     "Decides whether events of a key are allowed in a zone, and counts them if so.",
+					"requestBody": map[string]any{
+						"required": true,
+						"content":  map[string]any{"application/json": map[string]any{"schema": ref("DecisionRequest")}},
+					},
+					"responses": map[string]any{
+						"200": map[string]any{
+							"description": "The decision, whether the events are allowed or not.",
+							"content":     map[string]any{"application/json": map[string]any{"schema": ref("Decision")}},
+						},
+						"400": errorResponse("The request is invalid, e.g. its cost is less than 1."),
+						"404": errorResponse("The zone doesn't exist."),
+					},
+				},
+			},
+		},
+		"components": map[string]any{"schemas": schemas},
+	}
+}
+
+// decisionSchemas returns the JSON schemas of the decision API's types;
+// they never change, so they are generated once.
+var decisionSchemas = sync.OnceValue(func() map[string]any {
+	return map[string]any{
+		"DecisionRequest": jsonSchemaOf(reflect.TypeFor[decisionRequest]()),
+		"Decision":        jsonSchemaOf(reflect.TypeFor[decisionResponse]()),
+		"Error":           jsonSchemaOf(reflect.TypeFor[decisionError]()),
+	}
+})
+
+// jsonSchemaOf returns the JSON schema of values of t, which is a struct
+// of strings, numbers and booleans, as encoding/json encodes them. Its
+// fields are described by their doc tags, and are required unless they
+// are omitempty.
+func jsonSchemaOf(t reflect.Type) map[string]any {
+	properties := make(map[string]any)
+	required := []string{}
+	for _, field := range reflect.VisibleFields(t) {
+		name, opts, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if !field.IsExported() || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		property := map[string]any{}
+		switch field.Type.Kind() {
+		case reflect.String:
+			property["type"] = "string"
+		case reflect.Bool:
+			property["type"] = "boolean"
+		case reflect.Int, reflect.Int64:
+			property["type"] = "integer"
+		case reflect.Float64:
+			property["type"] = "number"
+		default:
+			panic(fmt.Sprintf("no JSON schema for field %s of type %s", field.Name, field.Type))
+		}
+		if doc := field.Tag.Get("doc"); doc != "" {
+			property["description"] = doc
+		}
+		properties[name] = property
+		if !strings.Contains(opts, "omitempty") {
+			required = append(required, name)
+		}
+	}
+	return map[string]any{
+		"type":       "object",
+		"properties": properties,
+		"required":   required,
+	}
+}
+
+// Interface guards
+var (
+	_ caddyhttp.MiddlewareHandler = (*DecisionHandler)(nil)
+	_ caddyfile.Unmarshaler       = (*DecisionHandler)(nil)
+)
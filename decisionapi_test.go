@@ -0,0 +1,97 @@
+package caddyrl
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestDecisionHandler(t *testing.T) {
+	initTime()
+	newTestZone(t, "decision_zone", 3, time.Minute)
+
+	serve := func(method, target, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		if err := (DecisionHandler{}).ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)), nil); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return rec
+	}
+	decide := func(body string) decisionResponse {
+		t.Helper()
+		rec := serve(http.MethodPost, "/limits/check", body)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d: %s", body, rec.Code, rec.Body)
+		}
+		var d decisionResponse
+		if err := json.NewDecoder(rec.Body).Decode(&d); err != nil {
+			t.Fatalf("decoding response: %v", err)
+		}
+		return d
+	}
+
+	if d := decide(`{"zone": "decision_zone", "key": "tenant"}`); !d.Allowed || d.Remaining != 2 || d.Reset != 60 || d.Limit != 3 || d.Window != 60 {
+		t.Errorf("unexpected decision: %+v", d)
+	}
+	advanceTime(15)
+	if d := decide(`{"zone": "decision_zone", "key": "tenant", "cost": 2}`); !d.Allowed || d.Remaining != 0 || d.Reset != 45 {
+		t.Errorf("unexpected decision: %+v", d)
+	}
+	if d := decide(`{"zone": "decision_zone", "key": "tenant"}`); d.Allowed || d.RetryAfter != 45 {
+		t.Errorf("expected a decline until the first event leaves the window, got %+v", d)
+	}
+
+	for body, status := range map[string]int{
+		`{"zone": "missing", "key": "tenant"}`:              http.StatusNotFound,
+		`{"key": "tenant"}`:                                 http.StatusBadRequest,
+		`{"zone": "decision_zone", "key": "a", "cost": -1}`: http.StatusBadRequest,
+		`not json`: http.StatusBadRequest,
+	} {
+		if rec := serve(http.MethodPost, "/limits/check", body); rec.Code != status || !strings.Contains(rec.Body.String(), `"error"`) {
+			t.Errorf("%s: expected status %d with an error, got %d: %s", body, status, rec.Code, rec.Body)
+		}
+	}
+	if rec := serve(http.MethodGet, "/limits/check", ""); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status 405, got %d", rec.Code)
+	}
+	if rec := serve(http.MethodGet, "/limits/other", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("expected status 404, got %d", rec.Code)
+	}
+
+	var spec struct {
+		OpenAPI string                    `json:"openapi"`
+		Servers []struct{ URL string }    `json:"servers"`
+		Paths   map[string]map[string]any `json:"paths"`
+		Comps   struct {
+			Schemas map[string]struct {
+				Properties map[string]struct{ Type string }
+				Required   []string
+			}
+		} `json:"components"`
+	}
+	rec := serve(http.MethodGet, "/limits/openapi.json", "")
+	if err := json.NewDecoder(rec.Body).Decode(&spec); err != nil {
+		t.Fatalf("decoding spec: %v", err)
+	}
+	if spec.OpenAPI == "" || len(spec.Servers) != 1 || spec.Servers[0].URL != "/limits" || spec.Paths["/check"]["post"] == nil {
+		t.Errorf("unexpected spec: %+v", spec)
+	}
+	if req := spec.Comps.Schemas["DecisionRequest"]; req.Properties["cost"].Type != "integer" || !slices.Equal(req.Required, []string{"zone", "key"}) {
+		t.Errorf("unexpected request schema: %+v", req)
+	}
+	if d := spec.Comps.Schemas["Decision"]; d.Properties["allowed"].Type != "boolean" || d.Properties["reset"].Type != "number" {
+		t.Errorf("unexpected decision schema: %+v", d)
+	}
+
+	var h DecisionHandler
+	if err := h.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`rate_limit_decisions extra`)); err == nil {
+		t.Error("expected an error for an argument")
+	}
+}
@@ -0,0 +1,52 @@
+package caddyrl
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// DeclineLog configures a dedicated log of a zone's declined requests,
+// separate from access logs, for abuse investigations. Entries are
+// written to the logger named `http.handlers.rate_limit.declines.<zone>`,
+// which can be routed to its own sink in Caddy's logging config.
+//
+// Unlike the handler's "rate limit exceeded" log, entries always
+// contain the key, since that is what investigations are about.
+type DeclineLog struct {
+	// Fraction of declined requests to log, between 0 and 1.
+	// Default: 1 (every declined request)
+	SampleRate float64 `json:"sample_rate,omitempty"`
+
+	logger *zap.Logger
+}
+
+func (dl *DeclineLog) provision(logger *zap.Logger, zoneName string) error {
+	if dl.SampleRate < 0 || dl.SampleRate > 1 {
+		return fmt.Errorf("sample_rate must be between 0 and 1")
+	}
+	if dl.SampleRate == 0 {
+		dl.SampleRate = 1
+	}
+	dl.logger = logger.Named("declines." + zoneName)
+	return nil
+}
+
+// log records a declined request, subject to sampling.
+func (dl *DeclineLog) log(r *http.Request, key, remoteIP string, wait time.Duration) {
+	if dl.SampleRate < 1 && rand.Float64() >= dl.SampleRate {
+		return
+	}
+	dl.logger.Info("request declined",
+		zap.String("key", key),
+		zap.String("remote_ip", remoteIP),
+		zap.String("method", r.Method),
+		zap.String("host", r.Host),
+		zap.String("uri", r.RequestURI),
+		zap.String("user_agent", r.UserAgent()),
+		zap.Duration("wait", wait),
+	)
+}
@@ -0,0 +1,48 @@
+package caddyrl
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestDeclineLog(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+
+	dl := new(DeclineLog)
+	if err := dl.provision(zap.New(core), "zone1"); err != nil {
+		t.Fatalf("provisioning decline log: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "/search?q=x", nil)
+	req.Header.Set("User-Agent", "scraper/1.0")
+	dl.log(req, "key1", "10.0.0.1", time.Second)
+
+	entries := logs.All()
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 log entry, got %d", len(entries))
+	}
+	if entries[0].LoggerName != "declines.zone1" {
+		t.Fatalf("unexpected logger name: %s", entries[0].LoggerName)
+	}
+	fields := entries[0].ContextMap()
+	if fields["key"] != "key1" || fields["remote_ip"] != "10.0.0.1" || fields["uri"] != "/search?q=x" || fields["user_agent"] != "scraper/1.0" {
+		t.Fatalf("unexpected log fields: %v", fields)
+	}
+
+	// with a vanishingly small sample rate, nothing should be logged
+	dl.SampleRate = 1e-12
+	for i := 0; i < 100; i++ {
+		dl.log(req, "key1", "10.0.0.1", time.Second)
+	}
+	if n := logs.Len(); n != 1 {
+		t.Fatalf("expected sampling to drop entries, but got %d", n)
+	}
+
+	if err := (&DeclineLog{SampleRate: 2}).provision(zap.NewNop(), "zone1"); err == nil {
+		t.Fatal("expected error for sample rate above 1")
+	}
+}
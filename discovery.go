@@ -0,0 +1,259 @@
+package caddyrl
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// PeerDiscovery discovers the instances that key ownership distributes
+// keys over from DNS SRV records or the Kubernetes Endpoints API,
+// instead of from the states that instances write to storage, so that
+// the instances of autoscaling groups join and leave as they are
+// started and stopped. Each discovered address is an instance, reached
+// at `<scheme>://<host>:<port>`, so each instance must advertise the
+// URL under which it is discovered.
+type PeerDiscovery struct {
+	// A DNS name whose SRV records list the instances, e.g.
+	// `_http._tcp.caddy.default.svc.cluster.local` of a headless
+	// Kubernetes service.
+	SRV string `json:"srv,omitempty"`
+
+	// A Kubernetes service whose ready endpoints are the instances.
+	Kubernetes *KubernetesEndpoints `json:"kubernetes,omitempty"`
+
+	// The scheme of the discovered instances' URLs. Default: http
+	Scheme string `json:"scheme,omitempty"`
+
+	// How often to look up the instances. Default: 30s
+	Interval caddy.Duration `json:"interval,omitempty"`
+}
+
+func (pd *PeerDiscovery) provision() error {
+	if (pd.SRV == "") == (pd.Kubernetes == nil) {
+		return fmt.Errorf("exactly one of srv and kubernetes is required")
+	}
+	switch pd.Scheme {
+	case "":
+		pd.Scheme = "http"
+	case "http", "https":
+	default:
+		return fmt.Errorf("unsupported scheme: %s", pd.Scheme)
+	}
+	if pd.Interval < 0 {
+		return fmt.Errorf("interval must be at least zero")
+	}
+	if pd.Interval == 0 {
+		pd.Interval = caddy.Duration(30 * time.Second)
+	}
+	if pd.Kubernetes != nil {
+		return pd.Kubernetes.provision()
+	}
+	return nil
+}
+
+// lookupSRV looks up SRV records; it is a variable so that tests can
+// replace DNS.
+var lookupSRV = net.DefaultResolver.LookupSRV
+
+// lookup returns the base URLs of the instances, sorted.
+func (pd *PeerDiscovery) lookup(ctx context.Context) ([]string, error) {
+	var hostPorts []string
+	if pd.Kubernetes != nil {
+		var err error
+		if hostPorts, err = pd.Kubernetes.lookup(ctx); err != nil {
+			return nil, err
+		}
+	} else {
+		_, records, err := lookupSRV(ctx, "", "", pd.SRV)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			host := strings.TrimSuffix(record.Target, ".")
+			hostPorts = append(hostPorts, net.JoinHostPort(host, strconv.Itoa(int(record.Port))))
+		}
+	}
+	urls := make([]string, 0, len(hostPorts))
+	for _, hostPort := range hostPorts {
+		urls = append(urls, pd.Scheme+"://"+hostPort)
+	}
+	slices.Sort(urls)
+	return slices.Compact(urls), nil
+}
+
+// discover keeps the owners of keys updated with the discovered
+// instances until ctx is canceled. While a lookup fails, the last
+// discovered instances are kept.
+func (ko *KeyOwnership) discover(ctx context.Context) {
+	labelTask(ctx, "discovery")
+	ticker := time.NewTicker(time.Duration(ko.Discovery.Interval))
+	defer ticker.Stop()
+	for {
+		ko.updateDiscovered(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// updateDiscovered looks up the instances and distributes keys over
+// them.
+func (ko *KeyOwnership) updateDiscovered(ctx context.Context) {
+	urls, err := ko.Discovery.lookup(ctx)
+	if err != nil {
+		ko.logger.Error("discovering instances for key ownership", zap.Error(err))
+		return
+	}
+	instances := map[string]string{ko.self: ko.Advertise}
+	for _, u := range urls {
+		instances[u] = u
+	}
+	if len(instances) > len(urls) {
+		// other instances won't forward events to this one
+		ko.logger.Warn("advertise URL is not among the discovered instances",
+			zap.String("advertise", ko.Advertise),
+			zap.Strings("discovered", urls))
+	}
+	ko.setOwners(ko.self, instances)
+}
+
+// KubernetesEndpoints discovers instances as the ready endpoints of a
+// Kubernetes service, through the API server of the cluster that Caddy
+// runs in, with the credentials of the pod's service account, which
+// must be allowed to get endpoints.
+type KubernetesEndpoints struct {
+	// The name of the service. Required.
+	Service string `json:"service,omitempty"`
+
+	// The namespace of the service. Default: the pod's namespace
+	Namespace string `json:"namespace,omitempty"`
+
+	// The name of the service's port at which instances are reached.
+	// Default: the service's first port
+	Port string `json:"port,omitempty"`
+
+	// the API server's URL and the directory of the service account's
+	// credentials; tests replace them
+	apiURL     string
+	accountDir string
+
+	client *http.Client
+}
+
+// kubernetesAccountDir is where Kubernetes mounts the credentials of a
+// pod's service account.
+const kubernetesAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+func (ke *KubernetesEndpoints) provision() error {
+	if ke.Service == "" {
+		return fmt.Errorf("kubernetes service is required")
+	}
+	if ke.accountDir == "" {
+		ke.accountDir = kubernetesAccountDir
+	}
+	if ke.apiURL == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return fmt.Errorf("not running in a Kubernetes cluster")
+		}
+		ke.apiURL = "https://" + net.JoinHostPort(host, port)
+	}
+	if ke.Namespace == "" {
+		namespace, err := os.ReadFile(filepath.Join(ke.accountDir, "namespace"))
+		if err != nil {
+			return fmt.Errorf("reading namespace: %v", err)
+		}
+		ke.Namespace = strings.TrimSpace(string(namespace))
+	}
+	caPEM, err := os.ReadFile(filepath.Join(ke.accountDir, "ca.crt"))
+	if err != nil {
+		return fmt.Errorf("reading cluster CA: %v", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEM) {
+		return fmt.Errorf("no certificates in cluster CA")
+	}
+	ke.client = &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}},
+	}
+	return nil
+}
+
+// kubernetesEndpoints is the part of a Kubernetes Endpoints object that
+// lists the ready addresses and their ports.
+type kubernetesEndpoints struct {
+	Subsets []struct {
+		Addresses []struct {
+			IP string `json:"ip"`
+		} `json:"addresses"`
+		Ports []struct {
+			Name string `json:"name"`
+			Port int    `json:"port"`
+		} `json:"ports"`
+	} `json:"subsets"`
+}
+
+// lookup returns the host and port of each ready endpoint.
+func (ke *KubernetesEndpoints) lookup(ctx context.Context) ([]string, error) {
+	// the token is rotated, so it is read for every lookup
+	token, err := os.ReadFile(filepath.Join(ke.accountDir, "token"))
+	if err != nil {
+		return nil, fmt.Errorf("reading service account token: %v", err)
+	}
+	endpoint := ke.apiURL + "/api/v1/namespaces/" + url.PathEscape(ke.Namespace) + "/endpoints/" + url.PathEscape(ke.Service)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := ke.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("kubernetes API responded with status %d", resp.StatusCode)
+	}
+	var endpoints kubernetesEndpoints
+	if err := json.NewDecoder(resp.Body).Decode(&endpoints); err != nil {
+		return nil, fmt.Errorf("decoding endpoints: %v", err)
+	}
+
+	var hostPorts []string
+	for _, subset := range endpoints.Subsets {
+		port := 0
+		for _, p := range subset.Ports {
+			if ke.Port == "" || p.Name == ke.Port {
+				port = p.Port
+				break
+			}
+		}
+		if port == 0 {
+			continue
+		}
+		for _, address := range subset.Addresses {
+			hostPorts = append(hostPorts, net.JoinHostPort(address.IP, strconv.Itoa(port)))
+		}
+	}
+	return hostPorts, nil
+}
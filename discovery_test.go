@@ -0,0 +1,158 @@
+package caddyrl
+
+import (
+	"context"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+func TestDiscoverySRV(t *testing.T) {
+	oldLookupSRV := lookupSRV
+	t.Cleanup(func() { lookupSRV = oldLookupSRV })
+	records := []*net.SRV{
+		{Target: "10-0-0-6.caddy.default.svc.cluster.local.", Port: 8080},
+		{Target: "10-0-0-5.caddy.default.svc.cluster.local.", Port: 8080},
+	}
+	lookupSRV = func(_ context.Context, _, _, name string) (string, []*net.SRV, error) {
+		if name != "_http._tcp.caddy.default.svc.cluster.local" {
+			t.Errorf("unexpected name: %s", name)
+		}
+		return "", records, nil
+	}
+
+	ko := &KeyOwnership{
+		Advertise: "http://10-0-0-5.caddy.default.svc.cluster.local:8080",
+		Secret:    "s",
+		Discovery: &PeerDiscovery{SRV: "_http._tcp.caddy.default.svc.cluster.local"},
+	}
+	if err := ko.provision("instance", nil, nil, zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+	ko.updateDiscovered(context.Background())
+
+	// keys are distributed over the discovered instances, of which the
+	// one at the advertise URL is this instance
+	owners := make(map[string]bool)
+	for _, point := range ko.owners.Load().points {
+		owners[point.instanceID] = true
+	}
+	if len(owners) != 2 || !owners[ko.Advertise] || !owners["http://10-0-0-6.caddy.default.svc.cluster.local:8080"] {
+		t.Errorf("unexpected owners: %v", owners)
+	}
+	if ko.self != ko.Advertise {
+		t.Errorf("expected this instance to be its advertise URL on the ring, got %s", ko.self)
+	}
+
+	// states in storage don't change the owners
+	ko.updateOwners("instance", []rlState{{InstanceID: "other", Advertise: "http://other", Timestamp: now()}}, now(), 0)
+	for _, point := range ko.owners.Load().points {
+		if point.instanceID == "other" {
+			t.Fatal("expected instances in storage to be ignored with discovery")
+		}
+	}
+
+	for _, pd := range []*PeerDiscovery{
+		{},
+		{SRV: "a", Kubernetes: &KubernetesEndpoints{Service: "caddy"}},
+		{SRV: "a", Scheme: "ftp"},
+	} {
+		if err := pd.provision(); err == nil {
+			t.Errorf("expected an error for %+v", pd)
+		}
+	}
+}
+
+func TestDiscoveryKubernetes(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/namespaces/prod/endpoints/caddy" || r.Header.Get("Authorization") != "Bearer secret-token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		_, _ = w.Write([]byte(`{"subsets": [{
+			"addresses": [{"ip": "10.0.0.5"}, {"ip": "10.0.0.6"}],
+			"notReadyAddresses": [{"ip": "10.0.0.7"}],
+			"ports": [{"name": "metrics", "port": 2019}, {"name": "http", "port": 8080}]
+		}]}`))
+	}))
+	defer srv.Close()
+
+	accountDir := t.TempDir()
+	for name, content := range map[string][]byte{
+		"ca.crt":    pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}),
+		"token":     []byte("secret-token\n"),
+		"namespace": []byte("prod"),
+	} {
+		if err := os.WriteFile(filepath.Join(accountDir, name), content, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pd := &PeerDiscovery{Kubernetes: &KubernetesEndpoints{Service: "caddy", Port: "http", apiURL: srv.URL, accountDir: accountDir}}
+	if err := pd.provision(); err != nil {
+		t.Fatal(err)
+	}
+	if pd.Kubernetes.Namespace != "prod" {
+		t.Errorf("expected the pod's namespace, got %q", pd.Kubernetes.Namespace)
+	}
+	urls, err := pd.lookup(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"http://10.0.0.5:8080", "http://10.0.0.6:8080"}; !slices.Equal(urls, expected) {
+		t.Errorf("expected the ready endpoints %v, got %v", expected, urls)
+	}
+
+	pd.Kubernetes.Service = "other"
+	if _, err := pd.lookup(context.Background()); err == nil {
+		t.Error("expected an error for a forbidden service")
+	}
+}
+
+func TestCaddyfileDiscovery(t *testing.T) {
+	var h Handler
+	if err := h.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`rate_limit {
+		distributed {
+			ownership http://10.0.0.5:8080 {
+				secret s
+				discovery {
+					kubernetes caddy prod
+					port       http
+					scheme     https
+					interval   10s
+				}
+			}
+		}
+	}`)); err != nil {
+		t.Fatalf("unmarshaling Caddyfile: %v", err)
+	}
+	pd := h.Distributed.Ownership.Discovery
+	if pd == nil || pd.Kubernetes == nil || pd.Kubernetes.Service != "caddy" || pd.Kubernetes.Namespace != "prod" ||
+		pd.Kubernetes.Port != "http" || pd.Scheme != "https" || pd.Interval != caddy.Duration(10*time.Second) {
+		t.Errorf("unexpected discovery: %+v", pd)
+	}
+
+	var bad Handler
+	if err := bad.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`rate_limit {
+		distributed {
+			ownership http://10.0.0.5:8080 {
+				discovery {
+					srv  _http._tcp.caddy
+					port http
+				}
+			}
+		}
+	}`)); err == nil {
+		t.Error("expected an error for a port without kubernetes discovery")
+	}
+}
@@ -0,0 +1,107 @@
+package caddyrl
+
+import (
+	"fmt"
+	"hash/maphash"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// DistinctLimit limits how many distinct values of a placeholder each
+// key may use within the zone's window, e.g. distinct paths or
+// usernames per client IP, to catch enumeration and credential stuffing
+// that per-request limits miss: a client that tries a thousand
+// usernames once each makes few requests, but uses many values.
+//
+// A request whose value the key used within the window is allowed, as
+// far as the distinct limit is concerned; one with a new value is
+// declined once the key has used max_values, until the value it used
+// least recently leaves the window. Requests with an empty value are
+// not limited. Values are remembered by their hash, and for at most
+// max_values per key, so that keys can't exhaust memory with values.
+type DistinctLimit struct {
+	// The value whose distinct values are counted per key, usually a
+	// placeholder such as `{http.request.uri.path}` or
+	// `{http.request.header.X-Username}`.
+	Value string `json:"value,omitempty"`
+
+	// The maximum number of distinct values that each key may use
+	// within the zone's window.
+	MaxValues int `json:"max_values,omitempty"`
+}
+
+// provision validates the limit.
+func (dl *DistinctLimit) provision() error {
+	if dl.Value == "" {
+		return fmt.Errorf("value is required")
+	}
+	if !strings.Contains(dl.Value, "{") {
+		return fmt.Errorf("value must contain a placeholder, otherwise every request has the same one: %s", dl.Value)
+	}
+	if dl.MaxValues < 1 {
+		return fmt.Errorf("max_values must be at least 1")
+	}
+	return nil
+}
+
+// wait uses the value of the request whose placeholders are in repl for
+// key, and returns zero if the key may use it, or how long the key has
+// to wait before it may use another value.
+func (dl *DistinctLimit) wait(rlm *rateLimitersMap, repl *caddy.Replacer, key string) time.Duration {
+	value := repl.ReplaceAll(dl.Value, "")
+	if value == "" {
+		return 0
+	}
+	return rlm.useDistinct(key, maphash.String(rlm.distinctSeed, value), dl.MaxValues)
+}
+
+// useDistinct records that key used the value with the given hash, and
+// returns zero, unless that is a new value and the key already used
+// maxValues within the window; then, it returns how long until the
+// value that the key used least recently leaves the window.
+func (rlm *rateLimitersMap) useDistinct(key string, value uint64, maxValues int) time.Duration {
+	ref := now()
+	window := time.Duration(rlm.window.Load())
+	rlm.limitersMu.Lock()
+	defer rlm.limitersMu.Unlock()
+
+	values := rlm.distinctValues[key]
+	if values == nil {
+		values = make(map[uint64]time.Time)
+		rlm.distinctValues[key] = values
+	}
+	if _, ok := values[value]; !ok && len(values) >= maxValues {
+		oldest := ref
+		for hash, lastUsed := range values {
+			if !lastUsed.After(ref.Add(-window)) {
+				delete(values, hash)
+			} else if lastUsed.Before(oldest) {
+				oldest = lastUsed
+			}
+		}
+		if len(values) >= maxValues {
+			return oldest.Add(window).Sub(ref)
+		}
+	}
+	values[value] = ref
+	return 0
+}
+
+// sweepDistinct forgets the values that left the window, and the keys
+// that have none left. It must be called while holding a lock on
+// limitersMu.
+func (rlm *rateLimitersMap) sweepDistinct() {
+	window := time.Duration(rlm.window.Load())
+	for key, values := range rlm.distinctValues {
+		for hash, lastUsed := range values {
+			if !lastUsed.After(now().Add(-window)) {
+				delete(values, hash)
+			}
+		}
+		if len(values) == 0 {
+			delete(rlm.distinctValues, key)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package caddyrl
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestDistinctLimit(t *testing.T) {
+	initTime()
+
+	rl := &RateLimit{
+		ZoneName: "distinct_zone",
+		Key:      "static",
+		Window:   caddy.Duration(time.Minute),
+		Distinct: &DistinctLimit{Value: "{http.request.uri.path}", MaxValues: 2},
+	}
+	h := newTestHandler(t, rl)
+	request := func(target string) (bool, string) {
+		t.Helper()
+		req := newTestRequest("GET", target, nil)
+		rec := httptest.NewRecorder()
+		err := h.limit(rec, req)
+		if err != nil && !isDeclined(err) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return err == nil, rec.Header().Get("Retry-After")
+	}
+
+	// the zone has no max_events, so values that were used can be used
+	// any number of times
+	for _, target := range []string{"/a", "/b", "/a", "/b", "/b"} {
+		if allowed, _ := request(target); !allowed {
+			t.Fatalf("expected %s to be allowed", target)
+		}
+	}
+	advanceTime(10)
+	if allowed, _ := request("/a"); !allowed {
+		t.Fatal("expected a used value to be allowed")
+	}
+
+	// a third value waits until /b, which was used least recently,
+	// leaves the window
+	if allowed, retryAfter := request("/c"); allowed || retryAfter != "50" {
+		t.Fatalf("expected a new value to be declined for 50s, got allowed=%v after %q", allowed, retryAfter)
+	}
+	advanceTime(61)
+	if allowed, _ := request("/c"); !allowed {
+		t.Fatal("expected a new value to be allowed once another left the window")
+	}
+	if allowed, _ := request("/b"); allowed {
+		t.Fatal("expected /b to be a new value again")
+	}
+
+	// resetting the key forgets its values
+	rl.limitersMap.delete("static")
+	if allowed, _ := request("/b"); !allowed {
+		t.Fatal("expected a reset key to be allowed new values")
+	}
+
+	// the values are remembered across reloads
+	if allowed, _ := request("/c"); !allowed {
+		t.Fatal("expected a second value to be allowed")
+	}
+	reloaded := &RateLimit{ZoneName: rl.ZoneName, Key: rl.Key, Window: rl.Window, Distinct: &DistinctLimit{Value: "{http.request.uri.path}", MaxValues: 2}}
+	h = newTestHandler(t, reloaded)
+	if allowed, _ := request("/b"); !allowed {
+		t.Fatal("expected a used value to be allowed after a reload")
+	}
+
+	for _, dl := range []*DistinctLimit{
+		{MaxValues: 1},
+		{Value: "static", MaxValues: 1},
+		{Value: "{http.request.uri.path}"},
+	} {
+		invalid := &RateLimit{Window: caddy.Duration(time.Minute), Distinct: dl}
+		if err := invalid.provision(caddy.Context{}, "invalid_distinct_zone"); err == nil {
+			t.Errorf("expected an error for %+v", dl)
+		}
+	}
+
+	var parsed Handler
+	if err := parsed.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`rate_limit {
+		zone login {
+			window   15m
+			distinct {http.request.header.X-Username} 5
+		}
+	}`)); err != nil {
+		t.Fatalf("unmarshaling Caddyfile: %v", err)
+	}
+	if dl := parsed.RateLimits[0].Distinct; dl == nil || dl.Value != "{http.request.header.X-Username}" || dl.MaxValues != 5 {
+		t.Errorf("unexpected distinct limit: %+v", dl)
+	}
+}
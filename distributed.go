@@ -17,11 +17,16 @@ package caddyrl
 import (
 	"bytes"
 	"context"
-	"encoding/gob"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	weakrand "math/rand"
 	"net/http"
 	"path"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
@@ -39,41 +44,171 @@ import (
 // intervals will result in higher consistency and precision, but more I/O
 // and CPU overhead.
 type DistributedRateLimiting struct {
-	// How often to sync internal state to storage. Default: 5s
+	// How often to sync internal state to storage. The state of all
+	// zones is written in one batch, so requests never wait on storage;
+	// longer intervals mean fewer writes but staler state on other
+	// instances. Default: 5s
 	WriteInterval caddy.Duration `json:"write_interval,omitempty"`
 
 	// How often to sync other instances' states from storage.
 	// Default: 5s
 	ReadInterval caddy.Duration `json:"read_interval,omitempty"`
 
+	// Fraction by which each read and write interval is varied randomly,
+	// either way, so that instances that started together don't sync in
+	// lockstep and load storage in bursts (example: 0.2 means each
+	// interval is between 80% and 120% of the configured one). Must be
+	// less than 1. Default: 0
+	Jitter float64 `json:"jitter,omitempty"`
+
+	// How the state that this instance writes is compressed: `none` or
+	// `gzip`. States of large key spaces compress well, which saves
+	// storage bandwidth at the cost of CPU. Instances read states however
+	// they are compressed. Default: none
+	Compression string `json:"compression,omitempty"`
+
 	// How long to wait before deleting stale states from other instances.
 	// Default: never
 	PurgeAge caddy.Duration `json:"purge_age,omitempty"`
 
+	// If set, each key is owned by one instance, which makes exact
+	// decisions for it; see KeyOwnership.
+	Ownership *KeyOwnership `json:"ownership,omitempty"`
+
+	// How long a read or write of state in storage may take before it
+	// is abandoned as failed. Strict decisions wait at most this long
+	// for storage. Default: 5s
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	// How other instances' states are read: `instances` (the default)
+	// reads the state of each instance from storage, while with `leader`,
+	// one elected instance reads them all and publishes them as one
+	// aggregate, which the other instances read instead. See
+	// publishAggregate.
+	Aggregation string `json:"aggregation,omitempty"`
+
+	// Fraction of each zone's events that is held back while Caddy is
+	// exiting, so that keys which have nearly used up their events in
+	// the cluster are declined rather than allowed events that may not
+	// reach the other instances before this one stops (example: 0.1
+	// declines keys with less than 10% of their events left). Must be
+	// less than 1. Default: 0
+	DrainReserve float64 `json:"drain_reserve,omitempty"`
+
+	// How far ahead of this instance's clock the timestamps of other
+	// instances' states and events may be. Later timestamps are taken
+	// to be this far ahead, so that an instance whose clock runs ahead
+	// can't keep its events in everyone's windows for longer than that.
+	// With clock_correction, clocks that are apart by less are not
+	// corrected. Default: 0 (timestamps are taken as they are)
+	MaxClockSkew caddy.Duration `json:"max_clock_skew,omitempty"`
+
+	// How the timestamps of other instances' states and events are
+	// corrected for the skew of their clocks: `none`, or `storage`,
+	// which estimates how far each instance's clock is off from
+	// storage's by comparing the timestamps of the states that it
+	// writes with the times at which storage says they were modified,
+	// so that an instance whose clock drifts can't expire or extend the
+	// other instances' windows. Storage must record modification times
+	// (like file_system does), and each read stats every state.
+	// Observers, which write no state, take their own clock to be
+	// storage's. Default: none
+	ClockCorrection string `json:"clock_correction,omitempty"`
+
+	// Trips to deciding locally when storage keeps failing; see
+	// StoreBreaker. It is always enabled, with defaults unless set.
+	Breaker *StoreBreaker `json:"breaker,omitempty"`
+
+	// The ID under which this instance writes its state, which must be
+	// unique in the cluster and should stay the same across restarts.
+	// Default: Caddy's instance ID, which is kept in its data directory
+	// (so instances whose data directory doesn't persist, e.g. in
+	// containers, should set one)
+	InstanceID string `json:"instance_id,omitempty"`
+
+	// If true, this instance only observes the cluster, e.g. as a canary
+	// or standby: it reads the states of the other instances, but never
+	// writes its own or leads, and never declines requests of zones
+	// whose consistency isn't local. Instead, the decisions it would
+	// have made are compared with those of the cluster's state alone;
+	// see observe.
+	Observe bool `json:"observe,omitempty"`
+
 	instanceID string
 
+	// when state was last read or written successfully; only
+	// accessed by the goroutine that syncs state
+	lastRead, lastWrite time.Time
+
 	otherStates   []rlState
 	otherStatesMu sync.RWMutex
+
+	// syncs of strict decisions
+	strictReads, strictWrites storeSync
+
+	// whether this instance is the leader that publishes the aggregate
+	// of all states; see Aggregation
+	leading atomic.Bool
+
+	// whether the last read or write of state failed, which makes
+	// decisions degraded; see RateLimit.StoreFailure
+	readFailed, writeFailed atomic.Bool
+
+	// how far this instance's clock is ahead of storage's, as last
+	// estimated; see ClockCorrection
+	clockOffset atomic.Pointer[time.Duration]
+}
+
+// withTimeout returns ctx limited to the timeout of storage calls.
+func (d *DistributedRateLimiting) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if d.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Duration(d.Timeout))
+}
+
+// jittered returns interval, varied randomly by up to Jitter of it
+// either way.
+func (d *DistributedRateLimiting) jittered(interval caddy.Duration) time.Duration {
+	if d.Jitter == 0 {
+		return time.Duration(interval)
+	}
+	return time.Duration(float64(interval) * (1 + d.Jitter*(2*weakrand.Float64()-1)))
+}
+
+// storeFailing returns whether state can't currently be synced with
+// storage.
+func (d *DistributedRateLimiting) storeFailing() bool {
+	return d.readFailed.Load() || d.writeFailed.Load()
 }
 
 func (h Handler) syncDistributed(ctx context.Context) {
-	readTicker := time.NewTicker(time.Duration(h.Distributed.ReadInterval))
-	writeTicker := time.NewTicker(time.Duration(h.Distributed.WriteInterval))
-	defer readTicker.Stop()
-	defer writeTicker.Stop()
+	labelTask(ctx, "sync")
+	readTimer := time.NewTimer(h.Distributed.jittered(h.Distributed.ReadInterval))
+	writeTimer := time.NewTimer(h.Distributed.jittered(h.Distributed.WriteInterval))
+	defer readTimer.Stop()
+	defer writeTimer.Stop()
 
 	for {
 		select {
-		case <-readTicker.C:
+		case <-readTimer.C:
+			readTimer.Reset(h.Distributed.jittered(h.Distributed.ReadInterval))
+			if !h.Distributed.Breaker.allow() {
+				continue
+			}
 			// get all the latest stored rate limiter states
-			err := h.syncDistributedRead(ctx)
+			err := h.recordSync(ctx, "read", h.syncDistributedRead, &h.Distributed.lastRead, &h.Distributed.readFailed)
 			if err != nil {
 				h.logger.Error("syncing distributed limiter states", zap.Error(err))
 			}
 
-		case <-writeTicker.C:
+		case <-writeTimer.C:
+			writeTimer.Reset(h.Distributed.jittered(h.Distributed.WriteInterval))
+			if h.Distributed.Observe || !h.Distributed.Breaker.allow() {
+				continue
+			}
 			// store all current rate limiter states
-			err := h.syncDistributedWrite(ctx)
+			err := h.recordSync(ctx, "write", h.syncDistributedWrite, &h.Distributed.lastWrite, &h.Distributed.writeFailed)
 			if err != nil {
 				h.logger.Error("distributing internal state", zap.Error(err))
 			}
@@ -84,11 +219,92 @@ func (h Handler) syncDistributed(ctx context.Context) {
 	}
 }
 
+// exiting returns whether Caddy is exiting, rather than reloading its
+// config; it is a variable so that tests can exit.
+var exiting = caddy.Exiting
+
+// syncDistributedLeave writes this instance's state once more when the
+// handler stops, so that the events since the last write aren't lost to
+// the other instances. If Caddy is exiting, the state is marked as
+// left, so that the other instances stop counting this one as a member
+// right away rather than once it goes stale, and if this instance leads,
+// its aggregate is removed so that another instance takes over.
+// Observers never wrote their state, so they have nothing to leave.
+func (h Handler) syncDistributedLeave() {
+	if h.Distributed.Observe {
+		return
+	}
+
+	// the handler's context is done, so its storage operations would
+	// fail now
+	ctx, cancel := h.Distributed.withTimeout(context.Background())
+	defer cancel()
+
+	state := h.localState()
+	state.Left = exiting()
+	if err := writeRateLimitState(ctx, state, h.Distributed.instanceID, h.storage, h.Distributed.Compression); err != nil {
+		h.logger.Error("distributing internal state before stopping", zap.Error(err))
+		return
+	}
+	if !state.Left {
+		return
+	}
+	if h.Distributed.leading.Load() {
+		if err := h.storage.Delete(ctx, aggregateStorageKey); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			h.logger.Error("removing rate limiter aggregate", zap.Error(err))
+		}
+	}
+	h.logger.Info("left distributed rate limiting", zap.String("instance_id", h.Distributed.instanceID))
+}
+
+// recordSync runs sync and records how long it took, whether it failed,
+// which is kept in failed, and how long ago the operation last
+// succeeded, which is kept in last.
+func (h Handler) recordSync(ctx context.Context, operation string, sync func(context.Context) error, last *time.Time, failed *atomic.Bool) error {
+	start := time.Now()
+	err := sync(ctx)
+	h.metrics.recordSync(operation, time.Since(start), err)
+	failed.Store(err != nil)
+
+	if err == nil {
+		*last = now()
+	}
+	h.metrics.updateSyncStaleness(operation, now().Sub(*last))
+	if operation == "read" {
+		h.metrics.updateClusterPeers(h.Distributed.peers(now()))
+	}
+
+	return err
+}
+
 // syncDistributedWrite stores all rate limiter states.
-func (h Handler) syncDistributedWrite(ctx context.Context) error {
+func (h Handler) syncDistributedWrite(ctx context.Context) (err error) {
+	ctx, cancel := h.Distributed.withTimeout(ctx)
+	defer cancel()
+	defer func() { h.Distributed.Breaker.record(err) }()
+
+	state := h.localState()
+	if err := writeRateLimitState(ctx, state, h.Distributed.instanceID, h.storage, h.Distributed.Compression); err != nil {
+		return err
+	}
+	if h.Distributed.ClockCorrection == clockCorrectionStorage {
+		h.Distributed.measureClock(ctx, h.storage, state.Timestamp)
+	}
+	return nil
+}
+
+// localState returns the current state of all of this instance's rate
+// limiters.
+func (h Handler) localState() rlState {
 	state := rlState{
-		Timestamp: now(),
-		Zones:     make(map[string]map[string]rlStateValue),
+		Version:    rlStateVersion,
+		MinVersion: rlStateMinVersion,
+		Timestamp:  now(),
+		InstanceID: h.Distributed.instanceID,
+		Zones:      make(map[string]map[string]rlStateValue),
+	}
+	if h.Distributed.Ownership != nil {
+		state.Advertise = h.Distributed.Ownership.Advertise
 	}
 
 	// iterate all rate limit zones
@@ -101,15 +317,15 @@ func (h Handler) syncDistributedWrite(ctx context.Context) error {
 		return true
 	})
 
-	return writeRateLimitState(ctx, state, h.Distributed.instanceID, h.storage)
+	return state
 }
 
-func writeRateLimitState(ctx context.Context, state rlState, instanceID string, storage certmagic.Storage) error {
+func writeRateLimitState(ctx context.Context, state rlState, instanceID string, storage certmagic.Storage, compression string) error {
 	buf := gobBufPool.Get().(*bytes.Buffer)
 	buf.Reset()
 	defer gobBufPool.Put(buf)
 
-	err := gob.NewEncoder(buf).Encode(state)
+	err := encodeState(buf, state, compression)
 	if err != nil {
 		return err
 	}
@@ -123,7 +339,23 @@ func writeRateLimitState(ctx context.Context, state rlState, instanceID string,
 }
 
 // syncDistributedRead loads all rate limiter states from other instances.
-func (h Handler) syncDistributedRead(ctx context.Context) error {
+func (h Handler) syncDistributedRead(ctx context.Context) (err error) {
+	ctx, cancel := h.Distributed.withTimeout(ctx)
+	defer cancel()
+	defer func() { h.Distributed.Breaker.record(err) }()
+
+	// followers read the states of all instances from the leader's
+	// aggregate, unless it isn't current
+	if h.Distributed.Aggregation == aggregationLeader && !h.Distributed.leading.Load() {
+		otherStates, ok, err := h.readAggregate(ctx)
+		if ok {
+			h.useOtherStates(otherStates)
+		}
+		if err != nil || ok {
+			return err
+		}
+	}
+
 	instanceFiles, err := h.storage.List(ctx, storagePrefix, false)
 	if err != nil {
 		return err
@@ -136,26 +368,31 @@ func (h Handler) syncDistributedRead(ctx context.Context) error {
 
 	for _, instanceFile := range instanceFiles {
 		// skip our own file
-		if strings.HasSuffix(instanceFile, h.Distributed.instanceID+".rlstate") {
+		if path.Base(instanceFile) == h.Distributed.instanceID+".rlstate" {
 			continue
 		}
 
+		modified := h.Distributed.modifiedBeforeLoad(ctx, h.storage, instanceFile)
 		encoded, err := h.storage.Load(ctx, instanceFile)
 		if err != nil {
 			h.logger.Error("unable to load distributed rate limiter state",
 				zap.String("key", instanceFile),
 				zap.Error(err))
+			// the instance's events still count, as last known
+			if last, ok := h.Distributed.lastState(strings.TrimSuffix(path.Base(instanceFile), ".rlstate")); ok {
+				otherStates = append(otherStates, last)
+			}
 			continue
 		}
 
-		var state rlState
-		err = gob.NewDecoder(bytes.NewReader(encoded)).Decode(&state)
+		state, err := decodeRateLimitState(encoded)
 		if err != nil {
 			h.logger.Error("corrupted rate limiter state file",
 				zap.String("key", instanceFile),
 				zap.Error(err))
 			continue
 		}
+		h.correctClock(ctx, instanceFile, modified, &state)
 
 		if h.Distributed.PurgeAge != 0 && state.Timestamp.Before(now().Add(-time.Duration(h.Distributed.PurgeAge))) {
 			err = h.storage.Delete(ctx, instanceFile)
@@ -170,65 +407,182 @@ func (h Handler) syncDistributedRead(ctx context.Context) error {
 		otherStates = append(otherStates, state)
 	}
 
+	h.useOtherStates(otherStates)
+
+	if h.Distributed.Aggregation == aggregationLeader && !h.Distributed.Observe {
+		return h.publishAggregate(ctx, otherStates)
+	}
+	return nil
+}
+
+// useOtherStates makes decisions account for the given states of other
+// instances from now on.
+func (h Handler) useOtherStates(otherStates []rlState) {
 	h.Distributed.otherStatesMu.Lock()
 	h.Distributed.otherStates = otherStates
 	h.Distributed.otherStatesMu.Unlock()
 
-	return nil
+	if h.Distributed.Ownership != nil {
+		// instances that stopped writing their state are presumed gone
+		h.Distributed.Ownership.updateOwners(h.Distributed.instanceID, otherStates, now(), h.Distributed.staleAfter())
+	}
+}
+
+// lastState returns the last known state of the instance with the given
+// ID.
+func (d *DistributedRateLimiting) lastState(instanceID string) (rlState, bool) {
+	d.otherStatesMu.RLock()
+	defer d.otherStatesMu.RUnlock()
+	for _, state := range d.otherStates {
+		if state.InstanceID == instanceID && instanceID != "" {
+			return state, true
+		}
+	}
+	return rlState{}, false
+}
+
+// newerState returns the more recent of two views of an instance's
+// state, i.e. the last write wins.
+func newerState(a, b rlState) rlState {
+	if b.Timestamp.After(a.Timestamp) {
+		return b
+	}
+	return a
 }
 
 // distributedRateLimiting enforces limiter (keyed by rlKey) in consideration of all other instances in the cluster.
 // If the limit is exceeded, the response is prepared and the relevant error is returned. Otherwise, a reservation
 // is made in the local limiter and no error is returned.
-func (h Handler) distributedRateLimiting(w http.ResponseWriter, r *http.Request, repl *caddy.Replacer, limiter *ringBufferRateLimiter, rlKey, zoneName string) error {
+func (h Handler) distributedRateLimiting(w http.ResponseWriter, r *http.Request, repl *caddy.Replacer, limiter *ringBufferRateLimiter, rlKey string, rl *RateLimit, cost int) error {
 	maxAllowed := limiter.MaxEvents()
 	window := limiter.Window()
 
-	var totalCount int
-	oldestEvent := now()
-
 	h.Distributed.otherStatesMu.RLock()
 	defer h.Distributed.otherStatesMu.RUnlock()
 
-	for _, otherInstanceState := range h.Distributed.otherStates {
+	totalCount, oldestEvent := countOtherInstances(h.Distributed.otherStates, rl.ZoneName, rlKey, maxAllowed, window, now())
+	if h.Distributed.DrainReserve > 0 && exiting() {
+		maxAllowed -= int(math.Ceil(h.Distributed.DrainReserve * float64(maxAllowed)))
+	}
+	if totalCount+cost > maxAllowed {
+		return h.rateLimitExceeded(w, r, repl, rl, rlKey, oldestEvent.Add(window).Sub(now()), rl.limitersMap.overloaded(nil))
+	}
+
+	// make the reservation if our own events are within what the other
+	// instances leave of the limit; the zone's total limit, if any, is
+	// reserved together with the key's
+	others := limiter.MaxEvents() - maxAllowed + totalCount
+	wait, byTotal := rl.limitersMap.reserveN(limiter, cost, others)
+	if wait == 0 {
+		return nil
+	}
+	if byTotal {
+		return h.rateLimitExceeded(w, r, repl, rl, rlKey, wait, true)
+	}
+
+	// otherwise, it appears limit has been exceeded until the oldest event
+	// of the cluster, including our own, leaves the window
+	if _, oldestLocalEvent := limiter.Count(now()); oldestLocalEvent.Before(oldestEvent) && oldestLocalEvent.After(now().Add(-window)) {
+		oldestEvent = oldestLocalEvent
+	}
+	return h.rateLimitExceeded(w, r, repl, rl, rlKey, oldestEvent.Add(window).Sub(now()), rl.limitersMap.overloaded(nil))
+}
+
+// observe records the decision that this observing instance would have
+// made for an event of key in rl, as a member of the cluster, along with
+// the decision of the cluster's state alone, i.e. of the last known
+// events of the other instances, without declining the event. Events
+// that it would have allowed are counted by limiter, so that they count
+// towards its later decisions as they would for a member. Comparing the
+// two shows how a canary's traffic or limits, or a standby's view of the
+// cluster, would change the cluster's decisions before the instance
+// joins it.
+func (h Handler) observe(limiter *ringBufferRateLimiter, key string, rl *RateLimit, cost int) {
+	maxAllowed := limiter.MaxEvents()
+	window := limiter.Window()
+	ref := now()
+
+	h.Distributed.otherStatesMu.RLock()
+	clusterCount, _ := countOtherInstances(h.Distributed.otherStates, rl.ZoneName, key, maxAllowed, window, ref)
+	h.Distributed.otherStatesMu.RUnlock()
+
+	decision, authoritative := decisionAllowed, decisionAllowed
+	if clusterCount+cost > maxAllowed {
+		authoritative = decisionDeclined
+	}
+
+	if _, wait := limiter.reserveN(cost, clusterCount); wait > 0 {
+		decision = decisionDeclined
+	}
+
+	h.metrics.recordObservedDecision(rl.ZoneName, decision, authoritative)
+}
+
+// Decisions as they are labeled in metrics and traces.
+const (
+	decisionAllowed  = "allowed"
+	decisionDeclined = "declined"
+)
+
+// countOtherInstances returns the sum of the last known counts of events
+// of key in the zone of the given states of other instances, and the
+// oldest of those events within the window from ref (or ref if there is
+// none). It stops counting once the sum reaches maxAllowed.
+func countOtherInstances(states []rlState, zoneName, key string, maxAllowed int, window time.Duration, ref time.Time) (int, time.Time) {
+	var totalCount int
+	oldestEvent := ref
+
+	for _, otherInstanceState := range states {
 		// if instance hasn't reported in longer than the window, no point in counting with it
-		if otherInstanceState.Timestamp.Before(now().Add(-window)) {
+		if otherInstanceState.Timestamp.Before(ref.Add(-window)) {
 			continue
 		}
 
 		// if instance has this zone, add last known limiter count
 		if zone, ok := otherInstanceState.Zones[zoneName]; ok {
 			// TODO: could probably skew the numbers here based on timestamp and window... perhaps try to predict a better updated count
-			totalCount += zone[rlKey].Count
-			if zone[rlKey].OldestEvent.Before(oldestEvent) && zone[rlKey].OldestEvent.After(now().Add(-window)) {
-				oldestEvent = zone[rlKey].OldestEvent
+			// (counts are capped so that the sum can't overflow)
+			totalCount += min(zone[key].Count, maxAllowed)
+			if zone[key].OldestEvent.Before(oldestEvent) && zone[key].OldestEvent.After(ref.Add(-window)) {
+				oldestEvent = zone[key].OldestEvent
 			}
 
 			// no point in counting more if we're already over
 			if totalCount >= maxAllowed {
-				return h.rateLimitExceeded(w, r, repl, zoneName, rlKey, oldestEvent.Add(window).Sub(now()))
+				break
 			}
 		}
 	}
+	return totalCount, oldestEvent
+}
 
-	// add our own internal count (we do this at the end instead of the beginning
-	// so the critical section over this limiter's lock is smaller), and make the
-	// reservation if we're within the limit
-	limiter.mu.Lock()
-	count, oldestLocalEvent := limiter.countUnsynced(now())
-	totalCount += count
-	if oldestLocalEvent.Before(oldestEvent) && oldestLocalEvent.After(now().Add(-window)) {
-		oldestEvent = oldestLocalEvent
+// decodeRateLimitState decodes the state that another instance stored,
+// upgraded to the current version. Since storage may be shared with
+// other software or corrupted, states with negative counts are rejected.
+func decodeRateLimitState(encoded []byte) (rlState, error) {
+	state, err := decodeState[rlState](encoded)
+	if err != nil {
+		return rlState{}, err
 	}
-	if totalCount < maxAllowed {
-		limiter.reserve()
-		limiter.mu.Unlock()
-		return nil
+	if err := migrateState(&state); err != nil {
+		return rlState{}, err
 	}
-	limiter.mu.Unlock()
+	if err := validateRateLimitState(state); err != nil {
+		return rlState{}, err
+	}
+	return state, nil
+}
 
-	// otherwise, it appears limit has been exceeded
-	return h.rateLimitExceeded(w, r, repl, zoneName, rlKey, oldestEvent.Add(window).Sub(now()))
+// validateRateLimitState returns an error if state has invalid values.
+func validateRateLimitState(state rlState) error {
+	for zoneName, zone := range state.Zones {
+		for key, value := range zone {
+			if value.Count < 0 {
+				return fmt.Errorf("negative count %d of key %s in zone %s", value.Count, key, zoneName)
+			}
+		}
+	}
+	return nil
 }
 
 type rlStateValue struct {
@@ -239,17 +593,33 @@ type rlStateValue struct {
 }
 
 type rlState struct {
+	// The version of the format of the state, and the oldest version
+	// whose readers interpret it correctly; see rlStateVersion. Gob
+	// ignores fields that readers don't know, so new fields can be added
+	// without raising MinVersion.
+	Version, MinVersion int
+
 	// When these values were recorded.
 	Timestamp time.Time
 
+	// The instance that recorded the values, and the address at which
+	// it decides for the keys it owns, if it enables key ownership.
+	InstanceID string
+	Advertise  string
+
+	// Whether the instance stopped because Caddy exited. Its events
+	// still count until they leave the window, but it is no longer a
+	// member of the cluster, e.g. an owner of keys or the leader.
+	Left bool
+
 	// Map of zone name to map of all rate limiters in that zone by key to the
 	// number of events within window and time at which the oldest event
 	// occurred.
 	Zones map[string]map[string]rlStateValue
 }
 
-var gobBufPool = sync.Pool{
-	New: func() interface{} {
+var gobBufPool = &countedPool{
+	new: func() any {
 		return new(bytes.Buffer)
 	},
 }
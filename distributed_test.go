@@ -15,8 +15,13 @@
 package caddyrl
 
 import (
+	"bytes"
 	"context"
+	"encoding/gob"
+	"errors"
 	"fmt"
+	"io/fs"
+	"math"
 	"os"
 	"path"
 	"strings"
@@ -24,9 +29,12 @@ import (
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddytest"
 	"github.com/caddyserver/certmagic"
 	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"go.uber.org/zap"
 )
 
@@ -89,7 +97,14 @@ func TestDistributed(t *testing.T) {
 
 	for _, testCase := range testCases {
 		t.Run(testCase.name, func(t *testing.T) {
-			storageDir := t.TempDir()
+			// The Caddy instance may still write to storage while the test
+			// is cleaned up, so removing the directory is best effort
+			// rather than a failure like with t.TempDir.
+			storageDir, err := os.MkdirTemp("", "caddy-ratelimit-distributed-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { _ = os.RemoveAll(storageDir) })
 			// Use a random UUID as the zone so that rate limits from multiple test runs
 			// don't collide with each other
 			zone := uuid.New().String()
@@ -110,7 +125,7 @@ func TestDistributed(t *testing.T) {
 			}
 
 			zoneLimiters := newRateLimiterMap()
-			zoneLimiters.limiters["static"] = simulatedPeer
+			zoneLimiters.shardFor("static").insert("static", simulatedPeer)
 
 			rlState := rlState{
 				Timestamp: testCase.peerStateTimeStamp,
@@ -123,7 +138,7 @@ func TestDistributed(t *testing.T) {
 				Path: storageDir,
 			}
 
-			if err := writeRateLimitState(context.Background(), rlState, "f92a00f1-050c-4353-83b1-8ccc2337c25b", &storage); err != nil {
+			if err := writeRateLimitState(context.Background(), rlState, "f92a00f1-050c-4353-83b1-8ccc2337c25b", &storage, compressionNone); err != nil {
 				t.Fatalf("failed to write state to storage: %s", err)
 			}
 
@@ -216,7 +231,7 @@ func TestPurgeDistributedState(t *testing.T) {
 		Timestamp: now(),
 		Zones:     make(map[string]map[string]rlStateValue, 0),
 	}
-	if err := writeRateLimitState(context.Background(), otherRlState, "12345678-1234-1234-1234-123456789abc", &storage); err != nil {
+	if err := writeRateLimitState(context.Background(), otherRlState, "12345678-1234-1234-1234-123456789abc", &storage, compressionNone); err != nil {
 		t.Fatalf("failed to write state to storage: %s", err)
 	}
 
@@ -262,3 +277,532 @@ func TestPurgeDistributedState(t *testing.T) {
 		t.Fatalf("storage directory was not empty: %v", dirEntries)
 	}
 }
+
+// FuzzDecodeRateLimitState checks that states read from storage, which
+// may be corrupted or written by others, can't crash the instances that
+// read them or make them count negative events.
+func FuzzDecodeRateLimitState(f *testing.F) {
+	ref := time.Unix(referenceTime, 0)
+	for _, state := range []rlState{
+		{Timestamp: ref},
+		{Timestamp: ref, Zones: map[string]map[string]rlStateValue{
+			"zone": {"key": {Count: 3, OldestEvent: ref.Add(-time.Second)}},
+		}},
+		{Timestamp: ref, Zones: map[string]map[string]rlStateValue{
+			"zone":  {"key": {Count: -1}, "": {Count: 1 << 62, OldestEvent: ref.Add(time.Hour)}},
+			"other": nil,
+		}},
+	} {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(state); err != nil {
+			f.Fatal(err)
+		}
+		f.Add(buf.Bytes())
+	}
+	f.Add([]byte{})
+	f.Add([]byte("not gob"))
+
+	f.Fuzz(func(t *testing.T, encoded []byte) {
+		state, err := decodeRateLimitState(encoded)
+		if err != nil {
+			return
+		}
+		for _, zone := range state.Zones {
+			for key, value := range zone {
+				if value.Count < 0 {
+					t.Fatalf("decoded negative count %d of key %q", value.Count, key)
+				}
+			}
+		}
+
+		const maxAllowed = 10
+		for zoneName, zone := range state.Zones {
+			for key := range zone {
+				count, oldest := countOtherInstances([]rlState{state, state}, zoneName, key, maxAllowed, time.Minute, ref)
+				if count < 0 || count >= 2*maxAllowed {
+					t.Fatalf("count %d of key %q is out of range", count, key)
+				}
+				if oldest.After(ref) {
+					t.Fatalf("oldest event %v is after the reference time", oldest)
+				}
+			}
+		}
+	})
+}
+
+// failingStorage is a storage whose List, or Load of keys with the given
+// suffix, fails, like a backend that is unreachable or partly corrupted.
+type failingStorage struct {
+	certmagic.Storage
+	failList   bool
+	failSuffix string
+}
+
+func (s *failingStorage) List(ctx context.Context, prefix string, recursive bool) ([]string, error) {
+	if s.failList {
+		return nil, fmt.Errorf("storage unavailable")
+	}
+	return s.Storage.List(ctx, prefix, recursive)
+}
+
+func (s *failingStorage) Load(ctx context.Context, key string) ([]byte, error) {
+	if s.failSuffix != "" && strings.HasSuffix(key, s.failSuffix) {
+		return nil, fmt.Errorf("storage unavailable")
+	}
+	return s.Storage.Load(ctx, key)
+}
+
+// rewritingStorage is a file storage whose values are modified again
+// right after they are loaded, like by an instance that writes its
+// state while it is being read.
+type rewritingStorage struct {
+	*certmagic.FileStorage
+	modified time.Time
+}
+
+func (s *rewritingStorage) Load(ctx context.Context, key string) ([]byte, error) {
+	value, err := s.FileStorage.Load(ctx, key)
+	if err == nil {
+		err = os.Chtimes(s.Filename(key), s.modified, s.modified)
+	}
+	return value, err
+}
+
+// distributedTestInstance is an instance of a cluster that shares storage,
+// with its own rate limiters of a zone.
+type distributedTestInstance struct {
+	handler  Handler
+	limiters *rateLimitersMap
+}
+
+func newDistributedTestInstance(t *testing.T, instanceID string, storage certmagic.Storage, maxEvents int, window time.Duration) *distributedTestInstance {
+	t.Helper()
+	limiters := newRateLimiterMap()
+	limiters.updateAll(maxEvents, window)
+	return &distributedTestInstance{
+		handler: Handler{
+			Distributed: &DistributedRateLimiting{instanceID: instanceID},
+			storage:     storage,
+			logger:      zap.NewNop(),
+		},
+		limiters: limiters,
+	}
+}
+
+// sync writes the instance's state and reads those of the others.
+func (inst *distributedTestInstance) sync(t *testing.T, zone string) {
+	t.Helper()
+	state := rlState{
+		Timestamp:  now(),
+		InstanceID: inst.handler.Distributed.instanceID,
+		Zones:      map[string]map[string]rlStateValue{zone: inst.limiters.rlStateForZone(now())},
+	}
+	if err := writeRateLimitState(context.Background(), state, inst.handler.Distributed.instanceID, inst.handler.storage, inst.handler.Distributed.Compression); err != nil {
+		t.Fatalf("writing state: %v", err)
+	}
+	if err := inst.handler.syncDistributedRead(context.Background()); err != nil {
+		t.Fatalf("reading states: %v", err)
+	}
+}
+
+// count returns the events of key in the zone across the cluster, as the
+// instance sees them.
+func (inst *distributedTestInstance) count(zone, key string, window time.Duration) int {
+	others, _ := countOtherInstances(inst.handler.Distributed.otherStates, zone, key, math.MaxInt, window, now())
+	local := 0
+	if limiter, ok := inst.limiters.get(key); ok {
+		local, _ = limiter.Count(now())
+	}
+	return others + local
+}
+
+func TestDistributedConvergence(t *testing.T) {
+	initTime()
+	const zone, key = "convergence", "client"
+	const window = time.Minute
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+
+	var instances []*distributedTestInstance
+	for i, events := range []int{1, 2, 3} {
+		inst := newDistributedTestInstance(t, fmt.Sprintf("00000000-0000-0000-0000-00000000000%d", i), storage, 10, window)
+		limiter := inst.limiters.getOrInsert(key)
+		for range events {
+			limiter.When()
+		}
+		instances = append(instances, inst)
+	}
+
+	// after every instance synced once, the last one to sync has seen
+	// all others; after a second round, all have
+	for round := 1; round <= 2; round++ {
+		for _, inst := range instances {
+			inst.sync(t, zone)
+		}
+	}
+	for i, inst := range instances {
+		if count := inst.count(zone, key, window); count != 6 {
+			t.Errorf("instance %d: expected 6 events across the cluster, got %d", i, count)
+		}
+	}
+
+	// new events converge with the next sync
+	instances[0].limiters.getOrInsert(key).When()
+	for _, inst := range instances {
+		inst.sync(t, zone)
+	}
+	for i, inst := range instances {
+		if count := inst.count(zone, key, window); count != 7 {
+			t.Errorf("instance %d: expected 7 events after new events, got %d", i, count)
+		}
+	}
+}
+
+func TestDistributedFailover(t *testing.T) {
+	initTime()
+	const zone, key = "failover", "client"
+	const window = time.Minute
+	storage := &failingStorage{Storage: &certmagic.FileStorage{Path: t.TempDir()}}
+
+	peer := newDistributedTestInstance(t, "11111111-1111-1111-1111-111111111111", storage, 10, window)
+	peer.limiters.getOrInsert(key).When()
+	peer.sync(t, zone)
+	unreachable := newDistributedTestInstance(t, "22222222-2222-2222-2222-222222222222", storage, 10, window)
+	unreachable.limiters.getOrInsert(key).When()
+	unreachable.sync(t, zone)
+	if err := storage.Store(context.Background(), path.Join(storagePrefix, "33333333-3333-3333-3333-333333333333.rlstate"), []byte("corrupted")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the states that can't be loaded or decoded are skipped
+	storage.failSuffix = "22222222-2222-2222-2222-222222222222.rlstate"
+	local := newDistributedTestInstance(t, "44444444-4444-4444-4444-444444444444", storage, 10, window)
+	local.sync(t, zone)
+	if count := local.count(zone, key, window); count != 1 {
+		t.Errorf("expected the readable peer's event only, got %d", count)
+	}
+
+	// while storage is unavailable, the last known states are kept
+	storage.failList = true
+	if err := local.handler.syncDistributedRead(context.Background()); err == nil {
+		t.Fatal("expected an error while storage is unavailable")
+	}
+	if count := local.count(zone, key, window); count != 1 {
+		t.Errorf("expected the last known states to be kept, got %d events", count)
+	}
+
+	// and once it is back, the instances converge again
+	storage.failList, storage.failSuffix = false, ""
+	local.sync(t, zone)
+	if count := local.count(zone, key, window); count != 2 {
+		t.Errorf("expected the events of both peers after recovery, got %d", count)
+	}
+}
+
+func TestDistributedMerge(t *testing.T) {
+	initTime()
+	const zone, key = "merge", "client"
+	const window = time.Minute
+	storage := &failingStorage{Storage: &certmagic.FileStorage{Path: t.TempDir()}}
+
+	peer := newDistributedTestInstance(t, "peer", storage, 10, window)
+	peer.limiters.getOrInsert(key).When()
+	peer.sync(t, zone)
+	local := newDistributedTestInstance(t, "local", storage, 10, window)
+	local.sync(t, zone)
+
+	// a state that can't be loaded counts as last known, rather than
+	// losing the peer's events until it can be loaded again
+	storage.failSuffix = "peer.rlstate"
+	local.sync(t, zone)
+	if count := local.count(zone, key, window); count != 1 {
+		t.Errorf("expected the peer's last known event, got %d", count)
+	}
+
+	// merging keeps the latest state of an instance, in any order
+	older := rlState{InstanceID: "peer", Timestamp: now().Add(-time.Second)}
+	newer := rlState{InstanceID: "peer", Timestamp: now()}
+	for _, merged := range []rlState{newerState(older, newer), newerState(newer, older), newerState(newer, newer)} {
+		if !merged.Timestamp.Equal(newer.Timestamp) {
+			t.Errorf("expected the newer state, got %v", merged.Timestamp)
+		}
+	}
+}
+
+func TestDistributedJitter(t *testing.T) {
+	d := &DistributedRateLimiting{Jitter: 0.2}
+	interval := caddy.Duration(10 * time.Second)
+	seen := make(map[time.Duration]bool)
+	for range 100 {
+		jittered := d.jittered(interval)
+		if jittered < 8*time.Second || jittered > 12*time.Second {
+			t.Fatalf("expected an interval within 20%% of 10s, got %s", jittered)
+		}
+		seen[jittered] = true
+	}
+	if len(seen) < 2 {
+		t.Error("expected intervals to vary")
+	}
+	if jittered := (&DistributedRateLimiting{}).jittered(interval); jittered != 10*time.Second {
+		t.Errorf("expected no jitter by default, got %s", jittered)
+	}
+
+	var h Handler
+	if err := h.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`rate_limit {
+		distributed {
+			jitter 0.1
+		}
+	}`)); err != nil {
+		t.Fatalf("unmarshaling Caddyfile: %v", err)
+	}
+	if h.Distributed.Jitter != 0.1 {
+		t.Errorf("unexpected jitter: %v", h.Distributed.Jitter)
+	}
+}
+
+func TestDistributedExpiry(t *testing.T) {
+	initTime()
+	const zone, key = "expiry", "client"
+	const window = time.Minute
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+
+	peer := newDistributedTestInstance(t, "55555555-5555-5555-5555-555555555555", storage, 10, window)
+	for range 3 {
+		peer.limiters.getOrInsert(key).When()
+	}
+	peer.sync(t, zone)
+	local := newDistributedTestInstance(t, "66666666-6666-6666-6666-666666666666", storage, 10, window)
+	local.handler.Distributed.PurgeAge = caddy.Duration(time.Hour)
+	local.sync(t, zone)
+	if count := local.count(zone, key, window); count != 3 {
+		t.Fatalf("expected the peer's 3 events, got %d", count)
+	}
+
+	// once the peer's events leave the window, its next state reports none
+	advanceTime(61)
+	peer.sync(t, zone)
+	local.sync(t, zone)
+	if count := local.count(zone, key, window); count != 0 {
+		t.Errorf("expected the peer's events to have expired, got %d", count)
+	}
+
+	// a peer that stops syncing isn't counted after a window...
+	for range 3 {
+		peer.limiters.getOrInsert(key).When()
+	}
+	peer.sync(t, zone)
+	advanceTime(61 + 61)
+	local.sync(t, zone)
+	if count := local.count(zone, key, window); count != 0 {
+		t.Errorf("expected the state of a silent peer not to be counted, got %d", count)
+	}
+
+	// ...and its state is deleted after purge_age
+	advanceTime(61 + 2*60*60)
+	local.sync(t, zone)
+	if _, err := storage.Load(context.Background(), path.Join(storagePrefix, "55555555-5555-5555-5555-555555555555.rlstate")); err == nil {
+		t.Error("expected the silent peer's state to be purged")
+	}
+}
+
+func TestDistributedLeave(t *testing.T) {
+	initTime()
+	oldExiting := exiting
+	t.Cleanup(func() { exiting = oldExiting })
+	const zone = "leave"
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+
+	leaving := newDistributedTestInstance(t, "a", storage, 10, time.Minute)
+	staying := newDistributedTestInstance(t, "b", storage, 10, time.Minute)
+	for _, inst := range []*distributedTestInstance{leaving, staying} {
+		inst.handler.Distributed.WriteInterval = caddy.Duration(5 * time.Second)
+		inst.handler.Distributed.Aggregation = aggregationLeader
+	}
+	for range 2 {
+		leaving.sync(t, zone)
+		staying.sync(t, zone)
+	}
+	if !leaving.handler.Distributed.leading.Load() {
+		t.Fatal("expected the instance with the lowest ID to lead")
+	}
+
+	// a reload keeps the instance in the cluster
+	exiting = func() bool { return false }
+	leaving.handler.syncDistributedLeave()
+	staying.sync(t, zone)
+	if active, _ := staying.handler.Distributed.peers(now()); active != 1 {
+		t.Errorf("expected the instance to stay in the cluster across reloads, got %d active peers", active)
+	}
+
+	// exiting leaves it right away
+	advanceTime(1)
+	exiting = func() bool { return true }
+	leaving.handler.syncDistributedLeave()
+	if _, err := storage.Load(context.Background(), aggregateStorageKey); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected the leaving leader to remove its aggregate, got %v", err)
+	}
+	staying.sync(t, zone)
+	if active, stale := staying.handler.Distributed.peers(now()); active != 0 || stale != 1 {
+		t.Errorf("expected the instance to have left, got %d active and %d stale peers", active, stale)
+	}
+	if !staying.handler.Distributed.leading.Load() {
+		t.Error("expected the remaining instance to take over as leader")
+	}
+
+	var h Handler
+	if err := h.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`rate_limit {
+		distributed {
+			drain_reserve 0.1
+		}
+	}`)); err != nil {
+		t.Fatalf("unmarshaling Caddyfile: %v", err)
+	}
+	if h.Distributed.DrainReserve != 0.1 {
+		t.Errorf("unexpected drain reserve: %v", h.Distributed.DrainReserve)
+	}
+}
+
+func TestDistributedObserve(t *testing.T) {
+	oldMetrics := globalMetrics
+	t.Cleanup(func() { globalMetrics = oldMetrics })
+	globalMetrics = initializeMetrics(prometheus.NewRegistry(), defaultProcessTimeBuckets)
+
+	initTime()
+	const zone, key = "observe", "client"
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+
+	member := newDistributedTestInstance(t, "b", storage, 5, time.Minute)
+	for range 3 {
+		member.limiters.getOrInsert(key).When()
+	}
+	member.sync(t, zone)
+
+	observer := newDistributedTestInstance(t, "a", storage, 5, time.Minute)
+	observer.handler.Distributed.Observe = true
+	observer.handler.Distributed.Aggregation = aggregationLeader
+	observer.handler.metrics = newMetricsCollector(true, &RateLimitApp{})
+	if err := observer.handler.syncDistributedRead(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if observer.handler.Distributed.leading.Load() {
+		t.Error("expected the observer not to lead, although it has the lowest ID")
+	}
+
+	// the observer's own events are counted on top of the cluster's
+	rl := &RateLimit{ZoneName: zone}
+	limiter := observer.limiters.getOrInsert(key)
+	for range 3 {
+		observer.handler.observe(limiter, key, rl, 1)
+	}
+	for _, tc := range []struct {
+		decision, authoritative string
+		want                    float64
+	}{
+		{decisionAllowed, decisionAllowed, 2},
+		{decisionDeclined, decisionAllowed, 1},
+		{decisionDeclined, decisionDeclined, 0},
+	} {
+		if got := testutil.ToFloat64(globalMetrics.observed.WithLabelValues(zone, tc.decision, tc.authoritative)); got != tc.want {
+			t.Errorf("expected %v decisions %s by the observer and %s by the cluster, got %v", tc.want, tc.decision, tc.authoritative, got)
+		}
+	}
+
+	// observers never write their state
+	observer.handler.syncDistributedLeave()
+	if _, err := storage.Load(context.Background(), path.Join(storagePrefix, "a.rlstate")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected the observer not to write its state, got %v", err)
+	}
+	member.sync(t, zone)
+	if active, stale := member.handler.Distributed.peers(now()); active != 0 || stale != 0 {
+		t.Errorf("expected the observer not to be a peer, got %d active and %d stale", active, stale)
+	}
+
+	var h Handler
+	if err := h.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`rate_limit {
+		distributed {
+			observe
+		}
+	}`)); err != nil {
+		t.Fatalf("unmarshaling Caddyfile: %v", err)
+	}
+	if !h.Distributed.Observe {
+		t.Error("expected the handler to observe")
+	}
+}
+
+func TestDistributedClockSkew(t *testing.T) {
+	initTime()
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	inst := newDistributedTestInstance(t, "a", storage, 10, time.Minute)
+	inst.handler.Distributed.ClockCorrection = clockCorrectionStorage
+	inst.handler.Distributed.MaxClockSkew = caddy.Duration(5 * time.Second)
+
+	// storage's clock is an hour behind this instance's, and an hour
+	// and a minute behind that of instance b, which runs a minute ahead
+	storageTime := now().Add(-time.Hour)
+	write := func(instanceID string, timestamp time.Time) {
+		t.Helper()
+		state := rlState{
+			Timestamp:  timestamp,
+			InstanceID: instanceID,
+			Zones: map[string]map[string]rlStateValue{
+				"skew_zone": {"client": {Count: 3, OldestEvent: timestamp.Add(-10 * time.Second)}},
+			},
+		}
+		if err := writeRateLimitState(context.Background(), state, instanceID, storage, compressionNone); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(storage.Filename(path.Join(storagePrefix, instanceID+".rlstate")), storageTime, storageTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("a", now())
+	inst.handler.Distributed.measureClock(context.Background(), storage, now())
+	write("b", now().Add(time.Minute))
+
+	if err := inst.handler.syncDistributedRead(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	states := inst.handler.Distributed.otherStates
+	if len(states) != 1 || !states[0].Timestamp.Equal(now()) {
+		t.Fatalf("expected b's state to be corrected to this instance's clock, got %+v", states)
+	}
+	if oldest := states[0].Zones["skew_zone"]["client"].OldestEvent; !oldest.Equal(now().Add(-10 * time.Second)) {
+		t.Errorf("expected b's events to be corrected to this instance's clock, got %v", oldest)
+	}
+
+	// a state that is modified while it is read isn't corrected, since
+	// its timestamp may be older than the modification
+	inst.handler.storage = &rewritingStorage{FileStorage: storage, modified: storageTime.Add(-time.Minute)}
+	if err := inst.handler.syncDistributedRead(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if state := inst.handler.Distributed.otherStates[0]; !state.Timestamp.Equal(now().Add(5 * time.Second)) {
+		t.Errorf("expected b's state to be clamped instead of corrected, got %v", state.Timestamp)
+	}
+	inst.handler.storage = storage
+	write("b", now().Add(time.Minute))
+
+	// without correction, timestamps ahead are taken to be at most
+	// max_clock_skew ahead
+	inst.handler.Distributed.ClockCorrection = clockCorrectionNone
+	if err := inst.handler.syncDistributedRead(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	state := inst.handler.Distributed.otherStates[0]
+	if want := now().Add(5 * time.Second); !state.Timestamp.Equal(want) || !state.Zones["skew_zone"]["client"].OldestEvent.Equal(want) {
+		t.Errorf("expected timestamps to be clamped to %v, got %+v", want, state)
+	}
+
+	var h Handler
+	if err := h.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`rate_limit {
+		distributed {
+			max_clock_skew 2s
+			clock_correction storage
+		}
+	}`)); err != nil {
+		t.Fatal(err)
+	}
+	if h.Distributed.MaxClockSkew != caddy.Duration(2*time.Second) || h.Distributed.ClockCorrection != clockCorrectionStorage {
+		t.Errorf("unexpected clock skew options: %+v", h.Distributed)
+	}
+}
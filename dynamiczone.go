@@ -0,0 +1,114 @@
+package caddyrl
+
+import (
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// dynamicZones holds the zones that a zone with placeholders in its
+// name resolves to, keyed by their resolved names.
+type dynamicZones struct {
+	mu    sync.RWMutex
+	zones map[string]*RateLimit
+
+	// the zone of the values beyond RateLimit.MaxZones, once there are
+	// any
+	overflow *RateLimit
+
+	// called with each zone when it is created, while holding mu
+	onNew func(zone *RateLimit)
+}
+
+// resolve returns the zone that a request is limited in: rl itself,
+// or if rl's name has placeholders, the zone named after the values
+// of the placeholders for the request, which is created on first use.
+func (rl *RateLimit) resolve(repl *caddy.Replacer) *RateLimit {
+	if rl.dynamic == nil {
+		return rl
+	}
+	name := rl.nameTemplate.key(repl)
+
+	rl.dynamic.mu.RLock()
+	zone, ok := rl.dynamic.zones[name]
+	if !ok && rl.full() && rl.dynamic.overflow != nil {
+		zone, ok = rl.dynamic.overflow, true
+	}
+	rl.dynamic.mu.RUnlock()
+	if ok {
+		return zone
+	}
+
+	rl.dynamic.mu.Lock()
+	defer rl.dynamic.mu.Unlock()
+	if zone, ok := rl.dynamic.zones[name]; ok {
+		return zone
+	}
+	if rl.full() {
+		if rl.dynamic.overflow == nil {
+			// the overflow zone is shared by all values, so the
+			// placeholders in its name are replaced by a fixed one
+			name := caddy.NewEmptyReplacer().ReplaceAll(rl.nameTemplate.raw, overflowKeyLabel)
+			rl.dynamic.overflow = rl.instantiate(name)
+			if rl.dynamic.onNew != nil {
+				rl.dynamic.onNew(rl.dynamic.overflow)
+			}
+		}
+		return rl.dynamic.overflow
+	}
+	zone = rl.instantiate(name)
+	if rl.tenantTemplate != nil {
+		zone.tenant = rl.tenantTemplate.key(repl)
+	}
+	rl.dynamic.zones[name] = zone
+	if rl.dynamic.onNew != nil {
+		rl.dynamic.onNew(zone)
+	}
+	return zone
+}
+
+// full returns true if rl has created as many zones as it may. It must
+// be called while holding a lock on rl.dynamic.mu.
+func (rl *RateLimit) full() bool {
+	return rl.MaxZones > 0 && len(rl.dynamic.zones) >= rl.MaxZones
+}
+
+// instantiate returns a zone with the given name and rl's settings.
+func (rl *RateLimit) instantiate(name string) *RateLimit {
+	zone := *rl
+	zone.ZoneName = name
+	zone.nameTemplate = keyTemplate{}
+	zone.dynamic = nil
+	zone.provisionState(name)
+	return &zone
+}
+
+// forEachZone calls fn with rl and the zones of its tiers and of its
+// authenticated requests, or if rl's
+// name has placeholders, with each zone it has resolved to so far.
+func (rl *RateLimit) forEachZone(fn func(zone *RateLimit)) {
+	if rl.dynamic == nil {
+		fn(rl)
+		for _, tier := range rl.Tiers {
+			if zone := rl.tiers[tier.Name]; zone != nil {
+				fn(zone)
+			}
+		}
+		if rl.authenticated != nil {
+			fn(rl.authenticated)
+		}
+		return
+	}
+	rl.dynamic.mu.RLock()
+	zones := make([]*RateLimit, 0, len(rl.dynamic.zones)+1)
+	for _, zone := range rl.dynamic.zones {
+		zones = append(zones, zone)
+	}
+	if rl.dynamic.overflow != nil {
+		zones = append(zones, rl.dynamic.overflow)
+	}
+	rl.dynamic.mu.RUnlock()
+	for _, zone := range zones {
+		fn(zone)
+	}
+}
@@ -0,0 +1,113 @@
+package caddyrl
+
+import (
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestDynamicZones(t *testing.T) {
+	initTime()
+
+	rl := &RateLimit{
+		ZoneName:  "site_{http.request.host}",
+		Key:       "static",
+		MaxEvents: 1,
+		Window:    caddy.Duration(time.Minute),
+	}
+	if err := rl.provision(caddy.Context{}, rl.ZoneName); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var created []string
+	rl.dynamic.onNew = func(zone *RateLimit) {
+		created = append(created, zone.ZoneName)
+	}
+
+	resolve := func(host string) *RateLimit {
+		repl := caddy.NewReplacer()
+		repl.Set("http.request.host", host)
+		return rl.resolve(repl)
+	}
+	a, b := resolve("a.example.com"), resolve("b.example.com")
+	if a.ZoneName != "site_a.example.com" || b.ZoneName != "site_b.example.com" {
+		t.Fatalf("unexpected zone names %q and %q", a.ZoneName, b.ZoneName)
+	}
+	if resolve("a.example.com") != a {
+		t.Fatal("expected the same zone for the same host")
+	}
+	if len(created) != 2 {
+		t.Fatalf("expected 2 zones to be created, got %v", created)
+	}
+	t.Cleanup(func() {
+		rl.forEachZone(func(zone *RateLimit) {
+			rateLimits.Delete(zone.ZoneName)
+		})
+	})
+
+	// zones of different hosts are limited independently
+	if a.limitersMap.getOrInsert("static").When() > 0 {
+		t.Fatal("first event of zone a should be allowed")
+	}
+	if a.limitersMap.getOrInsert("static").When() == 0 {
+		t.Fatal("second event of zone a should be declined")
+	}
+	if b.limitersMap.getOrInsert("static").When() > 0 {
+		t.Fatal("first event of zone b should be allowed")
+	}
+
+	var swept int
+	rl.forEachZone(func(*RateLimit) { swept++ })
+	if swept != 2 {
+		t.Fatalf("expected to visit 2 zones, visited %d", swept)
+	}
+}
+
+func TestMaxZones(t *testing.T) {
+	initTime()
+
+	rl := &RateLimit{
+		ZoneName:  "api_{http.request.header.X-API-Key}",
+		Key:       "static",
+		MaxEvents: 1,
+		Window:    caddy.Duration(time.Minute),
+		MaxZones:  2,
+	}
+	if err := rl.provision(caddy.Context{}, rl.ZoneName); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	t.Cleanup(func() {
+		rl.forEachZone(func(zone *RateLimit) {
+			rateLimits.Delete(zone.ZoneName)
+		})
+	})
+	resolve := func(apiKey string) *RateLimit {
+		repl := caddy.NewReplacer()
+		repl.Set("http.request.header.X-API-Key", apiKey)
+		return rl.resolve(repl)
+	}
+
+	a, b := resolve("a"), resolve("b")
+	if a.ZoneName != "api_a" || b.ZoneName != "api_b" {
+		t.Fatalf("unexpected zone names %q and %q", a.ZoneName, b.ZoneName)
+	}
+
+	// values beyond the cap share one zone
+	c, d := resolve("c"), resolve("d")
+	if c != d || c.ZoneName != "api___other__" {
+		t.Fatalf("expected further values to share the overflow zone, got %q and %q", c.ZoneName, d.ZoneName)
+	}
+	if resolve("a") != a {
+		t.Fatal("expected existing zones to be kept")
+	}
+	var zones int
+	rl.forEachZone(func(*RateLimit) { zones++ })
+	if zones != 3 {
+		t.Fatalf("expected 2 zones and the overflow zone, got %d", zones)
+	}
+
+	static := &RateLimit{ZoneName: "static_zone", Key: "static", MaxEvents: 1, Window: caddy.Duration(time.Minute), MaxZones: 2}
+	if err := static.provision(caddy.Context{}, static.ZoneName); err == nil {
+		t.Error("expected an error for max_zones without placeholders")
+	}
+}
@@ -0,0 +1,54 @@
+package caddyrl
+
+// Names of the events emitted through Caddy's events app. Every event
+// carries the zone name, the key and, where a request is involved, the
+// client's remote IP in its data.
+const (
+	// Emitted when a request is declined because its key exceeded
+	// the zone's rate limit or is banned.
+	eventDeny = "rate_limit.deny"
+
+	// Emitted when a key is placed into the penalty box.
+	eventBan = "rate_limit.ban"
+
+	// Emitted when a key leaves the penalty box, either because its
+	// ban expired or because it was lifted.
+	eventUnban = "rate_limit.unban"
+
+	// Emitted when a request is allowed but leaves its key at or above
+	// the zone's near_limit utilization threshold.
+	eventNearLimit = "rate_limit.near_limit"
+
+	// Emitted when a key makes sharply more requests in an interval
+	// than the zone's learned baseline.
+	eventAnomaly = "rate_limit.anomaly"
+
+	// Emitted when a key repeats the same request in a tight retry
+	// loop, right before it is banned.
+	eventRetryStorm = "rate_limit.retry_storm"
+
+	// Emitted when a zone's cap on new keys is reached, with the first
+	// new key that is declined, after new keys were admitted.
+	eventNewKeyFlood = "rate_limit.new_key_flood"
+)
+
+// emitEvent emits an event through Caddy's events app so that other
+// modules (exec, webhooks, notifications...) can react to it.
+func (h *Handler) emitEvent(name string, data map[string]any) {
+	if h.events != nil {
+		h.events.Emit(h.ctx, name, data)
+	}
+	if h.Webhook != nil {
+		h.Webhook.observe(name, data)
+	}
+	if h.BanHook != nil {
+		h.BanHook.observe(name, data)
+	}
+	if h.BanPersistence != nil {
+		h.BanPersistence.observe(name, data)
+	}
+	eventStream.publish(name, data)
+	if name == eventDeny {
+		recentDeclines.add(data)
+	}
+}
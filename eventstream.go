@@ -0,0 +1,146 @@
+package caddyrl
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// adminEventsPath is the admin endpoint that streams events.
+const adminEventsPath = "/rate_limit/events"
+
+// eventStreamBuffer is the number of events that a subscriber may fall
+// behind by before further events are dropped for it.
+const eventStreamBuffer = 256
+
+// eventStreamKeepAlive is how often an idle stream sends a comment, so
+// that proxies and clients don't close it.
+const eventStreamKeepAlive = 15 * time.Second
+
+// streamedEvent is an event as it is sent to subscribers of the stream.
+type streamedEvent struct {
+	Name string         `json:"event"`
+	Time time.Time      `json:"time"`
+	Data map[string]any `json:"data"`
+}
+
+// eventBroker fans events out to the subscribers of the admin API's
+// event stream. Slow subscribers miss events rather than hold up
+// requests.
+type eventBroker struct {
+	mu          sync.Mutex
+	subscribers map[chan streamedEvent]struct{}
+	count       atomic.Int64
+}
+
+// eventStream is the broker of the events of all handlers.
+var eventStream = &eventBroker{subscribers: make(map[chan streamedEvent]struct{})}
+
+// publish sends an event to all subscribers, without blocking.
+func (b *eventBroker) publish(name string, data map[string]any) {
+	if b.count.Load() == 0 {
+		return
+	}
+	e := streamedEvent{Name: name, Time: now(), Data: make(map[string]any, len(data))}
+	for k, v := range data {
+		// durations are more readable as strings than as nanoseconds
+		if d, ok := v.(time.Duration); ok {
+			v = d.String()
+		}
+		e.Data[k] = v
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+func (b *eventBroker) subscribe() chan streamedEvent {
+	ch := make(chan streamedEvent, eventStreamBuffer)
+	b.mu.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.mu.Unlock()
+	b.count.Add(1)
+	return ch
+}
+
+func (b *eventBroker) unsubscribe(ch chan streamedEvent) {
+	b.mu.Lock()
+	delete(b.subscribers, ch)
+	b.mu.Unlock()
+	b.count.Add(-1)
+}
+
+// handleEventStream streams events as server-sent events until the
+// client disconnects. The `zone` and `event` query parameters, which may
+// be repeated, restrict the stream to events of those zones and names;
+// event names may omit the `rate_limit.` prefix.
+func handleEventStream(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	zones := r.URL.Query()["zone"]
+	var names []string
+	for _, name := range r.URL.Query()["event"] {
+		if !strings.HasPrefix(name, "rate_limit.") {
+			name = "rate_limit." + name
+		}
+		names = append(names, name)
+	}
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return fmt.Errorf("streaming events: %v", err)
+	}
+
+	ch := eventStream.subscribe()
+	defer eventStream.unsubscribe(ch)
+	keepAlive := time.NewTicker(eventStreamKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case e := <-ch:
+			if len(names) > 0 && !slices.Contains(names, e.Name) {
+				continue
+			}
+			if zone, _ := e.Data["zone"].(string); len(zones) > 0 && !slices.Contains(zones, zone) {
+				continue
+			}
+			encoded, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Name, encoded); err != nil {
+				return nil
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return nil
+			}
+		case <-r.Context().Done():
+			return nil
+		}
+		if err := rc.Flush(); err != nil {
+			return nil
+		}
+	}
+}
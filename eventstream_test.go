@@ -0,0 +1,60 @@
+package caddyrl
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventStream(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := handleEventStream(w, r); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + adminEventsPath + "?zone=stream_zone&event=deny&event=rate_limit.ban")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("unexpected content type %s", resp.Header.Get("Content-Type"))
+	}
+
+	// the subscription starts once the response headers are sent
+	deadline := time.Now().Add(5 * time.Second)
+	for eventStream.count.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	eventStream.publish(eventNearLimit, map[string]any{"zone": "stream_zone", "key": "filtered"})
+	eventStream.publish(eventDeny, map[string]any{"zone": "other_zone", "key": "filtered"})
+	eventStream.publish(eventDeny, map[string]any{"zone": "stream_zone", "key": "abuser", "wait": 1500 * time.Millisecond})
+
+	reader := bufio.NewReader(resp.Body)
+	var lines []string
+	for len(lines) < 2 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if lines[0] != "event: "+eventDeny {
+		t.Fatalf("unexpected event line %q", lines[0])
+	}
+	var e streamedEvent
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(lines[1], "data: ")), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Name != eventDeny || e.Data["key"] != "abuser" || e.Data["wait"] != "1.5s" {
+		t.Errorf("unexpected event %+v", e)
+	}
+}
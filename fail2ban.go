@@ -0,0 +1,62 @@
+package caddyrl
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Fail2BanLog writes a line to a file for every declined request, in a
+// format that is trivially parsed by fail2ban, so that host-level bans
+// can be layered on top of HTTP rate limiting. Each line looks like:
+//
+//	2006-01-02T15:04:05Z rate_limit declined client=192.0.2.1 zone=login
+//
+// A matching fail2ban filter is:
+//
+//	failregex = ^\S+ rate_limit declined client=<HOST> zone=\S+$
+type Fail2BanLog struct {
+	// Path of the file to append lines to. Required.
+	Path string `json:"path,omitempty"`
+
+	file *os.File
+}
+
+func (fl *Fail2BanLog) provision() error {
+	if fl.Path == "" {
+		return fmt.Errorf("path is required")
+	}
+	file, err := os.OpenFile(fl.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	fl.file = file
+	return nil
+}
+
+// log appends a line for a declined request. Lines are written with a
+// single call, so entries of concurrent requests are not interleaved.
+func (fl *Fail2BanLog) log(remoteIP, zoneName string) error {
+	line := fmt.Sprintf("%s rate_limit declined client=%s zone=%s\n",
+		now().UTC().Format(time.RFC3339), remoteIP, fail2banField(zoneName))
+	_, err := fl.file.WriteString(line)
+	return err
+}
+
+func (fl *Fail2BanLog) close() error {
+	if fl.file == nil {
+		return nil
+	}
+	return fl.file.Close()
+}
+
+// fail2banField makes s safe to use as a single whitespace-delimited field.
+func fail2banField(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\n' || r == '\r' {
+			return '_'
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,38 @@
+package caddyrl
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+func TestFail2BanLog(t *testing.T) {
+	initTime()
+
+	fl := &Fail2BanLog{Path: filepath.Join(t.TempDir(), "declines.log")}
+	if err := fl.provision(); err != nil {
+		t.Fatalf("provisioning fail2ban log: %v", err)
+	}
+	if err := fl.log("192.0.2.1", "login zone"); err != nil {
+		t.Fatalf("writing line: %v", err)
+	}
+	if err := fl.log("2001:db8::1", "api"); err != nil {
+		t.Fatalf("writing line: %v", err)
+	}
+	if err := fl.close(); err != nil {
+		t.Fatalf("closing log: %v", err)
+	}
+
+	contents, err := os.ReadFile(fl.Path)
+	if err != nil {
+		t.Fatalf("reading log: %v", err)
+	}
+
+	// the failregex from the docs, with <HOST> expanded to a simple address pattern
+	failregex := regexp.MustCompile(`(?m)^\S+ rate_limit declined client=([0-9a-f.:]+) zone=\S+$`)
+	matches := failregex.FindAllStringSubmatch(string(contents), -1)
+	if len(matches) != 2 || matches[0][1] != "192.0.2.1" || matches[1][1] != "2001:db8::1" {
+		t.Fatalf("unexpected log contents:\n%s", contents)
+	}
+}
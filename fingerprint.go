@@ -0,0 +1,460 @@
+package caddyrl
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func init() {
+	caddy.RegisterModule(FingerprintListenerWrapper{})
+}
+
+// FingerprintListenerWrapper is a listener wrapper that fingerprints the
+// TLS ClientHello of each connection, so that rate limit keys can use
+// the client's JA3 and JA4 fingerprints through the
+// `{http.rate_limit.tls.ja3}` and `{http.rate_limit.tls.ja4}`
+// placeholders. Fingerprints identify the TLS stack of a client, which
+// survives the IP rotation of scrapers far better than IP addresses do.
+//
+// It must be placed before the `tls` listener wrapper, so that it reads
+// the ClientHello before the TLS handshake. Connections without a TLS
+// ClientHello (e.g. HTTP/3 or plain HTTP) have empty fingerprints.
+type FingerprintListenerWrapper struct{}
+
+// CaddyModule returns the Caddy module information.
+func (FingerprintListenerWrapper) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "caddy.listeners.tls_fingerprint",
+		New: func() caddy.Module { return new(FingerprintListenerWrapper) },
+	}
+}
+
+// WrapListener wraps l so that the ClientHello of its connections is
+// fingerprinted.
+func (FingerprintListenerWrapper) WrapListener(l net.Listener) net.Listener {
+	fingerprintListeners.Add(1)
+	return &fingerprintListener{Listener: l}
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler. Syntax:
+//
+//	tls_fingerprint
+func (*FingerprintListenerWrapper) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume wrapper name
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+// fingerprintListener fingerprints the connections that it accepts.
+type fingerprintListener struct {
+	net.Listener
+	closed atomic.Bool
+}
+
+func (l *fingerprintListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &fingerprintConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+func (l *fingerprintListener) Close() error {
+	if l.closed.CompareAndSwap(false, true) {
+		fingerprintListeners.Add(-1)
+	}
+	return l.Listener.Close()
+}
+
+// fingerprintConn fingerprints the ClientHello that it reads first. The
+// ClientHello is read when the TLS handshake reads from the connection,
+// not when it is accepted, so that slow clients don't hold up the
+// listener.
+type fingerprintConn struct {
+	net.Conn
+	reader *bufio.Reader
+	once   sync.Once
+}
+
+func (c *fingerprintConn) Read(p []byte) (int, error) {
+	c.once.Do(func() {
+		if fp, ok := c.fingerprint(); ok {
+			fingerprints.Store(c.RemoteAddr().String(), fp)
+		}
+	})
+	return c.reader.Read(p)
+}
+
+func (c *fingerprintConn) Close() error {
+	fingerprints.Delete(c.RemoteAddr().String())
+	return c.Conn.Close()
+}
+
+// fingerprint peeks at the first TLS record of the connection and
+// fingerprints the ClientHello in it.
+func (c *fingerprintConn) fingerprint() (tlsFingerprint, bool) {
+	header, err := c.reader.Peek(5)
+	if err != nil || header[0] != 0x16 { // handshake record
+		return tlsFingerprint{}, false
+	}
+	length := int(binary.BigEndian.Uint16(header[3:5]))
+	if length > c.reader.Size()-5 {
+		c.reader = bufio.NewReaderSize(c.reader, 5+length)
+	}
+	record, err := c.reader.Peek(5 + length)
+	if err != nil {
+		return tlsFingerprint{}, false
+	}
+	hello, err := parseClientHello(record[5:])
+	if err != nil {
+		return tlsFingerprint{}, false
+	}
+	return tlsFingerprint{ja3: hello.ja3(), ja4: hello.ja4()}, true
+}
+
+var (
+	// fingerprints of the TLS connections of all fingerprint listeners,
+	// keyed by the remote address of the connection
+	fingerprints sync.Map
+
+	// number of open fingerprint listeners, so that requests only look
+	// up fingerprints if there can be any
+	fingerprintListeners atomic.Int64
+)
+
+// tlsFingerprint holds the fingerprints of a TLS ClientHello.
+type tlsFingerprint struct {
+	ja3, ja4 string
+}
+
+// setFingerprintPlaceholders sets the placeholders of the TLS
+// fingerprints of the connection of r, if it has been fingerprinted.
+func setFingerprintPlaceholders(repl *caddy.Replacer, r *http.Request) {
+	if fingerprintListeners.Load() == 0 {
+		return
+	}
+	value, ok := fingerprints.Load(r.RemoteAddr)
+	if !ok {
+		return
+	}
+	fp := value.(tlsFingerprint)
+	repl.Set("http.rate_limit.tls.ja3", fp.ja3)
+	repl.Set("http.rate_limit.tls.ja4", fp.ja4)
+}
+
+// clientHello holds the fields of a TLS ClientHello that fingerprints
+// are made of.
+type clientHello struct {
+	version       uint16
+	ciphers       []uint16
+	extensions    []uint16
+	curves        []uint16
+	pointFormats  []uint8
+	sigAlgs       []uint16
+	alpn          []string
+	serverName    bool
+	supportedVers []uint16
+}
+
+// parseClientHello parses the ClientHello handshake message at the
+// start of b.
+func parseClientHello(b []byte) (*clientHello, error) {
+	p := parser(b)
+	if msgType, ok := p.uint8(); !ok || msgType != 0x01 {
+		return nil, fmt.Errorf("not a client hello")
+	}
+	body, ok := p.bytes24()
+	if !ok {
+		return nil, fmt.Errorf("truncated client hello")
+	}
+	p = body
+
+	var hello clientHello
+	if hello.version, ok = p.uint16(); !ok {
+		return nil, fmt.Errorf("truncated client hello")
+	}
+	if _, ok = p.take(32); !ok { // random
+		return nil, fmt.Errorf("truncated client hello")
+	}
+	if _, ok = p.bytes8(); !ok { // session ID
+		return nil, fmt.Errorf("truncated session id")
+	}
+	ciphers, ok := p.bytes16()
+	if !ok {
+		return nil, fmt.Errorf("truncated cipher suites")
+	}
+	for len(ciphers) > 0 {
+		cipher, ok := ciphers.uint16()
+		if !ok {
+			return nil, fmt.Errorf("truncated cipher suites")
+		}
+		hello.ciphers = append(hello.ciphers, cipher)
+	}
+	if _, ok = p.bytes8(); !ok { // compression methods
+		return nil, fmt.Errorf("truncated compression methods")
+	}
+
+	if len(p) == 0 {
+		return &hello, nil // no extensions
+	}
+	extensions, ok := p.bytes16()
+	if !ok {
+		return nil, fmt.Errorf("truncated extensions")
+	}
+	for len(extensions) > 0 {
+		extType, ok := extensions.uint16()
+		if !ok {
+			return nil, fmt.Errorf("truncated extension")
+		}
+		data, ok := extensions.bytes16()
+		if !ok {
+			return nil, fmt.Errorf("truncated extension")
+		}
+		hello.extensions = append(hello.extensions, extType)
+
+		switch extType {
+		case 0x0000: // server_name
+			hello.serverName = true
+		case 0x000a: // supported_groups
+			list, _ := data.bytes16()
+			for len(list) > 0 {
+				curve, _ := list.uint16()
+				hello.curves = append(hello.curves, curve)
+			}
+		case 0x000b: // ec_point_formats
+			list, _ := data.bytes8()
+			hello.pointFormats = append(hello.pointFormats, list...)
+		case 0x000d: // signature_algorithms
+			list, _ := data.bytes16()
+			for len(list) > 0 {
+				sigAlg, _ := list.uint16()
+				hello.sigAlgs = append(hello.sigAlgs, sigAlg)
+			}
+		case 0x0010: // application_layer_protocol_negotiation
+			list, _ := data.bytes16()
+			for len(list) > 0 {
+				proto, ok := list.bytes8()
+				if !ok {
+					break
+				}
+				hello.alpn = append(hello.alpn, string(proto))
+			}
+		case 0x002b: // supported_versions
+			list, _ := data.bytes8()
+			for len(list) > 0 {
+				version, ok := list.uint16()
+				if !ok {
+					break
+				}
+				hello.supportedVers = append(hello.supportedVers, version)
+			}
+		}
+	}
+	return &hello, nil
+}
+
+// isGREASE returns true for the reserved GREASE values (RFC 8701) that
+// clients send to keep servers tolerant, which fingerprints ignore.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// withoutGREASE returns vs without GREASE values.
+func withoutGREASE(vs []uint16) []uint16 {
+	out := make([]uint16, 0, len(vs))
+	for _, v := range vs {
+		if !isGREASE(v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// ja3 returns the JA3 fingerprint of the ClientHello: the MD5 hash of
+// its version, ciphers, extensions, curves and point formats.
+func (h *clientHello) ja3() string {
+	join := func(vs []uint16) string {
+		parts := make([]string, len(vs))
+		for i, v := range vs {
+			parts[i] = strconv.Itoa(int(v))
+		}
+		return strings.Join(parts, "-")
+	}
+	pointFormats := make([]string, len(h.pointFormats))
+	for i, v := range h.pointFormats {
+		pointFormats[i] = strconv.Itoa(int(v))
+	}
+	s := strings.Join([]string{
+		strconv.Itoa(int(h.version)),
+		join(withoutGREASE(h.ciphers)),
+		join(withoutGREASE(h.extensions)),
+		join(withoutGREASE(h.curves)),
+		strings.Join(pointFormats, "-"),
+	}, ",")
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// ja4 returns the JA4 fingerprint of the ClientHello, received over TCP.
+func (h *clientHello) ja4() string {
+	version := h.version
+	if versions := withoutGREASE(h.supportedVers); len(versions) > 0 {
+		version = slices.Max(versions)
+	}
+	var versionCode string
+	switch version {
+	case 0x0304:
+		versionCode = "13"
+	case 0x0303:
+		versionCode = "12"
+	case 0x0302:
+		versionCode = "11"
+	case 0x0301:
+		versionCode = "10"
+	case 0x0300:
+		versionCode = "s3"
+	default:
+		versionCode = "00"
+	}
+
+	sni := "i"
+	if h.serverName {
+		sni = "d"
+	}
+
+	ciphers := withoutGREASE(h.ciphers)
+	extensions := withoutGREASE(h.extensions)
+
+	alpn := "00"
+	if len(h.alpn) > 0 && h.alpn[0] != "" {
+		first, last := h.alpn[0][0], h.alpn[0][len(h.alpn[0])-1]
+		if isAlphanumeric(first) && isAlphanumeric(last) {
+			alpn = string([]byte{first, last})
+		} else {
+			alpn = hex.EncodeToString([]byte{first})[:1] + hex.EncodeToString([]byte{last})[1:]
+		}
+	}
+
+	// extensions are hashed without SNI and ALPN, which the first part
+	// already covers
+	var hashedExtensions []uint16
+	for _, ext := range extensions {
+		if ext != 0x0000 && ext != 0x0010 {
+			hashedExtensions = append(hashedExtensions, ext)
+		}
+	}
+	extensionsPart := hexList(slices.Sorted(slices.Values(hashedExtensions)))
+	if len(h.sigAlgs) > 0 {
+		extensionsPart += "_" + hexList(h.sigAlgs)
+	}
+
+	return fmt.Sprintf("t%s%s%02d%02d%s_%s_%s",
+		versionCode, sni, min(len(ciphers), 99), min(len(extensions), 99), alpn,
+		truncatedHash(hexList(slices.Sorted(slices.Values(ciphers)))),
+		truncatedHash(extensionsPart))
+}
+
+// hexList returns vs as comma-separated 4-digit hex numbers.
+func hexList(vs []uint16) string {
+	parts := make([]string, len(vs))
+	for i, v := range vs {
+		parts[i] = fmt.Sprintf("%04x", v)
+	}
+	return strings.Join(parts, ",")
+}
+
+// truncatedHash returns the first 12 hex digits of the SHA-256 hash of
+// s, or zeros if s is empty.
+func truncatedHash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func isAlphanumeric(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// parser reads the fields of TLS messages from the bytes it holds.
+type parser []byte
+
+func (p *parser) uint8() (uint8, bool) {
+	if len(*p) < 1 {
+		return 0, false
+	}
+	v := (*p)[0]
+	*p = (*p)[1:]
+	return v, true
+}
+
+func (p *parser) uint16() (uint16, bool) {
+	if len(*p) < 2 {
+		*p = nil
+		return 0, false
+	}
+	v := binary.BigEndian.Uint16(*p)
+	*p = (*p)[2:]
+	return v, true
+}
+
+// take returns the next n bytes.
+func (p *parser) take(n int) (parser, bool) {
+	if len(*p) < n {
+		*p = nil
+		return nil, false
+	}
+	v := (*p)[:n]
+	*p = (*p)[n:]
+	return v, true
+}
+
+// bytes8, bytes16 and bytes24 return the next bytes, prefixed by their
+// length in 1, 2 or 3 bytes.
+func (p *parser) bytes8() (parser, bool) {
+	n, ok := p.uint8()
+	if !ok {
+		return nil, false
+	}
+	return p.take(int(n))
+}
+
+func (p *parser) bytes16() (parser, bool) {
+	n, ok := p.uint16()
+	if !ok {
+		return nil, false
+	}
+	return p.take(int(n))
+}
+
+func (p *parser) bytes24() (parser, bool) {
+	if len(*p) < 3 {
+		return nil, false
+	}
+	n := int((*p)[0])<<16 | int((*p)[1])<<8 | int((*p)[2])
+	*p = (*p)[3:]
+	return p.take(n)
+}
+
+// Interface guards
+var (
+	_ caddy.ListenerWrapper = (*FingerprintListenerWrapper)(nil)
+	_ caddyfile.Unmarshaler = (*FingerprintListenerWrapper)(nil)
+)
@@ -0,0 +1,68 @@
+package caddyrl
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"regexp"
+	"testing"
+)
+
+func TestTLSFingerprint(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		// the handshake fails once the server closes the pipe
+		_ = tls.Client(client, &tls.Config{
+			ServerName: "example.com",
+			NextProtos: []string{"h2", "http/1.1"},
+		}).Handshake()
+	}()
+
+	conn := &fingerprintConn{Conn: server, reader: bufio.NewReader(server)}
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	value, ok := fingerprints.Load(server.RemoteAddr().String())
+	if !ok {
+		t.Fatal("expected the connection to be fingerprinted")
+	}
+	fp := value.(tlsFingerprint)
+	if !regexp.MustCompile(`^[0-9a-f]{32}$`).MatchString(fp.ja3) {
+		t.Errorf("expected an MD5 hash as JA3 fingerprint, got '%s'", fp.ja3)
+	}
+	// TLS 1.3 with SNI and ALPN h2
+	if !regexp.MustCompile(`^t13d\d{4}h2_[0-9a-f]{12}_[0-9a-f]{12}$`).MatchString(fp.ja4) {
+		t.Errorf("unexpected JA4 fingerprint '%s'", fp.ja4)
+	}
+
+	conn.Close()
+	if _, ok := fingerprints.Load(server.RemoteAddr().String()); ok {
+		t.Error("expected the fingerprint to be forgotten when the connection closes")
+	}
+
+	// GREASE values don't change fingerprints
+	hello := &clientHello{
+		version:      0x0303,
+		ciphers:      []uint16{0x1301, 0xc02b},
+		extensions:   []uint16{0x0000, 0x000a},
+		curves:       []uint16{0x001d},
+		pointFormats: []uint8{0},
+		serverName:   true,
+	}
+	greased := *hello
+	greased.ciphers = []uint16{0x2a2a, 0x1301, 0xc02b}
+	greased.extensions = []uint16{0xfafa, 0x0000, 0x000a}
+	if hello.ja3() != greased.ja3() || hello.ja4() != greased.ja4() {
+		t.Error("expected GREASE values to be ignored")
+	}
+	if expected := "t12d020200_"; hello.ja4()[:len(expected)] != expected {
+		t.Errorf("expected JA4 fingerprint to start with '%s', got '%s'", expected, hello.ja4())
+	}
+
+	for _, b := range [][]byte{nil, {0x02, 0, 0, 0}, {0x01, 0, 0, 4, 3, 3}} {
+		if _, err := parseClientHello(b); err == nil {
+			t.Errorf("expected an error parsing %x", b)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package caddyrl
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func init() {
+	caddy.RegisterModule(GCRA{})
+}
+
+// GCRA limits keys with the generic cell rate algorithm, the equivalent
+// of a token bucket that holds burst events and refills at the zone's
+// rate of max_events per window. Rather than a number of events per
+// window, it enforces an interval between events of window/max_events,
+// exact to the nanosecond, so rates below one event per second or per
+// any other unit, such as 1 event per 2s or 3 per 10s, are enforced as
+// evenly as whole ones, and the wait it returns for a declined event is
+// exactly how long until the bucket has room for it.
+//
+// Each key takes a few dozen bytes regardless of max_events, and is
+// forgotten once its bucket is full again.
+type GCRA struct {
+	// The number of events a key can make at once, after it has been
+	// idle long enough for its bucket to fill. Default: the zone's
+	// max_events
+	Burst int `json:"burst,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (GCRA) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "rate_limit.algorithms.gcra",
+		New: func() caddy.Module { return new(GCRA) },
+	}
+}
+
+// Provision validates the algorithm's config.
+func (g *GCRA) Provision(caddy.Context) error {
+	if g.Burst < 0 {
+		return fmt.Errorf("burst must be at least zero")
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler. Syntax:
+//
+//	algorithm gcra [<burst>]
+func (g *GCRA) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume algorithm name
+	if d.NextArg() {
+		burst, err := strconv.Atoi(d.Val())
+		if err != nil {
+			return d.Errf("invalid burst '%s': %v", d.Val(), err)
+		}
+		g.Burst = burst
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+// NewLimiter implements Algorithm.
+func (g GCRA) NewLimiter(maxEvents int, window time.Duration) Limiter {
+	return &gcraLimiter{burst: g.Burst, maxEvents: maxEvents, window: window}
+}
+
+// gcraLimiter limits one key with the GCRA algorithm; see GCRA.
+type gcraLimiter struct {
+	burst int // as configured, 0 for max_events
+
+	mu        sync.Mutex
+	maxEvents int
+	window    time.Duration
+
+	// the theoretical arrival time: when the key's bucket will be
+	// full again, at which point the limiter is idle
+	tat time.Time
+}
+
+// limitsUnsynced returns the interval between events and the number of
+// events in a full bucket.
+func (l *gcraLimiter) limitsUnsynced() (time.Duration, int) {
+	burst := l.burst
+	if burst == 0 {
+		burst = l.maxEvents
+	}
+	return l.window / time.Duration(l.maxEvents), burst
+}
+
+func (l *gcraLimiter) Allow(ref time.Time, n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxEvents <= 0 {
+		return l.window
+	}
+	interval, burst := l.limitsUnsynced()
+	if n > burst {
+		// more events than ever fit in the bucket
+		return l.window
+	}
+
+	// the events are allowed once the bucket has drained far enough
+	// for them, i.e. the arrival time they lead to is within a full
+	// bucket of ref
+	tat := l.tat
+	if tat.Before(ref) {
+		tat = ref
+	}
+	tat = tat.Add(time.Duration(n) * interval)
+	if allowed := tat.Add(-time.Duration(burst) * interval); allowed.After(ref) {
+		return allowed.Sub(ref)
+	}
+	l.tat = tat
+	return 0
+}
+
+func (l *gcraLimiter) Remaining(ref time.Time) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxEvents <= 0 {
+		return 0
+	}
+	interval, burst := l.limitsUnsynced()
+	if interval <= 0 || !l.tat.After(ref) {
+		return burst
+	}
+	return max(burst-int((l.tat.Sub(ref)+interval-1)/interval), 0)
+}
+
+func (l *gcraLimiter) SetLimits(maxEvents int, window time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.maxEvents, l.window = maxEvents, window
+}
+
+func (l *gcraLimiter) Idle(ref time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return !l.tat.After(ref)
+}
+
+// Interface guards
+var (
+	_ Algorithm             = (*GCRA)(nil)
+	_ caddy.Provisioner     = (*GCRA)(nil)
+	_ caddyfile.Unmarshaler = (*GCRA)(nil)
+)
@@ -0,0 +1,164 @@
+package caddyrl
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+func TestGCRALimiter(t *testing.T) {
+	ref := time.Unix(referenceTime, 0)
+
+	// 0.5 events per second, one at a time
+	limiter := GCRA{}.NewLimiter(1, 2*time.Second)
+	if wait := limiter.Allow(ref, 1); wait != 0 {
+		t.Fatalf("expected the first event to be allowed, got wait %v", wait)
+	}
+	if wait := limiter.Allow(ref.Add(500*time.Millisecond), 1); wait != 1500*time.Millisecond {
+		t.Errorf("expected to wait until 2s after the first event, got %v", wait)
+	}
+	if wait := limiter.Allow(ref.Add(2*time.Second), 1); wait != 0 {
+		t.Errorf("expected an event to be allowed after 2s, got wait %v", wait)
+	}
+	if limiter.Idle(ref.Add(3 * time.Second)) {
+		t.Error("expected the limiter not to be idle before its bucket is full")
+	}
+	if !limiter.Idle(ref.Add(4 * time.Second)) {
+		t.Error("expected the limiter to be idle once its bucket is full")
+	}
+
+	// 3 events per 10s with a burst of 2: the bucket refills one event
+	// every 3.33s
+	limiter = GCRA{Burst: 2}.NewLimiter(3, 10*time.Second)
+	for i := range 2 {
+		if wait := limiter.Allow(ref, 1); wait != 0 {
+			t.Fatalf("expected event %d of the burst to be allowed, got wait %v", i, wait)
+		}
+	}
+	if remaining := limiter.Remaining(ref); remaining != 0 {
+		t.Errorf("expected no remaining events after the burst, got %d", remaining)
+	}
+	if wait := limiter.Allow(ref, 1); wait != 3333333333 {
+		t.Errorf("expected to wait one interval, got %v", wait)
+	}
+	if remaining := limiter.Remaining(ref.Add(4 * time.Second)); remaining != 1 {
+		t.Errorf("expected one event to have refilled, got %d remaining", remaining)
+	}
+	if wait := limiter.Allow(ref, 3); wait != 10*time.Second {
+		t.Errorf("expected more events than the burst to wait a window, got %v", wait)
+	}
+
+	// new limits apply to the next events
+	limiter.SetLimits(0, 10*time.Second)
+	if wait := limiter.Allow(ref.Add(time.Hour), 1); wait == 0 {
+		t.Error("expected a limit of zero to decline all events")
+	}
+}
+
+func TestGCRARetryAfter(t *testing.T) {
+	initTime()
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: t.Context()})
+	defer cancel()
+
+	rl := &RateLimit{
+		ZoneName:     "gcra_zone",
+		Key:          "static",
+		MaxEvents:    1,
+		Window:       caddy.Duration(2 * time.Second),
+		AlgorithmRaw: json.RawMessage(`{"name": "gcra"}`),
+	}
+	if err := rl.provision(ctx, rl.ZoneName); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _, _ = rateLimits.Delete(rl.ZoneName) })
+
+	h := Handler{
+		rateLimits: []*RateLimit{rl},
+		metrics:    newMetricsCollector(false, &RateLimitApp{}),
+		logger:     zap.NewNop(),
+	}
+	serve := func() (*httptest.ResponseRecorder, error) {
+		req := newTestRequest("GET", "/report", nil)
+		rec := httptest.NewRecorder()
+		next := caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error { return nil })
+		return rec, h.ServeHTTP(rec, req, next)
+	}
+
+	if _, err := serve(); err != nil {
+		t.Fatalf("expected the first request to be allowed, got %v", err)
+	}
+
+	// 1.5s are left of the interval, which clients must not retry
+	// before
+	now = func() time.Time { return time.Unix(referenceTime, int64(500*time.Millisecond)) }
+	rec, err := serve()
+	if !isDeclined(err) {
+		t.Fatalf("expected the second request to be declined, got %v", err)
+	}
+	if retryAfter := rec.Header().Get("Retry-After"); retryAfter != "2" {
+		t.Errorf("expected a Retry-After of 2, got %s", retryAfter)
+	}
+
+	advanceTime(2)
+	if _, err := serve(); err != nil {
+		t.Errorf("expected a request to be allowed after the interval, got %v", err)
+	}
+}
+
+func TestCaddyfileGCRA(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`
+	rate_limit {
+		zone reports {
+			key    {http.vars.client_ip}
+			window 2s
+			events 1
+			algorithm gcra 3
+		}
+	}`)
+
+	var h Handler
+	if err := h.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshaling Caddyfile: %v", err)
+	}
+	var config struct {
+		Name  string `json:"name"`
+		Burst int    `json:"burst"`
+	}
+	if err := json.Unmarshal(h.RateLimits[0].AlgorithmRaw, &config); err != nil {
+		t.Fatal(err)
+	}
+	if config.Name != "gcra" || config.Burst != 3 {
+		t.Errorf("unexpected algorithm config: %+v", config)
+	}
+
+	for _, input := range []string{
+		`rate_limit {
+			zone z {
+				key static
+				window 1m
+				events 5
+				algorithm gcra many
+			}
+		}`,
+		`rate_limit {
+			zone z {
+				key static
+				window 1m
+				events 5
+				algorithm gcra 3 4
+			}
+		}`,
+	} {
+		var h Handler
+		if err := h.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err == nil {
+			t.Errorf("expected error for input: %s", input)
+		}
+	}
+}
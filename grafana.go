@@ -0,0 +1,277 @@
+package caddyrl
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+)
+
+func cmdDashboards(fl caddycmd.Flags) (int, error) {
+	configFlag := fl.String("config")
+	configAdapterFlag := fl.String("adapter")
+	outputFlag := fl.String("output")
+	declineRatioFlag := fl.Float64("decline-ratio")
+
+	if configFlag == "" {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("--config is required")
+	}
+	if declineRatioFlag <= 0 || declineRatioFlag > 1 {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("--decline-ratio must be greater than 0 and at most 1")
+	}
+	config, _, _, err := caddycmd.LoadConfig(configFlag, configAdapterFlag)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	zones, err := findZoneConfigs(config)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	if len(zones) == 0 {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("no zones in config")
+	}
+
+	if err := os.MkdirAll(outputFlag, 0o755); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	dashboard, err := json.MarshalIndent(grafanaDashboard(zones), "", "  ")
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	dashboardFile := filepath.Join(outputFlag, "rate-limit-dashboard.json")
+	if err := os.WriteFile(dashboardFile, append(dashboard, '\n'), 0o644); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	var rules strings.Builder
+	if err := writeAlertRules(&rules, alertRules(zones, declineRatioFlag)); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	rulesFile := filepath.Join(outputFlag, "rate-limit-alerts.yml")
+	if err := os.WriteFile(rulesFile, []byte(rules.String()), 0o644); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	fmt.Printf("Wrote %s and %s for %d zones\n", dashboardFile, rulesFile, len(zones))
+	return caddy.ExitCodeSuccess, nil
+}
+
+// metricName returns the full name of the module's metric with the
+// given name, as Prometheus scrapes it.
+func metricName(name string) string {
+	return "caddy_rate_limit_" + name
+}
+
+// zonePlaceholder matches the placeholders of zone names.
+var zonePlaceholder = regexp.MustCompile(`\{[^{}]*\}`)
+
+// zoneSelector returns the PromQL label matcher of the zone's metrics.
+// Zones whose names have placeholders are named after their values, so
+// their metrics are matched with a regular expression in which each
+// placeholder matches any value.
+func zoneSelector(zoneName string) string {
+	if !zonePlaceholder.MatchString(zoneName) {
+		return "zone=" + strconv.Quote(zoneName)
+	}
+	var re strings.Builder
+	last := 0
+	for _, loc := range zonePlaceholder.FindAllStringIndex(zoneName, -1) {
+		re.WriteString(regexp.QuoteMeta(zoneName[last:loc[0]]))
+		re.WriteString(".+")
+		last = loc[1]
+	}
+	re.WriteString(regexp.QuoteMeta(zoneName[last:]))
+	return "zone=~" + strconv.Quote(re.String())
+}
+
+// zoneLimitText describes the limits of a zone, e.g. "100 per 1m0s".
+func zoneLimitText(rl *RateLimit) string {
+	text := fmt.Sprintf("%d per %s", rl.MaxEvents, time.Duration(rl.Window))
+	if rl.TotalMaxEvents > 0 {
+		text += fmt.Sprintf(", %d in total", rl.TotalMaxEvents)
+	}
+	if rl.MaxKeys > 0 {
+		text += fmt.Sprintf(", at most %d keys", rl.MaxKeys)
+	}
+	return text
+}
+
+// grafanaDashboard returns a Grafana dashboard of the given zones: an
+// overview of all zones, and a row per zone with its requests and
+// declines, decline ratio, keys and utilization. Its Prometheus data
+// source is chosen when it is imported.
+func grafanaDashboard(zones []*RateLimit) map[string]any {
+	datasource := map[string]any{"type": "prometheus", "uid": "${datasource}"}
+	var panels []map[string]any
+	nextID := 1
+	y := 0
+	panel := func(title, kind string, x, w, h int, unit string, targets ...[2]string) map[string]any {
+		p := map[string]any{
+			"id":         nextID,
+			"title":      title,
+			"type":       kind,
+			"datasource": datasource,
+			"gridPos":    map[string]int{"x": x, "y": y, "w": w, "h": h},
+			"fieldConfig": map[string]any{
+				"defaults":  map[string]any{"unit": unit},
+				"overrides": []any{},
+			},
+		}
+		var ts []map[string]any
+		for i, target := range targets {
+			ts = append(ts, map[string]any{
+				"refId":        string(rune('A' + i)),
+				"datasource":   datasource,
+				"expr":         target[0],
+				"legendFormat": target[1],
+			})
+		}
+		p["targets"] = ts
+		nextID++
+		return p
+	}
+	row := func(title string) {
+		panels = append(panels, map[string]any{
+			"id":        nextID,
+			"title":     title,
+			"type":      "row",
+			"collapsed": false,
+			"gridPos":   map[string]int{"x": 0, "y": y, "w": 24, "h": 1},
+			"panels":    []any{},
+		})
+		nextID++
+		y++
+	}
+
+	row("All zones")
+	panels = append(panels,
+		panel("Declined requests by zone", "timeseries", 0, 12, 8, "reqps",
+			[2]string{"sum by (zone) (rate(" + metricName("declined_requests_total") + "[$__rate_interval]))", "{{zone}}"}),
+		panel("Processing time (p99) by zone", "timeseries", 12, 12, 8, "s",
+			[2]string{"histogram_quantile(0.99, sum by (zone, le) (rate(" + metricName("process_time_seconds_bucket") + "[$__rate_interval])))", "{{zone}}"}),
+	)
+	y += 8
+
+	for _, rl := range zones {
+		sel := "{" + zoneSelector(rl.ZoneName) + "}"
+		requests := "sum(rate(" + metricName("requests_total") + sel + "[$__rate_interval]))"
+		declined := "sum(rate(" + metricName("declined_requests_total") + sel + "[$__rate_interval]))"
+
+		row(rl.ZoneName + ": " + zoneLimitText(rl))
+		panels = append(panels,
+			panel("Requests", "timeseries", 0, 9, 8, "reqps",
+				[2]string{requests, "requests"},
+				[2]string{declined, "declined"}),
+			panel("Decline ratio", "stat", 9, 5, 8, "percentunit",
+				[2]string{declined + " / " + requests, "declined"}),
+			panel("Keys", "timeseries", 14, 5, 8, "short",
+				[2]string{"sum(" + metricName("keys_total") + sel + ")", "keys"}),
+			panel("Utilization of limits", "timeseries", 19, 5, 8, "percentunit",
+				[2]string{"histogram_quantile(0.5, sum by (le) (rate(" + metricName("utilization_ratio_bucket") + sel + "[$__rate_interval])))", "p50"},
+				[2]string{"histogram_quantile(0.95, sum by (le) (rate(" + metricName("utilization_ratio_bucket") + sel + "[$__rate_interval])))", "p95"}),
+		)
+		y += 8
+	}
+
+	return map[string]any{
+		"title":         "Caddy rate limits",
+		"uid":           "caddy-rate-limit",
+		"tags":          []string{"caddy", "rate-limit"},
+		"schemaVersion": 39,
+		"time":          map[string]string{"from": "now-6h", "to": "now"},
+		"refresh":       "30s",
+		"templating": map[string]any{
+			"list": []any{map[string]any{
+				"name":  "datasource",
+				"label": "Data source",
+				"type":  "datasource",
+				"query": "prometheus",
+			}},
+		},
+		"panels": panels,
+	}
+}
+
+// alertRule is a Prometheus alerting rule.
+type alertRule struct {
+	Alert       string
+	Expr        string
+	For         time.Duration
+	Labels      [][2]string // in order
+	Annotations [][2]string // in order
+}
+
+// alertRules returns the Prometheus alerting rules of the given zones:
+// each zone alerts when it declines more than declineRatio of its
+// requests, and zones with max_keys alert when they keep evicting keys.
+func alertRules(zones []*RateLimit, declineRatio float64) []alertRule {
+	var rules []alertRule
+	for _, rl := range zones {
+		sel := "{" + zoneSelector(rl.ZoneName) + "}"
+		labels := [][2]string{{"severity", "warning"}, {"rate_limit_zone", rl.ZoneName}}
+		rules = append(rules, alertRule{
+			Alert: "RateLimitDeclineRatioHigh",
+			Expr: fmt.Sprintf("sum(rate(%s%s[5m])) / sum(rate(%s%s[5m])) > %g",
+				metricName("declined_requests_total"), sel, metricName("requests_total"), sel, declineRatio),
+			For:    10 * time.Minute,
+			Labels: labels,
+			Annotations: [][2]string{
+				{"summary", fmt.Sprintf("Zone %s declines more than %.4g%% of its requests", rl.ZoneName, declineRatio*100)},
+				{"description", fmt.Sprintf("The limit of zone %s is %s. A sustained decline ratio means an attack, or a limit that is too low for legitimate traffic.", rl.ZoneName, zoneLimitText(rl))},
+			},
+		})
+		if rl.MaxKeys > 0 {
+			rules = append(rules, alertRule{
+				Alert:  "RateLimitKeysEvicted",
+				Expr:   fmt.Sprintf("sum(rate(%s{%s,reason=%q}[5m])) > 0", metricName("keys_removed_total"), zoneSelector(rl.ZoneName), keyRemovalEvicted),
+				For:    15 * time.Minute,
+				Labels: labels,
+				Annotations: [][2]string{
+					{"summary", fmt.Sprintf("Zone %s keeps evicting keys to stay within %d keys", rl.ZoneName, rl.MaxKeys)},
+					{"description", "Evicted keys start over with no events, so their limits are not enforced; raise max_keys if the zone has that many legitimate keys."},
+				},
+			})
+		}
+	}
+	return rules
+}
+
+// writeAlertRules writes rules as a Prometheus rule file. Strings are
+// quoted like in JSON, which YAML's double-quoted strings accept, but
+// without escaping HTML characters, so that expressions stay readable.
+func writeAlertRules(w io.Writer, rules []alertRule) error {
+	var sb strings.Builder
+	sb.WriteString("# Generated by caddy rate-limit dashboards\n")
+	sb.WriteString("groups:\n")
+	sb.WriteString("  - name: caddy-rate-limit\n")
+	sb.WriteString("    rules:\n")
+	quote := func(s string) string {
+		var quoted strings.Builder
+		enc := json.NewEncoder(&quoted)
+		enc.SetEscapeHTML(false)
+		_ = enc.Encode(s)
+		return strings.TrimSuffix(quoted.String(), "\n")
+	}
+	for _, rule := range rules {
+		fmt.Fprintf(&sb, "      - alert: %s\n", rule.Alert)
+		fmt.Fprintf(&sb, "        expr: %s\n", quote(rule.Expr))
+		fmt.Fprintf(&sb, "        for: %dm\n", int(rule.For.Minutes()))
+		sb.WriteString("        labels:\n")
+		for _, label := range rule.Labels {
+			fmt.Fprintf(&sb, "          %s: %s\n", label[0], quote(label[1]))
+		}
+		sb.WriteString("        annotations:\n")
+		for _, annotation := range rule.Annotations {
+			fmt.Fprintf(&sb, "          %s: %s\n", annotation[0], quote(annotation[1]))
+		}
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
@@ -0,0 +1,88 @@
+package caddyrl
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestDashboards(t *testing.T) {
+	config := `{
+		"apps": {"http": {"servers": {"srv0": {"routes": [{"handle": [
+			{"handler": "rate_limit", "rate_limits": [
+				{"zone_name": "login", "key": "{http.vars.client_ip}", "max_events": 5, "window": "1m"},
+				{"zone_name": "api_{http.request.host}", "key": "{http.request.header.X-Api-Key}", "max_events": 100, "window": "1m", "max_keys": 1000}
+			]}
+		]}]}}}}
+	}`
+	zones, err := findZoneConfigs([]byte(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]string{
+		"login":                    `zone="login"`,
+		"api_{http.request.host}":  `zone=~"api_.+"`,
+		"a.b/{vars.tenant}/{path}": `zone=~"a\\.b/.+/.+"`,
+	} {
+		if got := zoneSelector(name); got != want {
+			t.Errorf("%s: expected selector %s, got %s", name, want, got)
+		}
+	}
+
+	dashboard, err := json.Marshal(grafanaDashboard(zones))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded struct {
+		Panels []struct {
+			ID      int
+			Title   string
+			Type    string
+			Targets []struct{ Expr string }
+		}
+	}
+	if err := json.Unmarshal(dashboard, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	var rows []string
+	ids := make(map[int]bool)
+	for _, panel := range decoded.Panels {
+		if ids[panel.ID] {
+			t.Errorf("duplicate panel ID %d", panel.ID)
+		}
+		ids[panel.ID] = true
+		if panel.Type == "row" {
+			rows = append(rows, panel.Title)
+		}
+	}
+	wantRows := []string{"All zones", "api_{http.request.host}: 100 per 1m0s, at most 1000 keys", "login: 5 per 1m0s"}
+	if strings.Join(rows, "|") != strings.Join(wantRows, "|") {
+		t.Errorf("expected rows %q, got %q", wantRows, rows)
+	}
+	if !strings.Contains(string(dashboard), `caddy_rate_limit_keys_total{zone=\"login\"}`) {
+		t.Error("expected the login zone's keys to be selected by its name")
+	}
+
+	var rules strings.Builder
+	if err := writeAlertRules(&rules, alertRules(zones, 0.1)); err != nil {
+		t.Fatal(err)
+	}
+	out := rules.String()
+	if n := strings.Count(out, "- alert: RateLimitDeclineRatioHigh"); n != 2 {
+		t.Errorf("expected a decline ratio alert per zone, got %d:\n%s", n, out)
+	}
+	if n := strings.Count(out, "- alert: RateLimitKeysEvicted"); n != 1 {
+		t.Errorf("expected an eviction alert for the zone with max_keys only, got %d:\n%s", n, out)
+	}
+	for _, want := range []string{
+		`expr: "sum(rate(caddy_rate_limit_declined_requests_total{zone=\"login\"}[5m])) / sum(rate(caddy_rate_limit_requests_total{zone=\"login\"}[5m])) > 0.1"`,
+		"for: 10m\n",
+		`rate_limit_zone: "login"`,
+		`summary: "Zone login declines more than 10% of its requests"`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected rules to contain %s, got:\n%s", want, out)
+		}
+	}
+}
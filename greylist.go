@@ -0,0 +1,63 @@
+package caddyrl
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// Greylist gives keys that a zone hasn't seen before a much smaller,
+// provisional limit for a while, before they graduate to the zone's
+// full limit. This blunts hit-and-run scrapers, which make all their
+// requests with fresh keys, while established keys are untouched.
+//
+// A key is new when the zone has no state for it, so keys whose state
+// was dropped after they were idle for the window, or for the zone's
+// idle_ttl, are new again.
+type Greylist struct {
+	// The maximum number of events of new keys within the zone's window.
+	// It must be lower than the zone's max_events. Required.
+	MaxEvents int `json:"max_events,omitempty"`
+
+	// How long keys are new. Default: 10m
+	Duration caddy.Duration `json:"duration,omitempty"`
+}
+
+// provision sets the defaults and validates the greylist of a zone
+// that allows maxEvents events per window.
+func (g *Greylist) provision(maxEvents int) error {
+	if g.Duration == 0 {
+		g.Duration = caddy.Duration(10 * time.Minute)
+	}
+	if g.Duration < 0 {
+		return fmt.Errorf("duration must be greater than zero")
+	}
+	if g.MaxEvents < 1 || g.MaxEvents >= maxEvents {
+		return fmt.Errorf("max_events must be at least 1 and lower than the zone's max_events")
+	}
+	return nil
+}
+
+// wait returns how long the key with the given rate limiter has to
+// wait before an event of the given cost fits into its provisional
+// limit, or zero if it fits or the key is no longer new.
+func (g *Greylist) wait(rlm *rateLimitersMap, key string, limiter *ringBufferRateLimiter, cost int) time.Duration {
+	since, ok := rlm.since(key)
+	ref := now()
+	graduation := since.Add(time.Duration(g.Duration))
+	if !ok || !graduation.After(ref) {
+		return 0
+	}
+
+	count, oldest := limiter.Count(ref)
+	if count+cost <= g.MaxEvents {
+		return 0
+	}
+	if count == 0 {
+		// the event doesn't fit even into an empty window
+		return graduation.Sub(ref)
+	}
+	_, window := rlm.limits()
+	return min(oldest.Add(window).Sub(ref), graduation.Sub(ref))
+}
@@ -0,0 +1,51 @@
+package caddyrl
+
+import (
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestGreylist(t *testing.T) {
+	initTime()
+
+	rlm := newRateLimiterMap()
+	rlm.updateAll(10, time.Minute)
+	g := &Greylist{MaxEvents: 2, Duration: caddy.Duration(5 * time.Minute)}
+	if err := g.provision(10); err != nil {
+		t.Fatal(err)
+	}
+
+	// a new key is held to its provisional limit
+	limiter := rlm.getOrInsert("new")
+	for i := range 2 {
+		if dur := g.wait(rlm, "new", limiter, 1); dur != 0 {
+			t.Fatalf("event %d of new key should fit its provisional limit, must wait %s", i, dur)
+		}
+		limiter.When()
+		advanceTime(10 * (i + 1))
+	}
+	if dur := g.wait(rlm, "new", limiter, 1); dur != 40*time.Second {
+		t.Fatalf("expected new key to wait until its oldest event left the window, must wait %s", dur)
+	}
+
+	// events that don't fit even into an empty window wait until the
+	// key graduates
+	if dur := g.wait(rlm, "other", rlm.getOrInsert("other"), 3); dur != 5*time.Minute {
+		t.Fatalf("expected costly event of new key to wait until graduation, must wait %s", dur)
+	}
+
+	// graduated keys get the zone's full limit
+	for i := range 30 {
+		advanceTime(20 + 10*(i+1))
+		limiter.When()
+	}
+	if dur := g.wait(rlm, "new", limiter, 1); dur != 0 {
+		t.Fatalf("graduated key should not wait for the greylist, must wait %s", dur)
+	}
+
+	if err := (&Greylist{MaxEvents: 10}).provision(10); err == nil {
+		t.Error("expected an error for a provisional limit that isn't lower than max_events")
+	}
+}
@@ -0,0 +1,52 @@
+package caddyrl
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// grpcDeclined is the error of declined gRPC requests, whose response
+// headers already carry the gRPC status; the response must be written
+// with an HTTP 200 status, because gRPC clients treat other HTTP status
+// codes as transport errors.
+type grpcDeclined struct{}
+
+func (grpcDeclined) Error() string { return "grpc request declined: resource exhausted" }
+
+// grpcStatusResourceExhausted is the gRPC status code of requests that
+// exceed a rate limit.
+const grpcStatusResourceExhausted = "8"
+
+// isGRPC returns true if r is a gRPC request. gRPC-Web requests, which
+// carry the status in the response body, are not.
+func isGRPC(r *http.Request) bool {
+	contentType := r.Header.Get("Content-Type")
+	return contentType == "application/grpc" ||
+		strings.HasPrefix(contentType, "application/grpc+") ||
+		strings.HasPrefix(contentType, "application/grpc;")
+}
+
+// setGRPCPlaceholders sets the placeholders of the service and method of
+// the gRPC request r, whose path is of the form /<service>/<method>.
+func setGRPCPlaceholders(repl *caddy.Replacer, r *http.Request) {
+	service, method, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if !ok {
+		return
+	}
+	repl.Set("http.rate_limit.grpc_service", service)
+	repl.Set("http.rate_limit.grpc_method", method)
+}
+
+// setGRPCExhausted sets the headers of a trailers-only gRPC response
+// with the RESOURCE_EXHAUSTED status. The client is told to retry after
+// wait, which gRPC clients with retry policies honor.
+func setGRPCExhausted(header http.Header, wait time.Duration) {
+	header.Set("Content-Type", "application/grpc")
+	header.Set("Grpc-Status", grpcStatusResourceExhausted)
+	header.Set("Grpc-Message", "rate limit exceeded")
+	header.Set("Grpc-Retry-Pushback-Ms", strconv.FormatInt(ceilMilliseconds(wait), 10))
+}
@@ -0,0 +1,44 @@
+package caddyrl
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestGRPC(t *testing.T) {
+	for contentType, want := range map[string]bool{
+		"application/grpc":       true,
+		"application/grpc+proto": true,
+		"application/grpc-web":   false,
+		"application/json":       false,
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/helloworld.Greeter/SayHello", nil)
+		r.Header.Set("Content-Type", contentType)
+		if got := isGRPC(r); got != want {
+			t.Errorf("content type %s: expected %v, got %v", contentType, want, got)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/helloworld.Greeter/SayHello", nil)
+	repl := caddy.NewReplacer()
+	setGRPCPlaceholders(repl, r)
+	if service, _ := repl.GetString("http.rate_limit.grpc_service"); service != "helloworld.Greeter" {
+		t.Errorf("unexpected service %q", service)
+	}
+	if method, _ := repl.GetString("http.rate_limit.grpc_method"); method != "SayHello" {
+		t.Errorf("unexpected method %q", method)
+	}
+
+	header := make(http.Header)
+	setGRPCExhausted(header, 1500*time.Millisecond)
+	if header.Get("Grpc-Status") != "8" || header.Get("Grpc-Retry-Pushback-Ms") != "1500" {
+		t.Errorf("unexpected headers %v", header)
+	}
+	if !isDeclined(grpcDeclined{}) {
+		t.Error("declined gRPC requests should count as declined")
+	}
+}
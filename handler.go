@@ -17,11 +17,15 @@ package caddyrl
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	weakrand "math/rand"
 	"net"
 	"net/http"
+	"runtime/pprof"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
@@ -39,10 +43,21 @@ func init() {
 //
 // If a rate limit is exceeded, an HTTP error with status 429 will be
 // returned. This error can be handled using the conventional error
-// handling routes in your config. An additional placeholder is made
-// available, called `{http.rate_limit.exceeded.name}`, which you can
-// use for logging or handling; it contains the name of the rate limit
-// zone which limit was exceeded.
+// handling routes in your config. Additional placeholders are made
+// available, which you can use for logging or handling:
+// `{http.rate_limit.exceeded.name}` contains the name of the rate limit
+// zone which limit was exceeded, and `key`, `limit`, `remaining`,
+// `reset` and `reset_ms` under the same prefix describe the limit.
+//
+// For every zone that a request is evaluated against, the placeholders
+// `{http.rate_limit.<zone>.limit}`, `{http.rate_limit.<zone>.remaining}`
+// and `{http.rate_limit.<zone>.reset}` (seconds until the oldest event
+// in the window expires) are set, so later handlers can refer to the
+// key's budget. In distributed mode, they reflect local events only.
+//
+// The handler emits the `rate_limit.deny`, `rate_limit.ban`,
+// `rate_limit.unban` and `rate_limit.near_limit` events through Caddy's events app, so other
+// modules can react to rate limiting decisions.
 type Handler struct {
 	// RateLimits contains the definitions of the rate limit zones, keyed by name.
 	// The name **MUST** be globally unique across all other instances of this handler.
@@ -51,7 +66,8 @@ type Handler struct {
 	// Percentage jitter on expiration times (example: 0.2 means 20% jitter)
 	Jitter float64 `json:"jitter,omitempty"`
 
-	// How often to scan for expired rate limit states. Default: 1m.
+	// How often to scan for expired rate limit states of zones that
+	// don't set their own sweep interval. Default: 1m.
 	SweepInterval caddy.Duration `json:"sweep_interval,omitempty"`
 
 	// Enables distributed rate limiting. For this to work properly, rate limit
@@ -62,20 +78,110 @@ type Handler struct {
 	Distributed *DistributedRateLimiting `json:"distributed,omitempty"`
 
 	// Storage backend through which rate limit state is synced. If not set,
-	// the global or default storage configuration will be used.
+	// the rate_limit app's storage is used, or else the global or default
+	// storage configuration.
 	StorageRaw json.RawMessage `json:"storage,omitempty" caddy:"namespace=caddy.storage inline_key=module"`
 
+	// A path under which all rate limit state is kept in storage, so that
+	// several clusters, or other applications, can share one storage
+	// backend without their keys colliding. Only instances with the same
+	// storage and namespace are a cluster. If not set, the rate_limit
+	// app's namespace is used. (A database index, such as Redis's, is
+	// selected in the storage module's own configuration.)
+	StorageNamespace string `json:"storage_namespace,omitempty"`
+
+	// Maximum number of requests that a client may have in progress at
+	// once over one connection. HTTP/2 and HTTP/3 multiplex many requests
+	// over a connection, so this mitigates abuse such as rapid resets,
+	// where one connection opens thousands of streams that each pass the
+	// rate limits of the client's IP address. Requests beyond it are
+	// declined before they are limited in the zones. To limit the rate of
+	// requests per connection instead, key a zone on the client's address
+	// and port, `{http.request.remote}`. Default: 0 (no limit)
+	MaxConcurrentPerConnection int `json:"max_concurrent_per_connection,omitempty"`
+
+	// If true, requests that are rarely meant to be limited aren't
+	// limited in any zone: requests for common health-check paths
+	// (`/health`, `/healthz`, `/healthcheck`, `/livez`, `/readyz` and
+	// `/ping`), CORS preflight requests and ACME HTTP-01 challenges.
+	ExemptDefaults bool `json:"exempt_defaults,omitempty"`
+
+	// If true, declined responses don't get the `Cache-Control: no-store`
+	// header, nor a `Vary` header with the request headers that the
+	// zone's key depends on, which keep intermediary caches and CDNs from
+	// serving a declined response to other clients.
+	DisableCacheHeaders bool `json:"disable_cache_headers,omitempty"`
+
+	// The format of the Retry-After header of declined responses:
+	// `seconds` for the number of seconds to wait, or `http_date` for the
+	// time to retry at, since some clients only parse one of them. The
+	// `reset` placeholders are in seconds either way. Default: seconds
+	RetryAfterFormat string `json:"retry_after_format,omitempty"`
+
+	// A placeholder whose value is the tenant of a request, such as
+	// `{http.request.host}` or `{http.request.header.X-Tenant-ID}`, so
+	// that a fleet serving many customers keeps their rate limits apart.
+	// Every zone of the handler then has separate state per tenant, as
+	// if its name started with the tenant: zone `api` of tenant `acme` is
+	// named `acme/api` in placeholders, metrics and the admin API, and
+	// requests without a tenant are limited in `/api`. The app's global
+	// zone is shared by all tenants.
+	Tenant string `json:"tenant,omitempty"`
+
 	// LogKey, if true, will log the key used for rate limiting.
 	// Defaults to `false` because keys can contain sensitive information.
 	LogKey bool `json:"log_key,omitempty"`
 
-	rateLimits []*RateLimit
-	storage    certmagic.Storage
-	random     *weakrand.Rand
-	logger     *zap.Logger
-	ctx        caddy.Context
-	events     *caddyevents.App
-	metrics    *metricsCollector
+	// Sends notifications to a webhook when keys are declined
+	// repeatedly or banned.
+	Webhook *WebhookNotifier `json:"webhook,omitempty"`
+
+	// Runs commands when a ban begins or ends.
+	BanHook *BanExecHook `json:"ban_hook,omitempty"`
+
+	// Keeps bans in storage, so that they survive restarts and are
+	// shared by instances that use the same storage.
+	BanPersistence *BanPersistence `json:"ban_persistence,omitempty"`
+
+	// Writes declined requests to a file that fail2ban can parse.
+	Fail2Ban *Fail2BanLog `json:"fail2ban,omitempty"`
+
+	// Limits the messages that clients send over WebSocket connections
+	// that are upgraded by later handlers.
+	WebSocket *WebSocketLimit `json:"websocket,omitempty"`
+
+	// Classifies requests by their User-Agent, for zones to key on or
+	// match the `{http.rate_limit.user_agent_class}` placeholder.
+	UserAgentClasses *UserAgentClassifier `json:"user_agent_classes,omitempty"`
+
+	// Verifies requests that clients sign with a shared secret, for
+	// zones to give the `{http.rate_limit.tier}` of their keys higher
+	// limits.
+	Signing *RequestSigning `json:"signing,omitempty"`
+
+	// Answers declined browser requests with a challenge page, which
+	// gives clients that pass it higher limits or an exemption.
+	Challenge *Challenge `json:"challenge,omitempty"`
+
+	// Handles 429 responses of later handlers, e.g. of upstreams that
+	// limit requests themselves, coherently with the handler's zones.
+	UpstreamRetryAfter *UpstreamRetryAfter `json:"upstream_retry_after,omitempty"`
+
+	// Exports the events that keys consumed per period, e.g. for
+	// metering and billing.
+	UsageExport *UsageExport `json:"usage_export,omitempty"`
+
+	rateLimits  []*RateLimit
+	global      *RateLimit
+	tenantLabel *keyTemplate
+	connections *connectionRequests
+	coalescer   *coalescer // see RateLimit.Coalesce
+	storage     certmagic.Storage
+	random      *weakrand.Rand
+	logger      *zap.Logger
+	ctx         caddy.Context
+	events      *caddyevents.App
+	metrics     *metricsCollector
 }
 
 // CaddyModule returns the Caddy module information.
@@ -96,12 +202,12 @@ func (h *Handler) Provision(ctx caddy.Context) error {
 
 	httpAppCtx, _ := ctx.App("http")
 	httpApp := httpAppCtx.(*caddyhttp.App)
-	enableMetrics := httpApp.Metrics != nil
+	enableMetrics := httpApp.Metrics != nil || app.Metrics.OTLP != nil
 	h.metrics = newMetricsCollector(enableMetrics, app)
 
 	// Register metrics with Caddy's internal metrics registry
 	if registry := ctx.GetMetricsRegistry(); registry != nil {
-		if err := registerMetrics(registry); err != nil {
+		if err := registerMetrics(registry, app.Metrics.ProcessTimeBuckets); err != nil {
 			h.logger.Warn("failed to register rate limit metrics", zap.Error(err))
 			h.metrics.enabled = false
 		}
@@ -126,9 +232,18 @@ func (h *Handler) Provision(ctx caddy.Context) error {
 			return fmt.Errorf("creating storage value: %v", err)
 		}
 		h.storage = stor
+	} else if app.storage != nil {
+		h.storage = app.storage
 	} else {
 		h.storage = ctx.Storage()
 	}
+	if h.StorageNamespace == "" {
+		h.StorageNamespace = app.StorageNamespace
+	}
+	if err := validateStorageNamespace(h.StorageNamespace); err != nil {
+		return err
+	}
+	h.storage = withNamespace(h.storage, h.StorageNamespace)
 
 	if h.Distributed != nil {
 		// TODO: maybe choose defaults intelligently based on window durations?
@@ -138,37 +253,258 @@ func (h *Handler) Provision(ctx caddy.Context) error {
 		if h.Distributed.WriteInterval == 0 {
 			h.Distributed.WriteInterval = caddy.Duration(5 * time.Second)
 		}
+		if h.Distributed.Jitter < 0 || h.Distributed.Jitter >= 1 {
+			return fmt.Errorf("distributed jitter must be at least 0 and less than 1")
+		}
+		if h.Distributed.DrainReserve < 0 || h.Distributed.DrainReserve >= 1 {
+			return fmt.Errorf("drain_reserve must be at least 0 and less than 1")
+		}
+		switch h.Distributed.Compression {
+		case "":
+			h.Distributed.Compression = compressionNone
+		case compressionNone, compressionGzip:
+		default:
+			return fmt.Errorf("unrecognized compression: %s", h.Distributed.Compression)
+		}
+		if h.Distributed.Timeout < 0 {
+			return fmt.Errorf("distributed timeout must be at least zero")
+		}
+		if h.Distributed.Timeout == 0 {
+			h.Distributed.Timeout = caddy.Duration(5 * time.Second)
+		}
+		switch h.Distributed.Aggregation {
+		case "":
+			h.Distributed.Aggregation = aggregationInstances
+		case aggregationInstances, aggregationLeader:
+		default:
+			return fmt.Errorf("unrecognized aggregation: %s", h.Distributed.Aggregation)
+		}
+		if h.Distributed.MaxClockSkew < 0 {
+			return fmt.Errorf("max_clock_skew must be at least zero")
+		}
+		switch h.Distributed.ClockCorrection {
+		case "":
+			h.Distributed.ClockCorrection = clockCorrectionNone
+		case clockCorrectionNone, clockCorrectionStorage:
+		default:
+			return fmt.Errorf("unrecognized clock correction: %s", h.Distributed.ClockCorrection)
+		}
+		if h.Distributed.Breaker == nil {
+			h.Distributed.Breaker = new(StoreBreaker)
+		}
+		if err := h.Distributed.Breaker.provision(h.logger); err != nil {
+			return fmt.Errorf("setting up storage breaker: %v", err)
+		}
 
-		iid, err := caddy.InstanceID()
-		if err != nil {
-			return err
+		h.Distributed.instanceID = h.Distributed.InstanceID
+		if h.Distributed.instanceID == "" {
+			iid, err := caddy.InstanceID()
+			if err != nil {
+				return err
+			}
+			h.Distributed.instanceID = iid.String()
+		}
+		if strings.ContainsAny(h.Distributed.instanceID, `/\`) {
+			return fmt.Errorf("instance ID must not contain slashes: %s", h.Distributed.instanceID)
 		}
-		h.Distributed.instanceID = iid.String()
+
+		if h.Distributed.Observe && h.Distributed.Ownership != nil {
+			return fmt.Errorf("observers can't own keys")
+		}
+		if h.Distributed.Ownership != nil {
+			if err := h.Distributed.Ownership.provision(h.Distributed.instanceID, app.BackendTLS, app.BackendPool, h.logger); err != nil {
+				return fmt.Errorf("setting up key ownership: %v", err)
+			}
+			if h.Distributed.Ownership.Discovery != nil {
+				go h.Distributed.Ownership.discover(ctx)
+			}
+		}
+
+		// until the first successful sync, staleness is measured from now
+		h.Distributed.lastRead, h.Distributed.lastWrite = now(), now()
 
 		// gather distributed RL states right away so we can properly adjust
 		// our rate limiting decisions to account for other instances
-		err = h.syncDistributedRead(ctx)
+		err = h.recordSync(ctx, "read", h.syncDistributedRead, &h.Distributed.lastRead, &h.Distributed.readFailed)
 		if err != nil {
 			h.logger.Error("gathering initial rate limiter states", zap.Error(err))
 		}
 
 		// keep RL state synced
 		go h.syncDistributed(ctx)
+		clusters.Store(h.Distributed, struct{}{})
+	}
+
+	// metrics are labeled with the tenant, or else the app's grouping
+	if h.Tenant != "" {
+		tenant := newKeyTemplate(h.Tenant)
+		h.tenantLabel = &tenant
+	} else if app.Metrics.Tenant != "" {
+		tenant := newKeyTemplate(app.Metrics.Tenant)
+		h.tenantLabel = &tenant
+	}
+	if h.Tenant != "" {
+		if h.tenantLabel.static {
+			return fmt.Errorf("tenant must contain a placeholder: %s", h.Tenant)
+		}
+		unknown, err := unknownPlaceholders(h.Tenant)
+		if err != nil {
+			return fmt.Errorf("invalid tenant '%s': %v", h.Tenant, err)
+		}
+		if len(unknown) > 0 {
+			h.logger.Warn("tenant has placeholders of unknown namespaces, which are empty unless a plugin provides them",
+				zap.Strings("placeholders", unknown),
+			)
+		}
 	}
 
 	// provision each rate limit and put them in a slice so we can sort them
+	zoneNames := make(map[string]struct{}, len(h.RateLimits))
 	for _, rl := range h.RateLimits {
 		if rl.ZoneName == "" {
 			return fmt.Errorf("zone_name is empty or missing")
 		}
-		err := rl.provision(ctx, rl.ZoneName)
+		if _, ok := zoneNames[rl.ZoneName]; ok {
+			return fmt.Errorf("zone %s is defined more than once; zone names must be unique", rl.ZoneName)
+		}
+		zoneNames[rl.ZoneName] = struct{}{}
+		if rl.Policy != "" {
+			policy, ok := app.Policies[rl.Policy]
+			if !ok {
+				return fmt.Errorf("rate limit %s: unknown policy '%s'", rl.ZoneName, rl.Policy)
+			}
+			rl.inherit(policy)
+		}
+		if app.Defaults.Zone != nil {
+			rl.inherit(app.Defaults.Zone)
+		}
+		if err := rl.applyPreset(); err != nil {
+			return fmt.Errorf("rate limit %s: %v", rl.ZoneName, err)
+		}
+		// zones are checked before provisioning them, since that
+		// changes the limits of zones that other handlers share
+		if err := app.registerZone(rl); err != nil {
+			return err
+		}
+		unknown, err := unknownPlaceholders(rl.Key)
+		if err != nil {
+			return fmt.Errorf("rate limit %s: invalid key '%s': %v", rl.ZoneName, rl.Key, err)
+		}
+		if len(unknown) > 0 {
+			h.logger.Warn("rate limit key has placeholders of unknown namespaces, which are empty unless a plugin provides them",
+				zap.String("zone", rl.ZoneName),
+				zap.Strings("placeholders", unknown),
+			)
+		}
+		if _, err := unknownPlaceholders(rl.ZoneName); err != nil {
+			return fmt.Errorf("rate limit %s: invalid zone name: %v", rl.ZoneName, err)
+		}
+		// each tenant gets its own state of the zone; see resolve
+		name := rl.ZoneName
+		if h.Tenant != "" {
+			name = h.Tenant + "/" + name
+			rl.tenantTemplate = h.tenantLabel
+		}
+		err = rl.provision(ctx, name)
 		if err != nil {
 			return fmt.Errorf("setting up rate limit %s: %v", rl.ZoneName, err)
 		}
+		if rl.Log != nil {
+			rl.Log.logKey = h.LogKey
+		}
+		if h.Distributed != nil && rl.algorithm != nil {
+			return fmt.Errorf("rate limit %s: distributed rate limiting requires the sliding_window algorithm", rl.ZoneName)
+		}
+		if rl.dynamic != nil {
+			rl.dynamic.onNew = h.setUpZone
+		} else {
+			rl.forEachZone(h.setUpZone)
+		}
+		if rl.CircuitBreaker != nil {
+			if err := rl.CircuitBreaker.provision(ctx, h.events, rl, h.logger); err != nil {
+				return fmt.Errorf("setting up circuit breaker of rate limit %s: %v", rl.ZoneName, err)
+			}
+		}
+		if rl.Anomaly != nil {
+			if err := rl.Anomaly.provision(ctx, rl, h.storage, h.logger); err != nil {
+				return fmt.Errorf("setting up anomaly detection of rate limit %s: %v", rl.ZoneName, err)
+			}
+			go rl.Anomaly.run(ctx, h.emitEvent)
+		}
+		if buckets, ok := rl.algorithm.(*Buckets); ok && buckets.PersistInterval > 0 {
+			if rl.dynamic != nil {
+				return fmt.Errorf("rate limit %s: persist_interval requires a zone name without placeholders", rl.ZoneName)
+			}
+			go h.persistBuckets(ctx, rl, time.Duration(buckets.PersistInterval))
+		}
 		h.rateLimits = append(h.rateLimits, rl)
+	}
+
+	if h.UserAgentClasses != nil {
+		if err := h.UserAgentClasses.provision(); err != nil {
+			return fmt.Errorf("setting up user agent classes: %v", err)
+		}
+	}
+
+	if h.Signing != nil {
+		if err := h.Signing.provision(); err != nil {
+			return fmt.Errorf("setting up request signing: %v", err)
+		}
+	}
+
+	if h.Challenge != nil {
+		if err := h.Challenge.provision(h.logger); err != nil {
+			return fmt.Errorf("setting up challenge: %v", err)
+		}
+	}
+
+	if h.WebSocket != nil {
+		if err := h.WebSocket.provision(ctx, app, h); err != nil {
+			return fmt.Errorf("setting up websocket limit: %v", err)
+		}
+	}
+
+	switch h.RetryAfterFormat {
+	case "":
+		h.RetryAfterFormat = retryAfterSeconds
+	case retryAfterSeconds, retryAfterHTTPDate:
+	default:
+		return fmt.Errorf("unknown retry_after_format '%s'", h.RetryAfterFormat)
+	}
+
+	if h.UpstreamRetryAfter != nil {
+		if err := h.UpstreamRetryAfter.provision(); err != nil {
+			return fmt.Errorf("setting up upstream retry-after: %v", err)
+		}
+		h.UpstreamRetryAfter.format = h.RetryAfterFormat
+	}
+
+	// the app's global zone is limited in after the handler's zones
+	if app.Global != nil {
+		app.Global.limitersMap.setEventEmitter(h.emitEvent)
+		h.global = app.Global
+		h.rateLimits = append(h.rateLimits, app.Global)
+	}
+
+	if h.Jitter == 0 {
+		h.Jitter = app.Defaults.Jitter
+	}
+	h.LogKey = h.LogKey || app.Defaults.LogKey
+	if h.SweepInterval == 0 {
+		h.SweepInterval = app.Defaults.SweepInterval
+	}
+
+	if h.MaxConcurrentPerConnection < 0 {
+		return fmt.Errorf("max_concurrent_per_connection must be at least zero")
+	} else if h.MaxConcurrentPerConnection > 0 {
+		h.connections = newConnectionRequests()
+	}
 
-		// Record configuration metrics
-		h.metrics.recordConfig(rl.ZoneName, rl.MaxEvents, time.Duration(rl.Window))
+	for _, rl := range h.rateLimits {
+		if rl.Coalesce {
+			h.coalescer = newCoalescer()
+			break
+		}
 	}
 
 	if h.Jitter < 0 {
@@ -177,102 +513,667 @@ func (h *Handler) Provision(ctx caddy.Context) error {
 		h.random = weakrand.New(weakrand.NewSource(now().UnixNano()))
 	}
 
-	// clean up old rate limiters while handler is running
+	if h.Webhook != nil {
+		if err := h.Webhook.provision(ctx, h.logger); err != nil {
+			return fmt.Errorf("setting up webhook: %v", err)
+		}
+	}
+	if h.Fail2Ban != nil {
+		if err := h.Fail2Ban.provision(); err != nil {
+			return fmt.Errorf("setting up fail2ban log: %v", err)
+		}
+	}
+	if h.BanHook != nil {
+		if err := h.BanHook.provision(ctx, h.logger); err != nil {
+			return fmt.Errorf("setting up ban hook: %v", err)
+		}
+	}
+	if h.BanPersistence != nil {
+		if err := h.BanPersistence.provision(h.storage, h.logger); err != nil {
+			return fmt.Errorf("setting up ban persistence: %v", err)
+		}
+		go h.BanPersistence.run(ctx)
+	}
+	if h.UsageExport != nil {
+		if err := h.UsageExport.provision(h.storage, h.logger); err != nil {
+			return fmt.Errorf("setting up usage export: %v", err)
+		}
+		go h.UsageExport.run(ctx)
+	}
+
+	// clean up old rate limiters while handler is running; zones with
+	// their own sweep interval are swept on their own schedule
 	if h.SweepInterval == 0 {
 		h.SweepInterval = caddy.Duration(1 * time.Minute)
 	}
-	go h.sweepRateLimiters(ctx)
+	zones := h.rateLimits
+	if h.WebSocket != nil {
+		zones = append(zones[:len(zones):len(zones)], h.WebSocket.Zone)
+	}
+	var sharedSweep []*RateLimit
+	for _, rl := range zones {
+		if rl.SweepInterval > 0 {
+			go h.sweepRateLimiters(ctx, time.Duration(rl.SweepInterval), []*RateLimit{rl})
+		} else {
+			sharedSweep = append(sharedSweep, rl)
+		}
+	}
+	go h.sweepRateLimiters(ctx, time.Duration(h.SweepInterval), sharedSweep)
+
+	// switch the limits of zones with schedules as they start and end
+	var scheduled []*RateLimit
+	for _, rl := range zones {
+		if len(rl.Schedules) > 0 {
+			scheduled = append(scheduled, rl)
+		}
+	}
+	if len(scheduled) > 0 {
+		go h.applySchedules(ctx, scheduled)
+	}
 
 	return nil
 }
 
+// setUpZone prepares the handler to limit requests in zone.
+func (h *Handler) setUpZone(zone *RateLimit) {
+	zone.limitersMap.setEventEmitter(h.emitEvent)
+	if len(zone.Schedules) > 0 {
+		h.metrics.updateActiveSchedule(zone.ZoneName, zone.Schedules, zone.schedule)
+	}
+	if zone.MetricsIncludeKey != nil {
+		h.metrics.setZoneIncludeKey(zone.ZoneName, *zone.MetricsIncludeKey)
+	}
+
+	// Record configuration metrics
+	h.metrics.recordConfig(zone.ZoneName, zone.MaxEvents, time.Duration(zone.Window))
+}
+
+// Labels that attribute the module's work in CPU and goroutine profiles.
+// Requests are labeled with the zone they are being limited in, and
+// background goroutines with the task they perform.
+const (
+	profileLabelZone = "rate_limit_zone"
+	profileLabelTask = "rate_limit_task"
+)
+
+// labelTask labels the calling goroutine, and goroutines it starts,
+// with task in profiles.
+func labelTask(ctx context.Context, task string) {
+	pprof.SetGoroutineLabels(pprof.WithLabels(ctx, pprof.Labels(profileLabelTask, task)))
+}
+
 func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	// solutions of challenges are submitted by declined clients, so
+	// they are not limited
+	if h.Challenge != nil && r.URL.Path == h.Challenge.Path {
+		return h.Challenge.serveVerify(w, r)
+	}
+
+	// events forwarded by other instances were limited by them already
+	if h.Distributed != nil && h.Distributed.Ownership != nil && r.URL.Path == h.Distributed.Ownership.Path {
+		return h.Distributed.Ownership.serveDecide(w, r)
+	}
+
+	var quotas quotaUses
+	var err error
+	if h.connections != nil {
+		if h.connections.start(r.RemoteAddr, h.MaxConcurrentPerConnection) {
+			defer h.connections.done(r.RemoteAddr)
+			quotas, err = h.limitRequest(w, r)
+		} else {
+			err = h.tooManyConcurrent(w, r)
+		}
+	} else {
+		quotas, err = h.limitRequest(w, r)
+	}
+
+	// work of the next handlers is not the module's; the request's
+	// context has the labels the goroutine had before
+	pprof.SetGoroutineLabels(r.Context())
+
+	if quotas.flight != "" && h.coalescer.follow(w, r, quotas.flight) {
+		h.metrics.recordCoalescedRequest(quotas.flightZone)
+		return nil
+	}
+	if _, ok := err.(grpcDeclined); ok {
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+	if _, ok := err.(challengeDeclined); ok {
+		return h.Challenge.writePage(w, r)
+	}
+	if err != nil {
+		return err
+	}
+
+	// the response that reaches the client is recorded for requests
+	// that coalesce onto this one
+	var f *flight
+	if len(quotas.flights) > 0 {
+		if f = h.coalescer.lead(quotas.flights); f != nil {
+			w = &flightWriter{
+				ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w},
+				f:                     f,
+			}
+		}
+	}
+	if len(quotas.request) > 0 && r.Body != nil {
+		r.Body = &requestBytesReader{ReadCloser: r.Body, uses: quotas.request}
+	}
+	if len(quotas.response) > 0 {
+		w = &responseBytesWriter{
+			ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w},
+			uses:                  quotas.response,
+		}
+	}
+	if h.WebSocket != nil {
+		w = h.WebSocket.wrap(w, r)
+	}
+	if h.UpstreamRetryAfter != nil {
+		w = h.UpstreamRetryAfter.wrap(w, r, quotas.keys)
+	}
+	if len(quotas.costs) > 0 {
+		w = wrapUpstreamCost(w, quotas.costs)
+	}
+	if len(quotas.attempts) > 0 {
+		w = wrapBruteForce(w, quotas.attempts)
+	}
+	if f == nil {
+		return next.ServeHTTP(w, r)
+	}
+	// if the next handlers panic, the flight lands without a response
+	defer h.coalescer.land(f)
+	err = next.ServeHTTP(w, r)
+	f.served = err == nil
+	return err
+}
+
+// limit applies the rate limits of all zones that match r. It returns
+// an error if r is declined.
+func (h Handler) limit(w http.ResponseWriter, r *http.Request) error {
+	_, err := h.limitRequest(w, r)
+	return err
+}
+
+// tenantOf returns the tenant of the request whose placeholders are in
+// repl, which labels its metrics, or an empty string without tenancy.
+func (h Handler) tenantOf(repl *caddy.Replacer) string {
+	if h.tenantLabel == nil {
+		return ""
+	}
+	return h.tenantLabel.key(repl)
+}
+
+// limitRequest is like limit, but also returns the byte quotas that the
+// bodies of r and its response count against, if r is allowed.
+func (h Handler) limitRequest(w http.ResponseWriter, r *http.Request) (quotas quotaUses, err error) {
 	startTime := time.Now()
 	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
 
+	// the events of a method's limit are given back if the zone declines
+	// the request after all; see RateLimit.MethodEvents
+	var methodEvents *methodReservation
+	defer func() {
+		if methodEvents != nil && err != nil {
+			methodEvents.refund()
+		}
+	}()
+
 	var matchedZone bool
 	var lastZoneName, lastKey string
 
+	// a request declined at the limit of a zone that coalesces may get
+	// the response of another request in flight; see RateLimit.Coalesce
+	var flight string
+	defer func() {
+		if _, ok := err.(caddyhttp.HandlerError); ok && flight != "" && isDeclined(err) {
+			quotas = quotaUses{flight: flight, flightZone: lastZoneName}
+		}
+	}()
+
+	if isGRPC(r) {
+		setGRPCPlaceholders(repl, r)
+	}
+	setFingerprintPlaceholders(repl, r)
+	if h.UserAgentClasses != nil {
+		h.UserAgentClasses.setPlaceholder(repl, r)
+	}
+	if h.Signing != nil {
+		h.Signing.setPlaceholders(repl, r)
+	}
+	var exempt bool
+	if h.Challenge != nil {
+		passed := h.Challenge.passed(r)
+		repl.Set("http.rate_limit.challenge_passed", passed)
+		exempt = passed && h.Challenge.Exempt
+	}
+
+	exemptAll := h.ExemptDefaults && exemptByDefault(r)
+	tenant := h.tenantOf(repl)
+
+	// only zones set pressure headers, never clients
+	for _, rl := range h.rateLimits {
+		if rl.PressureHeader != "" {
+			r.Header.Del(rl.PressureHeader)
+		}
+	}
+
 	// iterate the slice, not the map, so the order is deterministic
 	for _, rl := range h.rateLimits {
+		flight = ""
+		if exemptAll || (exempt && rl != h.global) {
+			continue
+		}
+
 		// ignore rate limit if request doesn't qualify
 		{
 			matched, err := rl.matcherSets.AnyMatchWithError(r)
 			if err != nil {
-				return err
+				return quotaUses{}, err
 			}
 			if !matched {
 				continue
 			}
 		}
 
+		// a request passing through several handlers is only
+		// counted once in the global zone
+		if rl == h.global {
+			if caddyhttp.GetVar(r.Context(), globalZoneVar) != nil {
+				continue
+			}
+			caddyhttp.SetVar(r.Context(), globalZoneVar, true)
+		}
+
+		// zones with placeholders in their names are resolved per request
+		rl := rl.resolve(repl)
+
+		// and requests of tiers are limited in the tier's zone, or not
+		// at all if the tier is unlimited
+		rl, limited := rl.tier(repl)
+		if !limited {
+			continue
+		}
+
+		// a request that passes through the zone again, e.g. through
+		// error routes, was counted already
+		if !rl.CountRepeats && countedBefore(r, rl.ZoneName) {
+			continue
+		}
+
 		matchedZone = true
 		lastZoneName = rl.ZoneName
+		pprof.SetGoroutineLabels(rl.profileLabels)
 
 		// make key for the individual rate limiter in this zone
-		key := repl.ReplaceAll(rl.Key, "")
+		key := rl.keyFor(r, repl)
 		lastKey = key
-		limiter := rl.limitersMap.getOrInsert(key, rl.MaxEvents, time.Duration(rl.Window))
-
-		if h.Distributed == nil {
-			// internal rate limiter only
-			if dur := limiter.When(); dur > 0 {
-				// Record metrics for declined request
-				h.metrics.recordDeclinedRequest(rl.ZoneName, key)
-				h.metrics.recordRequestPerKey(rl.ZoneName, key)
-				h.metrics.recordProcessTimePerKey(time.Since(startTime), rl.ZoneName, key)
-				return h.rateLimitExceeded(w, r, repl, rl.ZoneName, key, dur)
+
+		maxEvents, window := rl.limitersMap.limits()
+		repl.Set(placeholderPrefix(rl.ZoneName)+"limit", maxEvents)
+
+		// listed keys and clients are exempted, or declined until the
+		// deny list is refreshed, without consulting their rate limiter
+		if rl.ExemptList.matches(r, key) {
+			continue
+		}
+		if rl.DenyList.matches(r, key) {
+			return quotaUses{}, h.decline(w, r, repl, rl, tenant, key, startTime, time.Duration(rl.DenyList.RefreshInterval), false)
+		}
+
+		// banned keys, and keys that an upstream asked to back off or
+		// that are cooling down, are declined without consulting their
+		// rate limiter
+		if dur := max(rl.limitersMap.banned(key), rl.limitersMap.backedOff(key)); dur > 0 {
+			return quotaUses{}, h.decline(w, r, repl, rl, tenant, key, startTime, dur, false)
+		}
+
+		// zones with brute force protection count the failed attempts
+		// that later handlers respond to, not requests
+		if rl.BruteForce != nil {
+			quotas.attempts = append(quotas.attempts, limitedKey{zone: rl, key: key})
+			continue
+		}
+
+		// keys in a retry storm are banned right away, rather than
+		// declined as fast as they retry
+		if rl.RetryStorm != nil && rl.RetryStorm.observe(rl.limitersMap, r, key) {
+			ban := time.Duration(rl.RetryStorm.BanDuration)
+			until := now().Add(ban)
+			rl.limitersMap.ban(key, until)
+			rl.Log.banned(rl.ZoneName, key, until, "retry_storm")
+			h.metrics.recordRetryStorm(rl.ZoneName)
+			h.emitEvent(eventRetryStorm, map[string]any{
+				"zone":      rl.ZoneName,
+				"key":       key,
+				"requests":  rl.RetryStorm.Threshold,
+				"remote_ip": remoteIPOf(r),
+			})
+			h.emitEvent(eventBan, map[string]any{
+				"zone":    rl.ZoneName,
+				"key":     key,
+				"expires": until,
+			})
+			return quotaUses{}, h.decline(w, r, repl, rl, tenant, key, startTime, ban, false)
+		}
+
+		if rl.Anomaly != nil {
+			rl.Anomaly.observe(key)
+		}
+
+		// zones that are observed for suggested limits don't limit yet
+		if rl.limitersMap.observation.Load().observe(key, window) {
+			continue
+		}
+
+		// keys that used up their bytes are declined until enough of
+		// them left the window
+		requestBytes, responseBytes := rl.limitersMap.requestBytes.Load(), rl.limitersMap.responseBytes.Load()
+		for _, quota := range []*byteQuota{requestBytes, responseBytes} {
+			if quota == nil {
+				continue
+			}
+			if dur := quota.wait(key, now()); dur > 0 {
+				return quotaUses{}, h.decline(w, r, repl, rl, tenant, key, startTime, dur, false)
+			}
+		}
+		if requestBytes != nil {
+			quotas.request = append(quotas.request, quotaUse{quota: requestBytes, key: key})
+		}
+		if responseBytes != nil {
+			quotas.response = append(quotas.response, quotaUse{quota: responseBytes, key: key})
+		}
+
+		// keys that used up their distinct values are declined new ones
+		if rl.Distinct != nil {
+			if dur := rl.Distinct.wait(rl.limitersMap, repl, key); dur > 0 {
+				return quotaUses{}, h.decline(w, r, repl, rl, tenant, key, startTime, dur, false)
+			}
+		}
+		// requests that cost nothing are not counted
+		cost := rl.costOf(r)
+		if rl.WAFScore != nil {
+			cost *= rl.WAFScore.factor(repl)
+		}
+		if !rl.limitsEvents() || cost == 0 {
+			continue
+		}
+
+		// retries of a request that was counted are not counted again
+		idempotencyKey := rl.idempotencyKeyOf(r)
+		if idempotencyKey != "" && rl.limitersMap.retried(key, idempotencyKey) {
+			continue
+		}
+
+		// nor are later requests of a connection or session that was
+		session := rl.sessionOf(repl)
+		if session != "" && rl.limitersMap.sessionCounted(key, session, now().Add(window)) {
+			continue
+		}
+
+		flight = coalescible(rl, key, r)
+
+		// floods of new keys are declined at the zone's cap
+		if rl.NewKeys != nil {
+			if dur, flood := rl.limitersMap.admitNewKey(key); dur > 0 {
+				if flood {
+					h.logger.Warn("declining new keys at the zone's cap",
+						zap.String("zone", rl.ZoneName),
+						zap.Int("max_keys", rl.NewKeys.MaxKeys),
+						zap.Duration("interval", time.Duration(rl.NewKeys.Interval)),
+					)
+					h.emitEvent(eventNewKeyFlood, map[string]any{
+						"zone":      rl.ZoneName,
+						"key":       key,
+						"max_keys":  rl.NewKeys.MaxKeys,
+						"interval":  time.Duration(rl.NewKeys.Interval),
+						"remote_ip": remoteIPOf(r),
+					})
+				}
+				return quotaUses{}, h.decline(w, r, repl, rl, tenant, key, startTime, dur, true)
+			}
+		}
+
+		// requests of methods with their own limit must be within it too
+		if limiters, ok := rl.limitersMap.methodLimiters(r.Method); ok {
+			if dur := limiters.whenN(limiters.getOrInsert(key), cost); dur > 0 {
+				return quotaUses{}, h.decline(w, r, repl, rl, tenant, key, startTime, dur, false)
 			}
+			methodEvents = &methodReservation{limiters: limiters, key: key, n: cost}
+		}
+
+		// the first event of a key needs no rate limiter if it is decided
+		// locally, and not by the key's age; see admitUnseen
+		firstEvent := (h.Distributed == nil || rl.Consistency == consistencyLocal) && cost == 1 &&
+			rl.Greylist == nil && rl.KeySlowStart == nil
+
+		var count int
+		var reset time.Duration
+		if al := rl.limitersMap.algorithm.Load(); al != nil {
+			// the zone's algorithm module only tells how many events
+			// remain, not when they reset
+			limiter := al.limiter(key, maxEvents, window)
+			if dur := limiter.Allow(now(), cost); dur > 0 {
+				return quotaUses{}, h.decline(w, r, repl, rl, tenant, key, startTime, dur, rl.limitersMap.overloaded(nil))
+			}
+			count = maxEvents - limiter.Remaining(now())
+		} else if d, ok := h.ownerDecision(r.Context(), rl, key, cost); ok {
+			// the key's owner decided exactly for the whole cluster
+			if d.Wait > 0 {
+				return quotaUses{}, h.decline(w, r, repl, rl, tenant, key, startTime, d.Wait, d.Overload)
+			}
+			count, reset = maxEvents-d.Remaining, d.Reset
+		} else if admitted, unsettled := rl.limitersMap.admitUnseen(key, firstEvent); admitted {
+			count, reset = 1, window
 		} else {
-			// distributed rate limiting; add last known state of other instances
-			if err := h.distributedRateLimiting(w, r, repl, limiter, key, rl.ZoneName); err != nil {
-				// Record metrics for declined request if it was a rate limit error
-				if caddyErr, ok := err.(caddyhttp.HandlerError); ok && caddyErr.StatusCode == http.StatusTooManyRequests {
-					h.metrics.recordDeclinedRequest(rl.ZoneName, key)
+			limiter := rl.limitersMap.getOrInsertUnsettled(key, unsettled)
+			// the request may keep the limiter across syncs with storage,
+			// which can take longer than the sweep interval
+			limiter.hold()
+			defer limiter.unhold()
+
+			// new keys are held to their provisional limit first
+			if rl.Greylist != nil {
+				if dur := rl.Greylist.wait(rl.limitersMap, key, limiter, cost); dur > 0 {
+					return quotaUses{}, h.decline(w, r, repl, rl, tenant, key, startTime, dur, false)
+				}
+			}
+			if rl.KeySlowStart != nil {
+				if dur := rl.KeySlowStart.wait(rl.limitersMap, key, limiter, maxEvents, cost); dur > 0 {
+					return quotaUses{}, h.decline(w, r, repl, rl, tenant, key, startTime, dur, false)
 				}
-				h.metrics.recordRequestPerKey(rl.ZoneName, key)
-				h.metrics.recordProcessTimePerKey(time.Since(startTime), rl.ZoneName, key)
-				return err
+			}
+
+			if h.Distributed == nil || rl.Consistency == consistencyLocal {
+				// internal rate limiter only
+				if dur := rl.limitersMap.whenN(limiter, cost); dur > 0 {
+					return quotaUses{}, h.decline(w, r, repl, rl, tenant, key, startTime, dur, rl.limitersMap.overloaded(limiter))
+				}
+			} else if h.Distributed.Observe {
+				// observers only compare their decisions with the cluster's
+				h.observe(limiter, key, rl, cost)
+			} else {
+				// storage isn't waited on while the breaker is tripped
+				tripped := h.Distributed.Breaker.isTripped()
+				strict := rl.Consistency == consistencyStrict && !tripped
+				if strict {
+					h.strictSync(r.Context(), "read", &h.Distributed.strictReads, h.syncDistributedRead, &h.Distributed.readFailed)
+				}
+				// while state can't be synced with storage, fail-open zones
+				// decide with the last known states, and fail-closed ones
+				// decline until the next read
+				if h.Distributed.storeFailing() {
+					h.metrics.recordDegradedDecision(rl.ZoneName, rl.StoreFailure)
+					if rl.StoreFailure == storeFailureClosed {
+						return quotaUses{}, h.decline(w, r, repl, rl, tenant, key, startTime, time.Duration(h.Distributed.ReadInterval), true)
+					}
+				}
+				// distributed rate limiting adds the last known state of other
+				// instances, unless deciding locally until storage recovers
+				if tripped {
+					if dur := rl.limitersMap.whenN(limiter, cost); dur > 0 {
+						return quotaUses{}, h.decline(w, r, repl, rl, tenant, key, startTime, dur, rl.limitersMap.overloaded(limiter))
+					}
+				} else if err := h.distributedRateLimiting(w, r, repl, limiter, key, rl, cost); err != nil {
+					// Record metrics for declined request if it was a rate limit error
+					if isDeclined(err) {
+						h.metrics.recordDeclinedRequest(r.Context(), rl.ZoneName, tenant, key)
+					}
+					h.metrics.recordRequestPerKey(rl.ZoneName, tenant, key)
+					h.metrics.recordProcessTimePerKey(r.Context(), time.Since(startTime), rl.ZoneName, key)
+					return quotaUses{}, err
+				}
+				if strict {
+					h.strictSync(r.Context(), "write", &h.Distributed.strictWrites, h.syncDistributedWrite, &h.Distributed.writeFailed)
+				}
+			}
+
+			ref := now()
+			var oldest time.Time
+			count, oldest = limiter.Count(ref)
+			if count > 0 {
+				reset = oldest.Add(window).Sub(ref)
+			}
+		}
+
+		// the zone allowed the request, so its method's events stay
+		// counted even if a later zone declines it, like the zone's
+		methodEvents = nil
+
+		if idempotencyKey != "" {
+			rl.limitersMap.counted(key, idempotencyKey, now().Add(time.Duration(rl.IdempotencyWindow)))
+		}
+		if session != "" {
+			rl.limitersMap.countSession(key, session, now().Add(window))
+		}
+		if h.UsageExport != nil {
+			h.UsageExport.count(rl.ZoneName, key, cost)
+		}
+		rl.limitersMap.recordUsage(key, cost, 0)
+
+		// make the key's remaining budget available to later handlers
+		repl.Set(placeholderPrefix(rl.ZoneName)+"remaining", max(maxEvents-count, 0))
+		repl.Set(placeholderPrefix(rl.ZoneName)+"reset", strconv.FormatFloat(reset.Seconds(), 'f', 0, 64))
+		repl.Set(placeholderPrefix(rl.ZoneName)+"reset_ms", ceilMilliseconds(reset))
+		traceDecision(r, rl.ZoneName, true, max(maxEvents-count, 0), 0)
+		rl.Log.allowed(rl.ZoneName, key, max(maxEvents-count, 0))
+		h.metrics.updateRemaining(rl.ZoneName, key, max(maxEvents-count, 0))
+		if maxEvents > 0 {
+			h.metrics.recordUtilization(rl.ZoneName, min(float64(count)/float64(maxEvents), 1))
+		}
+
+		// let others know when a key is about to run out of events
+		if rl.NearLimit > 0 && float64(count) >= rl.NearLimit*float64(maxEvents) {
+			h.metrics.recordNearLimitRequest(rl.ZoneName, key)
+			h.emitEvent(eventNearLimit, map[string]any{
+				"zone":      rl.ZoneName,
+				"key":       key,
+				"count":     count,
+				"limit":     maxEvents,
+				"remote_ip": remoteIPOf(r),
+			})
+		}
+
+		// let upstreams know when a key is under pressure
+		if rl.PressureHeader != "" && maxEvents > 0 {
+			if utilization := float64(count) / float64(maxEvents); utilization >= rl.PressureThreshold {
+				setPressureHeader(r.Header, rl.PressureHeader, utilization)
 			}
 		}
 
 		// Update keys count for this zone
-		rl.limitersMap.limitersMu.Lock()
-		keysCount := len(rl.limitersMap.limiters)
-		rl.limitersMap.limitersMu.Unlock()
-		h.metrics.updateKeysCount(rl.ZoneName, keysCount)
+		h.metrics.updateKeysCount(rl.ZoneName, rl.tenant, rl.limitersMap.len())
+
+		if h.UpstreamRetryAfter != nil {
+			quotas.keys = append(quotas.keys, limitedKey{zone: rl, key: key})
+		}
+		if rl.CostHeader != "" || rl.RefundHeader != "" {
+			quotas.costs = append(quotas.costs, upstreamCost{zone: rl, key: key, paid: cost})
+		}
+		if flight != "" {
+			quotas.flights = append(quotas.flights, flight)
+			flight = ""
+		}
 	}
 
 	// Record request metrics - use per-key metrics if we matched a zone, otherwise use the general method
 	if matchedZone {
-		h.metrics.recordRequestPerKey(lastZoneName, lastKey)
-		h.metrics.recordProcessTimePerKey(time.Since(startTime), lastZoneName, lastKey)
+		h.metrics.recordRequestPerKey(lastZoneName, tenant, lastKey)
+		h.metrics.recordProcessTimePerKey(r.Context(), time.Since(startTime), lastZoneName, lastKey)
 	} else {
 		h.metrics.recordRequest(false)
 		h.metrics.recordProcessTime(time.Since(startTime), false)
 	}
 
-	return next.ServeHTTP(w, r)
+	return quotas, nil
+}
+
+// defaultPressureThreshold is the pressure_threshold of zones that have
+// a pressure_header but neither a pressure_threshold nor a near_limit.
+const defaultPressureThreshold = 0.8
+
+// setPressureHeader sets the request header with the given name to the
+// utilization, unless an earlier zone set it to a higher one.
+func setPressureHeader(header http.Header, name string, utilization float64) {
+	utilization = min(utilization, 1)
+	if current, err := strconv.ParseFloat(header.Get(name), 64); err == nil && current >= utilization {
+		return
+	}
+	header.Set(name, strconv.FormatFloat(utilization, 'f', 2, 64))
 }
 
-func (h *Handler) rateLimitExceeded(w http.ResponseWriter, r *http.Request, repl *caddy.Replacer, zoneName string, key string, wait time.Duration) error {
+// decline records the metrics of r, which was declined by rl for key of
+// tenant after processing it since startTime, and declines it with
+// rateLimitExceeded.
+func (h *Handler) decline(w http.ResponseWriter, r *http.Request, repl *caddy.Replacer, rl *RateLimit, tenant, key string, startTime time.Time, wait time.Duration, overload bool) error {
+	h.metrics.recordDeclinedRequest(r.Context(), rl.ZoneName, tenant, key)
+	h.metrics.recordRequestPerKey(rl.ZoneName, tenant, key)
+	h.metrics.recordProcessTimePerKey(r.Context(), time.Since(startTime), rl.ZoneName, key)
+	return h.rateLimitExceeded(w, r, repl, rl, key, wait, overload)
+}
+
+// rateLimitExceeded declines r, which exceeded a limit of rl for key
+// and may be allowed after wait. If overload is true, the limit is one
+// of the zone as a whole rather than of key; see RateLimit.OverloadStatus.
+func (h *Handler) rateLimitExceeded(w http.ResponseWriter, r *http.Request, repl *caddy.Replacer, rl *RateLimit, key string, wait time.Duration, overload bool) error {
+	zoneName := rl.ZoneName
+
+	// keys that exceeded their own limit must be quiet for a while
+	if rl.Cooldown > 0 && !overload {
+		cooldown := time.Duration(rl.Cooldown)
+		rl.limitersMap.backOff(key, now().Add(cooldown))
+		wait = max(wait, cooldown)
+	}
+
 	// add jitter, if configured
 	if h.random != nil {
 		jitter := h.randomFloatInRange(0, float64(wait)*h.Jitter)
 		wait += time.Duration(jitter)
 	}
 
-	// add 0.5 to ceil() instead of round() which FormatFloat() does automatically
-	w.Header().Set("Retry-After", strconv.FormatFloat(wait.Seconds()+0.5, 'f', 0, 64))
+	// round up, so that clients don't retry before the wait is over,
+	// e.g. after 1.5s when events are allowed only once every 2s
+	seconds := math.Ceil(wait.Seconds())
+	retryAfter := strconv.FormatFloat(seconds, 'f', 0, 64)
+	w.Header().Set("Retry-After", formatRetryAfter(h.RetryAfterFormat, seconds))
 
-	// emit log about exceeding rate limit (see #37)
-	remoteIP, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		remoteIP = r.RemoteAddr // assume there was no port, I guess
+	// keep caches and CDNs from serving the decline to other clients
+	if !h.DisableCacheHeaders {
+		w.Header().Set("Cache-Control", "no-store")
+		for _, header := range rl.varyHeaders {
+			w.Header().Add("Vary", header)
+		}
 	}
 
-	// Create logger with common fields
-	logger := h.logger.With(
+	// emit log about exceeding rate limit (see #37)
+	remoteIP := remoteIPOf(r)
+
+	// Create logger with common fields, in the zone's log if it has one
+	logger := h.logger
+	if rl.Log != nil {
+		logger = rl.Log.logger
+	}
+	logger = logger.With(
 		zap.String("zone", zoneName),
 		zap.Duration("wait", wait),
 		zap.String("remote_ip", remoteIP),
@@ -285,29 +1186,258 @@ func (h *Handler) rateLimitExceeded(w http.ResponseWriter, r *http.Request, repl
 
 	// Log the rate limit exceeded message
 	logger.Info("rate limit exceeded")
+	if rl.DeclineLog != nil {
+		rl.DeclineLog.log(r, key, remoteIP, wait)
+	}
+	rl.limitersMap.recordUsage(key, 0, 1)
+	if h.Fail2Ban != nil {
+		if err := h.Fail2Ban.log(remoteIP, zoneName); err != nil {
+			h.logger.Error("writing fail2ban log", zap.Error(err))
+		}
+	}
 
 	// also emit event so user can configure custom responses to rate limit violations
-	h.events.Emit(h.ctx, "rate_limit_exceeded", map[string]any{
+	if h.events != nil {
+		h.events.Emit(h.ctx, "rate_limit_exceeded", map[string]any{
+			"zone":      zoneName,
+			"wait":      wait,
+			"remote_ip": remoteIP,
+		})
+	}
+	h.emitEvent(eventDeny, map[string]any{
 		"zone":      zoneName,
+		"key":       key,
 		"wait":      wait,
 		"remote_ip": remoteIP,
 	})
 
-	// make some information about this rate limit available
-	repl.Set("http.rate_limit.exceeded.name", zoneName)
+	// make some information about this rate limit available, also
+	// under names that don't depend on the zone, for error routes that
+	// respond to the declines of any zone
+	maxEvents, _ := rl.limitersMap.limits()
+	repl.Set(exceededPlaceholderPrefix+"name", zoneName)
+	repl.Set(exceededPlaceholderPrefix+"key", key)
+	repl.Set(exceededPlaceholderPrefix+"limit", maxEvents)
+	repl.Set(exceededPlaceholderPrefix+"remaining", 0)
+	repl.Set(exceededPlaceholderPrefix+"reset", retryAfter)
+	repl.Set(exceededPlaceholderPrefix+"reset_ms", ceilMilliseconds(wait))
+	repl.Set(placeholderPrefix(zoneName)+"remaining", 0)
+	repl.Set(placeholderPrefix(zoneName)+"reset", retryAfter)
+	repl.Set(placeholderPrefix(zoneName)+"reset_ms", ceilMilliseconds(wait))
+	traceDecision(r, zoneName, false, 0, wait)
+	h.metrics.updateRemaining(zoneName, key, 0)
+	h.metrics.recordUtilization(zoneName, 1)
+
+	// gRPC clients expect a gRPC status rather than an HTTP 429
+	if isGRPC(r) {
+		setGRPCExhausted(w.Header(), wait)
+		return grpcDeclined{}
+	}
 
+	// browsers may get a chance to prove that they are human
+	if h.Challenge != nil && h.Challenge.challengeable(r) && !h.Challenge.passed(r) {
+		return challengeDeclined{}
+	}
+
+	if overload && rl.OverloadStatus != 0 {
+		return caddyhttp.Error(rl.OverloadStatus, errZoneOverloaded)
+	}
 	return caddyhttp.Error(http.StatusTooManyRequests, nil)
 }
 
+// errZoneOverloaded is the error of requests that are declined because
+// of a zone's overall limits, with the zone's overload status.
+var errZoneOverloaded = errors.New("rate limit zone overloaded")
+
+// isDeclined returns true if err is the error of a declined request.
+func isDeclined(err error) bool {
+	switch err.(type) {
+	case grpcDeclined, challengeDeclined:
+		return true
+	}
+	handlerErr, ok := err.(caddyhttp.HandlerError)
+	return ok && (handlerErr.StatusCode == http.StatusTooManyRequests || errors.Is(handlerErr.Err, errZoneOverloaded))
+}
+
 // Cleanup cleans up the handler.
 func (h *Handler) Cleanup() error {
+	if h.Distributed != nil {
+		// Caddy may exit right after cleaning up, so the state is
+		// written now rather than by the goroutine that syncs it
+		if _, syncing := clusters.LoadAndDelete(h.Distributed); syncing {
+			h.syncDistributedLeave()
+		}
+	}
 	// remove unused rate limit zones
 	for name := range h.RateLimits {
 		rateLimits.Delete(name)
 	}
+	for _, rl := range h.rateLimits {
+		if rl.dynamic != nil {
+			rl.forEachZone(func(zone *RateLimit) {
+				rateLimits.Delete(zone.ZoneName)
+			})
+		}
+		for _, zone := range rl.tiers {
+			if zone != nil {
+				rateLimits.Delete(zone.ZoneName)
+			}
+		}
+		if rl.authenticated != nil {
+			rateLimits.Delete(rl.authenticated.ZoneName)
+		}
+	}
+	if h.Fail2Ban != nil {
+		return h.Fail2Ban.close()
+	}
 	return nil
 }
 
+// globalZoneVar is the request variable that marks requests which were
+// limited in the app's global zone.
+const globalZoneVar = "rate_limit.global_zone"
+
+// countedZonesVar is the request variable that holds the names of the
+// zones that a request was counted in; see RateLimit.CountRepeats.
+const countedZonesVar = "rate_limit.counted_zones"
+
+// countedBefore returns whether r was counted in the zone with the given
+// name before, and otherwise records that it is counted now.
+func countedBefore(r *http.Request, zoneName string) bool {
+	counted, _ := caddyhttp.GetVar(r.Context(), countedZonesVar).(map[string]struct{})
+	if _, ok := counted[zoneName]; ok {
+		return true
+	}
+	if counted == nil {
+		counted = make(map[string]struct{})
+		caddyhttp.SetVar(r.Context(), countedZonesVar, counted)
+	}
+	counted[zoneName] = struct{}{}
+	return false
+}
+
+// exceededPlaceholderPrefix is the prefix of the placeholders that
+// describe the limit that a declined request exceeded.
+const exceededPlaceholderPrefix = "http.rate_limit.exceeded."
+
+// placeholderPrefix returns the prefix of the placeholders that
+// describe the state of the given zone's rate limiter for a request.
+func placeholderPrefix(zoneName string) string {
+	return "http.rate_limit." + zoneName + "."
+}
+
+// ceilMilliseconds returns d in whole milliseconds, rounded up, so that
+// waits of sub-second windows aren't reported as 0.
+func ceilMilliseconds(d time.Duration) int64 {
+	return int64((d + time.Millisecond - 1) / time.Millisecond)
+}
+
+// remoteIPOf returns the IP address of the client connected to r.
+func remoteIPOf(r *http.Request) string {
+	remoteIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr // assume there was no port, I guess
+	}
+	return remoteIP
+}
+
+// healthCheckPaths are the paths of requests that exempt_defaults
+// exempts as health checks.
+var healthCheckPaths = map[string]struct{}{
+	"/health":      {},
+	"/healthz":     {},
+	"/healthcheck": {},
+	"/livez":       {},
+	"/readyz":      {},
+	"/ping":        {},
+}
+
+// exemptByDefault returns true if r is a health check, a CORS
+// preflight request or an ACME HTTP-01 challenge.
+func exemptByDefault(r *http.Request) bool {
+	if _, ok := healthCheckPaths[strings.TrimSuffix(r.URL.Path, "/")]; ok {
+		return true
+	}
+	if r.Method == http.MethodOptions && r.Header.Get("Origin") != "" && r.Header.Get("Access-Control-Request-Method") != "" {
+		return true
+	}
+	return strings.HasPrefix(r.URL.Path, "/.well-known/acme-challenge/")
+}
+
+// keyFor returns the key of the rate limiter for r in the zone.
+func (rl *RateLimit) keyFor(r *http.Request, repl *caddy.Replacer) string {
+	key := rl.keyTemplate.key(repl)
+	if rl.IsolateByHost {
+		key = hostOf(r) + "/" + key
+	}
+	return key
+}
+
+// costOf returns the number of events that r counts as in the zone:
+// the cost of its path, multiplied by the cost of its method.
+func (rl *RateLimit) costOf(r *http.Request) int {
+	cost := 1
+	for i, matcher := range rl.pathCostMatchers {
+		if matcher.Match(r) {
+			cost = rl.PathCosts[i].Cost
+			break
+		}
+	}
+	if methodCost, ok := rl.MethodCosts[r.Method]; ok {
+		cost *= methodCost
+	}
+	return cost
+}
+
+// idempotencyKeyOf returns the idempotency key of r, if the zone counts
+// its retries only once and it has one that isn't too long.
+func (rl *RateLimit) idempotencyKeyOf(r *http.Request) string {
+	if rl.IdempotencyWindow == 0 {
+		return ""
+	}
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if len(idempotencyKey) > maxIdempotencyKeyLength {
+		return ""
+	}
+	return idempotencyKey
+}
+
+// methodReservation is the events that a request reserved in the limit
+// of its method; see RateLimit.MethodEvents.
+type methodReservation struct {
+	limiters *rateLimitersMap
+	key      string
+	n        int
+}
+
+// refund gives the events back.
+func (mr *methodReservation) refund() {
+	_, _ = mr.limiters.refund(mr.key, mr.n)
+}
+
+// sessionOf returns the connection or session of a request, if the zone
+// counts them once and it has one that isn't too long.
+func (rl *RateLimit) sessionOf(repl *caddy.Replacer) string {
+	if rl.sessionTemplate == nil {
+		return ""
+	}
+	session := rl.sessionTemplate.key(repl)
+	if len(session) > maxIdempotencyKeyLength {
+		return ""
+	}
+	return session
+}
+
+// hostOf returns the host that r is addressed to, without the port and
+// in lower case. Hosts can't contain slashes, so it can namespace keys.
+func hostOf(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host // no port
+	}
+	return strings.ToLower(host)
+}
+
 func (h Handler) randomFloatInRange(min, max float64) float64 {
 	if h.random == nil {
 		return 0
@@ -315,30 +1445,19 @@ func (h Handler) randomFloatInRange(min, max float64) float64 {
 	return min + h.random.Float64()*(max-min)
 }
 
-func (h Handler) sweepRateLimiters(ctx context.Context) {
-	cleanerTicker := time.NewTicker(time.Duration(h.SweepInterval))
+// sweepRateLimiters periodically cleans up expired rate limit states and
+// bans of the given zones until ctx is done.
+func (h Handler) sweepRateLimiters(ctx context.Context, interval time.Duration, zones []*RateLimit) {
+	labelTask(ctx, "sweep")
+	cleanerTicker := time.NewTicker(interval)
 	defer cleanerTicker.Stop()
 
 	for {
 		select {
 		case <-cleanerTicker.C:
-			rateLimits.Range(func(key, value interface{}) bool {
-				zoneName := key.(string)
-				limitersMap := value.(*rateLimitersMap)
-
-				// Clean up expired rate limit states
-				limitersMap.sweep()
-
-				// Update keys count metrics if we have metrics enabled
-				if h.metrics != nil && h.metrics.enabled {
-					limitersMap.limitersMu.Lock()
-					keysCount := len(limitersMap.limiters)
-					limitersMap.limitersMu.Unlock()
-					h.metrics.updateKeysCount(zoneName, keysCount)
-				}
-
-				return true
-			})
+			for _, rl := range zones {
+				rl.forEachZone(h.sweepZone)
+			}
 
 		case <-ctx.Done():
 			return
@@ -346,6 +1465,47 @@ func (h Handler) sweepRateLimiters(ctx context.Context) {
 	}
 }
 
+// sweepZone cleans up expired rate limit states and bans of a zone, reports
+// keys evicted since the last sweep, and updates the metrics that are
+// collected in the background.
+func (h Handler) sweepZone(rl *RateLimit) {
+	zoneName, limitersMap := rl.ZoneName, rl.limitersMap
+	unbannedKeys, expired := limitersMap.sweep()
+	for _, unbanned := range unbannedKeys {
+		limitersMap.emitEvent(eventUnban, map[string]any{
+			"zone": zoneName,
+			"key":  unbanned,
+		})
+	}
+	if h.metrics != nil {
+		h.metrics.recordKeysRemoved(zoneName, keyRemovalExpired, expired)
+		h.metrics.recordServedBans(zoneName, limitersMap.takeServedBans())
+	}
+
+	evicted := limitersMap.takeEvictions()
+	if h.metrics != nil {
+		h.metrics.recordKeysRemoved(zoneName, keyRemovalEvicted, evicted)
+	}
+	if rl.LogEvictions && evicted > 0 {
+		h.logger.Warn("evicted least recently used keys to stay within max_keys",
+			zap.String("zone", zoneName),
+			zap.Int("max_keys", rl.MaxKeys),
+			zap.Int("evicted", evicted),
+		)
+	}
+
+	// Update keys count metrics if we have metrics enabled
+	if h.metrics != nil && h.metrics.active() {
+		h.metrics.updateKeysCount(zoneName, rl.tenant, limitersMap.len())
+		h.metrics.updateActiveBans(zoneName, len(limitersMap.activeBans()))
+		if rl.IsolateByHost {
+			h.metrics.updateHostKeysCount(zoneName, limitersMap.keysPerHost())
+		}
+		h.metrics.updateZoneRemaining(zoneName, limitersMap.minRemaining())
+		h.metrics.updateMemoryUsage(zoneName, limitersMap.memoryUsage())
+	}
+}
+
 // rateLimits persists RL zones through config changes.
 var rateLimits = caddy.NewUsagePool()
 
@@ -15,12 +15,19 @@
 package caddyrl
 
 import (
+	"context"
 	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
 	"strconv"
 	"testing"
 	"time"
 
+	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddytest"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
 )
 
 const referenceTime = 1000000
@@ -55,6 +62,46 @@ func assert429Response(t *testing.T, tester *caddytest.Tester, expectedRetryAfte
 	}
 }
 
+// newTestHandler provisions zones, which are deleted when the test
+// ends, and returns a handler that limits requests by them.
+func newTestHandler(tb testing.TB, zones ...*RateLimit) Handler {
+	tb.Helper()
+	for _, rl := range zones {
+		if err := rl.provision(caddy.Context{}, rl.ZoneName); err != nil {
+			tb.Fatal(err)
+		}
+		tb.Cleanup(func() { _, _ = rateLimits.Delete(rl.ZoneName) })
+	}
+	return Handler{
+		rateLimits: zones,
+		metrics:    newMetricsCollector(false, &RateLimitApp{}),
+		logger:     zap.NewNop(),
+	}
+}
+
+// newTestRequest returns a request whose replacer has the placeholders
+// of the request, and the given values of other placeholders.
+func newTestRequest(method, target string, values map[string]string) *http.Request {
+	req := httptest.NewRequest(method, target, nil)
+	repl := caddyhttp.NewTestReplacer(req)
+	for name, value := range values {
+		repl.Set(name, value)
+	}
+	return req
+}
+
+// allowedBy returns true if h allows req, which is then served by a
+// handler that does nothing, and fails the test if h fails otherwise.
+func allowedBy(t *testing.T, h Handler, req *http.Request) bool {
+	t.Helper()
+	next := caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error { return nil })
+	err := h.ServeHTTP(httptest.NewRecorder(), req, next)
+	if err != nil && !isDeclined(err) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return err == nil
+}
+
 func TestRateLimits(t *testing.T) {
 	window := 60
 	maxEvents := 10
@@ -251,3 +298,299 @@ func TestZoneOrdering(t *testing.T) {
 	// Check to ensure that the more permissive zone is rate limited.
 	tester.AssertGetResponse("http://localhost:8080/permissive3", 429, "")
 }
+
+func TestLimiterPlaceholders(t *testing.T) {
+	maxEvents := 3
+	// Admin API must be exposed on port 2999 to match what caddytest.Tester does
+	config := fmt.Sprintf(`{
+	"admin": {"listen": "localhost:2999"},
+	"apps": {
+		"http": {
+			"servers": {
+				"demo": {
+					"listen": [":8080"],
+					"routes": [{
+						"handle": [
+							{
+								"handler": "rate_limit",
+								"rate_limits": [
+									{
+										"zone_name": "placeholder_zone",
+										"key": "static",
+										"window": "60s",
+										"max_events": %d
+									}
+								]
+							},
+							{
+								"handler": "static_response",
+								"status_code": 200,
+								"body": "{http.rate_limit.placeholder_zone.remaining}/{http.rate_limit.placeholder_zone.limit} {http.rate_limit.placeholder_zone.reset}"
+							}
+						]
+					}]
+				}
+			}
+		}
+	}
+}`, maxEvents)
+
+	initTime()
+
+	tester := caddytest.NewTester(t)
+	tester.InitServer(config, "json")
+
+	tester.AssertGetResponse("http://localhost:8080", 200, "2/3 60")
+	advanceTime(10)
+	tester.AssertGetResponse("http://localhost:8080", 200, "1/3 50")
+	tester.AssertGetResponse("http://localhost:8080", 200, "0/3 50")
+}
+
+func TestSweepZone(t *testing.T) {
+	initTime()
+
+	rlm := newRateLimiterMap()
+	rlm.updateAll(5, time.Minute)
+	rlm.getOrInsert("stale").When()
+	advanceTime(30)
+	rlm.getOrInsert("fresh").When()
+
+	var unbanned []string
+	rlm.setEventEmitter(func(name string, data map[string]any) {
+		if name == eventUnban {
+			unbanned = append(unbanned, data["key"].(string))
+		}
+	})
+	rlm.ban("banned", now().Add(time.Second))
+
+	advanceTime(70)
+	h := Handler{metrics: newMetricsCollector(false, &RateLimitApp{})}
+	h.sweepZone(&RateLimit{ZoneName: "sweep_zone", limitersMap: rlm})
+
+	if _, ok := rlm.get("stale"); ok {
+		t.Fatal("key whose events left the window should be removed")
+	}
+	if _, ok := rlm.get("fresh"); !ok {
+		t.Fatal("key with events in the window should be kept")
+	}
+	if len(unbanned) != 1 || unbanned[0] != "banned" {
+		t.Fatalf("expected unban event for expired ban, got %v", unbanned)
+	}
+}
+
+// BenchmarkServeHTTP measures the allow path that every request pays for,
+// with one hot key, with many distinct keys in the default number of shards
+// and in a single one, and in distributed mode with the state of another
+// instance to account for. Requests run in parallel; run it with -cpu to see
+// how contention scales.
+func BenchmarkServeHTTP(b *testing.B) {
+	// events must leave the tiny window, so the clock has to move
+	oldNow := now
+	now = time.Now
+	b.Cleanup(func() { now = oldNow })
+
+	next := caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error { return nil })
+
+	for _, bm := range []struct {
+		name        string
+		keys        int
+		distributed bool
+		shards      int // 0 for the default number
+	}{
+		{"single_key", 1, false, 0},
+		{"many_keys", 1 << 16, false, 0},
+		{"many_keys_one_shard", 1 << 16, false, 1},
+		{"distributed", 1 << 10, true, 0},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			zoneName := "bench_" + bm.name
+			if bm.shards > 0 {
+				rateLimits.LoadOrStore(zoneName, newShardedRateLimiterMap(bm.shards))
+			}
+			rl := &RateLimit{
+				ZoneName:  zoneName,
+				Key:       "{bench.key}",
+				Window:    caddy.Duration(time.Nanosecond),
+				MaxEvents: 100,
+			}
+			h := newTestHandler(b, rl)
+
+			// keys are boxed once, so that setting them doesn't allocate
+			keys := make([]any, bm.keys)
+			for i := range keys {
+				keys[i] = strconv.Itoa(i)
+			}
+
+			if bm.distributed {
+				// the other instance's state stays current for the benchmark
+				peer := rlState{
+					Timestamp: time.Now().Add(time.Hour),
+					Zones:     map[string]map[string]rlStateValue{zoneName: {}},
+				}
+				for _, key := range keys {
+					peer.Zones[zoneName][key.(string)] = rlStateValue{Count: 1, OldestEvent: peer.Timestamp}
+				}
+				h.Distributed = &DistributedRateLimiting{otherStates: []rlState{peer}}
+			}
+
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				repl := caddy.NewReplacer()
+				req := httptest.NewRequest("GET", "/", nil)
+				req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl))
+				w := httptest.NewRecorder()
+
+				i := rand.IntN(len(keys))
+				for pb.Next() {
+					repl.Set("bench.key", keys[i%len(keys)])
+					if err := h.ServeHTTP(w, req, next); err != nil {
+						b.Errorf("request was not allowed: %v", err)
+						return
+					}
+					i++
+				}
+			})
+		})
+	}
+}
+
+func TestExemptByDefault(t *testing.T) {
+	for _, tc := range []struct {
+		method, target string
+		headers        map[string]string
+		expect         bool
+	}{
+		{method: "GET", target: "/healthz", expect: true},
+		{method: "GET", target: "/readyz/", expect: true},
+		{method: "GET", target: "/.well-known/acme-challenge/token", expect: true},
+		{method: "OPTIONS", target: "/api", headers: map[string]string{"Origin": "https://example.com", "Access-Control-Request-Method": "POST"}, expect: true},
+		{method: "OPTIONS", target: "/api", expect: false},
+		{method: "GET", target: "/api/healthz", expect: false},
+		{method: "POST", target: "/login", expect: false},
+	} {
+		req := httptest.NewRequest(tc.method, tc.target, nil)
+		for name, value := range tc.headers {
+			req.Header.Set(name, value)
+		}
+		if got := exemptByDefault(req); got != tc.expect {
+			t.Errorf("%s %s: expected exempt=%t, got %t", tc.method, tc.target, tc.expect, got)
+		}
+	}
+}
+
+func TestTenant(t *testing.T) {
+	// Admin API must be exposed on port 2999 to match what caddytest.Tester does
+	config := `{
+	"admin": {"listen": "localhost:2999"},
+	"apps": {
+		"http": {
+			"servers": {
+				"demo": {
+					"listen": [":8080"],
+					"routes": [{
+						"handle": [
+							{
+								"handler": "rate_limit",
+								"tenant": "{http.request.header.X-Tenant-ID}",
+								"rate_limits": [
+									{
+										"zone_name": "tenant_zone",
+										"key": "static",
+										"window": "60s",
+										"max_events": 1
+									}
+								]
+							},
+							{
+								"handler": "static_response",
+								"status_code": 200
+							}
+						]
+					}]
+				}
+			}
+		}
+	}
+}`
+
+	initTime()
+
+	tester := caddytest.NewTester(t)
+	tester.InitServer(config, "json")
+
+	request := func(tenant string) *http.Request {
+		req, _ := http.NewRequest(http.MethodGet, "http://localhost:8080", nil)
+		req.Header.Set("X-Tenant-ID", tenant)
+		return req
+	}
+
+	// tenants are limited in their own zones, with the same key
+	tester.AssertResponseCode(request("acme"), 200)
+	tester.AssertResponseCode(request("acme"), 429)
+	tester.AssertResponseCode(request("globex"), 200)
+
+	for _, name := range []string{"acme/tenant_zone", "globex/tenant_zone"} {
+		if _, ok := zoneLimiters(name); !ok {
+			t.Errorf("expected zone %s", name)
+		}
+	}
+	if _, ok := zoneLimiters("tenant_zone"); ok {
+		t.Error("expected no zone without the tenant")
+	}
+}
+
+func TestExceededPlaceholders(t *testing.T) {
+	// Admin API must be exposed on port 2999 to match what caddytest.Tester does
+	config := `{
+	"admin": {"listen": "localhost:2999"},
+	"apps": {
+		"http": {
+			"servers": {
+				"demo": {
+					"listen": [":8080"],
+					"routes": [{
+						"handle": [
+							{
+								"handler": "rate_limit",
+								"rate_limits": [
+									{
+										"zone_name": "exceeded_zone",
+										"key": "static",
+										"window": "60s",
+										"max_events": 1
+									}
+								]
+							},
+							{
+								"handler": "static_response",
+								"status_code": 200
+							}
+						]
+					}],
+					"errors": {
+						"routes": [{
+							"handle": [{
+								"handler": "static_response",
+								"status_code": "{http.error.status_code}",
+								"body": "{http.rate_limit.exceeded.name} {http.rate_limit.exceeded.key} {http.rate_limit.exceeded.remaining}/{http.rate_limit.exceeded.limit} {http.rate_limit.exceeded.reset} {http.rate_limit.exceeded.reset_ms}"
+							}]
+						}]
+					}
+				}
+			}
+		}
+	}
+}`
+
+	initTime()
+
+	tester := caddytest.NewTester(t)
+	tester.InitServer(config, "json")
+
+	tester.AssertGetResponse("http://localhost:8080", 200, "")
+	advanceTime(15)
+	resp, _ := tester.AssertGetResponse("http://localhost:8080", 429, "exceeded_zone static 0/1 45 45000")
+	if cacheControl := resp.Header.Get("Cache-Control"); cacheControl != "no-store" {
+		t.Errorf("expected the decline not to be stored by caches, got Cache-Control %q", cacheControl)
+	}
+}
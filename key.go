@@ -0,0 +1,160 @@
+package caddyrl
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// keyTemplate derives the keys of a zone's rate limiters from the zone's
+// configured key. Most keys are either static or a single placeholder,
+// such as the client IP; for those, the key is produced without building
+// a new string for every request, unlike a full placeholder replacement.
+type keyTemplate struct {
+	raw string
+
+	// true if raw contains no placeholders or escapes
+	static bool
+
+	// name of the placeholder that makes up all of raw, if any
+	placeholder string
+}
+
+// knownPlaceholderPrefixes are the namespaces of placeholders that are
+// available to HTTP handlers without plugins.
+var knownPlaceholderPrefixes = []string{"http.", "env.", "system.", "time.", "file.", "tls."}
+
+// unknownPlaceholders returns the names of the placeholders in key that are
+// not in a known namespace, which are probably typos (e.g. "{remote_host}",
+// which is only a shorthand in Caddyfiles). It returns an error if key has
+// unbalanced braces.
+func unknownPlaceholders(key string) ([]string, error) {
+	var unknown []string
+	start := -1
+	for i := 0; i < len(key); i++ {
+		switch key[i] {
+		case '\\':
+			i++ // skip the escaped character
+		case '{':
+			if start >= 0 {
+				return nil, fmt.Errorf("unclosed placeholder at position %d", start)
+			}
+			start = i
+		case '}':
+			if start < 0 {
+				return nil, fmt.Errorf("unopened placeholder at position %d", i)
+			}
+			name := key[start+1 : i]
+			if name == "" {
+				return nil, fmt.Errorf("empty placeholder at position %d", start)
+			}
+			known := false
+			for _, prefix := range knownPlaceholderPrefixes {
+				if strings.HasPrefix(name, prefix) {
+					known = true
+					break
+				}
+			}
+			if !known {
+				unknown = append(unknown, name)
+			}
+			start = -1
+		}
+	}
+	if start >= 0 {
+		return nil, fmt.Errorf("unclosed placeholder at position %d", start)
+	}
+	return unknown, nil
+}
+
+// varyHeaders returns the names of the request headers that key depends
+// on, for the Vary header of responses that differ by key.
+func varyHeaders(key string) []string {
+	var headers []string
+	for {
+		start := strings.IndexByte(key, '{')
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(key[start:], '}')
+		if end < 0 {
+			break
+		}
+		name := key[start+1 : start+end]
+		key = key[start+end+1:]
+
+		var header string
+		switch {
+		case strings.HasPrefix(name, "http.request.header."):
+			header = http.CanonicalHeaderKey(strings.TrimPrefix(name, "http.request.header."))
+		case strings.HasPrefix(name, "http.request.cookie."):
+			header = "Cookie"
+		default:
+			continue
+		}
+		if !slices.Contains(headers, header) {
+			headers = append(headers, header)
+		}
+	}
+	return headers
+}
+
+// expandEnv replaces the `{env.*}` placeholders in s with the values of
+// the environment variables, or empty strings if they are not set. Other
+// placeholders are kept.
+func expandEnv(s string) string {
+	const prefix = "{env."
+	if !strings.Contains(s, prefix) {
+		return s
+	}
+	var sb strings.Builder
+	for {
+		start := strings.Index(s, prefix)
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(s[start:], '}')
+		if end < 0 {
+			break
+		}
+		sb.WriteString(s[:start])
+		sb.WriteString(os.Getenv(s[start+len(prefix) : start+end]))
+		s = s[start+end+1:]
+	}
+	sb.WriteString(s)
+	return sb.String()
+}
+
+func newKeyTemplate(raw string) keyTemplate {
+	kt := keyTemplate{raw: raw}
+	if !strings.ContainsAny(raw, `{}\`) {
+		kt.static = true
+	} else if len(raw) > 2 && raw[0] == '{' && raw[len(raw)-1] == '}' &&
+		!strings.ContainsAny(raw[1:len(raw)-1], `{}\`) {
+		kt.placeholder = raw[1 : len(raw)-1]
+	}
+	return kt
+}
+
+// key returns the key for the request whose placeholders are in repl.
+// The result is the same as replacing all placeholders in the raw key,
+// with unknown placeholders replaced by empty strings.
+func (kt keyTemplate) key(repl *caddy.Replacer) string {
+	if kt.static {
+		return kt.raw
+	}
+	if kt.placeholder != "" {
+		val, ok := repl.Get(kt.placeholder)
+		if !ok {
+			return ""
+		}
+		if s, ok := val.(string); ok {
+			return s
+		}
+	}
+	return repl.ReplaceAll(kt.raw, "")
+}
@@ -0,0 +1,115 @@
+package caddyrl
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestKeyTemplate(t *testing.T) {
+	repl := caddy.NewReplacer()
+	repl.Set("client", "10.0.0.1")
+	repl.Set("tenant", "acme")
+	repl.Set("port", 8080)
+
+	for _, raw := range []string{
+		"",
+		"static",
+		"{client}",
+		"{tenant}:{client}",
+		"{port}",
+		"{unknown}",
+		"prefix-{client}",
+		`\{client\}`,
+		"{}",
+	} {
+		want := repl.ReplaceAll(raw, "")
+		if got := newKeyTemplate(raw).key(repl); got != want {
+			t.Errorf("key %q: expected %q, got %q", raw, want, got)
+		}
+	}
+}
+
+// BenchmarkKeyTemplate compares deriving keys with a full placeholder
+// replacement (before) and with a key template (after).
+func BenchmarkKeyTemplate(b *testing.B) {
+	repl := caddy.NewReplacer()
+	repl.Set("client", "10.0.0.1")
+	repl.Set("tenant", "acme")
+
+	for _, raw := range []string{"static", "{client}", "{tenant}:{client}"} {
+		b.Run("replace_all/"+raw, func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				repl.ReplaceAll(raw, "")
+			}
+		})
+		b.Run("template/"+raw, func(b *testing.B) {
+			kt := newKeyTemplate(raw)
+			b.ReportAllocs()
+			for b.Loop() {
+				kt.key(repl)
+			}
+		})
+	}
+}
+
+func TestUnknownPlaceholders(t *testing.T) {
+	unknown, err := unknownPlaceholders("{http.request.remote.host}:{remote_host}:{env.TENANT}")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(unknown) != 1 || unknown[0] != "remote_host" {
+		t.Fatalf("expected remote_host to be unknown, got %v", unknown)
+	}
+	if unknown, err := unknownPlaceholders(`static\{key\}`); err != nil || len(unknown) != 0 {
+		t.Fatalf("escaped braces are not placeholders, got %v, %v", unknown, err)
+	}
+	for _, key := range []string{"{http.request.remote.host", "host}", "{}", "{{http.vars.a}}"} {
+		if _, err := unknownPlaceholders(key); err == nil {
+			t.Errorf("expected error for key %q", key)
+		}
+	}
+}
+
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("RL_EVENTS", "100")
+	t.Setenv("RL_WINDOW", "1m")
+
+	if got := expandEnv("{env.RL_EVENTS}:{http.request.remote.host}:{env.RL_UNSET}"); got != "100:{http.request.remote.host}:" {
+		t.Errorf("unexpected expansion %q", got)
+	}
+
+	var rl RateLimit
+	err := json.Unmarshal([]byte(`{"key": "static", "max_events": "{env.RL_EVENTS}", "window": "{env.RL_WINDOW}"}`), &rl)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rl.Key != "static" || rl.MaxEvents != 100 || time.Duration(rl.Window) != time.Minute {
+		t.Fatalf("unexpected zone %+v", rl)
+	}
+
+	rl = RateLimit{}
+	if err := json.Unmarshal([]byte(`{"max_events": 5, "window": 1000000000}`), &rl); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rl.MaxEvents != 5 || time.Duration(rl.Window) != time.Second {
+		t.Fatalf("unexpected zone %+v", rl)
+	}
+
+	if err := json.Unmarshal([]byte(`{"max_events": "{env.RL_WINDOW}"}`), &rl); err == nil {
+		t.Fatal("expected error for a non-integer max_events")
+	}
+}
+
+func TestVaryHeaders(t *testing.T) {
+	headers := varyHeaders("{http.request.header.x-api-key}/{http.request.remote.host}/{http.request.cookie.session}/{http.request.header.X-Api-Key}")
+	if len(headers) != 2 || headers[0] != "X-Api-Key" || headers[1] != "Cookie" {
+		t.Errorf("unexpected headers: %v", headers)
+	}
+	if headers := varyHeaders("{http.request.remote.host}"); headers != nil {
+		t.Errorf("expected no headers, got %v", headers)
+	}
+}
@@ -0,0 +1,259 @@
+package caddyrl
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// KeyList is a list of keys and IP ranges that is loaded from a file or
+// URL and refreshed periodically, so that e.g. threat-intelligence feeds
+// and corporate allowlists stay current without config reloads.
+//
+// The list is either a JSON array of strings, or has one entry per line,
+// where only the first field of a line counts and empty lines and lines
+// starting with `#` or `;` are skipped. Entries that are IP addresses or
+// CIDR ranges match requests of clients in them; other entries match
+// the zone's key exactly.
+type KeyList struct {
+	// The path of a file, or an http:// or https:// URL, to load the
+	// list from. Required.
+	Source string `json:"source,omitempty"`
+
+	// How often the list is reloaded. URLs are requested with the ETag
+	// of their last response, and files are only read if they changed.
+	// If reloading fails, the last loaded list is kept. Default: 5m
+	RefreshInterval caddy.Duration `json:"refresh_interval,omitempty"`
+
+	client *http.Client
+	logger *zap.Logger
+
+	entries atomic.Pointer[keyListEntries]
+
+	// validators of the last load, used by the refresh goroutine only
+	etag    string
+	modTime time.Time
+}
+
+// keyListEntries are the parsed entries of a list.
+type keyListEntries struct {
+	keys     map[string]struct{}
+	prefixes []netip.Prefix
+}
+
+// maxKeyListSize is the maximum number of bytes of a list.
+const maxKeyListSize = 32 << 20
+
+// provision loads the list and keeps refreshing it until ctx is done.
+// A list that fails to load is empty until it loads.
+func (kl *KeyList) provision(ctx caddy.Context, logger *zap.Logger) error {
+	if kl.Source == "" {
+		return fmt.Errorf("source is required")
+	}
+	if kl.RefreshInterval < 0 {
+		return fmt.Errorf("refresh_interval must be at least zero")
+	}
+	if kl.RefreshInterval == 0 {
+		kl.RefreshInterval = caddy.Duration(5 * time.Minute)
+	}
+	kl.client = &http.Client{Timeout: 30 * time.Second}
+	kl.logger = logger.With(zap.String("source", kl.Source))
+	kl.entries.Store(new(keyListEntries))
+
+	if err := kl.load(ctx); err != nil {
+		kl.logger.Error("loading list", zap.Error(err))
+	}
+	go kl.run(ctx)
+
+	return nil
+}
+
+// run reloads the list every refresh interval until ctx is done.
+func (kl *KeyList) run(ctx context.Context) {
+	labelTask(ctx, "key_list_refresh")
+	ticker := time.NewTicker(time.Duration(kl.RefreshInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := kl.load(ctx); err != nil && ctx.Err() == nil {
+				kl.logger.Error("reloading list; keeping the last loaded list", zap.Error(err))
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// load loads the list from its source, unless it didn't change.
+func (kl *KeyList) load(ctx context.Context) error {
+	var body []byte
+	var err error
+	if strings.HasPrefix(kl.Source, "http://") || strings.HasPrefix(kl.Source, "https://") {
+		body, err = kl.fetch(ctx)
+	} else {
+		body, err = kl.read()
+	}
+	if err != nil || body == nil {
+		return err
+	}
+
+	entries, err := parseKeyList(body)
+	if err != nil {
+		return err
+	}
+	kl.entries.Store(entries)
+	kl.logger.Debug("loaded list",
+		zap.Int("keys", len(entries.keys)),
+		zap.Int("prefixes", len(entries.prefixes)))
+	return nil
+}
+
+// fetch returns the list at the source URL, or nil if it is unchanged.
+func (kl *KeyList) fetch(ctx context.Context) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, kl.Source, nil)
+	if err != nil {
+		return nil, err
+	}
+	if kl.etag != "" {
+		req.Header.Set("If-None-Match", kl.etag)
+	}
+
+	resp, err := kl.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	body, err := readKeyList(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	kl.etag = resp.Header.Get("ETag")
+	return body, nil
+}
+
+// read returns the list in the source file, or nil if it didn't change
+// since it was last read.
+func (kl *KeyList) read() ([]byte, error) {
+	file, err := os.Open(kl.Source)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.ModTime().Equal(kl.modTime) {
+		return nil, nil
+	}
+	body, err := readKeyList(file)
+	if err != nil {
+		return nil, err
+	}
+	kl.modTime = info.ModTime()
+	return body, nil
+}
+
+// readKeyList reads a list of at most maxKeyListSize bytes from r.
+func readKeyList(r io.Reader) ([]byte, error) {
+	body, err := io.ReadAll(io.LimitReader(r, maxKeyListSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxKeyListSize {
+		return nil, fmt.Errorf("list is larger than %d bytes", maxKeyListSize)
+	}
+	return body, nil
+}
+
+// parseKeyList parses a list in either of its formats.
+func parseKeyList(body []byte) (*keyListEntries, error) {
+	var values []string
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &values); err != nil {
+			return nil, fmt.Errorf("decoding JSON list: %v", err)
+		}
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(body))
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) == 0 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], ";") {
+				continue
+			}
+			values = append(values, fields[0])
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	entries := &keyListEntries{keys: make(map[string]struct{})}
+	for _, value := range values {
+		if prefix, err := netip.ParsePrefix(value); err == nil {
+			entries.prefixes = append(entries.prefixes, prefix.Masked())
+		} else if addr, err := netip.ParseAddr(value); err == nil {
+			entries.prefixes = append(entries.prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+		} else if value != "" {
+			entries.keys[value] = struct{}{}
+		}
+	}
+	return entries, nil
+}
+
+// matches returns true if key, or the IP address of the client of r,
+// is on the list. A nil list matches nothing.
+func (kl *KeyList) matches(r *http.Request, key string) bool {
+	if kl == nil {
+		return false
+	}
+	entries := kl.entries.Load()
+	if _, ok := entries.keys[key]; ok {
+		return true
+	}
+	if len(entries.prefixes) == 0 {
+		return false
+	}
+	addr, err := netip.ParseAddr(clientIPOf(r))
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range entries.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIPOf returns the IP address of the client of r, as determined
+// by the server's trusted proxies, or else the remote IP.
+func clientIPOf(r *http.Request) string {
+	if clientIP, ok := caddyhttp.GetVar(r.Context(), caddyhttp.ClientIPVarKey).(string); ok && clientIP != "" {
+		return clientIP
+	}
+	return remoteIPOf(r)
+}
@@ -0,0 +1,133 @@
+package caddyrl
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func TestParseKeyList(t *testing.T) {
+	for _, tc := range []struct {
+		body     string
+		keys     int
+		prefixes int
+	}{
+		{body: "# threat feed\n10.0.0.0/8 ; SBL1\n\n192.0.2.1\ntoken-abc\n", keys: 1, prefixes: 2},
+		{body: `["2001:db8::/32", "tenant one"]`, keys: 1, prefixes: 1},
+		{body: "", keys: 0, prefixes: 0},
+	} {
+		entries, err := parseKeyList([]byte(tc.body))
+		if err != nil {
+			t.Fatalf("parsing %q: %v", tc.body, err)
+		}
+		if len(entries.keys) != tc.keys || len(entries.prefixes) != tc.prefixes {
+			t.Fatalf("parsing %q: got %d keys and %d prefixes (wanted %d and %d)",
+				tc.body, len(entries.keys), len(entries.prefixes), tc.keys, tc.prefixes)
+		}
+	}
+
+	if _, err := parseKeyList([]byte(`["unterminated`)); err == nil {
+		t.Fatal("expected error for invalid JSON list")
+	}
+}
+
+func TestKeyListMatches(t *testing.T) {
+	entries, err := parseKeyList([]byte("10.0.0.0/8\ntoken-abc\n"))
+	if err != nil {
+		t.Fatalf("parsing list: %v", err)
+	}
+	kl := new(KeyList)
+	kl.entries.Store(entries)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.1.2.3:1234"
+	if !kl.matches(req, "other") {
+		t.Fatal("expected client in listed range to match")
+	}
+	req.RemoteAddr = "192.0.2.1:1234"
+	if kl.matches(req, "other") {
+		t.Fatal("expected client outside listed ranges not to match")
+	}
+	if !kl.matches(req, "token-abc") {
+		t.Fatal("expected listed key to match")
+	}
+	if (*KeyList)(nil).matches(req, "token-abc") {
+		t.Fatal("expected nil list to match nothing")
+	}
+}
+
+func TestKeyListRefresh(t *testing.T) {
+	var requests, notModified atomic.Int32
+	var list atomic.Value
+	list.Store("token-abc\n")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		body := list.Load().(string)
+		etag := `"` + strings.TrimSpace(body) + `"`
+		if r.Header.Get("If-None-Match") == etag {
+			notModified.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: t.Context()})
+	defer cancel()
+	req := httptest.NewRequest("GET", "/", nil)
+
+	kl := &KeyList{Source: srv.URL, RefreshInterval: caddy.Duration(time.Hour)}
+	if err := kl.provision(ctx, zap.NewNop()); err != nil {
+		t.Fatalf("provisioning list: %v", err)
+	}
+	if !kl.matches(req, "token-abc") {
+		t.Fatal("expected key of loaded list to match")
+	}
+
+	if err := kl.load(ctx); err != nil {
+		t.Fatalf("reloading list: %v", err)
+	}
+	if notModified.Load() != 1 {
+		t.Fatalf("expected unchanged list to be requested with its ETag (requests: %d)", requests.Load())
+	}
+
+	list.Store("token-def\n")
+	if err := kl.load(ctx); err != nil {
+		t.Fatalf("reloading list: %v", err)
+	}
+	if kl.matches(req, "token-abc") || !kl.matches(req, "token-def") {
+		t.Fatal("expected reloaded list to replace the last one")
+	}
+
+	// failing reloads keep the last list
+	srv.Close()
+	if err := kl.load(ctx); err == nil {
+		t.Fatal("expected error reloading from closed server")
+	}
+	if !kl.matches(req, "token-def") {
+		t.Fatal("expected failed reload to keep the last list")
+	}
+
+	// files are read
+	path := filepath.Join(t.TempDir(), "list.txt")
+	if err := os.WriteFile(path, []byte(`["token-ghi"]`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	kl = &KeyList{Source: path}
+	if err := kl.provision(ctx, zap.NewNop()); err != nil {
+		t.Fatalf("provisioning list: %v", err)
+	}
+	if !kl.matches(req, "token-ghi") {
+		t.Fatal("expected key of file list to match")
+	}
+}
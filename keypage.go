@@ -0,0 +1,200 @@
+package caddyrl
+
+import (
+	"cmp"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// Limits of the number of keys in a page of the key list
+const (
+	defaultKeyPageLimit = 100
+	maxKeyPageLimit     = 1000
+)
+
+// keyPageOrders are the orders in which the key list can be sorted,
+// by the value of the sort query parameter. Ties are broken by key.
+var keyPageOrders = map[string]func(a, b keyPageEntry) int{
+	// most events first
+	"events": func(a, b keyPageEntry) int { return cmp.Compare(b.Events, a.Events) },
+	// most recently seen first
+	"last_seen": func(a, b keyPageEntry) int { return b.LastSeen.Compare(a.LastSeen) },
+	"key":       func(a, b keyPageEntry) int { return 0 },
+}
+
+// keyPageEntry describes a key in the key list.
+type keyPageEntry struct {
+	Key       string    `json:"key"`
+	Events    int       `json:"events"`
+	Remaining int       `json:"remaining"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// keyPage is a page of the key list.
+type keyPage struct {
+	// Number of keys that match the filters, on all pages.
+	Total int            `json:"total"`
+	Keys  []keyPageEntry `json:"keys"`
+
+	// The cursor of the next page; empty on the last page.
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// keyPageQuery is a parsed query for the key list.
+type keyPageQuery struct {
+	prefix     string
+	minEvents  int
+	seenWithin time.Duration
+	order      func(a, b keyPageEntry) int
+	limit      int
+
+	// the last entry of the previous page, if any
+	after *keyPageEntry
+}
+
+// handleKeyPages lists the keys of a zone with events in the current
+// window, one page at a time. The query string filters keys by
+// `prefix`, by their number of events (`min_events`) and by how
+// recently they were seen (`seen_within`), sorts them by `events`
+// (the default), `last_seen` or `key`, and limits the page to `limit`
+// keys; the `cursor` of the previous page's `next_cursor` gets the
+// next page. Cursors are positions in the order, so keys whose events
+// change between pages may be skipped or listed twice. Only this
+// instance's state is considered.
+func handleKeyPages(w http.ResponseWriter, r *http.Request, rlm *rateLimitersMap) error {
+	query, err := parseKeyPageQuery(r)
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        err,
+		}
+	}
+
+	ref := now()
+	maxEvents, _ := rlm.limits()
+	var entries []keyPageEntry
+	rlm.forEach(func(key string, limiter *ringBufferRateLimiter) {
+		if !strings.HasPrefix(key, query.prefix) {
+			return
+		}
+		count, _ := limiter.Count(ref)
+		if count == 0 || count < query.minEvents {
+			return
+		}
+		lastSeen := limiter.lastEvent()
+		if query.seenWithin > 0 && ref.Sub(lastSeen) > query.seenWithin {
+			return
+		}
+		entries = append(entries, keyPageEntry{
+			Key:       key,
+			Events:    count,
+			Remaining: max(maxEvents-count, 0),
+			LastSeen:  lastSeen,
+		})
+	})
+
+	compare := func(a, b keyPageEntry) int {
+		if c := query.order(a, b); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Key, b.Key)
+	}
+	slices.SortFunc(entries, compare)
+
+	list := keyPage{Total: len(entries), Keys: []keyPageEntry{}}
+	if query.after != nil {
+		start, _ := slices.BinarySearchFunc(entries, *query.after, compare)
+		if start < len(entries) && compare(entries[start], *query.after) == 0 {
+			start++
+		}
+		entries = entries[start:]
+	}
+	if len(entries) > query.limit {
+		entries = entries[:query.limit]
+		list.NextCursor = encodeKeyPageCursor(entries[len(entries)-1])
+	}
+	list.Keys = append(list.Keys, entries...)
+	return writeAdminJSON(w, list)
+}
+
+// parseKeyPageQuery parses the query string of a key list request.
+func parseKeyPageQuery(r *http.Request) (keyPageQuery, error) {
+	values := r.URL.Query()
+	query := keyPageQuery{
+		prefix: values.Get("prefix"),
+		order:  keyPageOrders["events"],
+		limit:  defaultKeyPageLimit,
+	}
+	if value := values.Get("min_events"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return query, fmt.Errorf("invalid min_events '%s'", value)
+		}
+		query.minEvents = n
+	}
+	if value := values.Get("seen_within"); value != "" {
+		d, err := caddy.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return query, fmt.Errorf("invalid seen_within '%s'", value)
+		}
+		query.seenWithin = d
+	}
+	if value := values.Get("sort"); value != "" {
+		order, ok := keyPageOrders[value]
+		if !ok {
+			return query, fmt.Errorf("invalid sort '%s': must be events, last_seen or key", value)
+		}
+		query.order = order
+	}
+	if value := values.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxKeyPageLimit {
+			return query, fmt.Errorf("invalid limit '%s': must be between 1 and %d", value, maxKeyPageLimit)
+		}
+		query.limit = n
+	}
+	if value := values.Get("cursor"); value != "" {
+		after, err := decodeKeyPageCursor(value)
+		if err != nil {
+			return query, fmt.Errorf("invalid cursor '%s'", value)
+		}
+		query.after = &after
+	}
+	return query, nil
+}
+
+// encodeKeyPageCursor returns the cursor of the page after entry, which
+// holds what the orders compare: its events, when it was last seen and
+// its key.
+func encodeKeyPageCursor(entry keyPageEntry) string {
+	cursor := strconv.Itoa(entry.Events) + ":" + strconv.FormatInt(unixNano(entry.LastSeen), 10) + ":" + entry.Key
+	return base64.RawURLEncoding.EncodeToString([]byte(cursor))
+}
+
+// decodeKeyPageCursor returns the entry that a cursor is positioned at.
+func decodeKeyPageCursor(cursor string) (keyPageEntry, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return keyPageEntry{}, err
+	}
+	parts := strings.SplitN(string(raw), ":", 3)
+	if len(parts) != 3 {
+		return keyPageEntry{}, fmt.Errorf("malformed cursor")
+	}
+	events, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return keyPageEntry{}, err
+	}
+	lastSeen, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return keyPageEntry{}, err
+	}
+	return keyPageEntry{Key: parts[2], Events: events, LastSeen: fromUnixNano(lastSeen)}, nil
+}
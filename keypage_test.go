@@ -0,0 +1,87 @@
+package caddyrl
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestAdminKeyPages(t *testing.T) {
+	initTime()
+
+	rlm := newTestZone(t, "admin_zone_key_pages", 10, time.Minute)
+	for i, key := range []string{"a", "b", "c", "d", "e"} {
+		advanceTime(i)
+		for range i + 1 {
+			rlm.getOrInsert(key).When()
+		}
+	}
+	advanceTime(10)
+
+	list := func(query string) keyPage {
+		t.Helper()
+		rec, errStatus := serveAdmin(t, http.MethodGet, "/rate_limit/zones/admin_zone_key_pages/keys"+query)
+		if errStatus != 0 {
+			t.Fatalf("%s: unexpected error status %d", query, errStatus)
+		}
+		var page keyPage
+		if err := json.NewDecoder(rec.Body).Decode(&page); err != nil {
+			t.Fatalf("decoding response: %v", err)
+		}
+		return page
+	}
+	keys := func(page keyPage) []string {
+		var keys []string
+		for _, entry := range page.Keys {
+			keys = append(keys, entry.Key)
+		}
+		return keys
+	}
+
+	page := list("")
+	if page.Total != 5 || len(page.Keys) != 5 || page.NextCursor != "" {
+		t.Fatalf("expected all keys on one page, got %+v", page)
+	}
+	if first := page.Keys[0]; first.Key != "e" || first.Events != 5 || first.Remaining != 5 {
+		t.Errorf("expected the busiest key first, got %+v", first)
+	}
+
+	// filters
+	if page := list("?min_events=4"); page.Total != 2 {
+		t.Errorf("expected 2 keys with at least 4 events, got %v", keys(page))
+	}
+	if page := list("?seen_within=7s&sort=last_seen"); page.Total != 2 || keys(page)[0] != "e" {
+		t.Errorf("expected the 2 most recently seen keys, got %v", keys(page))
+	}
+	if page := list("?prefix=c"); page.Total != 1 || keys(page)[0] != "c" {
+		t.Errorf("expected the key with the prefix, got %v", keys(page))
+	}
+
+	// pages continue where the previous one ended
+	var all []string
+	page = list("?sort=key&limit=2")
+	for {
+		all = append(all, keys(page)...)
+		if page.NextCursor == "" {
+			break
+		}
+		if len(all) > 5 {
+			t.Fatalf("expected pagination to end, got %v", all)
+		}
+		page = list("?sort=key&limit=2&cursor=" + page.NextCursor)
+	}
+	if got := len(all); got != 5 || all[0] != "a" || all[4] != "e" {
+		t.Errorf("expected all keys in order across pages, got %v", all)
+	}
+	page = list("?limit=2")
+	if next := list("?limit=2&cursor=" + page.NextCursor); keys(next)[0] != "c" {
+		t.Errorf("expected the second page by events to start with c, got %v", keys(next))
+	}
+
+	for _, query := range []string{"?sort=size", "?limit=0", "?limit=5000", "?min_events=-1", "?seen_within=soon", "?cursor=%21"} {
+		if _, errStatus := serveAdmin(t, http.MethodGet, "/rate_limit/zones/admin_zone_key_pages/keys"+query); errStatus != http.StatusBadRequest {
+			t.Errorf("%s: expected bad request, got %d", query, errStatus)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package caddyrl
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// KeySlowStart ramps the limit of each key that a zone hasn't seen
+// before up from a fraction of the zone's limit to its full value, so
+// that scrapers that burst as soon as they arrive get only a trickle,
+// while steady clients, which rarely need their full limit right away,
+// are unaffected. Unlike a greylist, which holds new keys to a fixed
+// provisional limit, the limit grows steadily.
+//
+// Like with greylists, a key is new when the zone has no state for it.
+type KeySlowStart struct {
+	// Duration over which the limit of a new key ramps up to the zone's
+	// limit. Required.
+	Duration caddy.Duration `json:"duration,omitempty"`
+
+	// Fraction of the zone's limit that new keys start with, at least 0
+	// and less than 1; keys get at least one event. Default: 0.1
+	Factor float64 `json:"factor,omitempty"`
+}
+
+// provision sets the defaults and validates the slow start.
+func (ks *KeySlowStart) provision() error {
+	if ks.Factor == 0 {
+		ks.Factor = 0.1
+	}
+	if ks.Factor < 0 || ks.Factor >= 1 {
+		return fmt.Errorf("factor must be at least 0 and less than 1")
+	}
+	if ks.Duration <= 0 {
+		return fmt.Errorf("duration must be greater than zero")
+	}
+	return nil
+}
+
+// limit returns the limit of a key elapsed after the zone first saw it,
+// if the zone allows maxEvents events per window.
+func (ks *KeySlowStart) limit(maxEvents int, elapsed time.Duration) int {
+	ramp := min(float64(elapsed)/float64(ks.Duration), 1)
+	return max(int(float64(maxEvents)*(ks.Factor+(1-ks.Factor)*ramp)), 1)
+}
+
+// wait returns how long the key with the given rate limiter has to
+// wait before an event of the given cost fits into its ramping limit,
+// or zero if it fits or the key's limit has ramped up fully.
+func (ks *KeySlowStart) wait(rlm *rateLimitersMap, key string, limiter *ringBufferRateLimiter, maxEvents, cost int) time.Duration {
+	since, ok := rlm.since(key)
+	ref := now()
+	duration := time.Duration(ks.Duration)
+	elapsed := ref.Sub(since)
+	if !ok || elapsed >= duration {
+		return 0
+	}
+
+	count, oldest := limiter.Count(ref)
+	if count+cost <= ks.limit(maxEvents, elapsed) {
+		return 0
+	}
+
+	// the event fits once the limit has ramped up far enough, or when
+	// enough events left the window, whichever comes first
+	ramped := duration
+	if need := float64(count+cost) / float64(maxEvents); need <= 1 {
+		ramped = time.Duration((need - ks.Factor) / (1 - ks.Factor) * float64(duration))
+	}
+	wait := since.Add(ramped).Sub(ref)
+	if count > 0 {
+		_, window := rlm.limits()
+		wait = min(wait, oldest.Add(window).Sub(ref))
+	}
+	// rounding may put the ramp right at the limit
+	return max(wait, time.Millisecond)
+}
@@ -0,0 +1,94 @@
+package caddyrl
+
+import (
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestKeySlowStart(t *testing.T) {
+	ks := &KeySlowStart{Duration: caddy.Duration(5 * time.Minute)}
+	if err := ks.provision(); err != nil {
+		t.Fatal(err)
+	}
+	for elapsed, want := range map[time.Duration]int{
+		0:                 100 / 10,
+		time.Minute:       28,
+		150 * time.Second: 55,
+		5 * time.Minute:   100,
+		time.Hour:         100,
+	} {
+		if got := ks.limit(100, elapsed); got != want {
+			t.Errorf("after %s: expected a limit of %d, got %d", elapsed, want, got)
+		}
+	}
+	if got := ks.limit(5, 0); got != 1 {
+		t.Errorf("expected new keys to get at least 1 event, got %d", got)
+	}
+
+	for _, bad := range []*KeySlowStart{{}, {Duration: caddy.Duration(time.Minute), Factor: 1}, {Duration: caddy.Duration(time.Minute), Factor: -0.5}} {
+		if err := bad.provision(); err == nil {
+			t.Errorf("expected an error for %+v", bad)
+		}
+	}
+}
+
+func TestKeySlowStartLimit(t *testing.T) {
+	initTime()
+
+	rl := &RateLimit{
+		ZoneName:     "key_slow_start_zone",
+		Key:          "{http.request.remote.host}",
+		Window:       caddy.Duration(time.Hour),
+		MaxEvents:    100,
+		KeySlowStart: &KeySlowStart{Duration: caddy.Duration(10 * time.Minute)},
+	}
+	h := newTestHandler(t, rl)
+	allowed := func(n int) int {
+		t.Helper()
+		var allowed int
+		for range n {
+			if allowedBy(t, h, newTestRequest("GET", "/", map[string]string{"http.request.remote.host": "192.0.2.1"})) {
+				allowed++
+			}
+		}
+		return allowed
+	}
+
+	if n := allowed(50); n != 10 {
+		t.Errorf("expected a new key to start with 10 events, got %d", n)
+	}
+	advanceTime(5 * 60)
+	if n := allowed(50); n != 45 {
+		t.Errorf("expected the limit to have ramped up to 55 halfway, got %d more allowed", n)
+	}
+	advanceTime(10 * 60)
+	if n := allowed(50); n != 45 {
+		t.Errorf("expected the full limit once ramped up, got %d more allowed", n)
+	}
+}
+
+func TestCaddyfileKeySlowStart(t *testing.T) {
+	var h Handler
+	if err := h.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`rate_limit {
+		zone api {
+			events         100
+			window         1m
+			key_slow_start 5m 0.2
+		}
+	}`)); err != nil {
+		t.Fatalf("unmarshaling Caddyfile: %v", err)
+	}
+	if ks := h.RateLimits[0].KeySlowStart; ks == nil || ks.Duration != caddy.Duration(5*time.Minute) || ks.Factor != 0.2 {
+		t.Errorf("unexpected key_slow_start: %+v", ks)
+	}
+
+	for _, slowStart := range []string{"key_slow_start", "key_slow_start soon", "key_slow_start 5m lots", "key_slow_start 5m 0.1 2"} {
+		var bad Handler
+		if err := bad.UnmarshalCaddyfile(caddyfile.NewTestDispenser("rate_limit {\n\tzone api {\n\t\t" + slowStart + "\n\t}\n}")); err == nil {
+			t.Errorf("expected an error for %q", slowStart)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package caddyrl
+
+import (
+	"time"
+)
+
+// keyUsage is the recent usage of a key in a zone with usage_history,
+// per window-long period, for the usage endpoint of the admin API.
+type keyUsage struct {
+	// a ring of the key's periods, by period number modulo its length
+	periods []usagePeriod
+}
+
+// usagePeriod counts the events of a key in one period.
+type usagePeriod struct {
+	n        int64 // of the period since the epoch, in windows
+	allowed  int64
+	declined int64
+}
+
+// setUsageHistory makes the zone keep the usage of its keys in the
+// current period and in as many previous ones as history, each as long as
+// window. The usage is forgotten if either changes.
+func (rlm *rateLimitersMap) setUsageHistory(history int, window time.Duration) {
+	rlm.usageMu.Lock()
+	defer rlm.usageMu.Unlock()
+	if history == rlm.usageHistory && window == rlm.usageWindow {
+		return
+	}
+	rlm.usageHistory, rlm.usageWindow = history, window
+	rlm.usage = nil
+	if history > 0 {
+		rlm.usage = make(map[string]*keyUsage)
+	}
+}
+
+// usagePeriodAt returns the number of the period at ref.
+func (rlm *rateLimitersMap) usagePeriodAt(ref time.Time) int64 {
+	return unixNano(ref) / int64(max(rlm.usageWindow, 1))
+}
+
+// recordUsage counts allowed and declined events of key, if the zone
+// keeps a usage history.
+func (rlm *rateLimitersMap) recordUsage(key string, allowed, declined int) {
+	rlm.usageMu.Lock()
+	defer rlm.usageMu.Unlock()
+	if rlm.usage == nil {
+		return
+	}
+	ku, ok := rlm.usage[key]
+	if !ok {
+		ku = &keyUsage{periods: make([]usagePeriod, rlm.usageHistory+1)}
+		rlm.usage[key] = ku
+	}
+	n := rlm.usagePeriodAt(now())
+	period := &ku.periods[n%int64(len(ku.periods))]
+	if period.n != n {
+		*period = usagePeriod{n: n}
+	}
+	period.allowed += int64(allowed)
+	period.declined += int64(declined)
+}
+
+// usageOf returns the usage of key in the current period and the
+// previous ones that the history keeps, newest first, including periods
+// without events.
+func (rlm *rateLimitersMap) usageOf(key string) []usageStatus {
+	rlm.usageMu.Lock()
+	defer rlm.usageMu.Unlock()
+	if rlm.usage == nil {
+		return nil
+	}
+	ku := rlm.usage[key]
+	current := rlm.usagePeriodAt(now())
+	statuses := make([]usageStatus, 0, rlm.usageHistory+1)
+	for n := current; n >= current-int64(rlm.usageHistory); n-- {
+		status := usageStatus{
+			Start: fromUnixNano(n * int64(rlm.usageWindow)).UTC(),
+			End:   fromUnixNano((n + 1) * int64(rlm.usageWindow)).UTC(),
+		}
+		if ku != nil {
+			if period := ku.periods[n%int64(len(ku.periods))]; period.n == n {
+				status.Allowed, status.Declined = period.allowed, period.declined
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// sweepUsage forgets the usage of keys without events in the periods
+// that the history keeps.
+func (rlm *rateLimitersMap) sweepUsage() {
+	rlm.usageMu.Lock()
+	defer rlm.usageMu.Unlock()
+	if rlm.usage == nil {
+		return
+	}
+	oldest := rlm.usagePeriodAt(now()) - int64(rlm.usageHistory)
+	for key, ku := range rlm.usage {
+		var recent bool
+		for _, period := range ku.periods {
+			if period.n >= oldest && (period.allowed > 0 || period.declined > 0) {
+				recent = true
+				break
+			}
+		}
+		if !recent {
+			delete(rlm.usage, key)
+		}
+	}
+}
+
+// usageStatus is the usage of a key in a period in admin API responses.
+type usageStatus struct {
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Allowed  int64     `json:"allowed"`
+	Declined int64     `json:"declined"`
+}
@@ -0,0 +1,73 @@
+package caddyrl
+
+import (
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestUsageHistory(t *testing.T) {
+	initTime()
+
+	rlm := newRateLimiterMap()
+	rlm.recordUsage("tenant", 1, 0)
+	if usage := rlm.usageOf("tenant"); usage != nil {
+		t.Fatalf("expected no usage without a history, got %+v", usage)
+	}
+
+	rlm.setUsageHistory(1, time.Minute)
+	rlm.recordUsage("tenant", 3, 0)
+	advanceTime(60)
+	rlm.recordUsage("tenant", 1, 2)
+	usage := rlm.usageOf("tenant")
+	if len(usage) != 2 || usage[0].Allowed != 1 || usage[0].Declined != 2 || usage[1].Allowed != 3 {
+		t.Fatalf("unexpected usage: %+v", usage)
+	}
+
+	// the ring reuses the slots of windows that left the history
+	advanceTime(180)
+	rlm.recordUsage("tenant", 5, 0)
+	usage = rlm.usageOf("tenant")
+	if usage[0].Allowed != 5 || usage[1].Allowed != 0 || usage[1].Declined != 0 {
+		t.Errorf("expected old windows to be overwritten: %+v", usage)
+	}
+
+	// changing the window forgets the usage
+	rlm.setUsageHistory(1, time.Hour)
+	if usage := rlm.usageOf("tenant"); usage[0].Allowed != 0 {
+		t.Errorf("expected the usage to be forgotten, got %+v", usage)
+	}
+}
+
+func TestCaddyfileUsageHistory(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`
+	rate_limit {
+		zone api {
+			key           {http.request.header.X-Api-Key}
+			window        1h
+			events        1000
+			usage_history 24
+		}
+	}`)
+
+	var h Handler
+	if err := h.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshaling Caddyfile: %v", err)
+	}
+	if n := h.RateLimits[0].UsageHistory; n != 24 {
+		t.Errorf("expected a usage history of 24 windows, got %d", n)
+	}
+
+	var bad Handler
+	if err := bad.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`rate_limit {
+		zone api {
+			key static
+			window 1h
+			events 1000
+			usage_history day
+		}
+	}`)); err == nil {
+		t.Error("expected an error for an invalid usage history")
+	}
+}
@@ -0,0 +1,140 @@
+package caddyrl
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+	"slices"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	aggregationInstances = "instances"
+	aggregationLeader    = "leader"
+)
+
+// aggregateStorageKey is where the leader publishes the aggregate of
+// all instances' states.
+const aggregateStorageKey = "rate_limit/aggregate.rlstate"
+
+// rlAggregate is the state of all instances of a cluster, as last read
+// by its leader, along with the leader's own.
+type rlAggregate struct {
+	// The version of the format, as of rlState.
+	Version, MinVersion int
+
+	// When the aggregate was published.
+	Timestamp time.Time
+
+	// The instance that published it.
+	Leader string
+
+	States []rlState
+}
+
+// publishAggregate elects the leader of the cluster, which is the
+// instance with the lowest ID among those that are active, i.e. among
+// this instance and the active ones of otherStates. Every instance
+// comes to the same result from the states in storage, so no locks or
+// votes are needed. If this instance is the leader, it publishes
+// otherStates and its own state as the aggregate, so that the other
+// instances read one value instead of one per instance.
+func (h Handler) publishAggregate(ctx context.Context, otherStates []rlState) error {
+	leader := h.Distributed.instanceID
+	for _, state := range otherStates {
+		if h.Distributed.isActive(state, now()) && state.InstanceID < leader {
+			leader = state.InstanceID
+		}
+	}
+	wasLeading := h.Distributed.leading.Swap(leader == h.Distributed.instanceID)
+	if leader != h.Distributed.instanceID {
+		if wasLeading {
+			h.logger.Info("stepping down as leader of distributed rate limiting", zap.String("leader", leader))
+		}
+		return nil
+	}
+	if !wasLeading {
+		h.logger.Info("leading distributed rate limiting", zap.String("instance_id", leader))
+	}
+
+	aggregate := rlAggregate{
+		Version:    rlStateVersion,
+		MinVersion: rlStateMinVersion,
+		Timestamp:  now(),
+		Leader:     leader,
+		States:     append(slices.Clip(otherStates), h.localState()),
+	}
+	buf := gobBufPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer gobBufPool.Put(buf)
+	if err := encodeState(buf, aggregate, h.Distributed.Compression); err != nil {
+		return err
+	}
+	return h.storage.Store(ctx, aggregateStorageKey, buf.Bytes())
+}
+
+// readAggregate returns the states of other instances from the leader's
+// aggregate, and true; or false if there is no current aggregate, in
+// which case the states must be read from each instance. An aggregate
+// isn't current if the leader stopped publishing it, or if this
+// instance has a lower ID and so takes over as leader, unless it only
+// observes the cluster.
+func (h Handler) readAggregate(ctx context.Context) ([]rlState, bool, error) {
+	modified := h.Distributed.modifiedBeforeLoad(ctx, h.storage, aggregateStorageKey)
+	encoded, err := h.storage.Load(ctx, aggregateStorageKey)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	aggregate, err := decodeState[rlAggregate](encoded)
+	if err != nil {
+		h.logger.Error("corrupted rate limiter aggregate", zap.Error(err))
+		return nil, false, nil
+	}
+	// the leader already corrected the states for the clocks of their
+	// instances, so they only need correcting for its own
+	delta := h.Distributed.clockDelta(ctx, h.storage, aggregateStorageKey, aggregate.Timestamp, modified)
+	aggregate.Timestamp = aggregate.Timestamp.Add(delta)
+	if now().Sub(aggregate.Timestamp) > h.Distributed.staleAfter() || (h.Distributed.instanceID < aggregate.Leader && !h.Distributed.Observe) {
+		return nil, false, nil
+	}
+	if aggregate.MinVersion > rlStateVersion {
+		// a newer leader's aggregate, so read what can be interpreted
+		// directly
+		return nil, false, nil
+	}
+
+	otherStates := make([]rlState, 0, len(aggregate.States))
+	for _, state := range aggregate.States {
+		if state.InstanceID == h.Distributed.instanceID {
+			continue
+		}
+		if err := migrateState(&state); err != nil {
+			h.logger.Error("unsupported rate limiter state in aggregate",
+				zap.String("instance_id", state.InstanceID),
+				zap.Error(err))
+			continue
+		}
+		if err := validateRateLimitState(state); err != nil {
+			h.logger.Error("corrupted rate limiter state in aggregate",
+				zap.String("instance_id", state.InstanceID),
+				zap.Error(err))
+			continue
+		}
+		shiftState(&state, delta)
+		h.Distributed.clampState(&state, now())
+		// the aggregate may be older than what was read before, e.g.
+		// directly while the leader was being elected
+		if last, ok := h.Distributed.lastState(state.InstanceID); ok {
+			state = newerState(state, last)
+		}
+		otherStates = append(otherStates, state)
+	}
+	return otherStates, true, nil
+}
@@ -0,0 +1,83 @@
+package caddyrl
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/certmagic"
+)
+
+func TestLeaderAggregation(t *testing.T) {
+	initTime()
+	const zone, key = "aggregation", "client"
+	const window = time.Minute
+	storage := &failingStorage{Storage: &certmagic.FileStorage{Path: t.TempDir()}}
+
+	var instances []*distributedTestInstance
+	for i, id := range []string{"a", "b", "c"} {
+		inst := newDistributedTestInstance(t, id, storage, 10, window)
+		inst.handler.Distributed.WriteInterval = caddy.Duration(5 * time.Second)
+		inst.handler.Distributed.Aggregation = aggregationLeader
+		limiter := inst.limiters.getOrInsert(key)
+		for range i {
+			limiter.When()
+		}
+		instances = append(instances, inst)
+	}
+	leader, follower := instances[0], instances[1]
+
+	for range 2 {
+		for _, inst := range instances {
+			inst.sync(t, zone)
+		}
+	}
+	if !leader.handler.Distributed.leading.Load() || follower.handler.Distributed.leading.Load() {
+		t.Fatal("expected the instance with the lowest ID to lead")
+	}
+	for i, inst := range instances {
+		if count := inst.count(zone, key, window); count != 3 {
+			t.Errorf("instance %d: expected 3 events across the cluster, got %d", i, count)
+		}
+	}
+
+	// followers only load the aggregate
+	storage.failList = true
+	if err := follower.handler.syncDistributedRead(context.Background()); err != nil {
+		t.Errorf("expected the follower to read the aggregate only, got %v", err)
+	}
+	if err := leader.handler.syncDistributedRead(context.Background()); err == nil {
+		t.Error("expected the leader to read every instance's state")
+	}
+	storage.failList = false
+
+	// when the leader stops publishing, the next instance takes over
+	advanceTime(20)
+	follower.sync(t, zone)
+	if !follower.handler.Distributed.leading.Load() {
+		t.Fatal("expected a follower to lead after the leader went away")
+	}
+
+	// and hands the lead back once the leader returns
+	leader.sync(t, zone)
+	follower.sync(t, zone)
+	if !leader.handler.Distributed.leading.Load() || follower.handler.Distributed.leading.Load() {
+		t.Error("expected the returning instance with the lowest ID to lead again")
+	}
+}
+
+func TestCaddyfileAggregation(t *testing.T) {
+	var h Handler
+	if err := h.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`rate_limit {
+		distributed {
+			aggregation leader
+		}
+	}`)); err != nil {
+		t.Fatalf("unmarshaling Caddyfile: %v", err)
+	}
+	if h.Distributed.Aggregation != aggregationLeader {
+		t.Errorf("unexpected aggregation: %q", h.Distributed.Aggregation)
+	}
+}
@@ -0,0 +1,175 @@
+package caddyrl
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"runtime/metrics"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// LoadShedding tightens the event limits of all zones while the process
+// is under pressure, so that the rate limiter admits less work when the
+// instance is overloaded, whatever the cause. The process is under
+// pressure while any of the thresholds that are set is crossed.
+type LoadShedding struct {
+	// Fraction of the available CPU time (as per GOMAXPROCS) that the
+	// process may use, between 0 and 1. Default: 0 (not considered)
+	MaxCPU float64 `json:"max_cpu,omitempty"`
+
+	// Number of bytes of memory that the process may have obtained from
+	// the operating system. Default: 0 (not considered)
+	MaxMemory int64 `json:"max_memory,omitempty"`
+
+	// Number of goroutines that the process may run, which grows with the
+	// number of requests in flight. Default: 0 (not considered)
+	MaxGoroutines int `json:"max_goroutines,omitempty"`
+
+	// Factor by which the event limits of all zones are multiplied while
+	// the process is under pressure, between 0 and 1 (exclusive). It is
+	// applied on top of clamps of the admin API. Default: 0.5
+	Factor float64 `json:"factor,omitempty"`
+
+	// How often the process's usage is measured. Limits tighten and
+	// relax at most this often. Default: 5s
+	Interval caddy.Duration `json:"interval,omitempty"`
+
+	logger *zap.Logger
+
+	// CPU times of the previous measurement
+	cpuTotal, cpuIdle float64
+}
+
+func (ls *LoadShedding) provision(logger *zap.Logger) error {
+	if ls.MaxCPU < 0 || ls.MaxCPU > 1 {
+		return fmt.Errorf("max_cpu must be between 0 and 1")
+	}
+	if ls.MaxMemory < 0 {
+		return fmt.Errorf("max_memory must be at least zero")
+	}
+	if ls.MaxGoroutines < 0 {
+		return fmt.Errorf("max_goroutines must be at least zero")
+	}
+	if ls.MaxCPU == 0 && ls.MaxMemory == 0 && ls.MaxGoroutines == 0 {
+		return fmt.Errorf("at least one of max_cpu, max_memory and max_goroutines is required")
+	}
+	if ls.Factor == 0 {
+		ls.Factor = 0.5
+	}
+	if ls.Factor < 0 || ls.Factor >= 1 {
+		return fmt.Errorf("factor must be greater than 0 and less than 1")
+	}
+	if ls.Interval == 0 {
+		ls.Interval = caddy.Duration(5 * time.Second)
+	}
+	if ls.Interval < 0 {
+		return fmt.Errorf("interval must be greater than zero")
+	}
+	ls.logger = logger
+	return nil
+}
+
+// loadSample is a measurement of the process's usage.
+type loadSample struct {
+	cpu        float64 // fraction of the available CPU time since the last sample
+	memory     int64
+	goroutines int
+}
+
+// sample measures the process's usage.
+func (ls *LoadShedding) sample() loadSample {
+	samples := []metrics.Sample{
+		{Name: "/cpu/classes/total:cpu-seconds"},
+		{Name: "/cpu/classes/idle:cpu-seconds"},
+		{Name: "/memory/classes/total:bytes"},
+		{Name: "/memory/classes/heap/released:bytes"},
+	}
+	metrics.Read(samples)
+	cpuTotal, cpuIdle := samples[0].Value.Float64(), samples[1].Value.Float64()
+
+	s := loadSample{
+		memory:     int64(samples[2].Value.Uint64() - samples[3].Value.Uint64()),
+		goroutines: runtime.NumGoroutine(),
+	}
+	if total := cpuTotal - ls.cpuTotal; total > 0 {
+		s.cpu = 1 - (cpuIdle-ls.cpuIdle)/total
+	}
+	ls.cpuTotal, ls.cpuIdle = cpuTotal, cpuIdle
+	return s
+}
+
+// underPressure returns the fields of s that cross their threshold, or
+// none if the process is not under pressure.
+func (ls *LoadShedding) underPressure(s loadSample) []zap.Field {
+	var fields []zap.Field
+	if ls.MaxCPU > 0 && s.cpu > ls.MaxCPU {
+		fields = append(fields, zap.Float64("cpu", s.cpu))
+	}
+	if ls.MaxMemory > 0 && s.memory > ls.MaxMemory {
+		fields = append(fields, zap.Int64("memory", s.memory))
+	}
+	if ls.MaxGoroutines > 0 && s.goroutines > ls.MaxGoroutines {
+		fields = append(fields, zap.Int("goroutines", s.goroutines))
+	}
+	return fields
+}
+
+// run tightens and relaxes the limits of all zones as the process comes
+// under and out of pressure, until ctx is canceled.
+func (ls *LoadShedding) run(ctx context.Context) {
+	labelTask(ctx, "load_shedding")
+	ticker := time.NewTicker(time.Duration(ls.Interval))
+	defer ticker.Stop()
+
+	ls.sample()
+	var shedding bool
+	for {
+		select {
+		case <-ticker.C:
+			pressure := ls.underPressure(ls.sample())
+			switch {
+			case len(pressure) > 0 && !shedding:
+				ls.logger.Warn("process is under pressure; tightening rate limits",
+					append(pressure, zap.Float64("factor", ls.Factor))...)
+			case len(pressure) == 0 && shedding:
+				ls.logger.Info("process is no longer under pressure; relaxing rate limits")
+			}
+			shedding = len(pressure) > 0
+
+			// zones created while shedding are tightened on the next tick
+			var factor float64
+			if shedding {
+				factor = ls.Factor
+			}
+			rateLimits.Range(func(_, value any) bool {
+				value.(*rateLimitersMap).setShedFactor(factor)
+				return true
+			})
+
+		case <-ctx.Done():
+			rateLimits.Range(func(_, value any) bool {
+				value.(*rateLimitersMap).setShedFactor(0)
+				return true
+			})
+			return
+		}
+	}
+}
+
+// setShedFactor sets the factor by which load shedding scales the zone's
+// event limits; 0 means the zone isn't shedding load.
+func (rlm *rateLimitersMap) setShedFactor(factor float64) {
+	rlm.limitersMu.Lock()
+	if rlm.shedFactor == factor {
+		rlm.limitersMu.Unlock()
+		return
+	}
+	rlm.shedFactor = factor
+	maxEvents, window := rlm.configuredLimits()
+	rlm.limitersMu.Unlock()
+
+	rlm.updateAll(maxEvents, window)
+}
@@ -0,0 +1,62 @@
+package caddyrl
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoadShedding(t *testing.T) {
+	ls := &LoadShedding{MaxCPU: 0.8, MaxGoroutines: 1000}
+	if err := ls.provision(nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ls.Factor != 0.5 || time.Duration(ls.Interval) != 5*time.Second {
+		t.Fatalf("unexpected defaults: factor %v, interval %v", ls.Factor, ls.Interval)
+	}
+
+	for _, tc := range []struct {
+		sample   loadSample
+		pressure int
+	}{
+		{loadSample{cpu: 0.5, memory: 1 << 40, goroutines: 100}, 0}, // memory is not considered
+		{loadSample{cpu: 0.9, goroutines: 100}, 1},
+		{loadSample{cpu: 0.9, goroutines: 2000}, 2},
+	} {
+		if pressure := ls.underPressure(tc.sample); len(pressure) != tc.pressure {
+			t.Errorf("sample %+v: expected %d thresholds crossed, got %d", tc.sample, tc.pressure, len(pressure))
+		}
+	}
+
+	for _, invalid := range []*LoadShedding{
+		{},
+		{MaxCPU: 1.5},
+		{MaxGoroutines: 10, Factor: 1},
+		{MaxGoroutines: 10, Factor: -0.5},
+	} {
+		if err := invalid.provision(nil); err == nil {
+			t.Errorf("expected an error for %+v", invalid)
+		}
+	}
+}
+
+func TestShedFactor(t *testing.T) {
+	rlm := newRateLimiterMap()
+	rlm.updateAll(100, time.Minute)
+
+	rlm.setShedFactor(0.5)
+	if maxEvents, _ := rlm.limits(); maxEvents != 50 {
+		t.Fatalf("expected max events 50 while shedding load, got %d", maxEvents)
+	}
+
+	// load shedding applies on top of a clamp
+	rlm.setClamp(0.2, time.Hour)
+	if maxEvents, _ := rlm.limits(); maxEvents != 10 {
+		t.Fatalf("expected max events 10 while clamped and shedding load, got %d", maxEvents)
+	}
+	rlm.liftClamp(nil)
+
+	rlm.setShedFactor(0)
+	if maxEvents, _ := rlm.limits(); maxEvents != 100 {
+		t.Fatalf("expected max events 100 after shedding load, got %d", maxEvents)
+	}
+}
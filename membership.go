@@ -0,0 +1,114 @@
+package caddyrl
+
+import (
+	"cmp"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// adminClusterPath is the admin endpoint that reports the members of
+// the clusters that handlers sync state with.
+const adminClusterPath = "/rate_limit/cluster"
+
+// clusters holds the distributed settings of all provisioned handlers,
+// whose members are reported through the admin API.
+var clusters sync.Map // of *DistributedRateLimiting to struct{}
+
+// clusterMember describes an instance of a cluster in admin API
+// responses.
+type clusterMember struct {
+	InstanceID string `json:"instance_id"`
+
+	// Whether this is the instance that answers the request.
+	Self bool `json:"self,omitempty"`
+
+	// When the instance last wrote its state, as far as was last read;
+	// not set for this instance.
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+
+	// Whether the instance is contributing state, i.e. wrote it recently
+	// enough that it counts as a member of the cluster.
+	Active bool `json:"active"`
+}
+
+// staleAfter returns how long after an instance last wrote its state
+// it is presumed gone.
+func (d *DistributedRateLimiting) staleAfter() time.Duration {
+	return 3 * time.Duration(d.WriteInterval)
+}
+
+// isActive returns whether the instance whose state is state is a member
+// of the cluster at ref, i.e. it wrote its state recently enough and
+// didn't leave.
+func (d *DistributedRateLimiting) isActive(state rlState, ref time.Time) bool {
+	return !state.Left && ref.Sub(state.Timestamp) <= d.staleAfter()
+}
+
+// members returns this instance and the others whose state was last
+// read, at ref.
+func (d *DistributedRateLimiting) members(ref time.Time) []clusterMember {
+	members := []clusterMember{{InstanceID: d.instanceID, Self: true, Active: true}}
+	d.otherStatesMu.RLock()
+	defer d.otherStatesMu.RUnlock()
+	for _, state := range d.otherStates {
+		lastSeen := state.Timestamp
+		members = append(members, clusterMember{
+			InstanceID: state.InstanceID,
+			LastSeen:   &lastSeen,
+			Active:     d.isActive(state, ref),
+		})
+	}
+	return members
+}
+
+// peers returns the number of other instances whose state was last
+// read that are active, and that are stale, at ref.
+func (d *DistributedRateLimiting) peers(ref time.Time) (active, stale int) {
+	d.otherStatesMu.RLock()
+	defer d.otherStatesMu.RUnlock()
+	for _, state := range d.otherStates {
+		if d.isActive(state, ref) {
+			active++
+		} else {
+			stale++
+		}
+	}
+	return active, stale
+}
+
+// handleCluster lists the members of the clusters of all handlers, each
+// instance once, as last seen by any of them.
+func handleCluster(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	ref := now()
+	byID := make(map[string]clusterMember)
+	clusters.Range(func(key, _ any) bool {
+		for _, member := range key.(*DistributedRateLimiting).members(ref) {
+			known, ok := byID[member.InstanceID]
+			if ok && (known.Self || !member.Self && known.LastSeen.After(*member.LastSeen)) {
+				continue
+			}
+			byID[member.InstanceID] = member
+		}
+		return true
+	})
+
+	members := []clusterMember{}
+	for _, member := range byID {
+		members = append(members, member)
+	}
+	slices.SortFunc(members, func(a, b clusterMember) int {
+		return cmp.Compare(a.InstanceID, b.InstanceID)
+	})
+	return writeAdminJSON(w, members)
+}
@@ -0,0 +1,87 @@
+package caddyrl
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestCluster(t *testing.T) {
+	initTime()
+
+	// two handlers sync with clusters that share an instance
+	first := &DistributedRateLimiting{
+		WriteInterval: caddy.Duration(5 * time.Second),
+		instanceID:    "self",
+		otherStates: []rlState{
+			{InstanceID: "active", Timestamp: now().Add(-10 * time.Second)},
+			{InstanceID: "stale", Timestamp: now().Add(-time.Minute)},
+		},
+	}
+	second := &DistributedRateLimiting{
+		WriteInterval: caddy.Duration(5 * time.Second),
+		instanceID:    "self",
+		otherStates: []rlState{
+			{InstanceID: "stale", Timestamp: now().Add(-20 * time.Second)},
+		},
+	}
+	clusters.Store(first, struct{}{})
+	clusters.Store(second, struct{}{})
+	t.Cleanup(func() {
+		clusters.Delete(first)
+		clusters.Delete(second)
+	})
+
+	w := httptest.NewRecorder()
+	if err := handleCluster(w, httptest.NewRequest(http.MethodGet, adminClusterPath, nil)); err != nil {
+		t.Fatal(err)
+	}
+	var members []clusterMember
+	if err := json.NewDecoder(w.Body).Decode(&members); err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 3 {
+		t.Fatalf("expected each instance once, got %+v", members)
+	}
+	for i, expected := range []struct {
+		id     string
+		self   bool
+		active bool
+	}{
+		{"active", false, true},
+		{"self", true, true},
+		{"stale", false, false},
+	} {
+		member := members[i]
+		if member.InstanceID != expected.id || member.Self != expected.self || member.Active != expected.active {
+			t.Errorf("member %d: expected %+v, got %+v", i, expected, member)
+		}
+	}
+	if lastSeen := members[2].LastSeen; lastSeen == nil || !lastSeen.Equal(now().Add(-20*time.Second)) {
+		t.Errorf("expected an instance to be last seen when any handler last saw it, got %v", lastSeen)
+	}
+
+	err := handleCluster(httptest.NewRecorder(), httptest.NewRequest(http.MethodDelete, adminClusterPath, nil))
+	if apiErr, ok := err.(caddy.APIError); !ok || apiErr.HTTPStatus != http.StatusMethodNotAllowed {
+		t.Errorf("expected method not allowed, got %v", err)
+	}
+}
+
+func TestCaddyfileInstanceID(t *testing.T) {
+	var h Handler
+	if err := h.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`rate_limit {
+		distributed {
+			instance_id caddy-1
+		}
+	}`)); err != nil {
+		t.Fatalf("unmarshaling Caddyfile: %v", err)
+	}
+	if h.Distributed.InstanceID != "caddy-1" {
+		t.Errorf("unexpected instance ID: %q", h.Distributed.InstanceID)
+	}
+}
@@ -0,0 +1,67 @@
+package caddyrl
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// memoryCheckInterval is how often the memory budget is enforced.
+const memoryCheckInterval = 10 * time.Second
+
+// enforceMemoryBudget keeps the memory used by all zones within maxBytes
+// until ctx is canceled.
+func enforceMemoryBudget(ctx context.Context, maxBytes int64, logger *zap.Logger) {
+	labelTask(ctx, "memory_budget")
+	ticker := time.NewTicker(memoryCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			var zones []*rateLimitersMap
+			rateLimits.Range(func(_, value any) bool {
+				zones = append(zones, value.(*rateLimitersMap))
+				return true
+			})
+			if evicted := trimToMemoryBudget(zones, maxBytes); evicted > 0 {
+				logger.Warn("evicted least recently used keys to stay within max_memory",
+					zap.Int64("max_memory", maxBytes),
+					zap.Int("evicted", evicted),
+				)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// trimToMemoryBudget evicts least recently used rate limiters from zones
+// if together they use more than maxBytes. Every zone is shrunk by the same
+// fraction of its memory usage, so that a single busy zone doesn't lose
+// all of its state to make room for others. It returns the number of
+// rate limiters that were evicted.
+func trimToMemoryBudget(zones []*rateLimitersMap, maxBytes int64) int {
+	usages := make([]int64, len(zones))
+	var total int64
+	for i, zone := range zones {
+		usages[i] = int64(zone.memoryUsage())
+		total += usages[i]
+	}
+	if total <= maxBytes {
+		return 0
+	}
+
+	var evicted int
+	for i, zone := range zones {
+		keys := int64(zone.len())
+		if usages[i] == 0 || keys == 0 {
+			continue
+		}
+		excess := usages[i] - int64(float64(usages[i])*float64(maxBytes)/float64(total))
+		perKey := max(usages[i]/keys, 1)
+		evicted += zone.evictLeastRecent(int((excess + perKey - 1) / perKey))
+	}
+	return evicted
+}
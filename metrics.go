@@ -1,6 +1,9 @@
 package caddyrl
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"strconv"
 	"sync"
 	"time"
@@ -15,6 +18,23 @@ type rateLimitMetrics struct {
 	requestsTotal *prometheus.CounterVec
 	processTime   *prometheus.HistogramVec
 	keysTotal     *prometheus.GaugeVec
+	hostKeys      *prometheus.GaugeVec
+	schedule      *prometheus.GaugeVec
+	remaining     *prometheus.GaugeVec
+	nearLimit     *prometheus.CounterVec
+	utilization   *prometheus.HistogramVec
+	memoryBytes   *prometheus.GaugeVec
+	keysRemoved   *prometheus.CounterVec
+	retryStorms   *prometheus.CounterVec
+	activeBans    *prometheus.GaugeVec
+	banDuration   *prometheus.HistogramVec
+	coalesced     *prometheus.CounterVec
+	degraded      *prometheus.CounterVec
+	observed      *prometheus.CounterVec
+	syncDuration  *prometheus.HistogramVec
+	syncErrors    *prometheus.CounterVec
+	syncStaleness *prometheus.GaugeVec
+	clusterPeers  *prometheus.GaugeVec
 	config        *prometheus.CounterVec
 }
 
@@ -25,8 +45,19 @@ var (
 	globalMetrics *rateLimitMetrics
 )
 
+// defaultProcessTimeBuckets are the buckets of the process time histogram
+// unless the app configures others
+var defaultProcessTimeBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1}
+
+// banDurationBuckets are the buckets of the ban duration histogram,
+// from a second to a day
+var banDurationBuckets = []float64{1, 10, 30, 60, 300, 900, 1800, 3600, 4 * 3600, 24 * 3600}
+
+// utilizationBuckets are the buckets of the utilization histogram
+var utilizationBuckets = []float64{.1, .25, .5, .75, .9, .95, 1}
+
 // initializeMetrics creates and registers all rate limit metrics with Caddy's internal registry
-func initializeMetrics(registry prometheus.Registerer) *rateLimitMetrics {
+func initializeMetrics(registry prometheus.Registerer, processTimeBuckets []float64) *rateLimitMetrics {
 	const ns, sub = "caddy", "rate_limit"
 
 	factory := promauto.With(registry)
@@ -40,7 +71,7 @@ func initializeMetrics(registry prometheus.Registerer) *rateLimitMetrics {
 				Name:      "declined_requests_total",
 				Help:      "Total number of requests for which rate limit was applied (Declined with HTTP 429 status code returned).",
 			},
-			[]string{"zone", "key"},
+			[]string{"zone", "key", "tenant"},
 		),
 
 		// rate_limit_requests_total - Total number of requests that passed through the Rate Limit module
@@ -51,7 +82,7 @@ func initializeMetrics(registry prometheus.Registerer) *rateLimitMetrics {
 				Name:      "requests_total",
 				Help:      "Total number of requests that passed through Rate Limit module (both declined & processed).",
 			},
-			[]string{"zone", "key"},
+			[]string{"zone", "key", "tenant"},
 		),
 
 		// rate_limit_process_time_seconds - Time taken to process rate limiting for each request
@@ -61,7 +92,7 @@ func initializeMetrics(registry prometheus.Registerer) *rateLimitMetrics {
 				Subsystem: sub,
 				Name:      "process_time_seconds",
 				Help:      "A time taken to process rate limiting for each request.",
-				Buckets:   []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1},
+				Buckets:   processTimeBuckets,
 			},
 			[]string{"zone", "key"},
 		),
@@ -74,47 +105,318 @@ func initializeMetrics(registry prometheus.Registerer) *rateLimitMetrics {
 				Name:      "keys_total",
 				Help:      "Total number of keys that each RL zone contains. (This metric is collected in the background for each zone.)",
 			},
+			[]string{"zone", "tenant"},
+		),
+
+		// rate_limit_host_keys_total - Number of keys per host of zones that isolate keys by host
+		hostKeys: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "host_keys_total",
+				Help:      "Number of keys per host of RL zones with isolate_by_host. (This metric is collected in the background for each zone.)",
+			},
+			[]string{"zone", "host"},
+		),
+
+		// rate_limit_schedule_active - Whether a schedule of a zone is active
+		schedule: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "schedule_active",
+				Help:      "Whether a limit schedule of an RL zone is active (1) or not (0).",
+			},
+			[]string{"zone", "schedule"},
+		),
+
+		// rate_limit_remaining_events - Events left in the window
+		remaining: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "remaining_events",
+				Help:      "Events left in the window. With an empty key, the lowest remaining budget of any key in the zone (collected in the background); otherwise, the key's remaining budget as of its latest request.",
+			},
+			[]string{"zone", "key"},
+		),
+
+		// rate_limit_near_limit_requests_total - Allowed requests above the near limit threshold
+		nearLimit: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "near_limit_requests_total",
+				Help:      "Total number of requests that were allowed but left their key at or above the zone's near_limit utilization threshold.",
+			},
+			[]string{"zone", "key"},
+		),
+
+		// rate_limit_utilization_ratio - How much of their limit keys used per request
+		utilization: factory.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "utilization_ratio",
+				Help:      "Fraction of its limit that the key of each request had used when the request was decided: its events in the window over max_events for allowed requests, and 1 for declined ones.",
+				Buckets:   utilizationBuckets,
+			},
 			[]string{"zone"},
 		),
 
+		// rate_limit_memory_bytes - Approximate memory used by each RL zone's state
+		memoryBytes: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "memory_bytes",
+				Help:      "Approximate number of bytes used by the state of each RL zone (keys and their ring buffers). (This metric is collected in the background for each zone.)",
+			},
+			[]string{"zone"},
+		),
+
+		// rate_limit_keys_removed_total - Keys whose state was dropped by the module
+		keysRemoved: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "keys_removed_total",
+				Help:      "Total number of keys whose rate limit state was dropped, by reason (expired: no events left in the window; evicted: to stay within max_keys or max_memory).",
+			},
+			[]string{"zone", "reason"},
+		),
+
+		// rate_limit_retry_storms_total - Keys banned for retry storms
+		retryStorms: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "retry_storms_total",
+				Help:      "Total number of retry storms, after each of which the key that repeated the same request in a tight loop was banned.",
+			},
+			[]string{"zone"},
+		),
+
+		// rate_limit_active_bans - Keys in the penalty box
+		activeBans: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "active_bans",
+				Help:      "Number of keys of each RL zone that are currently banned. (This metric is collected in the background for each zone.)",
+			},
+			[]string{"zone"},
+		),
+
+		// rate_limit_ban_duration_seconds - How long bans lasted
+		banDuration: factory.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "ban_duration_seconds",
+				Help:      "How long keys were actually banned, from when they were banned until their ban expired or was lifted. (This metric is collected in the background for each zone.)",
+				Buckets:   banDurationBuckets,
+			},
+			[]string{"zone"},
+		),
+
+		// rate_limit_coalesced_requests_total - Declined requests served with another request's response
+		coalesced: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "coalesced_requests_total",
+				Help:      "Total number of requests that were declined but served with a copy of the response to an allowed request of the same key and URL.",
+			},
+			[]string{"zone"},
+		),
+
+		// rate_limit_degraded_decisions_total - Decisions while storage fails
+		degraded: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "degraded_decisions_total",
+				Help:      "Total number of decisions made while distributed state couldn't be synced with storage, by the zone's store_failure policy (open: decided with the last known states; closed: declined).",
+			},
+			[]string{"zone", "policy"},
+		),
+
+		// rate_limit_observed_decisions_total - Decisions of observers
+		observed: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "observed_decisions_total",
+				Help:      "Total number of decisions that an observing instance would have made, by its decision and the decision of the cluster's state alone.",
+			},
+			[]string{"zone", "decision", "authoritative"},
+		),
+
+		// rate_limit_sync_duration_seconds - Time taken to sync distributed state
+		syncDuration: factory.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "sync_duration_seconds",
+				Help:      "Time taken to read or write distributed rate limit state from or to storage.",
+				Buckets:   prometheus.DefBuckets,
+			},
+			[]string{"operation"},
+		),
+
+		// rate_limit_sync_errors_total - Failed distributed state syncs
+		syncErrors: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "sync_errors_total",
+				Help:      "Total number of failed reads or writes of distributed rate limit state.",
+			},
+			[]string{"operation"},
+		),
+
+		// rate_limit_sync_staleness_seconds - Time since the last successful sync
+		syncStaleness: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "sync_staleness_seconds",
+				Help:      "Seconds since distributed rate limit state was last read or written successfully. (This metric is updated on every sync attempt.)",
+			},
+			[]string{"operation"},
+		),
+
+		// rate_limit_cluster_peers - Other instances whose state was read
+		clusterPeers: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "cluster_peers",
+				Help:      "Number of other instances whose distributed rate limit state was last read, by whether they are still writing it (active) or stopped (stale).",
+			},
+			[]string{"status"},
+		),
+
 		// rate_limit_config - Shows configuration of the rate limiter module
 		config: factory.NewCounterVec(
 			prometheus.CounterOpts{
 				Namespace: ns,
 				Subsystem: sub,
 				Name:      "config",
-				Help:      "Shows configuration of the rate limiter module. Reported only once on bootstrap as configuration is not dynamically configurable.",
+				Help:      "Shows configuration of the rate limiter module. Reported on bootstrap and whenever a zone's limits are changed through the admin API.",
 			},
 			[]string{"zone", "max_events", "window"},
 		),
 	}
 }
 
-// registerMetrics registers all rate limit metrics with the provided Prometheus registry
-func registerMetrics(reg prometheus.Registerer) error {
+// registerMetrics registers all rate limit metrics with the provided Prometheus registry.
+// Metrics are only registered once per process, so bucket changes require a restart.
+func registerMetrics(reg prometheus.Registerer, processTimeBuckets []float64) error {
 	var err error
 	metricsOnce.Do(func() {
-		globalMetrics = initializeMetrics(reg)
+		if len(processTimeBuckets) == 0 {
+			processTimeBuckets = defaultProcessTimeBuckets
+		}
+		globalMetrics = initializeMetrics(reg, processTimeBuckets)
 	})
 	return err
 }
 
+// overflowKeyLabel is the key label of per-key metrics for keys beyond
+// a zone's cap on distinct key labels
+const overflowKeyLabel = "__other__"
+
+// keyLabels tracks which key label values have been used per zone, so
+// that their number can be capped. Like the metrics themselves, it is
+// shared by all handlers in the process.
+var keyLabels = struct {
+	sync.Mutex
+	zones map[string]map[string]struct{}
+}{zones: make(map[string]map[string]struct{})}
+
 // metricsCollector holds the metrics collection methods
 type metricsCollector struct {
 	globalOpts *RateLimitApp
 	enabled    bool
+
+	// per-zone overrides of the app's include_key setting;
+	// only written while provisioning
+	zoneIncludeKey map[string]bool
+
+	// if not nil, per-request measurements are recorded by its worker
+	queue *metricsQueue
 }
 
 // newMetricsCollector creates a new metrics collector
 func newMetricsCollector(enabled bool, globalOpts *RateLimitApp) *metricsCollector {
-	return &metricsCollector{
+	mc := &metricsCollector{
 		enabled:    enabled,
 		globalOpts: globalOpts,
 	}
+	if globalOpts != nil {
+		mc.queue = globalOpts.metricsQueue
+	}
+	return mc
+}
+
+// enqueue queues m to be recorded in the background. It returns false if
+// m must be recorded synchronously, because there is no queue, it is full,
+// or nothing would be recorded anyway.
+func (mc *metricsCollector) enqueue(m measurement) bool {
+	if mc.queue == nil || !mc.active() {
+		return false
+	}
+	m.mc = mc
+	return mc.queue.enqueue(m)
+}
+
+// active returns true if measurements are recorded anywhere, so that
+// callers can skip collecting values that would be discarded
+func (mc *metricsCollector) active() bool {
+	return mc.enabled || mc.statsd() != nil
+}
+
+// statsd returns the StatsD exporter, or nil if there is none
+func (mc *metricsCollector) statsd() *StatsDExporter {
+	if mc.globalOpts == nil {
+		return nil
+	}
+	return mc.globalOpts.Metrics.StatsD
+}
+
+// statsdTags returns the tags of a StatsD measurement about key in zone.
+// Unlike Prometheus metrics, which are recorded both per zone and per
+// key, a StatsD measurement is sent once, tagged with the key only if
+// per-key metrics are enabled for the zone.
+func (mc *metricsCollector) statsdTags(zone, key string) []statsdTag {
+	if mc.statsd() == nil {
+		return nil
+	}
+	tags := []statsdTag{{"zone", zone}}
+	if mc.includeKey(zone) {
+		tags = append(tags, statsdTag{"key", mc.keyLabel(zone, key)})
+	}
+	return tags
+}
+
+// tenantTags returns tags with the tenant tag, if there is a tenant;
+// see Handler.Tenant and MetricsConfig.Tenant.
+func (mc *metricsCollector) tenantTags(tags []statsdTag, tenant string) []statsdTag {
+	if tenant == "" || mc.statsd() == nil {
+		return tags
+	}
+	return append(tags, statsdTag{"tenant", tenant})
 }
 
 // recordRequest records a request that passed through the rate limit module
 func (mc *metricsCollector) recordRequest(hasZone bool) {
+	if mc.enqueue(measurement{kind: measureRequest, hasZone: hasZone}) {
+		return
+	}
+	mc.statsd().count("requests_total", 1)
+
 	if !mc.enabled || globalMetrics == nil {
 		return
 	}
@@ -124,37 +426,110 @@ func (mc *metricsCollector) recordRequest(hasZone bool) {
 		hasZoneStr = "true"
 	}
 	// Record zone-level aggregate metric (key is empty for zone-level aggregation)
-	globalMetrics.requestsTotal.WithLabelValues(hasZoneStr, "").Inc()
+	globalMetrics.requestsTotal.WithLabelValues(hasZoneStr, "", "").Inc()
 }
 
-// recordRequestPerKey records a request for a specific zone and key
-func (mc *metricsCollector) recordRequestPerKey(zone, key string) {
+// setZoneIncludeKey overrides whether per-key metrics are recorded for zone
+func (mc *metricsCollector) setZoneIncludeKey(zone string, includeKey bool) {
+	if mc.zoneIncludeKey == nil {
+		mc.zoneIncludeKey = make(map[string]bool)
+	}
+	mc.zoneIncludeKey[zone] = includeKey
+}
+
+// includeKey returns whether per-key metrics are recorded for zone
+func (mc *metricsCollector) includeKey(zone string) bool {
+	if includeKey, ok := mc.zoneIncludeKey[zone]; ok {
+		return includeKey
+	}
+	return mc.globalOpts.Metrics.IncludeKey
+}
+
+// keyLabel returns the label value to use for key in per-key metrics of
+// zone. If hash_keys is enabled, the key is hashed first. Once a zone has max_keys_per_zone distinct key labels, other keys
+// are folded into a single overflow label to bound cardinality.
+func (mc *metricsCollector) keyLabel(zone, key string) string {
+	if mc.globalOpts.Metrics.HashKeys {
+		key = hashKeyLabel(key)
+	}
+
+	maxKeys := mc.globalOpts.Metrics.MaxKeysPerZone
+	if maxKeys <= 0 {
+		return key
+	}
+
+	keyLabels.Lock()
+	defer keyLabels.Unlock()
+
+	keys, ok := keyLabels.zones[zone]
+	if !ok {
+		keys = make(map[string]struct{})
+		keyLabels.zones[zone] = keys
+	}
+	if _, ok := keys[key]; ok {
+		return key
+	}
+	if len(keys) >= maxKeys {
+		return overflowKeyLabel
+	}
+	keys[key] = struct{}{}
+	return key
+}
+
+// hashKeyLabel returns a short, stable hash of key, so that per-key
+// metrics can be told apart without exporting the key itself.
+func hashKeyLabel(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// recordRequestPerKey records a request for a specific zone and key of
+// a tenant, which is empty without tenancy
+func (mc *metricsCollector) recordRequestPerKey(zone, tenant, key string) {
+	if mc.enqueue(measurement{kind: measureRequestPerKey, zone: zone, tenant: tenant, key: key}) {
+		return
+	}
+	mc.statsd().count("requests_total", 1, mc.tenantTags(mc.statsdTags(zone, key), tenant)...)
+
 	if !mc.enabled || globalMetrics == nil {
 		return
 	}
 
 	// Record both zone-level aggregate and per-key detailed metrics
-	globalMetrics.requestsTotal.WithLabelValues(zone, "").Inc() // Zone-level aggregate
-	if mc.globalOpts.Metrics.IncludeKey {
-		globalMetrics.requestsTotal.WithLabelValues(zone, key).Inc() // Per-key detailed
+	globalMetrics.requestsTotal.WithLabelValues(zone, "", tenant).Inc() // Zone-level aggregate
+	if mc.includeKey(zone) {
+		globalMetrics.requestsTotal.WithLabelValues(zone, mc.keyLabel(zone, key), tenant).Inc() // Per-key detailed
 	}
 }
 
-// recordDeclinedRequest records a request that was declined due to rate limiting
-func (mc *metricsCollector) recordDeclinedRequest(zone, key string) {
+// recordDeclinedRequest records a request of a tenant that was declined due to rate limiting.
+// If the request is traced, its trace ID is attached as an exemplar.
+func (mc *metricsCollector) recordDeclinedRequest(ctx context.Context, zone, tenant, key string) {
+	if mc.enqueue(measurement{kind: measureDeclinedRequest, ctx: ctx, zone: zone, tenant: tenant, key: key}) {
+		return
+	}
+	mc.statsd().count("declined_requests_total", 1, mc.tenantTags(mc.statsdTags(zone, key), tenant)...)
+
 	if !mc.enabled || globalMetrics == nil {
 		return
 	}
 
+	exemplar := traceExemplar(ctx)
+
 	// Record both zone-level aggregate and per-key detailed metrics
-	globalMetrics.declinedTotal.WithLabelValues(zone, "").Inc() // Zone-level aggregate
-	if mc.globalOpts.Metrics.IncludeKey {
-		globalMetrics.declinedTotal.WithLabelValues(zone, key).Inc() // Per-key detailed
+	incWithExemplar(globalMetrics.declinedTotal.WithLabelValues(zone, "", tenant), exemplar) // Zone-level aggregate
+	if mc.includeKey(zone) {
+		incWithExemplar(globalMetrics.declinedTotal.WithLabelValues(zone, mc.keyLabel(zone, key), tenant), exemplar) // Per-key detailed
 	}
 }
 
 // recordProcessTime records the time taken to process rate limiting
 func (mc *metricsCollector) recordProcessTime(duration time.Duration, hasZone bool) {
+	if mc.enqueue(measurement{kind: measureProcessTime, duration: duration, hasZone: hasZone}) {
+		return
+	}
+	mc.statsd().timing("process_time", duration)
+
 	if !mc.enabled || globalMetrics == nil {
 		return
 	}
@@ -167,26 +542,293 @@ func (mc *metricsCollector) recordProcessTime(duration time.Duration, hasZone bo
 	globalMetrics.processTime.WithLabelValues(hasZoneStr, "").Observe(duration.Seconds())
 }
 
-// recordProcessTimePerKey records the time taken to process rate limiting for a specific zone and key
-func (mc *metricsCollector) recordProcessTimePerKey(duration time.Duration, zone, key string) {
+// recordProcessTimePerKey records the time taken to process rate limiting for a specific zone and key.
+// If the request is traced, its trace ID is attached as an exemplar.
+func (mc *metricsCollector) recordProcessTimePerKey(ctx context.Context, duration time.Duration, zone, key string) {
+	if mc.enqueue(measurement{kind: measureProcessTimePerKey, ctx: ctx, duration: duration, zone: zone, key: key}) {
+		return
+	}
+	mc.statsd().timing("process_time", duration, mc.statsdTags(zone, key)...)
+
+	if !mc.enabled || globalMetrics == nil {
+		return
+	}
+
+	exemplar := traceExemplar(ctx)
+
+	// Record both zone-level aggregate and per-key detailed metrics
+	observeWithExemplar(globalMetrics.processTime.WithLabelValues(zone, ""), duration.Seconds(), exemplar) // Zone-level aggregate
+	if mc.includeKey(zone) {
+		observeWithExemplar(globalMetrics.processTime.WithLabelValues(zone, mc.keyLabel(zone, key)), duration.Seconds(), exemplar) // Per-key detailed
+	}
+}
+
+// incWithExemplar increments counter, attaching exemplar if it is not nil
+func incWithExemplar(counter prometheus.Counter, exemplar prometheus.Labels) {
+	if adder, ok := counter.(prometheus.ExemplarAdder); ok && exemplar != nil {
+		adder.AddWithExemplar(1, exemplar)
+		return
+	}
+	counter.Inc()
+}
+
+// observeWithExemplar observes value, attaching exemplar if it is not nil
+func observeWithExemplar(observer prometheus.Observer, value float64, exemplar prometheus.Labels) {
+	if exemplarObserver, ok := observer.(prometheus.ExemplarObserver); ok && exemplar != nil {
+		exemplarObserver.ObserveWithExemplar(value, exemplar)
+		return
+	}
+	observer.Observe(value)
+}
+
+// updateKeysCount updates the count of keys for a specific zone of a
+// tenant, which is empty unless the zone is one of a tenant's zones
+func (mc *metricsCollector) updateKeysCount(zone, tenant string, count int) {
+	mc.statsd().gauge("keys_total", float64(count), mc.tenantTags([]statsdTag{{"zone", zone}}, tenant)...)
+
+	if !mc.enabled || globalMetrics == nil {
+		return
+	}
+
+	globalMetrics.keysTotal.WithLabelValues(zone, tenant).Set(float64(count))
+}
+
+// updateHostKeysCount replaces the counts of keys per host of a zone
+// that isolates keys by host
+func (mc *metricsCollector) updateHostKeysCount(zone string, counts map[string]int) {
+	for host, count := range counts {
+		mc.statsd().gauge("host_keys_total", float64(count), statsdTag{"zone", zone}, statsdTag{"host", host})
+	}
+
+	if !mc.enabled || globalMetrics == nil {
+		return
+	}
+
+	// hosts without keys are dropped rather than kept at zero
+	globalMetrics.hostKeys.DeletePartialMatch(prometheus.Labels{"zone": zone})
+	for host, count := range counts {
+		globalMetrics.hostKeys.WithLabelValues(zone, host).Set(float64(count))
+	}
+}
+
+// updateActiveSchedule reports which of the schedules of a zone is
+// active; active is empty if none is.
+func (mc *metricsCollector) updateActiveSchedule(zone string, schedules []*LimitSchedule, active string) {
+	for _, schedule := range schedules {
+		var value float64
+		if schedule.Name == active {
+			value = 1
+		}
+		mc.statsd().gauge("schedule_active", value, statsdTag{"zone", zone}, statsdTag{"schedule", schedule.Name})
+
+		if mc.enabled && globalMetrics != nil {
+			globalMetrics.schedule.WithLabelValues(zone, schedule.Name).Set(value)
+		}
+	}
+}
+
+// Reasons for which keys are removed from a zone
+const (
+	keyRemovalExpired = "expired"
+	keyRemovalEvicted = "evicted"
+)
+
+// recordKeysRemoved records keys whose state was dropped from a zone
+func (mc *metricsCollector) recordKeysRemoved(zone, reason string, count int) {
+	if count > 0 {
+		mc.statsd().count("keys_removed_total", float64(count), statsdTag{"zone", zone}, statsdTag{"reason", reason})
+	}
+
+	if !mc.enabled || globalMetrics == nil || count == 0 {
+		return
+	}
+
+	globalMetrics.keysRemoved.WithLabelValues(zone, reason).Add(float64(count))
+}
+
+// recordRetryStorm records a key of a zone that was banned for a retry storm
+func (mc *metricsCollector) recordRetryStorm(zone string) {
+	mc.statsd().count("retry_storms_total", 1, statsdTag{"zone", zone})
+
+	if !mc.enabled || globalMetrics == nil {
+		return
+	}
+
+	globalMetrics.retryStorms.WithLabelValues(zone).Inc()
+}
+
+// updateActiveBans updates the number of keys of a zone that are banned
+func (mc *metricsCollector) updateActiveBans(zone string, count int) {
+	mc.statsd().gauge("active_bans", float64(count), statsdTag{"zone", zone})
+
+	if !mc.enabled || globalMetrics == nil {
+		return
+	}
+
+	globalMetrics.activeBans.WithLabelValues(zone).Set(float64(count))
+}
+
+// recordServedBans records how long bans of keys of a zone lasted
+func (mc *metricsCollector) recordServedBans(zone string, durations []time.Duration) {
+	for _, d := range durations {
+		mc.statsd().timing("ban_duration", d, statsdTag{"zone", zone})
+	}
+
+	if !mc.enabled || globalMetrics == nil {
+		return
+	}
+
+	for _, d := range durations {
+		globalMetrics.banDuration.WithLabelValues(zone).Observe(d.Seconds())
+	}
+}
+
+// recordCoalescedRequest records a declined request of a zone that was
+// served with the response of another request
+func (mc *metricsCollector) recordCoalescedRequest(zone string) {
+	mc.statsd().count("coalesced_requests_total", 1, statsdTag{"zone", zone})
+
+	if !mc.enabled || globalMetrics == nil {
+		return
+	}
+
+	globalMetrics.coalesced.WithLabelValues(zone).Inc()
+}
+
+// recordDegradedDecision records a decision of a zone while distributed
+// state couldn't be synced, under the zone's store_failure policy
+func (mc *metricsCollector) recordDegradedDecision(zone, policy string) {
+	mc.statsd().count("degraded_decisions_total", 1, statsdTag{"zone", zone}, statsdTag{"policy", policy})
+
+	if !mc.enabled || globalMetrics == nil {
+		return
+	}
+
+	globalMetrics.degraded.WithLabelValues(zone, policy).Inc()
+}
+
+// recordObservedDecision records the decision that an observing instance
+// would have made, and the decision of the cluster's state alone
+func (mc *metricsCollector) recordObservedDecision(zone, decision, authoritative string) {
+	mc.statsd().count("observed_decisions_total", 1, statsdTag{"zone", zone}, statsdTag{"decision", decision}, statsdTag{"authoritative", authoritative})
+
+	if !mc.enabled || globalMetrics == nil {
+		return
+	}
+
+	globalMetrics.observed.WithLabelValues(zone, decision, authoritative).Inc()
+}
+
+// updateMemoryUsage updates the approximate memory used by a specific zone
+func (mc *metricsCollector) updateMemoryUsage(zone string, bytes int) {
+	mc.statsd().gauge("memory_bytes", float64(bytes), statsdTag{"zone", zone})
+
+	if !mc.enabled || globalMetrics == nil {
+		return
+	}
+
+	globalMetrics.memoryBytes.WithLabelValues(zone).Set(float64(bytes))
+}
+
+// recordSync records an attempt to read or write distributed state
+func (mc *metricsCollector) recordSync(operation string, duration time.Duration, err error) {
+	mc.statsd().timing("sync_duration", duration, statsdTag{"operation", operation})
+	if err != nil {
+		mc.statsd().count("sync_errors_total", 1, statsdTag{"operation", operation})
+	}
+
+	if !mc.enabled || globalMetrics == nil {
+		return
+	}
+
+	globalMetrics.syncDuration.WithLabelValues(operation).Observe(duration.Seconds())
+	if err != nil {
+		globalMetrics.syncErrors.WithLabelValues(operation).Inc()
+	}
+}
+
+// updateSyncStaleness updates the time since distributed state was last synced successfully
+func (mc *metricsCollector) updateSyncStaleness(operation string, staleness time.Duration) {
+	mc.statsd().gauge("sync_staleness_seconds", staleness.Seconds(), statsdTag{"operation", operation})
+
+	if !mc.enabled || globalMetrics == nil {
+		return
+	}
+
+	globalMetrics.syncStaleness.WithLabelValues(operation).Set(staleness.Seconds())
+}
+
+// updateClusterPeers updates the number of other instances whose state was read
+func (mc *metricsCollector) updateClusterPeers(active, stale int) {
+	mc.statsd().gauge("cluster_peers", float64(active), statsdTag{"status", "active"})
+	mc.statsd().gauge("cluster_peers", float64(stale), statsdTag{"status", "stale"})
+
+	if !mc.enabled || globalMetrics == nil {
+		return
+	}
+
+	globalMetrics.clusterPeers.WithLabelValues("active").Set(float64(active))
+	globalMetrics.clusterPeers.WithLabelValues("stale").Set(float64(stale))
+}
+
+// recordNearLimitRequest records an allowed request that left its key near the limit
+func (mc *metricsCollector) recordNearLimitRequest(zone, key string) {
+	if mc.enqueue(measurement{kind: measureNearLimitRequest, zone: zone, key: key}) {
+		return
+	}
+	mc.statsd().count("near_limit_requests_total", 1, mc.statsdTags(zone, key)...)
+
 	if !mc.enabled || globalMetrics == nil {
 		return
 	}
 
 	// Record both zone-level aggregate and per-key detailed metrics
-	globalMetrics.processTime.WithLabelValues(zone, "").Observe(duration.Seconds()) // Zone-level aggregate
-	if mc.globalOpts.Metrics.IncludeKey {
-		globalMetrics.processTime.WithLabelValues(zone, key).Observe(duration.Seconds()) // Per-key detailed
+	globalMetrics.nearLimit.WithLabelValues(zone, "").Inc() // Zone-level aggregate
+	if mc.includeKey(zone) {
+		globalMetrics.nearLimit.WithLabelValues(zone, mc.keyLabel(zone, key)).Inc() // Per-key detailed
 	}
 }
 
-// updateKeysCount updates the count of keys for a specific zone
-func (mc *metricsCollector) updateKeysCount(zone string, count int) {
+// recordUtilization records the fraction of its limit that the key of a
+// request of a zone had used when the request was decided
+func (mc *metricsCollector) recordUtilization(zone string, utilization float64) {
+	if mc.enqueue(measurement{kind: measureUtilization, zone: zone, utilization: utilization}) {
+		return
+	}
+	mc.statsd().histogram("utilization_ratio", utilization, statsdTag{"zone", zone})
+
 	if !mc.enabled || globalMetrics == nil {
 		return
 	}
 
-	globalMetrics.keysTotal.WithLabelValues(zone).Set(float64(count))
+	globalMetrics.utilization.WithLabelValues(zone).Observe(utilization)
+}
+
+// updateRemaining updates the remaining budget of a specific key, if per-key metrics are enabled
+func (mc *metricsCollector) updateRemaining(zone, key string, remaining int) {
+	if mc.enqueue(measurement{kind: measureRemaining, zone: zone, key: key, remaining: remaining}) {
+		return
+	}
+	if mc.includeKey(zone) {
+		mc.statsd().gauge("remaining_events", float64(remaining), mc.statsdTags(zone, key)...)
+	}
+
+	if !mc.enabled || globalMetrics == nil || !mc.includeKey(zone) {
+		return
+	}
+
+	globalMetrics.remaining.WithLabelValues(zone, mc.keyLabel(zone, key)).Set(float64(remaining))
+}
+
+// updateZoneRemaining updates the lowest remaining budget of any key in a zone
+func (mc *metricsCollector) updateZoneRemaining(zone string, remaining int) {
+	mc.statsd().gauge("remaining_events", float64(remaining), statsdTag{"zone", zone})
+
+	if !mc.enabled || globalMetrics == nil {
+		return
+	}
+
+	globalMetrics.remaining.WithLabelValues(zone, "").Set(float64(remaining))
 }
 
 // recordConfig records the configuration of a rate limit zone (called once during provision)
@@ -199,3 +841,16 @@ func (mc *metricsCollector) recordConfig(zone string, maxEvents int, window time
 		strconv.Itoa(maxEvents),
 		window.String()).Inc()
 }
+
+// updateConfigMetric replaces the configuration metric of a zone whose limits
+// were changed at runtime. Nothing is recorded if the zone's previous
+// configuration was never reported (e.g. because metrics are disabled).
+func updateConfigMetric(zone string, oldMaxEvents int, oldWindow time.Duration, maxEvents int, window time.Duration) {
+	if globalMetrics == nil {
+		return
+	}
+
+	if globalMetrics.config.DeleteLabelValues(zone, strconv.Itoa(oldMaxEvents), oldWindow.String()) {
+		globalMetrics.config.WithLabelValues(zone, strconv.Itoa(maxEvents), window.String()).Inc()
+	}
+}
@@ -1,14 +1,21 @@
 package caddyrl
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddytest"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"go.uber.org/zap"
 )
 
 func TestMetrics(t *testing.T) {
@@ -84,8 +91,8 @@ func TestMetrics(t *testing.T) {
 	}
 
 	// Check request metrics - verify both zone-level and per-key metrics
-	zoneLevelRequestsMetric := testutil.ToFloat64(globalMetrics.requestsTotal.WithLabelValues("test_zone", ""))
-	perKeyRequestsMetric := testutil.ToFloat64(globalMetrics.requestsTotal.WithLabelValues("test_zone", "static"))
+	zoneLevelRequestsMetric := testutil.ToFloat64(globalMetrics.requestsTotal.WithLabelValues("test_zone", "", ""))
+	perKeyRequestsMetric := testutil.ToFloat64(globalMetrics.requestsTotal.WithLabelValues("test_zone", "static", ""))
 
 	if zoneLevelRequestsMetric < float64(maxEvents) {
 		t.Errorf("Expected at least %d zone-level requests metric, got %f", maxEvents, zoneLevelRequestsMetric)
@@ -98,8 +105,8 @@ func TestMetrics(t *testing.T) {
 	tester.AssertGetResponse("http://localhost:8080", 429, "")
 
 	// Check declined requests metrics - verify both zone-level and per-key metrics
-	zoneLevelDeclinedMetric := testutil.ToFloat64(globalMetrics.declinedTotal.WithLabelValues("test_zone", ""))
-	perKeyDeclinedMetric := testutil.ToFloat64(globalMetrics.declinedTotal.WithLabelValues("test_zone", "static"))
+	zoneLevelDeclinedMetric := testutil.ToFloat64(globalMetrics.declinedTotal.WithLabelValues("test_zone", "", ""))
+	perKeyDeclinedMetric := testutil.ToFloat64(globalMetrics.declinedTotal.WithLabelValues("test_zone", "static", ""))
 
 	if zoneLevelDeclinedMetric == 0 {
 		t.Error("Expected zone-level declined requests metric to be recorded")
@@ -119,3 +126,272 @@ func TestMetrics(t *testing.T) {
 		t.Error("Expected per-key process time histogram to be created")
 	}
 }
+
+func TestProcessTimeBuckets(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	buckets := []float64{.00001, .0001, .001}
+	metrics := initializeMetrics(registry, buckets)
+	metrics.processTime.WithLabelValues("zone", "").Observe(.00005)
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("gathering metrics: %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() != "caddy_rate_limit_process_time_seconds" {
+			continue
+		}
+		histogram := family.GetMetric()[0].GetHistogram()
+		if len(histogram.GetBucket()) != len(buckets) {
+			t.Fatalf("expected %d buckets, got %d", len(buckets), len(histogram.GetBucket()))
+		}
+		for i, bucket := range histogram.GetBucket() {
+			if bucket.GetUpperBound() != buckets[i] {
+				t.Fatalf("bucket %d has upper bound %f (wanted %f)", i, bucket.GetUpperBound(), buckets[i])
+			}
+		}
+		return
+	}
+	t.Fatal("process time histogram was not registered")
+}
+
+func TestProcessTimeBucketsValidation(t *testing.T) {
+	app := RateLimitApp{Metrics: MetricsConfig{ProcessTimeBuckets: []float64{.1, .01}}}
+	if err := app.Provision(caddy.Context{}); err == nil {
+		t.Fatal("expected error for decreasing buckets")
+	}
+}
+
+func TestKeyLabelCardinalityGuard(t *testing.T) {
+	mc := newMetricsCollector(true, &RateLimitApp{Metrics: MetricsConfig{IncludeKey: true, MaxKeysPerZone: 2}})
+
+	for _, tc := range []struct {
+		zone, key, label string
+	}{
+		{"guarded_zone", "a", "a"},
+		{"guarded_zone", "b", "b"},
+		{"guarded_zone", "c", overflowKeyLabel},
+		{"guarded_zone", "a", "a"},
+		{"other_guarded_zone", "c", "c"},
+	} {
+		if label := mc.keyLabel(tc.zone, tc.key); label != tc.label {
+			t.Fatalf("key %s in zone %s: got label %s (wanted %s)", tc.key, tc.zone, label, tc.label)
+		}
+	}
+
+	unguarded := newMetricsCollector(true, &RateLimitApp{Metrics: MetricsConfig{IncludeKey: true}})
+	if label := unguarded.keyLabel("guarded_zone", "c"); label != "c" {
+		t.Fatalf("without a cap, keys should be used as labels; got %s", label)
+	}
+}
+
+func TestHashedKeyLabels(t *testing.T) {
+	mc := newMetricsCollector(true, &RateLimitApp{Metrics: MetricsConfig{IncludeKey: true, HashKeys: true}})
+
+	label := mc.keyLabel("hashed_zone", "user@example.com")
+	if label == "user@example.com" || len(label) != 16 {
+		t.Fatalf("expected a 16 character hash, got %s", label)
+	}
+	if again := mc.keyLabel("hashed_zone", "user@example.com"); again != label {
+		t.Fatalf("hash is not stable: %s != %s", again, label)
+	}
+	if other := mc.keyLabel("hashed_zone", "other@example.com"); other == label {
+		t.Fatal("different keys should have different hashes")
+	}
+}
+
+func TestSyncMetrics(t *testing.T) {
+	oldMetrics := globalMetrics
+	t.Cleanup(func() { globalMetrics = oldMetrics })
+	globalMetrics = initializeMetrics(prometheus.NewRegistry(), defaultProcessTimeBuckets)
+
+	initTime()
+	h := Handler{
+		Distributed: &DistributedRateLimiting{
+			WriteInterval: caddy.Duration(5 * time.Second),
+			otherStates:   []rlState{{Timestamp: now()}, {Timestamp: now().Add(-time.Minute)}},
+		},
+		metrics: newMetricsCollector(true, &RateLimitApp{}),
+	}
+	last := now()
+	var failed atomic.Bool
+
+	advanceTime(10)
+	err := h.recordSync(t.Context(), "read", func(context.Context) error { return errors.New("storage unavailable") }, &last, &failed)
+	if err == nil || !failed.Load() {
+		t.Fatal("expected sync error to be returned and recorded")
+	}
+	if errs := testutil.ToFloat64(globalMetrics.syncErrors.WithLabelValues("read")); errs != 1 {
+		t.Fatalf("expected 1 sync error, got %f", errs)
+	}
+	if staleness := testutil.ToFloat64(globalMetrics.syncStaleness.WithLabelValues("read")); staleness != 10 {
+		t.Fatalf("expected staleness of 10s after failed sync, got %f", staleness)
+	}
+
+	if err := h.recordSync(t.Context(), "read", func(context.Context) error { return nil }, &last, &failed); err != nil || failed.Load() {
+		t.Fatalf("unexpected sync error: %v", err)
+	}
+	if staleness := testutil.ToFloat64(globalMetrics.syncStaleness.WithLabelValues("read")); staleness != 0 {
+		t.Fatalf("expected no staleness after successful sync, got %f", staleness)
+	}
+	if !last.Equal(now()) {
+		t.Fatalf("expected last successful sync to be updated, got %s", last.Format(time.RFC3339))
+	}
+	if count := testutil.CollectAndCount(globalMetrics.syncDuration); count != 1 {
+		t.Fatalf("expected sync durations for 1 operation, got %d", count)
+	}
+	if active := testutil.ToFloat64(globalMetrics.clusterPeers.WithLabelValues("active")); active != 1 {
+		t.Fatalf("expected 1 active peer, got %f", active)
+	}
+	if stale := testutil.ToFloat64(globalMetrics.clusterPeers.WithLabelValues("stale")); stale != 1 {
+		t.Fatalf("expected 1 stale peer, got %f", stale)
+	}
+}
+
+func TestBanMetrics(t *testing.T) {
+	oldMetrics := globalMetrics
+	t.Cleanup(func() { globalMetrics = oldMetrics })
+	globalMetrics = initializeMetrics(prometheus.NewRegistry(), defaultProcessTimeBuckets)
+
+	initTime()
+	rl := &RateLimit{ZoneName: "ban_metrics_zone", Window: caddy.Duration(time.Minute), MaxEvents: 1}
+	if err := rl.provision(caddy.Context{}, rl.ZoneName); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _, _ = rateLimits.Delete(rl.ZoneName) })
+	h := Handler{metrics: newMetricsCollector(true, &RateLimitApp{}), logger: zap.NewNop()}
+
+	rl.limitersMap.ban("short", now().Add(10*time.Second))
+	rl.limitersMap.ban("long", now().Add(time.Hour))
+	h.sweepZone(rl)
+	if bans := testutil.ToFloat64(globalMetrics.activeBans.WithLabelValues(rl.ZoneName)); bans != 2 {
+		t.Fatalf("expected 2 active bans, got %f", bans)
+	}
+
+	advanceTime(20)
+	h.sweepZone(rl)
+	if bans := testutil.ToFloat64(globalMetrics.activeBans.WithLabelValues(rl.ZoneName)); bans != 1 {
+		t.Fatalf("expected 1 active ban after one expired, got %f", bans)
+	}
+	if count := testutil.CollectAndCount(globalMetrics.banDuration); count != 1 {
+		t.Fatalf("expected ban durations of 1 zone, got %d", count)
+	}
+}
+
+func TestUtilizationMetric(t *testing.T) {
+	oldMetrics := globalMetrics
+	t.Cleanup(func() { globalMetrics = oldMetrics })
+	globalMetrics = initializeMetrics(prometheus.NewRegistry(), defaultProcessTimeBuckets)
+
+	initTime()
+	rl := &RateLimit{
+		ZoneName:  "utilization_zone",
+		Key:       "static",
+		Window:    caddy.Duration(time.Minute),
+		MaxEvents: 4,
+	}
+	h := newTestHandler(t, rl)
+	h.metrics = newMetricsCollector(true, &RateLimitApp{})
+	for range 5 {
+		allowedBy(t, h, newTestRequest("GET", "/", nil))
+	}
+
+	// 0.25, 0.5, 0.75 and 1 for the allowed requests, and 1 for the declined one
+	var metric dto.Metric
+	if err := globalMetrics.utilization.WithLabelValues(rl.ZoneName).(prometheus.Histogram).Write(&metric); err != nil {
+		t.Fatal(err)
+	}
+	histogram := metric.GetHistogram()
+	if count, sum := histogram.GetSampleCount(), histogram.GetSampleSum(); count != 5 || sum != 3.5 {
+		t.Fatalf("expected 5 observations summing to 3.5, got %d summing to %f", count, sum)
+	}
+	for _, bucket := range histogram.GetBucket() {
+		if bucket.GetUpperBound() == .5 && bucket.GetCumulativeCount() != 2 {
+			t.Errorf("expected 2 requests at up to half of the limit, got %d", bucket.GetCumulativeCount())
+		}
+	}
+}
+
+func TestZoneIncludeKeyOverride(t *testing.T) {
+	mc := newMetricsCollector(true, &RateLimitApp{Metrics: MetricsConfig{IncludeKey: true}})
+	mc.setZoneIncludeKey("per_ip", false)
+
+	if mc.includeKey("per_ip") {
+		t.Fatal("zone override should disable per-key metrics")
+	}
+	if !mc.includeKey("per_tenant") {
+		t.Fatal("zones without override should use the app's setting")
+	}
+
+	mc = newMetricsCollector(true, &RateLimitApp{})
+	mc.setZoneIncludeKey("per_tenant", true)
+	if !mc.includeKey("per_tenant") {
+		t.Fatal("zone override should enable per-key metrics")
+	}
+	if mc.includeKey("per_ip") {
+		t.Fatal("zones without override should use the app's setting")
+	}
+}
+
+func TestAsyncMetrics(t *testing.T) {
+	oldMetrics := globalMetrics
+	t.Cleanup(func() { globalMetrics = oldMetrics })
+	globalMetrics = initializeMetrics(prometheus.NewRegistry(), defaultProcessTimeBuckets)
+
+	app := &RateLimitApp{metricsQueue: newMetricsQueue(1)}
+	mc := newMetricsCollector(true, app)
+
+	// the first measurement is queued; the second doesn't fit in the
+	// buffer, so it is recorded right away
+	mc.recordRequestPerKey("async_zone", "", "key")
+	mc.recordRequestPerKey("async_zone", "", "key")
+	requests := globalMetrics.requestsTotal.WithLabelValues("async_zone", "", "")
+	if count := testutil.ToFloat64(requests); count != 1 {
+		t.Fatalf("expected 1 request recorded synchronously, got %f", count)
+	}
+
+	app.metricsQueue.start()
+	app.metricsQueue.stop()
+	if count := testutil.ToFloat64(requests); count != 2 {
+		t.Fatalf("expected queued request to be recorded, got %f", count)
+	}
+
+	// after the queue is stopped, measurements are recorded synchronously
+	mc.recordRequestPerKey("async_zone", "", "key")
+	if count := testutil.ToFloat64(requests); count != 3 {
+		t.Fatalf("expected request to be recorded after stop, got %f", count)
+	}
+}
+
+func TestTenantMetrics(t *testing.T) {
+	oldMetrics := globalMetrics
+	t.Cleanup(func() { globalMetrics = oldMetrics })
+	globalMetrics = initializeMetrics(prometheus.NewRegistry(), defaultProcessTimeBuckets)
+
+	mc := newMetricsCollector(true, &RateLimitApp{})
+	mc.recordRequestPerKey("acme/api", "acme", "key")
+	mc.recordDeclinedRequest(context.Background(), "acme/api", "acme", "key")
+	mc.recordRequestPerKey("globex/api", "globex", "key")
+	mc.updateKeysCount("acme/api", "acme", 2)
+
+	if count := testutil.ToFloat64(globalMetrics.requestsTotal.WithLabelValues("acme/api", "", "acme")); count != 1 {
+		t.Errorf("expected 1 request of the tenant, got %f", count)
+	}
+	if count := testutil.ToFloat64(globalMetrics.declinedTotal.WithLabelValues("acme/api", "", "acme")); count != 1 {
+		t.Errorf("expected 1 declined request of the tenant, got %f", count)
+	}
+	if keys := testutil.ToFloat64(globalMetrics.keysTotal.WithLabelValues("acme/api", "acme")); keys != 2 {
+		t.Errorf("expected 2 keys of the tenant, got %f", keys)
+	}
+
+	// without tenancy, the app's grouping placeholder labels requests
+	repl := caddy.NewReplacer()
+	repl.Set("http.request.header.X-Customer-ID", "initech")
+	grouping := newKeyTemplate("{http.request.header.X-Customer-ID}")
+	if tenant := (Handler{tenantLabel: &grouping}).tenantOf(repl); tenant != "initech" {
+		t.Errorf("expected tenant initech, got %q", tenant)
+	}
+	if tenant := (Handler{}).tenantOf(repl); tenant != "" {
+		t.Errorf("expected no tenant without tenancy, got %q", tenant)
+	}
+}
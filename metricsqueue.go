@@ -0,0 +1,126 @@
+package caddyrl
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// metricsQueue records per-request measurements in a background worker,
+// so that label lookups and observations (and StatsD packets) are not
+// made while serving requests. If the queue is full, measurements are
+// recorded synchronously rather than dropped.
+type metricsQueue struct {
+	measurements chan measurement
+	done         chan struct{}
+	stopped      atomic.Bool
+	wg           sync.WaitGroup
+}
+
+// measurementKind identifies the metricsCollector method that records
+// a queued measurement.
+type measurementKind uint8
+
+const (
+	measureRequest measurementKind = iota
+	measureRequestPerKey
+	measureDeclinedRequest
+	measureProcessTime
+	measureProcessTimePerKey
+	measureNearLimitRequest
+	measureRemaining
+	measureUtilization
+)
+
+// measurement holds the arguments of a queued metricsCollector call.
+type measurement struct {
+	mc        *metricsCollector
+	kind      measurementKind
+	ctx       context.Context
+	zone, key string
+	tenant    string
+	hasZone   bool
+	duration  time.Duration
+	remaining int
+
+	utilization float64
+}
+
+func newMetricsQueue(size int) *metricsQueue {
+	return &metricsQueue{
+		measurements: make(chan measurement, size),
+		done:         make(chan struct{}),
+	}
+}
+
+// start records queued measurements until stop is called.
+func (q *metricsQueue) start() {
+	q.wg.Go(func() {
+		for {
+			select {
+			case m := <-q.measurements:
+				m.record()
+			case <-q.done:
+				// record what is left, so it isn't lost on reloads
+				for {
+					select {
+					case m := <-q.measurements:
+						m.record()
+					default:
+						return
+					}
+				}
+			}
+		}
+	})
+}
+
+// stop records the remaining measurements and stops the worker.
+func (q *metricsQueue) stop() {
+	// handlers of the previous config may still be serving requests
+	// until they finish; their measurements are recorded synchronously
+	q.stopped.Store(true)
+	close(q.done)
+	q.wg.Wait()
+}
+
+// enqueue queues m without blocking. It returns false if the queue is
+// full or stopped, in which case the caller should record m itself.
+func (q *metricsQueue) enqueue(m measurement) bool {
+	if q.stopped.Load() {
+		return false
+	}
+	select {
+	case q.measurements <- m:
+		return true
+	default:
+		return false
+	}
+}
+
+// record makes the metricsCollector call that m was queued for.
+func (m measurement) record() {
+	// a copy of the collector without the queue records synchronously
+	mc := *m.mc
+	mc.queue = nil
+
+	switch m.kind {
+	case measureRequest:
+		mc.recordRequest(m.hasZone)
+	case measureRequestPerKey:
+		mc.recordRequestPerKey(m.zone, m.tenant, m.key)
+	case measureDeclinedRequest:
+		mc.recordDeclinedRequest(m.ctx, m.zone, m.tenant, m.key)
+	case measureProcessTime:
+		mc.recordProcessTime(m.duration, m.hasZone)
+	case measureProcessTimePerKey:
+		mc.recordProcessTimePerKey(m.ctx, m.duration, m.zone, m.key)
+	case measureNearLimitRequest:
+		mc.recordNearLimitRequest(m.zone, m.key)
+	case measureRemaining:
+		mc.updateRemaining(m.zone, m.key, m.remaining)
+	case measureUtilization:
+		mc.recordUtilization(m.zone, m.utilization)
+	}
+}
@@ -0,0 +1,88 @@
+package caddyrl
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// NewKeyLimit caps the rate at which keys that a zone hasn't seen
+// before enter it. Floods of requests with randomized identifiers, e.g.
+// API keys, session IDs or spoofed headers, defeat per-key limits,
+// since every request has a fresh key with a full limit; but legitimate
+// clients rarely show up in such numbers at once. Once the cap is
+// reached, the zone switches to a stricter stance: requests of new keys
+// are declined until the rate of new keys falls below the cap, while
+// keys that the zone already has state for are unaffected.
+//
+// Like with greylists, a key is new when the zone has no state for it.
+type NewKeyLimit struct {
+	// The maximum number of new keys within the interval. Required.
+	MaxKeys int `json:"max_keys,omitempty"`
+
+	// The sliding interval in which new keys are counted. Default: 1m
+	Interval caddy.Duration `json:"interval,omitempty"`
+}
+
+// provision sets the defaults and validates the limit.
+func (nk *NewKeyLimit) provision() error {
+	if nk.Interval == 0 {
+		nk.Interval = caddy.Duration(time.Minute)
+	}
+	if nk.Interval < 0 {
+		return fmt.Errorf("interval must be greater than zero")
+	}
+	if nk.MaxKeys < 1 {
+		return fmt.Errorf("max_keys must be at least 1")
+	}
+	return nil
+}
+
+// setNewKeyLimit caps the number of new keys of the zone within
+// interval; a maxKeys of 0 removes the cap. The new keys counted so far
+// are kept.
+func (rlm *rateLimitersMap) setNewKeyLimit(maxKeys int, interval time.Duration) {
+	rlm.limitersMu.Lock()
+	defer rlm.limitersMu.Unlock()
+	if maxKeys == 0 {
+		rlm.newKeys.Store(nil)
+		return
+	}
+	if newKeys := rlm.newKeys.Load(); newKeys != nil {
+		newKeys.SetMaxEvents(maxKeys)
+		newKeys.SetWindow(interval)
+		return
+	}
+	rlm.newKeys.Store(newRingBufferRateLimiter(maxKeys, interval))
+}
+
+// known returns true if the zone has state for key, or remembers it in
+// its first-seen filter.
+func (rlm *rateLimitersMap) known(key string) bool {
+	if al := rlm.algorithm.Load(); al != nil {
+		_, ok := al.get(key)
+		return ok
+	}
+	if _, ok := rlm.get(key); ok {
+		return true
+	}
+	f := rlm.firstSeen.Load()
+	return f != nil && f.contains(key)
+}
+
+// admitNewKey counts key towards the zone's cap on new keys if it is
+// new. It returns how long new keys have to wait if the cap is reached,
+// or zero if key is admitted, and true if this started a flood of new
+// keys, i.e. the cap was just reached after new keys were admitted.
+func (rlm *rateLimitersMap) admitNewKey(key string) (time.Duration, bool) {
+	newKeys := rlm.newKeys.Load()
+	if newKeys == nil || rlm.known(key) {
+		return 0, false
+	}
+	if wait := newKeys.When(); wait > 0 {
+		return wait, rlm.newKeyFlood.CompareAndSwap(false, true)
+	}
+	rlm.newKeyFlood.Store(false)
+	return 0, false
+}
@@ -0,0 +1,77 @@
+package caddyrl
+
+import (
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestNewKeyLimit(t *testing.T) {
+	initTime()
+
+	rl := &RateLimit{
+		ZoneName:  "new_keys_zone",
+		Key:       "{http.request.remote.host}",
+		Window:    caddy.Duration(time.Minute),
+		MaxEvents: 10,
+		NewKeys:   &NewKeyLimit{MaxKeys: 2},
+	}
+	h := newTestHandler(t, rl)
+	allowed := func(host string) bool {
+		t.Helper()
+		return allowedBy(t, h, newTestRequest("GET", "/", map[string]string{"http.request.remote.host": host}))
+	}
+
+	if !allowed("192.0.2.1") || !allowed("192.0.2.2") {
+		t.Fatal("expected new keys to be allowed up to the cap")
+	}
+	if allowed("192.0.2.3") || allowed("192.0.2.4") {
+		t.Fatal("expected new keys beyond the cap to be declined")
+	}
+	if !rl.limitersMap.newKeyFlood.Load() {
+		t.Error("expected the zone to be flooded with new keys")
+	}
+	if !allowed("192.0.2.1") {
+		t.Error("expected known keys to be allowed during a flood of new keys")
+	}
+
+	// the flood is over once new keys left the interval
+	advanceTime(61)
+	if !allowed("192.0.2.3") {
+		t.Error("expected new keys to be allowed again after the interval")
+	}
+	if rl.limitersMap.newKeyFlood.Load() {
+		t.Error("expected the flood of new keys to be over")
+	}
+
+	for _, bad := range []*NewKeyLimit{{}, {MaxKeys: 1, Interval: -1}} {
+		if err := bad.provision(); err == nil {
+			t.Errorf("expected an error for %+v", bad)
+		}
+	}
+}
+
+func TestCaddyfileNewKeys(t *testing.T) {
+	var h Handler
+	if err := h.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`rate_limit {
+		zone api {
+			events   100
+			window   1m
+			new_keys 1000 30s
+		}
+	}`)); err != nil {
+		t.Fatalf("unmarshaling Caddyfile: %v", err)
+	}
+	if nk := h.RateLimits[0].NewKeys; nk == nil || nk.MaxKeys != 1000 || nk.Interval != caddy.Duration(30*time.Second) {
+		t.Errorf("unexpected new_keys: %+v", nk)
+	}
+
+	for _, newKeys := range []string{"new_keys", "new_keys lots", "new_keys 10 soon", "new_keys 10 1m 2"} {
+		var bad Handler
+		if err := bad.UnmarshalCaddyfile(caddyfile.NewTestDispenser("rate_limit {\n\tzone api {\n\t\t" + newKeys + "\n\t}\n}")); err == nil {
+			t.Errorf("expected an error for %q", newKeys)
+		}
+	}
+}
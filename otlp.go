@@ -0,0 +1,123 @@
+package caddyrl
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	otelprom "go.opentelemetry.io/contrib/bridges/prometheus"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+)
+
+// OTLPExporter periodically pushes the module's metrics to an
+// OpenTelemetry collector over OTLP, for environments that standardize
+// on OpenTelemetry rather than Prometheus scraping. The pushed metrics
+// are the same as the Prometheus metrics, whether or not Caddy's
+// metrics are enabled.
+//
+// Settings that are not configured here, such as headers or TLS
+// certificates, can be set with the standard OTEL_EXPORTER_OTLP_*
+// environment variables.
+type OTLPExporter struct {
+	// The host:port of the collector. Default: localhost:4317 for gRPC
+	// and localhost:4318 for HTTP, unless set by the environment.
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// The OTLP protocol, either `grpc` or `http/protobuf`. Default: grpc
+	Protocol string `json:"protocol,omitempty"`
+
+	// If true, the collector is connected to without TLS.
+	Insecure bool `json:"insecure,omitempty"`
+
+	// How often metrics are pushed. Default: 1m
+	Interval caddy.Duration `json:"interval,omitempty"`
+
+	gatherer prometheus.Gatherer
+	provider *sdkmetric.MeterProvider
+}
+
+func (oe *OTLPExporter) provision(registry *prometheus.Registry) error {
+	switch oe.Protocol {
+	case "":
+		oe.Protocol = "grpc"
+	case "grpc", "http/protobuf":
+	default:
+		return fmt.Errorf("unsupported protocol '%s'", oe.Protocol)
+	}
+	if oe.Interval < 0 {
+		return fmt.Errorf("interval must be at least zero")
+	}
+	if oe.Interval == 0 {
+		oe.Interval = caddy.Duration(time.Minute)
+	}
+	if registry == nil {
+		return fmt.Errorf("metrics registry not available")
+	}
+	oe.gatherer = rateLimitGatherer(registry)
+	return nil
+}
+
+// start begins pushing metrics in the background.
+func (oe *OTLPExporter) start(ctx context.Context) error {
+	var exporter sdkmetric.Exporter
+	var err error
+	switch oe.Protocol {
+	case "grpc":
+		var opts []otlpmetricgrpc.Option
+		if oe.Endpoint != "" {
+			opts = append(opts, otlpmetricgrpc.WithEndpoint(oe.Endpoint))
+		}
+		if oe.Insecure {
+			opts = append(opts, otlpmetricgrpc.WithInsecure())
+		}
+		exporter, err = otlpmetricgrpc.New(ctx, opts...)
+	case "http/protobuf":
+		var opts []otlpmetrichttp.Option
+		if oe.Endpoint != "" {
+			opts = append(opts, otlpmetrichttp.WithEndpoint(oe.Endpoint))
+		}
+		if oe.Insecure {
+			opts = append(opts, otlpmetrichttp.WithInsecure())
+		}
+		exporter, err = otlpmetrichttp.New(ctx, opts...)
+	}
+	if err != nil {
+		return fmt.Errorf("creating %s exporter: %v", oe.Protocol, err)
+	}
+
+	reader := sdkmetric.NewPeriodicReader(exporter,
+		sdkmetric.WithInterval(time.Duration(oe.Interval)),
+		sdkmetric.WithProducer(otelprom.NewMetricProducer(otelprom.WithGatherer(oe.gatherer))),
+	)
+	oe.provider = sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	return nil
+}
+
+// stop pushes metrics one last time and stops the exporter.
+func (oe *OTLPExporter) stop(ctx context.Context) error {
+	if oe.provider == nil {
+		return nil
+	}
+	return oe.provider.Shutdown(ctx)
+}
+
+// rateLimitGatherer returns a gatherer of only this module's metrics
+// from registry, which also contains the rest of Caddy's metrics.
+func rateLimitGatherer(registry prometheus.Gatherer) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		families, err := registry.Gather()
+		filtered := families[:0]
+		for _, family := range families {
+			if strings.HasPrefix(family.GetName(), "caddy_rate_limit_") {
+				filtered = append(filtered, family)
+			}
+		}
+		return filtered, err
+	})
+}
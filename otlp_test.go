@@ -0,0 +1,39 @@
+package caddyrl
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+func TestRateLimitGatherer(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	promauto.With(registry).NewCounter(prometheus.CounterOpts{Name: "caddy_http_requests_total"}).Inc()
+	promauto.With(registry).NewCounter(prometheus.CounterOpts{Name: "caddy_rate_limit_requests_total"}).Inc()
+
+	families, err := rateLimitGatherer(registry).Gather()
+	if err != nil {
+		t.Fatalf("gathering metrics: %v", err)
+	}
+	if len(families) != 1 || families[0].GetName() != "caddy_rate_limit_requests_total" {
+		t.Fatalf("expected only the rate limit metric, got %v", families)
+	}
+}
+
+func TestOTLPExporterProvision(t *testing.T) {
+	oe := new(OTLPExporter)
+	if err := oe.provision(prometheus.NewRegistry()); err != nil {
+		t.Fatalf("provisioning exporter: %v", err)
+	}
+	if oe.Protocol != "grpc" {
+		t.Fatalf("expected default protocol grpc, got %s", oe.Protocol)
+	}
+
+	if err := (&OTLPExporter{Protocol: "thrift"}).provision(prometheus.NewRegistry()); err == nil {
+		t.Fatal("expected error for unsupported protocol")
+	}
+	if err := new(OTLPExporter).provision(nil); err == nil {
+		t.Fatal("expected error without a metrics registry")
+	}
+}
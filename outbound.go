@@ -0,0 +1,43 @@
+package caddyrl
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Reserve reserves an event for key in the zone named zoneName, for
+// modules that send requests to third parties and want to stay within
+// limits shared with rate_limit handlers and transports. The zone must
+// be defined by one of them (or be the app's global zone), and has the
+// same state as theirs. If the event is not allowed, no reservation is
+// made, and Reserve returns how long to wait before trying again.
+func Reserve(zoneName, key string) (time.Duration, error) {
+	rlm, ok := zoneLimiters(zoneName)
+	if !ok {
+		return 0, fmt.Errorf("rate limit zone %s is not defined", zoneName)
+	}
+	if wait := rlm.banned(key); wait > 0 {
+		return wait, nil
+	}
+	return rlm.whenKey(key), nil
+}
+
+// Wait reserves an event for key in the zone named zoneName, waiting
+// until the event is allowed or ctx is done; see Reserve.
+func Wait(ctx context.Context, zoneName, key string) error {
+	for {
+		wait, err := Reserve(zoneName, key)
+		if err != nil || wait == 0 {
+			return err
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
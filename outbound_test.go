@@ -0,0 +1,32 @@
+package caddyrl
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestReserve(t *testing.T) {
+	initTime()
+
+	rlm := newRateLimiterMap()
+	rlm.updateAll(1, time.Minute)
+	rateLimits.LoadOrStore("outbound", rlm)
+	t.Cleanup(func() { rateLimits.Delete("outbound") })
+
+	if wait, err := Reserve("outbound", "api"); err != nil || wait != 0 {
+		t.Fatalf("first event should be allowed, got wait %s, error %v", wait, err)
+	}
+	if wait, err := Reserve("outbound", "api"); err != nil || wait != time.Minute {
+		t.Fatalf("expected to wait a minute, got wait %s, error %v", wait, err)
+	}
+	if _, err := Reserve("undefined", "api"); err == nil {
+		t.Fatal("expected error for undefined zone")
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	if err := Wait(ctx, "outbound", "api"); err != context.Canceled {
+		t.Fatalf("expected wait to end with the context, got %v", err)
+	}
+}
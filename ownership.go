@@ -0,0 +1,396 @@
+package caddyrl
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// KeyOwnership makes distributed rate limiting exact: each key is owned
+// by one instance of the cluster, chosen by consistent hashing over the
+// IDs of the instances, which makes the decisions for the key. Other
+// instances forward events of the key to its owner, and remember its
+// declines until they expire. If the owner can't be reached, they fall
+// back to the approximate decision that uses the last known states of
+// other instances.
+//
+// Forwarded events are requests to Path, which the rate_limit handler
+// answers before limiting anything, so the handler must be reachable at
+// Advertise by other instances. All instances must enable ownership with
+// the same secret.
+type KeyOwnership struct {
+	// The base URL at which other instances reach this instance's
+	// handler, e.g. `http://10.0.0.5:8080`. Required.
+	Advertise string `json:"advertise,omitempty"`
+
+	// The secret with which instances sign forwarded events, so that
+	// clients can't forge them. Required.
+	Secret string `json:"secret,omitempty"`
+
+	// The path at which the handler answers forwarded events.
+	// Default: `/.well-known/caddy-rate-limit/decide`
+	Path string `json:"path,omitempty"`
+
+	// How long to wait for the owner of a key before deciding locally.
+	// Default: 1s
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	// If set, keys are distributed over the instances it discovers,
+	// rather than over those that write their state to storage; see
+	// PeerDiscovery.
+	Discovery *PeerDiscovery `json:"discovery,omitempty"`
+
+	// the ID of this instance on the ring of owners: its instance ID, or
+	// its advertise URL with discovery
+	self string
+
+	client     *http.Client
+	backendTLS *BackendTLS
+	pool       *BackendPool
+	warming    atomic.Bool
+	logger     *zap.Logger
+
+	// the owners of keys, as of the last read of other instances' states
+	owners atomic.Pointer[ownerRing]
+}
+
+// provision sets up ownership, with connections to other instances
+// secured by backendTLS and pooled as configured by pool, if not nil.
+func (ko *KeyOwnership) provision(instanceID string, backendTLS *BackendTLS, pool *BackendPool, logger *zap.Logger) error {
+	if ko.Advertise == "" {
+		return fmt.Errorf("advertise address is required")
+	}
+	if _, err := url.Parse(ko.Advertise); err != nil {
+		return fmt.Errorf("invalid advertise address '%s': %v", ko.Advertise, err)
+	}
+	if ko.Secret == "" {
+		return fmt.Errorf("secret is required")
+	}
+	if ko.Path == "" {
+		ko.Path = "/.well-known/caddy-rate-limit/decide"
+	}
+	if ko.Timeout < 0 {
+		return fmt.Errorf("timeout must be at least zero")
+	}
+	if ko.Timeout == 0 {
+		ko.Timeout = caddy.Duration(time.Second)
+	}
+	if err := backendTLS.allows(ko.Advertise); err != nil {
+		return err
+	}
+	var tlsConfig *tls.Config
+	if backendTLS != nil {
+		var err error
+		if tlsConfig, err = backendTLS.config(); err != nil {
+			return fmt.Errorf("setting up backend TLS: %v", err)
+		}
+	}
+	if pool == nil {
+		pool = new(BackendPool)
+	}
+	if err := pool.provision(); err != nil {
+		return fmt.Errorf("setting up backend pool: %v", err)
+	}
+	ko.client = pool.client(time.Duration(ko.Timeout), tlsConfig)
+	ko.backendTLS = backendTLS
+	ko.pool = pool
+	ko.logger = logger
+
+	ko.self = instanceID
+	if ko.Discovery != nil {
+		if err := ko.Discovery.provision(); err != nil {
+			return fmt.Errorf("setting up discovery: %v", err)
+		}
+		ko.self = ko.Advertise
+	}
+
+	// until other instances are known, this instance owns all keys
+	ko.owners.Store(newOwnerRing(map[string]string{ko.self: ko.Advertise}))
+	return nil
+}
+
+// updateOwners distributes keys over this instance and the other
+// instances that advertise themselves in states and have written them
+// recently enough, which is within staleAfter of ref.
+//
+// With discovery, the discovered instances are kept instead.
+func (ko *KeyOwnership) updateOwners(instanceID string, states []rlState, ref time.Time, staleAfter time.Duration) {
+	if ko.Discovery != nil {
+		return
+	}
+	instances := map[string]string{instanceID: ko.Advertise}
+	for _, state := range states {
+		if state.InstanceID == "" || state.Advertise == "" || state.Left || state.Timestamp.Before(ref.Add(-staleAfter)) {
+			continue
+		}
+		instances[state.InstanceID] = state.Advertise
+	}
+	ko.setOwners(instanceID, instances)
+}
+
+// setOwners distributes keys over instances, which map IDs to advertised
+// addresses, and of which the one with the ID self is this instance.
+func (ko *KeyOwnership) setOwners(self string, instances map[string]string) {
+	ko.owners.Store(newOwnerRing(instances))
+
+	// keep connections to the other instances open ahead of events
+	if ko.pool.MinIdleConns > 0 && ko.warming.CompareAndSwap(false, true) {
+		var endpoints []string
+		for id, advertise := range instances {
+			endpoint, err := url.JoinPath(advertise, ko.Path)
+			if id == self || err != nil || ko.backendTLS.allows(endpoint) != nil {
+				continue
+			}
+			endpoints = append(endpoints, endpoint)
+		}
+		go func() {
+			defer ko.warming.Store(false)
+			ko.pool.warm(context.Background(), ko.client, endpoints)
+		}()
+	}
+}
+
+// ownerRingReplicas is the number of points of each instance on the
+// ring, which spreads keys evenly over instances.
+const ownerRingReplicas = 64
+
+// ownerRing maps keys to instances by consistent hashing, so that only
+// the keys of an instance that joins or leaves change owners.
+type ownerRing struct {
+	points []ownerPoint // sorted by hash
+}
+
+type ownerPoint struct {
+	hash       uint64
+	instanceID string
+	advertise  string
+}
+
+// newOwnerRing returns a ring of the given instances, which are mapped
+// to their advertised addresses.
+func newOwnerRing(instances map[string]string) *ownerRing {
+	ring := &ownerRing{points: make([]ownerPoint, 0, len(instances)*ownerRingReplicas)}
+	for id, advertise := range instances {
+		for i := range ownerRingReplicas {
+			ring.points = append(ring.points, ownerPoint{
+				hash:       ownerHash(id + "#" + strconv.Itoa(i)),
+				instanceID: id,
+				advertise:  advertise,
+			})
+		}
+	}
+	slices.SortFunc(ring.points, func(a, b ownerPoint) int {
+		// collisions are resolved the same way by all instances
+		return cmp.Or(cmp.Compare(a.hash, b.hash), strings.Compare(a.instanceID, b.instanceID))
+	})
+	return ring
+}
+
+// owner returns the instance that owns key in the zone with the given
+// name.
+func (ring *ownerRing) owner(zoneName, key string) ownerPoint {
+	hash := ownerHash(zoneName + "\x00" + key)
+	i, _ := slices.BinarySearchFunc(ring.points, hash, func(p ownerPoint, hash uint64) int {
+		return cmp.Compare(p.hash, hash)
+	})
+	if i == len(ring.points) {
+		i = 0
+	}
+	return ring.points[i]
+}
+
+// ownerHash hashes s the same way on all instances, spreading similar
+// strings such as the names of an instance's points evenly.
+func ownerHash(s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// ownedEvent is an event that is forwarded to the owner of its key.
+type ownedEvent struct {
+	Zone string `json:"zone"`
+	Key  string `json:"key"`
+
+	// the number of events it counts as; 0 counts as 1, so that
+	// instances that don't send costs can still forward events
+	Cost int `json:"cost,omitempty"`
+
+	// when the event was forwarded, so that it can't be replayed later
+	Time time.Time `json:"time"`
+}
+
+// ownedDecision is the decision of the owner of a key about an event.
+type ownedDecision struct {
+	// how long to wait before the event would be allowed, or 0 if it
+	// is allowed
+	Wait time.Duration `json:"wait"`
+
+	// whether the event was declined because of the zone as a whole;
+	// see RateLimit.OverloadStatus
+	Overload bool `json:"overload,omitempty"`
+
+	// the events left in the key's window, and when it resets
+	Remaining int           `json:"remaining"`
+	Reset     time.Duration `json:"reset"`
+}
+
+// ownedEventMaxAge is how old a forwarded event may be when it arrives;
+// clocks of instances may differ by up to this much.
+const ownedEventMaxAge = time.Minute
+
+// ownershipSignatureHeader is the header of forwarded events that has
+// their signature.
+const ownershipSignatureHeader = "Caddy-Rate-Limit-Signature"
+
+// decideOwned decides about an event of key in the zone that rlm
+// limits, whose owner is this instance, which counts as cost events.
+func decideOwned(rlm *rateLimitersMap, key string, cost int) ownedDecision {
+	limiter := rlm.getOrInsert(key)
+	var d ownedDecision
+	if d.Wait = rlm.whenN(limiter, cost); d.Wait > 0 {
+		d.Overload = rlm.overloaded(limiter)
+		return d
+	}
+	ref := now()
+	count, oldest := limiter.Count(ref)
+	d.Remaining = max(limiter.MaxEvents()-count, 0)
+	if count > 0 {
+		d.Reset = oldest.Add(limiter.Window()).Sub(ref)
+	}
+	return d
+}
+
+// ownerDecision gets the decision about an event of key in rl from the
+// key's owner, if the handler enables key ownership; see decide.
+func (h Handler) ownerDecision(ctx context.Context, rl *RateLimit, key string, cost int) (ownedDecision, bool) {
+	if h.Distributed == nil || h.Distributed.Ownership == nil || rl.Consistency == consistencyLocal {
+		return ownedDecision{}, false
+	}
+	return h.Distributed.Ownership.decide(ctx, h.Distributed.Ownership.self, rl, key, cost)
+}
+
+// decide gets the decision about an event of key in rl from the key's
+// owner, which may be this instance. It returns false if the owner
+// couldn't decide, in which case the event must be decided otherwise.
+func (ko *KeyOwnership) decide(ctx context.Context, instanceID string, rl *RateLimit, key string, cost int) (ownedDecision, bool) {
+	owner := ko.owners.Load().owner(rl.ZoneName, key)
+	if owner.instanceID == instanceID {
+		return decideOwned(rl.limitersMap, key, cost), true
+	}
+
+	d, err := ko.forward(ctx, owner.advertise, ownedEvent{Zone: rl.ZoneName, Key: key, Cost: cost, Time: now()})
+	if err != nil {
+		ko.logger.Warn("forwarding event to owner of key; deciding locally",
+			zap.String("zone", rl.ZoneName),
+			zap.String("owner", owner.instanceID),
+			zap.Error(err))
+		return ownedDecision{}, false
+	}
+	if d.Wait > 0 {
+		// the key's events are declined without asking the owner again
+		// until they may be allowed
+		rl.limitersMap.backOff(key, now().Add(d.Wait))
+	}
+	return d, true
+}
+
+// forward sends event to the instance at advertise and returns its
+// decision.
+func (ko *KeyOwnership) forward(ctx context.Context, advertise string, event ownedEvent) (ownedDecision, error) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return ownedDecision{}, err
+	}
+	endpoint, err := url.JoinPath(advertise, ko.Path)
+	if err != nil {
+		return ownedDecision{}, err
+	}
+	if err := ko.backendTLS.allows(endpoint); err != nil {
+		return ownedDecision{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return ownedDecision{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(ownershipSignatureHeader, hex.EncodeToString(ko.sign(body)))
+
+	resp, err := ko.client.Do(req)
+	if err != nil {
+		return ownedDecision{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return ownedDecision{}, fmt.Errorf("owner responded with status %d", resp.StatusCode)
+	}
+	var d ownedDecision
+	if err := json.NewDecoder(resp.Body).Decode(&d); err != nil {
+		return ownedDecision{}, fmt.Errorf("decoding decision: %v", err)
+	}
+	return d, nil
+}
+
+// sign returns the signature of a forwarded event's body.
+func (ko *KeyOwnership) sign(body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(ko.Secret))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// serveDecide answers an event that another instance forwarded to this
+// one as the owner of its key.
+func (ko *KeyOwnership) serveDecide(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return nil
+	}
+	signature, err := hex.DecodeString(r.Header.Get(ownershipSignatureHeader))
+	if err != nil || !hmac.Equal(signature, ko.sign(body)) {
+		w.WriteHeader(http.StatusForbidden)
+		return nil
+	}
+
+	var event ownedEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return nil
+	}
+	if age := now().Sub(event.Time); age > ownedEventMaxAge || age < -ownedEventMaxAge {
+		w.WriteHeader(http.StatusForbidden)
+		return nil
+	}
+	rlm, ok := zoneLimiters(event.Zone)
+	if !ok {
+		// e.g. a zone whose name has placeholders, which this instance
+		// hasn't resolved yet
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(decideOwned(rlm, event.Key, max(event.Cost, 1)))
+}
@@ -0,0 +1,195 @@
+package caddyrl
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+func TestOwnerRing(t *testing.T) {
+	three := newOwnerRing(map[string]string{"a": "http://a", "b": "http://b", "c": "http://c"})
+	again := newOwnerRing(map[string]string{"c": "http://c", "a": "http://a", "b": "http://b"})
+
+	owned := make(map[string]int)
+	for i := range 3000 {
+		key := fmt.Sprintf("client-%d", i)
+		owner := three.owner("zone", key)
+		if other := again.owner("zone", key); other.instanceID != owner.instanceID {
+			t.Fatalf("key %s: expected the same owner on all instances, got %s and %s", key, owner.instanceID, other.instanceID)
+		}
+		if owner.advertise != "http://"+owner.instanceID {
+			t.Fatalf("key %s: unexpected address %s of owner %s", key, owner.advertise, owner.instanceID)
+		}
+		owned[owner.instanceID]++
+	}
+	for id, n := range owned {
+		if n < 500 {
+			t.Errorf("expected keys to be spread evenly, instance %s owns %d of 3000", id, n)
+		}
+	}
+
+	// only keys that the new instance takes over change owners
+	four := newOwnerRing(map[string]string{"a": "http://a", "b": "http://b", "c": "http://c", "d": "http://d"})
+	for i := range 3000 {
+		key := fmt.Sprintf("client-%d", i)
+		before, after := three.owner("zone", key), four.owner("zone", key)
+		if after.instanceID != "d" && after.instanceID != before.instanceID {
+			t.Fatalf("key %s moved from %s to %s", key, before.instanceID, after.instanceID)
+		}
+	}
+}
+
+func TestUpdateOwners(t *testing.T) {
+	ref := time.Unix(referenceTime, 0)
+	ko := &KeyOwnership{Advertise: "http://self", Secret: "s"}
+	if err := ko.provision("self", nil, nil, zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+	ko.updateOwners("self", []rlState{
+		{InstanceID: "fresh", Advertise: "http://fresh", Timestamp: ref.Add(-time.Second)},
+		{InstanceID: "stale", Advertise: "http://stale", Timestamp: ref.Add(-time.Hour)},
+		{InstanceID: "approximate", Timestamp: ref},
+	}, ref, time.Minute)
+
+	owners := make(map[string]bool)
+	for _, p := range ko.owners.Load().points {
+		owners[p.instanceID] = true
+	}
+	if len(owners) != 2 || !owners["self"] || !owners["fresh"] {
+		t.Errorf("expected only this instance and the fresh one to own keys, got %v", owners)
+	}
+}
+
+func TestKeyOwnershipForwarding(t *testing.T) {
+	initTime()
+
+	rl := &RateLimit{
+		ZoneName:  "owned_zone",
+		Key:       "static",
+		Window:    caddy.Duration(time.Minute),
+		MaxEvents: 2,
+	}
+	if err := rl.provision(caddy.Context{}, rl.ZoneName); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _, _ = rateLimits.Delete(rl.ZoneName) })
+
+	// the owner and the forwarding instance share the zone's limiters in
+	// this process, but the forwarding instance never counts events
+	// itself, so the owner's decisions are the only ones
+	owner := &KeyOwnership{Secret: "shared"}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = owner.serveDecide(w, r)
+	}))
+	defer srv.Close()
+	owner.Advertise = srv.URL
+	if err := owner.provision("owner", nil, nil, zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+
+	forwarder := &KeyOwnership{Advertise: "http://forwarder", Secret: "shared"}
+	if err := forwarder.provision("forwarder", nil, nil, zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+	forwarder.owners.Store(newOwnerRing(map[string]string{"owner": srv.URL}))
+
+	for i := range 2 {
+		d, ok := forwarder.decide(context.Background(), "forwarder", rl, "client", 1)
+		if !ok || d.Wait != 0 || d.Remaining != 1-i {
+			t.Fatalf("event %d: expected the owner to allow it, got %+v, %t", i, d, ok)
+		}
+	}
+	d, ok := forwarder.decide(context.Background(), "forwarder", rl, "client", 1)
+	if !ok || d.Wait != time.Minute {
+		t.Fatalf("expected the owner to decline the third event, got %+v, %t", d, ok)
+	}
+	if wait := rl.limitersMap.backedOff("client"); wait != time.Minute {
+		t.Errorf("expected the decline to be remembered for a minute, got %v", wait)
+	}
+
+	// the owner doesn't know zones it hasn't resolved
+	unknown := &RateLimit{ZoneName: "unknown_owned_zone", limitersMap: rl.limitersMap}
+	if _, ok := forwarder.decide(context.Background(), "forwarder", unknown, "client", 1); ok {
+		t.Error("expected an unknown zone not to be decided by the owner")
+	}
+
+	// events that aren't signed with the secret are refused
+	forged := &KeyOwnership{Advertise: "http://forged", Secret: "guessed"}
+	if err := forged.provision("forged", nil, nil, zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := forged.forward(context.Background(), srv.URL, ownedEvent{Zone: rl.ZoneName, Key: "other", Time: now()}); err == nil {
+		t.Error("expected an event with a wrong signature to be refused")
+	}
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, owner.Path, bytes.NewReader([]byte(`{"zone":"owned_zone","key":"other"}`)))
+	if _ = owner.serveDecide(rec, req); rec.Code != http.StatusForbidden {
+		t.Errorf("expected an unsigned event to be refused, got status %d", rec.Code)
+	}
+	if _, ok := rl.limitersMap.get("other"); ok {
+		t.Error("expected refused events not to be counted")
+	}
+
+	// if the owner is gone, the event is decided otherwise
+	srv.Close()
+	if _, ok := forwarder.decide(context.Background(), "forwarder", rl, "another", 1); ok {
+		t.Error("expected an unreachable owner not to decide")
+	}
+}
+
+func TestCaddyfileOwnership(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`
+	rate_limit {
+		distributed {
+			ownership http://10.0.0.5:8080 {
+				secret  hunter2
+				path    /decide
+				timeout 250ms
+			}
+		}
+	}`)
+
+	var h Handler
+	if err := h.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshaling Caddyfile: %v", err)
+	}
+	ko := h.Distributed.Ownership
+	if ko == nil || ko.Advertise != "http://10.0.0.5:8080" || ko.Secret != "hunter2" || ko.Path != "/decide" || ko.Timeout != caddy.Duration(250*time.Millisecond) {
+		t.Fatalf("unexpected ownership: %+v", ko)
+	}
+
+	for _, input := range []string{
+		`rate_limit {
+			distributed {
+				ownership
+			}
+		}`,
+		`rate_limit {
+			distributed {
+				ownership http://a {
+					secret
+				}
+			}
+		}`,
+		`rate_limit {
+			distributed {
+				ownership http://a {
+					bogus
+				}
+			}
+		}`,
+	} {
+		var h Handler
+		if err := h.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err == nil {
+			t.Errorf("expected error for input: %s", input)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package caddyrl
+
+import (
+	"hash/maphash"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// firstSeenHashes is the number of bits that each key sets in a first-
+// seen filter, which minimizes false positives at the filter's size.
+const firstSeenHashes = 7
+
+// firstSeenFilter remembers which keys of a zone were seen within about
+// the window, in Bloom filters of fixed size, so that the first event of
+// a key doesn't need a rate limiter; see RateLimit.FirstSeenFilter. Keys
+// are added to the current filter, which becomes the previous one after
+// a window, so a key is remembered for one to two windows.
+//
+// A key whose first event was allowed without a rate limiter is
+// unsettled until that event is counted by the rate limiter created for
+// the key, or the key is reset; see settle.
+type firstSeenFilter struct {
+	capacity int
+	seed     maphash.Seed
+
+	// the zone's limits; see setLimits
+	maxEvents atomic.Int64
+	window    atomic.Int64 // in nanoseconds
+
+	generation atomic.Pointer[firstSeenGeneration]
+}
+
+type firstSeenGeneration struct {
+	started           time.Time
+	current, previous *bloomFilter
+
+	// the settled keys of the current and previous window
+	settled, settledBefore *bloomFilter
+}
+
+func newFirstSeenFilter(capacity, maxEvents int, window time.Duration) *firstSeenFilter {
+	f := &firstSeenFilter{capacity: capacity, seed: maphash.MakeSeed()}
+	f.setLimits(maxEvents, window)
+	f.reset()
+	return f
+}
+
+// reset forgets all keys.
+func (f *firstSeenFilter) reset() {
+	f.generation.Store(&firstSeenGeneration{
+		started:       now(),
+		current:       newBloomFilter(f.capacity),
+		previous:      newBloomFilter(f.capacity),
+		settled:       newBloomFilter(f.capacity),
+		settledBefore: newBloomFilter(f.capacity),
+	})
+}
+
+// setLimits changes the zone's limits, which are needed without
+// locking the zone.
+func (f *firstSeenFilter) setLimits(maxEvents int, window time.Duration) {
+	f.maxEvents.Store(int64(maxEvents))
+	f.window.Store(int64(window))
+}
+
+// add adds key to the filter. It returns true if the key wasn't seen
+// before, or false if it was, or collides with keys that were.
+func (f *firstSeenFilter) add(key string) bool {
+	hash := maphash.String(f.seed, key)
+	gen := f.rotate(now())
+	if gen.previous.contains(hash) {
+		return false
+	}
+	return gen.current.add(hash)
+}
+
+// contains returns true if key was probably seen.
+func (f *firstSeenFilter) contains(key string) bool {
+	hash := maphash.String(f.seed, key)
+	gen := f.rotate(now())
+	return gen.current.contains(hash) || gen.previous.contains(hash)
+}
+
+// unsettled returns true if key was probably seen and isn't settled.
+func (f *firstSeenFilter) unsettled(key string) bool {
+	hash := maphash.String(f.seed, key)
+	gen := f.rotate(now())
+	seen := gen.current.contains(hash) || gen.previous.contains(hash)
+	return seen && !gen.settled.contains(hash) && !gen.settledBefore.contains(hash)
+}
+
+// settle remembers that the first event of key no longer needs to be
+// counted, because a rate limiter counts it or the key was reset.
+func (f *firstSeenFilter) settle(key string) {
+	f.rotate(now()).settled.add(maphash.String(f.seed, key))
+}
+
+// rotate returns the generation of filters at ref, starting a new one if
+// the current filter is a window old.
+func (f *firstSeenFilter) rotate(ref time.Time) *firstSeenGeneration {
+	for {
+		gen := f.generation.Load()
+		if ref.Sub(gen.started) < time.Duration(f.window.Load()) {
+			return gen
+		}
+		next := &firstSeenGeneration{
+			started:       ref,
+			current:       newBloomFilter(f.capacity),
+			previous:      gen.current,
+			settled:       newBloomFilter(f.capacity),
+			settledBefore: gen.settled,
+		}
+		if f.generation.CompareAndSwap(gen, next) {
+			return next
+		}
+	}
+}
+
+// bloomFilter is a Bloom filter whose bits can be set concurrently.
+type bloomFilter struct {
+	words []atomic.Uint64
+}
+
+// newBloomFilter returns a filter with a false positive rate of about 1%
+// once it has capacity keys.
+func newBloomFilter(capacity int) *bloomFilter {
+	bits := int(math.Ceil(float64(capacity) * -math.Log(0.01) / (math.Ln2 * math.Ln2)))
+	return &bloomFilter{words: make([]atomic.Uint64, max((bits+63)/64, 1))}
+}
+
+// bit returns the word and bit of the ith bit of hash.
+func (b *bloomFilter) bit(hash uint64, i int) (*atomic.Uint64, uint64) {
+	// double hashing derives the bits from one hash
+	h1, h2 := hash, hash>>32|1
+	n := (h1 + uint64(i)*h2) % uint64(len(b.words)*64)
+	return &b.words[n/64], 1 << (n % 64)
+}
+
+// add sets the bits of hash and returns true if any of them wasn't set
+// before, so that only one of concurrent adds of a hash returns true.
+func (b *bloomFilter) add(hash uint64) bool {
+	var added bool
+	for i := range firstSeenHashes {
+		word, mask := b.bit(hash, i)
+		if word.Or(mask)&mask == 0 {
+			added = true
+		}
+	}
+	return added
+}
+
+func (b *bloomFilter) contains(hash uint64) bool {
+	for i := range firstSeenHashes {
+		word, mask := b.bit(hash, i)
+		if word.Load()&mask == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// setFirstSeenFilter makes the zone remember the keys it has seen in a
+// filter sized for capacity keys per window; 0 disables the filter. A
+// filter of the same capacity is kept, with the keys it remembers.
+func (rlm *rateLimitersMap) setFirstSeenFilter(capacity int) {
+	rlm.limitersMu.Lock()
+	defer rlm.limitersMu.Unlock()
+	if capacity == 0 {
+		rlm.firstSeen.Store(nil)
+		return
+	}
+	if f := rlm.firstSeen.Load(); f != nil && f.capacity == capacity {
+		return
+	}
+	maxEvents, window := rlm.limits()
+	rlm.firstSeen.Store(newFirstSeenFilter(capacity, maxEvents, window))
+}
+
+// admitUnseen allows the event of key without a rate limiter if it is
+// eligible, e.g. costs one event, and the key wasn't seen within about
+// the window, counting it towards the zone's total limit, if any. If it
+// returns false, the event must be decided by the key's rate limiter, and
+// unsettled is true if the key's first event was allowed without one,
+// so that a new rate limiter counts that event too; see
+// getOrInsertUnsettled.
+func (rlm *rateLimitersMap) admitUnseen(key string, eligible bool) (admitted, unsettled bool) {
+	f := rlm.firstSeen.Load()
+	if f == nil {
+		return false, false
+	}
+	if f.contains(key) {
+		return false, f.unsettled(key)
+	}
+	if !eligible || f.maxEvents.Load() < 1 {
+		return false, false
+	}
+
+	// the key is only added once its event is allowed, so that events
+	// that the total declines aren't counted later
+	var res reservation
+	if total := rlm.total.Load(); total != nil {
+		var wait time.Duration
+		if res, wait = total.reserveN(1, 0); wait > 0 {
+			return false, false
+		}
+	}
+	if !f.add(key) {
+		// the key collides with keys that were seen, or was added
+		// by a concurrent event
+		res.cancel()
+		return false, f.unsettled(key)
+	}
+	return true, false
+}
@@ -0,0 +1,179 @@
+package caddyrl
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestBloomFilter(t *testing.T) {
+	const capacity = 10000
+	b := newBloomFilter(capacity)
+	for i := range capacity {
+		b.add(uint64(i) * 0x9e3779b97f4a7c15)
+	}
+	for i := range capacity {
+		if !b.contains(uint64(i) * 0x9e3779b97f4a7c15) {
+			t.Fatalf("expected added hash %d to be contained", i)
+		}
+	}
+
+	f := newFirstSeenFilter(capacity, 1, time.Minute)
+	var falsePositives int
+	for i := range capacity {
+		if !f.add(fmt.Sprintf("key-%d", i)) {
+			falsePositives++
+		}
+	}
+	if falsePositives > capacity/50 {
+		t.Errorf("expected about 1%% false positives at capacity, got %d of %d", falsePositives, capacity)
+	}
+	if f.add("key-0") {
+		t.Error("expected a key not to be added twice")
+	}
+}
+
+func TestFirstSeenFilter(t *testing.T) {
+	initTime()
+
+	rl := &RateLimit{
+		ZoneName:        "first_seen_zone",
+		Key:             "{test.client}",
+		Window:          caddy.Duration(time.Minute),
+		MaxEvents:       2,
+		FirstSeenFilter: 1000,
+	}
+	h := newTestHandler(t, rl)
+	serve := func(client string) (*caddy.Replacer, error) {
+		repl := caddy.NewReplacer()
+		repl.Set("test.client", client)
+		req := httptest.NewRequest("GET", "/", nil)
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl))
+		_, err := h.limitRequest(httptest.NewRecorder(), req)
+		return repl, err
+	}
+	rlm := rl.limitersMap
+
+	// a flood of keys with one request each allocates no rate limiters
+	for i := range 100 {
+		if _, err := serve(fmt.Sprintf("random-%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := rlm.len(); n != 0 {
+		t.Errorf("expected no rate limiters for first requests, got %d", n)
+	}
+
+	// a key that comes back gets a rate limiter, which counts its first
+	// request too
+	repl, err := serve("returning")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remaining, _ := repl.GetString(placeholderPrefix(rl.ZoneName) + "remaining"); remaining != "1" {
+		t.Errorf("expected 1 remaining event after the first request, got %s", remaining)
+	}
+	if _, err := serve("returning"); err != nil {
+		t.Fatalf("expected the second request to be allowed, got %v", err)
+	}
+	if _, err := serve("returning"); !isDeclined(err) {
+		t.Errorf("expected the third request to be declined, got %v", err)
+	}
+	if n := rlm.len(); n != 1 {
+		t.Errorf("expected one rate limiter, got %d", n)
+	}
+
+	// a reset key or zone doesn't count first requests from before
+	for _, reset := range []func(){
+		func() { rlm.delete("random-1") },
+		rlm.reset,
+	} {
+		if _, err := serve("random-1"); err != nil {
+			t.Fatal(err)
+		}
+		reset()
+		repl, err := serve("random-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if remaining, _ := repl.GetString(placeholderPrefix(rl.ZoneName) + "remaining"); remaining != "1" {
+			t.Errorf("expected 1 remaining event after a reset, got %s", remaining)
+		}
+		rlm.reset()
+	}
+
+	// keys are forgotten after two windows
+	if _, err := serve("random-0"); err != nil {
+		t.Fatal(err)
+	}
+	advanceTime(61)
+	if admitted, _ := rlm.admitUnseen("random-0", true); admitted {
+		t.Error("expected a key to be remembered for more than a window")
+	}
+	advanceTime(122)
+	if admitted, _ := rlm.admitUnseen("random-0", true); !admitted {
+		t.Error("expected a key to be forgotten after two windows")
+	}
+
+	// zones that decline everything admit nothing
+	rlm.setClamp(0, time.Hour)
+	if admitted, _ := rlm.admitUnseen("new", true); admitted {
+		t.Error("expected a clamp to zero to decline first requests too")
+	}
+	rlm.liftClamp(nil)
+
+	// nor are first requests that the zone's total declines remembered,
+	// which their keys' rate limiters would count
+	rlm.setTotal(1)
+	if admitted, _ := rlm.admitUnseen("total-1", true); !admitted {
+		t.Fatal("expected a first request within the total to be admitted")
+	}
+	if admitted, unsettled := rlm.admitUnseen("total-2", true); admitted || unsettled || rlm.firstSeen.Load().contains("total-2") {
+		t.Error("expected a first request beyond the total not to be remembered")
+	}
+	rlm.setTotal(0)
+
+	// disabling the filter on reload stops admitting keys without limiters
+	rl.FirstSeenFilter = 0
+	rl.provisionState(rl.ZoneName)
+	if admitted, _ := rlm.admitUnseen("another", true); admitted {
+		t.Error("expected the filter to be disabled")
+	}
+}
+
+func TestCaddyfileFirstSeenFilter(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`
+	rate_limit {
+		zone flood {
+			key               {http.request.remote.host}
+			window            1m
+			events            10
+			first_seen_filter 100000
+		}
+	}`)
+
+	var h Handler
+	if err := h.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshaling Caddyfile: %v", err)
+	}
+	if n := h.RateLimits[0].FirstSeenFilter; n != 100000 {
+		t.Errorf("expected a capacity of 100000, got %d", n)
+	}
+
+	var bad Handler
+	if err := bad.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`rate_limit {
+		zone flood {
+			key static
+			window 1m
+			events 10
+			first_seen_filter many
+		}
+	}`)); err == nil {
+		t.Error("expected an error for an invalid capacity")
+	}
+}
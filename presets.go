@@ -0,0 +1,77 @@
+package caddyrl
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// presets are the built-in settings that zones can be based on by setting
+// their `preset`, for common kinds of endpoints. Every call returns new
+// settings, so that zones don't share the state of their components.
+var presets = map[string]func() *RateLimit{
+	// general APIs: a generous per-client rate, with tight retry loops
+	// banned and zone-wide limits answered as overload
+	"api": func() *RateLimit {
+		return &RateLimit{
+			Key:            "{http.vars.client_ip}",
+			MaxEvents:      600,
+			Window:         caddy.Duration(time.Minute),
+			OverloadStatus: 503,
+			RetryStorm:     &RetryStormDetection{},
+		}
+	},
+
+	// login endpoints: failed attempts per username and client, with
+	// lockouts that grow longer; see BruteForceProtection
+	"login": func() *RateLimit {
+		return &RateLimit{
+			BruteForce: &BruteForceProtection{},
+		}
+	},
+
+	// pages that crawlers fetch: a modest per-client rate, which new
+	// clients only get after a while
+	"crawl": func() *RateLimit {
+		return &RateLimit{
+			Key:        "{http.vars.client_ip}",
+			MaxEvents:  60,
+			Window:     caddy.Duration(time.Minute),
+			Greylist:   &Greylist{MaxEvents: 10},
+			RetryStorm: &RetryStormDetection{},
+		}
+	},
+
+	// large downloads: few requests and a cap on the bytes sent to each
+	// client per hour
+	"download": func() *RateLimit {
+		return &RateLimit{
+			Key:              "{http.vars.client_ip}",
+			MaxEvents:        100,
+			Window:           caddy.Duration(time.Hour),
+			MaxResponseBytes: 5 << 30,
+		}
+	},
+}
+
+// applyPreset sets the fields of rl that are not set to those of its
+// preset, if it has one.
+func (rl *RateLimit) applyPreset() error {
+	if rl.Preset == "" {
+		return nil
+	}
+	preset, ok := presets[rl.Preset]
+	if !ok {
+		names := make([]string, 0, len(presets))
+		for name := range presets {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		return fmt.Errorf("unknown preset '%s' (known presets: %s)", rl.Preset, strings.Join(names, ", "))
+	}
+	rl.inherit(preset())
+	return nil
+}
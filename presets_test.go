@@ -0,0 +1,46 @@
+package caddyrl
+
+import (
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestPresets(t *testing.T) {
+	// every preset is a valid zone on its own
+	for name := range presets {
+		rl := &RateLimit{Preset: name}
+		if err := rl.applyPreset(); err != nil {
+			t.Fatalf("applying preset %s: %v", name, err)
+		}
+		zoneName := "preset_zone_" + name
+		if err := rl.provision(caddy.Context{}, zoneName); err != nil {
+			t.Fatalf("provisioning zone with preset %s: %v", name, err)
+		}
+		_, _ = rateLimits.Delete(zoneName)
+	}
+
+	// settings of the zone and its policy take precedence
+	rl := &RateLimit{Preset: "api", MaxEvents: 1200}
+	rl.inherit(&RateLimit{Window: caddy.Duration(time.Second)})
+	if err := rl.applyPreset(); err != nil {
+		t.Fatal(err)
+	}
+	if rl.MaxEvents != 1200 || rl.Window != caddy.Duration(time.Second) || rl.Key != "{http.vars.client_ip}" || rl.RetryStorm == nil {
+		t.Fatalf("unexpected settings after preset: %d events per %s, key %q", rl.MaxEvents, time.Duration(rl.Window), rl.Key)
+	}
+
+	// zones don't share the components of presets
+	other := &RateLimit{Preset: "api"}
+	if err := other.applyPreset(); err != nil {
+		t.Fatal(err)
+	}
+	if other.RetryStorm == rl.RetryStorm {
+		t.Fatal("expected zones with the same preset to have their own retry storm detection")
+	}
+
+	if err := (&RateLimit{Preset: "unknown"}).applyPreset(); err == nil {
+		t.Error("expected an error for an unknown preset")
+	}
+}
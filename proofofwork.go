@@ -0,0 +1,120 @@
+package caddyrl
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"html/template"
+	"math/bits"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// challengeProofOfWork is the provider of challenges that clients pass
+// by solving a hash puzzle.
+const challengeProofOfWork = "proof_of_work"
+
+// powPuzzleTTL is how long clients have to solve a puzzle.
+const powPuzzleTTL = 5 * time.Minute
+
+// puzzle returns a new puzzle for the client of r: its expiry, some
+// random bytes and their signature. A solution is a nonce such that the
+// SHA-256 hash of `<puzzle>:<nonce>` has the configured number of
+// leading zero bits.
+func (c *Challenge) puzzle(r *http.Request) string {
+	random := make([]byte, 16)
+	_, _ = rand.Read(random)
+	puzzle := strconv.FormatInt(now().Add(powPuzzleTTL).Unix(), 10) + "." + base64.RawURLEncoding.EncodeToString(random)
+	return puzzle + "." + base64.RawURLEncoding.EncodeToString(c.sign("puzzle", puzzle, remoteIPOf(r)))
+}
+
+// verifyWork returns true if nonce solves puzzle, a puzzle that was
+// given to the client of r and has not expired.
+func (c *Challenge) verifyWork(r *http.Request, puzzle, nonce string) bool {
+	if _, err := strconv.ParseUint(nonce, 10, 64); err != nil {
+		return false
+	}
+	unsigned, signature, ok := cutLast(puzzle, ".")
+	if !ok {
+		return false
+	}
+	want, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(want, c.sign("puzzle", unsigned, remoteIPOf(r))) {
+		return false
+	}
+	expires, _, _ := strings.Cut(unsigned, ".")
+	if unix, err := strconv.ParseInt(expires, 10, 64); err != nil || now().Unix() >= unix {
+		return false
+	}
+	hash := sha256.Sum256([]byte(puzzle + ":" + nonce))
+	return leadingZeroBits(hash[:]) >= c.Difficulty
+}
+
+// cutLast slices s around the last instance of sep.
+func cutLast(s, sep string) (before, after string, found bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
+// leadingZeroBits returns the number of leading zero bits of b.
+func leadingZeroBits(b []byte) int {
+	var n int
+	for _, x := range b {
+		if x != 0 {
+			return n + bits.LeadingZeros8(x)
+		}
+		n += 8
+	}
+	return n
+}
+
+// proofOfWorkPage is the page that makes declined clients solve a
+// puzzle. Web Crypto is only available in secure contexts, so sites must
+// be served over HTTPS (or from localhost).
+var proofOfWorkPage = template.Must(template.New("proof_of_work").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Just a moment</title>
+</head>
+<body>
+<h1>Just a moment</h1>
+<p>You have sent a lot of requests. Your browser is checking that you are human; this page continues on its own.</p>
+<noscript><p>Please enable JavaScript to continue.</p></noscript>
+<form id="challenge" method="POST" action="{{.Path}}">
+<input type="hidden" name="redirect" value="{{.Redirect}}">
+<input type="hidden" name="puzzle" value="{{.Puzzle}}">
+<input type="hidden" name="nonce">
+</form>
+<script>
+(async () => {
+	const puzzle = {{.Puzzle}}, difficulty = {{.Difficulty}};
+	const encoder = new TextEncoder();
+	const zeroBits = (hash) => {
+		let n = 0;
+		for (const b of hash) {
+			if (b !== 0) return n + Math.clz32(b) - 24;
+			n += 8;
+		}
+		return n;
+	};
+	for (let nonce = 0; ; nonce++) {
+		const hash = new Uint8Array(await crypto.subtle.digest("SHA-256", encoder.encode(puzzle + ":" + nonce)));
+		if (zeroBits(hash) >= difficulty) {
+			const form = document.getElementById("challenge");
+			form.elements.nonce.value = nonce;
+			form.submit();
+			return;
+		}
+	}
+})();
+</script>
+</body>
+</html>
+`))
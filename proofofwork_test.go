@@ -0,0 +1,82 @@
+package caddyrl
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestProofOfWork(t *testing.T) {
+	initTime()
+
+	c := &Challenge{Provider: challengeProofOfWork, Difficulty: 8}
+	if err := c.provision(zap.NewNop()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/page", nil)
+	puzzle := c.puzzle(r)
+	var nonce string
+	for i := 0; ; i++ {
+		hash := sha256.Sum256([]byte(puzzle + ":" + strconv.Itoa(i)))
+		if leadingZeroBits(hash[:]) >= c.Difficulty {
+			nonce = strconv.Itoa(i)
+			break
+		}
+	}
+
+	if !c.verifyWork(r, puzzle, nonce) {
+		t.Error("expected the solution to be valid")
+	}
+	if c.verifyWork(r, puzzle, nonce+"0") && c.verifyWork(r, puzzle, nonce+"1") {
+		t.Error("expected wrong nonces to be invalid")
+	}
+	other := httptest.NewRequest(http.MethodGet, "/page", nil)
+	other.RemoteAddr = "192.0.2.2:1234"
+	if c.verifyWork(other, puzzle, nonce) {
+		t.Error("expected the puzzle to be bound to the client's IP address")
+	}
+	if c.verifyWork(r, "1."+puzzle, nonce) {
+		t.Error("expected a tampered puzzle to be invalid")
+	}
+
+	// solutions are submitted like those of CAPTCHAs
+	form := url.Values{"puzzle": {puzzle}, "nonce": {nonce}, "redirect": {"/page"}}
+	submit := httptest.NewRequest(http.MethodPost, c.Path, strings.NewReader(form.Encode()))
+	submit.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	if err := c.serveVerify(w, submit); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if w.Code != http.StatusSeeOther || len(w.Result().Cookies()) != 1 {
+		t.Errorf("expected a pass and a redirect, got %d", w.Code)
+	}
+
+	advanceTime(int(powPuzzleTTL.Seconds()))
+	if c.verifyWork(r, puzzle, nonce) {
+		t.Error("expected the puzzle to expire")
+	}
+
+	r.Header.Set("Accept", "text/html")
+	w = httptest.NewRecorder()
+	if err := c.writePage(w, r); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(w.Body.String(), `name="puzzle" value="`) || !regexp.MustCompile(`difficulty = +8 *;`).MatchString(w.Body.String()) {
+		t.Errorf("unexpected challenge page:\n%s", w.Body.String())
+	}
+
+	if leadingZeroBits([]byte{0, 0x1f}) != 11 {
+		t.Error("unexpected number of leading zero bits")
+	}
+	if err := (&Challenge{Provider: challengeProofOfWork, Difficulty: 33}).provision(zap.NewNop()); err == nil {
+		t.Error("expected an error for a difficulty beyond 32")
+	}
+}
@@ -0,0 +1,216 @@
+package caddyrl
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// byteQuotaSlots is the number of slots that the window of a byte quota
+// is divided into. The window slides by one slot at a time, so bytes
+// leave it up to a 60th of the window late.
+const byteQuotaSlots = 60
+
+// byteQuota limits the number of bytes of each key within a sliding
+// window, e.g. the bytes of responses sent to each API token per day.
+// Unlike events, bytes are counted after the fact: a request is only
+// declined once its key has used up the quota, so the last request
+// within the quota can exceed it.
+type byteQuota struct {
+	mu       sync.Mutex
+	max      int64
+	window   time.Duration
+	counters map[string]*byteCounter
+}
+
+// byteCounter counts the bytes of a key in the slots of the window.
+type byteCounter [byteQuotaSlots]struct {
+	slot  int64 // number of the slot since the Unix epoch
+	bytes int64
+}
+
+func newByteQuota(max int64, window time.Duration) *byteQuota {
+	return &byteQuota{
+		max:      max,
+		window:   window,
+		counters: make(map[string]*byteCounter),
+	}
+}
+
+// set changes the quota's limits. Bytes counted in a window of another
+// duration can't be carried over, so changing the window resets them.
+func (q *byteQuota) set(max int64, window time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.max = max
+	if window != q.window {
+		q.window = window
+		clear(q.counters)
+	}
+}
+
+// slotOf returns the number of the slot that ref falls into.
+func (q *byteQuota) slotOf(ref time.Time) int64 {
+	return unixNano(ref) / max(int64(q.window)/byteQuotaSlots, 1)
+}
+
+// add counts n bytes of key at ref.
+func (q *byteQuota) add(key string, n int64, ref time.Time) {
+	if n <= 0 {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	counter, ok := q.counters[key]
+	if !ok {
+		counter = new(byteCounter)
+		q.counters[key] = counter
+	}
+	slot := q.slotOf(ref)
+	s := &counter[slot%byteQuotaSlots]
+	if s.slot != slot {
+		s.slot, s.bytes = slot, 0
+	}
+	s.bytes += n
+}
+
+// used returns the number of bytes of key within the window at ref.
+func (q *byteQuota) used(key string, ref time.Time) int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.usedLocked(q.counters[key], q.slotOf(ref))
+}
+
+func (q *byteQuota) usedLocked(counter *byteCounter, current int64) int64 {
+	if counter == nil {
+		return 0
+	}
+	var used int64
+	for _, s := range counter {
+		if s.slot > current-byteQuotaSlots {
+			used += s.bytes
+		}
+	}
+	return used
+}
+
+// wait returns how long key has to wait at ref until it is within the
+// quota again, or 0 if it is within the quota.
+func (q *byteQuota) wait(key string, ref time.Time) time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	counter := q.counters[key]
+	current := q.slotOf(ref)
+	used := q.usedLocked(counter, current)
+	if used < q.max {
+		return 0
+	}
+
+	// the bytes of the oldest slots leave the window first
+	slotDuration := max(int64(q.window)/byteQuotaSlots, 1)
+	for slot := current - byteQuotaSlots + 1; slot <= current; slot++ {
+		if s := counter[slot%byteQuotaSlots]; s.slot == slot {
+			used -= s.bytes
+		}
+		if used < q.max {
+			return time.Duration((slot+byteQuotaSlots)*slotDuration - unixNano(ref))
+		}
+	}
+	return q.window
+}
+
+// sweep forgets the keys that have no bytes within the window at ref.
+func (q *byteQuota) sweep(ref time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	current := q.slotOf(ref)
+	for key, counter := range q.counters {
+		if q.usedLocked(counter, current) == 0 {
+			delete(q.counters, key)
+		}
+	}
+}
+
+// len returns the number of keys whose bytes are counted.
+func (q *byteQuota) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.counters)
+}
+
+// quotaUse is a key whose bytes count against a byte quota.
+type quotaUse struct {
+	quota *byteQuota
+	key   string
+}
+
+// quotaUses are the byte quotas that the bodies of a request and its
+// response count against, the keys whose events it counts against, if
+// the handler needs them, and the keys of zones whose later handlers
+// may declare its cost or refund events, and of zones that count the
+// failed authentication responses of later handlers.
+type quotaUses struct {
+	request, response []quotaUse
+	keys              []limitedKey
+	costs             []upstreamCost
+	attempts          []limitedKey
+
+	// the flights that r leads if allowed, or the one that it may
+	// coalesce onto, and its zone, if declined; see RateLimit.Coalesce
+	flights            []string
+	flight, flightZone string
+}
+
+// countBytes counts n bytes against each of uses.
+func countBytes(uses []quotaUse, n int64) {
+	if n <= 0 {
+		return
+	}
+	ref := now()
+	for _, use := range uses {
+		use.quota.add(use.key, n, ref)
+	}
+}
+
+// responseBytesWriter counts the bytes of the response body that it
+// writes against byte quotas. Headers are not counted.
+type responseBytesWriter struct {
+	*caddyhttp.ResponseWriterWrapper
+	uses []quotaUse
+}
+
+func (w *responseBytesWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriterWrapper.Write(p)
+	countBytes(w.uses, int64(n))
+	return n, err
+}
+
+// ReadFrom counts the bytes that e.g. file servers copy to the response,
+// which bypass Write.
+func (w *responseBytesWriter) ReadFrom(r io.Reader) (int64, error) {
+	n, err := w.ResponseWriterWrapper.ReadFrom(r)
+	countBytes(w.uses, n)
+	return n, err
+}
+
+// requestBytesReader counts the bytes of the request body that are read
+// from it against byte quotas.
+type requestBytesReader struct {
+	io.ReadCloser
+	uses []quotaUse
+}
+
+func (r *requestBytesReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	countBytes(r.uses, int64(n))
+	return n, err
+}
+
+// Interface guards
+var (
+	_ http.ResponseWriter = (*responseBytesWriter)(nil)
+	_ io.ReaderFrom       = (*responseBytesWriter)(nil)
+)
@@ -0,0 +1,84 @@
+package caddyrl
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestByteQuota(t *testing.T) {
+	initTime()
+
+	q := newByteQuota(100, time.Minute)
+	q.add("a", 60, now())
+	if wait := q.wait("a", now()); wait != 0 {
+		t.Fatalf("key a is within its quota, expected no wait, got %s", wait)
+	}
+
+	// the last response within the quota can exceed it
+	advanceTime(10)
+	q.add("a", 50, now())
+	if used := q.used("a", now()); used != 110 {
+		t.Fatalf("expected 110 bytes of key a, got %d", used)
+	}
+	if wait := q.wait("a", now()); wait != 50*time.Second {
+		t.Fatalf("expected key a to wait until its first bytes leave the window, got %s", wait)
+	}
+	if wait := q.wait("b", now()); wait != 0 {
+		t.Fatalf("key b has no bytes, expected no wait, got %s", wait)
+	}
+
+	advanceTime(61)
+	if wait := q.wait("a", now()); wait != 0 {
+		t.Fatalf("expected no wait once the first bytes left the window, got %s", wait)
+	}
+	if used := q.used("a", now()); used != 50 {
+		t.Fatalf("expected 50 bytes of key a, got %d", used)
+	}
+
+	advanceTime(71)
+	q.sweep(now())
+	if n := q.len(); n != 0 {
+		t.Fatalf("expected keys without bytes in the window to be swept, got %d keys", n)
+	}
+}
+
+func TestResponseBytesWriter(t *testing.T) {
+	initTime()
+
+	q := newByteQuota(100, time.Minute)
+	w := &responseBytesWriter{
+		ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: httptest.NewRecorder()},
+		uses:                  []quotaUse{{quota: q, key: "a"}},
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	if _, err := w.Write([]byte("hello, ")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.ReadFrom(strings.NewReader("world")); err != nil {
+		t.Fatal(err)
+	}
+	if used := q.used("a", now()); used != 12 {
+		t.Fatalf("expected the 12 bytes of the body to be counted, got %d", used)
+	}
+}
+
+func TestRequestBytesReader(t *testing.T) {
+	initTime()
+
+	q := newByteQuota(100, time.Minute)
+	r := &requestBytesReader{
+		ReadCloser: io.NopCloser(strings.NewReader("uploaded body")),
+		uses:       []quotaUse{{quota: q, key: "a"}},
+	}
+	if _, err := io.ReadAll(r); err != nil {
+		t.Fatal(err)
+	}
+	if used := q.used("a", now()); used != 13 {
+		t.Fatalf("expected the 13 bytes of the body to be counted, got %d", used)
+	}
+}
@@ -15,9 +15,21 @@
 package caddyrl
 
 import (
+	"container/list"
+	"context"
+	"encoding/json"
 	"fmt"
+	"hash/maphash"
+	"maps"
+	"runtime"
+	"runtime/pprof"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unsafe"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
@@ -25,143 +37,2272 @@ import (
 
 // RateLimit describes an HTTP rate limit zone.
 type RateLimit struct {
-	// The name of the zone. This name is **required**.
+	// The name of the zone. This name is **required**. It can contain
+	// placeholders, e.g. `{http.request.host}`, in which case a separate
+	// zone is created for each of their values, named after them.
 	ZoneName string `json:"zone_name,omitempty"`
 
+	// Names that the zone had before, whose state it takes over if it
+	// has none yet, so that renaming a zone in a reload doesn't reset
+	// the events of its keys. The old names must no longer be used by
+	// other zones. Requires a zone name without placeholders.
+	RenamedFrom []string `json:"renamed_from,omitempty"`
+
+	// Maximum number of zones that a zone with placeholders in its name
+	// creates, e.g. one per value of an `X-API-Key` header, so that
+	// clients that make up values can't create zones without bound.
+	// Requests with further values are limited together in one more
+	// zone, whose name has `__other__` in place of the placeholders.
+	// Default: 0 (no limit)
+	MaxZones int `json:"max_zones,omitempty"`
+
+	// The name of a policy of the rate_limit app that this zone is
+	// based on. Fields that the zone doesn't set are taken from the
+	// policy, so that many sites can share the same limits.
+	Policy string `json:"policy,omitempty"`
+
+	// The name of a built-in preset of settings that this zone is based
+	// on: `api`, `login`, `crawl` or `download`. Fields that neither the
+	// zone nor its policy set are taken from the preset.
+	Preset string `json:"preset,omitempty"`
+
 	// Request matchers, which defines the class of requests that are in the RL zone.
 	MatcherSetsRaw caddyhttp.RawMatcherSets `json:"match,omitempty" caddy:"namespace=http.matchers"`
 
-	// The key which uniquely differentiates rate limits within this zone. It could
-	// be a static string (no placeholders), resulting in one and only one rate limiter
-	// for the whole zone. Or, placeholders could be used to dynamically allocate
-	// rate limiters. For example, a key of "foo" will create exactly one rate limiter
-	// for all clients. But a key of "{http.request.remote.host}" will create one rate
-	// limiter for each different client IP address.
-	Key string `json:"key,omitempty"`
+	// The key which uniquely differentiates rate limits within this zone. It could
+	// be a static string (no placeholders), resulting in one and only one rate limiter
+	// for the whole zone. Or, placeholders could be used to dynamically allocate
+	// rate limiters. For example, a key of "foo" will create exactly one rate limiter
+	// for all clients. But a key of "{http.request.remote.host}" will create one rate
+	// limiter for each different client IP address.
+	Key string `json:"key,omitempty"`
+
+	// Number of events allowed within the window. In JSON, it can also be
+	// a string of `{env.*}` placeholders, resolved when the config is loaded.
+	MaxEvents int `json:"max_events,omitempty"`
+
+	// Duration of the sliding window. It can contain `{env.*}`
+	// placeholders, resolved when the config is loaded.
+	Window caddy.Duration `json:"window,omitempty"`
+
+	// The algorithm that decides whether events are allowed, by module
+	// name in the `rate_limit.algorithms` namespace, so that algorithms
+	// other than the sliding window can be compiled in. Zones with
+	// another algorithm cannot have total_max_events or max_keys, nor
+	// be limited by handlers with distributed rate limiting.
+	// Default: `sliding_window`
+	AlgorithmRaw json.RawMessage `json:"algorithm,omitempty" caddy:"namespace=rate_limit.algorithms inline_key=name"`
+
+	// Maximum number of events of all keys together within the window,
+	// evaluated together with max_events: an event is only allowed if
+	// neither its key nor the zone as a whole has reached its limit. This
+	// caps the load that e.g. many distinct client IPs can put on the
+	// origin. With distributed rate limiting, the total is per instance.
+	// Default: 0 (no total limit)
+	TotalMaxEvents int `json:"total_max_events,omitempty"`
+
+	// HTTP status of responses to requests that are declined because of
+	// the zone as a whole rather than their key's own limit, e.g. 503, so
+	// that CDNs, clients' retries and monitoring can tell an overloaded
+	// service from a misbehaving client. That is, when total_max_events
+	// is reached while the key's max_events isn't, or while the zone's
+	// limits are scaled down by a clamp, load shedding or a circuit
+	// breaker. Such responses also have a Retry-After header.
+	// Default: 429
+	OverloadStatus int `json:"overload_status,omitempty"`
+
+	// How long a key must be quiet after one of its requests was
+	// declined before its requests are allowed again. Requests during
+	// the cooldown are declined and restart it, so that clients that
+	// poll right at the limit, retrying as soon as an event leaves the
+	// window, can't keep the zone saturated. Declines because of the
+	// zone as a whole (see overload_status) don't start a cooldown.
+	// Default: 0 (no cooldown)
+	Cooldown caddy.Duration `json:"cooldown,omitempty"`
+
+	// How the zone's decisions account for other instances under
+	// distributed rate limiting, trading accuracy for latency:
+	//
+	// - `strict`: each decision reads other instances' states from
+	// storage first, and an allowed event is stored before the request
+	// continues, so requests wait on storage. Concurrent decisions share
+	// reads and writes.
+	// - `eventual`: decisions use the last known states of other
+	// instances, which are synced every read_interval and write_interval.
+	// - `local`: decisions only count this instance's events, as if it
+	// were alone; its events still count towards other instances' limits.
+	//
+	// Default: eventual
+	Consistency string `json:"consistency,omitempty"`
+
+	// What the zone decides while distributed state can't be read from
+	// or written to storage, e.g. because the storage is unreachable:
+	//
+	// - `open`: decisions use the last known states of other
+	// instances, so requests are only declined if the instance's own
+	// events or those states exceed the limit.
+	// - `closed`: requests are declined until state is read again.
+	//
+	// Zones with `local` consistency don't depend on storage.
+	// Default: open
+	StoreFailure string `json:"store_failure,omitempty"`
+
+	// The number of events that requests count as, by HTTP method, so
+	// that e.g. writes use up a key's events faster than reads. Methods
+	// that aren't listed count as 1 event. A request that costs more
+	// than max_events is never allowed. For example, with GET=1,
+	// POST=5 and max_events 100, a key can make 100 GET or 20 POST
+	// requests per window. The cost of a method multiplies the cost of
+	// the request's path. Default: every request counts as 1 event
+	MethodCosts map[string]int `json:"method_costs,omitempty"`
+
+	// Maximum number of events within the window of each key's requests
+	// of the given HTTP methods, in addition to max_events, so that
+	// e.g. a key can make 100 requests per minute but only 10 of them
+	// POST. Each method's events are counted by this instance with the
+	// sliding window, apart from the zone's events, and with the same
+	// key, window and costs. Default: no limits by method
+	MethodEvents map[string]int `json:"method_events,omitempty"`
+
+	// The number of events that requests count as, by path, so that
+	// expensive endpoints can be weighted within one zone. The first
+	// entry whose path pattern matches the request applies; requests
+	// that match none count as 1 event. Patterns are those of the
+	// `path` matcher, e.g. `/search*` or `/static/*`. Requests whose
+	// cost is 0 are not counted.
+	PathCosts []PathCost `json:"path_costs,omitempty"`
+
+	// The name of a response header, e.g. `X-RateLimit-Cost`, in which
+	// later handlers such as reverse_proxy upstreams declare the number
+	// of events that a request actually cost, for requests whose cost
+	// is only known once they were handled. What the declared cost
+	// exceeds the request's cost by is debited from its key, even
+	// beyond the limit, so that the key's next requests wait; lower
+	// costs are not refunded. The header is removed from responses.
+	// Zones with an algorithm other than sliding_window can't have a
+	// cost header.
+	CostHeader string `json:"cost_header,omitempty"`
+
+	// The name of a response header, e.g. `X-RateLimit-Refund`, in
+	// which later handlers such as reverse_proxy upstreams credit a
+	// number of events back to the request's key, e.g. because an
+	// operation that was charged for was rolled back. Refunds remove
+	// the key's oldest events in the window. The header is removed from
+	// responses, so clients can't see it; only later handlers can set
+	// it, so it is as trusted as they are. Zones with an algorithm
+	// other than sliding_window can't have a refund header.
+	RefundHeader string `json:"refund_header,omitempty"`
+
+	// How long retries of a request with the same `Idempotency-Key`
+	// header count as the same event, so that clients that safely retry
+	// e.g. after a timeout don't use up their events twice. Only the
+	// first allowed request with an idempotency key within this long is
+	// counted against the zone's key; its retries are not counted, nor
+	// limited. Idempotency keys longer than 255 bytes are ignored.
+	// Default: 0 (retries are counted like other requests)
+	IdempotencyWindow caddy.Duration `json:"idempotency_window,omitempty"`
+
+	// What each key's events are counted once per, rather than once per
+	// request: `connection`, so that the requests of a client
+	// connection after its first allowed one are neither counted nor
+	// limited, e.g. to limit how often clients connect apart from how
+	// often they make requests; or a placeholder whose value identifies
+	// a session, e.g. `{http.request.cookie.session}`. Requests without
+	// a session, or with one longer than 255 bytes, are counted as
+	// usual. A connection or session is forgotten once it had no
+	// requests for the window. Default: none (each request is counted)
+	CountOncePer string `json:"count_once_per,omitempty"`
+
+	// Maximum number of bytes of response bodies sent to each key within
+	// the window, e.g. to cap the egress of each API token per day. Once
+	// a key has used up its bytes, its requests are declined until enough
+	// of them have left the window; a response in progress is not cut
+	// off, so the last one can exceed the quota. If max_events is 0, the
+	// zone only limits bytes. Default: 0 (no byte quota)
+	MaxResponseBytes int64 `json:"max_response_bytes,omitempty"`
+
+	// Maximum number of bytes of request bodies uploaded by each key
+	// within the window, so that bulk uploads are limited by volume and
+	// not just by count. Bytes are counted as the request body is read,
+	// and are otherwise treated like max_response_bytes.
+	// Default: 0 (no byte quota)
+	MaxRequestBytes int64 `json:"max_request_bytes,omitempty"`
+
+	// Schedules that give the zone another max_events on certain days
+	// and times, e.g. stricter limits overnight. The first schedule that
+	// is active applies; if none is, the zone's own max_events does.
+	// Schedules take effect within seconds of their start and end, and
+	// then override limits changed through the admin API.
+	Schedules []*LimitSchedule `json:"schedules,omitempty"`
+
+	// The IANA time zone of the days and times of the zone's schedules,
+	// e.g. `Europe/Berlin`. Default: the system's local time zone
+	Timezone string `json:"timezone,omitempty"`
+
+	// Utilization threshold, as a fraction of max_events, at or above
+	// which an allowed request emits the `rate_limit.near_limit` event
+	// and is counted by the near_limit_requests_total metric.
+	// For example, 0.8 emits the event once a key has used 80% of its
+	// events in the window. Default: 0 (disabled).
+	NearLimit float64 `json:"near_limit,omitempty"`
+
+	// The name of a request header, e.g. `X-RateLimit-Pressure`, that
+	// allowed requests whose key is at or above pressure_threshold get
+	// for later handlers such as reverse_proxy upstreams. Its value is
+	// the key's utilization as a fraction of max_events, e.g. `0.92`,
+	// so upstreams can degrade gracefully (smaller pages, cached
+	// answers) before clients are declined. The header is removed from
+	// all other requests, so clients can't set it; if several zones set
+	// the same header, it has the highest utilization of their keys.
+	PressureHeader string `json:"pressure_header,omitempty"`
+
+	// Utilization threshold, as a fraction of max_events, at or above
+	// which allowed requests get the pressure_header.
+	// Default: near_limit if it is set, otherwise 0.8
+	PressureThreshold float64 `json:"pressure_threshold,omitempty"`
+
+	// Maximum number of keys whose state is kept in memory. When a new
+	// key would exceed it, the state of a least recently used key is
+	// evicted, which resets that key's quota. This keeps floods of
+	// distinct keys (e.g. spoofed IP addresses) from exhausting memory.
+	// Eviction order is approximate, since keys are partitioned to
+	// reduce lock contention. Default: 0 (no limit)
+	MaxKeys int `json:"max_keys,omitempty"`
+
+	// Number of distinct keys per window for which to size a filter of
+	// the keys the zone has seen, so that the first event of a key is
+	// allowed without creating its rate limiter, which is only created
+	// once the key has another event and then counts the first one too.
+	// This saves most of the memory and allocations of floods of random
+	// keys, which each only make one request. The filter takes about
+	// 4.8 bytes per key, and remembers keys for one to two windows; a
+	// key that returns after more than a window may count one more event
+	// than it had, and beyond the capacity, keys increasingly get rate
+	// limiters right away. Zones with an algorithm other than
+	// sliding_window, a greylist or a key slow start, and zones under
+	// distributed rate limiting, unless their consistency is `local`,
+	// don't use the filter.
+	// Default: 0 (no filter)
+	FirstSeenFilter int `json:"first_seen_filter,omitempty"`
+
+	// If true, the number of keys evicted because of max_keys is
+	// logged every sweep interval.
+	LogEvictions bool `json:"log_evictions,omitempty"`
+
+	// If true, keys are namespaced by the request's host, so that each
+	// host of e.g. a multi-tenant wildcard site gets its own rate limiters
+	// for the same key. The zone's keys then have the form `<host>/<key>`,
+	// also in per-key metrics and the admin API.
+	IsolateByHost bool `json:"isolate_by_host,omitempty"`
+
+	// If true, a request counts in the zone every time it passes through
+	// a handler with the zone, e.g. again through error routes or a
+	// second handler. By default, each request counts at most once in
+	// each zone.
+	CountRepeats bool `json:"count_repeats,omitempty"`
+
+	// If true, a GET request that the zone declines at its key's limit
+	// waits for a request of the same key and URL that the zone allowed
+	// and that is still in flight, if any, and gets a copy of its
+	// response instead of being declined, which smooths thundering herds
+	// on hot resources. Requests only coalesce if they have the same
+	// host, URI and Accept-Encoding, so the upstream's responses must not
+	// depend on other parts of the requests of a key; Set-Cookie headers
+	// aren't copied. Requests with Authorization or Cookie headers don't
+	// coalesce. Responses with bodies over 1 MiB, whose handlers fail, or
+	// with `Cache-Control: private` or `no-store` aren't copied either, so
+	// their followers are declined after all. Default: false
+	Coalesce bool `json:"coalesce,omitempty"`
+
+	// A placeholder whose values select the tier of a request, e.g. the
+	// roles of an authenticated user as `{http.auth.user.roles}`. Values
+	// are separated by spaces or commas, and the first of the tiers that
+	// is among them applies. Each tier is limited like a zone of its own,
+	// named `<zone>.<tier>`, with the zone's settings but the tier's
+	// limit and key, e.g. to allow users 100 requests per minute by
+	// their ID, and admins any number. Requests without a value, or whose
+	// values aren't tiers, such as anonymous ones, get the zone's own
+	// limit and key. Requires a zone name without placeholders and the
+	// sliding window algorithm.
+	TierBy string `json:"tier_by,omitempty"`
+
+	// The tiers that tier_by selects, in order of precedence.
+	Tiers []*ZoneTier `json:"tiers,omitempty"`
+
+	// Gives authenticated requests, i.e. those with a user, a limit and
+	// key of their own, while anonymous requests get the zone's, e.g. a
+	// stricter limit by client IP, without a zone and matchers of their
+	// own. Tiers take precedence. Requires a zone name without
+	// placeholders and the sliding window algorithm.
+	Authenticated *AuthenticatedLimit `json:"authenticated,omitempty"`
+
+	// How long the state of a key that has no events is kept, from its
+	// last event, before it is dropped. By default, a key's state is
+	// dropped once all of its events have left the window. A shorter
+	// TTL drops the state of idle keys sooner, which saves memory but
+	// forgets the events that were still in the window, so the key gets
+	// its full quota back early; a longer TTL keeps keys that come back
+	// after a pause in memory, listed by the admin API, per-key metrics
+	// and the distributed state. Bans and upstream backoffs last for
+	// their own durations either way. States are dropped by the sweep,
+	// so at most sweep_interval late. Zones with an algorithm other than
+	// sliding_window can't have an idle TTL.
+	// Default: 0 (until the key's events have left the window)
+	IdleTTL caddy.Duration `json:"idle_ttl,omitempty"`
+
+	// How often to scan this zone for keys whose events have all left
+	// the window, so that their state can be removed. Default: the
+	// handler's sweep interval.
+	SweepInterval caddy.Duration `json:"sweep_interval,omitempty"`
+
+	// Number of past windows for which to keep how many events of each
+	// key were allowed and declined, besides the current window, so that
+	// the admin API can report a key's recent usage, e.g. to answer why
+	// a customer hit their limit. Windows are aligned to multiples of
+	// their duration since the Unix epoch. Usage is kept in memory for
+	// keys with events in these windows, and forgotten when the window
+	// or the number of windows change. Default: 0 (no usage is kept)
+	UsageHistory int `json:"usage_history,omitempty"`
+
+	// Overrides the rate_limit app's metrics `include_key` setting for
+	// this zone, so that high-cardinality zones (e.g. keyed by IP) can
+	// report aggregates only while low-cardinality zones (e.g. keyed by
+	// tenant) report per-key detail. Default: the app's setting.
+	MetricsIncludeKey *bool `json:"metrics_include_key,omitempty"`
+
+	// Reduces the zone's limits while reverse_proxy upstreams are
+	// unhealthy, and ramps them back up once they have recovered.
+	CircuitBreaker *CircuitBreaker `json:"circuit_breaker,omitempty"`
+
+	// Learns the zone's usual per-key request rates, and flags or bans
+	// keys that deviate sharply from them.
+	Anomaly *AnomalyDetection `json:"anomaly,omitempty"`
+
+	// Bans keys that repeat the same request in a tight retry loop.
+	RetryStorm *RetryStormDetection `json:"retry_storm,omitempty"`
+
+	// Limits how many distinct values, e.g. of paths or usernames, each
+	// key may use within the window. If max_events is 0, the zone only
+	// limits distinct values.
+	Distinct *DistinctLimit `json:"distinct,omitempty"`
+
+	// Throttles requests that a WAF found suspicious harder than clean
+	// ones, by their anomaly score.
+	WAFScore *WAFScore `json:"waf_score,omitempty"`
+
+	// Makes the zone count failed authentication responses instead of
+	// requests, and lock out the keys that fail too often.
+	BruteForce *BruteForceProtection `json:"brute_force,omitempty"`
+
+	// Ramps the zone's limits up gradually when it starts without state.
+	WarmUp *WarmUp `json:"warm_up,omitempty"`
+
+	// Gives keys that the zone hasn't seen before a smaller limit for
+	// a while. Zones with an algorithm other than sliding_window can't
+	// have a greylist.
+	Greylist *Greylist `json:"greylist,omitempty"`
+
+	// Ramps the limit of keys that the zone hasn't seen before up to
+	// the zone's limit. Zones with an algorithm other than
+	// sliding_window can't have a key slow start.
+	KeySlowStart *KeySlowStart `json:"key_slow_start,omitempty"`
+
+	// Caps the rate at which keys that the zone hasn't seen before
+	// enter it, declining requests of new keys beyond it.
+	NewKeys *NewKeyLimit `json:"new_keys,omitempty"`
+
+	// Observes the zone without limiting it for a while, and suggests
+	// limits from the observed per-key rates.
+	Suggest *LimitSuggestion `json:"suggest,omitempty"`
+
+	// Logs declined requests of this zone to a dedicated logger.
+	DeclineLog *DeclineLog `json:"decline_log,omitempty"`
+
+	// Gives the zone a logger of its own, with its own name and level.
+	Log *ZoneLog `json:"log,omitempty"`
+
+	// Keys and client IP ranges whose requests are declined in the
+	// zone without consulting their rate limiters, as if they were
+	// banned until the list's next refresh.
+	DenyList *KeyList `json:"deny_list,omitempty"`
+
+	// Keys and client IP ranges whose requests are not limited in the
+	// zone. Exemptions take precedence over the deny list.
+	ExemptList *KeyList `json:"exempt_list,omitempty"`
+
+	matcherSets caddyhttp.MatcherSets
+
+	// matchers of the patterns of path_costs, in the same order
+	pathCostMatchers []caddyhttp.MatchPath
+
+	// the zone's algorithm, unless it is the sliding window
+	algorithm Algorithm
+
+	limitersMap *rateLimitersMap
+
+	keyTemplate keyTemplate
+
+	// what the zone counts once per, if anything; see CountOncePer
+	sessionTemplate *keyTemplate
+
+	// request headers that the key depends on; see varyHeaders
+	varyHeaders []string
+
+	// set if the zone's name has placeholders
+	nameTemplate keyTemplate
+	dynamic      *dynamicZones
+
+	// set if the zone has tiers: the zone of each tier by name, or nil
+	// for unlimited ones; see TierBy
+	tierTemplate keyTemplate
+	tiers        map[string]*RateLimit
+
+	// set if the zone has an authenticated limit: the zone of
+	// authenticated requests; see Authenticated
+	authenticated *RateLimit
+
+	// set if the handler has a tenant, and the tenant that a zone
+	// was resolved for; see Handler.Tenant
+	tenantTemplate *keyTemplate
+	tenant         string
+
+	// profiler labels of work done for this zone, made once so that
+	// labeling requests doesn't allocate
+	profileLabels context.Context
+
+	// time zone of the schedules, and the name of the schedule whose
+	// limits were last applied, if any
+	location *time.Location
+	schedule string
+}
+
+// PathCost is the cost of the requests whose path matches a pattern.
+type PathCost struct {
+	// The path pattern, as in the `path` matcher. Required.
+	Path string `json:"path,omitempty"`
+
+	// The number of events that matching requests count as.
+	Cost int `json:"cost"`
+}
+
+// UnmarshalJSON unmarshals rl, resolving `{env.*}` placeholders in
+// window and max_events, so that environments can share a config file
+// with different limits.
+func (rl *RateLimit) UnmarshalJSON(b []byte) error {
+	type rateLimit RateLimit // without this method
+	aux := struct {
+		*rateLimit
+		MaxEvents json.RawMessage `json:"max_events,omitempty"`
+		Window    json.RawMessage `json:"window,omitempty"`
+	}{rateLimit: (*rateLimit)(rl)}
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return err
+	}
+
+	if len(aux.MaxEvents) > 0 {
+		var value string
+		if err := json.Unmarshal(aux.MaxEvents, &value); err != nil {
+			if err := json.Unmarshal(aux.MaxEvents, &rl.MaxEvents); err != nil {
+				return fmt.Errorf("max_events: %v", err)
+			}
+		} else {
+			maxEvents, err := strconv.Atoi(expandEnv(value))
+			if err != nil {
+				return fmt.Errorf("max_events: invalid integer '%s': %v", value, err)
+			}
+			rl.MaxEvents = maxEvents
+		}
+	}
+
+	if len(aux.Window) > 0 {
+		var value string
+		if err := json.Unmarshal(aux.Window, &value); err == nil {
+			window, err := caddy.ParseDuration(expandEnv(value))
+			if err != nil {
+				return fmt.Errorf("window: invalid duration '%s': %v", value, err)
+			}
+			rl.Window = caddy.Duration(window)
+		} else if err := rl.Window.UnmarshalJSON(aux.Window); err != nil {
+			return fmt.Errorf("window: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// inherit sets the fields of rl that are not set to those of policy.
+// A zero max_events counts as not set.
+func (rl *RateLimit) inherit(policy *RateLimit) {
+	if len(rl.MatcherSetsRaw) == 0 {
+		rl.MatcherSetsRaw = policy.MatcherSetsRaw
+	}
+	if rl.Preset == "" {
+		rl.Preset = policy.Preset
+	}
+	if rl.Key == "" {
+		rl.Key = policy.Key
+	}
+	if rl.MaxEvents == 0 {
+		rl.MaxEvents = policy.MaxEvents
+	}
+	if rl.Window == 0 {
+		rl.Window = policy.Window
+	}
+	if len(rl.AlgorithmRaw) == 0 {
+		rl.AlgorithmRaw = policy.AlgorithmRaw
+	}
+	if rl.NearLimit == 0 {
+		rl.NearLimit = policy.NearLimit
+	}
+	if rl.PressureHeader == "" {
+		rl.PressureHeader = policy.PressureHeader
+	}
+	if rl.PressureThreshold == 0 {
+		rl.PressureThreshold = policy.PressureThreshold
+	}
+	if len(rl.Schedules) == 0 {
+		rl.Schedules = policy.Schedules
+	}
+	if rl.Timezone == "" {
+		rl.Timezone = policy.Timezone
+	}
+	if rl.TotalMaxEvents == 0 {
+		rl.TotalMaxEvents = policy.TotalMaxEvents
+	}
+	if rl.OverloadStatus == 0 {
+		rl.OverloadStatus = policy.OverloadStatus
+	}
+	if rl.Cooldown == 0 {
+		rl.Cooldown = policy.Cooldown
+	}
+	if rl.Consistency == "" {
+		rl.Consistency = policy.Consistency
+	}
+	if rl.StoreFailure == "" {
+		rl.StoreFailure = policy.StoreFailure
+	}
+	if rl.MethodCosts == nil {
+		rl.MethodCosts = policy.MethodCosts
+	}
+	if rl.MethodEvents == nil {
+		rl.MethodEvents = policy.MethodEvents
+	}
+	if len(rl.PathCosts) == 0 {
+		rl.PathCosts = policy.PathCosts
+	}
+	if rl.CostHeader == "" {
+		rl.CostHeader = policy.CostHeader
+	}
+	if rl.RefundHeader == "" {
+		rl.RefundHeader = policy.RefundHeader
+	}
+	if rl.CountOncePer == "" {
+		rl.CountOncePer = policy.CountOncePer
+	}
+	if rl.IdempotencyWindow == 0 {
+		rl.IdempotencyWindow = policy.IdempotencyWindow
+	}
+	if rl.MaxResponseBytes == 0 {
+		rl.MaxResponseBytes = policy.MaxResponseBytes
+	}
+	if rl.MaxRequestBytes == 0 {
+		rl.MaxRequestBytes = policy.MaxRequestBytes
+	}
+	if rl.MaxZones == 0 {
+		rl.MaxZones = policy.MaxZones
+	}
+	if rl.MaxKeys == 0 {
+		rl.MaxKeys = policy.MaxKeys
+	}
+	if rl.FirstSeenFilter == 0 {
+		rl.FirstSeenFilter = policy.FirstSeenFilter
+	}
+	rl.LogEvictions = rl.LogEvictions || policy.LogEvictions
+	rl.IsolateByHost = rl.IsolateByHost || policy.IsolateByHost
+	rl.CountRepeats = rl.CountRepeats || policy.CountRepeats
+	rl.Coalesce = rl.Coalesce || policy.Coalesce
+	if rl.TierBy == "" && len(rl.Tiers) == 0 {
+		rl.TierBy = policy.TierBy
+		rl.Tiers = policy.Tiers
+	}
+	if rl.Authenticated == nil {
+		rl.Authenticated = policy.Authenticated
+	}
+	if rl.SweepInterval == 0 {
+		rl.SweepInterval = policy.SweepInterval
+	}
+	if rl.IdleTTL == 0 {
+		rl.IdleTTL = policy.IdleTTL
+	}
+	if rl.UsageHistory == 0 {
+		rl.UsageHistory = policy.UsageHistory
+	}
+	if rl.MetricsIncludeKey == nil {
+		rl.MetricsIncludeKey = policy.MetricsIncludeKey
+	}
+	if rl.CircuitBreaker == nil && policy.CircuitBreaker != nil {
+		// every zone needs its own breaker state
+		rl.CircuitBreaker = &CircuitBreaker{
+			Upstreams: policy.CircuitBreaker.Upstreams,
+			Factor:    policy.CircuitBreaker.Factor,
+			SlowStart: policy.CircuitBreaker.SlowStart,
+		}
+	}
+	if rl.Anomaly == nil && policy.Anomaly != nil {
+		// every zone learns its own baseline
+		rl.Anomaly = &AnomalyDetection{
+			Action:         policy.Anomaly.Action,
+			BanDuration:    policy.Anomaly.BanDuration,
+			Interval:       policy.Anomaly.Interval,
+			Threshold:      policy.Anomaly.Threshold,
+			MinEvents:      policy.Anomaly.MinEvents,
+			LearningPeriod: policy.Anomaly.LearningPeriod,
+		}
+	}
+	if rl.RetryStorm == nil && policy.RetryStorm != nil {
+		rl.RetryStorm = &RetryStormDetection{
+			Interval:    policy.RetryStorm.Interval,
+			Threshold:   policy.RetryStorm.Threshold,
+			BanDuration: policy.RetryStorm.BanDuration,
+		}
+	}
+	if rl.Distinct == nil && policy.Distinct != nil {
+		rl.Distinct = &DistinctLimit{
+			Value:     policy.Distinct.Value,
+			MaxValues: policy.Distinct.MaxValues,
+		}
+	}
+	if rl.WAFScore == nil && policy.WAFScore != nil {
+		rl.WAFScore = &WAFScore{
+			Score:     policy.WAFScore.Score,
+			Threshold: policy.WAFScore.Threshold,
+			Weight:    policy.WAFScore.Weight,
+			MaxFactor: policy.WAFScore.MaxFactor,
+		}
+	}
+	if rl.BruteForce == nil {
+		rl.BruteForce = policy.BruteForce
+	}
+	if rl.WarmUp == nil {
+		rl.WarmUp = policy.WarmUp
+	}
+	if rl.Greylist == nil {
+		rl.Greylist = policy.Greylist
+	}
+	if rl.KeySlowStart == nil {
+		rl.KeySlowStart = policy.KeySlowStart
+	}
+	if rl.NewKeys == nil {
+		rl.NewKeys = policy.NewKeys
+	}
+	if rl.Suggest == nil {
+		rl.Suggest = policy.Suggest
+	}
+	if rl.DeclineLog == nil && policy.DeclineLog != nil {
+		// every zone needs its own logger
+		declineLog := *policy.DeclineLog
+		rl.DeclineLog = &declineLog
+	}
+	if rl.Log == nil && policy.Log != nil {
+		zoneLog := *policy.Log
+		rl.Log = &zoneLog
+	}
+	// every zone loads its own lists
+	if rl.DenyList == nil && policy.DenyList != nil {
+		rl.DenyList = &KeyList{Source: policy.DenyList.Source, RefreshInterval: policy.DenyList.RefreshInterval}
+	}
+	if rl.ExemptList == nil && policy.ExemptList != nil {
+		rl.ExemptList = &KeyList{Source: policy.ExemptList.Source, RefreshInterval: policy.ExemptList.RefreshInterval}
+	}
+}
+
+func (rl *RateLimit) provision(ctx caddy.Context, name string) error {
+	if rl.BruteForce != nil {
+		rl.BruteForce.preset(rl)
+		if err := rl.BruteForce.provision(); err != nil {
+			return fmt.Errorf("setting up brute force protection: %v", err)
+		}
+	}
+	if rl.Window <= 0 {
+		return fmt.Errorf("window must be greater than zero")
+	}
+	if rl.MaxEvents < 0 {
+		return fmt.Errorf("max_events must be at least zero")
+	}
+	if rl.TotalMaxEvents < 0 {
+		return fmt.Errorf("total_max_events must be at least zero")
+	}
+	if rl.OverloadStatus != 0 && (rl.OverloadStatus < 400 || rl.OverloadStatus > 599) {
+		return fmt.Errorf("overload_status must be an error status code (4xx or 5xx)")
+	}
+	if rl.Cooldown < 0 {
+		return fmt.Errorf("cooldown must be at least zero")
+	}
+	if err := validConsistency(rl.Consistency); err != nil {
+		return err
+	}
+	if err := validStoreFailure(rl.StoreFailure); err != nil {
+		return err
+	}
+	if rl.StoreFailure == "" {
+		rl.StoreFailure = storeFailureOpen
+	}
+	for method, maxEvents := range rl.MethodEvents {
+		if maxEvents < 1 {
+			return fmt.Errorf("method_events: events of %s must be at least 1", method)
+		}
+		if upper := strings.ToUpper(method); upper != method {
+			return fmt.Errorf("method_events: method %s must be upper case", method)
+		}
+	}
+	for method, cost := range rl.MethodCosts {
+		if cost < 1 {
+			return fmt.Errorf("method_costs: cost of %s must be at least 1", method)
+		}
+		if upper := strings.ToUpper(method); upper != method {
+			return fmt.Errorf("method_costs: method %s must be upper case", method)
+		}
+	}
+	rl.pathCostMatchers = nil
+	for _, pc := range rl.PathCosts {
+		if pc.Path == "" {
+			return fmt.Errorf("path_costs: path is required")
+		}
+		if pc.Cost < 0 {
+			return fmt.Errorf("path_costs: cost of %s must be at least zero", pc.Path)
+		}
+		matcher := caddyhttp.MatchPath{pc.Path}
+		if err := matcher.Provision(ctx); err != nil {
+			return fmt.Errorf("path_costs: %v", err)
+		}
+		rl.pathCostMatchers = append(rl.pathCostMatchers, matcher)
+	}
+	if rl.IdempotencyWindow < 0 {
+		return fmt.Errorf("idempotency_window must be at least zero")
+	}
+	switch rl.CountOncePer {
+	case "":
+	case countOncePerConnection:
+		sessionTemplate := newKeyTemplate("{http.request.remote}")
+		rl.sessionTemplate = &sessionTemplate
+	default:
+		sessionTemplate := newKeyTemplate(rl.CountOncePer)
+		if sessionTemplate.static {
+			return fmt.Errorf("count_once_per must be 'connection' or have placeholders: %s", rl.CountOncePer)
+		}
+		rl.sessionTemplate = &sessionTemplate
+	}
+	if rl.MaxResponseBytes < 0 {
+		return fmt.Errorf("max_response_bytes must be at least zero")
+	}
+	if rl.MaxRequestBytes < 0 {
+		return fmt.Errorf("max_request_bytes must be at least zero")
+	}
+	if rl.MaxKeys < 0 {
+		return fmt.Errorf("max_keys must be at least zero")
+	}
+	if rl.MaxZones < 0 {
+		return fmt.Errorf("max_zones must be at least zero")
+	}
+	if rl.FirstSeenFilter < 0 {
+		return fmt.Errorf("first_seen_filter must be at least zero")
+	}
+	if rl.IdleTTL < 0 {
+		return fmt.Errorf("idle_ttl must be at least zero")
+	}
+	if rl.SweepInterval < 0 {
+		return fmt.Errorf("sweep_interval must be at least zero")
+	}
+	if rl.UsageHistory < 0 {
+		return fmt.Errorf("usage_history must be at least zero")
+	}
+	if rl.NearLimit < 0 || rl.NearLimit > 1 {
+		return fmt.Errorf("near_limit must be between 0 and 1")
+	}
+	if rl.PressureThreshold < 0 || rl.PressureThreshold > 1 {
+		return fmt.Errorf("pressure_threshold must be between 0 and 1")
+	}
+	if rl.PressureHeader != "" && rl.PressureThreshold == 0 {
+		rl.PressureThreshold = rl.NearLimit
+		if rl.PressureThreshold == 0 {
+			rl.PressureThreshold = defaultPressureThreshold
+		}
+	}
+
+	if err := rl.provisionSchedules(); err != nil {
+		return err
+	}
+
+	if rl.RetryStorm != nil {
+		if err := rl.RetryStorm.provision(); err != nil {
+			return fmt.Errorf("setting up retry storm detection: %v", err)
+		}
+	}
+
+	if rl.Distinct != nil {
+		if err := rl.Distinct.provision(); err != nil {
+			return fmt.Errorf("setting up distinct limit: %v", err)
+		}
+	}
+
+	if rl.WAFScore != nil {
+		if err := rl.WAFScore.provision(); err != nil {
+			return fmt.Errorf("setting up waf_score: %v", err)
+		}
+	}
+
+	if rl.WarmUp != nil {
+		if err := rl.WarmUp.provision(); err != nil {
+			return fmt.Errorf("setting up warm-up: %v", err)
+		}
+	}
+
+	if rl.Greylist != nil {
+		if err := rl.Greylist.provision(rl.MaxEvents); err != nil {
+			return fmt.Errorf("setting up greylist: %v", err)
+		}
+	}
+
+	if rl.KeySlowStart != nil {
+		if err := rl.KeySlowStart.provision(); err != nil {
+			return fmt.Errorf("setting up key_slow_start: %v", err)
+		}
+	}
+
+	if rl.NewKeys != nil {
+		if err := rl.NewKeys.provision(); err != nil {
+			return fmt.Errorf("setting up new_keys: %v", err)
+		}
+	}
+
+	if rl.Suggest != nil {
+		if err := rl.Suggest.provision(ctx.Logger()); err != nil {
+			return fmt.Errorf("setting up suggestion: %v", err)
+		}
+	}
+
+	if rl.DeclineLog != nil {
+		if err := rl.DeclineLog.provision(ctx.Logger(), name); err != nil {
+			return fmt.Errorf("setting up decline log: %v", err)
+		}
+	}
+
+	if rl.Log != nil {
+		if err := rl.Log.provision(ctx.Logger(), name); err != nil {
+			return fmt.Errorf("setting up log: %v", err)
+		}
+	}
+
+	if rl.DenyList != nil {
+		if err := rl.DenyList.provision(ctx, ctx.Logger()); err != nil {
+			return fmt.Errorf("setting up deny list: %v", err)
+		}
+	}
+	if rl.ExemptList != nil {
+		if err := rl.ExemptList.provision(ctx, ctx.Logger()); err != nil {
+			return fmt.Errorf("setting up exempt list: %v", err)
+		}
+	}
+
+	if len(rl.MatcherSetsRaw) > 0 {
+		matcherSets, err := ctx.LoadModule(rl, "MatcherSetsRaw")
+		if err != nil {
+			return err
+		}
+		err = rl.matcherSets.FromInterface(matcherSets)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(rl.AlgorithmRaw) > 0 {
+		// loading the module clears the field, but it is still needed
+		// to compare the zone with other definitions and reloads
+		raw := rl.AlgorithmRaw
+		mod, err := ctx.LoadModule(rl, "AlgorithmRaw")
+		rl.AlgorithmRaw = raw
+		if err != nil {
+			return fmt.Errorf("loading algorithm: %v", err)
+		}
+		// the sliding window is built in, with all its features
+		if _, ok := mod.(*SlidingWindow); !ok {
+			rl.algorithm = mod.(Algorithm)
+		}
+	}
+	if rl.algorithm != nil && rl.TotalMaxEvents > 0 {
+		return fmt.Errorf("total_max_events requires the sliding_window algorithm")
+	}
+	if rl.algorithm != nil && rl.MaxKeys > 0 {
+		return fmt.Errorf("max_keys requires the sliding_window algorithm")
+	}
+	if rl.algorithm != nil && rl.IdleTTL > 0 {
+		return fmt.Errorf("idle_ttl requires the sliding_window algorithm")
+	}
+	if rl.algorithm != nil && rl.CostHeader != "" {
+		return fmt.Errorf("cost_header requires the sliding_window algorithm")
+	}
+	if rl.algorithm != nil && rl.RefundHeader != "" {
+		return fmt.Errorf("refund_header requires the sliding_window algorithm")
+	}
+	if rl.algorithm != nil && rl.BruteForce != nil {
+		return fmt.Errorf("brute_force requires the sliding_window algorithm")
+	}
+	if rl.algorithm != nil && rl.Greylist != nil {
+		return fmt.Errorf("greylist requires the sliding_window algorithm")
+	}
+	if rl.algorithm != nil && rl.KeySlowStart != nil {
+		return fmt.Errorf("key_slow_start requires the sliding_window algorithm")
+	}
+
+	rl.keyTemplate = newKeyTemplate(expandEnv(rl.Key))
+	rl.varyHeaders = varyHeaders(rl.keyTemplate.raw)
+
+	// zones whose names have placeholders get their state when
+	// requests resolve them; see resolve
+	if nameTemplate := newKeyTemplate(name); !nameTemplate.static {
+		if len(rl.RenamedFrom) > 0 {
+			return fmt.Errorf("renamed_from requires a zone name without placeholders")
+		}
+		if len(rl.Tiers) > 0 || rl.Authenticated != nil {
+			return fmt.Errorf("tiers and authenticated limits require a zone name without placeholders")
+		}
+		rl.nameTemplate = nameTemplate
+		rl.dynamic = &dynamicZones{zones: make(map[string]*RateLimit)}
+		return nil
+	}
+	if rl.MaxZones > 0 {
+		return fmt.Errorf("max_zones requires a zone name with placeholders")
+	}
+	rl.provisionState(name)
+
+	return rl.provisionTiers(name)
+}
+
+// algorithmConfig returns the JSON config of the zone's algorithm, or
+// an empty string for the sliding window.
+func (rl *RateLimit) algorithmConfig() string {
+	if rl.algorithm == nil {
+		return ""
+	}
+	return string(rl.AlgorithmRaw)
+}
+
+// limitsAnything returns true if the zone limits events, bytes or
+// distinct values.
+func (rl *RateLimit) limitsAnything() bool {
+	return rl.MaxEvents > 0 || rl.MaxResponseBytes > 0 || rl.MaxRequestBytes > 0 || rl.Distinct != nil
+}
+
+// limitsEvents returns false if the zone only limits bytes or distinct
+// values.
+func (rl *RateLimit) limitsEvents() bool {
+	return rl.MaxEvents > 0 || !rl.limitsAnything()
+}
+
+// provisionState sets up the state of the zone with the given name.
+func (rl *RateLimit) provisionState(name string) {
+	// ensure rate limiter state endures across config changes
+	rl.limitersMap = newRateLimiterMap()
+	// a renamed zone takes over the state of its old name, which the
+	// config that is being replaced still uses
+	var renamed bool
+	for _, oldName := range rl.RenamedFrom {
+		if state, ok := zoneLimiters(oldName); ok {
+			rl.limitersMap, renamed = state, true
+			break
+		}
+	}
+	val, loaded := rateLimits.LoadOrStore(name, rl.limitersMap)
+	if loaded {
+		rl.limitersMap = val.(*rateLimitersMap)
+	}
+	loaded = loaded || renamed
+	maxEvents, schedule := rl.maxEventsAt(now())
+	rl.schedule = schedule
+	rl.limitersMap.updateAll(maxEvents, time.Duration(rl.Window))
+	if !loaded && rl.WarmUp != nil {
+		rl.limitersMap.startWarmUp(rl.WarmUp.Factor, time.Duration(rl.WarmUp.Duration))
+	}
+	rl.limitersMap.setAlgorithm(rl.algorithm, rl.algorithmConfig())
+	rl.limitersMap.setMaxKeys(rl.MaxKeys)
+	rl.limitersMap.setFirstSeenFilter(rl.FirstSeenFilter)
+	rl.limitersMap.idleTTL.Store(int64(rl.IdleTTL))
+	rl.limitersMap.setTotal(rl.TotalMaxEvents)
+	if rl.NewKeys != nil {
+		rl.limitersMap.setNewKeyLimit(rl.NewKeys.MaxKeys, time.Duration(rl.NewKeys.Interval))
+	} else {
+		rl.limitersMap.setNewKeyLimit(0, 0)
+	}
+	rl.limitersMap.setMethodEvents(rl.MethodEvents, time.Duration(rl.Window))
+	rl.limitersMap.setByteQuota(&rl.limitersMap.requestBytes, rl.MaxRequestBytes)
+	rl.limitersMap.setByteQuota(&rl.limitersMap.responseBytes, rl.MaxResponseBytes)
+	rl.limitersMap.setSuggestion(name, rl.Suggest)
+	rl.limitersMap.setUsageHistory(rl.UsageHistory, time.Duration(rl.Window))
+	rl.profileLabels = pprof.WithLabels(context.Background(), pprof.Labels(profileLabelZone, name))
+}
+
+type rateLimitersMap struct {
+	// the zone's rate limiters, spread across shards by key so
+	// that concurrent requests rarely contend for the same lock
+	shards    []limiterShard
+	shardSeed maphash.Seed
+
+	// number of rate limiters in all shards
+	keys atomic.Int64
+
+	// how long the state of an idle key is kept, in nanoseconds, or 0
+	// until its events have left the window
+	idleTTL atomic.Int64
+
+	// maximum number of rate limiters, or 0 for no limit; beyond
+	// it, the least recently used rate limiters are evicted
+	maxKeys atomic.Int64
+
+	// rate limiter of the events of all keys, if the zone limits their
+	// total; see when
+	total atomic.Pointer[ringBufferRateLimiter]
+
+	// rate limiter of the keys that are new to the zone, if it caps
+	// them, and whether their cap is reached; see admitNewKey
+	newKeys     atomic.Pointer[ringBufferRateLimiter]
+	newKeyFlood atomic.Bool
+
+	// rate limiters of the events of each key by HTTP method, if the
+	// zone limits them; see RateLimit.MethodEvents
+	methods atomic.Pointer[map[string]*rateLimitersMap]
+
+	// prefixes of keys in the penalty box, mapped to when their ban
+	// expires, or nil if there are none; the map is replaced, not
+	// changed, while holding limitersMu. See banPrefix.
+	prefixBans atomic.Pointer[map[string]time.Time]
+
+	// bytes of request and response bodies of each key, if the
+	// zone limits them
+	requestBytes  atomic.Pointer[byteQuota]
+	responseBytes atomic.Pointer[byteQuota]
+
+	// observation of the zone's keys for suggested limits, during
+	// which the zone doesn't limit events
+	observation atomic.Pointer[limitObservation]
+
+	// keys that the zone has seen, if their first events are allowed
+	// without rate limiters; see admitUnseen
+	firstSeen atomic.Pointer[firstSeenFilter]
+
+	// limiters of the zone's keys if it uses an algorithm module other
+	// than the sliding window, in which case the shards hold no rate
+	// limiters
+	algorithm atomic.Pointer[algorithmLimiters]
+
+	// number of rate limiters evicted since takeEvictions was called
+	evictions atomic.Int64
+
+	// number of sweeps of the zone, and how long the last one took, in
+	// nanoseconds; see handleDebugVars
+	sweeps        atomic.Int64
+	sweepDuration atomic.Int64
+
+	// rate limiters that were removed from the shards, waiting to be
+	// reused; see retire
+	retiredMu sync.Mutex
+	retiring  []*ringBufferRateLimiter
+	retired   []*ringBufferRateLimiter
+
+	// recent usage of the zone's keys, if it keeps a usage history;
+	// see RateLimit.UsageHistory
+	usageMu      sync.Mutex
+	usageHistory int
+	usageWindow  time.Duration
+	usage        map[string]*keyUsage
+
+	// limits applied to new and existing rate limiters, and the maximum
+	// number of events before it is scaled by the clamp, load shedding,
+	// circuit breaker and warm-up, if any; they are only changed while
+	// holding limitersMu, but can be read without it
+	maxEvents           atomic.Int64
+	window              atomic.Int64
+	configuredMaxEvents atomic.Int64
+
+	// protects the fields below; if both are needed, a shard's
+	// lock must be acquired before limitersMu
+	limitersMu sync.Mutex
+
+	// limit of the zone's total before it is scaled, and what scales
+	// the limits: the clamp, load shedding, circuit breaker and warm-up,
+	// if any
+	totalMaxEvents int
+	clamp          *zoneClamp
+	shedFactor     float64
+	breakerFactor  float64
+	breakerActive  bool
+	warmUp         *zoneWarmUp
+
+	// requests with an idempotency key, by key and idempotency key,
+	// mapped to when their retries are counted again; see
+	// RateLimit.IdempotencyWindow
+	idempotent map[idempotentRequest]time.Time
+
+	// connections or sessions of keys that were counted, mapped to
+	// when they are forgotten; see RateLimit.CountOncePer
+	sessions map[keySession]time.Time
+
+	// runs of identical requests of keys; see RateLimit.RetryStorm
+	retryStreaks map[string]retryStreak
+
+	// runs of lockouts of keys; see RateLimit.BruteForce
+	lockouts map[string]lockoutStreak
+
+	// hashes of the values that keys used, mapped to when they last
+	// used them; see RateLimit.Distinct. The values are hashed with
+	// distinctSeed, which is kept with them across reloads.
+	distinctValues map[string]map[uint64]time.Time
+	distinctSeed   maphash.Seed
+
+	// emits events about the zone
+	emit func(name string, data map[string]any)
+}
+
+// limiterShard holds the rate limiters of a subset of a zone's keys.
+// Its methods must be called while holding a lock on mu.
+type limiterShard struct {
+	mu       sync.Mutex
+	limiters map[string]*limiterEntry
+
+	// keys of the shard's rate limiters, from the most to the
+	// least recently used
+	recency list.List
+
+	// keys of the shard in the penalty box, mapped to when their ban
+	// expires
+	bans map[string]time.Time
+
+	// keys of the shard in the penalty box, mapped to when they were
+	// banned, and how long the bans that ended since takeServedBans was
+	// called lasted
+	bannedSince map[string]time.Time
+	servedBans  []time.Duration
+
+	// keys of the shard that an upstream asked to back off, or that are
+	// cooling down, mapped to when they may make requests again; see
+	// UpstreamRetryAfter and RateLimit.Cooldown
+	backoffs map[string]time.Time
+
+	// number of times that mu was locked by someone else when it was
+	// about to be locked; see lock
+	contended atomic.Int64
+}
+
+// lock locks the shard, counting whether it had to wait for the lock.
+func (shard *limiterShard) lock() {
+	if !shard.mu.TryLock() {
+		shard.contended.Add(1)
+		shard.mu.Lock()
+	}
+}
+
+// limiterEntry is a rate limiter in a shard.
+type limiterEntry struct {
+	limiter *ringBufferRateLimiter
+	recent  *list.Element // in the shard's recency list
+	since   time.Time     // when the entry was inserted
+}
+
+// insert adds the rate limiter for key to the shard as the most
+// recently used one.
+func (shard *limiterShard) insert(key string, rl *ringBufferRateLimiter) {
+	shard.limiters[key] = &limiterEntry{
+		limiter: rl,
+		recent:  shard.recency.PushFront(key),
+		since:   now(),
+	}
+}
+
+// remove removes the rate limiter for key from the shard. It returns
+// true if there was one.
+func (shard *limiterShard) remove(key string) bool {
+	entry, ok := shard.limiters[key]
+	if !ok {
+		return false
+	}
+	shard.recency.Remove(entry.recent)
+	delete(shard.limiters, key)
+	return true
+}
+
+// evictLeastRecent removes the least recently used rate limiter from
+// the shard and returns it. It returns nil if the shard is empty.
+func (shard *limiterShard) evictLeastRecent() *ringBufferRateLimiter {
+	oldest := shard.recency.Back()
+	if oldest == nil {
+		return nil
+	}
+	key := oldest.Value.(string)
+	rl := shard.limiters[key].limiter
+	shard.remove(key)
+	return rl
+}
+
+// newRateLimiterMap returns a map with one shard per available CPU,
+// rounded up to a power of two.
+func newRateLimiterMap() *rateLimitersMap {
+	shards := 1
+	for shards < runtime.GOMAXPROCS(0) {
+		shards *= 2
+	}
+	return newShardedRateLimiterMap(shards)
+}
+
+// newShardedRateLimiterMap returns a map with the given number of
+// shards, which must be a power of two.
+func newShardedRateLimiterMap(shards int) *rateLimitersMap {
+	rlm := &rateLimitersMap{
+		shards:       make([]limiterShard, shards),
+		shardSeed:    maphash.MakeSeed(),
+		idempotent:   make(map[idempotentRequest]time.Time),
+		sessions:     make(map[keySession]time.Time),
+		retryStreaks: make(map[string]retryStreak),
+		lockouts:     make(map[string]lockoutStreak),
+
+		distinctValues: make(map[string]map[uint64]time.Time),
+		distinctSeed:   maphash.MakeSeed(),
+	}
+	for i := range rlm.shards {
+		rlm.shards[i].limiters = make(map[string]*limiterEntry)
+		rlm.shards[i].bans = make(map[string]time.Time)
+		rlm.shards[i].bannedSince = make(map[string]time.Time)
+		rlm.shards[i].backoffs = make(map[string]time.Time)
+	}
+	return rlm
+}
+
+// shardFor returns the shard that holds the rate limiter for key.
+func (rlm *rateLimitersMap) shardFor(key string) *limiterShard {
+	return &rlm.shards[maphash.String(rlm.shardSeed, key)&uint64(len(rlm.shards)-1)]
+}
+
+// getOrInsert returns an existing rate limiter from the map, or inserts a new
+// one with the zone's current limits and returns it. If the map is full, the
+// least recently used rate limiter of the key's shard is evicted to make room.
+func (rlm *rateLimitersMap) getOrInsert(key string) *ringBufferRateLimiter {
+	return rlm.getOrInsertUnsettled(key, false)
+}
+
+// getOrInsertUnsettled is like getOrInsert, but if unsettled is true, i.e.
+// the first event of key was allowed without a rate limiter (see
+// admitUnseen), a new rate limiter counts that event too.
+func (rlm *rateLimitersMap) getOrInsertUnsettled(key string, unsettled bool) *ringBufferRateLimiter {
+	shard := rlm.shardFor(key)
+	shard.lock()
+	defer shard.mu.Unlock()
+
+	entry, ok := shard.limiters[key]
+	if !ok {
+		// evicting only from this shard keeps shards independent; so
+		// eviction order is approximate, and if this shard is empty,
+		// the map may briefly hold more rate limiters than allowed
+		if maxKeys := rlm.maxKeys.Load(); maxKeys > 0 && rlm.keys.Load() >= maxKeys {
+			if evicted := shard.evictLeastRecent(); evicted != nil {
+				rlm.keys.Add(-1)
+				rlm.evictions.Add(1)
+				rlm.retire(evicted)
+			}
+		}
+
+		// reading the limits while holding the shard's lock ensures
+		// that a concurrent updateAll, which stores them before it
+		// locks the shards, either is seen here or updates the new
+		// rate limiter afterwards
+		maxEvents, window := rlm.limits()
+		newRateLimiter := newRingBufferRateLimiter(maxEvents, window)
+		if f := rlm.firstSeen.Load(); f != nil && unsettled {
+			newRateLimiter.reserve()
+			f.settle(key)
+		}
+		shard.insert(key, newRateLimiter)
+		rlm.keys.Add(1)
+		return newRateLimiter
+	}
+	shard.recency.MoveToFront(entry.recent)
+	return entry.limiter
+}
+
+// get returns the rate limiter for key without inserting one. It does
+// not count as a use of the rate limiter for eviction purposes.
+func (rlm *rateLimitersMap) get(key string) (*ringBufferRateLimiter, bool) {
+	shard := rlm.shardFor(key)
+	shard.lock()
+	defer shard.mu.Unlock()
+	entry, ok := shard.limiters[key]
+	if !ok {
+		return nil, false
+	}
+	return entry.limiter, true
+}
+
+// since returns when the rate limiter for key was inserted, if it exists.
+func (rlm *rateLimitersMap) since(key string) (time.Time, bool) {
+	shard := rlm.shardFor(key)
+	shard.lock()
+	defer shard.mu.Unlock()
+	entry, ok := shard.limiters[key]
+	if !ok {
+		return time.Time{}, false
+	}
+	return entry.since, true
+}
+
+// setTotal sets the maximum number of events of all keys together
+// within the zone's window; 0 means no limit.
+func (rlm *rateLimitersMap) setTotal(maxEvents int) {
+	rlm.limitersMu.Lock()
+	defer rlm.limitersMu.Unlock()
+	rlm.totalMaxEvents = maxEvents
+	maxEvents = rlm.clamped(maxEvents)
+	if rlm.totalMaxEvents == 0 {
+		rlm.total.Store(nil)
+		return
+	}
+	if total := rlm.total.Load(); total != nil {
+		total.SetMaxEvents(maxEvents)
+		return
+	}
+	rlm.total.Store(newRingBufferRateLimiter(maxEvents, time.Duration(rlm.window.Load())))
+}
+
+// setMethodEvents sets the maximum number of events of each key within
+// window by HTTP method, keeping the rate limiters of methods that were
+// limited before.
+func (rlm *rateLimitersMap) setMethodEvents(events map[string]int, window time.Duration) {
+	rlm.limitersMu.Lock()
+	defer rlm.limitersMu.Unlock()
+	if len(events) == 0 {
+		rlm.methods.Store(nil)
+		return
+	}
+	var old map[string]*rateLimitersMap
+	if previous := rlm.methods.Load(); previous != nil {
+		old = *previous
+	}
+	methods := make(map[string]*rateLimitersMap, len(events))
+	for method, maxEvents := range events {
+		limiters, ok := old[method]
+		if !ok {
+			limiters = newRateLimiterMap()
+		}
+		limiters.updateAll(maxEvents, window)
+		methods[method] = limiters
+	}
+	rlm.methods.Store(&methods)
+}
+
+// methodLimiters returns the rate limiters of the events of keys with
+// the given method, if the zone limits them.
+func (rlm *rateLimitersMap) methodLimiters(method string) (*rateLimitersMap, bool) {
+	methods := rlm.methods.Load()
+	if methods == nil {
+		return nil, false
+	}
+	limiters, ok := (*methods)[method]
+	return limiters, ok
+}
+
+// setByteQuota sets the maximum number of bytes of each key within the
+// window of the byte quota that quota points to, which is removed if max
+// is 0.
+func (rlm *rateLimitersMap) setByteQuota(quota *atomic.Pointer[byteQuota], max int64) {
+	rlm.limitersMu.Lock()
+	defer rlm.limitersMu.Unlock()
+	if max == 0 {
+		quota.Store(nil)
+		return
+	}
+	window := time.Duration(rlm.window.Load())
+	if q := quota.Load(); q != nil {
+		q.set(max, window)
+		return
+	}
+	quota.Store(newByteQuota(max, window))
+}
+
+// byteQuotas returns the pointers to the zone's byte quotas, which are
+// nil if the zone doesn't limit those bytes.
+func (rlm *rateLimitersMap) byteQuotas() [2]*atomic.Pointer[byteQuota] {
+	return [2]*atomic.Pointer[byteQuota]{&rlm.requestBytes, &rlm.responseBytes}
+}
 
-	// Number of events allowed within the window.
-	MaxEvents int `json:"max_events,omitempty"`
+// when is like limiter.When, but also applies the zone's total limit,
+// if any. The event is reserved in both limiter and the zone's total,
+// or in neither.
+func (rlm *rateLimitersMap) when(limiter *ringBufferRateLimiter) time.Duration {
+	return rlm.whenN(limiter, 1)
+}
 
-	// Duration of the sliding window.
-	Window caddy.Duration `json:"window,omitempty"`
+// whenN is like when, for n events at once, which are reserved
+// together or not at all.
+func (rlm *rateLimitersMap) whenN(limiter *ringBufferRateLimiter, n int) time.Duration {
+	wait, _ := rlm.reserveN(limiter, n, 0)
+	return wait
+}
 
-	matcherSets caddyhttp.MatcherSets
+// reserveN reserves n events in limiter, which must fit in its window
+// along with others events that are counted elsewhere (see
+// ringBufferRateLimiter.reserveN), and in the zone's total, if any. The
+// events are reserved in both or in neither: if the total declines
+// them, they are given back to limiter. It returns how long until the
+// events would be allowed, and true if only the total declined them.
+func (rlm *rateLimitersMap) reserveN(limiter *ringBufferRateLimiter, n, others int) (time.Duration, bool) {
+	res, wait := limiter.reserveN(n, others)
+	total := rlm.total.Load()
+	if total == nil {
+		return wait, false
+	}
+	if wait > 0 {
+		return max(wait, total.waitNUnsynced(now(), n)), false
+	}
+	if _, wait := total.reserveN(n, 0); wait > 0 {
+		res.cancel()
+		return wait, true
+	}
+	return 0, false
+}
 
-	limitersMap *rateLimitersMap
+// debit counts n more events of key, whether or not they are allowed,
+// e.g. because the cost of an allowed event was only known after it
+// happened. Events beyond the key's limit are not counted, since the
+// window can't hold them.
+func (rlm *rateLimitersMap) debit(key string, n int) {
+	limiter := rlm.getOrInsert(key)
+	total := rlm.total.Load()
+	if total != nil {
+		total.mu.Lock()
+		defer total.mu.Unlock()
+	}
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	for range min(n, limiter.MaxEvents()) {
+		limiter.reserve()
+		if total != nil {
+			total.reserve()
+		}
+	}
 }
 
-func (rl *RateLimit) provision(ctx caddy.Context, name string) error {
-	if rl.Window <= 0 {
-		return fmt.Errorf("window must be greater than zero")
+// refund removes up to n events of key from its window, and as many
+// from the zone's total, if any, and returns the number of events of
+// key that were removed. Zones with an algorithm module can't refund
+// events.
+func (rlm *rateLimitersMap) refund(key string, n int) (int, error) {
+	if rlm.algorithm.Load() != nil {
+		return 0, fmt.Errorf("refunds require the sliding_window algorithm")
 	}
-	if rl.MaxEvents < 0 {
-		return fmt.Errorf("max_events must be at least zero")
+	limiter, ok := rlm.get(key)
+	if !ok {
+		return 0, nil
+	}
+	ref := now()
+	refunded := limiter.refund(ref, n)
+	if total := rlm.total.Load(); total != nil && refunded > 0 {
+		total.refund(ref, refunded)
+	}
+	return refunded, nil
+}
+
+// whenKey is like when, for the rate limiter of key, which is inserted
+// if needed, or the limiter of the zone's algorithm module, if any.
+func (rlm *rateLimitersMap) whenKey(key string) time.Duration {
+	if al := rlm.algorithm.Load(); al != nil {
+		maxEvents, window := rlm.limits()
+		return al.limiter(key, maxEvents, window).Allow(now(), 1)
 	}
+	return rlm.when(rlm.getOrInsert(key))
+}
 
-	if len(rl.MatcherSetsRaw) > 0 {
-		matcherSets, err := ctx.LoadModule(rl, "MatcherSetsRaw")
-		if err != nil {
-			return err
+// overloaded returns true if an event of the key of limiter, which was
+// just declined, was declined because of the zone as a whole rather than
+// the key's own limit: because the zone's limits are scaled down by a
+// clamp, load shedding or a circuit breaker, or the zone's total limit
+// is reached while the key's isn't. A nil limiter means the key's events
+// are not counted by the zone's rate limiters, e.g. with an algorithm
+// module, so only the zone's scaling is considered.
+func (rlm *rateLimitersMap) overloaded(limiter *ringBufferRateLimiter) bool {
+	if rlm.maxEvents.Load() < rlm.configuredMaxEvents.Load() {
+		return true
+	}
+
+	total := rlm.total.Load()
+	if total == nil || limiter == nil {
+		return false
+	}
+	ref := now()
+	if count, _ := limiter.Count(ref); count >= limiter.MaxEvents() {
+		return false
+	}
+	count, _ := total.Count(ref)
+	return count >= total.MaxEvents()
+}
+
+// setMaxKeys sets the maximum number of rate limiters in the map;
+// 0 means no limit. Excess rate limiters are evicted as new keys
+// are inserted.
+func (rlm *rateLimitersMap) setMaxKeys(maxKeys int) {
+	rlm.maxKeys.Store(int64(maxKeys))
+}
+
+// evictLeastRecent evicts about n of the least recently used rate
+// limiters from the map, taking from each shard in proportion to its
+// size, and returns how many were evicted.
+func (rlm *rateLimitersMap) evictLeastRecent(n int) int {
+	total := int(rlm.keys.Load())
+	if n <= 0 || total <= 0 {
+		return 0
+	}
+
+	var evicted int
+	for i := range rlm.shards {
+		shard := &rlm.shards[i]
+		shard.lock()
+		share := min((n*len(shard.limiters)+total-1)/total, n-evicted)
+		for range share {
+			rl := shard.evictLeastRecent()
+			if rl == nil {
+				break
+			}
+			rlm.retire(rl)
+			evicted++
 		}
-		err = rl.matcherSets.FromInterface(matcherSets)
-		if err != nil {
-			return err
+		shard.mu.Unlock()
+	}
+	rlm.keys.Add(-int64(evicted))
+	rlm.evictions.Add(int64(evicted))
+	return evicted
+}
+
+// takeEvictions returns the number of rate limiters that were
+// evicted since the last call.
+func (rlm *rateLimitersMap) takeEvictions() int {
+	return int(rlm.evictions.Swap(0))
+}
+
+// peek reports whether an event for key would be allowed right now,
+// how many events remain in the window, and how long to wait before
+// the next event is allowed. Unlike a real event, it does not make a
+// reservation or allocate a rate limiter for unknown keys.
+func (rlm *rateLimitersMap) peek(key string) (allowed bool, remaining int, wait time.Duration) {
+	maxEvents, window := rlm.limits()
+
+	if dur := max(rlm.banned(key), rlm.backedOff(key)); dur > 0 {
+		return false, 0, dur
+	}
+
+	if al := rlm.algorithm.Load(); al != nil {
+		limiter, ok := al.get(key)
+		if !ok {
+			return maxEvents > 0, maxEvents, 0
 		}
+		remaining = limiter.Remaining(now())
+		return remaining > 0, remaining, 0
 	}
 
-	// ensure rate limiter state endures across config changes
-	rl.limitersMap = newRateLimiterMap()
-	if val, loaded := rateLimits.LoadOrStore(name, rl.limitersMap); loaded {
-		rl.limitersMap = val.(*rateLimitersMap)
+	limiter, ok := rlm.get(key)
+	if !ok {
+		return maxEvents > 0, maxEvents, 0
 	}
-	rl.limitersMap.updateAll(rl.MaxEvents, time.Duration(rl.Window))
 
-	return nil
+	ref := now()
+	count, oldest := limiter.Count(ref)
+	remaining = max(limiter.MaxEvents()-count, 0)
+	if remaining > 0 {
+		return true, remaining, 0
+	}
+	if count > 0 {
+		wait = oldest.Add(window).Sub(ref)
+	}
+	return false, 0, wait
 }
 
-type rateLimitersMap struct {
-	limiters   map[string]*ringBufferRateLimiter
-	limitersMu sync.Mutex
+// delete removes the rate limiter for key, if it exists, and any
+// backoff, distinct values, method events, counted idempotency keys and
+// sessions, retry streak, lockout streak and first event allowed by the
+// first-seen filter of key, so that the next event for that key starts
+// with a fresh state. Its ban and usage history are kept. It returns
+// true if any was removed.
+func (rlm *rateLimitersMap) delete(key string) bool {
+	rlm.limitersMu.Lock()
+	_, usedValues := rlm.distinctValues[key]
+	delete(rlm.distinctValues, key)
+	_, retrying := rlm.retryStreaks[key]
+	delete(rlm.retryStreaks, key)
+	_, lockedOut := rlm.lockouts[key]
+	delete(rlm.lockouts, key)
+	retries := len(rlm.idempotent)
+	maps.DeleteFunc(rlm.idempotent, func(req idempotentRequest, _ time.Time) bool { return req.key == key })
+	retried := len(rlm.idempotent) < retries
+	sessions := len(rlm.sessions)
+	maps.DeleteFunc(rlm.sessions, func(ks keySession, _ time.Time) bool { return ks.key == key })
+	inSession := len(rlm.sessions) < sessions
+	rlm.limitersMu.Unlock()
+	removed := usedValues || retried || inSession || retrying || lockedOut
+	if methods := rlm.methods.Load(); methods != nil {
+		for _, limiters := range *methods {
+			removed = limiters.delete(key) || removed
+		}
+	}
+	if f := rlm.firstSeen.Load(); f != nil && f.unsettled(key) {
+		f.settle(key)
+		removed = true
+	}
+
+	if al := rlm.algorithm.Load(); al != nil {
+		removed = al.delete(key) || removed
+	}
+
+	shard := rlm.shardFor(key)
+	shard.lock()
+	defer shard.mu.Unlock()
+
+	if _, ok := shard.backoffs[key]; ok {
+		delete(shard.backoffs, key)
+		removed = true
+	}
+	if !shard.remove(key) {
+		return removed
+	}
+	rlm.keys.Add(-1)
+	return true
 }
 
-func newRateLimiterMap() *rateLimitersMap {
-	var rlm rateLimitersMap
-	rlm.limiters = make(map[string]*ringBufferRateLimiter)
-	return &rlm
+// keysWithPrefix returns the keys of the map's rate limiters and
+// backoffs that start with prefix.
+func (rlm *rateLimitersMap) keysWithPrefix(prefix string) []string {
+	keys := make(map[string]struct{})
+	if al := rlm.algorithm.Load(); al != nil {
+		al.forEach(func(key string, _ Limiter) {
+			if strings.HasPrefix(key, prefix) {
+				keys[key] = struct{}{}
+			}
+		})
+	} else {
+		rlm.forEach(func(key string, _ *ringBufferRateLimiter) {
+			if strings.HasPrefix(key, prefix) {
+				keys[key] = struct{}{}
+			}
+		})
+	}
+
+	for i := range rlm.shards {
+		shard := &rlm.shards[i]
+		shard.lock()
+		for key := range shard.backoffs {
+			if strings.HasPrefix(key, prefix) {
+				keys[key] = struct{}{}
+			}
+		}
+		shard.mu.Unlock()
+	}
+
+	return slices.Sorted(maps.Keys(keys))
 }
 
-// getOrInsert returns an existing rate limiter from the map, or inserts a new
-// one with the desired settings and returns it.
-func (rlm *rateLimitersMap) getOrInsert(key string, maxEvents int, window time.Duration) *ringBufferRateLimiter {
+// reset removes all rate limiters, backoffs, distinct values, method
+// events, counted idempotency keys and sessions, retry streaks, lockout
+// streaks and keys of the first-seen filter in the map, so that every
+// key starts with a fresh state. Bans are not lifted, and the usage
+// history is kept, since it reports what happened before the reset.
+func (rlm *rateLimitersMap) reset() {
+	for i := range rlm.shards {
+		shard := &rlm.shards[i]
+		shard.lock()
+		rlm.keys.Add(-int64(len(shard.limiters)))
+		clear(shard.limiters)
+		shard.recency.Init()
+		clear(shard.backoffs)
+		shard.mu.Unlock()
+	}
+
+	if al := rlm.algorithm.Load(); al != nil {
+		al.reset()
+	}
+	if methods := rlm.methods.Load(); methods != nil {
+		for _, limiters := range *methods {
+			limiters.reset()
+		}
+	}
+	if f := rlm.firstSeen.Load(); f != nil {
+		f.reset()
+	}
+
+	rlm.limitersMu.Lock()
+	clear(rlm.distinctValues)
+	clear(rlm.idempotent)
+	clear(rlm.sessions)
+	clear(rlm.retryStreaks)
+	clear(rlm.lockouts)
+	window := time.Duration(rlm.window.Load())
+	if total := rlm.total.Load(); total != nil {
+		rlm.total.Store(newRingBufferRateLimiter(total.MaxEvents(), window))
+	}
+	for _, quota := range rlm.byteQuotas() {
+		if q := quota.Load(); q != nil {
+			quota.Store(newByteQuota(q.max, window))
+		}
+	}
+	rlm.limitersMu.Unlock()
+}
+
+// len returns the number of rate limiters in the map.
+func (rlm *rateLimitersMap) len() int {
+	if al := rlm.algorithm.Load(); al != nil {
+		return al.len()
+	}
+	return int(rlm.keys.Load())
+}
+
+// setEventEmitter sets the function through which events about the
+// zone are emitted, replacing the previous one (e.g. after a config
+// reload).
+func (rlm *rateLimitersMap) setEventEmitter(emit func(name string, data map[string]any)) {
 	rlm.limitersMu.Lock()
 	defer rlm.limitersMu.Unlock()
+	rlm.emit = emit
+}
+
+// emitEvent emits an event about the zone, if an emitter is set.
+func (rlm *rateLimitersMap) emitEvent(name string, data map[string]any) {
+	rlm.limitersMu.Lock()
+	emit := rlm.emit
+	rlm.limitersMu.Unlock()
+
+	if emit != nil {
+		emit(name, data)
+	}
+}
 
-	rateLimiter, ok := rlm.limiters[key]
+// ban places key in the penalty box until the given time. Events
+// for a banned key are declined regardless of its rate limiter.
+func (rlm *rateLimitersMap) ban(key string, until time.Time) {
+	shard := rlm.shardFor(key)
+	shard.lock()
+	defer shard.mu.Unlock()
+
+	// a ban of a key that is still banned extends it
+	if current, ok := shard.bans[key]; ok && !current.After(now()) {
+		shard.endBan(key, current)
+	}
+	if _, ok := shard.bannedSince[key]; !ok {
+		shard.bannedSince[key] = now()
+	}
+	shard.bans[key] = until
+}
+
+// endBan removes key from the penalty box, remembering how long it was
+// banned if it ended at the given time.
+func (shard *limiterShard) endBan(key string, end time.Time) {
+	if since, ok := shard.bannedSince[key]; ok {
+		shard.servedBans = append(shard.servedBans, max(end.Sub(since), 0))
+	}
+	delete(shard.bans, key)
+	delete(shard.bannedSince, key)
+}
+
+// takeServedBans returns how long the bans that ended since the last
+// call lasted.
+func (rlm *rateLimitersMap) takeServedBans() []time.Duration {
+	var served []time.Duration
+	for i := range rlm.shards {
+		shard := &rlm.shards[i]
+		shard.lock()
+		served = append(served, shard.servedBans...)
+		shard.servedBans = nil
+		shard.mu.Unlock()
+	}
+	return served
+}
+
+// unban removes key from the penalty box. It returns true if the
+// key was banned.
+func (rlm *rateLimitersMap) unban(key string) bool {
+	shard := rlm.shardFor(key)
+	shard.lock()
+	defer shard.mu.Unlock()
+
+	until, ok := shard.bans[key]
 	if !ok {
-		newRateLimiter := newRingBufferRateLimiter(maxEvents, window)
-		rlm.limiters[key] = newRateLimiter
-		return newRateLimiter
+		return false
 	}
-	return rateLimiter
+	end := now()
+	if until.Before(end) {
+		end = until
+	}
+	shard.endBan(key, end)
+	return until.After(now())
 }
 
-// updateAll updates existing rate limiters with new settings.
-func (rlm *rateLimitersMap) updateAll(maxEvents int, window time.Duration) {
+// banned returns how long key remains in the penalty box, by its own
+// ban or that of a prefix, or zero if it is not banned.
+func (rlm *rateLimitersMap) banned(key string) time.Duration {
+	wait := rlm.prefixBanned(key)
+
+	shard := rlm.shardFor(key)
+	shard.lock()
+	defer shard.mu.Unlock()
+
+	until, ok := shard.bans[key]
+	if !ok {
+		return wait
+	}
+	return max(until.Sub(now()), wait)
+}
+
+// banPrefix places all keys that start with prefix in the penalty box
+// until the given time, including keys that the zone hasn't seen yet.
+// A ban of a prefix that is already banned replaces it.
+func (rlm *rateLimitersMap) banPrefix(prefix string, until time.Time) {
 	rlm.limitersMu.Lock()
 	defer rlm.limitersMu.Unlock()
 
-	for _, limiter := range rlm.limiters {
-		limiter.SetMaxEvents(maxEvents)
-		limiter.SetWindow(time.Duration(window))
+	bans := map[string]time.Time{}
+	if current := rlm.prefixBans.Load(); current != nil {
+		maps.Copy(bans, *current)
 	}
+	bans[prefix] = until
+	rlm.prefixBans.Store(&bans)
+}
+
+// unbanPrefixes lifts the bans of all prefixes that start with prefix,
+// and returns how many were still active.
+func (rlm *rateLimitersMap) unbanPrefixes(prefix string) int {
+	return rlm.dropPrefixBans(func(banned string, _ time.Time) bool {
+		return strings.HasPrefix(banned, prefix)
+	})
 }
 
-// sweep cleans up expired rate limit states.
-func (rlm *rateLimitersMap) sweep() {
+// dropPrefixBans lifts the bans of the prefixes for which drop returns
+// true, and returns how many of them were still active.
+func (rlm *rateLimitersMap) dropPrefixBans(drop func(prefix string, until time.Time) bool) int {
 	rlm.limitersMu.Lock()
 	defer rlm.limitersMu.Unlock()
 
-	for key, rl := range rlm.limiters {
-		func(rl *ringBufferRateLimiter) {
-			rl.mu.Lock()
-			defer rl.mu.Unlock()
+	current := rlm.prefixBans.Load()
+	if current == nil {
+		return 0
+	}
+	var active int
+	bans := maps.Clone(*current)
+	maps.DeleteFunc(bans, func(prefix string, until time.Time) bool {
+		if !drop(prefix, until) {
+			return false
+		}
+		if until.After(now()) {
+			active++
+		}
+		return true
+	})
+	if len(bans) == len(*current) {
+		return 0
+	}
+	if len(bans) == 0 {
+		rlm.prefixBans.Store(nil)
+	} else {
+		rlm.prefixBans.Store(&bans)
+	}
+	return active
+}
+
+// prefixBanned returns how long the longest ban of a prefix of key
+// lasts, or zero if there is none.
+func (rlm *rateLimitersMap) prefixBanned(key string) time.Duration {
+	bans := rlm.prefixBans.Load()
+	if bans == nil {
+		return 0
+	}
+	var wait time.Duration
+	for prefix, until := range *bans {
+		if strings.HasPrefix(key, prefix) {
+			wait = max(wait, until.Sub(now()))
+		}
+	}
+	return wait
+}
 
-			// no point in keeping a ring buffer of size 0 around
-			if len(rl.ring) == 0 {
-				delete(rlm.limiters, key)
-				return
+// activePrefixBans returns all prefixes that are currently banned,
+// mapped to when their ban expires.
+func (rlm *rateLimitersMap) activePrefixBans() map[string]time.Time {
+	bans := make(map[string]time.Time)
+	if current := rlm.prefixBans.Load(); current != nil {
+		for prefix, until := range *current {
+			if until.After(now()) {
+				bans[prefix] = until
 			}
+		}
+	}
+	return bans
+}
+
+// backOff declines events for key until the given time, unless they
+// are already declined for longer, because an upstream asked for it or
+// the key is cooling down after a decline. Unlike bans, backoffs don't
+// emit events.
+func (rlm *rateLimitersMap) backOff(key string, until time.Time) {
+	shard := rlm.shardFor(key)
+	shard.lock()
+	defer shard.mu.Unlock()
+	if until.After(shard.backoffs[key]) {
+		shard.backoffs[key] = until
+	}
+}
+
+// backedOff returns how long key has to back off, or zero if it
+// doesn't.
+func (rlm *rateLimitersMap) backedOff(key string) time.Duration {
+	shard := rlm.shardFor(key)
+	shard.lock()
+	defer shard.mu.Unlock()
+
+	until, ok := shard.backoffs[key]
+	if !ok {
+		return 0
+	}
+	return max(until.Sub(now()), 0)
+}
+
+// idempotentRequest identifies the retries of a request of a key.
+type idempotentRequest struct {
+	key, idempotencyKey string
+}
 
-			// get newest event in ring (should come right before oldest)
-			cursorNewest := rl.cursor - 1
-			if cursorNewest < 0 {
-				cursorNewest = len(rl.ring) - 1
+// maxIdempotencyKeyLength is the maximum length of the idempotency keys
+// that are remembered.
+const maxIdempotencyKeyLength = 255
+
+// retried returns true if a request of key with the idempotency key was
+// counted within the zone's idempotency window.
+func (rlm *rateLimitersMap) retried(key, idempotencyKey string) bool {
+	rlm.limitersMu.Lock()
+	defer rlm.limitersMu.Unlock()
+	until, ok := rlm.idempotent[idempotentRequest{key, idempotencyKey}]
+	return ok && until.After(now())
+}
+
+// counted remembers that a request of key with the idempotency key was
+// counted, so that its retries until the given time are not.
+func (rlm *rateLimitersMap) counted(key, idempotencyKey string, until time.Time) {
+	rlm.limitersMu.Lock()
+	defer rlm.limitersMu.Unlock()
+	rlm.idempotent[idempotentRequest{key, idempotencyKey}] = until
+}
+
+// countOncePerConnection is the CountOncePer of zones that count each
+// client connection once.
+const countOncePerConnection = "connection"
+
+// keySession identifies a connection or session of a key.
+type keySession struct {
+	key, session string
+}
+
+// sessionCounted returns true if the connection or session of key was
+// counted and hasn't been forgotten, in which case it is remembered
+// until the given time.
+func (rlm *rateLimitersMap) sessionCounted(key, session string, until time.Time) bool {
+	rlm.limitersMu.Lock()
+	defer rlm.limitersMu.Unlock()
+	ks := keySession{key, session}
+	if expires, ok := rlm.sessions[ks]; !ok || !expires.After(now()) {
+		return false
+	}
+	rlm.sessions[ks] = until
+	return true
+}
+
+// countSession remembers that the connection or session of key was
+// counted, so that its requests until the given time are not.
+func (rlm *rateLimitersMap) countSession(key, session string, until time.Time) {
+	rlm.limitersMu.Lock()
+	defer rlm.limitersMu.Unlock()
+	rlm.sessions[keySession{key, session}] = until
+}
+
+// activeBans returns all keys that are currently banned, mapped
+// to when their ban expires.
+func (rlm *rateLimitersMap) activeBans() map[string]time.Time {
+	bans := make(map[string]time.Time)
+	for i := range rlm.shards {
+		shard := &rlm.shards[i]
+		shard.lock()
+		for key, until := range shard.bans {
+			if until.After(now()) {
+				bans[key] = until
 			}
-			newest := rl.ring[cursorNewest]
-			window := rl.window
+		}
+		shard.mu.Unlock()
+	}
+	return bans
+}
+
+// limits returns the zone's current maximum number of events, scaled
+// by its clamp if any, and window duration.
+func (rlm *rateLimitersMap) limits() (int, time.Duration) {
+	return int(rlm.maxEvents.Load()), time.Duration(rlm.window.Load())
+}
+
+// configuredLimits returns the zone's maximum number of events before it
+// is scaled, and window duration.
+func (rlm *rateLimitersMap) configuredLimits() (int, time.Duration) {
+	return int(rlm.configuredMaxEvents.Load()), time.Duration(rlm.window.Load())
+}
+
+// updateAll updates the zone's limits and all existing rate
+// limiters with new settings.
+func (rlm *rateLimitersMap) updateAll(maxEvents int, window time.Duration) {
+	rlm.limitersMu.Lock()
+	rlm.configuredMaxEvents.Store(int64(maxEvents))
+	maxEvents = rlm.clamped(maxEvents)
+	rlm.maxEvents.Store(int64(maxEvents))
+	rlm.window.Store(int64(window))
+	if total := rlm.total.Load(); total != nil {
+		total.SetMaxEvents(rlm.clamped(rlm.totalMaxEvents))
+		total.SetWindow(window)
+	}
+	for _, quota := range rlm.byteQuotas() {
+		if q := quota.Load(); q != nil {
+			q.set(q.max, window)
+		}
+	}
+	rlm.limitersMu.Unlock()
+
+	if f := rlm.firstSeen.Load(); f != nil {
+		f.setLimits(maxEvents, window)
+	}
+	if al := rlm.algorithm.Load(); al != nil {
+		al.setLimits(maxEvents, window)
+	}
+	for i := range rlm.shards {
+		shard := &rlm.shards[i]
+		shard.lock()
+		for _, entry := range shard.limiters {
+			entry.limiter.SetMaxEvents(maxEvents)
+			entry.limiter.SetWindow(window)
+		}
+		shard.mu.Unlock()
+	}
+}
 
-			// if newest event in memory is outside the window,
-			// the entire ring has expired and can be forgotten
-			if newest.Add(window).Before(now()) {
-				delete(rlm.limiters, key)
+// sweep cleans up expired rate limit states and bans. It returns
+// the keys whose ban expired and the number of expired rate limiters
+// that were removed.
+func (rlm *rateLimitersMap) sweep() (unbanned []string, expired int) {
+	start := time.Now()
+	defer func() {
+		rlm.sweeps.Add(1)
+		rlm.sweepDuration.Store(int64(time.Since(start)))
+	}()
+
+	for i := range rlm.shards {
+		shard := &rlm.shards[i]
+		shard.lock()
+		for key, until := range shard.bans {
+			if !until.After(now()) {
+				shard.endBan(key, until)
+				unbanned = append(unbanned, key)
+			}
+		}
+		for key, until := range shard.backoffs {
+			if !until.After(now()) {
+				delete(shard.backoffs, key)
 			}
-		}(rl)
+		}
+		shard.mu.Unlock()
+	}
+	rlm.dropPrefixBans(func(_ string, until time.Time) bool { return !until.After(now()) })
+
+	rlm.limitersMu.Lock()
+	for req, until := range rlm.idempotent {
+		if !until.After(now()) {
+			delete(rlm.idempotent, req)
+		}
+	}
+	for session, until := range rlm.sessions {
+		if !until.After(now()) {
+			delete(rlm.sessions, session)
+		}
+	}
+	for key, streak := range rlm.retryStreaks {
+		if !streak.expires.After(now()) {
+			delete(rlm.retryStreaks, key)
+		}
+	}
+	for key, streak := range rlm.lockouts {
+		if !streak.expires.After(now()) {
+			delete(rlm.lockouts, key)
+		}
+	}
+	rlm.sweepDistinct()
+	rlm.limitersMu.Unlock()
+
+	rlm.sweepUsage()
+
+	// rate limiters retired before the previous sweep have been out
+	// of the map for a whole sweep interval, so they can be reused,
+	// unless a request still holds them; those wait for another sweep
+	rlm.retiredMu.Lock()
+	for _, rl := range rlm.retired {
+		if rl.held() {
+			rlm.retiring = append(rlm.retiring, rl)
+			continue
+		}
+		rl.release()
+	}
+	clear(rlm.retired)
+	rlm.retired, rlm.retiring = rlm.retiring, rlm.retired[:0]
+	rlm.retiredMu.Unlock()
+
+	for _, quota := range rlm.byteQuotas() {
+		if q := quota.Load(); q != nil {
+			q.sweep(now())
+		}
+	}
+	if methods := rlm.methods.Load(); methods != nil {
+		for _, limiters := range *methods {
+			limiters.sweep()
+		}
+	}
+
+	for i := range rlm.shards {
+		expired += rlm.shards[i].sweep(rlm)
+	}
+	rlm.keys.Add(-int64(expired))
+	if al := rlm.algorithm.Load(); al != nil {
+		expired += al.sweep(now())
+	}
+
+	return unbanned, expired
+}
+
+// sweep removes expired rate limiters from the shard, retires
+// them in rlm and returns how many were removed. Unlike other
+// methods of the shard, it locks the shard itself.
+func (shard *limiterShard) sweep(rlm *rateLimitersMap) int {
+	shard.lock()
+	defer shard.mu.Unlock()
+
+	var expired int
+	for key, entry := range shard.limiters {
+		// if the newest event in memory is outside the window (or
+		// there is no room for events at all), the entire ring has
+		// expired and can be forgotten, unless its retention is set
+		if rlm.idle(entry.limiter, now()) {
+			shard.remove(key)
+			rlm.retire(entry.limiter)
+			expired++
+		}
+	}
+	return expired
+}
+
+// idle returns true if the state of rl can be dropped at ref; see
+// RateLimit.IdleTTL.
+func (rlm *rateLimitersMap) idle(rl *ringBufferRateLimiter, ref time.Time) bool {
+	if ttl := time.Duration(rlm.idleTTL.Load()); ttl > 0 {
+		return rl.idle(ref, ttl)
+	}
+	return rl.expired(ref)
+}
+
+// maxRetired is the maximum number of rate limiters per zone that are
+// kept for reuse between sweeps; any more are left to the garbage
+// collector, so that floods of keys don't hold on to extra memory.
+const maxRetired = 1024
+
+// retire schedules rl, which was removed from the map, to be reused
+// for new keys. A request that looked up rl just before it was removed
+// may still be using it, so rl is only released to the pool by the
+// second sweep after it was retired, and only once no request holds it
+// (see ringBufferRateLimiter.hold), however long the sweep interval is.
+func (rlm *rateLimitersMap) retire(rl *ringBufferRateLimiter) {
+	rlm.retiredMu.Lock()
+	if len(rlm.retiring) < maxRetired {
+		rlm.retiring = append(rlm.retiring, rl)
+	}
+	rlm.retiredMu.Unlock()
+}
+
+// forEach calls fn for every rate limiter in the map, one shard at
+// a time, while holding that shard's lock.
+func (rlm *rateLimitersMap) forEach(fn func(key string, rl *ringBufferRateLimiter)) {
+	for i := range rlm.shards {
+		shard := &rlm.shards[i]
+		shard.lock()
+		for key, entry := range shard.limiters {
+			fn(key, entry.limiter)
+		}
+		shard.mu.Unlock()
 	}
 }
 
+// keysPerHost returns the number of keys per host of a zone whose keys
+// are namespaced by host; see RateLimit.IsolateByHost.
+func (rlm *rateLimitersMap) keysPerHost() map[string]int {
+	counts := make(map[string]int)
+	rlm.forEach(func(key string, _ *ringBufferRateLimiter) {
+		host, _, _ := strings.Cut(key, "/")
+		counts[host]++
+	})
+	return counts
+}
+
+// minRemaining returns the lowest number of events left in the window
+// of any rate limiter in the map. Without rate limiters, it is the
+// zone's maximum number of events.
+func (rlm *rateLimitersMap) minRemaining() int {
+	lowest, _ := rlm.limits()
+
+	ref := now()
+	rlm.forEach(func(_ string, rl *ringBufferRateLimiter) {
+		count, _ := rl.Count(ref)
+		lowest = min(lowest, max(rl.MaxEvents()-count, 0))
+	})
+	return lowest
+}
+
+// memoryUsage returns the approximate number of bytes used by the
+// rate limiters in the map: their keys, the limiters themselves and
+// their ring buffers. Overhead of the map itself is not included.
+func (rlm *rateLimitersMap) memoryUsage() int {
+	var bytes int
+	rlm.forEach(func(key string, rl *ringBufferRateLimiter) {
+		bytes += len(key) + int(unsafe.Sizeof(limiterEntry{})) + int(unsafe.Sizeof(list.Element{})) +
+			int(unsafe.Sizeof(*rl)) + int(unsafe.Sizeof(eventRing{})) + rl.MaxEvents()*int(unsafe.Sizeof(eventSlot{}))
+	})
+	return bytes
+}
+
 // rlStateForZone returns the state of all rate limiters in the map.
 func (rlm *rateLimitersMap) rlStateForZone(timestamp time.Time) map[string]rlStateValue {
 	state := make(map[string]rlStateValue)
 
-	rlm.limitersMu.Lock()
-	defer rlm.limitersMu.Unlock()
-	for key, rl := range rlm.limiters {
+	rlm.forEach(func(key string, rl *ringBufferRateLimiter) {
 		count, oldestEvent := rl.Count(timestamp)
 		state[key] = rlStateValue{
 			Count:       count,
 			OldestEvent: oldestEvent,
 		}
-	}
+	})
 
 	return state
 }
+
+// zoneLimiters returns the rate limiters of the zone with the
+// given name, if the zone exists. caddy.UsagePool has no lookup that
+// leaves the reference count unchanged, so the pool is scanned instead.
+func zoneLimiters(zoneName string) (*rateLimitersMap, bool) {
+	var rlm *rateLimitersMap
+	rateLimits.Range(func(key, value interface{}) bool {
+		if key.(string) == zoneName {
+			rlm = value.(*rateLimitersMap)
+			return false
+		}
+		return true
+	})
+	return rlm, rlm != nil
+}
@@ -0,0 +1,966 @@
+package caddyrl
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestMinRemaining(t *testing.T) {
+	initTime()
+
+	rlm := newRateLimiterMap()
+	rlm.updateAll(5, time.Minute)
+	if remaining := rlm.minRemaining(); remaining != 5 {
+		t.Fatalf("empty zone should have full budget, got %d", remaining)
+	}
+
+	for i := 0; i < 3; i++ {
+		rlm.getOrInsert("busy").When()
+	}
+	rlm.getOrInsert("idle").When()
+	if remaining := rlm.minRemaining(); remaining != 2 {
+		t.Fatalf("expected lowest remaining budget of 2, got %d", remaining)
+	}
+
+	advanceTime(61)
+	if remaining := rlm.minRemaining(); remaining != 5 {
+		t.Fatalf("expired events should not count, got %d", remaining)
+	}
+}
+
+func TestMemoryUsage(t *testing.T) {
+	initTime()
+
+	rlm := newRateLimiterMap()
+	rlm.updateAll(10, time.Minute)
+	if bytes := rlm.memoryUsage(); bytes != 0 {
+		t.Fatalf("empty zone should use no memory, got %d bytes", bytes)
+	}
+
+	rlm.getOrInsert("a").When()
+	one := rlm.memoryUsage()
+	if one <= 0 {
+		t.Fatalf("expected positive memory usage, got %d", one)
+	}
+
+	rlm.getOrInsert("b").When()
+	if two := rlm.memoryUsage(); two != 2*one {
+		t.Fatalf("expected memory usage to grow with keys: %d (wanted %d)", two, 2*one)
+	}
+
+	rlm.updateAll(20, time.Minute)
+	if bigger := rlm.memoryUsage(); bigger <= 2*one {
+		t.Fatalf("expected memory usage to grow with ring size, got %d", bigger)
+	}
+}
+
+func TestSweepCountsExpired(t *testing.T) {
+	initTime()
+
+	rlm := newRateLimiterMap()
+	rlm.updateAll(5, time.Minute)
+	rlm.getOrInsert("old").When()
+	rlm.ban("banned", now().Add(30*time.Second))
+
+	advanceTime(45)
+	rlm.getOrInsert("new").When()
+
+	unbanned, expired := rlm.sweep()
+	if len(unbanned) != 1 || unbanned[0] != "banned" {
+		t.Fatalf("expected ban of 'banned' to expire, got %v", unbanned)
+	}
+	if expired != 0 {
+		t.Fatalf("expected no expired keys yet, got %d", expired)
+	}
+
+	advanceTime(90)
+	if _, expired := rlm.sweep(); expired != 1 {
+		t.Fatalf("expected 1 expired key, got %d", expired)
+	}
+	if _, ok := rlm.get("new"); !ok {
+		t.Fatal("key with events in the window should not be removed")
+	}
+}
+
+func TestServedBans(t *testing.T) {
+	initTime()
+
+	rlm := newRateLimiterMap()
+	rlm.ban("expires", now().Add(30*time.Second))
+	rlm.ban("extended", now().Add(30*time.Second))
+	rlm.ban("lifted", now().Add(time.Hour))
+
+	advanceTime(20)
+	rlm.ban("extended", now().Add(time.Minute))
+	if !rlm.unban("lifted") {
+		t.Fatal("expected 'lifted' to be banned")
+	}
+
+	advanceTime(45)
+	rlm.sweep()
+	served := rlm.takeServedBans()
+	slices.Sort(served)
+	if !slices.Equal(served, []time.Duration{20 * time.Second, 30 * time.Second}) {
+		t.Fatalf("expected the lifted and expired bans to be served, got %v", served)
+	}
+	if served := rlm.takeServedBans(); len(served) != 0 {
+		t.Fatalf("expected served bans to be taken once, got %v", served)
+	}
+
+	advanceTime(90)
+	rlm.sweep()
+	if served := rlm.takeServedBans(); !slices.Equal(served, []time.Duration{80 * time.Second}) {
+		t.Fatalf("expected the extended ban to be served once in full, got %v", served)
+	}
+}
+
+func TestSweepIdleTTL(t *testing.T) {
+	initTime()
+
+	rlm := newRateLimiterMap()
+	rlm.updateAll(5, time.Hour)
+	rlm.idleTTL.Store(int64(time.Minute))
+	rlm.getOrInsert("idle").When()
+	rlm.getOrInsert("active").When()
+
+	// a shorter TTL drops keys whose events are still in the window
+	advanceTime(30)
+	rlm.getOrInsert("active").When()
+	advanceTime(61)
+	if _, expired := rlm.sweep(); expired != 1 {
+		t.Fatalf("expected the idle key to be dropped, got %d", expired)
+	}
+	if _, ok := rlm.get("active"); !ok {
+		t.Fatal("expected the key with a recent event to be kept")
+	}
+
+	// a longer TTL keeps keys whose events have left the window
+	rlm.updateAll(5, time.Second)
+	rlm.idleTTL.Store(int64(time.Hour))
+	advanceTime(3600)
+	if _, expired := rlm.sweep(); expired != 0 {
+		t.Fatalf("expected the key to be kept for the TTL, got %d dropped", expired)
+	}
+	advanceTime(3631)
+	if _, expired := rlm.sweep(); expired != 1 {
+		t.Fatalf("expected the key to be dropped after the TTL, got %d", expired)
+	}
+
+	zone := &RateLimit{
+		ZoneName:     "idle_ttl_algorithm_zone",
+		MaxEvents:    5,
+		Window:       caddy.Duration(time.Minute),
+		IdleTTL:      caddy.Duration(time.Hour),
+		AlgorithmRaw: json.RawMessage(`{"name": "count_min_sketch"}`),
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: t.Context()})
+	defer cancel()
+	if err := zone.provision(ctx, zone.ZoneName); err == nil {
+		t.Error("expected an idle TTL to require the sliding window")
+	}
+}
+
+func TestMaxKeysEviction(t *testing.T) {
+	initTime()
+
+	// with a single shard, eviction order is exact
+	rlm := newShardedRateLimiterMap(1)
+	rlm.updateAll(5, time.Minute)
+	rlm.setMaxKeys(2)
+
+	rlm.getOrInsert("a").When()
+	rlm.getOrInsert("b").When()
+	rlm.getOrInsert("a").When() // a is now more recently used than b
+	rlm.getOrInsert("c").When()
+
+	if n := rlm.len(); n != 2 {
+		t.Fatalf("expected 2 keys, got %d", n)
+	}
+	if _, ok := rlm.get("b"); ok {
+		t.Fatal("least recently used key should have been evicted")
+	}
+	if _, ok := rlm.get("a"); !ok {
+		t.Fatal("recently used key should be kept")
+	}
+	if n := rlm.takeEvictions(); n != 1 {
+		t.Fatalf("expected 1 eviction, got %d", n)
+	}
+	if n := rlm.takeEvictions(); n != 0 {
+		t.Fatalf("expected evictions to be reset, got %d", n)
+	}
+
+	rlm.delete("a")
+	rlm.getOrInsert("d")
+	if n := rlm.takeEvictions(); n != 0 {
+		t.Fatalf("expected no eviction after a key was deleted, got %d", n)
+	}
+
+	// without a limit, nothing is evicted
+	rlm.setMaxKeys(0)
+	for i := range 10 {
+		rlm.getOrInsert(strconv.Itoa(i))
+	}
+	if n := rlm.len(); n != 12 {
+		t.Fatalf("expected 12 keys, got %d", n)
+	}
+}
+
+func TestTrimToMemoryBudget(t *testing.T) {
+	initTime()
+
+	big := newRateLimiterMap()
+	big.updateAll(10, time.Minute)
+	small := newRateLimiterMap()
+	small.updateAll(10, time.Minute)
+	// keys of equal length use equal amounts of memory
+	for i := range 300 {
+		big.getOrInsert(fmt.Sprintf("%03d", i))
+		if i < 100 {
+			small.getOrInsert(fmt.Sprintf("%03d", i))
+		}
+	}
+	zones := []*rateLimitersMap{big, small}
+
+	total := int64(big.memoryUsage() + small.memoryUsage())
+	if evicted := trimToMemoryBudget(zones, total); evicted != 0 {
+		t.Fatalf("expected no evictions within budget, got %d", evicted)
+	}
+
+	// halving the budget should evict about half of each zone
+	trimToMemoryBudget(zones, total/2)
+	if used := int64(big.memoryUsage() + small.memoryUsage()); used > total/2 {
+		t.Fatalf("expected at most %d bytes after trimming, got %d", total/2, used)
+	}
+	if n := big.len(); n < 140 || n > 150 {
+		t.Fatalf("expected about 150 keys left in big zone, got %d", n)
+	}
+	if n := small.len(); n < 40 || n > 50 {
+		t.Fatalf("expected about 50 keys left in small zone, got %d", n)
+	}
+	if n := big.takeEvictions() + small.takeEvictions(); n != 400-big.len()-small.len() {
+		t.Fatalf("evictions were not counted: %d", n)
+	}
+}
+
+func TestRetiredLimiters(t *testing.T) {
+	initTime()
+
+	rlm := newShardedRateLimiterMap(1)
+	rlm.updateAll(5, time.Minute)
+	rlm.setMaxKeys(1)
+	rlm.getOrInsert("a").When()
+	rlm.getOrInsert("b").When() // evicts a
+
+	// a request may still be using a, so it must not be released yet
+	rlm.sweep()
+	if len(rlm.retired) != 1 {
+		t.Fatalf("expected evicted limiter to wait a sweep before release, got %d retired", len(rlm.retired))
+	}
+	rlm.sweep()
+	if len(rlm.retired) != 0 || len(rlm.retiring) != 0 {
+		t.Fatalf("expected retired limiters to be released, got %d retired and %d retiring",
+			len(rlm.retired), len(rlm.retiring))
+	}
+
+	// limiters that a request holds are kept until it ends the hold
+	held := rlm.getOrInsert("b")
+	held.hold()
+	rlm.getOrInsert("c").When() // evicts b
+	rlm.sweep()
+	rlm.sweep()
+	rlm.sweep()
+	if len(rlm.retired) != 1 {
+		t.Fatalf("expected the held limiter to be kept, got %d retired", len(rlm.retired))
+	}
+	held.unhold()
+	rlm.sweep()
+	if len(rlm.retired) != 0 || len(rlm.retiring) != 0 {
+		t.Fatalf("expected the limiter to be released once it isn't held, got %d retired and %d retiring",
+			len(rlm.retired), len(rlm.retiring))
+	}
+}
+
+func TestShardedMap(t *testing.T) {
+	initTime()
+
+	rlm := newShardedRateLimiterMap(4)
+	rlm.updateAll(1, time.Minute)
+	for i := 0; i < 100; i++ {
+		rlm.getOrInsert(strconv.Itoa(i)).When()
+	}
+	if n := rlm.len(); n != 100 {
+		t.Fatalf("expected 100 keys, got %d", n)
+	}
+	for i := range rlm.shards {
+		if len(rlm.shards[i].limiters) == 0 {
+			t.Fatalf("expected keys to be spread across shards, but shard %d is empty", i)
+		}
+	}
+
+	// limits changes must reach rate limiters in every shard
+	rlm.updateAll(2, time.Minute)
+	rlm.forEach(func(key string, rl *ringBufferRateLimiter) {
+		if rl.MaxEvents() != 2 {
+			t.Fatalf("rate limiter for key %s was not updated", key)
+		}
+	})
+
+	rlm.reset()
+	if n := rlm.len(); n != 0 {
+		t.Fatalf("expected no keys after reset, got %d", n)
+	}
+}
+
+// BenchmarkRateLimitersMap compares a single shard (one lock per zone)
+// with the default number of shards under concurrent requests for many
+// keys; run it with -cpu to see how contention scales.
+func BenchmarkRateLimitersMap(b *testing.B) {
+	keys := make([]string, 4096)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+	}
+
+	for _, bm := range []struct {
+		name string
+		rlm  *rateLimitersMap
+	}{
+		{"shards=1", newShardedRateLimiterMap(1)},
+		{"shards=default", newRateLimiterMap()},
+	} {
+		bm.rlm.updateAll(100, time.Minute)
+		b.Run(bm.name, func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				i := rand.IntN(len(keys))
+				for pb.Next() {
+					bm.rlm.getOrInsert(keys[i%len(keys)]).When()
+					i++
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkKeyChurn measures allocations when every request is for a new
+// key, such as during a flood of spoofed IP addresses, so that rate limiters
+// are constantly evicted and replaced.
+func BenchmarkKeyChurn(b *testing.B) {
+	keys := make([]string, 1<<16)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+	}
+
+	rlm := newRateLimiterMap()
+	rlm.updateAll(100, time.Minute)
+	rlm.setMaxKeys(1000)
+
+	b.ReportAllocs()
+	i := 0
+	for b.Loop() {
+		rlm.getOrInsert(keys[i%len(keys)]).When()
+		i++
+		if i%1000 == 0 {
+			rlm.sweep()
+		}
+	}
+}
+
+func TestInheritPolicy(t *testing.T) {
+	includeKey := true
+	policy := &RateLimit{
+		Key:               "{http.request.remote.host}",
+		Window:            caddy.Duration(time.Minute),
+		MaxEvents:         100,
+		MetricsIncludeKey: &includeKey,
+		DeclineLog:        &DeclineLog{SampleRate: 0.5},
+	}
+
+	zone := &RateLimit{ZoneName: "login", MaxEvents: 10}
+	zone.inherit(policy)
+	if zone.Key != policy.Key || zone.Window != policy.Window || zone.MetricsIncludeKey != &includeKey {
+		t.Fatalf("unset fields should be inherited: %+v", zone)
+	}
+	if zone.MaxEvents != 10 {
+		t.Fatalf("zone's own max events should be kept, got %d", zone.MaxEvents)
+	}
+	if zone.DeclineLog == policy.DeclineLog || zone.DeclineLog.SampleRate != 0.5 {
+		t.Fatal("decline log should be copied, not shared")
+	}
+}
+
+func TestRenamedZone(t *testing.T) {
+	initTime()
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: t.Context()})
+	defer cancel()
+
+	old := &RateLimit{ZoneName: "renamed_old", Key: "static", MaxEvents: 2, Window: caddy.Duration(time.Minute)}
+	if err := old.provision(ctx, old.ZoneName); err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		if wait := old.limitersMap.whenKey("client"); wait != 0 {
+			t.Fatalf("expected to be allowed, got wait %v", wait)
+		}
+	}
+
+	// the reload provisions the renamed zone before cleaning up the old
+	renamed := &RateLimit{ZoneName: "renamed_new", RenamedFrom: []string{"renamed_old"}, Key: "static", MaxEvents: 2, Window: caddy.Duration(time.Minute)}
+	if err := renamed.provision(ctx, renamed.ZoneName); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _, _ = rateLimits.Delete(renamed.ZoneName) })
+	_, _ = rateLimits.Delete(old.ZoneName)
+	if wait := renamed.limitersMap.whenKey("client"); wait == 0 {
+		t.Error("expected the renamed zone to keep the events of its old name")
+	}
+	if _, ok := zoneLimiters(old.ZoneName); ok {
+		t.Error("expected the old name to be gone after the reload")
+	}
+
+	dynamic := &RateLimit{ZoneName: "{http.request.host}", RenamedFrom: []string{"renamed_old"}, Key: "static", MaxEvents: 2, Window: caddy.Duration(time.Minute)}
+	if err := dynamic.provision(ctx, dynamic.ZoneName); err == nil {
+		t.Error("expected an error for renaming a zone with placeholders")
+	}
+
+	var h Handler
+	if err := h.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`rate_limit {
+		zone api_v1 {
+			renamed_from api v1
+			key    static
+			window 1m
+			events 10
+		}
+	}`)); err != nil {
+		t.Fatalf("unmarshaling Caddyfile: %v", err)
+	}
+	if renamedFrom := h.RateLimits[0].RenamedFrom; len(renamedFrom) != 2 || renamedFrom[0] != "api" || renamedFrom[1] != "v1" {
+		t.Errorf("unexpected old names: %v", renamedFrom)
+	}
+}
+
+func TestIsolateByHost(t *testing.T) {
+	for host, want := range map[string]string{
+		"Tenant.example.com:8443": "tenant.example.com",
+		"tenant.example.com":      "tenant.example.com",
+		"[::1]:80":                "::1",
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Host = host
+		if got := hostOf(r); got != want {
+			t.Errorf("host %q: expected %q, got %q", host, want, got)
+		}
+	}
+
+	rlm := newRateLimiterMap()
+	rlm.updateAll(5, time.Minute)
+	for _, key := range []string{"a.example.com/1", "a.example.com/2", "b.example.com/1"} {
+		rlm.getOrInsert(key)
+	}
+	counts := rlm.keysPerHost()
+	if len(counts) != 2 || counts["a.example.com"] != 2 || counts["b.example.com"] != 1 {
+		t.Fatalf("unexpected keys per host %v", counts)
+	}
+}
+
+func TestTotalMaxEvents(t *testing.T) {
+	initTime()
+
+	rlm := newRateLimiterMap()
+	rlm.updateAll(2, time.Minute)
+	rlm.setTotal(3)
+
+	// each key may have 2 events, but all keys together only 3
+	for _, key := range []string{"a", "a", "b"} {
+		if wait := rlm.when(rlm.getOrInsert(key)); wait > 0 {
+			t.Fatalf("event of key %s should be allowed", key)
+		}
+	}
+	if wait := rlm.when(rlm.getOrInsert("a")); wait != time.Minute {
+		t.Fatalf("key a has reached its limit, expected to wait a minute, got %s", wait)
+	}
+	if wait := rlm.when(rlm.getOrInsert("b")); wait != time.Minute {
+		t.Fatalf("zone has reached its total, expected to wait a minute, got %s", wait)
+	}
+
+	// declined events are not counted against the key or the total
+	if count, _ := rlm.getOrInsert("b").Count(now()); count != 1 {
+		t.Fatalf("expected 1 event of key b, got %d", count)
+	}
+
+	advanceTime(61)
+	if wait := rlm.when(rlm.getOrInsert("c")); wait > 0 {
+		t.Fatal("event should be allowed once the window has passed")
+	}
+
+	rlm.setTotal(0)
+	if rlm.total.Load() != nil {
+		t.Fatal("expected no total limit")
+	}
+}
+
+func TestCountRepeats(t *testing.T) {
+	initTime()
+
+	var zones []*RateLimit
+	for _, countRepeats := range []bool{false, true} {
+		rl := &RateLimit{
+			ZoneName:     fmt.Sprintf("count_repeats_%t", countRepeats),
+			Key:          "static",
+			Window:       caddy.Duration(time.Minute),
+			MaxEvents:    10,
+			CountRepeats: countRepeats,
+		}
+		zones = append(zones, rl)
+	}
+	h := newTestHandler(t, zones...)
+	next := caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error { return nil })
+
+	// the request passes through the handler twice, e.g. through error
+	// routes
+	req := httptest.NewRequest("GET", "/", nil)
+	ctx := context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer())
+	ctx = context.WithValue(ctx, caddyhttp.VarsCtxKey, make(map[string]any))
+	req = req.WithContext(ctx)
+	for range 2 {
+		if err := h.ServeHTTP(httptest.NewRecorder(), req, next); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, expected := range []int{1, 2} {
+		if count, _ := zones[i].limitersMap.getOrInsert("static").Count(now()); count != expected {
+			t.Errorf("zone %s: expected %d events, got %d", zones[i].ZoneName, expected, count)
+		}
+	}
+}
+
+func TestOverloadStatus(t *testing.T) {
+	initTime()
+
+	rl := &RateLimit{
+		ZoneName:       "overload_zone",
+		Key:            "{overload.key}",
+		Window:         caddy.Duration(time.Minute),
+		MaxEvents:      2,
+		TotalMaxEvents: 3,
+		OverloadStatus: http.StatusServiceUnavailable,
+	}
+	h := newTestHandler(t, rl)
+	next := caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error { return nil })
+	status := func(key string) int {
+		t.Helper()
+		req := newTestRequest("GET", "/", map[string]string{"overload.key": key})
+		rec := httptest.NewRecorder()
+		err := h.ServeHTTP(rec, req, next)
+		if err == nil {
+			return http.StatusOK
+		}
+		if !isDeclined(err) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if rec.Header().Get("Retry-After") == "" {
+			t.Error("declined response should have a Retry-After header")
+		}
+		return err.(caddyhttp.HandlerError).StatusCode
+	}
+
+	for _, key := range []string{"a", "a", "b"} {
+		if s := status(key); s != http.StatusOK {
+			t.Fatalf("event of key %s should be allowed, got %d", key, s)
+		}
+	}
+	if s := status("a"); s != http.StatusTooManyRequests {
+		t.Errorf("key a exceeded its own limit, expected 429, got %d", s)
+	}
+	if s := status("b"); s != http.StatusServiceUnavailable {
+		t.Errorf("the zone reached its total, expected 503, got %d", s)
+	}
+
+	// while the zone is clamped, declines are the zone's fault too
+	advanceTime(61)
+	rl.limitersMap.setTotal(0)
+	rl.limitersMap.setClamp(0.5, time.Hour)
+	defer rl.limitersMap.liftClamp(nil)
+	if s := status("c"); s != http.StatusOK {
+		t.Fatalf("first event should be allowed, got %d", s)
+	}
+	if s := status("c"); s != http.StatusServiceUnavailable {
+		t.Errorf("the zone is clamped, expected 503, got %d", s)
+	}
+
+	if isDeclined(caddyhttp.Error(http.StatusServiceUnavailable, nil)) {
+		t.Error("other 503 errors are not declines")
+	}
+	invalid := &RateLimit{Window: caddy.Duration(time.Minute), MaxEvents: 1, OverloadStatus: 200}
+	if err := invalid.provision(caddy.Context{}, "invalid_overload_zone"); err == nil {
+		t.Error("expected an error for a non-error overload status")
+	}
+}
+
+func TestCooldown(t *testing.T) {
+	initTime()
+
+	rl := &RateLimit{
+		ZoneName:  "cooldown_zone",
+		Key:       "static",
+		Window:    caddy.Duration(10 * time.Second),
+		MaxEvents: 1,
+		Cooldown:  caddy.Duration(30 * time.Second),
+	}
+	h := newTestHandler(t, rl)
+	request := func() (bool, string) {
+		t.Helper()
+		req := newTestRequest("GET", "/", nil)
+		rec := httptest.NewRecorder()
+		err := h.limit(rec, req)
+		if err != nil && !isDeclined(err) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return err == nil, rec.Header().Get("Retry-After")
+	}
+
+	if allowed, _ := request(); !allowed {
+		t.Fatal("expected the first request to be allowed")
+	}
+	if allowed, retryAfter := request(); allowed || retryAfter != "30" {
+		t.Fatalf("expected a decline with the cooldown as Retry-After, got allowed=%v after %q", allowed, retryAfter)
+	}
+
+	// polling at the limit restarts the cooldown, although the event
+	// left the window
+	advanceTime(20)
+	if allowed, _ := request(); allowed {
+		t.Fatal("expected requests during the cooldown to be declined")
+	}
+	advanceTime(40)
+	if allowed, _ := request(); allowed {
+		t.Fatal("expected the cooldown to have restarted")
+	}
+
+	// quiet keys get their budget back
+	advanceTime(71)
+	if allowed, _ := request(); !allowed {
+		t.Fatal("expected a quiet key to be allowed after the cooldown")
+	}
+
+	invalid := &RateLimit{Window: caddy.Duration(time.Minute), MaxEvents: 1, Cooldown: -1}
+	if err := invalid.provision(caddy.Context{}, "invalid_cooldown_zone"); err == nil {
+		t.Error("expected an error for a negative cooldown")
+	}
+}
+
+func TestPressureHeader(t *testing.T) {
+	initTime()
+
+	var zones []*RateLimit
+	for _, rl := range []*RateLimit{
+		{ZoneName: "pressure_zone", MaxEvents: 4, PressureHeader: "X-RateLimit-Pressure"},
+		{ZoneName: "pressure_low_zone", MaxEvents: 10, PressureHeader: "X-RateLimit-Pressure", PressureThreshold: 0.1},
+	} {
+		rl.Key = "static"
+		rl.Window = caddy.Duration(time.Minute)
+		zones = append(zones, rl)
+	}
+	h := newTestHandler(t, zones...)
+	if zones[0].PressureThreshold != defaultPressureThreshold {
+		t.Fatalf("expected the default threshold, got %v", zones[0].PressureThreshold)
+	}
+
+	// the highest utilization of the zones above their threshold wins,
+	// and clients can't set the header themselves
+	for i, want := range []string{"0.10", "0.20", "0.30", "1.00"} {
+		req := newTestRequest("GET", "/", nil)
+		req.Header.Set("X-RateLimit-Pressure", "0.99")
+		if err := h.limit(httptest.NewRecorder(), req); err != nil {
+			t.Fatalf("request %d: unexpected error: %v", i+1, err)
+		}
+		if got := req.Header.Get("X-RateLimit-Pressure"); got != want {
+			t.Errorf("request %d: expected pressure %s, got %q", i+1, want, got)
+		}
+	}
+
+	nearLimit := &RateLimit{Window: caddy.Duration(time.Minute), MaxEvents: 1, NearLimit: 0.5, PressureHeader: "X-RateLimit-Pressure"}
+	if err := nearLimit.provision(caddy.Context{}, "pressure_near_limit_zone"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _, _ = rateLimits.Delete("pressure_near_limit_zone") })
+	if nearLimit.PressureThreshold != 0.5 {
+		t.Errorf("expected near_limit as the threshold, got %v", nearLimit.PressureThreshold)
+	}
+	invalid := &RateLimit{Window: caddy.Duration(time.Minute), MaxEvents: 1, PressureHeader: "X-RateLimit-Pressure", PressureThreshold: 2}
+	if err := invalid.provision(caddy.Context{}, "invalid_pressure_zone"); err == nil {
+		t.Error("expected an error for a threshold above 1")
+	}
+}
+
+func TestMethodCosts(t *testing.T) {
+	initTime()
+
+	rl := &RateLimit{
+		ZoneName:    "method_costs_zone",
+		Key:         "static",
+		Window:      caddy.Duration(time.Minute),
+		MaxEvents:   10,
+		MethodCosts: map[string]int{"POST": 4, "DELETE": 11},
+	}
+	h := newTestHandler(t, rl)
+	allowed := func(method string) bool {
+		t.Helper()
+		return allowedBy(t, h, newTestRequest(method, "/", nil))
+	}
+
+	// 4 + 4 + 1 + 1 events fill the window
+	for _, method := range []string{"POST", "POST", "GET", "GET"} {
+		if !allowed(method) {
+			t.Fatalf("%s should be allowed", method)
+		}
+	}
+	if allowed("GET") {
+		t.Fatal("GET should be declined once the window is full")
+	}
+
+	// a request that costs more than max_events is never allowed
+	advanceTime(61)
+	if allowed("DELETE") {
+		t.Fatal("DELETE costs more than max_events and should be declined")
+	}
+	if !allowed("POST") {
+		t.Fatal("POST should be allowed once the window has passed")
+	}
+	if count, _ := rl.limitersMap.getOrInsert("static").Count(now()); count != 4 {
+		t.Fatalf("expected the POST to count as 4 events, got %d", count)
+	}
+
+	invalid := &RateLimit{Window: caddy.Duration(time.Minute), MaxEvents: 1, MethodCosts: map[string]int{"POST": 0}}
+	if err := invalid.provision(caddy.Context{}, "invalid_method_costs_zone"); err == nil {
+		t.Error("expected an error for a cost less than 1")
+	}
+}
+
+func TestMethodEvents(t *testing.T) {
+	initTime()
+
+	rl := &RateLimit{
+		ZoneName:     "method_events_zone",
+		Key:          "static",
+		Window:       caddy.Duration(time.Minute),
+		MaxEvents:    5,
+		MethodEvents: map[string]int{"POST": 2},
+	}
+	h := newTestHandler(t, rl)
+	allowed := func(method string) bool {
+		t.Helper()
+		return allowedBy(t, h, newTestRequest(method, "/", nil))
+	}
+	methodCount := func() int {
+		limiters, _ := rl.limitersMap.methodLimiters("POST")
+		n, _ := limiters.getOrInsert("static").Count(now())
+		return n
+	}
+
+	// POSTs are held to their own limit, within the zone's
+	if !allowed("POST") || !allowed("POST") || allowed("POST") {
+		t.Fatal("expected the third POST to exceed its method's limit")
+	}
+	if !allowed("GET") || !allowed("GET") || !allowed("GET") || allowed("GET") {
+		t.Fatal("expected the zone's limit to include the POSTs")
+	}
+
+	// a POST that the zone declines isn't counted against its method
+	advanceTime(61)
+	for range 5 {
+		allowed("GET")
+	}
+	if allowed("POST") {
+		t.Fatal("expected the zone to decline the POST")
+	}
+	if n := methodCount(); n != 0 {
+		t.Fatalf("expected the declined POST to be given back, got %d events", n)
+	}
+
+	// the method's rate limiters are kept across reloads
+	advanceTime(122)
+	allowed("POST")
+	rl.limitersMap.setMethodEvents(map[string]int{"POST": 3}, time.Minute)
+	if n := methodCount(); n != 1 {
+		t.Fatalf("expected the method's events to be kept, got %d", n)
+	}
+
+	// resetting the key, or the whole zone, resets its method's events
+	for _, reset := range []func(){
+		func() { rl.limitersMap.delete("static") },
+		rl.limitersMap.reset,
+	} {
+		for allowed("POST") {
+		}
+		reset()
+		if !allowed("POST") {
+			t.Fatal("expected a POST to be allowed after a reset")
+		}
+	}
+
+	invalid := &RateLimit{Window: caddy.Duration(time.Minute), MaxEvents: 1, MethodEvents: map[string]int{"post": 1}}
+	if err := invalid.provision(caddy.Context{}, "invalid_method_events_zone"); err == nil {
+		t.Error("expected an error for a method that isn't upper case")
+	}
+}
+
+func TestPathCosts(t *testing.T) {
+	rl := &RateLimit{
+		Window:      caddy.Duration(time.Minute),
+		MaxEvents:   100,
+		MethodCosts: map[string]int{"POST": 2},
+		PathCosts: []PathCost{
+			{Path: "/search*", Cost: 10},
+			{Path: "/static/*", Cost: 0},
+			{Path: "/search/cheap", Cost: 1},
+		},
+	}
+	if err := rl.provision(caddy.Context{}, "path_costs_zone"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _, _ = rateLimits.Delete("path_costs_zone") })
+
+	for _, tc := range []struct {
+		method, target string
+		expect         int
+	}{
+		{method: "GET", target: "/search?q=x", expect: 10},
+		{method: "GET", target: "/search/cheap", expect: 10}, // first match applies
+		{method: "POST", target: "/search", expect: 20},
+		{method: "GET", target: "/static/app.js", expect: 0},
+		{method: "GET", target: "/other", expect: 1},
+		{method: "POST", target: "/other", expect: 2},
+	} {
+		req := newTestRequest(tc.method, tc.target, nil)
+		if cost := rl.costOf(req); cost != tc.expect {
+			t.Errorf("%s %s: expected cost %d, got %d", tc.method, tc.target, tc.expect, cost)
+		}
+	}
+
+	invalid := &RateLimit{Window: caddy.Duration(time.Minute), MaxEvents: 1, PathCosts: []PathCost{{Path: "/x", Cost: -1}}}
+	if err := invalid.provision(caddy.Context{}, "invalid_path_costs_zone"); err == nil {
+		t.Error("expected an error for a negative cost")
+	}
+}
+
+func TestIdempotencyWindow(t *testing.T) {
+	initTime()
+
+	rl := &RateLimit{
+		ZoneName:          "idempotency_zone",
+		Key:               "static",
+		Window:            caddy.Duration(time.Minute),
+		MaxEvents:         2,
+		IdempotencyWindow: caddy.Duration(10 * time.Second),
+	}
+	h := newTestHandler(t, rl)
+	allowed := func(idempotencyKey string) bool {
+		t.Helper()
+		req := newTestRequest("POST", "/", nil)
+		if idempotencyKey != "" {
+			req.Header.Set("Idempotency-Key", idempotencyKey)
+		}
+		return allowedBy(t, h, req)
+	}
+	count := func() int {
+		n, _ := rl.limitersMap.getOrInsert("static").Count(now())
+		return n
+	}
+
+	// retries of a request are counted once
+	for range 3 {
+		if !allowed("a") {
+			t.Fatal("retries should be allowed")
+		}
+	}
+	if n := count(); n != 1 {
+		t.Fatalf("expected retries to count as 1 event, got %d", n)
+	}
+
+	// other idempotency keys, and requests without one, are counted
+	if !allowed("b") || allowed("") {
+		t.Fatal("expected the second request to fill the window")
+	}
+
+	// a declined request isn't remembered, so its retry is counted too
+	if allowed("c") || allowed("c") {
+		t.Fatal("expected requests with a new idempotency key to be declined")
+	}
+
+	// after the idempotency window, retries are counted again
+	advanceTime(11)
+	if allowed("a") {
+		t.Fatal("expected retry after the idempotency window to be declined")
+	}
+	rl.limitersMap.sweep()
+	if len(rl.limitersMap.idempotent) != 0 {
+		t.Fatalf("expected idempotency keys to be swept, have %d", len(rl.limitersMap.idempotent))
+	}
+}
+
+func TestCountOncePer(t *testing.T) {
+	initTime()
+
+	rl := &RateLimit{
+		ZoneName:     "sessions_zone",
+		Key:          "static",
+		Window:       caddy.Duration(time.Minute),
+		MaxEvents:    2,
+		CountOncePer: "{test.session}",
+	}
+	h := newTestHandler(t, rl)
+	allowed := func(session string) bool {
+		t.Helper()
+		return allowedBy(t, h, newTestRequest("GET", "/", map[string]string{"test.session": session}))
+	}
+
+	// a session's requests count once
+	for range 5 {
+		if !allowed("a") {
+			t.Fatal("later requests of a session should be allowed")
+		}
+	}
+	if n, _ := rl.limitersMap.getOrInsert("static").Count(now()); n != 1 {
+		t.Fatalf("expected the session to count as 1 event, got %d", n)
+	}
+
+	// other sessions, and requests without one, are counted
+	if !allowed("b") || allowed("") || allowed("c") {
+		t.Fatal("expected the second session to fill the window")
+	}
+
+	// sessions that are used are remembered beyond the window
+	advanceTime(50)
+	if !allowed("a") {
+		t.Fatal("expected the session to still be counted")
+	}
+	advanceTime(100)
+	if !allowed("a") {
+		t.Fatal("expected the session to be remembered while it has requests")
+	}
+	advanceTime(161)
+	rl.limitersMap.sweep()
+	if len(rl.limitersMap.sessions) != 0 {
+		t.Fatalf("expected idle sessions to be swept, have %d", len(rl.limitersMap.sessions))
+	}
+
+	for countOncePer, valid := range map[string]bool{"connection": true, "static": false} {
+		zone := &RateLimit{ZoneName: "sessions_zone_" + countOncePer, Key: "static", Window: caddy.Duration(time.Minute), CountOncePer: countOncePer}
+		err := zone.provision(caddy.Context{}, zone.ZoneName)
+		if (err == nil) != valid {
+			t.Errorf("count_once_per %s: unexpected error %v", countOncePer, err)
+		}
+		_, _ = rateLimits.Delete(zone.ZoneName)
+	}
+}
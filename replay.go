@@ -0,0 +1,241 @@
+package caddyrl
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func cmdReplay(fl caddycmd.Flags) (int, error) {
+	configFlag := fl.String("config")
+	configAdapterFlag := fl.String("adapter")
+	logFlag := fl.String("log")
+	zoneFlag := fl.String("zone")
+	topFlag := fl.Int("top")
+	percentileFlag := fl.Float64("percentile")
+	headroomFlag := fl.Float64("headroom")
+
+	if configFlag == "" || logFlag == "" {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("--config and --log are required")
+	}
+	suggestion := &LimitSuggestion{Percentile: percentileFlag, Headroom: headroomFlag}
+	if err := suggestion.provision(nil); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	config, _, _, err := caddycmd.LoadConfig(configFlag, configAdapterFlag)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	zones, err := findZoneConfigs(config)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	if zoneFlag != "" {
+		zones = slices.DeleteFunc(zones, func(rl *RateLimit) bool { return rl.ZoneName != zoneFlag })
+	}
+	if len(zones) == 0 {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("no zones to replay in config")
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	replays := make([]*zoneReplay, 0, len(zones))
+	for _, rl := range zones {
+		zr, err := newZoneReplay(ctx, rl, suggestion)
+		if err != nil {
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("zone %s: %v", rl.ZoneName, err)
+		}
+		replays = append(replays, zr)
+	}
+
+	in := os.Stdin
+	if logFlag != "-" {
+		file, err := os.Open(logFlag)
+		if err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+		defer file.Close()
+		in = file
+	}
+	if err := readAccessLog(in, replays); err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("reading %s: %v", logFlag, err)
+	}
+
+	for i, zr := range replays {
+		if i > 0 {
+			fmt.Fprintln(os.Stdout)
+		}
+		if err := zr.writeReport(os.Stdout, topFlag); err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+	}
+	return caddy.ExitCodeSuccess, nil
+}
+
+// zoneReplay replays the requests of an access log through a zone: the
+// requests that its matchers match are collected under their keys, so
+// that they can be simulated against its limits, and observed for a
+// suggestion of its max_events.
+type zoneReplay struct {
+	rl       *RateLimit
+	key      keyTemplate
+	requests []simulatedRequest
+	obs      *limitObservation
+}
+
+func newZoneReplay(ctx caddy.Context, rl *RateLimit, suggestion *LimitSuggestion) (*zoneReplay, error) {
+	if rl.Window <= 0 || rl.MaxEvents < 0 {
+		return nil, fmt.Errorf("a window and max_events are required")
+	}
+	if len(rl.MatcherSetsRaw) > 0 {
+		matcherSets, err := ctx.LoadModule(rl, "MatcherSetsRaw")
+		if err != nil {
+			return nil, err
+		}
+		if err := rl.matcherSets.FromInterface(matcherSets); err != nil {
+			return nil, err
+		}
+	}
+	return &zoneReplay{
+		rl:  rl,
+		key: newKeyTemplate(rl.Key),
+		obs: &limitObservation{
+			percentile: suggestion.Percentile,
+			headroom:   suggestion.Headroom,
+			windows:    make(map[string]*observedWindow),
+			counts:     make(map[int]int),
+		},
+	}, nil
+}
+
+// add collects r, which was made at the given time, if it is in the
+// zone.
+func (zr *zoneReplay) add(r *http.Request, repl *caddy.Replacer, at time.Time) error {
+	if len(zr.rl.matcherSets) > 0 {
+		matched, err := zr.rl.matcherSets.AnyMatchWithError(r)
+		if err != nil {
+			return err
+		}
+		if !matched {
+			return nil
+		}
+	}
+	zr.requests = append(zr.requests, simulatedRequest{at: at, key: zr.key.key(repl)})
+	return nil
+}
+
+// writeReport simulates the collected requests against the zone's
+// limits and prints the result, with up to top of the keys with the
+// most declined requests, and the max_events suggested by the number of
+// events that keys made per window.
+func (zr *zoneReplay) writeReport(w io.Writer, top int) error {
+	sort.SliceStable(zr.requests, func(i, j int) bool { return zr.requests[i].at.Before(zr.requests[j].at) })
+	window := time.Duration(zr.rl.Window)
+	for _, req := range zr.requests {
+		zr.obs.count(req.key, window, req.at)
+	}
+	if err := writeSimulationReport(w, zr.rl, simulate(zr.rl, zr.requests), top); err != nil {
+		return err
+	}
+	s := zr.obs.finish()
+	if s.Windows == 0 {
+		return nil
+	}
+	_, err := fmt.Fprintf(w, "suggested max_events: %d (p%g of %d windows is %d, ×%g headroom)\n",
+		s.SuggestedMaxEvents, zr.obs.percentile, s.Windows,
+		s.Percentiles[strconv.FormatFloat(zr.obs.percentile, 'f', -1, 64)], zr.obs.headroom)
+	return err
+}
+
+// accessLogEntry is the part of a Caddy JSON access log entry that
+// requests are rebuilt from.
+type accessLogEntry struct {
+	TS      float64 `json:"ts"`
+	Request *struct {
+		RemoteIP   string      `json:"remote_ip"`
+		RemotePort string      `json:"remote_port"`
+		ClientIP   string      `json:"client_ip"`
+		Proto      string      `json:"proto"`
+		Method     string      `json:"method"`
+		Host       string      `json:"host"`
+		URI        string      `json:"uri"`
+		Headers    http.Header `json:"headers"`
+	} `json:"request"`
+}
+
+// readAccessLog rebuilds the requests of a Caddy JSON access log, one
+// entry per line, and adds each of them to the replays of the zones.
+// Entries without a request, e.g. of other loggers, and empty lines are
+// skipped.
+func readAccessLog(r io.Reader, replays []*zoneReplay) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var entry accessLogEntry
+		if err := json.Unmarshal([]byte(text), &entry); err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+		if entry.Request == nil {
+			continue
+		}
+		req, repl, err := entry.rebuild()
+		if err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+		for _, zr := range replays {
+			if err := zr.add(req, repl, unixSeconds(entry.TS)); err != nil {
+				return fmt.Errorf("line %d: zone %s: %v", line, zr.rl.ZoneName, err)
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// rebuild returns the request of the entry, prepared like Caddy's HTTP
+// server does, and its replacer.
+func (entry accessLogEntry) rebuild() (*http.Request, *caddy.Replacer, error) {
+	logged := entry.Request
+	req, err := http.NewRequest(logged.Method, logged.URI, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Host = logged.Host
+	req.RequestURI = logged.URI
+	if logged.Headers != nil {
+		req.Header = logged.Headers
+	}
+	if major, minor, ok := http.ParseHTTPVersion(logged.Proto); ok {
+		req.Proto, req.ProtoMajor, req.ProtoMinor = logged.Proto, major, minor
+	}
+	req.RemoteAddr = net.JoinHostPort(logged.RemoteIP, logged.RemotePort)
+
+	repl := caddy.NewReplacer()
+	req = caddyhttp.PrepareRequest(req, repl, nil, nil)
+	// the client IP that Caddy determined, which differs from the
+	// remote IP behind trusted proxies
+	clientIP := logged.ClientIP
+	if clientIP == "" {
+		clientIP = logged.RemoteIP
+	}
+	caddyhttp.SetVar(req.Context(), caddyhttp.ClientIPVarKey, clientIP)
+	return req, repl, nil
+}
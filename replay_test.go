@@ -0,0 +1,81 @@
+package caddyrl
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestReplayAccessLog(t *testing.T) {
+	config := `{
+		"apps": {"http": {"servers": {"srv0": {"routes": [{"handle": [
+			{"handler": "rate_limit", "rate_limits": [
+				{"zone_name": "login", "key": "{http.vars.client_ip}", "max_events": 2, "window": "1m",
+					"match": [{"path": ["/login"]}]},
+				{"zone_name": "api", "key": "{http.request.header.X-Api-Key}", "max_events": 100, "window": "1m"}
+			]}
+		]}]}}}}
+	}`
+	zones, err := findZoneConfigs([]byte(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zones) != 2 || zones[0].ZoneName != "api" || zones[1].ZoneName != "login" {
+		t.Fatalf("expected both zones sorted by name, got %+v", zones)
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	suggestion := new(LimitSuggestion)
+	if err := suggestion.provision(nil); err != nil {
+		t.Fatal(err)
+	}
+	var replays []*zoneReplay
+	for _, rl := range zones {
+		zr, err := newZoneReplay(ctx, rl, suggestion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		replays = append(replays, zr)
+	}
+
+	log := `{"level":"info","logger":"http.log.access","ts":1700000000,"request":{"remote_ip":"192.0.2.1","remote_port":"5000","client_ip":"192.0.2.1","proto":"HTTP/1.1","method":"POST","host":"example.com","uri":"/login","headers":{"X-Api-Key":["a"]}}}
+{"level":"info","logger":"http.log.access","ts":1700000010,"request":{"remote_ip":"192.0.2.1","remote_port":"5001","method":"POST","host":"example.com","uri":"/login","headers":{"X-Api-Key":["a"]}}}
+
+{"level":"info","logger":"tls","ts":1700000015,"msg":"certificate obtained"}
+{"level":"info","logger":"http.log.access","ts":1700000020,"request":{"remote_ip":"10.0.0.1","remote_port":"5002","client_ip":"192.0.2.1","method":"POST","host":"example.com","uri":"/login?next=%2F","headers":{"X-Api-Key":["b"]}}}
+{"level":"info","logger":"http.log.access","ts":1700000030,"request":{"remote_ip":"192.0.2.2","remote_port":"5003","method":"GET","host":"example.com","uri":"/items","headers":{"X-Api-Key":["a"]}}}
+`
+	if err := readAccessLog(strings.NewReader(log), replays); err != nil {
+		t.Fatal(err)
+	}
+	api, login := replays[0], replays[1]
+	if len(api.requests) != 4 || len(login.requests) != 3 {
+		t.Fatalf("expected 4 requests in api and 3 in login, got %d and %d", len(api.requests), len(login.requests))
+	}
+	if key := login.requests[2].key; key != "192.0.2.1" {
+		t.Errorf("expected the logged client IP as the key, got %q", key)
+	}
+
+	var out strings.Builder
+	if err := login.writeReport(&out, 10); err != nil {
+		t.Fatal(err)
+	}
+	want := "login: 2 per 1m0s\n" +
+		"requests:  3 over 20s\n" +
+		"declined:  1 (33.3%)\n" +
+		"keys:      1, of which 1 were declined\n" +
+		"\n" +
+		"  KEY        REQUESTS  DECLINED\n" +
+		"  192.0.2.1  3         1\n" +
+		"suggested max_events: 5 (p99 of 1 windows is 3, ×1.5 headroom)\n"
+	if out.String() != want {
+		t.Errorf("unexpected report:\n%s\nwant:\n%s", out.String(), want)
+	}
+
+	if err := readAccessLog(strings.NewReader("not json\n"), replays); err == nil {
+		t.Error("expected an error for a line that isn't JSON")
+	}
+}
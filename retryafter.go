@@ -0,0 +1,149 @@
+package caddyrl
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// UpstreamRetryAfter makes the handler coherent with later handlers that
+// limit requests themselves, e.g. reverse_proxy upstreams that respond
+// with 429 Too Many Requests. The Retry-After header of such a response
+// is merged into a single value, and the `remaining` and `reset`
+// placeholders of the request's zones are set to match it, so that
+// deferred header operations don't contradict the upstream.
+type UpstreamRetryAfter struct {
+	// If true, the Retry-After of a 429 response is recorded against the
+	// request's key in each zone that limited it, so that the handler
+	// declines the key's requests until then instead of passing them on
+	// to the upstream. Default: false
+	Record bool `json:"record,omitempty"`
+
+	// The longest Retry-After that is recorded; longer ones are recorded
+	// as this, but are passed on to the client unchanged. Default: 1h
+	MaxDuration caddy.Duration `json:"max_duration,omitempty"`
+
+	format string // of the merged Retry-After; see Handler.RetryAfterFormat
+}
+
+// Formats of the Retry-After header.
+const (
+	retryAfterSeconds  = "seconds"
+	retryAfterHTTPDate = "http_date"
+)
+
+// formatRetryAfter returns a Retry-After value for a wait of seconds
+// whole seconds from now, in format.
+func formatRetryAfter(format string, seconds float64) string {
+	if format == retryAfterHTTPDate {
+		return now().Add(time.Duration(seconds) * time.Second).UTC().Format(http.TimeFormat)
+	}
+	return strconv.FormatFloat(seconds, 'f', 0, 64)
+}
+
+func (ura *UpstreamRetryAfter) provision() error {
+	if ura.MaxDuration < 0 {
+		return fmt.Errorf("max_duration must be at least zero")
+	}
+	if ura.MaxDuration == 0 {
+		ura.MaxDuration = caddy.Duration(time.Hour)
+	}
+	return nil
+}
+
+// limitedKey is a key that a request was counted against in a zone.
+type limitedKey struct {
+	zone *RateLimit
+	key  string
+}
+
+// wrap returns w wrapped so that the 429 responses of later handlers
+// apply to the keys of the request.
+func (ura *UpstreamRetryAfter) wrap(w http.ResponseWriter, r *http.Request, keys []limitedKey) http.ResponseWriter {
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	return &retryAfterWriter{
+		ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w},
+		upstream:              ura,
+		keys:                  keys,
+		repl:                  repl,
+	}
+}
+
+// retryAfterWriter handles the Retry-After of 429 responses of later
+// handlers; see UpstreamRetryAfter.
+type retryAfterWriter struct {
+	*caddyhttp.ResponseWriterWrapper
+	upstream    *UpstreamRetryAfter
+	keys        []limitedKey
+	repl        *caddy.Replacer
+	wroteHeader bool
+}
+
+func (w *retryAfterWriter) WriteHeader(status int) {
+	// informational responses are followed by the final one
+	if !w.wroteHeader && status >= 200 {
+		w.wroteHeader = true
+		if status == http.StatusTooManyRequests {
+			w.upstream.tooManyRequests(w.Header(), w.repl, w.keys)
+		}
+	}
+	w.ResponseWriterWrapper.WriteHeader(status)
+}
+
+// tooManyRequests merges the Retry-After values in the header of a
+// 429 response to a request and applies the wait to the request's keys.
+func (ura *UpstreamRetryAfter) tooManyRequests(header http.Header, repl *caddy.Replacer, keys []limitedKey) {
+	wait, ok := parseRetryAfter(header.Values("Retry-After"), now())
+	if !ok {
+		return
+	}
+	wait = max(wait, 0)
+	rounded := math.Ceil(wait.Seconds())
+	seconds := strconv.FormatFloat(rounded, 'f', 0, 64)
+	header.Set("Retry-After", formatRetryAfter(ura.format, rounded))
+
+	until := now().Add(min(wait, time.Duration(ura.MaxDuration)))
+	for _, lk := range keys {
+		repl.Set(placeholderPrefix(lk.zone.ZoneName)+"remaining", 0)
+		repl.Set(placeholderPrefix(lk.zone.ZoneName)+"reset", seconds)
+		repl.Set(placeholderPrefix(lk.zone.ZoneName)+"reset_ms", ceilMilliseconds(wait))
+		if ura.Record {
+			lk.zone.limitersMap.backOff(lk.key, until)
+		}
+	}
+}
+
+// parseRetryAfter returns the longest wait of the given Retry-After
+// values at ref, which are either seconds or HTTP dates. A header may
+// have several values if more than one layer set it; values that can't
+// be parsed are ignored. It returns false if none could be parsed.
+func parseRetryAfter(values []string, ref time.Time) (time.Duration, bool) {
+	var wait time.Duration
+	var ok bool
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		// dates have commas, but lists of seconds are separated by them
+		if date, err := http.ParseTime(value); err == nil {
+			wait, ok = max(wait, date.Sub(ref)), true
+			continue
+		}
+		for _, v := range strings.Split(value, ",") {
+			seconds, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+			if err != nil || seconds < 0 {
+				continue
+			}
+			seconds = min(seconds, math.MaxInt64/int64(time.Second))
+			wait, ok = max(wait, time.Duration(seconds)*time.Second), true
+		}
+	}
+	return wait, ok
+}
+
+// Interface guards
+var _ http.ResponseWriter = (*retryAfterWriter)(nil)
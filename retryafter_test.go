@@ -0,0 +1,186 @@
+package caddyrl
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	ref := time.Unix(referenceTime, 0)
+	for _, tc := range []struct {
+		values   []string
+		expected time.Duration
+		ok       bool
+	}{
+		{[]string{"30"}, 30 * time.Second, true},
+		{[]string{"30", "120"}, 2 * time.Minute, true},
+		{[]string{"30, 90"}, 90 * time.Second, true},
+		{[]string{ref.Add(time.Hour).UTC().Format(http.TimeFormat)}, time.Hour, true},
+		{[]string{"10", ref.Add(time.Minute).UTC().Format(http.TimeFormat)}, time.Minute, true},
+		{[]string{"-5", "soon"}, 0, false},
+		{nil, 0, false},
+	} {
+		wait, ok := parseRetryAfter(tc.values, ref)
+		if wait != tc.expected || ok != tc.ok {
+			t.Errorf("%q: expected %v, %t; got %v, %t", tc.values, tc.expected, tc.ok, wait, ok)
+		}
+	}
+}
+
+func TestUpstreamRetryAfter(t *testing.T) {
+	initTime()
+
+	rl := &RateLimit{
+		ZoneName:  "upstream_retry_zone",
+		Key:       "static",
+		Window:    caddy.Duration(time.Minute),
+		MaxEvents: 100,
+	}
+	h := newTestHandler(t, rl)
+
+	ura := &UpstreamRetryAfter{Record: true, MaxDuration: caddy.Duration(time.Minute)}
+	if err := ura.provision(); err != nil {
+		t.Fatal(err)
+	}
+	h.UpstreamRetryAfter = ura
+
+	// the upstream limits the client itself, and so does another layer
+	// in between, with a different opinion
+	upstream := caddyhttp.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) error {
+		w.Header().Add("Retry-After", "30")
+		w.Header().Add("Retry-After", "300")
+		w.WriteHeader(http.StatusTooManyRequests)
+		return nil
+	})
+	serve := func() (*httptest.ResponseRecorder, *caddy.Replacer, error) {
+		repl := caddy.NewReplacer()
+		req := httptest.NewRequest("GET", "/", nil)
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl))
+		rec := httptest.NewRecorder()
+		return rec, repl, h.ServeHTTP(rec, req, upstream)
+	}
+
+	rec, repl, err := serve()
+	if err != nil {
+		t.Fatalf("expected the first request to reach the upstream, got %v", err)
+	}
+	if values := rec.Header().Values("Retry-After"); len(values) != 1 || values[0] != "300" {
+		t.Errorf("expected one merged Retry-After of 300, got %q", values)
+	}
+	prefix := placeholderPrefix(rl.ZoneName)
+	if remaining, _ := repl.GetString(prefix + "remaining"); remaining != "0" {
+		t.Errorf("expected no remaining events after the upstream's 429, got %s", remaining)
+	}
+	if reset, _ := repl.GetString(prefix + "reset"); reset != "300" {
+		t.Errorf("expected the reset to match the upstream's Retry-After, got %s", reset)
+	}
+
+	// the key backs off for at most max_duration, without reaching the
+	// upstream
+	advanceTime(10)
+	rec, _, err = serve()
+	if !isDeclined(err) {
+		t.Fatalf("expected the request to be declined while backing off, got %v", err)
+	}
+	if retryAfter := rec.Header().Get("Retry-After"); retryAfter != "50" {
+		t.Errorf("expected to back off for 50 more seconds, got %s", retryAfter)
+	}
+	if allowed, _, wait := rl.limitersMap.peek("static"); allowed || wait != 50*time.Second {
+		t.Errorf("expected peek to report the backoff, got %t, %v", allowed, wait)
+	}
+
+	// backoffs end after max_duration, and are deleted with the key
+	advanceTime(60)
+	if _, _, err := serve(); err != nil {
+		t.Fatalf("expected the request to be allowed after backing off, got %v", err)
+	}
+	rl.limitersMap.sweep()
+	if !rl.limitersMap.delete("static") || rl.limitersMap.backedOff("static") != 0 {
+		t.Error("expected the backoff to be deleted with the key")
+	}
+
+	// without record, headers are merged but the key doesn't back off
+	ura.Record = false
+	if _, _, err := serve(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := serve(); err != nil {
+		t.Errorf("expected the key not to back off, got %v", err)
+	}
+
+	// the merged header can be a date, while the placeholders stay in
+	// seconds
+	ura.format = retryAfterHTTPDate
+	rec, repl, _ = serve()
+	if retryAfter, want := rec.Header().Get("Retry-After"), now().Add(300*time.Second).UTC().Format(http.TimeFormat); retryAfter != want {
+		t.Errorf("expected a Retry-After of %s, got %s", want, retryAfter)
+	}
+	if reset, _ := repl.GetString(prefix + "reset"); reset != "300" {
+		t.Errorf("expected the reset in seconds, got %s", reset)
+	}
+}
+
+func TestRetryAfterFormat(t *testing.T) {
+	initTime()
+
+	if got := formatRetryAfter(retryAfterSeconds, 45); got != "45" {
+		t.Errorf("expected 45 seconds, got %s", got)
+	}
+	want := now().Add(45 * time.Second).UTC().Format(http.TimeFormat)
+	if got := formatRetryAfter(retryAfterHTTPDate, 45); got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+	if wait, ok := parseRetryAfter([]string{want}, now()); !ok || wait != 45*time.Second {
+		t.Errorf("expected the date to parse as a wait of 45s, got %v, %t", wait, ok)
+	}
+
+	var h Handler
+	if err := h.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`rate_limit {
+		retry_after_format http_date
+	}`)); err != nil || h.RetryAfterFormat != retryAfterHTTPDate {
+		t.Fatalf("expected the http_date format, got %q (%v)", h.RetryAfterFormat, err)
+	}
+	var bad Handler
+	if err := bad.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`rate_limit {
+		retry_after_format rfc1123
+	}`)); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
+
+func TestCaddyfileUpstreamRetryAfter(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`
+	rate_limit {
+		zone api {
+			key    {http.request.remote.host}
+			window 1m
+			events 100
+		}
+		upstream_retry_after {
+			record
+			max_duration 10m
+		}
+	}`)
+
+	var h Handler
+	if err := h.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshaling Caddyfile: %v", err)
+	}
+	if ura := h.UpstreamRetryAfter; ura == nil || !ura.Record || ura.MaxDuration != caddy.Duration(10*time.Minute) {
+		t.Fatalf("unexpected upstream retry-after: %+v", ura)
+	}
+
+	var bare Handler
+	if err := bare.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`rate_limit {
+		upstream_retry_after
+	}`)); err != nil || bare.UpstreamRetryAfter == nil || bare.UpstreamRetryAfter.Record {
+		t.Fatalf("expected headers to be merged without recording, got %+v (%v)", bare.UpstreamRetryAfter, err)
+	}
+}
@@ -0,0 +1,99 @@
+package caddyrl
+
+import (
+	"fmt"
+	"hash/maphash"
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// RetryStormDetection bans keys that retry the same request in a tight
+// loop, e.g. clients that retry failed requests immediately and without
+// backoff. Per-window limits only decline such keys once they used up
+// their events, and then keep declining them just as fast as they retry;
+// banning them right away sheds the storm sooner.
+type RetryStormDetection struct {
+	// The longest time between two identical requests of a key for the
+	// second to count as a retry of the first. Default: 1s
+	Interval caddy.Duration `json:"interval,omitempty"`
+
+	// The number of identical requests of a key in a row, each a retry
+	// of the one before, at which the key is banned. Default: 10
+	Threshold int `json:"threshold,omitempty"`
+
+	// How long keys in a retry storm are banned. Default: 5m
+	BanDuration caddy.Duration `json:"ban_duration,omitempty"`
+
+	seed maphash.Seed
+}
+
+// retryStreak is a key's run of identical requests.
+type retryStreak struct {
+	signature uint64
+	requests  int
+
+	// when the next request is no longer a retry of the last one
+	expires time.Time
+}
+
+// provision sets the defaults and validates the detection.
+func (rs *RetryStormDetection) provision() error {
+	if rs.Interval == 0 {
+		rs.Interval = caddy.Duration(time.Second)
+	}
+	if rs.Threshold == 0 {
+		rs.Threshold = 10
+	}
+	if rs.BanDuration == 0 {
+		rs.BanDuration = caddy.Duration(5 * time.Minute)
+	}
+	if rs.Interval < 0 || rs.Threshold < 2 || rs.BanDuration < 0 {
+		return fmt.Errorf("interval and ban_duration must be greater than zero, and threshold at least 2")
+	}
+	rs.seed = maphash.MakeSeed()
+	return nil
+}
+
+// signature returns a hash of what makes requests identical: their
+// method, host and URI.
+func (rs *RetryStormDetection) signature(r *http.Request) uint64 {
+	var h maphash.Hash
+	h.SetSeed(rs.seed)
+	h.WriteString(r.Method)
+	h.WriteByte(0)
+	h.WriteString(r.Host)
+	h.WriteByte(0)
+	h.WriteString(r.URL.RequestURI())
+	return h.Sum64()
+}
+
+// observe counts a request of key, and returns true if it makes the
+// key's run of identical requests a retry storm.
+func (rs *RetryStormDetection) observe(rlm *rateLimitersMap, r *http.Request, key string) bool {
+	return rlm.countRetry(key, rs.signature(r), time.Duration(rs.Interval), rs.Threshold)
+}
+
+// countRetry counts a request of key with the given signature, and
+// returns true if it makes the key's run of identical requests, each
+// made within interval of the one before, as long as threshold. The run
+// then starts over.
+func (rlm *rateLimitersMap) countRetry(key string, signature uint64, interval time.Duration, threshold int) bool {
+	ref := now()
+	rlm.limitersMu.Lock()
+	defer rlm.limitersMu.Unlock()
+
+	streak, ok := rlm.retryStreaks[key]
+	if !ok || streak.signature != signature || !streak.expires.After(ref) {
+		streak = retryStreak{signature: signature}
+	}
+	streak.requests++
+	if streak.requests >= threshold {
+		delete(rlm.retryStreaks, key)
+		return true
+	}
+	streak.expires = ref.Add(interval)
+	rlm.retryStreaks[key] = streak
+	return false
+}
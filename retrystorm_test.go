@@ -0,0 +1,50 @@
+package caddyrl
+
+import (
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestRetryStorm(t *testing.T) {
+	initTime()
+
+	rl := &RateLimit{
+		ZoneName:   "retry_storm_zone",
+		Key:        "static",
+		Window:     caddy.Duration(time.Minute),
+		MaxEvents:  100,
+		RetryStorm: &RetryStormDetection{Threshold: 3},
+	}
+	h := newTestHandler(t, rl)
+	allowed := func(target string) bool {
+		t.Helper()
+		return allowedBy(t, h, newTestRequest("POST", target, nil))
+	}
+
+	// different requests, and identical ones that are further apart
+	// than the interval, are no storm
+	for _, target := range []string{"/a", "/a", "/b", "/a", "/a"} {
+		if !allowed(target) {
+			t.Fatalf("request to %s should be allowed", target)
+		}
+	}
+	advanceTime(2)
+	if !allowed("/a") || !allowed("/a") {
+		t.Fatal("requests after a pause should be allowed")
+	}
+
+	// the third identical request in a row bans the key
+	if allowed("/a") {
+		t.Fatal("expected the retry storm to be declined")
+	}
+	if dur := rl.limitersMap.banned("static"); dur != 5*time.Minute {
+		t.Fatalf("expected the key to be banned for 5m, got %s", dur)
+	}
+
+	invalid := &RateLimit{Window: caddy.Duration(time.Minute), MaxEvents: 1, RetryStorm: &RetryStormDetection{Threshold: 1}}
+	if err := invalid.provision(caddy.Context{}, "invalid_retry_storm_zone"); err == nil {
+		t.Error("expected an error for a threshold less than 2")
+	}
+}
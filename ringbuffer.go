@@ -15,90 +15,260 @@
 package caddyrl
 
 import (
+	"math"
+	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // ringBufferRateLimiter uses a ring to enforce rate limits
 // consisting of a maximum number of events within a single
 // sliding window of a given duration. An empty value is
-// not valid; always call initialize() before using.
+// not valid; always call newRingBufferRateLimiter() before using.
+//
+// Reservations are lock-free: events are reserved by atomically
+// claiming the oldest slots in the ring, once the events in them
+// have left the window (see reserveN). The mutex only serializes
+// maintenance of the ring, such as resizing it and refunds.
 type ringBufferRateLimiter struct {
 	mu     sync.Mutex
-	window time.Duration
-	ring   []time.Time // len(ring) == maxEvents
-	cursor int         // always points to the oldest timestamp
+	window atomic.Int64              // nanoseconds
+	ring   atomic.Pointer[eventRing] // replaced when resized
+	holds  atomic.Int32              // see hold
 }
 
+// eventRing is a ring of event timestamps. Every event gets a ticket
+// from a counter, and the event with ticket n is stored in slot
+// n % len(slots); so the slot of the next ticket holds the oldest event.
+type eventRing struct {
+	next  atomic.Uint64 // ticket of the next event
+	slots []eventSlot   // len(slots) == maxEvents
+}
+
+// eventSlot holds the timestamp of an event in an eventRing.
+type eventSlot struct {
+	at   atomic.Int64  // unix nanoseconds, or noEvent
+	done atomic.Uint64 // ticket+1 of the event stored in at
+}
+
+// noEvent is the timestamp of a slot that has never held an event;
+// it is before any window.
+const noEvent = math.MinInt64
+
+// newEventRing returns a ring with size empty slots.
+func newEventRing(size int) *eventRing {
+	ring := &eventRing{slots: make([]eventSlot, size)}
+	for i := range ring.slots {
+		ring.slots[i].at.Store(noEvent)
+	}
+	return ring
+}
+
+// slot returns the slot of the event with the given ticket.
+func (ring *eventRing) slot(ticket uint64) *eventSlot {
+	return &ring.slots[ticket%uint64(len(ring.slots))]
+}
+
+// settled returns true if the slot of ticket holds the event of the
+// previous round, i.e. a reservation of that event is not in progress.
+func (ring *eventRing) settled(ticket uint64) bool {
+	return ring.slot(ticket).done.Load()+uint64(len(ring.slots)) > ticket
+}
+
+// reuse empties ring for reuse with size slots. If the ring's memory is
+// too small, or much larger than needed, a new ring is returned instead.
+func (ring *eventRing) reuse(size int) *eventRing {
+	if ring == nil || cap(ring.slots) < size || cap(ring.slots) > 2*size {
+		return newEventRing(size)
+	}
+	ring.next.Store(0)
+	ring.slots = ring.slots[:size]
+	for i := range ring.slots {
+		ring.slots[i].at.Store(noEvent)
+		ring.slots[i].done.Store(0)
+	}
+	return ring
+}
+
+// limiterPool holds rate limiters that are no longer used, so that
+// churn of short-lived keys doesn't allocate a rate limiter and ring
+// for every new key.
+var limiterPool countedPool
+
 // newRingBufferRateLimiter sets up a new rate limiter, allowing maxEvents
 // in a sliding window of size window. If maxEvents is 0, no events are
 // allowed. If window is 0, all events are allowed. It panics if maxEvents or
 // window are less than zero.
 func newRingBufferRateLimiter(maxEvents int, window time.Duration) *ringBufferRateLimiter {
-	r := new(ringBufferRateLimiter)
 	if maxEvents < 0 {
 		panic("maxEvents cannot be less than zero")
 	}
 	if window < 0 {
 		panic("window cannot be less than zero")
 	}
-	r.window = window
-	r.ring = make([]time.Time, maxEvents) // TODO: we can probably pool these
+	r, ok := limiterPool.Get().(*ringBufferRateLimiter)
+	if !ok {
+		r = new(ringBufferRateLimiter)
+	}
+	r.window.Store(int64(window))
+	r.ring.Store(r.ring.Load().reuse(maxEvents))
 	return r
 }
 
+// release puts r in the pool to be reused by newRingBufferRateLimiter.
+// r must not be used afterwards.
+func (r *ringBufferRateLimiter) release() {
+	limiterPool.Put(r)
+}
+
+// hold marks r as used by a request that may keep it for a long time,
+// e.g. across a sync with storage, so that r isn't released while the
+// request uses it, even if r is retired meanwhile. Every hold must be
+// ended with unhold.
+func (r *ringBufferRateLimiter) hold() {
+	r.holds.Add(1)
+}
+
+// unhold ends a hold of r.
+func (r *ringBufferRateLimiter) unhold() {
+	r.holds.Add(-1)
+}
+
+// held returns true if a request holds r.
+func (r *ringBufferRateLimiter) held() bool {
+	return r.holds.Load() > 0
+}
+
 // When returns the duration before the next allowable event; it does not block.
 // If zero, the event is allowed and a reservation is immediately made.
 // If non-zero, the event is NOT allowed and a reservation is not made.
 func (r *ringBufferRateLimiter) When() time.Duration {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	if r.allowed() {
-		return 0
+	_, wait := r.reserveN(1, 0)
+	return wait
+}
+
+// reservation is a claim of n consecutive tickets of a ring, whose
+// events happened at the same time.
+type reservation struct {
+	ring   *eventRing
+	ticket uint64
+	n      int
+	at     int64 // unix nanoseconds
+}
+
+// cancel gives back the events of res, e.g. because a limit that they
+// were reserved together with declined them, by giving back their
+// tickets. If other events were reserved since, the events can't be
+// taken out of the ring without reordering it, so they are kept: a
+// limit may then count events that were declined, but it never allows
+// too many.
+func (res reservation) cancel() {
+	if res.ring == nil {
+		return
+	}
+	// the slots are emptied before the tickets are given back, so that
+	// a reservation that takes the tickets again never has its event
+	// overwritten
+	for i := range uint64(res.n) {
+		res.ring.slot(res.ticket+i).at.CompareAndSwap(res.at, noEvent)
+	}
+	if res.ring.next.CompareAndSwap(res.ticket+uint64(res.n), res.ticket) {
+		return
+	}
+	for i := range uint64(res.n) {
+		res.ring.slot(res.ticket+i).at.CompareAndSwap(noEvent, res.at)
 	}
-	return r.ring[r.cursor].Add(r.window).Sub(now())
 }
 
-// allowed returns true if the event is allowed to happen right now.
-// It does not wait. If the event is allowed, a reservation is made.
-// It is NOT safe for concurrent use, so it must be called inside a
-// lock on r.mu.
-func (r *ringBufferRateLimiter) allowed() bool {
-	if len(r.ring) == 0 {
-		return false
+// reserveN is like When, for n events at once, which are reserved
+// together or not at all, and which must fit in the window along with
+// the events in the ring and others events that are counted elsewhere,
+// e.g. by other instances. It returns the reservation, or how long
+// until the events would be allowed; if they never are, because n and
+// others exceed MaxEvents, the window (at least 1ns) is returned.
+//
+// The events are allowed if the newest of the n+others oldest events
+// in the ring has left the window. Their tickets are claimed with a
+// compare-and-swap that fails if another reservation took a ticket
+// since that event was checked, so all reservations made with reserveN
+// are atomic with each other.
+func (r *ringBufferRateLimiter) reserveN(n, others int) (reservation, time.Duration) {
+	ring := r.ring.Load()
+	window := r.window.Load()
+	if n < 1 {
+		return reservation{}, 0
 	}
-	if now().Sub(r.ring[r.cursor]) > r.window {
-		r.reserve()
-		return true
+	if n+max(others, 0) > len(ring.slots) {
+		return reservation{}, time.Duration(max(window, 1))
+	}
+
+	for {
+		ticket := ring.next.Load()
+		last := ticket + uint64(n+max(others, 0)) - 1
+		if !ring.settled(last) {
+			// the previous event in this slot is being stored
+			runtime.Gosched()
+			continue
+		}
+
+		oldest := ring.slot(last).at.Load()
+		ref := unixNano(now())
+
+		// the events are allowed if the oldest event that they would
+		// leave room for has left the window, which it has once it is
+		// a whole window old
+		if oldest > ref-window {
+			if ring.next.Load() != ticket {
+				// the oldest events changed meanwhile; look again so
+				// the wait is accurate
+				continue
+			}
+			return reservation{}, time.Duration(oldest + window - ref)
+		}
+
+		if ring.next.CompareAndSwap(ticket, ticket+uint64(n)) {
+			for t := ticket; t < ticket+uint64(n); t++ {
+				for !ring.settled(t) {
+					runtime.Gosched()
+				}
+				slot := ring.slot(t)
+				slot.at.Store(ref)
+				slot.done.Store(t + 1)
+			}
+			return reservation{ring: ring, ticket: ticket, n: n, at: ref}, 0
+		}
 	}
-	return false
 }
 
-// reserve claims the current spot in the ring buffer
-// and advances the cursor.
-// It is NOT safe for concurrent use, so it must
-// be called inside a lock on r.mu.
+// reserve claims the next spot in the ring buffer regardless of the
+// events in it, e.g. to count an event that already happened. Events
+// that are only allowed depending on the events in the ring must be
+// reserved with reserveN instead.
 func (r *ringBufferRateLimiter) reserve() {
-	r.ring[r.cursor] = now()
-	r.advance()
+	r.reserveAt(now())
 }
 
-// advance moves the cursor to the next position.
-// It is NOT safe for concurrent use, so it must
-// be called inside a lock on r.mu.
-func (r *ringBufferRateLimiter) advance() {
-	r.cursor++
-	if r.cursor >= len(r.ring) {
-		r.cursor = 0
+// reserveAt is like reserve, but the event happens at ref.
+func (r *ringBufferRateLimiter) reserveAt(ref time.Time) {
+	ring := r.ring.Load()
+	if len(ring.slots) == 0 {
+		return
+	}
+
+	ticket := ring.next.Add(1) - 1
+	for !ring.settled(ticket) {
+		runtime.Gosched()
 	}
+	slot := ring.slot(ticket)
+	slot.at.Store(unixNano(ref))
+	slot.done.Store(ticket + 1)
 }
 
 // MaxEvents returns the maximum number of events that
 // are allowed within the sliding window.
 func (r *ringBufferRateLimiter) MaxEvents() int {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	return len(r.ring)
+	return len(r.ring.Load().slots)
 }
 
 // SetMaxEvents changes the maximum number of events that are
@@ -106,6 +276,9 @@ func (r *ringBufferRateLimiter) MaxEvents() int {
 // the oldest events will be forgotten. If the new limit is
 // higher, the window will suddenly have capacity for new
 // reservations. It panics if maxEvents is less than 0.
+//
+// Events reserved by When while the ring is being replaced
+// may be forgotten.
 func (r *ringBufferRateLimiter) SetMaxEvents(maxEvents int) {
 	if maxEvents < 0 {
 		panic("maxEvents cannot be less than zero")
@@ -114,47 +287,30 @@ func (r *ringBufferRateLimiter) SetMaxEvents(maxEvents int) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
+	oldRing := r.ring.Load()
+
 	// only make a change if the new limit is different
-	if maxEvents == len(r.ring) {
+	if maxEvents == len(oldRing.slots) {
 		return
 	}
 
-	newRing := make([]time.Time, maxEvents)
-
-	// the new ring may be smaller; fast-forward to the
-	// oldest timestamp that will be kept in the new
-	// ring so the oldest ones are forgotten and the
-	// newest ones will be remembered
-	sizeDiff := len(r.ring) - maxEvents
-	for i := 0; i < sizeDiff; i++ {
-		r.advance()
-	}
-
-	if len(r.ring) > 0 {
-		// copy timestamps into the new ring until we
-		// have either copied all of them or have reached
-		// the capacity of the new ring
-		startCursor := r.cursor
-		for i := 0; i < len(newRing); i++ {
-			newRing[i] = r.ring[r.cursor]
-			r.advance()
-			if r.cursor == startCursor {
-				// new ring is larger than old one;
-				// "we've come full circle"
-				break
-			}
-		}
+	// copy the newest events into the end of the new ring, oldest
+	// first, so the new ring's first slots are the oldest ones;
+	// if the new ring is larger, those are empty
+	newRing := newEventRing(maxEvents)
+	keep := min(maxEvents, len(oldRing.slots))
+	next := oldRing.next.Load()
+	for i := 0; i < keep; i++ {
+		ticket := next + uint64(len(oldRing.slots)-keep+i)
+		newRing.slots[maxEvents-keep+i].at.Store(oldRing.slot(ticket).at.Load())
 	}
 
-	r.ring = newRing
-	r.cursor = 0
+	r.ring.Store(newRing)
 }
 
 // Window returns the size of the sliding window.
 func (r *ringBufferRateLimiter) Window() time.Duration {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	return r.window
+	return time.Duration(r.window.Load())
 }
 
 // SetWindow changes r's sliding window duration to window.
@@ -163,50 +319,183 @@ func (r *ringBufferRateLimiter) SetWindow(window time.Duration) {
 	if window < 0 {
 		panic("window cannot be less than zero")
 	}
-	r.mu.Lock()
-	r.window = window
-	r.mu.Unlock()
+	r.window.Store(int64(window))
 }
 
 // Count counts how many events are in the window from the reference time and
 // returns that value and the oldest event in the buffer (the zero value of
 // time.Time if there are no events in the window).
 func (r *ringBufferRateLimiter) Count(ref time.Time) (int, time.Time) {
-	r.mu.Lock()
-	defer r.mu.Unlock()
 	return r.countUnsynced(ref)
 }
 
-// countUnsycned counts how many events are in the window from the reference time.
-// It is NOT safe to use without a lock on r.mu.
+// lastEvent returns the time of the newest event in the buffer, or the
+// zero value of time.Time if there are none. An event whose reservation
+// is in progress may not be seen yet.
+func (r *ringBufferRateLimiter) lastEvent() time.Time {
+	ring := r.ring.Load()
+	size := uint64(len(ring.slots))
+	if size == 0 {
+		return time.Time{}
+	}
+	at := ring.slots[(ring.next.Load()+size-1)%size].at.Load()
+	if at == noEvent {
+		return time.Time{}
+	}
+	return fromUnixNano(at)
+}
+
+// countUnsynced counts how many events are in the window from the reference time.
+// It does not take a lock on r.mu, and events may be reserved meanwhile; to make
+// a reservation based on the count atomically, use reserveN, unless every
+// reservation of r is made while holding a lock on r.mu.
+// Events whose reservation is in progress are counted as happening at ref.
 // TODO: this is currently O(n) but could probably become O(log n) if we switch to some weird, custom binary search modulo ring length around the cursor.
 func (r *ringBufferRateLimiter) countUnsynced(ref time.Time) (int, time.Time) {
 	var zeroTime time.Time
-	beginningOfWindow := ref.Add(-r.window)
-
-	// This loop is a little gnarly, I know. We start at one before the cursor because that's
-	// the newest event, and we're trying to count how many events are in the window; so
-	// iterating backwards from the cursor and wrapping around to the end of the ring is the
-	// same as iterating events in reverse chronological order starting with most recent. When
-	// we encounter the first element that's outside the window, then eventsInWindow has the
-	// correct count of events within the window.
-	for eventsInWindow := 0; eventsInWindow < len(r.ring); eventsInWindow++ {
-		// start at cursor, add difference between ring length and offset (eventsInWindow),
-		// then subtract 1 because we want to start 1 before cursor (newest event), then
-		// modulus the ring length to wrap around if necessary
-		i := (r.cursor + (len(r.ring) - eventsInWindow - 1)) % len(r.ring)
-		if r.ring[i].Before(beginningOfWindow) {
-			if eventsInWindow == 0 {
-				return eventsInWindow, zeroTime
-			} else {
-				return eventsInWindow, r.ring[(i+1)%len(r.ring)]
-			}
+	ring := r.ring.Load()
+	size := uint64(len(ring.slots))
+	beginningOfWindow := unixNano(ref) - r.window.Load()
+
+	// We start at the ticket before the next one because that's the newest event,
+	// and we're trying to count how many events are in the window; so iterating
+	// backwards through the tickets is the same as iterating events in reverse
+	// chronological order starting with most recent. When we encounter the first
+	// event that's outside the window, then eventsInWindow has the correct count
+	// of events within the window.
+	next := ring.next.Load()
+	oldest := unixNano(ref)
+	var eventsInWindow int
+	for i := uint64(0); i < size; i++ {
+		// the slot of ticket next-1-i, wrapping around the end of the ring
+		slot := &ring.slots[(next+size-1-i)%size]
+
+		// slots without a ticket yet hold events from before the ring
+		// was created; otherwise, the event may still be being stored
+		at := unixNano(ref)
+		if i >= next || slot.done.Load() > next-1-i {
+			at = slot.at.Load()
+		}
+		if at == noEvent {
+			// the event was cancelled, or refunded, so it doesn't count,
+			// but older events may
+			continue
+		}
+		if at < beginningOfWindow {
+			break
+		}
+		eventsInWindow++
+		oldest = at
+	}
+
+	if eventsInWindow == 0 {
+		return 0, zeroTime
+	}
+	return eventsInWindow, fromUnixNano(oldest)
+}
+
+// waitUnsynced returns the duration from the reference time before the next
+// allowable event, or 0 if an event is allowed. Like countUnsynced, it does
+// not take a lock on r.mu.
+func (r *ringBufferRateLimiter) waitUnsynced(ref time.Time) time.Duration {
+	count, oldest := r.countUnsynced(ref)
+	if count < r.MaxEvents() {
+		return 0
+	}
+	if count == 0 {
+		return max(r.Window(), 1) // no events are allowed
+	}
+	return oldest.Add(r.Window()).Sub(ref)
+}
+
+// waitNUnsynced is like waitUnsynced, but returns the duration before n
+// events are allowed at once, which is when enough of the oldest events
+// in the window have left it. If n exceeds MaxEvents, the events are
+// never allowed and the window (at least 1ns) is returned.
+func (r *ringBufferRateLimiter) waitNUnsynced(ref time.Time, n int) time.Duration {
+	ring := r.ring.Load()
+	size := len(ring.slots)
+	if n > size {
+		return max(r.Window(), 1)
+	}
+	count, _ := r.countUnsynced(ref)
+	excess := count + n - size
+	if excess <= 0 {
+		return 0
+	}
+
+	// the excess oldest events in the window must leave it; the last
+	// of them is the (count-excess)th newest event
+	next := ring.next.Load()
+	slot := &ring.slots[(next+uint64(size)-1-uint64(count-excess))%uint64(size)]
+	return fromUnixNano(slot.at.Load()).Add(r.Window()).Sub(ref)
+}
+
+// refund removes up to n of the events in the window from the reference
+// time, oldest first, so that they can be made again, e.g. because the
+// operation they stood for was rolled back. The oldest events are
+// removed because the ring is ordered by time. It returns the number of
+// events that were removed.
+func (r *ringBufferRateLimiter) refund(ref time.Time, n int) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ring := r.ring.Load()
+	size := uint64(len(ring.slots))
+	beginningOfWindow := unixNano(ref) - r.window.Load()
+
+	// like countUnsynced, but with the slots of the events in the window
+	// relative to the same ticket, since When may take new ones meanwhile
+	next := ring.next.Load()
+	type event struct {
+		slot *eventSlot
+		at   int64
+	}
+	var inWindow []event
+	for i := uint64(0); i < size; i++ {
+		slot := &ring.slots[(next+size-1-i)%size]
+		if i < next && slot.done.Load() <= next-1-i {
+			// the event is still being stored; it isn't refunded, but
+			// older events are
+			continue
+		}
+		at := slot.at.Load()
+		if at < beginningOfWindow {
+			break
 		}
+		inWindow = append(inWindow, event{slot, at})
 	}
 
-	// if we looped the entire ring, all events are within the window
-	return len(r.ring), r.ring[r.cursor]
+	var refunded int
+	for i := len(inWindow) - 1; i >= 0 && refunded < n; i-- {
+		// the slot may have been taken for a new event meanwhile
+		if inWindow[i].slot.at.CompareAndSwap(inWindow[i].at, noEvent) {
+			refunded++
+		}
+	}
+	return refunded
 }
 
-// Current time function, to be substituted by tests
-var now = time.Now
+// expired returns true if there are no events in the window from the
+// reference time, so the rate limiter can be forgotten.
+func (r *ringBufferRateLimiter) expired(ref time.Time) bool {
+	count, _ := r.countUnsynced(ref)
+	return count == 0
+}
+
+// idle returns true if there are no events within ttl before the
+// reference time, regardless of the window.
+func (r *ringBufferRateLimiter) idle(ref time.Time, ttl time.Duration) bool {
+	ring := r.ring.Load()
+	size := uint64(len(ring.slots))
+	if size == 0 {
+		return true
+	}
+	// like in countUnsynced, the newest event may still be being stored
+	next := ring.next.Load()
+	slot := &ring.slots[(next+size-1)%size]
+	if next > 0 && slot.done.Load() <= next-1 {
+		return false
+	}
+	return slot.at.Load() < unixNano(ref.Add(-ttl))
+}
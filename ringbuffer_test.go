@@ -15,6 +15,8 @@
 package caddyrl
 
 import (
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -46,7 +48,7 @@ func TestCount(t *testing.T) {
 		if count != i+1 {
 			t.Fatalf("count %d is wrong", count)
 		}
-		if oldest != startTime {
+		if !oldest.Equal(startTime) {
 			t.Fatalf("oldest time %+v is wrong", oldest)
 		}
 	}
@@ -59,7 +61,7 @@ func TestCount(t *testing.T) {
 	if count != bufSize {
 		t.Fatalf("count %d is wrong", count)
 	}
-	if oldest != startTime {
+	if !oldest.Equal(startTime) {
 		t.Fatalf("oldest time %+v is wrong", oldest)
 	}
 
@@ -71,7 +73,7 @@ func TestCount(t *testing.T) {
 	if count != bufSize/2 {
 		t.Fatalf("count %d is wrong", count)
 	}
-	if oldest != startTime.Add(time.Duration(bufSize/2)*time.Second) {
+	if !oldest.Equal(startTime.Add(time.Duration(bufSize/2) * time.Second)) {
 		t.Fatalf("oldest time %+v is wrong", oldest)
 	}
 
@@ -86,3 +88,280 @@ func TestCount(t *testing.T) {
 		t.Fatalf("oldest time %+v is wrong", oldest)
 	}
 }
+
+func TestWhenConcurrent(t *testing.T) {
+	initTime()
+
+	const maxEvents = 100
+	rb := newRingBufferRateLimiter(maxEvents, time.Minute)
+
+	// reservations of one and of several events at once race each other
+	var wg sync.WaitGroup
+	var allowed atomic.Int64
+	for i := 0; i < 8; i++ {
+		n := i%3 + 1
+		wg.Go(func() {
+			for j := 0; j < 50; j++ {
+				if _, wait := rb.reserveN(n, 0); wait == 0 {
+					allowed.Add(int64(n))
+				}
+			}
+		})
+	}
+	wg.Wait()
+
+	if n := allowed.Load(); n > maxEvents || n < maxEvents-2 {
+		t.Fatalf("expected the window to be filled with at most %d events, got %d", maxEvents, n)
+	}
+	if count, _ := rb.Count(now()); int64(count) != allowed.Load() {
+		t.Fatalf("expected the %d allowed events in the window, got %d", allowed.Load(), count)
+	}
+}
+
+func TestSetMaxEvents(t *testing.T) {
+	initTime()
+
+	rb := newRingBufferRateLimiter(3, 10*time.Second)
+	for i := 0; i < 3; i++ {
+		advanceTime(i)
+		rb.When()
+	}
+
+	// shrinking keeps the newest events
+	rb.SetMaxEvents(2)
+	count, oldest := rb.Count(now())
+	if count != 2 || !oldest.Equal(time.Unix(referenceTime+1, 0)) {
+		t.Fatalf("after shrinking: count %d, oldest %v", count, oldest)
+	}
+	if when := rb.When(); when == 0 {
+		t.Fatal("shrunk ring buffer should be full")
+	}
+
+	// growing makes room for new events right away
+	rb.SetMaxEvents(4)
+	if when := rb.When(); when != 0 {
+		t.Fatalf("grown ring buffer should allow events, but must wait %s", when)
+	}
+	if when := rb.When(); when != 0 {
+		t.Fatalf("grown ring buffer should allow events, but must wait %s", when)
+	}
+	if when := rb.When(); when != 9*time.Second {
+		t.Fatalf("full ring buffer should forbid events until the oldest expires, got %s", when)
+	}
+}
+
+func TestEventRingReuse(t *testing.T) {
+	initTime()
+
+	rb := newRingBufferRateLimiter(4, time.Minute)
+	for range 4 {
+		rb.When()
+	}
+	ring := rb.ring.Load()
+
+	// a similar size reuses the ring, emptied
+	reused := ring.reuse(3)
+	if reused != ring {
+		t.Fatal("expected ring to be reused")
+	}
+	rb.ring.Store(reused)
+	if count, _ := rb.Count(now()); count != 0 {
+		t.Fatalf("reused ring should be empty, has %d events", count)
+	}
+	for i := range 3 {
+		if when := rb.When(); when != 0 {
+			t.Fatalf("event %d in reused ring should be allowed, must wait %s", i, when)
+		}
+	}
+	if when := rb.When(); when == 0 {
+		t.Fatal("reused ring should be full")
+	}
+
+	// a much larger or much smaller size gets a new ring
+	if ring.reuse(10) == ring || ring.reuse(1) == ring {
+		t.Fatal("expected a new ring for a very different size")
+	}
+}
+
+func TestRefund(t *testing.T) {
+	initTime()
+
+	rb := newRingBufferRateLimiter(3, time.Minute)
+	for i := range 3 {
+		rb.When()
+		advanceTime(10 * (i + 1))
+	}
+	if when := rb.When(); when != 30*time.Second {
+		t.Fatalf("full window should have to wait 30s, must wait %s", when)
+	}
+
+	// the oldest events are refunded, so the window still ends with the
+	// remaining oldest one
+	if refunded := rb.refund(now(), 2); refunded != 2 {
+		t.Fatalf("expected 2 events to be refunded, got %d", refunded)
+	}
+	if count, oldest := rb.Count(now()); count != 1 || !oldest.Equal(now().Add(-10*time.Second)) {
+		t.Fatalf("expected newest event to remain, have %d events from %s", count, oldest)
+	}
+
+	// refunds are bounded by the events in the window
+	if refunded := rb.refund(now(), 5); refunded != 1 {
+		t.Fatalf("expected 1 event to be refunded, got %d", refunded)
+	}
+	for i := range 3 {
+		if when := rb.When(); when != 0 {
+			t.Fatalf("event %d after refunds should be allowed, must wait %s", i, when)
+		}
+	}
+}
+
+func BenchmarkWhenHotKey(b *testing.B) {
+	rb := newRingBufferRateLimiter(1000, time.Nanosecond)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			rb.When()
+		}
+	})
+}
+
+// TestWindowBoundaries checks that the ways of limiting events agree at
+// the edges of the window: When, which reserves as it checks; waitUnsynced
+// followed by reserve, which zones with total_max_events use; and the
+// window of simulations.
+func TestWindowBoundaries(t *testing.T) {
+	const window = 10 * time.Second
+	start := time.Unix(referenceTime, 0)
+
+	for _, tc := range []struct {
+		name      string
+		maxEvents int
+		window    time.Duration
+		events    []time.Duration // offsets from start
+		at        time.Duration
+		wantWait  time.Duration // 0 if allowed
+		wantCount int
+	}{
+		{name: "empty", maxEvents: 1, window: window, at: 0, wantWait: 0, wantCount: 0},
+		{name: "not full", maxEvents: 2, window: window, events: []time.Duration{0}, at: time.Second, wantWait: 0, wantCount: 1},
+		{name: "just within the window", maxEvents: 1, window: window, events: []time.Duration{0}, at: window - 1, wantWait: 1, wantCount: 1},
+		{name: "exactly one window later", maxEvents: 1, window: window, events: []time.Duration{0}, at: window, wantWait: 0, wantCount: 1},
+		{name: "past the window", maxEvents: 1, window: window, events: []time.Duration{0}, at: window + 1, wantWait: 0, wantCount: 0},
+		{name: "oldest leaves", maxEvents: 2, window: window, events: []time.Duration{0, 5 * time.Second}, at: window, wantWait: 0, wantCount: 2},
+		{name: "waits for oldest", maxEvents: 2, window: window, events: []time.Duration{0, 5 * time.Second}, at: 9 * time.Second, wantWait: time.Second, wantCount: 2},
+		{name: "ring wrapped", maxEvents: 2, window: window, events: []time.Duration{0, 5 * time.Second, 11 * time.Second}, at: 14 * time.Second, wantWait: time.Second, wantCount: 2},
+		{name: "no events allowed", maxEvents: 0, window: window, at: 0, wantWait: window, wantCount: 0},
+		{name: "zero window", maxEvents: 1, window: 0, events: []time.Duration{0}, at: 0, wantWait: 0, wantCount: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			clock := useTestClock(t, start)
+
+			when := newRingBufferRateLimiter(tc.maxEvents, tc.window)
+			reserved := newRingBufferRateLimiter(tc.maxEvents, tc.window)
+			var simulated simulatedWindow
+			for _, offset := range tc.events {
+				clock.set(start.Add(offset))
+				if wait := when.When(); wait != 0 {
+					t.Fatalf("event at %v: expected to be allowed, got wait %v", offset, wait)
+				}
+				if wait := reserved.waitUnsynced(now()); wait != 0 {
+					t.Fatalf("event at %v: expected wait 0, got %v", offset, wait)
+				}
+				reserved.reserve()
+				if simulated.full(now(), tc.maxEvents, tc.window) {
+					t.Fatalf("event at %v: expected the simulated window not to be full", offset)
+				}
+				simulated.add(now(), tc.maxEvents)
+			}
+
+			clock.set(start.Add(tc.at))
+			if count, _ := when.Count(now()); count != tc.wantCount {
+				t.Errorf("expected count %d, got %d", tc.wantCount, count)
+			}
+			if wait := reserved.waitUnsynced(now()); wait != tc.wantWait {
+				t.Errorf("waitUnsynced: expected wait %v, got %v", tc.wantWait, wait)
+			}
+			if full := simulated.full(now(), tc.maxEvents, tc.window); full != (tc.wantWait > 0) {
+				t.Errorf("simulated window: expected full to be %t, got %t", tc.wantWait > 0, full)
+			}
+			next := when.ring.Load().next.Load()
+			wait := when.When()
+			if wait != tc.wantWait {
+				t.Errorf("When: expected wait %v, got %v", tc.wantWait, wait)
+			}
+			if reservedEvent := when.ring.Load().next.Load() != next; reservedEvent != (wait == 0) {
+				t.Errorf("When: expected a reservation to be made only if the event is allowed, got wait %v and reservation %t", wait, reservedEvent)
+			}
+		})
+	}
+}
+
+// FuzzRingBuffer applies sequences of operations to a rate limiter and
+// checks that it never panics or counts more events than it allows.
+// Each pair of bytes is an operation and its argument.
+func FuzzRingBuffer(f *testing.F) {
+	f.Add([]byte{1, 0, 1, 0, 1, 0, 4, 0})
+	f.Add([]byte{1, 0, 0, 200, 2, 3, 1, 0, 3, 10, 1, 0, 4, 0})
+	f.Add([]byte{2, 0, 1, 0, 2, 255, 1, 0, 5, 0, 4, 0})
+	f.Add([]byte{3, 0, 1, 0, 1, 0, 0, 1, 2, 1, 4, 0})
+
+	f.Fuzz(func(t *testing.T, ops []byte) {
+		clock := useTestClock(t, time.Unix(referenceTime, 0))
+		rb := newRingBufferRateLimiter(4, 100*time.Millisecond)
+
+		for i := 0; i+1 < len(ops); i += 2 {
+			arg := int(ops[i+1])
+			switch ops[i] % 6 {
+			case 0:
+				clock.advance(time.Duration(arg) * time.Millisecond)
+			case 1:
+				if wait := rb.When(); wait < 0 {
+					t.Fatalf("negative wait %v", wait)
+				} else if wait > max(rb.Window(), 1) {
+					t.Fatalf("wait %v is longer than the window %v", wait, rb.Window())
+				}
+			case 2:
+				rb.SetMaxEvents(arg % 32)
+			case 3:
+				rb.SetWindow(time.Duration(arg) * time.Millisecond)
+			case 4:
+				if wait := rb.waitUnsynced(now()); wait < 0 {
+					t.Fatalf("negative wait %v", wait)
+				} else if wait == 0 {
+					rb.reserve()
+				}
+			case 5:
+				if _, oldest := rb.Count(now()); oldest.After(now()) {
+					t.Fatalf("oldest event %v is in the future", oldest)
+				}
+			}
+			if count, _ := rb.Count(now()); count < 0 || count > rb.MaxEvents() {
+				t.Fatalf("count %d is out of range for %d max events", count, rb.MaxEvents())
+			}
+		}
+	})
+}
+
+func TestSubSecondWindow(t *testing.T) {
+	clock := useTestClock(t, time.Unix(referenceTime, 0))
+
+	rb := newRingBufferRateLimiter(2, 100*time.Millisecond)
+	for range 2 {
+		if when := rb.When(); when != 0 {
+			t.Fatalf("expected event to be allowed, got wait %v", when)
+		}
+		clock.advance(30 * time.Millisecond)
+	}
+	if when := rb.When(); when != 40*time.Millisecond {
+		t.Errorf("expected to wait until 100ms after the first event, got %v", when)
+	}
+	clock.advance(40 * time.Millisecond)
+	if when := rb.When(); when != 0 {
+		t.Errorf("expected an event to be allowed once the first left the window, got wait %v", when)
+	}
+	if count, oldest := rb.Count(now()); count != 2 || !oldest.Equal(time.Unix(referenceTime, int64(30*time.Millisecond))) {
+		t.Errorf("expected 2 events since 30ms, got %d since %v", count, oldest)
+	}
+	if ms := ceilMilliseconds(rb.waitUnsynced(now().Add(time.Microsecond))); ms != 30 {
+		t.Errorf("expected a wait of 30ms, rounded up, got %dms", ms)
+	}
+}
@@ -0,0 +1,186 @@
+package caddyrl
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// LimitSchedule gives a zone another max_events on certain days of the
+// week and times of day, e.g. stricter limits overnight when only bots
+// are around.
+type LimitSchedule struct {
+	// The name of the schedule, which the schedule_active metric reports.
+	// This name is **required**.
+	Name string `json:"name,omitempty"`
+
+	// Days of the week on which the schedule is active, by their first
+	// three letters, e.g. `["sat", "sun"]`. Default: every day
+	Days []string `json:"days,omitempty"`
+
+	// Time of day from which the schedule is active, in the form `15:04`.
+	// Default: `00:00`
+	From string `json:"from,omitempty"`
+
+	// Time of day until which the schedule is active, exclusive. If it is
+	// before from, the schedule extends past midnight into the next day.
+	// Default: `24:00`
+	To string `json:"to,omitempty"`
+
+	// Number of events allowed within the zone's window while the
+	// schedule is active.
+	MaxEvents int `json:"max_events,omitempty"`
+
+	days     [7]bool // indexed by time.Weekday
+	from, to int     // minutes since midnight
+}
+
+// weekdays maps the names of days of the week to their time.Weekday.
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func (s *LimitSchedule) provision() error {
+	if s.Name == "" {
+		return fmt.Errorf("name is empty or missing")
+	}
+	if s.MaxEvents < 0 {
+		return fmt.Errorf("schedule %s: max_events must be at least zero", s.Name)
+	}
+
+	if len(s.Days) == 0 {
+		s.days = [7]bool{true, true, true, true, true, true, true}
+	}
+	for _, day := range s.Days {
+		weekday, ok := weekdays[strings.ToLower(day)]
+		if !ok {
+			return fmt.Errorf("schedule %s: unknown day of the week '%s'", s.Name, day)
+		}
+		s.days[weekday] = true
+	}
+
+	var err error
+	if s.from, err = parseTimeOfDay(s.From, 0); err != nil {
+		return fmt.Errorf("schedule %s: invalid from: %v", s.Name, err)
+	}
+	if s.to, err = parseTimeOfDay(s.To, 24*60); err != nil {
+		return fmt.Errorf("schedule %s: invalid to: %v", s.Name, err)
+	}
+	if s.from == s.to {
+		return fmt.Errorf("schedule %s: from and to must be different", s.Name)
+	}
+
+	return nil
+}
+
+// parseTimeOfDay returns the minutes since midnight of a time of day of
+// the form `15:04`, or def if it is empty.
+func parseTimeOfDay(value string, def int) (int, error) {
+	if value == "" {
+		return def, nil
+	}
+	if value == "24:00" {
+		return 24 * 60, nil
+	}
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("time of day '%s' must be of the form 15:04", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// activeAt returns true if the schedule is active at t, which must be in
+// the zone's time zone.
+func (s *LimitSchedule) activeAt(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	if s.from < s.to {
+		return s.days[t.Weekday()] && minute >= s.from && minute < s.to
+	}
+	// past midnight, the schedule belongs to the day it started on
+	return s.days[t.Weekday()] && minute >= s.from ||
+		s.days[(t.Weekday()+6)%7] && minute < s.to
+}
+
+// provisionSchedules sets up the zone's schedules and time zone.
+func (rl *RateLimit) provisionSchedules() error {
+	rl.location = time.Local
+	if rl.Timezone != "" {
+		location, err := time.LoadLocation(rl.Timezone)
+		if err != nil {
+			return fmt.Errorf("loading timezone '%s': %v", rl.Timezone, err)
+		}
+		rl.location = location
+	}
+
+	names := make(map[string]struct{}, len(rl.Schedules))
+	for _, schedule := range rl.Schedules {
+		if err := schedule.provision(); err != nil {
+			return err
+		}
+		if _, ok := names[schedule.Name]; ok {
+			return fmt.Errorf("schedule %s is defined more than once", schedule.Name)
+		}
+		names[schedule.Name] = struct{}{}
+	}
+	return nil
+}
+
+// maxEventsAt returns the zone's max_events at t and the name of the
+// schedule it is from, which is the first one active at t. If none is,
+// the name is empty.
+func (rl *RateLimit) maxEventsAt(t time.Time) (int, string) {
+	if len(rl.Schedules) == 0 {
+		return rl.MaxEvents, ""
+	}
+	t = t.In(rl.location)
+	for _, schedule := range rl.Schedules {
+		if schedule.activeAt(t) {
+			return schedule.MaxEvents, schedule.Name
+		}
+	}
+	return rl.MaxEvents, ""
+}
+
+// scheduleInterval is how often zones check whether another schedule
+// has become active.
+const scheduleInterval = 10 * time.Second
+
+// applySchedules periodically applies the limits of the schedules of the
+// given zones until ctx is done.
+func (h Handler) applySchedules(ctx context.Context, zones []*RateLimit) {
+	labelTask(ctx, "schedule")
+	ticker := time.NewTicker(scheduleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, rl := range zones {
+				rl.forEachZone(h.applySchedule)
+			}
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// applySchedule applies the limits of the schedule that is active now
+// to the zone, if it has changed.
+func (h Handler) applySchedule(rl *RateLimit) {
+	maxEvents, schedule := rl.maxEventsAt(now())
+	if schedule == rl.schedule {
+		return
+	}
+	rl.schedule = schedule
+	_, window := rl.limitersMap.limits()
+	rl.limitersMap.updateAll(maxEvents, window)
+	h.metrics.updateActiveSchedule(rl.ZoneName, rl.Schedules, schedule)
+}
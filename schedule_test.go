@@ -0,0 +1,61 @@
+package caddyrl
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimitSchedules(t *testing.T) {
+	rl := &RateLimit{
+		MaxEvents: 10,
+		Timezone:  "America/New_York",
+		Schedules: []*LimitSchedule{
+			{Name: "business_hours", Days: []string{"mon", "tue", "wed", "thu", "fri"}, From: "08:00", To: "18:00", MaxEvents: 100},
+			{Name: "overnight", Days: []string{"fri"}, From: "22:00", To: "06:00", MaxEvents: 1},
+		},
+	}
+	if err := rl.provisionSchedules(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	location, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("time zone database not available: %v", err)
+	}
+	for _, tc := range []struct {
+		time      string
+		maxEvents int
+		schedule  string
+	}{
+		{"2026-10-16 08:00", 100, "business_hours"}, // Friday
+		{"2026-10-16 17:59", 100, "business_hours"},
+		{"2026-10-16 18:00", 10, ""},
+		{"2026-10-16 23:30", 1, "overnight"},
+		{"2026-10-17 05:59", 1, "overnight"}, // Saturday, after Friday night
+		{"2026-10-17 10:00", 10, ""},
+		{"2026-10-18 23:30", 10, ""}, // Sunday night
+	} {
+		ref, err := time.ParseInLocation("2006-01-02 15:04", tc.time, location)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the schedules are evaluated in the zone's time zone
+		maxEvents, schedule := rl.maxEventsAt(ref.UTC())
+		if maxEvents != tc.maxEvents || schedule != tc.schedule {
+			t.Errorf("at %s: expected %d events of schedule '%s', got %d of '%s'",
+				tc.time, tc.maxEvents, tc.schedule, maxEvents, schedule)
+		}
+	}
+
+	for _, schedule := range []*LimitSchedule{
+		{Name: "a", Days: []string{"someday"}},
+		{Name: "b", From: "8am"},
+		{Name: "c", From: "10:00", To: "10:00"},
+		{From: "10:00"},
+	} {
+		rl := &RateLimit{Schedules: []*LimitSchedule{schedule}}
+		if err := rl.provisionSchedules(); err == nil {
+			t.Errorf("expected an error for schedule %+v", schedule)
+		}
+	}
+}
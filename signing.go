@@ -0,0 +1,146 @@
+package caddyrl
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// signingTierDefault is the tier of requests that aren't signed, or
+// whose signature isn't valid.
+const signingTierDefault = "default"
+
+// RequestSigning verifies requests that clients sign with a shared
+// secret, and sets the `{http.rate_limit.tier}` placeholder to the tier
+// of the secret's key, so that zones can give partners higher limits
+// without authentication of their own. Requests that aren't signed, or
+// whose signature isn't valid, are of the `default` tier.
+//
+// A request is signed with the header
+// `<key id>:<unix time>:<signature>`, where the signature is the hex
+// encoded HMAC-SHA256 of `<unix time>\n<method>\n<host><request URI>`.
+// Request bodies aren't signed.
+type RequestSigning struct {
+	// The keys that requests may be signed with. At least one is
+	// required.
+	Keys []*SigningKey `json:"keys,omitempty"`
+
+	// The header of the signature. Default: X-Signature
+	Header string `json:"header,omitempty"`
+
+	// How far the time of a signature may be from the time the request
+	// is received, in either direction, which limits how long a captured
+	// signature can be replayed. Default: 5m
+	MaxSkew caddy.Duration `json:"max_skew,omitempty"`
+
+	keys map[string]*SigningKey
+}
+
+// SigningKey is a key that clients sign requests with.
+type SigningKey struct {
+	// The ID of the key, which signatures name and which the
+	// `{http.rate_limit.signer}` placeholder is set to. Required.
+	ID string `json:"id"`
+
+	// The shared secret. Placeholders, e.g. of environment variables,
+	// are replaced once. Required.
+	Secret string `json:"secret"`
+
+	// The tier of requests signed with the key. Default: signed
+	Tier string `json:"tier,omitempty"`
+
+	secret []byte
+}
+
+func (rs *RequestSigning) provision() error {
+	if len(rs.Keys) == 0 {
+		return fmt.Errorf("at least one key is required")
+	}
+	repl := caddy.NewReplacer()
+	rs.keys = make(map[string]*SigningKey, len(rs.Keys))
+	for i, key := range rs.Keys {
+		if key.ID == "" || strings.Contains(key.ID, ":") {
+			return fmt.Errorf("key %d: id is required and must not contain ':'", i)
+		}
+		if _, ok := rs.keys[key.ID]; ok {
+			return fmt.Errorf("key %d: duplicate id '%s'", i, key.ID)
+		}
+		secret := repl.ReplaceKnown(key.Secret, "")
+		if secret == "" {
+			return fmt.Errorf("key %d: secret is required", i)
+		}
+		key.secret = []byte(secret)
+		if key.Tier == "" {
+			key.Tier = "signed"
+		}
+		if key.Tier == signingTierDefault {
+			return fmt.Errorf("key %d: tier must not be '%s'", i, signingTierDefault)
+		}
+		rs.keys[key.ID] = key
+	}
+	if rs.Header == "" {
+		rs.Header = "X-Signature"
+	}
+	if rs.MaxSkew < 0 {
+		return fmt.Errorf("max_skew must be at least zero")
+	}
+	if rs.MaxSkew == 0 {
+		rs.MaxSkew = caddy.Duration(5 * time.Minute)
+	}
+	return nil
+}
+
+// signer returns the key that r is signed with, or nil if r isn't
+// signed or its signature isn't valid.
+func (rs *RequestSigning) signer(r *http.Request) *SigningKey {
+	header := r.Header.Get(rs.Header)
+	if header == "" {
+		return nil
+	}
+	id, rest, _ := strings.Cut(header, ":")
+	unix, signature, ok := strings.Cut(rest, ":")
+	if !ok {
+		return nil
+	}
+	key := rs.keys[id]
+	if key == nil {
+		return nil
+	}
+	seconds, err := strconv.ParseInt(unix, 10, 64)
+	if err != nil {
+		return nil
+	}
+	if skew := now().Sub(time.Unix(seconds, 0)); skew > time.Duration(rs.MaxSkew) || skew < -time.Duration(rs.MaxSkew) {
+		return nil
+	}
+	want, err := hex.DecodeString(signature)
+	if err != nil || !hmac.Equal(want, key.sign(unix, r)) {
+		return nil
+	}
+	return key
+}
+
+// sign returns the signature of r at the Unix time unix.
+func (key *SigningKey) sign(unix string, r *http.Request) []byte {
+	mac := hmac.New(sha256.New, key.secret)
+	mac.Write([]byte(unix + "\n" + r.Method + "\n" + r.Host + r.URL.RequestURI()))
+	return mac.Sum(nil)
+}
+
+// setPlaceholders sets the placeholders of the tier and signer of r.
+func (rs *RequestSigning) setPlaceholders(repl *caddy.Replacer, r *http.Request) {
+	if key := rs.signer(r); key != nil {
+		repl.Set("http.rate_limit.tier", key.Tier)
+		repl.Set("http.rate_limit.signer", key.ID)
+		return
+	}
+	repl.Set("http.rate_limit.tier", signingTierDefault)
+	repl.Set("http.rate_limit.signer", "")
+}
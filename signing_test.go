@@ -0,0 +1,108 @@
+package caddyrl
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestRequestSigning(t *testing.T) {
+	initTime()
+
+	rs := &RequestSigning{
+		Keys: []*SigningKey{
+			{ID: "acme", Secret: "acme-secret", Tier: "partner"},
+			{ID: "globex", Secret: "globex-secret"},
+		},
+	}
+	if err := rs.provision(); err != nil {
+		t.Fatal(err)
+	}
+
+	// signatures are computed as clients would, independently of sign
+	signed := func(id, secret string, at time.Time, method, target string) *http.Request {
+		r := httptest.NewRequest(method, target, nil)
+		unix := strconv.FormatInt(at.Unix(), 10)
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(unix + "\n" + method + "\n" + r.Host + r.URL.RequestURI()))
+		r.Header.Set("X-Signature", id+":"+unix+":"+hex.EncodeToString(mac.Sum(nil)))
+		return r
+	}
+	tier := func(r *http.Request) (string, string) {
+		repl := caddy.NewReplacer()
+		rs.setPlaceholders(repl, r)
+		tier, _ := repl.GetString("http.rate_limit.tier")
+		signer, _ := repl.GetString("http.rate_limit.signer")
+		return tier, signer
+	}
+
+	for i, test := range []struct {
+		r            *http.Request
+		tier, signer string
+	}{
+		{signed("acme", "acme-secret", now(), "GET", "/items?page=2"), "partner", "acme"},
+		{signed("globex", "globex-secret", now().Add(-4*time.Minute), "POST", "/items"), "signed", "globex"},
+		{httptest.NewRequest("GET", "/items", nil), signingTierDefault, ""},
+		// wrong secret, unknown key, and expired or future signatures
+		{signed("acme", "globex-secret", now(), "GET", "/items"), signingTierDefault, ""},
+		{signed("initech", "acme-secret", now(), "GET", "/items"), signingTierDefault, ""},
+		{signed("acme", "acme-secret", now().Add(-6*time.Minute), "GET", "/items"), signingTierDefault, ""},
+		{signed("acme", "acme-secret", now().Add(6*time.Minute), "GET", "/items"), signingTierDefault, ""},
+	} {
+		if tier, signer := tier(test.r); tier != test.tier || signer != test.signer {
+			t.Errorf("test %d: expected tier %q of signer %q, got %q of %q", i, test.tier, test.signer, tier, signer)
+		}
+	}
+
+	// a signature doesn't carry over to another request
+	r := signed("acme", "acme-secret", now(), "GET", "/items")
+	r.URL.RawQuery = "page=3"
+	if tier, _ := tier(r); tier != signingTierDefault {
+		t.Errorf("expected the signature of another URI to be rejected, got tier %q", tier)
+	}
+
+	for _, keys := range [][]*SigningKey{
+		nil,
+		{{Secret: "s"}},
+		{{ID: "a:b", Secret: "s"}},
+		{{ID: "a"}},
+		{{ID: "a", Secret: "s"}, {ID: "a", Secret: "t"}},
+		{{ID: "a", Secret: "s", Tier: signingTierDefault}},
+	} {
+		if err := (&RequestSigning{Keys: keys}).provision(); err == nil {
+			t.Errorf("expected an error for keys %+v", keys)
+		}
+	}
+}
+
+func TestCaddyfileSigning(t *testing.T) {
+	var h Handler
+	if err := h.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`rate_limit {
+		signing {
+			key      acme secret partner
+			key      globex other
+			header   X-Partner-Signature
+			max_skew 1m
+		}
+	}`)); err != nil {
+		t.Fatalf("unmarshaling Caddyfile: %v", err)
+	}
+	rs := h.Signing
+	if rs == nil || len(rs.Keys) != 2 || rs.Header != "X-Partner-Signature" || rs.MaxSkew != caddy.Duration(time.Minute) {
+		t.Fatalf("unexpected signing: %+v", rs)
+	}
+	if key := rs.Keys[0]; key.ID != "acme" || key.Secret != "secret" || key.Tier != "partner" {
+		t.Errorf("unexpected key: %+v", key)
+	}
+	if key := rs.Keys[1]; key.ID != "globex" || key.Tier != "" {
+		t.Errorf("unexpected key: %+v", key)
+	}
+}
@@ -0,0 +1,407 @@
+package caddyrl
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+)
+
+func cmdSimulate(fl caddycmd.Flags) (int, error) {
+	configFlag := fl.String("config")
+	configAdapterFlag := fl.String("adapter")
+	zoneFlag := fl.String("zone")
+	replayFlag := fl.String("replay")
+	keyFieldFlag := fl.String("key-field")
+	keysFlag := fl.Int("keys")
+	rateFlag := fl.Float64("rate")
+	topFlag := fl.Int("top")
+
+	rl := new(RateLimit)
+	if configFlag != "" {
+		if zoneFlag == "" {
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("--zone is required with --config")
+		}
+		config, _, _, err := caddycmd.LoadConfig(configFlag, configAdapterFlag)
+		if err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+		if rl, err = findZoneConfig(config, zoneFlag); err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+	}
+	if fl.Changed("max-events") {
+		rl.MaxEvents = fl.Int("max-events")
+	}
+	if fl.Changed("window") {
+		rl.Window = caddy.Duration(fl.Duration("window"))
+	}
+	if fl.Changed("total-max-events") {
+		rl.TotalMaxEvents = fl.Int("total-max-events")
+	}
+	if rl.MaxEvents < 0 || rl.Window <= 0 || rl.TotalMaxEvents < 0 {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("a window and max_events are required, from --config and --zone or from --window and --max-events")
+	}
+
+	var requests []simulatedRequest
+	switch {
+	case replayFlag != "":
+		in := os.Stdin
+		if replayFlag != "-" {
+			file, err := os.Open(replayFlag)
+			if err != nil {
+				return caddy.ExitCodeFailedStartup, err
+			}
+			defer file.Close()
+			in = file
+		}
+		var err error
+		if requests, err = readReplay(in, keyFieldFlag); err != nil {
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("reading %s: %v", replayFlag, err)
+		}
+	case rateFlag > 0:
+		duration := fl.Duration("duration")
+		if duration <= 0 {
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("--duration must be greater than zero")
+		}
+		if keysFlag < 1 {
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("--keys must be at least 1")
+		}
+		requests = syntheticRequests(keysFlag, rateFlag, duration)
+	default:
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("a request pattern is required, from --replay or from --rate")
+	}
+
+	result := simulate(rl, requests)
+	if err := writeSimulationReport(os.Stdout, rl, result, topFlag); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	return caddy.ExitCodeSuccess, nil
+}
+
+// findZoneConfig returns the zone of the given name from a JSON config,
+// with the fields that it inherits from its policy and the defaults of
+// the rate_limit app, like the handler provisions it.
+func findZoneConfig(config []byte, zoneName string) (*RateLimit, error) {
+	zones, err := findZoneConfigs(config)
+	if err != nil {
+		return nil, err
+	}
+	for _, rl := range zones {
+		if rl.ZoneName == zoneName {
+			return rl, nil
+		}
+	}
+	return nil, fmt.Errorf("zone %s not found in config", zoneName)
+}
+
+// findZoneConfigs returns the zones of a JSON config, one definition of
+// each name, sorted by name, with the fields that they inherit from
+// their policies and the defaults of the rate_limit app.
+func findZoneConfigs(config []byte) ([]*RateLimit, error) {
+	var root any
+	if err := json.Unmarshal(config, &root); err != nil {
+		return nil, fmt.Errorf("decoding config: %v", err)
+	}
+
+	var found []*RateLimit
+	seen := make(map[string]bool)
+	var walk func(v any) error
+	walk = func(v any) error {
+		switch v := v.(type) {
+		case map[string]any:
+			if v["handler"] == "rate_limit" {
+				encoded, _ := json.Marshal(v["rate_limits"])
+				var zones []*RateLimit
+				if err := json.Unmarshal(encoded, &zones); err != nil {
+					return fmt.Errorf("decoding rate limits: %v", err)
+				}
+				for _, rl := range zones {
+					if !seen[rl.ZoneName] {
+						seen[rl.ZoneName] = true
+						found = append(found, rl)
+					}
+				}
+			}
+			for _, child := range v {
+				if err := walk(child); err != nil {
+					return err
+				}
+			}
+		case []any:
+			for _, child := range v {
+				if err := walk(child); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := walk(root); err != nil {
+		return nil, err
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].ZoneName < found[j].ZoneName })
+
+	var app RateLimitApp
+	if apps, ok := root.(map[string]any)["apps"].(map[string]any); ok && apps["rate_limit"] != nil {
+		encoded, _ := json.Marshal(apps["rate_limit"])
+		if err := json.Unmarshal(encoded, &app); err != nil {
+			return nil, fmt.Errorf("decoding rate_limit app: %v", err)
+		}
+	}
+	for _, rl := range found {
+		if rl.Policy != "" {
+			policy, ok := app.Policies[rl.Policy]
+			if !ok {
+				return nil, fmt.Errorf("rate limit %s: unknown policy '%s'", rl.ZoneName, rl.Policy)
+			}
+			rl.inherit(policy)
+		}
+		if app.Defaults.Zone != nil {
+			rl.inherit(app.Defaults.Zone)
+		}
+	}
+	return found, nil
+}
+
+// simulatedRequest is a request of a key at a point in time.
+type simulatedRequest struct {
+	at  time.Time
+	key string
+}
+
+// syntheticRequests returns the requests of keys that each make rate
+// requests per second, evenly spaced, for duration. The keys are offset
+// from each other so that they don't all make requests at once.
+func syntheticRequests(keys int, rate float64, duration time.Duration) []simulatedRequest {
+	start := time.Unix(0, 0)
+	interval := time.Duration(float64(time.Second) / rate)
+	var requests []simulatedRequest
+	for i := range keys {
+		key := "key" + strconv.Itoa(i+1)
+		for at := interval * time.Duration(i) / time.Duration(keys); at < duration; at += interval {
+			requests = append(requests, simulatedRequest{at: start.Add(at), key: key})
+		}
+	}
+	sort.SliceStable(requests, func(i, j int) bool { return requests[i].at.Before(requests[j].at) })
+	return requests
+}
+
+// readReplay reads requests to replay, one per line: either JSON
+// objects like those of Caddy's access logs, with the time in `ts` and
+// the key in the field that keyField names with dots, or a timestamp
+// (RFC 3339 or Unix seconds) and a key separated by whitespace. Empty
+// lines and lines starting with # are skipped.
+func readReplay(r io.Reader, keyField string) ([]simulatedRequest, error) {
+	var requests []simulatedRequest
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		var req simulatedRequest
+		var err error
+		if strings.HasPrefix(text, "{") {
+			req, err = parseReplayJSON(text, keyField)
+		} else {
+			req, err = parseReplayLine(text)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		requests = append(requests, req)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(requests, func(i, j int) bool { return requests[i].at.Before(requests[j].at) })
+	return requests, nil
+}
+
+func parseReplayJSON(text, keyField string) (simulatedRequest, error) {
+	var entry map[string]any
+	if err := json.Unmarshal([]byte(text), &entry); err != nil {
+		return simulatedRequest{}, err
+	}
+	ts, ok := entry["ts"].(float64)
+	if !ok {
+		return simulatedRequest{}, fmt.Errorf("missing ts")
+	}
+	var value any = entry
+	for _, field := range strings.Split(keyField, ".") {
+		object, ok := value.(map[string]any)
+		if !ok {
+			value = nil
+			break
+		}
+		value = object[field]
+	}
+	if value == nil {
+		return simulatedRequest{}, fmt.Errorf("missing %s", keyField)
+	}
+	return simulatedRequest{at: unixSeconds(ts), key: fmt.Sprint(value)}, nil
+}
+
+func parseReplayLine(text string) (simulatedRequest, error) {
+	i := strings.IndexAny(text, " \t")
+	if i < 0 {
+		return simulatedRequest{}, fmt.Errorf("expected a timestamp and a key")
+	}
+	timestamp := text[:i]
+	req := simulatedRequest{key: strings.TrimSpace(text[i:])}
+	if seconds, err := strconv.ParseFloat(timestamp, 64); err == nil {
+		req.at = unixSeconds(seconds)
+	} else if req.at, err = time.Parse(time.RFC3339Nano, timestamp); err != nil {
+		return simulatedRequest{}, fmt.Errorf("invalid timestamp '%s'", timestamp)
+	}
+	return req, nil
+}
+
+func unixSeconds(seconds float64) time.Time {
+	whole, frac := math.Modf(seconds)
+	return time.Unix(int64(whole), int64(frac*1e9))
+}
+
+// simulatedWindow is the sliding window of a simulated rate limiter.
+// Like ringBufferRateLimiter, it remembers the times of the last
+// maxEvents events.
+type simulatedWindow struct {
+	events []time.Time // ring buffer
+	next   int
+}
+
+// full returns true if an event at ref would exceed maxEvents in the
+// window that ends at ref.
+func (sw *simulatedWindow) full(ref time.Time, maxEvents int, window time.Duration) bool {
+	if maxEvents == 0 {
+		return true
+	}
+	if len(sw.events) < maxEvents {
+		return false
+	}
+	return sw.events[sw.next].After(ref.Add(-window))
+}
+
+// add records an event at ref.
+func (sw *simulatedWindow) add(ref time.Time, maxEvents int) {
+	if len(sw.events) < maxEvents {
+		sw.events = append(sw.events, ref)
+		return
+	}
+	sw.events[sw.next] = ref
+	sw.next = (sw.next + 1) % maxEvents
+}
+
+type simulationResult struct {
+	Requests int
+	Declined int
+	Start    time.Time
+	End      time.Time
+	Keys     map[string]*simulatedKey
+}
+
+type simulatedKey struct {
+	Requests int
+	Declined int
+}
+
+// simulate replays requests, which must be in chronological order,
+// against the limits of rl and counts the requests that would have been
+// declined.
+func simulate(rl *RateLimit, requests []simulatedRequest) simulationResult {
+	window := time.Duration(rl.Window)
+	result := simulationResult{Keys: make(map[string]*simulatedKey)}
+	windows := make(map[string]*simulatedWindow)
+	var total simulatedWindow
+
+	for _, req := range requests {
+		if result.Requests == 0 {
+			result.Start = req.at
+		}
+		result.End = req.at
+		result.Requests++
+		key, ok := result.Keys[req.key]
+		if !ok {
+			key = new(simulatedKey)
+			result.Keys[req.key] = key
+			windows[req.key] = new(simulatedWindow)
+		}
+		key.Requests++
+
+		sw := windows[req.key]
+		if sw.full(req.at, rl.MaxEvents, window) ||
+			(rl.TotalMaxEvents > 0 && total.full(req.at, rl.TotalMaxEvents, window)) {
+			result.Declined++
+			key.Declined++
+			continue
+		}
+		sw.add(req.at, rl.MaxEvents)
+		if rl.TotalMaxEvents > 0 {
+			total.add(req.at, rl.TotalMaxEvents)
+		}
+	}
+	return result
+}
+
+// writeSimulationReport prints the result of a simulation, with up to
+// top of the keys with the most declined requests.
+func writeSimulationReport(w io.Writer, rl *RateLimit, result simulationResult, top int) error {
+	limit := fmt.Sprintf("%d per %s", rl.MaxEvents, time.Duration(rl.Window))
+	if rl.TotalMaxEvents > 0 {
+		limit += fmt.Sprintf(", %d in total", rl.TotalMaxEvents)
+	}
+	if rl.ZoneName != "" {
+		limit = rl.ZoneName + ": " + limit
+	}
+	fmt.Fprintln(w, limit)
+
+	var declinedKeys []string
+	for name, key := range result.Keys {
+		if key.Declined > 0 {
+			declinedKeys = append(declinedKeys, name)
+		}
+	}
+	sort.Slice(declinedKeys, func(i, j int) bool {
+		a, b := result.Keys[declinedKeys[i]], result.Keys[declinedKeys[j]]
+		if a.Declined != b.Declined {
+			return a.Declined > b.Declined
+		}
+		return declinedKeys[i] < declinedKeys[j]
+	})
+
+	var percent float64
+	if result.Requests > 0 {
+		percent = float64(result.Declined) * 100 / float64(result.Requests)
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "requests:\t%d over %s\n", result.Requests, result.End.Sub(result.Start))
+	fmt.Fprintf(tw, "declined:\t%d (%.1f%%)\n", result.Declined, percent)
+	fmt.Fprintf(tw, "keys:\t%d, of which %d were declined\n", len(result.Keys), len(declinedKeys))
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if len(declinedKeys) == 0 || top <= 0 {
+		return nil
+	}
+	fmt.Fprintln(w)
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "  KEY\tREQUESTS\tDECLINED")
+	for _, name := range declinedKeys[:min(top, len(declinedKeys))] {
+		key := result.Keys[name]
+		fmt.Fprintf(tw, "  %s\t%d\t%d\n", name, key.Requests, key.Declined)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,103 @@
+package caddyrl
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestSimulate(t *testing.T) {
+	rl := &RateLimit{MaxEvents: 5, Window: caddy.Duration(time.Minute)}
+
+	// 2 keys making 1 request every 6s for 2m: 10 per window, so half of
+	// the requests of each key are declined
+	result := simulate(rl, syntheticRequests(2, 1.0/6, 2*time.Minute))
+	if result.Requests != 40 || result.Declined != 20 || len(result.Keys) != 2 {
+		t.Errorf("unexpected result: %+v", result)
+	}
+	if key := result.Keys["key2"]; key.Requests != 20 || key.Declined != 10 {
+		t.Errorf("unexpected result for key: %+v", key)
+	}
+
+	rl.TotalMaxEvents = 6
+	if result := simulate(rl, syntheticRequests(2, 1.0/6, time.Minute)); result.Declined != 14 {
+		t.Errorf("expected total_max_events to decline 14 requests, got %d", result.Declined)
+	}
+}
+
+func TestReadReplay(t *testing.T) {
+	input := `# comment
+{"ts":1700000001.5,"request":{"client_ip":"192.0.2.1"}}
+1700000000 192.0.2.2
+
+2023-11-14T22:13:22Z	192.0.2.1
+`
+	requests, err := readReplay(strings.NewReader(input), "request.client_ip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []simulatedRequest{
+		{at: time.Unix(1700000000, 0), key: "192.0.2.2"},
+		{at: time.Unix(1700000001, 5e8), key: "192.0.2.1"},
+		{at: time.Unix(1700000002, 0), key: "192.0.2.1"},
+	}
+	if len(requests) != len(want) {
+		t.Fatalf("expected %d requests, got %+v", len(want), requests)
+	}
+	for i := range want {
+		if !requests[i].at.Equal(want[i].at) || requests[i].key != want[i].key {
+			t.Errorf("request %d: expected %+v, got %+v", i, want[i], requests[i])
+		}
+	}
+
+	if _, err := readReplay(strings.NewReader(`{"ts":1}`), "request.client_ip"); err == nil {
+		t.Error("expected an error for a log entry without the key field")
+	}
+	if _, err := readReplay(strings.NewReader("yesterday 192.0.2.1"), "request.client_ip"); err == nil {
+		t.Error("expected an error for an invalid timestamp")
+	}
+}
+
+func TestFindZoneConfig(t *testing.T) {
+	config := `{
+		"apps": {
+			"rate_limit": {"policies": {"strict": {"max_events": 3, "window": "10s"}}},
+			"http": {"servers": {"srv0": {"routes": [{"handle": [
+				{"handler": "subroute", "routes": [{"handle": [
+					{"handler": "rate_limit", "rate_limits": [
+						{"zone_name": "other", "max_events": 100, "window": "1m"},
+						{"zone_name": "login", "policy": "strict", "total_max_events": 20}
+					]}
+				]}]}
+			]}]}}}
+		}
+	}`
+	rl, err := findZoneConfig([]byte(config), "login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rl.MaxEvents != 3 || time.Duration(rl.Window) != 10*time.Second || rl.TotalMaxEvents != 20 {
+		t.Errorf("unexpected zone: %+v", rl)
+	}
+	if _, err := findZoneConfig([]byte(config), "missing"); err == nil {
+		t.Error("expected an error for a missing zone")
+	}
+
+	var out strings.Builder
+	result := simulate(rl, syntheticRequests(1, 1, 10*time.Second))
+	if err := writeSimulationReport(&out, rl, result, 10); err != nil {
+		t.Fatal(err)
+	}
+	want := "login: 3 per 10s, 20 in total\n" +
+		"requests:  10 over 9s\n" +
+		"declined:  7 (70.0%)\n" +
+		"keys:      1, of which 1 were declined\n" +
+		"\n" +
+		"  KEY   REQUESTS  DECLINED\n" +
+		"  key1  10        7\n"
+	if out.String() != want {
+		t.Errorf("unexpected report:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
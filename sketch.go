@@ -0,0 +1,301 @@
+package caddyrl
+
+import (
+	"fmt"
+	"hash/maphash"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func init() {
+	caddy.RegisterModule(CountMinSketch{})
+}
+
+// sketchSlots is the number of slots that a sketch's window is divided
+// into; events are counted in slots, so they count towards the limit for
+// up to one slot longer than the window.
+const sketchSlots = 8
+
+// CountMinSketch counts the events of all of a zone's keys together in
+// a count-min sketch, in memory that doesn't depend on the number of
+// keys, for zones keyed by something unbounded, such as full URLs or
+// user agents. Counts are approximate: a key's count is never lower
+// than its actual count, but may be higher because other keys' events
+// collide with it. With probability at least 1 - e^-depth, the
+// over-count is at most e/width times the number of events of all of the
+// zone's keys within the window.
+//
+// The window is divided into 8 slots, and events count towards the
+// limit until their slot has left the window, so for up to an eighth
+// of the window longer than with the sliding window. Keys can't be
+// deleted or listed, so they are neither swept nor reported by the
+// admin API, and the zone's key count is always 0.
+//
+// The sketch takes 9*width*depth*4 bytes per zone.
+type CountMinSketch struct {
+	// The number of counters per row. Wider sketches over-count less.
+	// Default: 2048
+	Width int `json:"width,omitempty"`
+
+	// The number of rows, each with its own hash function. Deeper
+	// sketches over-count more than the bound less often.
+	// Default: 4
+	Depth int `json:"depth,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (CountMinSketch) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "rate_limit.algorithms.count_min_sketch",
+		New: func() caddy.Module { return new(CountMinSketch) },
+	}
+}
+
+// Provision sets up the sketch's defaults.
+func (cms *CountMinSketch) Provision(caddy.Context) error {
+	if cms.Width < 0 || cms.Depth < 0 {
+		return fmt.Errorf("width and depth must be at least zero")
+	}
+	if cms.Width == 0 {
+		cms.Width = 2048
+	}
+	if cms.Depth == 0 {
+		cms.Depth = 4
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler. Syntax:
+//
+//	algorithm count_min_sketch {
+//	    width <counters>
+//	    depth <rows>
+//	}
+func (cms *CountMinSketch) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume algorithm name
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		n, err := strconv.Atoi(d.Val())
+		if err != nil {
+			return d.Errf("invalid %s '%s': %v", option, d.Val(), err)
+		}
+		switch option {
+		case "width":
+			cms.Width = n
+		case "depth":
+			cms.Depth = n
+		default:
+			return d.Errf("unrecognized count-min sketch option '%s'", option)
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+	}
+	return nil
+}
+
+// NewLimiter implements Algorithm. The keys of a zone share one sketch,
+// so it only returns a limiter for a key of a sketch of its own.
+func (cms CountMinSketch) NewLimiter(maxEvents int, window time.Duration) Limiter {
+	sketch := cms.newShared()
+	sketch.setLimits(maxEvents, window)
+	return sketch.get("")
+}
+
+func (cms CountMinSketch) newShared() sharedLimiters {
+	return &countMinSketch{
+		width: cms.Width,
+		depth: cms.Depth,
+		seed:  maphash.MakeSeed(),
+	}
+}
+
+// countMinSketch is the state of a zone that uses the CountMinSketch
+// algorithm. Its counters are in slots, which each count the events of
+// a slot-long part of the window; slots are reused once they have left
+// the window.
+type countMinSketch struct {
+	width, depth int
+	seed         maphash.Seed
+
+	mu        sync.Mutex
+	maxEvents int
+	window    time.Duration
+	slots     [sketchSlots + 1]sketchSlot
+}
+
+type sketchSlot struct {
+	n      int64    // of the slot since the epoch, in slot durations
+	counts []uint32 // depth rows of width counters; nil until used
+}
+
+func (s *countMinSketch) limiter(key string, maxEvents int, window time.Duration) Limiter {
+	s.setLimits(maxEvents, window)
+	return s.get(key)
+}
+
+func (s *countMinSketch) get(key string) Limiter {
+	hash := maphash.String(s.seed, key)
+	return &sketchLimiter{sketch: s, h1: uint32(hash), h2: uint32(hash>>32) | 1}
+}
+
+func (s *countMinSketch) setLimits(maxEvents int, window time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if window != s.window {
+		// the counts are in slots of the old window
+		s.resetUnsynced()
+	}
+	s.maxEvents, s.window = maxEvents, window
+}
+
+func (s *countMinSketch) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.resetUnsynced()
+}
+
+func (s *countMinSketch) resetUnsynced() {
+	for i := range s.slots {
+		s.slots[i].n = 0
+		clear(s.slots[i].counts)
+	}
+}
+
+// slotDuration returns the duration of each slot, which is at least
+// 1ns.
+func (s *countMinSketch) slotDuration() time.Duration {
+	return max(s.window/sketchSlots, 1)
+}
+
+// slotAt returns the number of the slot at ref.
+func (s *countMinSketch) slotAt(ref time.Time) int64 {
+	return unixNano(ref) / int64(s.slotDuration())
+}
+
+// live returns true if slot still counts at the slot numbered current.
+func (s *countMinSketch) live(slot *sketchSlot, current int64) bool {
+	return slot.counts != nil && slot.n > current-int64(len(s.slots))
+}
+
+// sketchLimiter is the limiter of one key in a countMinSketch; it is
+// derived from the key's hash whenever it is needed, rather than stored.
+type sketchLimiter struct {
+	sketch *countMinSketch
+	h1, h2 uint32
+}
+
+// index returns the index of the key's counter in row.
+func (l *sketchLimiter) index(row int) int {
+	// double hashing derives the rows' hashes from one
+	return row*l.sketch.width + int((l.h1+uint32(row)*l.h2)%uint32(l.sketch.width))
+}
+
+// slotCount returns the key's estimated events in slot.
+func (l *sketchLimiter) slotCount(slot *sketchSlot) int {
+	count := uint32(0)
+	for row := range l.sketch.depth {
+		if c := slot.counts[l.index(row)]; row == 0 || c < count {
+			count = c
+		}
+	}
+	return int(count)
+}
+
+// countUnsynced returns the key's estimated events in the slots that
+// count at the slot numbered current. Summing the estimates of slots is
+// at least as tight as estimating from each row's sum over the slots.
+func (l *sketchLimiter) countUnsynced(current int64) int {
+	var count int
+	for i := range l.sketch.slots {
+		if slot := &l.sketch.slots[i]; l.sketch.live(slot, current) {
+			count += l.slotCount(slot)
+		}
+	}
+	return count
+}
+
+func (l *sketchLimiter) Allow(ref time.Time, n int) time.Duration {
+	s := l.sketch
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current := s.slotAt(ref)
+	count := l.countUnsynced(current)
+	if count+n > s.maxEvents {
+		return l.waitUnsynced(ref, current, count, n)
+	}
+
+	slot := &s.slots[current%int64(len(s.slots))]
+	if slot.counts == nil {
+		slot.counts = make([]uint32, s.width*s.depth)
+		slot.n = current
+	} else if slot.n != current {
+		// the slot left the window
+		clear(slot.counts)
+		slot.n = current
+	}
+	for row := range s.depth {
+		slot.counts[l.index(row)] += uint32(n)
+	}
+	return 0
+}
+
+// waitUnsynced returns how long until enough of the key's events have
+// left the window for n more to be allowed.
+func (l *sketchLimiter) waitUnsynced(ref time.Time, current int64, count, n int) time.Duration {
+	s := l.sketch
+	if n > s.maxEvents {
+		return s.window
+	}
+	slotDuration := s.slotDuration()
+	// the slots from oldest to newest
+	for i := current - int64(len(s.slots)) + 1; i <= current; i++ {
+		slot := &s.slots[i%int64(len(s.slots))]
+		if !s.live(slot, current) || slot.n != i {
+			continue
+		}
+		count -= l.slotCount(slot)
+		if count+n <= s.maxEvents {
+			// the slot stops counting once it is as old as all slots
+			end := fromUnixNano((i + int64(len(s.slots))) * int64(slotDuration))
+			return max(end.Sub(ref), 1)
+		}
+	}
+	return s.window
+}
+
+func (l *sketchLimiter) Remaining(ref time.Time) int {
+	s := l.sketch
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return max(s.maxEvents-l.countUnsynced(s.slotAt(ref)), 0)
+}
+
+func (l *sketchLimiter) SetLimits(maxEvents int, window time.Duration) {
+	l.sketch.setLimits(maxEvents, window)
+}
+
+// Idle returns false, since keys of a sketch are never forgotten; the
+// sketch's memory doesn't grow with them.
+func (l *sketchLimiter) Idle(time.Time) bool {
+	return false
+}
+
+// Interface guards
+var (
+	_ Algorithm             = (*CountMinSketch)(nil)
+	_ caddy.Provisioner     = (*CountMinSketch)(nil)
+	_ caddyfile.Unmarshaler = (*CountMinSketch)(nil)
+	_ sharedAlgorithm       = (*CountMinSketch)(nil)
+)
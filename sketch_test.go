@@ -0,0 +1,198 @@
+package caddyrl
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestCountMinSketchLimiter(t *testing.T) {
+	ref := time.Unix(referenceTime, 0)
+	limiter := CountMinSketch{Width: 64, Depth: 4}.NewLimiter(3, 80*time.Second)
+
+	// slots are 10s long; the events are in the slots at 0s and 20s
+	if wait := limiter.Allow(ref, 2); wait != 0 {
+		t.Fatalf("expected 2 events to be allowed, got wait %v", wait)
+	}
+	if wait := limiter.Allow(ref.Add(20*time.Second), 1); wait != 0 {
+		t.Fatalf("expected a third event to be allowed, got wait %v", wait)
+	}
+	if remaining := limiter.Remaining(ref.Add(20 * time.Second)); remaining != 0 {
+		t.Errorf("expected no remaining events, got %d", remaining)
+	}
+
+	// the first slot counts until 9 slots after it began
+	if wait := limiter.Allow(ref.Add(30*time.Second), 1); wait != 60*time.Second {
+		t.Errorf("expected to wait until the first slot leaves the window, got %v", wait)
+	}
+	if wait := limiter.Allow(ref.Add(30*time.Second), 3); wait != 80*time.Second {
+		t.Errorf("expected to wait until both slots leave the window, got %v", wait)
+	}
+	if wait := limiter.Allow(ref.Add(30*time.Second), 4); wait != 80*time.Second {
+		t.Errorf("expected more events than allowed at all to wait a window, got %v", wait)
+	}
+	if remaining := limiter.Remaining(ref.Add(90 * time.Second)); remaining != 2 {
+		t.Errorf("expected the first slot to have left the window, got %d remaining", remaining)
+	}
+	if wait := limiter.Allow(ref.Add(90*time.Second), 2); wait != 0 {
+		t.Errorf("expected events to be allowed once the first slot left, got wait %v", wait)
+	}
+	if limiter.Idle(ref.Add(time.Hour)) {
+		t.Error("expected sketch limiters never to be idle")
+	}
+}
+
+func TestCountMinSketchError(t *testing.T) {
+	ref := time.Unix(referenceTime, 0)
+	sketch := CountMinSketch{Width: 256, Depth: 4}.newShared()
+	sketch.setLimits(1000, time.Minute)
+
+	// many keys with one event each; the bound is e/width times the
+	// total, about 39 events, which it exceeds with probability e^-4
+	const keys = 3600
+	for i := range keys {
+		if wait := sketch.get(fmt.Sprintf("key-%d", i)).Allow(ref, 1); wait != 0 {
+			t.Fatalf("key %d: expected to be allowed, got wait %v", i, wait)
+		}
+	}
+	var exceeded int
+	for i := range keys {
+		count := 1000 - sketch.get(fmt.Sprintf("key-%d", i)).Remaining(ref)
+		if count < 1 {
+			t.Fatalf("key %d: expected never to under-count, got %d", i, count)
+		}
+		if count-1 > 39 {
+			exceeded++
+		}
+	}
+	if exceeded > keys/20 {
+		t.Errorf("expected at most 5%% of keys to exceed the error bound, got %d of %d", exceeded, keys)
+	}
+
+	// changing the window starts over, since slots have other durations
+	sketch.setLimits(1000, time.Hour)
+	if remaining := sketch.get("key-0").Remaining(ref); remaining != 1000 {
+		t.Errorf("expected the sketch to be reset, got %d remaining", remaining)
+	}
+}
+
+func TestCountMinSketchZone(t *testing.T) {
+	initTime()
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: t.Context()})
+	defer cancel()
+
+	zone := &RateLimit{
+		ZoneName:     "sketch_zone",
+		MaxEvents:    2,
+		Window:       caddy.Duration(time.Minute),
+		AlgorithmRaw: json.RawMessage(`{"name": "count_min_sketch", "width": 128}`),
+	}
+	if err := zone.provision(ctx, zone.ZoneName); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _, _ = rateLimits.Delete(zone.ZoneName) })
+	cms, ok := zone.algorithm.(*CountMinSketch)
+	if !ok || cms.Width != 128 || cms.Depth != 4 {
+		t.Fatalf("expected a count-min sketch with the default depth, got %#v", zone.algorithm)
+	}
+	rlm := zone.limitersMap
+
+	for range 2 {
+		if wait := rlm.whenKey("/a"); wait != 0 {
+			t.Fatalf("expected to be allowed, got wait %v", wait)
+		}
+	}
+	if wait := rlm.whenKey("/a"); wait == 0 {
+		t.Error("expected the third event to be declined")
+	}
+	if allowed, remaining, _ := rlm.peek("/b"); !allowed || remaining != 2 {
+		t.Errorf("expected another key to be allowed, got %t, %d", allowed, remaining)
+	}
+	if n := rlm.len(); n != 0 {
+		t.Errorf("expected keys not to be counted, got %d", n)
+	}
+	if rlm.delete("/a") {
+		t.Error("expected keys not to be deletable")
+	}
+
+	// reprovisioning with the same config keeps the counts
+	again := &RateLimit{
+		ZoneName:     "sketch_zone",
+		MaxEvents:    2,
+		Window:       caddy.Duration(time.Minute),
+		AlgorithmRaw: json.RawMessage(`{"name": "count_min_sketch", "width": 128}`),
+	}
+	if err := again.provision(ctx, again.ZoneName); err != nil {
+		t.Fatal(err)
+	}
+	if wait := rlm.whenKey("/a"); wait == 0 {
+		t.Error("expected the counts to be kept across reloads")
+	}
+	rlm.reset()
+	if wait := rlm.whenKey("/a"); wait != 0 {
+		t.Errorf("expected a reset to forget the counts, got wait %v", wait)
+	}
+}
+
+func TestCaddyfileCountMinSketch(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`
+	rate_limit {
+		zone by_url {
+			key    {http.request.uri}
+			window 1m
+			events 100
+			algorithm count_min_sketch {
+				width 4096
+				depth 5
+			}
+		}
+	}`)
+
+	var h Handler
+	if err := h.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshaling Caddyfile: %v", err)
+	}
+	var config struct {
+		Name  string `json:"name"`
+		Width int    `json:"width"`
+		Depth int    `json:"depth"`
+	}
+	if err := json.Unmarshal(h.RateLimits[0].AlgorithmRaw, &config); err != nil {
+		t.Fatal(err)
+	}
+	if config.Name != "count_min_sketch" || config.Width != 4096 || config.Depth != 5 {
+		t.Errorf("unexpected algorithm config: %+v", config)
+	}
+
+	for _, input := range []string{
+		`rate_limit {
+			zone z {
+				key static
+				window 1m
+				events 5
+				algorithm count_min_sketch {
+					width wide
+				}
+			}
+		}`,
+		`rate_limit {
+			zone z {
+				key static
+				window 1m
+				events 5
+				algorithm count_min_sketch {
+					height 3
+				}
+			}
+		}`,
+	} {
+		var h Handler
+		if err := h.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err == nil {
+			t.Errorf("expected error for input: %s", input)
+		}
+	}
+}
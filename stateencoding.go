@@ -0,0 +1,94 @@
+package caddyrl
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/gob"
+	"fmt"
+)
+
+// rlStateVersion is the version of the format of the states that this
+// instance writes, and rlStateMinVersion is the oldest version whose
+// readers interpret them correctly. A change that older readers would
+// misinterpret, e.g. counts that mean something else, raises
+// rlStateMinVersion too. States that this instance can't interpret are
+// skipped rather than misread, so in a cluster of mixed versions, the
+// events of newer instances are undercounted at worst. States of
+// version 1 were written before versions were recorded.
+const (
+	rlStateVersion    = 2
+	rlStateMinVersion = 1
+)
+
+// stateMigrations upgrade a state from the version it is indexed by to
+// the next version.
+var stateMigrations = map[int]func(*rlState){
+	// version 2 only records the version
+	1: func(*rlState) {},
+}
+
+// migrateState upgrades state to the current version, or returns an
+// error if this instance can't interpret it. Newer states that this
+// instance can interpret are used as they are.
+func migrateState(state *rlState) error {
+	if state.Version == 0 {
+		state.Version = 1
+	}
+	if state.MinVersion > rlStateVersion {
+		return fmt.Errorf("state of version %d requires version %d, but only versions up to %d are supported",
+			state.Version, state.MinVersion, rlStateVersion)
+	}
+	for state.Version < rlStateVersion {
+		stateMigrations[state.Version](state)
+		state.Version++
+	}
+	return nil
+}
+
+const (
+	compressionNone = "none"
+	compressionGzip = "gzip"
+)
+
+// gzipHeader starts every gzip stream of deflated data.
+var gzipHeader = []byte{0x1f, 0x8b, 0x08}
+
+var gzipWriterPool = &countedPool{
+	new: func() any {
+		return gzip.NewWriter(nil)
+	},
+}
+
+// encodeState writes v, a state or an aggregate of states, to buf with
+// gob, compressed with gzip if compression is gzip.
+func encodeState(buf *bytes.Buffer, v any, compression string) error {
+	if compression != compressionGzip {
+		return gob.NewEncoder(buf).Encode(v)
+	}
+	zw := gzipWriterPool.Get().(*gzip.Writer)
+	defer gzipWriterPool.Put(zw)
+	zw.Reset(buf)
+	if err := gob.NewEncoder(zw).Encode(v); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// decodeState decodes a state or an aggregate of states, whether it is
+// compressed or not, so that instances can change their compression one
+// at a time.
+func decodeState[T any](encoded []byte) (T, error) {
+	if bytes.HasPrefix(encoded, gzipHeader) {
+		// an uncompressed state could start the same way, if unlikely
+		if zr, err := gzip.NewReader(bytes.NewReader(encoded)); err == nil {
+			defer zr.Close()
+			var v T
+			if err := gob.NewDecoder(zr).Decode(&v); err == nil {
+				return v, nil
+			}
+		}
+	}
+	var v T
+	err := gob.NewDecoder(bytes.NewReader(encoded)).Decode(&v)
+	return v, err
+}
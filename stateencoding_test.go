@@ -0,0 +1,75 @@
+package caddyrl
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestStateEncoding(t *testing.T) {
+	initTime()
+	state := rlState{
+		Timestamp:  now(),
+		InstanceID: "instance",
+		Zones:      map[string]map[string]rlStateValue{"zone": {}},
+	}
+	for i := range 1000 {
+		state.Zones["zone"][fmt.Sprintf("10.0.%d.%d", i/256, i%256)] = rlStateValue{Count: i % 10, OldestEvent: now().Add(-time.Duration(i) * time.Millisecond)}
+	}
+
+	var plain, compressed bytes.Buffer
+	if err := encodeState(&plain, state, compressionNone); err != nil {
+		t.Fatal(err)
+	}
+	if err := encodeState(&compressed, state, compressionGzip); err != nil {
+		t.Fatal(err)
+	}
+	if compressed.Len() >= plain.Len()/2 {
+		t.Errorf("expected a large state to compress well, got %d bytes from %d", compressed.Len(), plain.Len())
+	}
+
+	// states are decoded however they are compressed
+	for _, encoded := range [][]byte{plain.Bytes(), compressed.Bytes()} {
+		decoded, err := decodeRateLimitState(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, expected := decoded.Zones["zone"]["10.0.3.231"], state.Zones["zone"]["10.0.3.231"]
+		if decoded.InstanceID != state.InstanceID || len(decoded.Zones["zone"]) != 1000 ||
+			value.Count != expected.Count || !value.OldestEvent.Equal(expected.OldestEvent) {
+			t.Errorf("unexpected decoded state: %s with %d keys", decoded.InstanceID, len(decoded.Zones["zone"]))
+		}
+	}
+	if _, err := decodeState[rlState](append(bytes.Clone(gzipHeader), "corrupted"...)); err == nil {
+		t.Error("expected an error for a corrupted state")
+	}
+}
+
+func TestStateVersions(t *testing.T) {
+	encode := func(state rlState) []byte {
+		var buf bytes.Buffer
+		if err := encodeState(&buf, state, compressionNone); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	// states from before versions were recorded are upgraded
+	legacy, err := decodeRateLimitState(encode(rlState{InstanceID: "old"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if legacy.Version != rlStateVersion {
+		t.Errorf("expected a legacy state to be upgraded to version %d, got %d", rlStateVersion, legacy.Version)
+	}
+
+	// newer states are used if this version interprets them correctly,
+	// and skipped otherwise
+	if _, err := decodeRateLimitState(encode(rlState{Version: rlStateVersion + 1, MinVersion: rlStateMinVersion})); err != nil {
+		t.Errorf("expected a compatible newer state to be used, got %v", err)
+	}
+	if _, err := decodeRateLimitState(encode(rlState{Version: rlStateVersion + 1, MinVersion: rlStateVersion + 1})); err == nil {
+		t.Error("expected an incompatible newer state to be skipped")
+	}
+}
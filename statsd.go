@@ -0,0 +1,129 @@
+package caddyrl
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StatsDExporter sends the module's measurements to a StatsD or
+// DogStatsD agent over UDP, for deployments that don't scrape
+// Prometheus. It emits the same measurements as the Prometheus
+// metrics, independently of whether Caddy's metrics are enabled.
+//
+// With DogStatsD, labels are sent as tags. Otherwise, label values
+// are appended to the metric name, e.g. `caddy.rate_limit.requests_total.login`.
+// Packets are sent without waiting for the agent, so lost packets
+// are not noticed.
+type StatsDExporter struct {
+	// The address of the agent, as host:port. Required.
+	Address string `json:"address,omitempty"`
+
+	// Prefix of metric names. Default: caddy.rate_limit
+	Prefix string `json:"prefix,omitempty"`
+
+	// If true, labels are sent as DogStatsD tags.
+	DogStatsD bool `json:"dogstatsd,omitempty"`
+
+	conn net.Conn
+}
+
+// statsdTag is a label of a StatsD measurement.
+type statsdTag struct {
+	name, value string
+}
+
+func (se *StatsDExporter) provision() error {
+	if se.Address == "" {
+		return fmt.Errorf("address is required")
+	}
+	if se.Prefix == "" {
+		se.Prefix = "caddy.rate_limit"
+	}
+	conn, err := net.Dial("udp", se.Address)
+	if err != nil {
+		return err
+	}
+	se.conn = conn
+	return nil
+}
+
+func (se *StatsDExporter) close() error {
+	if se.conn == nil {
+		return nil
+	}
+	return se.conn.Close()
+}
+
+// count sends a counter increment. It does nothing if se is nil.
+func (se *StatsDExporter) count(name string, value float64, tags ...statsdTag) {
+	se.send(name, strconv.FormatFloat(value, 'f', -1, 64), "c", tags)
+}
+
+// gauge sends a gauge value. It does nothing if se is nil.
+func (se *StatsDExporter) gauge(name string, value float64, tags ...statsdTag) {
+	se.send(name, strconv.FormatFloat(value, 'f', -1, 64), "g", tags)
+}
+
+// histogram sends a value of a distribution. It does nothing if se is nil.
+func (se *StatsDExporter) histogram(name string, value float64, tags ...statsdTag) {
+	se.send(name, strconv.FormatFloat(value, 'f', -1, 64), "h", tags)
+}
+
+// timing sends a duration in milliseconds. It does nothing if se is nil.
+func (se *StatsDExporter) timing(name string, duration time.Duration, tags ...statsdTag) {
+	se.send(name, strconv.FormatFloat(float64(duration)/float64(time.Millisecond), 'f', -1, 64), "ms", tags)
+}
+
+func (se *StatsDExporter) send(name, value, metricType string, tags []statsdTag) {
+	if se == nil || se.conn == nil {
+		return
+	}
+
+	var sb strings.Builder
+	sb.WriteString(se.Prefix)
+	sb.WriteByte('.')
+	sb.WriteString(name)
+	if !se.DogStatsD {
+		for _, tag := range tags {
+			sb.WriteByte('.')
+			sb.WriteString(statsdField(tag.value))
+		}
+	}
+	sb.WriteByte(':')
+	sb.WriteString(value)
+	sb.WriteByte('|')
+	sb.WriteString(metricType)
+	if se.DogStatsD && len(tags) > 0 {
+		sb.WriteString("|#")
+		for i, tag := range tags {
+			if i > 0 {
+				sb.WriteByte(',')
+			}
+			sb.WriteString(tag.name)
+			sb.WriteByte(':')
+			sb.WriteString(statsdField(tag.value))
+		}
+	}
+
+	// errors are expected if no agent is listening; they are not
+	// worth logging for every request
+	_, _ = se.conn.Write([]byte(sb.String()))
+}
+
+// statsdField makes s safe to use as part of a metric name or tag,
+// which must not contain the protocol's separators.
+func statsdField(s string) string {
+	if s == "" {
+		return "_"
+	}
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ':', '|', ',', '#', '@', '.', ' ', '\n':
+			return '_'
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,69 @@
+package caddyrl
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStatsDExporter(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	defer conn.Close()
+
+	receive := func() string {
+		buf := make([]byte, 1024)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("reading packet: %v", err)
+		}
+		return string(buf[:n])
+	}
+
+	for _, tc := range []struct {
+		dogstatsd bool
+		expected  []string
+	}{
+		{
+			dogstatsd: false,
+			expected: []string{
+				"caddy.rate_limit.requests_total.login.10_0_0_1:1|c",
+				"caddy.rate_limit.process_time.login:1.5|ms",
+				"caddy.rate_limit.keys_total.login:3|g",
+			},
+		},
+		{
+			dogstatsd: true,
+			expected: []string{
+				"caddy.rate_limit.requests_total:1|c|#zone:login,key:10_0_0_1",
+				"caddy.rate_limit.process_time:1.5|ms|#zone:login",
+				"caddy.rate_limit.keys_total:3|g|#zone:login",
+			},
+		},
+	} {
+		se := &StatsDExporter{Address: conn.LocalAddr().String(), DogStatsD: tc.dogstatsd}
+		if err := se.provision(); err != nil {
+			t.Fatalf("provisioning exporter: %v", err)
+		}
+		mc := newMetricsCollector(false, &RateLimitApp{Metrics: MetricsConfig{StatsD: se}})
+		mc.setZoneIncludeKey("login", true)
+
+		mc.recordRequestPerKey("login", "", "10.0.0.1")
+		mc.statsd().timing("process_time", 1500*time.Microsecond, statsdTag{"zone", "login"})
+		mc.updateKeysCount("login", "", 3)
+
+		for _, expected := range tc.expected {
+			if packet := receive(); packet != expected {
+				t.Errorf("dogstatsd=%t: got packet %q (wanted %q)", tc.dogstatsd, packet, expected)
+			}
+		}
+		se.close()
+	}
+
+	if err := (&StatsDExporter{}).provision(); err == nil {
+		t.Fatal("expected error without address")
+	}
+}
@@ -0,0 +1,83 @@
+package caddyrl
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/caddyserver/certmagic"
+)
+
+// namespacedStorage stores all keys of the wrapped storage under a
+// namespace, so that several clusters, or other applications, can share
+// one storage backend without their keys colliding.
+type namespacedStorage struct {
+	certmagic.Storage
+	namespace string
+}
+
+// withNamespace returns storage with its keys under namespace, which
+// must be a valid namespace, or storage itself if namespace is empty.
+func withNamespace(storage certmagic.Storage, namespace string) certmagic.Storage {
+	if namespace == "" {
+		return storage
+	}
+	return namespacedStorage{Storage: storage, namespace: namespace}
+}
+
+// validateStorageNamespace returns an error if namespace isn't a clean,
+// relative path, which keys could escape from or collide within.
+func validateStorageNamespace(namespace string) error {
+	if namespace == "" {
+		return nil
+	}
+	if path.IsAbs(namespace) || path.Clean(namespace) != namespace || namespace == "." || strings.HasPrefix(namespace, "..") {
+		return fmt.Errorf("storage namespace %q must be a clean, relative path", namespace)
+	}
+	return nil
+}
+
+func (ns namespacedStorage) key(key string) string {
+	return path.Join(ns.namespace, key)
+}
+
+func (ns namespacedStorage) Lock(ctx context.Context, name string) error {
+	return ns.Storage.Lock(ctx, ns.key(name))
+}
+
+func (ns namespacedStorage) Unlock(ctx context.Context, name string) error {
+	return ns.Storage.Unlock(ctx, ns.key(name))
+}
+
+func (ns namespacedStorage) Store(ctx context.Context, key string, value []byte) error {
+	return ns.Storage.Store(ctx, ns.key(key), value)
+}
+
+func (ns namespacedStorage) Load(ctx context.Context, key string) ([]byte, error) {
+	return ns.Storage.Load(ctx, ns.key(key))
+}
+
+func (ns namespacedStorage) Delete(ctx context.Context, key string) error {
+	return ns.Storage.Delete(ctx, ns.key(key))
+}
+
+func (ns namespacedStorage) Exists(ctx context.Context, key string) bool {
+	return ns.Storage.Exists(ctx, ns.key(key))
+}
+
+// List lists the keys under prefix in the namespace, without the
+// namespace, as they were stored.
+func (ns namespacedStorage) List(ctx context.Context, prefix string, recursive bool) ([]string, error) {
+	keys, err := ns.Storage.List(ctx, ns.key(prefix), recursive)
+	for i, key := range keys {
+		keys[i] = strings.TrimPrefix(key, ns.namespace+"/")
+	}
+	return keys, err
+}
+
+func (ns namespacedStorage) Stat(ctx context.Context, key string) (certmagic.KeyInfo, error) {
+	info, err := ns.Storage.Stat(ctx, ns.key(key))
+	info.Key = strings.TrimPrefix(info.Key, ns.namespace+"/")
+	return info, err
+}
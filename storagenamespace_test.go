@@ -0,0 +1,92 @@
+package caddyrl
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"slices"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/certmagic"
+)
+
+func TestStorageNamespace(t *testing.T) {
+	ctx := context.Background()
+	shared := &certmagic.FileStorage{Path: t.TempDir()}
+	prod := withNamespace(shared, "prod/eu")
+	staging := withNamespace(shared, "staging")
+
+	key := path.Join(storagePrefix, "instance1.json")
+	if err := prod.Store(ctx, key, []byte("prod")); err != nil {
+		t.Fatal(err)
+	}
+	if err := staging.Store(ctx, key, []byte("staging")); err != nil {
+		t.Fatal(err)
+	}
+
+	// keys are kept under the namespace, but used without it
+	if !shared.Exists(ctx, "prod/eu/"+key) || shared.Exists(ctx, key) {
+		t.Error("expected the key to be stored under the namespace only")
+	}
+	value, err := prod.Load(ctx, key)
+	if err != nil || string(value) != "prod" {
+		t.Errorf("expected the namespace's own value, got %q (%v)", value, err)
+	}
+	keys, err := staging.List(ctx, storagePrefix, false)
+	if err != nil || !slices.Equal(keys, []string{key}) {
+		t.Errorf("expected the namespace's keys without the namespace, got %v (%v)", keys, err)
+	}
+	info, err := prod.Stat(ctx, key)
+	if err != nil || info.Key != key {
+		t.Errorf("expected the key without the namespace, got %q (%v)", info.Key, err)
+	}
+	if err := prod.Delete(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if prod.Exists(ctx, key) || !staging.Exists(ctx, key) {
+		t.Error("expected deleting to only affect the namespace")
+	}
+
+	if withNamespace(shared, "") != certmagic.Storage(shared) {
+		t.Error("expected no namespace to leave the storage as is")
+	}
+	for _, namespace := range []string{"/prod", "prod/", "../prod", "prod//eu", "."} {
+		if err := validateStorageNamespace(namespace); err == nil {
+			t.Errorf("expected an error for namespace %q", namespace)
+		}
+	}
+}
+
+func TestCaddyfileStorageNamespace(t *testing.T) {
+	var h Handler
+	if err := h.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`rate_limit {
+		storage_namespace prod/eu
+	}`)); err != nil {
+		t.Fatalf("unmarshaling Caddyfile: %v", err)
+	}
+	if h.StorageNamespace != "prod/eu" {
+		t.Errorf("unexpected handler namespace: %q", h.StorageNamespace)
+	}
+
+	parsed, err := parseGlobalRateLimitMetrics(caddyfile.NewTestDispenser(`rate_limit {
+		storage_namespace prod
+	}`), nil)
+	if err != nil {
+		t.Fatalf("unmarshaling Caddyfile: %v", err)
+	}
+	var app RateLimitApp
+	if err := json.Unmarshal(parsed.(httpcaddyfile.App).Value, &app); err != nil {
+		t.Fatal(err)
+	}
+	if app.StorageNamespace != "prod" {
+		t.Errorf("unexpected app namespace: %q", app.StorageNamespace)
+	}
+
+	if _, err := parseGlobalRateLimitMetrics(caddyfile.NewTestDispenser(`rate_limit {
+		storage_namespace prod eu
+	}`), nil); err == nil {
+		t.Error("expected an error for extra arguments")
+	}
+}
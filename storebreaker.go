@@ -0,0 +1,99 @@
+package caddyrl
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// StoreBreaker keeps failing storage from slowing down distributed rate
+// limiting: after too many storage calls in a row failed, the breaker
+// trips, and decisions are made locally, without reading from or writing
+// to storage, as if zones had `local` consistency. While tripped, state
+// is synced only once per probe interval, and the first sync that
+// succeeds closes the breaker again.
+type StoreBreaker struct {
+	// The number of storage calls in a row that must fail for the
+	// breaker to trip. Default: 5
+	Failures int `json:"failures,omitempty"`
+
+	// How often storage is probed while the breaker is tripped.
+	// Default: 30s
+	ProbeInterval caddy.Duration `json:"probe_interval,omitempty"`
+
+	logger *zap.Logger
+
+	tripped atomic.Bool
+
+	mu        sync.Mutex
+	failures  int       // in a row
+	nextProbe time.Time // while tripped
+}
+
+func (sb *StoreBreaker) provision(logger *zap.Logger) error {
+	if sb.Failures < 0 {
+		return fmt.Errorf("failures must be at least zero")
+	}
+	if sb.Failures == 0 {
+		sb.Failures = 5
+	}
+	if sb.ProbeInterval < 0 {
+		return fmt.Errorf("probe_interval must be at least zero")
+	}
+	if sb.ProbeInterval == 0 {
+		sb.ProbeInterval = caddy.Duration(30 * time.Second)
+	}
+	sb.logger = logger
+	return nil
+}
+
+// isTripped returns whether decisions are made locally because storage
+// is failing.
+func (sb *StoreBreaker) isTripped() bool {
+	return sb != nil && sb.tripped.Load()
+}
+
+// allow returns whether storage may be called now: always if the
+// breaker isn't tripped, and once per probe interval if it is.
+func (sb *StoreBreaker) allow() bool {
+	if !sb.isTripped() {
+		return true
+	}
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	if now().Before(sb.nextProbe) {
+		return false
+	}
+	sb.nextProbe = now().Add(time.Duration(sb.ProbeInterval))
+	return true
+}
+
+// record counts the outcome of a storage call, tripping the breaker
+// after too many failures in a row and closing it after a success.
+func (sb *StoreBreaker) record(err error) {
+	if sb == nil {
+		return
+	}
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	if err == nil {
+		sb.failures = 0
+		if sb.tripped.CompareAndSwap(true, false) {
+			sb.logger.Info("storage is reachable again; syncing distributed state")
+		}
+		return
+	}
+	sb.failures++
+	if sb.failures >= sb.Failures && !sb.tripped.Load() {
+		sb.nextProbe = now().Add(time.Duration(sb.ProbeInterval))
+		sb.tripped.Store(true)
+		sb.logger.Warn("storage is failing; deciding locally until it recovers",
+			zap.Int("failures", sb.failures),
+			zap.Duration("probe_interval", time.Duration(sb.ProbeInterval)),
+			zap.Error(err))
+	}
+}
@@ -0,0 +1,143 @@
+package caddyrl
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+func TestStoreBreaker(t *testing.T) {
+	initTime()
+
+	sb := &StoreBreaker{Failures: 3, ProbeInterval: caddy.Duration(10 * time.Second)}
+	if err := sb.provision(zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+	errStorage := errors.New("storage unavailable")
+
+	// failures in a row trip the breaker, and successes reset the count
+	sb.record(errStorage)
+	sb.record(errStorage)
+	sb.record(nil)
+	sb.record(errStorage)
+	sb.record(errStorage)
+	if sb.isTripped() {
+		t.Fatal("expected the breaker not to trip before 3 failures in a row")
+	}
+	sb.record(errStorage)
+	if !sb.isTripped() {
+		t.Fatal("expected the breaker to trip after 3 failures in a row")
+	}
+
+	// storage is probed once per probe interval
+	if sb.allow() {
+		t.Error("expected no storage calls right after tripping")
+	}
+	advanceTime(10)
+	if !sb.allow() || sb.allow() {
+		t.Error("expected one probe after the probe interval")
+	}
+	sb.record(errStorage)
+	if !sb.isTripped() {
+		t.Error("expected a failed probe to keep the breaker tripped")
+	}
+	advanceTime(20)
+	if !sb.allow() {
+		t.Fatal("expected another probe")
+	}
+	sb.record(nil)
+	if sb.isTripped() || !sb.allow() {
+		t.Error("expected a successful probe to close the breaker")
+	}
+
+	var nilBreaker *StoreBreaker
+	if nilBreaker.isTripped() || !nilBreaker.allow() {
+		t.Error("expected a nil breaker never to trip")
+	}
+	if err := (&StoreBreaker{Failures: -1}).provision(zap.NewNop()); err == nil {
+		t.Error("expected an error for negative failures")
+	}
+}
+
+func TestStoreBreakerDecisions(t *testing.T) {
+	initTime()
+
+	rl := &RateLimit{
+		ZoneName:    "breaker_zone",
+		Key:         "static",
+		Window:      caddy.Duration(time.Minute),
+		MaxEvents:   2,
+		Consistency: consistencyStrict,
+	}
+	h := newTestHandler(t, rl)
+
+	sb := &StoreBreaker{Failures: 1}
+	if err := sb.provision(zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+	sb.record(errors.New("storage unavailable"))
+
+	// another instance used up the key's events as far as was last known
+	h.Distributed = &DistributedRateLimiting{
+		instanceID: "self",
+		Breaker:    sb,
+		otherStates: []rlState{{
+			Timestamp: now(),
+			Zones:     map[string]map[string]rlStateValue{rl.ZoneName: {"static": {Count: 2, OldestEvent: now()}}},
+		}},
+	}
+	serve := func() error {
+		_, err := h.limitRequest(httptest.NewRecorder(), newTestRequest("GET", "/", nil))
+		return err
+	}
+
+	// while tripped, decisions neither wait on storage (which is nil)
+	// nor count other instances' events
+	for i := range 2 {
+		if err := serve(); err != nil {
+			t.Fatalf("expected event %d to be decided locally, got %v", i+1, err)
+		}
+	}
+	if err := serve(); !isDeclined(err) {
+		t.Errorf("expected the local limit to apply, got %v", err)
+	}
+}
+
+func TestCaddyfileStoreBreaker(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`
+	rate_limit {
+		distributed {
+			timeout 500ms
+			breaker {
+				failures       3
+				probe_interval 1m
+			}
+		}
+	}`)
+
+	var h Handler
+	if err := h.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshaling Caddyfile: %v", err)
+	}
+	dist := h.Distributed
+	if dist.Timeout != caddy.Duration(500*time.Millisecond) || dist.Breaker == nil ||
+		dist.Breaker.Failures != 3 || dist.Breaker.ProbeInterval != caddy.Duration(time.Minute) {
+		t.Errorf("unexpected distributed config: %+v (breaker %+v)", dist, dist.Breaker)
+	}
+
+	var bad Handler
+	if err := bad.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`rate_limit {
+		distributed {
+			breaker {
+				failures many
+			}
+		}
+	}`)); err == nil {
+		t.Error("expected an error for invalid breaker failures")
+	}
+}
@@ -0,0 +1,238 @@
+package caddyrl
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// LimitSuggestion observes a zone without limiting it for a while, and
+// then suggests a max_events from the number of events that keys made
+// per window, so that limits can be based on data rather than guesses.
+// The suggestion is logged when the observation ends, and available
+// from the admin API at any time.
+type LimitSuggestion struct {
+	// How long the zone is observed, during which its requests are not
+	// limited (though banned keys are still declined). Default: 24h
+	Period caddy.Duration `json:"period,omitempty"`
+
+	// The percentile of the per-key counts of events per window that the
+	// suggestion is based on, between 0 and 100. Default: 99
+	Percentile float64 `json:"percentile,omitempty"`
+
+	// Factor by which the percentile is multiplied, leaving room for
+	// legitimate bursts. Default: 1.5
+	Headroom float64 `json:"headroom,omitempty"`
+
+	logger *zap.Logger
+}
+
+func (ls *LimitSuggestion) provision(logger *zap.Logger) error {
+	if ls.Period == 0 {
+		ls.Period = caddy.Duration(24 * time.Hour)
+	}
+	if ls.Period < 0 {
+		return fmt.Errorf("period must be greater than zero")
+	}
+	if ls.Percentile == 0 {
+		ls.Percentile = 99
+	}
+	if ls.Percentile < 0 || ls.Percentile > 100 {
+		return fmt.Errorf("percentile must be between 0 and 100")
+	}
+	if ls.Headroom == 0 {
+		ls.Headroom = 1.5
+	}
+	if ls.Headroom < 1 {
+		return fmt.Errorf("headroom must be at least 1")
+	}
+	ls.logger = logger
+	return nil
+}
+
+// limitObservation is the observation of a zone's keys for a suggestion.
+// It is kept with the zone's rate limiters, so that it continues across
+// config reloads that don't change the suggestion's settings.
+type limitObservation struct {
+	period               time.Duration
+	percentile, headroom float64
+	start, until         time.Time
+	timer                *time.Timer
+	mu                   sync.Mutex
+	windows              map[string]*observedWindow
+	counts               map[int]int // events per window => number of such windows
+	windowsObserved      int
+}
+
+// observedWindow is the window of a key that is being counted.
+type observedWindow struct {
+	start  time.Time
+	events int
+}
+
+// setSuggestion starts observing the zone for ls, unless it is already
+// being observed with the same settings; a nil ls stops observing it.
+func (rlm *rateLimitersMap) setSuggestion(zoneName string, ls *LimitSuggestion) {
+	rlm.limitersMu.Lock()
+	defer rlm.limitersMu.Unlock()
+	if obs := rlm.observation.Load(); obs != nil {
+		if ls != nil && obs.period == time.Duration(ls.Period) &&
+			obs.percentile == ls.Percentile && obs.headroom == ls.Headroom {
+			return
+		}
+		obs.timer.Stop()
+		rlm.observation.Store(nil)
+	}
+	if ls == nil {
+		return
+	}
+
+	obs := &limitObservation{
+		period:     time.Duration(ls.Period),
+		percentile: ls.Percentile,
+		headroom:   ls.Headroom,
+		start:      now(),
+		windows:    make(map[string]*observedWindow),
+		counts:     make(map[int]int),
+	}
+	obs.until = obs.start.Add(obs.period)
+	logger := ls.logger
+	obs.timer = time.AfterFunc(obs.period, func() {
+		s := obs.finish()
+		logger.Info("observation of zone finished; suggesting max_events",
+			zap.String("zone", zoneName),
+			zap.Int("windows", s.Windows),
+			zap.Float64("percentile", obs.percentile),
+			zap.Int("suggested_max_events", s.SuggestedMaxEvents),
+		)
+	})
+	rlm.observation.Store(obs)
+}
+
+// observe counts an event of key in windows of the given duration, and
+// returns true if the zone is being observed and is thus not to limit
+// the event.
+func (obs *limitObservation) observe(key string, window time.Duration) bool {
+	if obs == nil {
+		return false
+	}
+	ref := now()
+	if !ref.Before(obs.until) {
+		return false
+	}
+
+	obs.mu.Lock()
+	defer obs.mu.Unlock()
+	obs.count(key, window, ref)
+	return true
+}
+
+// count counts an event of key at ref in windows of the given duration,
+// which start with the first event of the key after the previous one
+// ended. obs.mu must be held.
+func (obs *limitObservation) count(key string, window time.Duration, ref time.Time) {
+	w, ok := obs.windows[key]
+	if !ok {
+		w = &observedWindow{start: ref}
+		obs.windows[key] = w
+	} else if ref.Sub(w.start) >= window {
+		obs.record(w.events)
+		w.start, w.events = ref, 0
+	}
+	w.events++
+}
+
+// record adds a window with the given number of events. obs.mu must be
+// held.
+func (obs *limitObservation) record(events int) {
+	obs.counts[events]++
+	obs.windowsObserved++
+}
+
+// finish records the windows that are still open, so that they are
+// part of the suggestion, and returns it.
+func (obs *limitObservation) finish() suggestionStatus {
+	obs.mu.Lock()
+	for key, w := range obs.windows {
+		obs.record(w.events)
+		delete(obs.windows, key)
+	}
+	obs.mu.Unlock()
+	return obs.status()
+}
+
+// suggestionStatus describes a zone's observation in admin API responses.
+type suggestionStatus struct {
+	Observing          bool           `json:"observing"`
+	Until              time.Time      `json:"until"`
+	Windows            int            `json:"windows"`
+	Percentiles        map[string]int `json:"percentiles"`
+	Percentile         float64        `json:"percentile"`
+	SuggestedMaxEvents int            `json:"suggested_max_events"`
+}
+
+// status returns the suggestion of the windows that ended so far.
+func (obs *limitObservation) status() suggestionStatus {
+	obs.mu.Lock()
+	defer obs.mu.Unlock()
+
+	events := make([]int, 0, len(obs.counts))
+	for n := range obs.counts {
+		events = append(events, n)
+	}
+	slices.Sort(events)
+
+	// the smallest count of events that the given percentile of
+	// windows doesn't exceed
+	percentile := func(p float64) int {
+		threshold := p / 100 * float64(obs.windowsObserved)
+		var windows int
+		for _, n := range events {
+			windows += obs.counts[n]
+			if float64(windows) >= threshold {
+				return n
+			}
+		}
+		return 0
+	}
+
+	s := suggestionStatus{
+		Observing:   now().Before(obs.until),
+		Until:       obs.until,
+		Windows:     obs.windowsObserved,
+		Percentiles: make(map[string]int),
+		Percentile:  obs.percentile,
+	}
+	for _, p := range []float64{50, 90, 95, 99, 100, obs.percentile} {
+		s.Percentiles[strconv.FormatFloat(p, 'f', -1, 64)] = percentile(p)
+	}
+	if obs.windowsObserved > 0 {
+		s.SuggestedMaxEvents = max(int(math.Ceil(float64(percentile(obs.percentile))*obs.headroom)), 1)
+	}
+	return s
+}
+
+// handleSuggestion reports the suggested limits of a zone.
+func handleSuggestion(w http.ResponseWriter, r *http.Request, rlm *rateLimitersMap, zoneName string) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	obs := rlm.observation.Load()
+	if obs == nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("zone %s is not observed for suggestions", zoneName),
+		}
+	}
+	return writeAdminJSON(w, obs.status())
+}
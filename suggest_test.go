@@ -0,0 +1,77 @@
+package caddyrl
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func TestLimitSuggestion(t *testing.T) {
+	initTime()
+
+	rlm := newTestZone(t, "suggest_zone", 10, time.Minute)
+	ls := &LimitSuggestion{Period: caddy.Duration(time.Hour), Percentile: 90, Headroom: 2}
+	if err := ls.provision(zap.NewNop()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	rlm.setSuggestion("suggest_zone", ls)
+	defer rlm.setSuggestion("suggest_zone", nil)
+
+	// 10 keys make 1 to 10 events in each of two windows
+	obs := rlm.observation.Load()
+	for minute := range 2 {
+		advanceTime(60 * minute)
+		for i := 1; i <= 10; i++ {
+			for range i {
+				if !obs.observe(fmt.Sprintf("client%d", i), time.Minute) {
+					t.Fatal("expected events to go unlimited while observing")
+				}
+			}
+		}
+	}
+
+	// reloading with the same settings continues the observation
+	rlm.setSuggestion("suggest_zone", ls)
+	if rlm.observation.Load() != obs {
+		t.Fatal("expected the observation to continue")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/rate_limit/zones/suggest_zone/suggestion", nil)
+	rec := httptest.NewRecorder()
+	if err := handleZones(rec, req); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var status suggestionStatus
+	if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	// only the first window of each key has ended
+	if !status.Observing || status.Windows != 10 || status.Percentiles["90"] != 9 || status.SuggestedMaxEvents != 18 {
+		t.Errorf("unexpected status while observing: %+v", status)
+	}
+
+	advanceTime(3600)
+	if obs.observe("client1", time.Minute) {
+		t.Error("expected events to be limited after the observation")
+	}
+	status = obs.finish()
+	if status.Observing || status.Windows != 20 || status.Percentiles["50"] != 5 || status.Percentiles["100"] != 10 {
+		t.Errorf("unexpected status after observing: %+v", status)
+	}
+
+	rlm.setSuggestion("suggest_zone", nil)
+	rec = httptest.NewRecorder()
+	if err := handleZones(rec, req); err == nil {
+		t.Error("expected an error for a zone that isn't observed")
+	}
+
+	if err := (&LimitSuggestion{Percentile: 101}).provision(zap.NewNop()); err == nil {
+		t.Error("expected an error for a percentile beyond 100")
+	}
+}
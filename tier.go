@@ -0,0 +1,152 @@
+package caddyrl
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// ZoneTier gives the requests of a tier, e.g. of users with a role,
+// limits of their own within a zone; see RateLimit.TierBy.
+type ZoneTier struct {
+	// The name of the tier, which is matched against the values of
+	// the zone's tier_by placeholder. Required.
+	Name string `json:"name"`
+
+	// Maximum number of events of each key of the tier within the
+	// zone's window. Required, unless the tier is unlimited.
+	MaxEvents int `json:"max_events,omitempty"`
+
+	// The key of the tier's requests. Default: the zone's key
+	Key string `json:"key,omitempty"`
+
+	// If true, requests of the tier are not limited by the zone.
+	Unlimited bool `json:"unlimited,omitempty"`
+}
+
+// AuthenticatedLimit gives authenticated requests a limit and key of
+// their own within a zone: requests whose user placeholder has a value
+// are limited by user, while anonymous requests get the zone's own
+// limit and key, e.g. a stricter one by client IP. Authenticated
+// requests are limited like in a zone of their own, named
+// `<zone>.authenticated`; see RateLimit.Authenticated.
+type AuthenticatedLimit struct {
+	// The placeholder with the authenticated user of a request, which
+	// is empty for anonymous ones. It is the key of authenticated
+	// requests. Default: `{http.auth.user.id}`
+	User string `json:"user,omitempty"`
+
+	// Maximum number of events of each user within the zone's window.
+	// Required.
+	MaxEvents int `json:"max_events,omitempty"`
+}
+
+// authenticatedTier is the name of the tier of authenticated requests.
+const authenticatedTier = "authenticated"
+
+// provisionTiers sets up the state of each tier of the zone, whose own
+// state has the given name. Each tier is limited like a zone of its
+// own, named `<zone>.<tier>`, that has the zone's settings but the
+// tier's limit and key.
+func (rl *RateLimit) provisionTiers(name string) error {
+	rl.tiers = nil
+	rl.authenticated = nil
+	if auth := rl.Authenticated; auth != nil {
+		if auth.User == "" {
+			auth.User = "{http.auth.user.id}"
+		}
+		if newKeyTemplate(auth.User).static {
+			return fmt.Errorf("authenticated user must have placeholders: '%s'", auth.User)
+		}
+		if auth.MaxEvents < 1 {
+			return fmt.Errorf("authenticated max_events must be at least 1")
+		}
+		if rl.algorithm != nil {
+			return fmt.Errorf("authenticated limits require the sliding_window algorithm")
+		}
+		rl.authenticated = rl.tierZone(name, authenticatedTier, auth.MaxEvents, auth.User)
+	}
+	if len(rl.Tiers) == 0 {
+		if rl.TierBy != "" {
+			return fmt.Errorf("tier_by requires tiers")
+		}
+		return nil
+	}
+	tierTemplate := newKeyTemplate(rl.TierBy)
+	if tierTemplate.static {
+		return fmt.Errorf("tier_by must have placeholders: '%s'", rl.TierBy)
+	}
+	if rl.algorithm != nil {
+		return fmt.Errorf("tiers require the sliding_window algorithm")
+	}
+	rl.tierTemplate = tierTemplate
+	rl.tiers = make(map[string]*RateLimit, len(rl.Tiers))
+	for i, tier := range rl.Tiers {
+		if tier.Name == "" || strings.ContainsAny(tier.Name, " ,") {
+			return fmt.Errorf("tier %d: name is required and must not contain spaces or commas", i)
+		}
+		if _, ok := rl.tiers[tier.Name]; ok || (tier.Name == authenticatedTier && rl.authenticated != nil) {
+			return fmt.Errorf("tier %d: duplicate name '%s'", i, tier.Name)
+		}
+		if tier.Unlimited {
+			if tier.MaxEvents != 0 || tier.Key != "" {
+				return fmt.Errorf("tier %s: unlimited tiers have no max_events or key", tier.Name)
+			}
+			rl.tiers[tier.Name] = nil
+			continue
+		}
+		if tier.MaxEvents < 1 {
+			return fmt.Errorf("tier %s: max_events must be at least 1", tier.Name)
+		}
+
+		rl.tiers[tier.Name] = rl.tierZone(name, tier.Name, tier.MaxEvents, tier.Key)
+	}
+	return nil
+}
+
+// tierZone returns the zone of the tier with the given name, limit and
+// key (or the zone's key if empty), which has the zone's settings
+// otherwise, and its state, named after the zone's state.
+func (rl *RateLimit) tierZone(name, tierName string, maxEvents int, key string) *RateLimit {
+	zone := *rl
+	zone.ZoneName = rl.ZoneName + "." + tierName
+	zone.MaxEvents = maxEvents
+	zone.TierBy, zone.Tiers, zone.tiers = "", nil, nil
+	zone.Authenticated, zone.authenticated = nil, nil
+	// the zone's schedules set the zone's limit, not the tier's
+	zone.Schedules = nil
+	if key != "" {
+		zone.Key = key
+		zone.keyTemplate = newKeyTemplate(expandEnv(key))
+		zone.varyHeaders = varyHeaders(zone.keyTemplate.raw)
+	}
+	zone.provisionState(name + "." + tierName)
+	return &zone
+}
+
+// tier returns the zone that a request is limited in, according to the
+// values of the zone's tier_by placeholder for it: the zone of the first
+// of the zone's tiers that is among the values, which are separated by
+// spaces or commas, or if none is, the zone of authenticated requests if
+// the request has a user, or rl itself. It returns false if the request
+// is of an unlimited tier.
+func (rl *RateLimit) tier(repl *caddy.Replacer) (*RateLimit, bool) {
+	if rl.tiers != nil {
+		values := strings.FieldsFunc(rl.tierTemplate.key(repl), func(c rune) bool {
+			return c == ' ' || c == ','
+		})
+		for _, tier := range rl.Tiers {
+			for _, value := range values {
+				if value == tier.Name {
+					zone := rl.tiers[tier.Name]
+					return zone, zone != nil
+				}
+			}
+		}
+	}
+	if rl.authenticated != nil && rl.authenticated.keyTemplate.key(repl) != "" {
+		return rl.authenticated, true
+	}
+	return rl, true
+}
@@ -0,0 +1,198 @@
+package caddyrl
+
+import (
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestZoneTiers(t *testing.T) {
+	initTime()
+
+	rl := &RateLimit{
+		ZoneName:  "tier_zone",
+		Key:       "{http.request.remote.host}",
+		Window:    caddy.Duration(time.Minute),
+		MaxEvents: 1,
+		TierBy:    "{http.auth.user.roles}",
+		Tiers: []*ZoneTier{
+			{Name: "admin", Unlimited: true},
+			{Name: "user", MaxEvents: 3, Key: "{http.auth.user.id}"},
+		},
+	}
+	h := newTestHandler(t, rl)
+	t.Cleanup(func() { _, _ = rateLimits.Delete("tier_zone.user") })
+
+	allowed := func(userID, roles string) int {
+		t.Helper()
+		n := 0
+		for range 5 {
+			req := newTestRequest("GET", "/", map[string]string{
+				"http.request.remote.host": "192.0.2.1",
+				"http.auth.user.id":        userID,
+				"http.auth.user.roles":     roles,
+			})
+			if allowedBy(t, h, req) {
+				n++
+			}
+		}
+		return n
+	}
+
+	// anonymous requests and unknown roles get the zone's own limit
+	if n := allowed("", ""); n != 1 {
+		t.Errorf("expected 1 anonymous request to be allowed, got %d", n)
+	}
+	if n := allowed("", "guest"); n != 0 {
+		t.Errorf("expected requests of unknown roles to share the zone's limit, got %d allowed", n)
+	}
+
+	// users are limited by their ID in the tier's zone
+	if n := allowed("alice", "user"); n != 3 {
+		t.Errorf("expected 3 requests of a user to be allowed, got %d", n)
+	}
+	if n := allowed("bob", "reader,user"); n != 3 {
+		t.Errorf("expected another user to have their own limit, got %d allowed", n)
+	}
+	if _, ok := zoneLimiters("tier_zone.user"); !ok {
+		t.Error("expected the tier to have a zone of its own")
+	}
+
+	// the first tier among the roles applies, and admins aren't limited
+	if n := allowed("carol", "user admin"); n != 5 {
+		t.Errorf("expected admins not to be limited, got %d allowed", n)
+	}
+
+	for _, tiers := range [][]*ZoneTier{
+		{{MaxEvents: 1}},
+		{{Name: "a", MaxEvents: 1}, {Name: "a", MaxEvents: 2}},
+		{{Name: "a"}},
+		{{Name: "a", Unlimited: true, MaxEvents: 1}},
+	} {
+		zone := &RateLimit{ZoneName: "bad_tier_zone", Window: caddy.Duration(time.Minute), MaxEvents: 1, TierBy: "{http.auth.user.roles}", Tiers: tiers}
+		if err := zone.provision(caddy.Context{}, zone.ZoneName); err == nil {
+			t.Errorf("expected an error for tiers %+v", tiers)
+		}
+		_, _ = rateLimits.Delete(zone.ZoneName)
+	}
+	zone := &RateLimit{ZoneName: "bad_tier_zone", Window: caddy.Duration(time.Minute), MaxEvents: 1, TierBy: "roles", Tiers: []*ZoneTier{{Name: "a", MaxEvents: 1}}}
+	if err := zone.provision(caddy.Context{}, zone.ZoneName); err == nil {
+		t.Error("expected an error for tier_by without placeholders")
+	}
+	_, _ = rateLimits.Delete(zone.ZoneName)
+}
+
+func TestCaddyfileTiers(t *testing.T) {
+	var h Handler
+	if err := h.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`rate_limit {
+		zone api {
+			tier_by {http.auth.user.roles}
+			tier    admin unlimited
+			tier    user 100 {http.auth.user.id}
+			tier    partner 1000
+			events  10
+			window  1m
+		}
+	}`)); err != nil {
+		t.Fatalf("unmarshaling Caddyfile: %v", err)
+	}
+	zone := h.RateLimits[0]
+	if zone.TierBy != "{http.auth.user.roles}" || len(zone.Tiers) != 3 {
+		t.Fatalf("unexpected tiers: %q %+v", zone.TierBy, zone.Tiers)
+	}
+	for i, expected := range []ZoneTier{
+		{Name: "admin", Unlimited: true},
+		{Name: "user", MaxEvents: 100, Key: "{http.auth.user.id}"},
+		{Name: "partner", MaxEvents: 1000},
+	} {
+		if *zone.Tiers[i] != expected {
+			t.Errorf("tier %d: expected %+v, got %+v", i, expected, *zone.Tiers[i])
+		}
+	}
+
+	for _, tier := range []string{"tier admin unlimited {http.auth.user.id}", "tier user lots", "tier user"} {
+		var bad Handler
+		if err := bad.UnmarshalCaddyfile(caddyfile.NewTestDispenser("rate_limit {\n\tzone api {\n\t\t" + tier + "\n\t}\n}")); err == nil {
+			t.Errorf("expected an error for %q", tier)
+		}
+	}
+}
+
+func TestAuthenticatedLimit(t *testing.T) {
+	initTime()
+
+	rl := &RateLimit{
+		ZoneName:      "auth_zone",
+		Key:           "{http.request.remote.host}",
+		Window:        caddy.Duration(time.Minute),
+		MaxEvents:     1,
+		TierBy:        "{http.auth.user.roles}",
+		Tiers:         []*ZoneTier{{Name: "admin", Unlimited: true}},
+		Authenticated: &AuthenticatedLimit{MaxEvents: 3},
+	}
+	h := newTestHandler(t, rl)
+	t.Cleanup(func() { _, _ = rateLimits.Delete("auth_zone.authenticated") })
+
+	allowed := func(userID, roles string) int {
+		t.Helper()
+		n := 0
+		for range 5 {
+			req := newTestRequest("GET", "/", map[string]string{
+				"http.request.remote.host": "192.0.2.1",
+				"http.auth.user.id":        userID,
+				"http.auth.user.roles":     roles,
+			})
+			if allowedBy(t, h, req) {
+				n++
+			}
+		}
+		return n
+	}
+
+	// anonymous requests get the zone's limit by IP, and users their
+	// own limit by ID, although they come from the same IP
+	if n := allowed("", ""); n != 1 {
+		t.Errorf("expected 1 anonymous request to be allowed, got %d", n)
+	}
+	if n := allowed("alice", ""); n != 3 {
+		t.Errorf("expected 3 requests of a user to be allowed, got %d", n)
+	}
+	if n := allowed("bob", "reader"); n != 3 {
+		t.Errorf("expected another user to have their own limit, got %d allowed", n)
+	}
+	if _, ok := zoneLimiters("auth_zone.authenticated"); !ok {
+		t.Error("expected authenticated requests to have a zone of their own")
+	}
+
+	// tiers take precedence
+	if n := allowed("alice", "admin"); n != 5 {
+		t.Errorf("expected admins not to be limited, got %d allowed", n)
+	}
+
+	for _, auth := range []*AuthenticatedLimit{
+		{},
+		{MaxEvents: 1, User: "static"},
+	} {
+		zone := &RateLimit{ZoneName: "bad_auth_zone", Window: caddy.Duration(time.Minute), MaxEvents: 1, Authenticated: auth}
+		if err := zone.provision(caddy.Context{}, zone.ZoneName); err == nil {
+			t.Errorf("expected an error for %+v", auth)
+		}
+		_, _ = rateLimits.Delete(zone.ZoneName)
+	}
+
+	var parsed Handler
+	if err := parsed.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`rate_limit {
+		zone api {
+			authenticated 300 {http.request.header.X-User}
+			events 30
+			window 1m
+		}
+	}`)); err != nil {
+		t.Fatalf("unmarshaling Caddyfile: %v", err)
+	}
+	if auth := parsed.RateLimits[0].Authenticated; auth == nil || *auth != (AuthenticatedLimit{MaxEvents: 300, User: "{http.request.header.X-User}"}) {
+		t.Errorf("unexpected authenticated limit: %+v", auth)
+	}
+}
@@ -0,0 +1,51 @@
+package caddyrl
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// traceDecision annotates the request's span with the outcome of
+// evaluating a zone, so that declined requests are recognizable in
+// distributed traces. It does nothing unless Caddy's tracing handler
+// is recording a span for the request. When several zones apply to a
+// request, the attributes describe the last one evaluated.
+func traceDecision(r *http.Request, zoneName string, allowed bool, remaining int, wait time.Duration) {
+	span := trace.SpanFromContext(r.Context())
+	if !span.IsRecording() {
+		return
+	}
+
+	decision := decisionAllowed
+	if !allowed {
+		decision = decisionDeclined
+	}
+	attrs := []attribute.KeyValue{
+		attribute.String("rate_limit.zone", zoneName),
+		attribute.String("rate_limit.decision", decision),
+		attribute.Int("rate_limit.remaining", remaining),
+	}
+	span.SetAttributes(attrs...)
+
+	if !allowed {
+		span.AddEvent("rate_limit.declined", trace.WithAttributes(
+			append(attrs, attribute.Float64("rate_limit.wait_seconds", wait.Seconds()))...,
+		))
+	}
+}
+
+// traceExemplar returns the exemplar labels that link a metric sample
+// to the trace of ctx, or nil if the request is not part of a sampled
+// trace, so that users can jump from a metric straight to an example.
+func traceExemplar(ctx context.Context) prometheus.Labels {
+	spanCtx := trace.SpanContextFromContext(ctx)
+	if !spanCtx.IsSampled() {
+		return nil
+	}
+	return prometheus.Labels{"trace_id": spanCtx.TraceID().String()}
+}
@@ -0,0 +1,58 @@
+package caddyrl
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTraceDecision(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	ctx, span := provider.Tracer("test").Start(t.Context(), "request")
+	req := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+
+	traceDecision(req, "zone1", true, 4, 0)
+	traceDecision(req, "zone2", false, 0, 3*time.Second)
+	span.End()
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("expected 1 span, got %d", len(spans))
+	}
+
+	attrs := make(map[string]string)
+	for _, kv := range spans[0].Attributes() {
+		attrs[string(kv.Key)] = kv.Value.Emit()
+	}
+	if attrs["rate_limit.zone"] != "zone2" || attrs["rate_limit.decision"] != "declined" || attrs["rate_limit.remaining"] != "0" {
+		t.Fatalf("unexpected span attributes: %v", attrs)
+	}
+
+	events := spans[0].Events()
+	if len(events) != 1 || events[0].Name != "rate_limit.declined" {
+		t.Fatalf("expected a single decline event, got %+v", events)
+	}
+
+	// without a recording span, nothing should happen
+	traceDecision(httptest.NewRequest("GET", "/", nil), "zone1", false, 0, time.Second)
+}
+
+func TestTraceExemplar(t *testing.T) {
+	provider := sdktrace.NewTracerProvider()
+	ctx, span := provider.Tracer("test").Start(t.Context(), "request")
+	defer span.End()
+
+	exemplar := traceExemplar(ctx)
+	if exemplar["trace_id"] != span.SpanContext().TraceID().String() {
+		t.Fatalf("expected exemplar with trace ID %s, got %v", span.SpanContext().TraceID(), exemplar)
+	}
+
+	if exemplar := traceExemplar(t.Context()); exemplar != nil {
+		t.Fatalf("expected no exemplar without a trace, got %v", exemplar)
+	}
+}
@@ -0,0 +1,303 @@
+package caddyrl
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/headers"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+)
+
+func init() {
+	caddy.RegisterModule(UpstreamTransport{})
+}
+
+// UpstreamTransport is a reverse_proxy transport that rate limits
+// requests after an upstream has been selected for them, before passing
+// them on to another transport. So zones can be keyed on the upstream,
+// e.g. with `{http.reverse_proxy.upstream.hostport}`, to give each
+// backend its own protective ceiling.
+//
+// It has the same settings as the rate_limit handler. A declined request
+// gets a 429 response with a Retry-After header from the transport, as
+// if the upstream had sent it; so reverse_proxy's `handle_response` can
+// handle it, but it is not retried with another upstream. Alternatively,
+// requests can wait until they are within the limits, which throttles
+// requests to e.g. third-party APIs with a quota.
+type UpstreamTransport struct {
+	Handler
+
+	// If greater than zero, a request that exceeds a limit waits until
+	// it is within the limit, if that is no longer than this, instead of
+	// being declined right away. Default: 0 (decline right away)
+	MaxWait caddy.Duration `json:"max_wait,omitempty"`
+
+	// The transport that requests within the limits are passed on to.
+	// Default: http
+	TransportRaw json.RawMessage `json:"transport,omitempty" caddy:"namespace=http.reverse_proxy.transport inline_key=protocol"`
+
+	transport http.RoundTripper
+}
+
+// CaddyModule returns the Caddy module information.
+func (UpstreamTransport) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.reverse_proxy.transport.rate_limit",
+		New: func() caddy.Module { return new(UpstreamTransport) },
+	}
+}
+
+// Provision sets up the transport.
+func (t *UpstreamTransport) Provision(ctx caddy.Context) error {
+	if t.MaxWait < 0 {
+		return fmt.Errorf("max_wait must be at least zero")
+	}
+	if err := t.Handler.Provision(ctx); err != nil {
+		return err
+	}
+
+	if t.TransportRaw != nil {
+		mod, err := ctx.LoadModule(t, "TransportRaw")
+		if err != nil {
+			return fmt.Errorf("loading transport: %v", err)
+		}
+		t.transport = mod.(http.RoundTripper)
+	} else {
+		transport := new(reverseproxy.HTTPTransport)
+		if err := transport.Provision(ctx); err != nil {
+			return fmt.Errorf("setting up default transport: %v", err)
+		}
+		t.transport = transport
+	}
+
+	return nil
+}
+
+// RoundTrip applies the rate limits to req, and passes it on to the
+// transport if it is within them.
+func (t *UpstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.MaxWait > 0 {
+		if wait := t.wait(req); wait > 0 && wait <= time.Duration(t.MaxWait) {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-req.Context().Done():
+				timer.Stop()
+				return nil, req.Context().Err()
+			}
+		}
+	}
+
+	header := make(http.Header)
+	quotas, err := t.limitRequest(headerWriter(header), req)
+	if err != nil {
+		if isDeclined(err) {
+			status := http.StatusTooManyRequests
+			if handlerErr, ok := err.(caddyhttp.HandlerError); ok {
+				status = handlerErr.StatusCode
+			} else if _, ok := err.(grpcDeclined); ok {
+				status = http.StatusOK
+			}
+			return &http.Response{
+				Status:     fmt.Sprintf("%d %s", status, http.StatusText(status)),
+				StatusCode: status,
+				Proto:      req.Proto,
+				ProtoMajor: req.ProtoMajor,
+				ProtoMinor: req.ProtoMinor,
+				Header:     header,
+				Body:       http.NoBody,
+				Request:    req,
+			}, nil
+		}
+		return nil, err
+	}
+
+	resp, err := t.transport.RoundTrip(req)
+	if err == nil && t.UpstreamRetryAfter != nil && resp.StatusCode == http.StatusTooManyRequests {
+		repl := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+		t.UpstreamRetryAfter.tooManyRequests(resp.Header, repl, quotas.keys)
+	}
+	return resp, err
+}
+
+// wait returns how long req has to wait until it is within the limits
+// of all zones that it matches. Concurrent requests may use up the
+// events it waited for, in which case it is declined after all.
+func (t *UpstreamTransport) wait(req *http.Request) time.Duration {
+	repl := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+
+	var wait time.Duration
+	for _, rl := range t.rateLimits {
+		if matched, err := rl.matcherSets.AnyMatchWithError(req); err != nil || !matched {
+			continue
+		}
+		rl := rl.resolve(repl)
+		if !rl.limitsEvents() {
+			continue
+		}
+		_, _, keyWait := rl.limitersMap.peek(rl.keyFor(req, repl))
+		wait = max(wait, keyWait)
+		if total := rl.limitersMap.total.Load(); total != nil {
+			wait = max(wait, total.waitUnsynced(now()))
+		}
+	}
+	return wait
+}
+
+// Cleanup cleans up the transport.
+func (t *UpstreamTransport) Cleanup() error {
+	if cleanerUpper, ok := t.transport.(caddy.CleanerUpper); ok {
+		if err := cleanerUpper.Cleanup(); err != nil {
+			return err
+		}
+	}
+	return t.Handler.Cleanup()
+}
+
+// The optional interfaces of reverse_proxy transports are implemented by
+// delegating to the wrapped transport, so that wrapping it doesn't change
+// how reverse_proxy uses it.
+
+// TLSEnabled returns true if the wrapped transport has TLS enabled.
+func (t *UpstreamTransport) TLSEnabled() bool {
+	tlsTransport, ok := t.transport.(reverseproxy.TLSTransport)
+	return ok && tlsTransport.TLSEnabled()
+}
+
+// EnableTLS enables TLS within the wrapped transport.
+func (t *UpstreamTransport) EnableTLS(base *reverseproxy.TLSConfig) error {
+	tlsTransport, ok := t.transport.(reverseproxy.TLSTransport)
+	if !ok {
+		return fmt.Errorf("transport does not support TLS")
+	}
+	return tlsTransport.EnableTLS(base)
+}
+
+// EnableH2C enables H2C within the wrapped transport.
+func (t *UpstreamTransport) EnableH2C() error {
+	h2cTransport, ok := t.transport.(reverseproxy.H2CTransport)
+	if !ok {
+		return fmt.Errorf("transport does not support h2c")
+	}
+	return h2cTransport.EnableH2C()
+}
+
+// ProxyProtocolEnabled returns true if the wrapped transport uses the
+// proxy protocol.
+func (t *UpstreamTransport) ProxyProtocolEnabled() bool {
+	proxyProtocolTransport, ok := t.transport.(reverseproxy.ProxyProtocolTransport)
+	return ok && proxyProtocolTransport.ProxyProtocolEnabled()
+}
+
+// OverrideHealthCheckScheme lets the wrapped transport override the
+// scheme of health checks.
+func (t *UpstreamTransport) OverrideHealthCheckScheme(base *url.URL, port string) {
+	if overrider, ok := t.transport.(reverseproxy.HealthCheckSchemeOverriderTransport); ok {
+		overrider.OverrideHealthCheckScheme(base, port)
+	}
+}
+
+// DefaultBufferSizes returns the default buffer sizes of the wrapped
+// transport.
+func (t *UpstreamTransport) DefaultBufferSizes() (int64, int64) {
+	if bufferedTransport, ok := t.transport.(reverseproxy.BufferedTransport); ok {
+		return bufferedTransport.DefaultBufferSizes()
+	}
+	return 0, 0
+}
+
+// RequestHeaderOps returns the header operations of the wrapped transport.
+func (t *UpstreamTransport) RequestHeaderOps() *headers.HeaderOps {
+	if headerOpsTransport, ok := t.transport.(reverseproxy.RequestHeaderOpsTransport); ok {
+		return headerOpsTransport.RequestHeaderOps()
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler. It takes the
+// options of the rate_limit handler, plus the transport to wrap:
+//
+//	transport rate_limit {
+//	    zone <name> {
+//	        key {http.reverse_proxy.upstream.hostport}
+//	        ...
+//	    }
+//	    max_wait <duration>
+//	    transport <name> {
+//	        ...
+//	    }
+//	}
+func (t *UpstreamTransport) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume transport name
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "transport":
+			if t.TransportRaw != nil {
+				return d.Err("transport already specified")
+			}
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			name := d.Val()
+			unm, err := caddyfile.UnmarshalModule(d, "http.reverse_proxy.transport."+name)
+			if err != nil {
+				return err
+			}
+			transport, ok := unm.(http.RoundTripper)
+			if !ok {
+				return d.Errf("module %s (%T) is not a RoundTripper", name, unm)
+			}
+			t.TransportRaw = caddyconfig.JSONModuleObject(transport, "protocol", name, nil)
+
+		case "max_wait":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			maxWait, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid max wait '%s': %v", d.Val(), err)
+			}
+			t.MaxWait = caddy.Duration(maxWait)
+
+		default:
+			if err := t.unmarshalOption(d); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// headerWriter is a ResponseWriter that only collects headers, for
+// limiting requests where no response is being written.
+type headerWriter http.Header
+
+func (w headerWriter) Header() http.Header       { return http.Header(w) }
+func (headerWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (headerWriter) WriteHeader(int)             {}
+
+// Interface guards
+var (
+	_ caddy.Provisioner                                = (*UpstreamTransport)(nil)
+	_ caddy.CleanerUpper                               = (*UpstreamTransport)(nil)
+	_ http.RoundTripper                                = (*UpstreamTransport)(nil)
+	_ caddyfile.Unmarshaler                            = (*UpstreamTransport)(nil)
+	_ reverseproxy.TLSTransport                        = (*UpstreamTransport)(nil)
+	_ reverseproxy.H2CTransport                        = (*UpstreamTransport)(nil)
+	_ reverseproxy.ProxyProtocolTransport              = (*UpstreamTransport)(nil)
+	_ reverseproxy.HealthCheckSchemeOverriderTransport = (*UpstreamTransport)(nil)
+	_ reverseproxy.BufferedTransport                   = (*UpstreamTransport)(nil)
+	_ reverseproxy.RequestHeaderOpsTransport           = (*UpstreamTransport)(nil)
+)
@@ -0,0 +1,84 @@
+package caddyrl
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// roundTripperFunc is an http.RoundTripper made of a function.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestUpstreamTransport(t *testing.T) {
+	initTime()
+
+	rl := &RateLimit{
+		ZoneName:  "upstream_transport",
+		Key:       "{http.reverse_proxy.upstream.hostport}",
+		MaxEvents: 1,
+		Window:    caddy.Duration(time.Minute),
+	}
+
+	var proxied int
+	transport := &UpstreamTransport{
+		Handler: newTestHandler(t, rl),
+		transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			proxied++
+			return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+		}),
+	}
+	roundTrip := func(upstream string) *http.Response {
+		req := newTestRequest(http.MethodGet, "/", map[string]string{"http.reverse_proxy.upstream.hostport": upstream})
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return resp
+	}
+
+	if resp := roundTrip("10.0.0.1:80"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("first request to upstream should be proxied, got status %d", resp.StatusCode)
+	}
+	resp := roundTrip("10.0.0.1:80")
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "60" {
+		t.Fatalf("expected 429 with Retry-After 60, got status %d, headers %v", resp.StatusCode, resp.Header)
+	}
+	if resp := roundTrip("10.0.0.2:80"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("other upstreams have their own limits, got status %d", resp.StatusCode)
+	}
+	if proxied != 2 {
+		t.Fatalf("expected 2 requests to be proxied, got %d", proxied)
+	}
+}
+
+func TestUnmarshalUpstreamTransport(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`
+	rate_limit {
+		zone per_upstream {
+			key    {http.reverse_proxy.upstream.hostport}
+			window 1m
+			events 100
+		}
+		transport http {
+			read_timeout 5s
+		}
+	}`)
+
+	var transport UpstreamTransport
+	if err := transport.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshaling Caddyfile: %v", err)
+	}
+	if len(transport.RateLimits) != 1 || transport.RateLimits[0].ZoneName != "per_upstream" {
+		t.Fatalf("unexpected zones: %+v", transport.RateLimits)
+	}
+	if len(transport.TransportRaw) == 0 {
+		t.Fatal("expected the wrapped transport to be set")
+	}
+}
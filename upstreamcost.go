@@ -0,0 +1,107 @@
+package caddyrl
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// upstreamCost is a key that a request was counted against in a zone
+// whose later handlers may declare the request's actual cost, or refund
+// events to the key.
+type upstreamCost struct {
+	zone *RateLimit
+	key  string
+
+	// the number of events the request was already counted as
+	paid int
+}
+
+// wrapUpstreamCost returns w wrapped so that the costs that later
+// handlers declare in their responses are debited from the keys, and
+// their refunds credited to them.
+func wrapUpstreamCost(w http.ResponseWriter, costs []upstreamCost) http.ResponseWriter {
+	return &upstreamCostWriter{
+		ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w},
+		costs:                 costs,
+	}
+}
+
+// upstreamCostWriter debits the costs and credits the refunds in the
+// response headers of later handlers; see RateLimit.CostHeader and
+// RateLimit.RefundHeader.
+type upstreamCostWriter struct {
+	*caddyhttp.ResponseWriterWrapper
+	costs       []upstreamCost
+	wroteHeader bool
+}
+
+func (w *upstreamCostWriter) WriteHeader(status int) {
+	// informational responses are followed by the final one
+	if !w.wroteHeader && status >= 200 {
+		w.wroteHeader = true
+		debitUpstreamCosts(w.Header(), w.costs)
+	}
+	w.ResponseWriterWrapper.WriteHeader(status)
+}
+
+func (w *upstreamCostWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriterWrapper.Write(p)
+}
+
+func (w *upstreamCostWriter) ReadFrom(r io.Reader) (int64, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriterWrapper.ReadFrom(r)
+}
+
+// debitUpstreamCosts debits the cost that header declares for each
+// zone, beyond what the request was already counted as, from the
+// request's key, and credits the refund it declares. The cost and
+// refund headers are removed from the response.
+func debitUpstreamCosts(header http.Header, costs []upstreamCost) {
+	for _, uc := range costs {
+		if cost, ok := upstreamCostHeader(header, uc.zone.CostHeader); ok && cost > uc.paid {
+			uc.zone.limitersMap.debit(uc.key, cost-uc.paid)
+		}
+		if refund, ok := upstreamCostHeader(header, uc.zone.RefundHeader); ok && refund > 0 {
+			// the zone has no algorithm module, so refunds can't fail
+			_, _ = uc.zone.limitersMap.refund(uc.key, refund)
+		}
+	}
+	for _, uc := range costs {
+		if uc.zone.CostHeader != "" {
+			header.Del(uc.zone.CostHeader)
+		}
+		if uc.zone.RefundHeader != "" {
+			header.Del(uc.zone.RefundHeader)
+		}
+	}
+}
+
+// upstreamCostHeader returns the number of events in the header with
+// the given name, if it is set to a number.
+func upstreamCostHeader(header http.Header, name string) (int, bool) {
+	if name == "" {
+		return 0, false
+	}
+	value := header.Get(name)
+	if value == "" {
+		return 0, false
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(value))
+	return n, err == nil
+}
+
+// Interface guards
+var (
+	_ http.ResponseWriter = (*upstreamCostWriter)(nil)
+	_ io.ReaderFrom       = (*upstreamCostWriter)(nil)
+)
@@ -0,0 +1,79 @@
+package caddyrl
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestUpstreamCost(t *testing.T) {
+	initTime()
+
+	rl := &RateLimit{
+		Window:     caddy.Duration(time.Minute),
+		MaxEvents:  10,
+		CostHeader: "X-RateLimit-Cost",
+	}
+	if err := rl.provision(caddy.Context{}, "upstream_cost_zone"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _, _ = rateLimits.Delete("upstream_cost_zone") })
+	count := func() int {
+		n, _ := rl.limitersMap.getOrInsert("client").Count(now())
+		return n
+	}
+
+	respond := func(cost string, paid int) *httptest.ResponseRecorder {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		w := wrapUpstreamCost(rec, []upstreamCost{{zone: rl, key: "client", paid: paid}})
+		if cost != "" {
+			w.Header().Set("X-RateLimit-Cost", cost)
+		}
+		w.WriteHeader(http.StatusOK)
+		return rec
+	}
+
+	// the request already counted as 2 events, so 5 more are debited
+	rl.limitersMap.debit("client", 2)
+	rec := respond("7", 2)
+	if n := count(); n != 7 {
+		t.Fatalf("expected 7 events after the declared cost, got %d", n)
+	}
+	if rec.Header().Get("X-RateLimit-Cost") != "" {
+		t.Fatal("expected cost header to be removed from the response")
+	}
+
+	// lower, missing and invalid costs debit nothing
+	for _, cost := range []string{"1", "", "lots"} {
+		respond(cost, 1)
+	}
+	if n := count(); n != 7 {
+		t.Fatalf("expected no more events, got %d", n)
+	}
+
+	// costs beyond the limit fill the window, so the key has to wait
+	respond("100", 1)
+	if n := count(); n != 10 {
+		t.Fatalf("expected the window to be full, got %d", n)
+	}
+	if wait := rl.limitersMap.when(rl.limitersMap.getOrInsert("client")); wait == 0 {
+		t.Fatal("expected the key's next event to wait")
+	}
+
+	// refunds credit events back to the key
+	rl.RefundHeader = "X-RateLimit-Refund"
+	rec = httptest.NewRecorder()
+	w := wrapUpstreamCost(rec, []upstreamCost{{zone: rl, key: "client", paid: 1}})
+	w.Header().Set("X-RateLimit-Refund", "4")
+	w.WriteHeader(http.StatusOK)
+	if n := count(); n != 6 {
+		t.Fatalf("expected 6 events after the refund, got %d", n)
+	}
+	if rec.Header().Get("X-RateLimit-Refund") != "" {
+		t.Fatal("expected refund header to be removed from the response")
+	}
+}
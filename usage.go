@@ -0,0 +1,315 @@
+package caddyrl
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+)
+
+// UsageExport exports how many events each key of the handler's zones
+// consumed per period, e.g. per hour, so that the quotas that are
+// enforced can also be metered and billed. At the end of every period,
+// a record per zone and key with events in the period is written to
+// each configured sink: a file, the handler's storage, or a URL.
+//
+// Records are per instance. The events of a period may be split over
+// several records of a key, e.g. when the config is reloaded during the
+// period; consumers should sum them.
+type UsageExport struct {
+	// How long each period is. Periods are aligned to multiples of
+	// their duration since the Unix epoch, e.g. to full hours in UTC.
+	// Default: 1h
+	Period caddy.Duration `json:"period,omitempty"`
+
+	// The zones whose usage is exported. Default: all of the handler's
+	// zones
+	Zones []string `json:"zones,omitempty"`
+
+	// Path of a file to append records to.
+	File string `json:"file,omitempty"`
+
+	// The format of the file: `json` for a JSON object per line, or
+	// `csv`, with a header line if the file is new. Default: json
+	Format string `json:"format,omitempty"`
+
+	// URL to POST the records of every period to, as a JSON object with
+	// a `records` array.
+	URL string `json:"url,omitempty"`
+
+	// If true, the records of every period are stored as JSON in the
+	// handler's storage, under `rate_limit/usage/<period start>/`.
+	Storage bool `json:"storage,omitempty"`
+
+	storage    certmagic.Storage
+	client     *http.Client
+	instanceID string
+	logger     *zap.Logger
+
+	mu     sync.Mutex
+	start  time.Time // of the current period
+	counts map[usageKey]int64
+}
+
+type usageKey struct {
+	zone, key string
+}
+
+// usageRecord is the usage of a key in a period, as it is exported.
+type usageRecord struct {
+	Zone        string    `json:"zone"`
+	Key         string    `json:"key"`
+	Events      int64     `json:"events"`
+	PeriodStart time.Time `json:"period_start"`
+	PeriodEnd   time.Time `json:"period_end"`
+	Instance    string    `json:"instance"`
+}
+
+// usagePayload is the body POSTed to the usage URL.
+type usagePayload struct {
+	Records []usageRecord `json:"records"`
+}
+
+// Formats of usage files.
+const (
+	usageFormatJSON = "json"
+	usageFormatCSV  = "csv"
+)
+
+// usageStoragePrefix is where usage records are kept in storage.
+const usageStoragePrefix = "rate_limit/usage"
+
+func (ue *UsageExport) provision(storage certmagic.Storage, logger *zap.Logger) error {
+	if ue.Period == 0 {
+		ue.Period = caddy.Duration(time.Hour)
+	}
+	if ue.Period < 0 {
+		return fmt.Errorf("period must be greater than zero")
+	}
+	switch ue.Format {
+	case "":
+		ue.Format = usageFormatJSON
+	case usageFormatJSON, usageFormatCSV:
+	default:
+		return fmt.Errorf("unknown format '%s'", ue.Format)
+	}
+	if ue.File == "" && ue.URL == "" && !ue.Storage {
+		return fmt.Errorf("at least one of file, url and storage is required")
+	}
+	iid, err := caddy.InstanceID()
+	if err != nil {
+		return fmt.Errorf("getting instance ID: %v", err)
+	}
+	ue.instanceID = iid.String()
+	ue.storage = storage
+	ue.client = &http.Client{Timeout: 10 * time.Second}
+	ue.logger = logger.Named("usage")
+	ue.start = now().Truncate(time.Duration(ue.Period))
+	ue.counts = make(map[usageKey]int64)
+	return nil
+}
+
+// count adds n events of key in zone to the current period.
+func (ue *UsageExport) count(zone, key string, n int) {
+	if len(ue.Zones) > 0 && !slices.Contains(ue.Zones, zone) {
+		return
+	}
+	ue.mu.Lock()
+	ue.counts[usageKey{zone, key}] += int64(n)
+	ue.mu.Unlock()
+}
+
+// take returns the records of the period up to end, and starts the
+// next one.
+func (ue *UsageExport) take(end time.Time) []usageRecord {
+	ue.mu.Lock()
+	counts, start := ue.counts, ue.start
+	ue.counts = make(map[usageKey]int64, len(counts))
+	ue.start = end
+	ue.mu.Unlock()
+
+	records := make([]usageRecord, 0, len(counts))
+	for uk, events := range counts {
+		records = append(records, usageRecord{
+			Zone:        uk.zone,
+			Key:         uk.key,
+			Events:      events,
+			PeriodStart: start.UTC(),
+			PeriodEnd:   end.UTC(),
+			Instance:    ue.instanceID,
+		})
+	}
+	slices.SortFunc(records, func(a, b usageRecord) int {
+		return cmp.Or(cmp.Compare(a.Zone, b.Zone), cmp.Compare(a.Key, b.Key))
+	})
+	return records
+}
+
+// run exports the records of every period as it ends, and the records
+// of the unfinished period when ctx is done, e.g. on a config reload.
+func (ue *UsageExport) run(ctx context.Context) {
+	labelTask(ctx, "usage_export")
+	for {
+		ue.mu.Lock()
+		end := ue.start.Add(time.Duration(ue.Period))
+		ue.mu.Unlock()
+
+		timer := time.NewTimer(end.Sub(now()))
+		select {
+		case <-timer.C:
+			ue.export(ctx, ue.take(end))
+		case <-ctx.Done():
+			timer.Stop()
+			// the context's requests and storage operations would fail now
+			exportCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			ue.export(exportCtx, ue.take(now()))
+			cancel()
+			return
+		}
+	}
+}
+
+// export writes records to every configured sink.
+func (ue *UsageExport) export(ctx context.Context, records []usageRecord) {
+	if len(records) == 0 {
+		return
+	}
+	if ue.File != "" {
+		if err := ue.writeFile(records); err != nil {
+			ue.logger.Error("writing usage file", zap.String("file", ue.File), zap.Error(err))
+		}
+	}
+	if ue.Storage {
+		if err := ue.store(ctx, records); err != nil {
+			ue.logger.Error("storing usage", zap.Error(err))
+		}
+	}
+	if ue.URL != "" {
+		ue.send(ctx, records)
+	}
+}
+
+// usageAttempts is how often sending the records of a period to the
+// usage URL is attempted.
+const usageAttempts = 5
+
+// Initial delay before retrying to send usage records, to be
+// substituted by tests
+var usageBackoff = time.Second
+
+// send posts records to the URL, retrying with exponential backoff.
+func (ue *UsageExport) send(ctx context.Context, records []usageRecord) {
+	backoff := usageBackoff
+	for attempt := 1; ; attempt++ {
+		err := ue.post(ctx, records)
+		if err == nil {
+			return
+		}
+		if attempt >= usageAttempts {
+			ue.logger.Error("giving up on sending usage",
+				zap.String("url", ue.URL),
+				zap.Int("attempts", attempt),
+				zap.Int("records", len(records)),
+				zap.Error(err))
+			return
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+		backoff *= 2
+	}
+}
+
+// writeFile appends records to the file in its format.
+func (ue *UsageExport) writeFile(records []usageRecord) error {
+	file, err := os.OpenFile(ue.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var buf bytes.Buffer
+	switch ue.Format {
+	case usageFormatCSV:
+		w := csv.NewWriter(&buf)
+		if info, err := file.Stat(); err == nil && info.Size() == 0 {
+			_ = w.Write([]string{"period_start", "period_end", "zone", "key", "events", "instance"})
+		}
+		for _, record := range records {
+			_ = w.Write([]string{
+				record.PeriodStart.Format(time.RFC3339),
+				record.PeriodEnd.Format(time.RFC3339),
+				record.Zone,
+				record.Key,
+				strconv.FormatInt(record.Events, 10),
+				record.Instance,
+			})
+		}
+		w.Flush()
+	default:
+		enc := json.NewEncoder(&buf)
+		for _, record := range records {
+			if err := enc.Encode(record); err != nil {
+				return err
+			}
+		}
+	}
+	// a single write, so that records aren't interleaved with those
+	// of another handler
+	_, err = file.Write(buf.Bytes())
+	return err
+}
+
+// store keeps records in storage, in a file per instance and export.
+func (ue *UsageExport) store(ctx context.Context, records []usageRecord) error {
+	encoded, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	first := records[0]
+	storageKey := path.Join(usageStoragePrefix,
+		first.PeriodStart.Format("20060102T150405Z"),
+		ue.instanceID+"-"+strconv.FormatInt(first.PeriodEnd.UnixNano(), 10)+".json")
+	return ue.storage.Store(ctx, storageKey, encoded)
+}
+
+// post sends records to the URL.
+func (ue *UsageExport) post(ctx context.Context, records []usageRecord) error {
+	body, err := json.Marshal(usagePayload{Records: records})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ue.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := ue.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package caddyrl
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+)
+
+func TestUsageExport(t *testing.T) {
+	initTime()
+
+	var posted usagePayload
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &posted); err != nil {
+			t.Errorf("decoding posted records: %v", err)
+		}
+	}))
+	defer srv.Close()
+
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	file := filepath.Join(t.TempDir(), "usage.csv")
+	ue := &UsageExport{
+		Period:  caddy.Duration(time.Hour),
+		Zones:   []string{"api"},
+		File:    file,
+		Format:  "csv",
+		URL:     srv.URL,
+		Storage: true,
+	}
+	if err := ue.provision(storage, zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+
+	ue.count("api", "customer-a", 1)
+	ue.count("api", "customer-a", 5)
+	ue.count("api", "customer-b", 2)
+	ue.count("other", "customer-a", 100)
+
+	start := now().Truncate(time.Hour)
+	records := ue.take(start.Add(time.Hour))
+	if len(records) != 2 || records[0].Key != "customer-a" || records[0].Events != 6 || records[1].Events != 2 {
+		t.Fatalf("unexpected records: %+v", records)
+	}
+	if !records[0].PeriodStart.Equal(start) || !records[0].PeriodEnd.Equal(start.Add(time.Hour)) {
+		t.Errorf("expected the period from %v, got %v to %v", start, records[0].PeriodStart, records[0].PeriodEnd)
+	}
+	ue.export(t.Context(), records)
+
+	csvFile, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(csvFile)), "\n")
+	if len(lines) != 3 || lines[0] != "period_start,period_end,zone,key,events,instance" || !strings.Contains(lines[1], ",api,customer-a,6,") {
+		t.Errorf("unexpected CSV file:\n%s", csvFile)
+	}
+	if len(posted.Records) != 2 || posted.Records[1].Key != "customer-b" {
+		t.Errorf("unexpected posted records: %+v", posted.Records)
+	}
+	stored, err := storage.List(t.Context(), usageStoragePrefix, false)
+	if err != nil || len(stored) != 1 {
+		t.Errorf("expected the records of one period in storage, got %v (%v)", stored, err)
+	}
+
+	// the next period starts empty, and the header isn't repeated
+	if records := ue.take(start.Add(2 * time.Hour)); len(records) != 0 {
+		t.Errorf("expected no records in the next period, got %+v", records)
+	}
+	ue.count("api", "customer-a", 1)
+	ue.export(t.Context(), ue.take(start.Add(3*time.Hour)))
+	csvFile, _ = os.ReadFile(file)
+	if n := strings.Count(string(csvFile), "period_start"); n != 1 {
+		t.Errorf("expected one header line, got %d", n)
+	}
+
+	if err := (&UsageExport{}).provision(storage, zap.NewNop()); err == nil {
+		t.Error("expected an error without sinks")
+	}
+	if err := (&UsageExport{File: file, Format: "xml"}).provision(storage, zap.NewNop()); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
+
+func TestCaddyfileUsageExport(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`
+	rate_limit {
+		usage_export 24h {
+			zones api uploads
+			file  /var/log/usage.csv csv
+			url   https://billing.example.com/usage
+			storage
+		}
+	}`)
+
+	var h Handler
+	if err := h.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshaling Caddyfile: %v", err)
+	}
+	ue := h.UsageExport
+	if ue == nil || ue.Period != caddy.Duration(24*time.Hour) || len(ue.Zones) != 2 || ue.File != "/var/log/usage.csv" ||
+		ue.Format != "csv" || ue.URL != "https://billing.example.com/usage" || !ue.Storage {
+		t.Errorf("unexpected usage export: %+v", ue)
+	}
+
+	for _, input := range []string{
+		`rate_limit {
+			usage_export daily
+		}`,
+		`rate_limit {
+			usage_export {
+				file
+			}
+		}`,
+		`rate_limit {
+			usage_export {
+				bucket usage
+			}
+		}`,
+	} {
+		var h Handler
+		if err := h.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err == nil {
+			t.Errorf("expected error for input: %s", input)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package caddyrl
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// User-Agent classes of the built-in lists.
+const (
+	userAgentBrowser = "browser"
+	userAgentGoodBot = "good-bot"
+	userAgentBadBot  = "bad-bot"
+	userAgentUnknown = "unknown"
+)
+
+// UserAgentClassifier assigns requests to classes by their User-Agent
+// header, so that zones can be keyed on the class or select requests of
+// certain classes through the `{http.rate_limit.user_agent_class}`
+// placeholder. User-Agents are trivially spoofed, so classes are a hint
+// to differentiate limits, not a means of authentication.
+type UserAgentClassifier struct {
+	// Rules that assign classes, tried in order before the built-in
+	// lists. The first rule with a matching pattern wins.
+	Rules []*UserAgentRule `json:"rules,omitempty"`
+
+	// If true, the built-in lists of known browsers and bots are not
+	// used, and requests that no rule matches are of the `unknown` class.
+	DisableBuiltin bool `json:"disable_builtin,omitempty"`
+
+	rules []userAgentRule
+}
+
+// UserAgentRule assigns a class to requests whose User-Agent matches any
+// of its patterns.
+type UserAgentRule struct {
+	// The class of the matching requests, e.g. `partner`.
+	Class string `json:"class"`
+
+	// Regular expressions that are matched against the User-Agent header.
+	Patterns []string `json:"patterns"`
+}
+
+// userAgentRule is a provisioned UserAgentRule.
+type userAgentRule struct {
+	class   string
+	pattern *regexp.Regexp
+}
+
+// builtinUserAgentRules are the built-in lists of bots and browsers,
+// tried in order after the configured rules. Bots are listed before
+// browsers, since many bots claim to be browsers too.
+var builtinUserAgentRules = []userAgentRule{
+	{
+		// search engines, link previews and monitoring that identify
+		// themselves and generally honor robots.txt
+		class: userAgentGoodBot,
+		pattern: regexp.MustCompile(`(?i)googlebot|google-inspectiontool|storebot-google|adsbot-google|` +
+			`bingbot|bingpreview|duckduckbot|yandex(bot|images)|baiduspider|applebot|slurp|` +
+			`facebookexternalhit|facebookcatalog|twitterbot|linkedinbot|slackbot|discordbot|` +
+			`telegrambot|whatsapp|pinterestbot|uptimerobot|pingdom`),
+	},
+	{
+		// aggressive crawlers, scrapers, scanners and HTTP libraries
+		class: userAgentBadBot,
+		pattern: regexp.MustCompile(`(?i)ahrefsbot|semrushbot|mj12bot|dotbot|petalbot|bytespider|` +
+			`blexbot|dataforseobot|megaindex|serpstatbot|scrapy|python-requests|python-urllib|` +
+			`aiohttp|httpx|go-http-client|java/|okhttp|libwww-perl|wget|curl/|` +
+			`masscan|zgrab|nmap|nikto|sqlmap|nuclei|headlesschrome|phantomjs`),
+	},
+	{
+		class:   userAgentBrowser,
+		pattern: regexp.MustCompile(`^Mozilla/5\.0 \(.*(Chrome|Firefox|Safari|Edg|OPR)/`),
+	},
+}
+
+func (uc *UserAgentClassifier) provision() error {
+	uc.rules = nil
+	for i, rule := range uc.Rules {
+		if rule.Class == "" {
+			return fmt.Errorf("rule %d: class is required", i)
+		}
+		if len(rule.Patterns) == 0 {
+			return fmt.Errorf("rule %d: at least one pattern is required", i)
+		}
+		for _, pattern := range rule.Patterns {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return fmt.Errorf("rule %d: invalid pattern '%s': %v", i, pattern, err)
+			}
+			uc.rules = append(uc.rules, userAgentRule{class: rule.Class, pattern: re})
+		}
+	}
+	if !uc.DisableBuiltin {
+		uc.rules = append(uc.rules, builtinUserAgentRules...)
+	}
+	return nil
+}
+
+// classify returns the class of the User-Agent userAgent.
+func (uc *UserAgentClassifier) classify(userAgent string) string {
+	if userAgent == "" {
+		return userAgentUnknown
+	}
+	for _, rule := range uc.rules {
+		if rule.pattern.MatchString(userAgent) {
+			return rule.class
+		}
+	}
+	return userAgentUnknown
+}
+
+// setPlaceholder sets the placeholder of the class of r.
+func (uc *UserAgentClassifier) setPlaceholder(repl *caddy.Replacer, r *http.Request) {
+	repl.Set("http.rate_limit.user_agent_class", uc.classify(r.UserAgent()))
+}
@@ -0,0 +1,64 @@
+package caddyrl
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestUserAgentClassifier(t *testing.T) {
+	uc := &UserAgentClassifier{
+		Rules: []*UserAgentRule{
+			{Class: "partner", Patterns: []string{`^PartnerSync/`, `^python-requests/.* partner$`}},
+		},
+	}
+	if err := uc.provision(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for userAgent, want := range map[string]string{
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Safari/537.36":         userAgentBrowser,
+		"Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0":                                                  userAgentBrowser,
+		"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)":                                                userAgentGoodBot,
+		"Mozilla/5.0 (Linux; Android 6.0.1) AppleWebKit/537.36 Chrome/126.0.0.0 Mobile Safari/537.36 (compatible; Googlebot/2.1)": userAgentGoodBot,
+		"Mozilla/5.0 (compatible; AhrefsBot/7.0; +http://ahrefs.com/robot/)":                                                      userAgentBadBot,
+		"python-requests/2.32.3":         userAgentBadBot,
+		"python-requests/2.32.3 partner": "partner",
+		"PartnerSync/1.0":                "partner",
+		"SomeTool/1.0":                   userAgentUnknown,
+		"":                               userAgentUnknown,
+	} {
+		if got := uc.classify(userAgent); got != want {
+			t.Errorf("%q: expected class %s, got %s", userAgent, want, got)
+		}
+	}
+
+	uc.DisableBuiltin = true
+	if err := uc.provision(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := uc.classify("python-requests/2.32.3"); got != userAgentUnknown {
+		t.Errorf("expected built-in lists to be disabled, got class %s", got)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("User-Agent", "PartnerSync/1.0")
+	repl := caddy.NewReplacer()
+	uc.setPlaceholder(repl, r)
+	if class, _ := repl.GetString("http.rate_limit.user_agent_class"); class != "partner" {
+		t.Errorf("unexpected class placeholder %q", class)
+	}
+
+	for _, rule := range []*UserAgentRule{
+		{Patterns: []string{"a"}},
+		{Class: "a"},
+		{Class: "a", Patterns: []string{"("}},
+	} {
+		uc := &UserAgentClassifier{Rules: []*UserAgentRule{rule}}
+		if err := uc.provision(); err == nil {
+			t.Errorf("expected an error for rule %+v", rule)
+		}
+	}
+}
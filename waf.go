@@ -0,0 +1,69 @@
+package caddyrl
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// WAFScore shrinks the limit of keys whose requests a web application
+// firewall that runs before the handler, such as Coraza, found
+// suspicious but didn't block, so that such traffic is throttled harder
+// than clean traffic. The more a request's anomaly score exceeds the
+// threshold, the more events it counts as, which shrinks the key's
+// effective limit by the same factor.
+type WAFScore struct {
+	// A placeholder with the request's anomaly score, wherever the WAF
+	// exports it, e.g. `{http.vars.anomaly_score}`. Requests without a
+	// numeric score are clean. Required.
+	Score string `json:"score,omitempty"`
+
+	// The highest score of clean requests, which count as usual.
+	// Default: 0
+	Threshold float64 `json:"threshold,omitempty"`
+
+	// How much each point of the score above the threshold adds to the
+	// factor that a request's cost is multiplied by, which starts at 1;
+	// e.g. with a weight of 1, a request that scores 3 points above the
+	// threshold counts as 4 events, so its key gets a quarter of its
+	// limit. Default: 1
+	Weight float64 `json:"weight,omitempty"`
+
+	// The highest factor that a request's cost is multiplied by.
+	// Default: 10
+	MaxFactor int `json:"max_factor,omitempty"`
+
+	scoreTemplate keyTemplate
+}
+
+// provision sets the defaults and validates the coupling.
+func (ws *WAFScore) provision() error {
+	ws.scoreTemplate = newKeyTemplate(ws.Score)
+	if ws.scoreTemplate.static {
+		return fmt.Errorf("score must be a placeholder: '%s'", ws.Score)
+	}
+	if ws.Weight == 0 {
+		ws.Weight = 1
+	}
+	if ws.MaxFactor == 0 {
+		ws.MaxFactor = 10
+	}
+	if ws.Threshold < 0 || ws.Weight < 0 || ws.MaxFactor < 1 {
+		return fmt.Errorf("threshold and weight must be at least zero, and max_factor at least 1")
+	}
+	return nil
+}
+
+// factor returns what the cost of the request whose placeholders are in
+// repl is multiplied by.
+func (ws *WAFScore) factor(repl *caddy.Replacer) int {
+	score, err := strconv.ParseFloat(strings.TrimSpace(ws.scoreTemplate.key(repl)), 64)
+	if err != nil || !(score > ws.Threshold) {
+		return 1
+	}
+	factor := math.Ceil(1 + (score-ws.Threshold)*ws.Weight)
+	return int(min(factor, float64(ws.MaxFactor)))
+}
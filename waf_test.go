@@ -0,0 +1,100 @@
+package caddyrl
+
+import (
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestWAFScore(t *testing.T) {
+	ws := &WAFScore{Score: "{http.vars.anomaly_score}", Threshold: 2}
+	if err := ws.provision(); err != nil {
+		t.Fatal(err)
+	}
+	for score, want := range map[string]int{
+		"":      1,
+		"clean": 1,
+		"NaN":   1,
+		"0":     1,
+		"2":     1,
+		"2.5":   2,
+		" 5 ":   4,
+		"100":   10,
+	} {
+		repl := caddy.NewReplacer()
+		repl.Set("http.vars.anomaly_score", score)
+		if got := ws.factor(repl); got != want {
+			t.Errorf("score %q: expected factor %d, got %d", score, want, got)
+		}
+	}
+
+	for _, bad := range []*WAFScore{
+		{Score: "5"},
+		{Score: "{http.vars.anomaly_score}", Weight: -1},
+		{Score: "{http.vars.anomaly_score}", MaxFactor: -1},
+	} {
+		if err := bad.provision(); err == nil {
+			t.Errorf("expected an error for %+v", bad)
+		}
+	}
+}
+
+func TestWAFScoreLimit(t *testing.T) {
+	initTime()
+
+	rl := &RateLimit{
+		ZoneName:  "waf_zone",
+		Key:       "{http.request.remote.host}",
+		Window:    caddy.Duration(time.Minute),
+		MaxEvents: 8,
+		WAFScore:  &WAFScore{Score: "{http.vars.anomaly_score}"},
+	}
+	h := newTestHandler(t, rl)
+	allowed := func(host, score string) int {
+		t.Helper()
+		n := 0
+		for range 10 {
+			req := newTestRequest("GET", "/", map[string]string{
+				"http.request.remote.host": host,
+				"http.vars.anomaly_score":  score,
+			})
+			if allowedBy(t, h, req) {
+				n++
+			}
+		}
+		return n
+	}
+
+	if n := allowed("192.0.2.1", "0"); n != 8 {
+		t.Errorf("expected clean traffic to get the whole limit, got %d allowed", n)
+	}
+	if n := allowed("192.0.2.2", "3"); n != 2 {
+		t.Errorf("expected suspicious traffic to get a quarter of the limit, got %d allowed", n)
+	}
+	if n := allowed("192.0.2.3", "9"); n != 0 {
+		t.Errorf("expected requests that count as more than the limit to be declined, got %d allowed", n)
+	}
+}
+
+func TestCaddyfileWAFScore(t *testing.T) {
+	var h Handler
+	if err := h.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`rate_limit {
+		zone api {
+			events 100
+			window 1m
+			waf_score {http.vars.anomaly_score} {
+				threshold  2
+				weight     0.5
+				max_factor 4
+			}
+		}
+	}`)); err != nil {
+		t.Fatalf("unmarshaling Caddyfile: %v", err)
+	}
+	ws := h.RateLimits[0].WAFScore
+	if ws == nil || ws.Score != "{http.vars.anomaly_score}" || ws.Threshold != 2 || ws.Weight != 0.5 || ws.MaxFactor != 4 {
+		t.Errorf("unexpected waf_score: %+v", ws)
+	}
+}
@@ -0,0 +1,80 @@
+package caddyrl
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// WarmUp ramps a zone's event limits up from a fraction of their value
+// after a cold start, i.e. when the zone starts without state, as after
+// a restart or deploy. Otherwise every client gets a fresh, full quota at
+// the same moment, and their pent-up requests hit the backend at once.
+// Zones that keep their state across a config reload don't warm up.
+type WarmUp struct {
+	// Factor by which the zone's event limits are multiplied at the
+	// start, between 0 and 1. Default: 0.1
+	Factor float64 `json:"factor,omitempty"`
+
+	// Duration over which the limits ramp up from the factor to their
+	// full value. Required.
+	Duration caddy.Duration `json:"duration,omitempty"`
+}
+
+// provision sets the defaults and validates the warm-up.
+func (wu *WarmUp) provision() error {
+	if wu.Factor == 0 {
+		wu.Factor = 0.1
+	}
+	if wu.Factor < 0 || wu.Factor > 1 {
+		return fmt.Errorf("factor must be between 0 and 1")
+	}
+	if wu.Duration <= 0 {
+		return fmt.Errorf("duration must be greater than zero")
+	}
+	return nil
+}
+
+// zoneWarmUp is the running warm-up of a zone.
+type zoneWarmUp struct {
+	from     float64
+	factor   float64
+	duration time.Duration
+}
+
+// warmUpSteps is the number of steps in which limits warm up.
+const warmUpSteps = 20
+
+// startWarmUp scales the zone's event limits by factor, and raises them
+// to their full value over duration. Like clamps, warm-ups outlast
+// config reloads.
+func (rlm *rateLimitersMap) startWarmUp(factor float64, duration time.Duration) {
+	wu := &zoneWarmUp{from: factor, duration: duration}
+	rlm.limitersMu.Lock()
+	rlm.warmUp = wu
+	rlm.limitersMu.Unlock()
+
+	rlm.warmUpStep(wu, 0)
+}
+
+// warmUpStep sets the factor of step of the warm-up and schedules the
+// next step, or ends the warm-up after the last step, unless another
+// warm-up started meanwhile.
+func (rlm *rateLimitersMap) warmUpStep(wu *zoneWarmUp, step int) {
+	rlm.limitersMu.Lock()
+	if rlm.warmUp != wu {
+		rlm.limitersMu.Unlock()
+		return
+	}
+	if step >= warmUpSteps {
+		rlm.warmUp = nil
+	} else {
+		wu.factor = wu.from + (1-wu.from)*float64(step)/warmUpSteps
+		time.AfterFunc(wu.duration/warmUpSteps, func() { rlm.warmUpStep(wu, step+1) })
+	}
+	maxEvents, window := rlm.configuredLimits()
+	rlm.limitersMu.Unlock()
+
+	rlm.updateAll(maxEvents, window)
+}
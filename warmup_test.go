@@ -0,0 +1,57 @@
+package caddyrl
+
+import (
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestWarmUp(t *testing.T) {
+	rl := &RateLimit{
+		Window:    caddy.Duration(time.Minute),
+		MaxEvents: 100,
+		WarmUp:    &WarmUp{Duration: caddy.Duration(time.Hour)},
+	}
+	if err := rl.provision(caddy.Context{}, "warm_up_zone"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _, _ = rateLimits.Delete("warm_up_zone") })
+	rlm := rl.limitersMap
+
+	// a cold zone starts at the factor
+	if maxEvents, _ := rlm.limits(); maxEvents != 10 {
+		t.Fatalf("expected cold zone to start at 10 events, got %d", maxEvents)
+	}
+
+	// and ramps up step by step
+	rlm.limitersMu.Lock()
+	wu := rlm.warmUp
+	rlm.limitersMu.Unlock()
+	rlm.warmUpStep(wu, warmUpSteps/2)
+	if maxEvents, _ := rlm.limits(); maxEvents != 55 {
+		t.Fatalf("expected zone halfway through warm-up at 55 events, got %d", maxEvents)
+	}
+	rlm.warmUpStep(wu, warmUpSteps)
+	if maxEvents, _ := rlm.limits(); maxEvents != 100 {
+		t.Fatalf("expected warm zone at 100 events, got %d", maxEvents)
+	}
+
+	// zones that keep their state don't warm up again
+	reloaded := &RateLimit{
+		Window:    caddy.Duration(time.Minute),
+		MaxEvents: 100,
+		WarmUp:    &WarmUp{Duration: caddy.Duration(time.Hour)},
+	}
+	if err := reloaded.provision(caddy.Context{}, "warm_up_zone"); err != nil {
+		t.Fatal(err)
+	}
+	if maxEvents, _ := rlm.limits(); maxEvents != 100 {
+		t.Fatalf("expected reloaded zone to stay at 100 events, got %d", maxEvents)
+	}
+
+	invalid := &RateLimit{Window: caddy.Duration(time.Minute), MaxEvents: 1, WarmUp: &WarmUp{}}
+	if err := invalid.provision(caddy.Context{}, "invalid_warm_up_zone"); err == nil {
+		t.Error("expected an error for a warm-up without duration")
+	}
+}
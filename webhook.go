@@ -0,0 +1,208 @@
+package caddyrl
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// WebhookNotifier POSTs a JSON payload to a URL when a key is declined
+// repeatedly or banned, so that external abuse tooling hears about
+// offenders in near real time. Notifications are batched, and failed
+// deliveries are retried with exponential backoff. If the notifier falls
+// behind, new notifications are dropped rather than slowing down requests.
+type WebhookNotifier struct {
+	// The URL to POST notifications to. Required.
+	URL string `json:"url,omitempty"`
+
+	// Number of declined requests for a key, within one flush interval,
+	// after which a notification is sent. Default: 1
+	DeclineThreshold int `json:"decline_threshold,omitempty"`
+
+	// How often batched notifications are sent. Default: 5s
+	FlushInterval caddy.Duration `json:"flush_interval,omitempty"`
+
+	// Maximum number of notifications in a batch; a full batch is sent
+	// right away. Default: 100
+	MaxBatchSize int `json:"max_batch_size,omitempty"`
+
+	// Maximum number of delivery attempts for a batch. Default: 5
+	MaxAttempts int `json:"max_attempts,omitempty"`
+
+	client *http.Client
+	queue  chan webhookNotification
+	logger *zap.Logger
+}
+
+// webhookNotification is a single entry of a webhook payload.
+type webhookNotification struct {
+	Event    string    `json:"event"`
+	Zone     string    `json:"zone"`
+	Key      string    `json:"key"`
+	RemoteIP string    `json:"remote_ip,omitempty"`
+	Declines int       `json:"declines,omitempty"`
+	Expires  time.Time `json:"expires,omitzero"`
+	Time     time.Time `json:"time"`
+}
+
+// webhookPayload is the body POSTed to the webhook URL.
+type webhookPayload struct {
+	Notifications []webhookNotification `json:"notifications"`
+}
+
+func (wn *WebhookNotifier) provision(ctx caddy.Context, logger *zap.Logger) error {
+	if wn.URL == "" {
+		return fmt.Errorf("url is required")
+	}
+	if wn.DeclineThreshold < 0 {
+		return fmt.Errorf("decline_threshold must be at least zero")
+	}
+	if wn.DeclineThreshold == 0 {
+		wn.DeclineThreshold = 1
+	}
+	if wn.FlushInterval == 0 {
+		wn.FlushInterval = caddy.Duration(5 * time.Second)
+	}
+	if wn.MaxBatchSize == 0 {
+		wn.MaxBatchSize = 100
+	}
+	if wn.MaxAttempts == 0 {
+		wn.MaxAttempts = 5
+	}
+
+	wn.client = &http.Client{Timeout: 10 * time.Second}
+	wn.queue = make(chan webhookNotification, 1024)
+	wn.logger = logger.With(zap.String("webhook", wn.URL))
+
+	go wn.run(ctx)
+
+	return nil
+}
+
+// observe queues a notification for the given event, if it is one
+// the notifier cares about. It never blocks.
+func (wn *WebhookNotifier) observe(name string, data map[string]any) {
+	if name != eventDeny && name != eventBan {
+		return
+	}
+
+	n := webhookNotification{Event: name, Time: now()}
+	n.Zone, _ = data["zone"].(string)
+	n.Key, _ = data["key"].(string)
+	n.RemoteIP, _ = data["remote_ip"].(string)
+	n.Expires, _ = data["expires"].(time.Time)
+
+	select {
+	case wn.queue <- n:
+	default:
+		wn.logger.Warn("webhook queue is full; dropping notification",
+			zap.String("event", name),
+			zap.String("zone", n.Zone))
+	}
+}
+
+// run batches queued notifications and sends them until ctx is done.
+func (wn *WebhookNotifier) run(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(wn.FlushInterval))
+	defer ticker.Stop()
+
+	var batch []webhookNotification
+	declines := make(map[string]int)
+
+	for {
+		select {
+		case n := <-wn.queue:
+			if n.Event == eventDeny {
+				// only notify once a key reaches the threshold
+				id := n.Zone + "\x00" + n.Key
+				declines[id]++
+				if declines[id] != wn.DeclineThreshold {
+					continue
+				}
+				n.Declines = declines[id]
+			}
+			batch = append(batch, n)
+			if len(batch) >= wn.MaxBatchSize {
+				wn.send(ctx, batch)
+				batch = nil
+			}
+
+		case <-ticker.C:
+			if len(batch) > 0 {
+				wn.send(ctx, batch)
+				batch = nil
+			}
+			clear(declines)
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// send delivers a batch, retrying with exponential backoff.
+func (wn *WebhookNotifier) send(ctx context.Context, batch []webhookNotification) {
+	body, err := json.Marshal(webhookPayload{Notifications: batch})
+	if err != nil {
+		wn.logger.Error("encoding webhook payload", zap.Error(err))
+		return
+	}
+
+	backoff := webhookBackoff
+	for attempt := 1; ; attempt++ {
+		err = wn.post(ctx, body)
+		if err == nil {
+			return
+		}
+		if attempt >= wn.MaxAttempts {
+			wn.logger.Error("giving up on webhook delivery",
+				zap.Int("attempts", attempt),
+				zap.Int("notifications", len(batch)),
+				zap.Error(err))
+			return
+		}
+
+		wn.logger.Warn("webhook delivery failed; retrying",
+			zap.Int("attempt", attempt),
+			zap.Duration("backoff", backoff),
+			zap.Error(err))
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+		backoff *= 2
+	}
+}
+
+func (wn *WebhookNotifier) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wn.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := wn.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return nil
+}
+
+// Initial delay before retrying a failed webhook delivery,
+// to be substituted by tests
+var webhookBackoff = time.Second
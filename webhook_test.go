@@ -0,0 +1,75 @@
+package caddyrl
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func TestWebhookNotifier(t *testing.T) {
+	initTime()
+	webhookBackoff = time.Millisecond
+
+	var attempts atomic.Int32
+	payloads := make(chan webhookPayload, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// fail the first delivery to exercise retries
+		if attempts.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var payload webhookPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("decoding payload: %v", err)
+		}
+		payloads <- payload
+	}))
+	defer server.Close()
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	wn := &WebhookNotifier{
+		URL:              server.URL,
+		DeclineThreshold: 3,
+		FlushInterval:    caddy.Duration(time.Hour),
+		MaxBatchSize:     2,
+	}
+	if err := wn.provision(ctx, zap.NewNop()); err != nil {
+		t.Fatalf("provisioning notifier: %v", err)
+	}
+
+	// two declines are below the threshold, the third one is reported
+	for i := 0; i < 3; i++ {
+		wn.observe(eventDeny, map[string]any{"zone": "zone1", "key": "abuser", "remote_ip": "10.0.0.1"})
+	}
+	wn.observe(eventNearLimit, map[string]any{"zone": "zone1", "key": "other"})
+	wn.observe(eventBan, map[string]any{"zone": "zone1", "key": "abuser", "expires": now().Add(time.Minute)})
+
+	select {
+	case payload := <-payloads:
+		if len(payload.Notifications) != 2 {
+			t.Fatalf("expected 2 notifications, got %+v", payload.Notifications)
+		}
+		deny, ban := payload.Notifications[0], payload.Notifications[1]
+		if deny.Event != eventDeny || deny.Key != "abuser" || deny.Declines != 3 || deny.RemoteIP != "10.0.0.1" {
+			t.Fatalf("unexpected deny notification: %+v", deny)
+		}
+		if ban.Event != eventBan || !ban.Expires.Equal(now().Add(time.Minute)) {
+			t.Fatalf("unexpected ban notification: %+v", ban)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for webhook delivery")
+	}
+
+	if n := attempts.Load(); n != 2 {
+		t.Fatalf("expected 2 delivery attempts, got %d", n)
+	}
+}
@@ -0,0 +1,217 @@
+package caddyrl
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// WebSocketLimit limits the messages that clients send over WebSocket
+// connections, which the limits of HTTP requests don't see once a
+// connection is upgraded. Only connections upgraded over HTTP/1.1 are
+// limited.
+type WebSocketLimit struct {
+	// The zone in which messages are limited. Every message that a
+	// client sends is an event of the key of its upgrade request, and
+	// the zone's matchers select the upgrade requests whose connections
+	// are limited. Control frames (ping, pong, close) are not counted.
+	Zone *RateLimit `json:"zone,omitempty"`
+
+	// If true, messages that exceed the limit are delayed until they are
+	// within it, which slows the client down. Otherwise, the connection
+	// is closed.
+	Throttle bool `json:"throttle,omitempty"`
+
+	logger  *zap.Logger
+	metrics *metricsCollector
+}
+
+// provision sets up the limit for the handler h.
+func (wl *WebSocketLimit) provision(ctx caddy.Context, app *RateLimitApp, h *Handler) error {
+	rl := wl.Zone
+	if rl == nil {
+		return fmt.Errorf("zone is missing")
+	}
+	if rl.ZoneName == "" {
+		return fmt.Errorf("zone_name is empty or missing")
+	}
+	if !newKeyTemplate(rl.ZoneName).static {
+		return fmt.Errorf("zone %s: zone name cannot have placeholders", rl.ZoneName)
+	}
+	if rl.Policy != "" {
+		policy, ok := app.Policies[rl.Policy]
+		if !ok {
+			return fmt.Errorf("zone %s: unknown policy '%s'", rl.ZoneName, rl.Policy)
+		}
+		rl.inherit(policy)
+	}
+	if err := app.registerZone(rl); err != nil {
+		return err
+	}
+	if _, err := unknownPlaceholders(rl.Key); err != nil {
+		return fmt.Errorf("zone %s: invalid key '%s': %v", rl.ZoneName, rl.Key, err)
+	}
+	if err := rl.provision(ctx, rl.ZoneName); err != nil {
+		return fmt.Errorf("setting up zone %s: %v", rl.ZoneName, err)
+	}
+	h.setUpZone(rl)
+	wl.logger = h.logger
+	wl.metrics = h.metrics
+	return nil
+}
+
+// wrap returns w wrapped so that, if r upgrades the connection to
+// WebSocket and matches the limit's zone, the messages that the client
+// sends after the upgrade are limited.
+func (wl *WebSocketLimit) wrap(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return w
+	}
+	if matched, err := wl.Zone.matcherSets.AnyMatchWithError(r); err != nil || !matched {
+		return w
+	}
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	return &webSocketLimitWriter{
+		ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w},
+		limit:                 wl,
+		key:                   wl.Zone.keyFor(r, repl),
+		remoteIP:              remoteIPOf(r),
+	}
+}
+
+// allow reserves an event for a message of key. If the message exceeds
+// the limit, it waits until the message is within it if throttling, and
+// otherwise returns false.
+func (wl *WebSocketLimit) allow(key, remoteIP string) bool {
+	rlm := wl.Zone.limitersMap
+	for {
+		wait := rlm.whenKey(key)
+		if wait == 0 {
+			return true
+		}
+		wl.metrics.recordDeclinedRequest(context.Background(), wl.Zone.ZoneName, "", key)
+		if !wl.Throttle {
+			wl.logger.Info("websocket message rate limit exceeded; closing connection",
+				zap.String("zone", wl.Zone.ZoneName),
+				zap.String("remote_ip", remoteIP),
+			)
+			return false
+		}
+		time.Sleep(wait)
+	}
+}
+
+// webSocketLimitWriter limits the messages of the connection that
+// it is hijacked for.
+type webSocketLimitWriter struct {
+	*caddyhttp.ResponseWriterWrapper
+	limit    *WebSocketLimit
+	key      string
+	remoteIP string
+}
+
+// Hijack hijacks the connection and returns it wrapped, so that the
+// messages read from it are limited.
+func (w *webSocketLimitWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	limitedConn := &webSocketLimitConn{Conn: conn, writer: w}
+
+	// frames that were read ahead are passed on by whoever hijacked the
+	// connection, so they are counted, but can't be limited
+	if buffered := brw.Reader.Buffered(); buffered > 0 {
+		peeked, _ := brw.Reader.Peek(buffered)
+		limitedConn.frames.messages(peeked)
+	}
+	return limitedConn, brw, nil
+}
+
+// webSocketLimitConn is a connection whose incoming WebSocket messages
+// are limited.
+type webSocketLimitConn struct {
+	net.Conn
+	writer *webSocketLimitWriter
+	frames frameReader
+}
+
+func (c *webSocketLimitConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	for range c.frames.messages(p[:n]) {
+		if !c.writer.limit.allow(c.writer.key, c.writer.remoteIP) {
+			c.Conn.Close()
+			return 0, net.ErrClosed
+		}
+	}
+	return n, err
+}
+
+// frameReader follows the frames of a WebSocket stream to count the
+// messages in it, without buffering their payloads.
+type frameReader struct {
+	header    [14]byte // the longest frame header
+	headerLen int      // bytes of header read so far
+	payload   uint64   // bytes left of the current frame's payload
+}
+
+// messages reads the next bytes of the stream and returns the number of
+// messages that were completed by them. A message is completed by a data
+// frame with the FIN bit.
+func (fr *frameReader) messages(p []byte) int {
+	var messages int
+	for len(p) > 0 {
+		// skip the payload of the current frame
+		if fr.payload > 0 {
+			skip := min(fr.payload, uint64(len(p)))
+			fr.payload -= skip
+			p = p[skip:]
+			continue
+		}
+
+		// read the frame header
+		fr.header[fr.headerLen] = p[0]
+		fr.headerLen++
+		p = p[1:]
+		if fr.headerLen < 2 {
+			continue
+		}
+		need := 2
+		switch fr.header[1] & 0x7f {
+		case 126:
+			need += 2
+		case 127:
+			need += 8
+		}
+		if fr.header[1]&0x80 != 0 {
+			need += 4 // masking key
+		}
+		if fr.headerLen < need {
+			continue
+		}
+
+		switch length := fr.header[1] & 0x7f; length {
+		case 126:
+			fr.payload = uint64(binary.BigEndian.Uint16(fr.header[2:4]))
+		case 127:
+			fr.payload = binary.BigEndian.Uint64(fr.header[2:10])
+		default:
+			fr.payload = uint64(length)
+		}
+		fin, opcode := fr.header[0]&0x80 != 0, fr.header[0]&0x0f
+		if fin && opcode < 0x8 {
+			messages++
+		}
+		fr.headerLen = 0
+	}
+	return messages
+}
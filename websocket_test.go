@@ -0,0 +1,33 @@
+package caddyrl
+
+import (
+	"testing"
+)
+
+func TestFrameReader(t *testing.T) {
+	// a masked text message, an unmasked binary message with a 16-bit
+	// length, a ping, and a message fragmented in two frames
+	var stream []byte
+	stream = append(stream, 0x81, 0x85, 1, 2, 3, 4, 'h', 'e', 'l', 'l', 'o')
+	stream = append(stream, 0x82, 126, 0x01, 0x00)
+	stream = append(stream, make([]byte, 256)...)
+	stream = append(stream, 0x89, 0x80, 1, 2, 3, 4)
+	stream = append(stream, 0x01, 0x81, 1, 2, 3, 4, 'a', 0x80, 0x81, 1, 2, 3, 4, 'b')
+
+	var fr frameReader
+	if messages := fr.messages(stream); messages != 3 {
+		t.Fatalf("expected 3 messages, got %d", messages)
+	}
+
+	// messages are counted no matter how the stream is split
+	for _, size := range []int{1, 3, 7} {
+		var fr frameReader
+		var messages int
+		for i := 0; i < len(stream); i += size {
+			messages += fr.messages(stream[i:min(i+size, len(stream))])
+		}
+		if messages != 3 {
+			t.Errorf("reading %d bytes at a time: expected 3 messages, got %d", size, messages)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package caddyrl
+
+import (
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// ZoneLog gives a zone a logger of its own, so that its logs can be
+// routed and filtered apart from those of other zones, e.g. to keep a
+// noisy experimental zone from drowning the logs of production zones.
+// The zone logs its decisions at debug level, declined requests at info
+// level and bans at warn level.
+type ZoneLog struct {
+	// The name of the zone's logger, below `http.handlers.rate_limit`.
+	// Default: `zones.<zone>`
+	Name string `json:"name,omitempty"`
+
+	// The lowest level that is logged: `debug`, `info`, `warn` or
+	// `error`. Entries must also pass the level of the log they are
+	// written to, so debug entries need a log at debug level.
+	// Default: the level of the log
+	Level string `json:"level,omitempty"`
+
+	logger *zap.Logger
+	logKey bool // whether entries contain the key; see Handler.LogKey
+}
+
+func (zl *ZoneLog) provision(logger *zap.Logger, zoneName string) error {
+	if zl.Name == "" {
+		zl.Name = "zones." + zoneName
+	}
+	logger = logger.Named(zl.Name)
+	switch zl.Level {
+	case "":
+	case "debug", "info", "warn", "error":
+		level, err := zapcore.ParseLevel(zl.Level)
+		if err != nil {
+			return err
+		}
+		// zap refuses to go below the log's own level, which filters the
+		// entries anyway
+		if logger.Core().Enabled(level) {
+			logger = logger.WithOptions(zap.IncreaseLevel(level))
+		}
+	default:
+		return fmt.Errorf("unknown level '%s'", zl.Level)
+	}
+	zl.logger = logger
+	return nil
+}
+
+// allowed logs that zone allowed an event of key, if the zone has a log.
+func (zl *ZoneLog) allowed(zone, key string, remaining int) {
+	if zl == nil {
+		return
+	}
+	if ce := zl.logger.Check(zapcore.DebugLevel, "rate limit allowed"); ce != nil {
+		ce.Write(zl.fields(zone, key, zap.Int("remaining", remaining))...)
+	}
+}
+
+// banned logs that key was banned in zone until then, for reason, if the
+// zone has a log.
+func (zl *ZoneLog) banned(zone, key string, until time.Time, reason string) {
+	if zl == nil {
+		return
+	}
+	zl.logger.Warn("key banned", zl.fields(zone, key,
+		zap.Time("until", until),
+		zap.String("reason", reason),
+	)...)
+}
+
+// fields returns the fields of an entry about key in zone.
+func (zl *ZoneLog) fields(zone, key string, fields ...zap.Field) []zap.Field {
+	fields = append([]zap.Field{zap.String("zone", zone)}, fields...)
+	if zl.logKey {
+		fields = append(fields, zap.String("key", key))
+	}
+	return fields
+}
@@ -0,0 +1,116 @@
+package caddyrl
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestZoneLog(t *testing.T) {
+	initTime()
+
+	rl := &RateLimit{
+		ZoneName:  "zone_log_zone",
+		Key:       "static",
+		Window:    caddy.Duration(time.Minute),
+		MaxEvents: 1,
+	}
+	h := newTestHandler(t, rl)
+
+	core, logs := observer.New(zap.DebugLevel)
+	rl.Log = new(ZoneLog)
+	if err := rl.Log.provision(zap.New(core), rl.ZoneName); err != nil {
+		t.Fatal(err)
+	}
+	next := caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error { return nil })
+	serve := func() error {
+		req := newTestRequest("GET", "/", nil)
+		return h.ServeHTTP(httptest.NewRecorder(), req, next)
+	}
+
+	if err := serve(); err != nil {
+		t.Fatal(err)
+	}
+	if err := serve(); !isDeclined(err) {
+		t.Fatalf("expected the second request to be declined, got %v", err)
+	}
+	entries := logs.All()
+	if len(entries) != 2 || entries[0].Message != "rate limit allowed" || entries[1].Message != "rate limit exceeded" {
+		t.Fatalf("expected the decision and the decline in the zone's log, got %+v", entries)
+	}
+	if entries[0].LoggerName != "zones.zone_log_zone" || entries[0].Level != zap.DebugLevel || entries[1].Level != zap.InfoLevel {
+		t.Errorf("unexpected logger or levels: %s %s %s", entries[0].LoggerName, entries[0].Level, entries[1].Level)
+	}
+	if _, ok := entries[0].ContextMap()["key"]; ok {
+		t.Error("expected no key without log_key")
+	}
+
+	// at warn level, only bans are logged
+	core, logs = observer.New(zap.DebugLevel)
+	zl := &ZoneLog{Name: "experimental", Level: "warn", logKey: true}
+	if err := zl.provision(zap.New(core), rl.ZoneName); err != nil {
+		t.Fatal(err)
+	}
+	zl.allowed(rl.ZoneName, "static", 0)
+	zl.banned(rl.ZoneName, "static", now().Add(time.Minute), "retry_storm")
+	entries = logs.All()
+	if len(entries) != 1 || entries[0].LoggerName != "experimental" || entries[0].Message != "key banned" {
+		t.Fatalf("expected only the ban to be logged, got %+v", entries)
+	}
+	if fields := entries[0].ContextMap(); fields["key"] != "static" || fields["reason"] != "retry_storm" {
+		t.Errorf("unexpected ban fields: %v", fields)
+	}
+
+	// a level below the log's own is not an error
+	infoCore, _ := observer.New(zap.InfoLevel)
+	if err := (&ZoneLog{Level: "debug"}).provision(zap.New(infoCore), rl.ZoneName); err != nil {
+		t.Errorf("expected a debug level to be accepted, got %v", err)
+	}
+	if err := (&ZoneLog{Level: "verbose"}).provision(zap.NewNop(), rl.ZoneName); err == nil {
+		t.Error("expected an error for an unknown level")
+	}
+}
+
+func TestCaddyfileZoneLog(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`
+	rate_limit {
+		zone experimental {
+			key    {http.request.remote.host}
+			window 1m
+			events 100
+			log {
+				name  rate_limit.experimental
+				level debug
+			}
+		}
+	}`)
+
+	var h Handler
+	if err := h.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshaling Caddyfile: %v", err)
+	}
+	if zl := h.RateLimits[0].Log; zl == nil || zl.Name != "rate_limit.experimental" || zl.Level != "debug" {
+		t.Errorf("unexpected zone log: %+v", zl)
+	}
+
+	var bad Handler
+	if err := bad.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`rate_limit {
+		zone experimental {
+			key    static
+			window 1m
+			events 100
+			log {
+				format json
+			}
+		}
+	}`)); err == nil {
+		t.Error("expected an error for an unknown log option")
+	}
+}